@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"examples/config"
+	"examples/errorlog"
+	"examples/errs"
+	"examples/health"
+	"examples/metrics"
+	"examples/tasks"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminRoutes builds the router for our admin/ops listener. Everything served here is operational (metrics, health
+// checks, profiling, admin endpoints) and is served on a separate port from the public API, so these surfaces are never
+// exposed through the public load balancer. Only make this port reachable from inside your network.
+func (s *server) adminRoutes() http.Handler {
+	router := mux.NewRouter()
+	router.Use(requestID, s.traceRequests)
+
+	// Prometheus scrapes this endpoint to collect our metrics
+	router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+
+	// Liveness check, if this doesn't respond the process is stuck and should be restarted
+	router.HandleFunc("/healthz", s.healthz).Methods(http.MethodGet)
+	// Readiness check, reports whether we're able to serve traffic (e.g. our database is reachable)
+	router.HandleFunc("/readyz", s.readyz).Methods(http.MethodGet)
+
+	// Go's built in profiler, incredibly useful for tracking down CPU or memory problems in a running service.
+	// We register these by hand as importing net/http/pprof normally registers them on http.DefaultServeMux
+	router.HandleFunc("/debug/pprof/", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// Any other named profiles (heap, goroutine, etc) are served by pprof.Index
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	// Admin endpoints, these can do much more than the rest of this listener so also require our admin token
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.adminAuth, s.validateSchemas)
+	// Watch our logs and requests live, over a WebSocket
+	admin.HandleFunc("/logs/stream", s.streamLogs).Methods(http.MethodGet)
+	// Our most recent server side errors, for quick triage
+	admin.HandleFunc("/errors", s.recentErrors).Methods(http.MethodGet)
+	// Merge duplicate accounts, such as after importing users that already had accounts
+	admin.HandleFunc("/users/{a}/merge/{b}", s.userMerge).Methods(http.MethodPost)
+	// Create users who log in with a password, users can also sign themselves up through an OAuth provider
+	admin.HandleFunc("/users/", s.userAdd).Methods(http.MethodPost)
+	// Delete users, the rest of their data is cleaned up in the background and its progress can be checked on
+	admin.HandleFunc("/users/{username}", s.userDelete).Methods(http.MethodDelete)
+	admin.HandleFunc("/deletions/{id}", s.userDeletion).Methods(http.MethodGet)
+	// Promoting and demoting admins is on our public API too (for admins), it's here so the first admin can be promoted
+	admin.HandleFunc("/users/{username}/admin", s.userPromote).Methods(http.MethodPut)
+	admin.HandleFunc("/users/{username}/admin", s.userDemote).Methods(http.MethodDelete)
+	// Unlock users who have been locked out after too many failed logins
+	admin.HandleFunc("/users/{username}/lock", s.userUnlock).Methods(http.MethodDelete)
+	// Dealership memberships decide which users can see each other on the public API, so for now they're managed here
+	admin.HandleFunc("/users/{username}/dealership/{cid}", s.userAddToDealership).Methods(http.MethodPut)
+	admin.HandleFunc("/users/{username}/dealership/{cid}", s.userRemoveFromDealership).Methods(http.MethodDelete)
+	// Revoke sessions in bulk, such as everyone who logged in from a network we've found to be compromised
+	admin.HandleFunc("/sessions/revoke", s.revokeSessions).Methods(http.MethodPost)
+	// Or a single session, such as one a User has reported as not theirs
+	admin.HandleFunc("/sessions/{id}", s.expireSession).Methods(http.MethodDelete)
+	// Check on our background tasks, and run them on demand
+	admin.HandleFunc("/tasks", s.listTasks).Methods(http.MethodGet)
+	admin.HandleFunc("/tasks/{name}/run", s.runTask).Methods(http.MethodPost)
+	// Our effective configuration, with secrets redacted
+	admin.HandleFunc("/config", s.showConfig).Methods(http.MethodGet)
+	// Export our security event log for a SIEM, and check its hash chain hasn't been tampered with
+	admin.HandleFunc("/security-events", s.exportSecurityEvents).Methods(http.MethodGet)
+	admin.HandleFunc("/security-events/verify", s.verifySecurityEvents).Methods(http.MethodGet)
+	// Login successes, failures and lockouts over time, for security dashboards
+	admin.HandleFunc("/metrics/logins", s.loginStats).Methods(http.MethodGet)
+	// Our domain events, so other services following our data can catch up after missing some (see cmd/events)
+	admin.HandleFunc("/events", s.listDomainEvents).Methods(http.MethodGet)
+	// Settings tenants (dealerships) have overridden for their members, such as shorter sessions or longer passwords
+	admin.HandleFunc("/tenants/", s.listTenantSettings).Methods(http.MethodGet)
+	admin.HandleFunc("/tenants/{id}", s.getTenantSettings).Methods(http.MethodGet)
+	admin.HandleFunc("/tenants/{id}", s.saveTenantSettings).Methods(http.MethodPut)
+	admin.HandleFunc("/tenants/{id}", s.deleteTenantSettings).Methods(http.MethodDelete)
+	// How much of our traffic is traced, which can be turned up for a while when looking into a problem
+	admin.HandleFunc("/tracing/sampling", s.showSampling).Methods(http.MethodGet)
+	admin.HandleFunc("/tracing/sampling/{group}", s.overrideSampling).Methods(http.MethodPut)
+	admin.HandleFunc("/tracing/sampling/{group}", s.removeSamplingOverride).Methods(http.MethodDelete)
+
+	return router
+}
+
+// adminAuth only lets requests through that carry our admin token as a bearer token, rejecting everything if we don't
+// have one configured.
+func (s *server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			s.writeError(w, r, errs.New(errs.Forbidden, "admin endpoints are disabled, set ADMIN_TOKEN to enable them"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// Compare in constant time, so the time taken doesn't reveal how much of the token was right
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			s.writeError(w, r, errs.New(errs.Unauthorized, "a valid admin token is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthz simply returns a 200 status, if we're able to respond at all then we're alive.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {}
+
+// readyzResponse describes whether we're ready to serve traffic, and the state of each of our dependencies.
+type readyzResponse struct {
+	Ready     bool            `json:"ready"`
+	WarmingUp bool            `json:"warmingUp,omitempty"` // We're still warming up, and won't be ready until we're done
+	Checks    []health.Report `json:"checks"`
+}
+
+// readyz returns a 200 status if all our dependencies are reachable, or a 503 status if we can't currently serve traffic.
+// We're also not ready while warming up after starting (see warm). Our dependencies are checked in the background, so
+// this is cheap to call as often as a load balancer likes. Add ?verbose=1 to include the recent history of each check,
+// which shows whether a dependency is flapping or hard down.
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	resp := readyzResponse{
+		WarmingUp: s.warming.Load(),
+		Checks:    s.health.Reports(r.URL.Query().Get("verbose") == "1"),
+	}
+	resp.Ready = s.health.Ready() && !resp.WarmingUp
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeJSON(w, r, status, resp)
+}
+
+// recentErrorsResponse lists our most recent errors, newest first. Total counts every error since we started, so
+// comparing it between calls shows how many have happened in between.
+type recentErrorsResponse struct {
+	Total  uint64            `json:"total"`
+	Errors []errorlog.Record `json:"errors"`
+}
+
+// recentErrors returns our most recent server side errors, add ?limit=n to only return the n newest (Default all).
+func (s *server) recentErrors(w http.ResponseWriter, r *http.Request) {
+	if s.errorLog == nil {
+		s.writeError(w, r, errs.New(errs.NotFound, "error tracking is not enabled"))
+		return
+	}
+	limit := math.MaxInt
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.writeError(w, r, errs.New(errs.Invalid, "limit must be a positive number"))
+			return
+		}
+		limit = n
+	}
+	var resp recentErrorsResponse
+	resp.Errors, resp.Total = s.errorLog.Recent(limit)
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// tasksResponse lists our background tasks.
+type tasksResponse struct {
+	Tasks []tasks.Status `json:"tasks"`
+}
+
+// listTasks lists each of our background tasks, when it last ran and how that went, and when it will next run.
+func (s *server) listTasks(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, tasksResponse{Tasks: s.tasks.Statuses()})
+}
+
+// runTask runs the background task in the {name} path parameter straight away, rather than waiting for its next turn.
+// The task runs in the background, so this responds with 202 Accepted without waiting for it, check on it with
+// listTasks.
+func (s *server) runTask(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := s.tasks.Trigger(name); errors.Is(err, tasks.ErrUnknown) {
+		s.writeError(w, r, errs.New(errs.NotFound, "no task with that name"))
+		return
+	}
+	s.audit(r, "task.run", 0, name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// configResponse is our effective configuration, with secrets redacted.
+type configResponse struct {
+	Loaded time.Time     `json:"loaded"` // When this configuration was read, at startup or our last reload
+	Config config.Config `json:"config"`
+}
+
+// showConfig shows the configuration we're running with, after defaults have been filled in and any reloads applied,
+// with every secret redacted. Handy for checking a reload (or deploy) changed what was intended.
+func (s *server) showConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, loaded := s.config.Loaded()
+	s.writeJSON(w, r, http.StatusOK, configResponse{Loaded: loaded, Config: cfg.Redacted()})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiTokenPrefix starts every API token, so our auth middleware can tell them apart from session tokens and JWTs
+// without a database lookup, and so a leaked one is easy to spot (such as by secret scanners).
+const apiTokenPrefix = "pat_"
+
+// apiTokenDefaultLifetime is how long an API token lasts when its User doesn't say, and apiTokenMaxLifetime is the
+// longest they may ask for. Tokens living in CI settings tend to be forgotten, so none last forever.
+const (
+	apiTokenDefaultLifetime = 30 * 24 * time.Hour
+	apiTokenMaxLifetime     = 365 * 24 * time.Hour
+)
+
+// maxAPITokens is how many API tokens (expired or not) a User may have at once. They can delete old ones to make room.
+const maxAPITokens = 20
+
+// maxAPITokenName is the longest name an API token may have, in characters.
+const maxAPITokenName = 100
+
+// apiTokenRequest is the body expected when creating an API token.
+type apiTokenRequest struct {
+	Name          string   `json:"name"`                    // So the User can tell their tokens apart, such as "CI deploys"
+	Scopes        []string `json:"scopes"`                  // Permissions the token has (see authz.go), at least one
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // Defaults to 30 days, up to a year
+}
+
+// apiTokenResponse describes an API token. The token itself is only returned once, when it's created, as we only keep
+// its hash.
+type apiTokenResponse struct {
+	ID       int64      `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"` // Missing if the token has never been used
+	Token    string     `json:"token,omitempty"`    // Only when created
+}
+
+// newAPITokenResponse describes an API token for clients.
+func newAPITokenResponse(token database.APIToken) apiTokenResponse {
+	resp := apiTokenResponse{
+		ID:      token.ID,
+		Name:    token.Name,
+		Scopes:  token.Scopes,
+		Created: token.Created,
+		Expires: token.Expires,
+	}
+	if resp.Scopes == nil {
+		resp.Scopes = []string{}
+	}
+	if !token.LastUsed.IsZero() {
+		resp.LastUsed = &token.LastUsed
+	}
+	return resp
+}
+
+// apiTokens returns middleware letting scripts and CI authenticate with an API token as a bearer token, in place of
+// the session (or JWT) our auth middleware expects. Anything else is handed on to auth. Like auth it leaves the User
+// in the request context, along with the token, so authorize can limit the request to the token's scopes.
+//
+// API tokens are only accepted in the Authorization header, never as a cookie, so a browser never sends one on its
+// own and checkCSRF can let them through.
+func (s *server) apiTokens(auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withSession := auth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hash, ok := apiTokenOf(r)
+			if !ok {
+				withSession.ServeHTTP(w, r)
+				return
+			}
+			token, err := s.unscoped(r).GetAPIToken(hash)
+			if errors.Is(err, errs.NotFound) {
+				s.writeError(w, r, errs.New(errs.Unauthorized, "not logged in"))
+				return
+			}
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+			// A disabled User's tokens stop working along with their sessions
+			user, err := s.activeUser(r, token.UserID)
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+			// As with sessions, Users only need a rough idea of when each token was last used
+			if now := clock.Now(); now.Sub(token.LastUsed) >= sessionTouchInterval {
+				if err := s.unscoped(r).TouchAPIToken(token.ID, now); err != nil {
+					s.logger.Printf("WARNING: Unable to record use of API token %d: %v", token.ID, err)
+				} else {
+					token.LastUsed = now
+				}
+			}
+			ctx := requestctx.WithUser(r.Context(), user)
+			ctx = requestctx.WithAPIToken(ctx, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// apiTokenOf reads the API token from the request, returning its hash to look the token up by. Returns false if the
+// request doesn't carry one. A replayed request only has the hash (see deferWrite).
+func apiTokenOf(r *http.Request) ([]byte, bool) {
+	if replay, ok := requestctx.ReplayOf(r.Context()); ok && len(replay.TokenHash) > 0 {
+		return replay.TokenHash, replay.APIToken
+	}
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(raw, apiTokenPrefix) {
+		return nil, false
+	}
+	return hashToken(raw), true
+}
+
+// requireSession refuses requests authenticated with an API token, for routes managing API tokens themselves. Otherwise
+// a leaked token could be used to mint more tokens (outliving its own expiry), or to revoke the User's others.
+func requireSession(r *http.Request) error {
+	if _, ok := requestctx.APIToken(r.Context()); ok {
+		return errs.New(errs.Forbidden, "API tokens can't be used to manage API tokens, log in instead")
+	}
+	return nil
+}
+
+// createAPIToken creates a named API token for the logged in User, limited to the scopes they ask for. Every scope must
+// be a permission they have now, and the token loses any they lose later (see authorize).
+func (s *server) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	if err := requireSession(r); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var req apiTokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len([]rune(req.Name)) > maxAPITokenName {
+		s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("name must be between 1 and %d characters", maxAPITokenName)))
+		return
+	}
+	lifetime := apiTokenDefaultLifetime
+	if req.ExpiresInDays != 0 {
+		lifetime = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	if lifetime <= 0 || lifetime > apiTokenMaxLifetime {
+		s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("expiresInDays must be between 1 and %d", int(apiTokenMaxLifetime.Hours()/24))))
+		return
+	}
+	scopes, err := s.apiTokenScopes(r, user, req.Scopes)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+
+	existing, err := s.dbFor(r).ListAPITokens(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if len(existing) >= maxAPITokens {
+		s.writeError(w, r, errs.New(errs.Conflict, fmt.Sprintf("you already have %d API tokens, delete one first", maxAPITokens)))
+		return
+	}
+
+	secret, _, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "createAPIToken"))
+		return
+	}
+	raw := apiTokenPrefix + secret
+	now := clock.Now()
+	token := database.APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		TokenHash: hashToken(raw),
+		Scopes:    scopes,
+		Created:   now,
+		Expires:   now.Add(lifetime),
+	}
+	if err := s.dbFor(r).CreateAPIToken(&token); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "apitoken.create", user.ID, fmt.Sprintf("token %d %q scopes %v", token.ID, token.Name, token.Scopes))
+	s.securityEvent(r, eventAPITokenCreated, user.ID, fmt.Sprintf("token %d, scopes %v", token.ID, token.Scopes))
+
+	resp := newAPITokenResponse(token)
+	resp.Token = raw
+	s.writeJSON(w, r, http.StatusCreated, resp)
+}
+
+// apiTokenScopes checks the scopes asked for in a new API token are all permissions the User has, returning them
+// sorted and without duplicates.
+func (s *server) apiTokenScopes(r *http.Request, user database.User, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, errs.New(errs.Invalid, "scopes must list at least one permission")
+	}
+	scopes := slices.Clone(requested)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	for _, scope := range scopes {
+		want := []permission{permission(scope)}
+		have, err := s.permissionsOf(r, user, want)
+		if err != nil {
+			return nil, err
+		}
+		if !(policy{permissions: want}).allows(have) {
+			return nil, errs.New(errs.Invalid, fmt.Sprintf("scope %q isn't a permission you have", scope))
+		}
+	}
+	return scopes, nil
+}
+
+// listAPITokens lists the logged in User's API tokens, including expired ones, newest first.
+func (s *server) listAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	if err := requireSession(r); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	tokens, err := s.dbFor(r).ListAPITokens(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	resp := make([]apiTokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		resp = append(resp, newAPITokenResponse(token))
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// deleteAPIToken revokes one of the logged in User's API tokens, so it stops working straight away.
+func (s *server) deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	if err := requireSession(r); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		s.writeError(w, r, errs.New(errs.Invalid, "API token ID must be a positive number"))
+		return
+	}
+	if err := s.dbFor(r).DeleteAPIToken(user.ID, id); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "apitoken.delete", user.ID, strconv.FormatInt(id, 10))
+	s.securityEvent(r, eventAPITokenRevoked, user.ID, fmt.Sprintf("token %d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
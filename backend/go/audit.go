@@ -0,0 +1,40 @@
+package main
+
+import (
+	"examples/clock"
+	"examples/database"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// audit records an action in our audit log, attributed to the logged in user making the request (if any). The action
+// has already happened by the time we record it, so failing to record it is logged rather than failing the request.
+func (s *server) audit(r *http.Request, action string, targetID int64, detail string) {
+	entry := s.auditEntry(r, action, targetID, detail)
+	if err := s.unscoped(r).CreateAuditEntry(&entry); err != nil {
+		s.logger.Printf("ERROR: Unable to record audit entry %q for user %d: %v", action, targetID, err)
+	}
+}
+
+// auditEntry builds the entry audit records, for handlers recording it themselves as part of a transaction (see
+// database.Storer.WithTx), so the action and its entry are recorded together or not at all.
+func (s *server) auditEntry(r *http.Request, action string, targetID int64, detail string) database.AuditEntry {
+	entry := database.AuditEntry{
+		Time:     clock.Now(),
+		Action:   action,
+		TargetID: targetID,
+		Detail:   detail,
+		IP:       s.clientIP(r),
+	}
+	if user, ok := requestctx.User(r.Context()); ok {
+		entry.ActorID = user.ID
+	}
+	// Whatever support staff do while impersonating a User is down to them, not the User
+	if session, ok := requestctx.Session(r.Context()); ok && session.ImpersonatorID != 0 {
+		entry.ActorID = session.ImpersonatorID
+		entry.Detail = strings.TrimSpace(fmt.Sprintf("%s (while impersonating user %d)", detail, session.UserID))
+	}
+	return entry
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"examples/database"
+	"examples/database/instrumented"
+	"examples/database/scoped"
+	"examples/errs"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// role is a level of access a user can have
+type role string
+
+// Our roles
+const (
+	roleUser  role = "user"  // Any logged in user
+	roleAdmin role = "admin" // Administrators
+)
+
+// routeKey identifies a route by its HTTP method and path template (e.g. "/users/{username}")
+type routeKey struct {
+	method, path string
+}
+
+// permission is something a user may do, named as area:action (e.g. "users:write"). Routes require permissions rather
+// than roles, so what each role may do is decided in one place (rolePermissions), and access can also come from
+// somewhere other than a role, such as dealership membership.
+type permission string
+
+// Our permissions
+const (
+	permSelfRead   permission = "self:read"   // See their own account and sessions
+	permSelfWrite  permission = "self:write"  // Change their own account and sessions
+	permUsersRead  permission = "users:read"  // See other users (which ones is still up to dbFor)
+	permUsersWrite permission = "users:write" // Change other users, such as disabling them
+	permRolesWrite permission = "roles:write" // Promote and demote admins
+)
+
+// rolePermissions lists the permissions each role grants.
+var rolePermissions = map[role][]permission{
+	roleUser:  {permSelfRead, permSelfWrite},
+	roleAdmin: {permSelfRead, permSelfWrite, permUsersRead, permUsersWrite, permRolesWrite},
+}
+
+// membershipPermissions are granted to members of at least one dealership, on top of their role's. Without a
+// dealership there's nobody else a user could see, so there's no point letting them try.
+var membershipPermissions = []permission{permUsersRead}
+
+// policy describes who may use a route. A caller needs at least one of the listed permissions.
+type policy struct {
+	permissions []permission
+	unverified  bool // Users who haven't verified their email yet may use the route too (see requireVerifiedEmail)
+}
+
+// policies is our authorization policy table, listing the permissions needed for every route behind our auth
+// middleware. Keeping every rule in one place means permissions can be reviewed at a glance, rather than hunting
+// through each handler.
+//
+// Any route without an entry here is refused (we fail closed), and routes() checks every route has an entry at
+// startup so a missing one is caught straight away. Handlers may still make finer grained checks, such as only
+// allowing users to change their own email.
+var policies = map[routeKey]policy{
+	{http.MethodGet, "/users/"}:                    {permissions: []permission{permSelfRead}, unverified: true},
+	{http.MethodGet, "/users/search/{name}"}:       {permissions: []permission{permUsersRead}},
+	{http.MethodPut, "/users/{username}"}:          {permissions: []permission{permSelfWrite, permUsersWrite}},
+	{http.MethodPut, "/users/{username}/email"}:    {permissions: []permission{permSelfWrite}},
+	{http.MethodPost, "/users/{username}/email"}:   {permissions: []permission{permSelfWrite}},
+	{http.MethodGet, "/users/{username}/avatar"}:   {permissions: []permission{permSelfRead, permUsersRead}},
+	{http.MethodPut, "/users/{username}/username"}: {permissions: []permission{permSelfWrite}},
+	{http.MethodGet, "/users/{username}/username"}: {permissions: []permission{permSelfRead, permUsersRead}},
+	{http.MethodPost, "/users/{username}/2fa"}:     {permissions: []permission{permSelfWrite}},
+	{http.MethodPut, "/users/{username}/2fa"}:      {permissions: []permission{permSelfWrite}},
+	{http.MethodDelete, "/users/{username}/2fa"}:   {permissions: []permission{permSelfWrite}},
+	{http.MethodGet, "/csrf/"}:                     {permissions: []permission{permSelfRead}, unverified: true},
+	{http.MethodGet, "/sessions/"}:                 {permissions: []permission{permSelfRead}, unverified: true},
+	{http.MethodDelete, "/sessions/{id}"}:          {permissions: []permission{permSelfWrite}, unverified: true},
+	{http.MethodPut, "/users/password"}:            {permissions: []permission{permSelfWrite}, unverified: true},
+	{http.MethodPost, "/verify/"}:                  {permissions: []permission{permSelfWrite}, unverified: true},
+	{http.MethodPost, "/users/self/tokens"}:        {permissions: []permission{permSelfWrite}},
+	{http.MethodGet, "/users/self/tokens"}:         {permissions: []permission{permSelfRead}},
+	{http.MethodDelete, "/users/self/tokens/{id}"}: {permissions: []permission{permSelfWrite}},
+
+	// Admin only
+	{http.MethodGet, "/users/all"}:                     {permissions: []permission{permUsersRead}},
+	{http.MethodPut, "/users/{username}/admin"}:        {permissions: []permission{permRolesWrite}},
+	{http.MethodDelete, "/users/{username}/admin"}:     {permissions: []permission{permRolesWrite}},
+	{http.MethodPut, "/users/{username}/enabled"}:      {permissions: []permission{permUsersWrite}},
+	{http.MethodDelete, "/users/{username}/enabled"}:   {permissions: []permission{permUsersWrite}},
+	{http.MethodPut, "/users/{username}/password"}:     {permissions: []permission{permUsersWrite}},
+	{http.MethodPost, "/users/{username}/impersonate"}: {permissions: []permission{permUsersWrite}},
+	{http.MethodPost, "/invites/"}:                     {permissions: []permission{permUsersWrite}},
+	{http.MethodGet, "/invites/"}:                      {permissions: []permission{permUsersRead}},
+	{http.MethodDelete, "/invites/{id}"}:               {permissions: []permission{permUsersWrite}},
+}
+
+// rolesOf returns every role a user has. Admins can do anything a regular user can, so have both roles.
+func rolesOf(user database.User) []role {
+	if user.Role == database.RoleAdmin {
+		return []role{roleUser, roleAdmin}
+	}
+	return []role{roleUser}
+}
+
+// dbFor returns our database, limited to the users the logged in user is allowed to see: themselves and the other
+// members of their dealerships, or everyone for admins (see the scoped package). Handlers on our public API should
+// load and change users through this rather than s.db, so dealership isolation is enforced in one place rather than
+// checked by each handler. Without a logged in user nobody is visible at all, so a handler mistakenly mounted outside
+// our auth middleware fails closed.
+func (s *server) dbFor(r *http.Request) database.Storer {
+	user, ok := requestctx.User(r.Context())
+	if !ok {
+		return scoped.New(s.unscoped(r), 0, false)
+	}
+	return scoped.New(s.unscoped(r), user.ID, hasRole(rolesOf(user), roleAdmin))
+}
+
+// unscoped returns our database without any limit on which users are visible, for handlers that need to find users
+// before anyone is logged in (such as login itself) and for our admin endpoints. Calls made through it are counted
+// towards the request's database calls (see countQueries), so handlers should use this rather than s.db.
+func (s *server) unscoped(r *http.Request) database.Storer {
+	if counter, ok := requestctx.QueryCounter(r.Context()); ok {
+		return instrumented.Counting(s.db, counter)
+	}
+	return s.db
+}
+
+// hasRole reports whether want is among the given roles.
+func hasRole(roles []role, want role) bool {
+	for _, have := range roles {
+		if have == want {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the logged in user is allowed to use the route they've requested, according to our policy table.
+// This must come after our auth middleware, as it needs to know who the user is.
+func (s *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forbidden := errs.New(errs.Forbidden, "you don't have permission to do this")
+		user, ok := requestctx.User(r.Context())
+		if !ok {
+			s.writeError(w, r, forbidden)
+			return
+		}
+		// Middleware on a mux router runs after the route is matched, so we can find which route this is
+		path, err := mux.CurrentRoute(r).GetPathTemplate()
+		if err != nil {
+			s.writeError(w, r, errs.Wrap(err, "authorize"))
+			return
+		}
+		p, ok := policies[routeKey{r.Method, path}]
+		if !ok {
+			s.writeError(w, r, forbidden)
+			return
+		}
+		have, err := s.grantedPermissions(r, user, p.permissions)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if !p.allows(have) {
+			s.writeError(w, r, forbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grantedPermissions returns the permissions a user has (see permissionsOf), limited by how they've logged in for this
+// request. Handlers making finer grained checks than our policy table use this too, so they see the same permissions.
+func (s *server) grantedPermissions(r *http.Request, user database.User, want []permission) ([]permission, error) {
+	have, err := s.permissionsOf(r, user, want)
+	if err != nil {
+		return nil, err
+	}
+	// Impersonation sessions only get the read permissions the User has, whatever else they could do
+	if session, ok := requestctx.Session(r.Context()); ok && session.ImpersonatorID != 0 {
+		have = slices.DeleteFunc(have, func(p permission) bool {
+			return !slices.Contains(impersonationPermissions, p)
+		})
+	}
+	// Likewise API tokens only get the scopes they were created with, and only while the User still has them
+	if token, ok := requestctx.APIToken(r.Context()); ok {
+		have = slices.DeleteFunc(have, func(p permission) bool {
+			return !slices.Contains(token.Scopes, string(p))
+		})
+	}
+	return have, nil
+}
+
+// hasPermission reports whether the logged in user has been granted a permission for this request, for handlers
+// making finer grained checks than our policy table, such as who may change whose details.
+func (s *server) hasPermission(r *http.Request, want permission) (bool, error) {
+	user, ok := requestctx.User(r.Context())
+	if !ok {
+		return false, nil
+	}
+	have, err := s.grantedPermissions(r, user, []permission{want})
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(have, want), nil
+}
+
+// permissionsOf returns the permissions a user has, from their role and their dealership memberships. Membership is
+// only looked up if the permissions it grants could make a difference to want, saving a query on most requests.
+func (s *server) permissionsOf(r *http.Request, user database.User, want []permission) ([]permission, error) {
+	var have []permission
+	for _, ro := range rolesOf(user) {
+		have = append(have, rolePermissions[ro]...)
+	}
+	if (policy{permissions: want}).allows(have) || !(policy{permissions: want}).allows(membershipPermissions) {
+		return have, nil
+	}
+	dealerships, err := s.unscoped(r).ListUserDealerships(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(dealerships) > 0 {
+		have = append(have, membershipPermissions...)
+	}
+	return have, nil
+}
+
+// requireRole returns middleware only letting through logged in users with at least one of the given roles, so a group
+// of routes (such as everything only admins may use) can be protected in one place when they're hooked up. This is on
+// top of our policy table rather than instead of it, the table still needs an entry for each route, but a route added
+// to the group can't accidentally be opened up to everyone by a wrong entry. This must come after our auth middleware.
+func (s *server) requireRole(roles ...role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := requestctx.User(r.Context())
+			if ok {
+				for _, want := range roles {
+					if hasRole(rolesOf(user), want) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			s.writeError(w, r, errs.New(errs.Forbidden, "you don't have permission to do this"))
+		})
+	}
+}
+
+// allows reports whether any of the given permissions satisfies the policy.
+func (p policy) allows(have []permission) bool {
+	for _, got := range have {
+		for _, want := range p.permissions {
+			if got == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPolicies returns an error listing any route on the router that has no entry in our policy table.
+func checkPolicies(router *mux.Router) error {
+	var missing []string
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			// Routes without a path (such as a PathPrefix("") subrouter) don't need a policy
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if _, ok := policies[routeKey{method, path}]; !ok {
+				missing = append(missing, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("routes missing an authorization policy: %v", missing)
+	}
+	return nil
+}
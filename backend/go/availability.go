@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"examples/errs"
+	"examples/username"
+	"net/http"
+)
+
+// availabilityResponse says whether a username is free to sign up with.
+type availabilityResponse struct {
+	Username bool `json:"username"`
+}
+
+// availability checks whether ?username= is free to sign up with, so signup forms can say so as it's typed rather than
+// once the form is submitted. Usernames are how Users find each other, so saying which are taken gives nothing away.
+// Emails are deliberately not checked here: anyone can call this, and an answer saying an email is taken tells them who
+// has an account with us. A signup with an email that's taken is refused by the signup itself, as usual. Checks are
+// still limited per client, so nobody can list every username we have this way. Invalid usernames are refused straight
+// away.
+func (s *server) availability(w http.ResponseWriter, r *http.Request) {
+	name := username.Normalize(r.URL.Query().Get("username"))
+	if name == "" {
+		s.writeError(w, r, errs.New(errs.Invalid, "a username to check is required"))
+		return
+	}
+	if err := username.Validate(name); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if s.availabilityLimiter != nil {
+		if ok, retryAfter := s.availabilityLimiter.Allow(s.clientIP(r)); !ok {
+			err := errs.New(errs.TooManyRequests, "too many availability checks, please wait before trying again")
+			err.RetryAfter = retryAfter
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	free, err := s.usernameFree(r, name)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, availabilityResponse{Username: free})
+}
+
+// usernameFree reports whether nobody has a username, and nobody has given it up either. Given up usernames stay
+// reserved for whoever had them (see Storer.UsernameReserved), so signing up with one would fail just as with one
+// that's in use, and we shouldn't say it's free.
+func (s *server) usernameFree(r *http.Request, name string) (bool, error) {
+	_, err := s.unscoped(r).GetUserByUsername(name)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, errs.NotFound) {
+		return false, err
+	}
+	reserved, err := s.unscoped(r).UsernameReserved(name)
+	if err != nil {
+		return false, err
+	}
+	return !reserved, nil
+}
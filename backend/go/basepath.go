@@ -0,0 +1,50 @@
+package main
+
+import (
+	"examples/errs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Our public API can be mounted under a path prefix (see config.BasePath), for ingresses that route to each service by
+// the start of the path rather than by hostname. Our routes are all written as if we were mounted at the root, and the
+// prefix is stripped before the request reaches our router. That way our route templates (which our policies, schemas,
+// changelog and metrics are keyed by) don't change with where we're deployed. Anything we hand out pointing back at
+// ourselves, such as links and cookie paths, goes through s.pathTo to put the prefix back.
+
+// stripBasePath takes our base path off the front of each request's path before passing it on, and refuses any request
+// outside it.
+func (s *server) stripBasePath(next http.Handler) http.Handler {
+	if s.basePath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutPrefix(r.URL.Path, s.basePath)
+		// Only a whole path segment counts, /api/backend shouldn't match /api/backendfoo
+		if !ok || (path != "" && !strings.HasPrefix(path, "/")) {
+			s.writeError(w, r, errs.New(errs.NotFound, "not found"))
+			return
+		}
+		if path == "" {
+			path = "/"
+		}
+		// Just as http.StripPrefix does, leaving the caller's request untouched
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		if raw, ok := strings.CutPrefix(r.URL.RawPath, s.basePath); ok {
+			r2.URL.RawPath = raw
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// pathTo returns the path a client should use to reach one of our routes, such as "/token/refresh", with our base path
+// in front.
+func (s *server) pathTo(route string) string {
+	return s.basePath + route
+}
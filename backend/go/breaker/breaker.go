@@ -0,0 +1,155 @@
+// breaker wraps calls to our external dependencies (external APIs, our mailer, etc) in circuit breakers.
+//
+// When a dependency starts failing, carrying on calling it just piles up slow, doomed requests (and the goroutines and
+// connections serving them). A circuit breaker watches for failures, and once too many happen it "opens", failing
+// every call immediately without touching the dependency. After a timeout it goes "half-open", letting a single probe
+// request through: if that succeeds the breaker closes again, otherwise it stays open for another timeout.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"examples/errs"
+	"examples/mailer"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	// state reports the current state of each breaker (0 closed, 1 half-open, 2 open)
+	state = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "Current state of each circuit breaker (0 closed, 1 half-open, 2 open).",
+	}, []string{"name"})
+	// rejected counts the calls each breaker failed immediately, without calling the dependency
+	rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_rejected_total",
+		Help: "Total number of calls rejected by an open circuit breaker.",
+	}, []string{"name"})
+)
+
+// Settings controls when a breaker opens, and how long it stays open.
+type Settings struct {
+	Name     string        // Name used in metrics and errors, e.g. "mailer"
+	Failures uint32        // Consecutive failures before the breaker opens
+	Timeout  time.Duration // How long the breaker stays open before letting a probe request through
+}
+
+// DefaultSettings returns reasonable settings for a breaker with the given name.
+func DefaultSettings(name string) Settings {
+	return Settings{Name: name, Failures: 5, Timeout: 30 * time.Second}
+}
+
+// Breaker is a circuit breaker that can wrap any call to a dependency.
+type Breaker struct {
+	cb       *gobreaker.TwoStepCircuitBreaker
+	name     string
+	timeout  time.Duration
+	openedAt atomic.Int64 // Time the breaker last opened (in Unix nanoseconds), used to estimate Retry-After
+}
+
+// New creates a closed Breaker.
+func New(st Settings) *Breaker {
+	b := &Breaker{name: st.Name, timeout: st.Timeout}
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name: st.Name,
+		// Only allow a single probe request through while half-open
+		MaxRequests: 1,
+		Timeout:     st.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= st.Failures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			state.WithLabelValues(name).Set(float64(to))
+			if to == gobreaker.StateOpen {
+				b.openedAt.Store(time.Now().UnixNano())
+			}
+		},
+	})
+	state.WithLabelValues(st.Name).Set(float64(gobreaker.StateClosed))
+	return b
+}
+
+// Do calls fn if the breaker allows it, recording whether it failed. If the breaker is open, fn isn't called and an
+// Unavailable error is returned instead.
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.cb.Allow()
+	if err != nil {
+		return b.rejected(err)
+	}
+	err = fn()
+	done(err == nil)
+	return err
+}
+
+// rejected records a rejected call, and converts the breaker's error into an Unavailable error telling the caller
+// roughly when the breaker will let a probe through.
+func (b *Breaker) rejected(err error) error {
+	rejected.WithLabelValues(b.name).Inc()
+	retry := b.timeout - time.Since(time.Unix(0, b.openedAt.Load()))
+	if retry <= 0 {
+		retry = time.Second
+	}
+	return &errs.Error{Code: errs.Unavailable, Op: "breaker." + b.name, Err: err, RetryAfter: retry}
+}
+
+// Open reports whether an error was caused by an open breaker rejecting the call.
+func Open(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// Mailer wraps a Mailer in a circuit breaker. While the breaker is open, emails are handed to the fallback Mailer (if
+// there is one) so they aren't lost entirely, otherwise an Unavailable error is returned.
+func Mailer(next mailer.Mailer, fallback mailer.Mailer, st Settings) mailer.Mailer {
+	return &breakerMailer{next: next, fallback: fallback, breaker: New(st)}
+}
+
+// breakerMailer is a Mailer protected by a circuit breaker.
+type breakerMailer struct {
+	next     mailer.Mailer
+	fallback mailer.Mailer
+	breaker  *Breaker
+}
+
+// Send implements mailer.Mailer.
+func (m *breakerMailer) Send(ctx context.Context, msg mailer.Message) error {
+	err := m.breaker.Do(func() error {
+		return m.next.Send(ctx, msg)
+	})
+	if Open(err) && m.fallback != nil {
+		return m.fallback.Send(ctx, msg)
+	}
+	return err
+}
+
+// Transport wraps a http.RoundTripper in a circuit breaker, for use in the http.Client of any external API client.
+// Server errors (5xx statuses) count as failures, as they usually mean the dependency is struggling. While the
+// breaker is open requests fail immediately, without being sent.
+func Transport(next http.RoundTripper, st Settings) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &breakerTransport{next: next, breaker: New(st)}
+}
+
+// breakerTransport is a http.RoundTripper protected by a circuit breaker.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *Breaker
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, err := t.breaker.cb.Allow()
+	if err != nil {
+		return nil, t.breaker.rejected(err)
+	}
+	resp, err := t.next.RoundTrip(req)
+	done(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
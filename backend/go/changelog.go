@@ -0,0 +1,203 @@
+package main
+
+import (
+	"examples/errs"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of change to a route
+const (
+	changeAdded   = "added"
+	changeChanged = "changed"
+	changeRemoved = "removed"
+)
+
+// changelogEntry records a single change to one of our public routes, in the release it shipped in.
+type changelogEntry struct {
+	Version     string `json:"version"` // Release the change shipped in, such as "1.2.0"
+	Date        string `json:"date"`    // When it shipped, as YYYY-MM-DD
+	Method      string `json:"method"`
+	Path        string `json:"path"`   // Path template, such as "/users/{username}/email"
+	Change      string `json:"change"` // One of added, changed or removed
+	Description string `json:"description"`
+}
+
+// changelog lists every change to our public API, oldest first. Add an entry here alongside any route that's added,
+// changed or removed, and routes() will refuse to start if a route has no "added" entry, or an entry names a route we
+// don't have. Routes that existed before we kept a changelog are all listed as added in 1.0.0.
+var changelog = []changelogEntry{
+	{"1.0.0", "2026-10-16", http.MethodPost, "/login/", changeAdded, "Log in with a username or email and password"},
+	{"1.0.0", "2026-10-16", http.MethodPost, "/login/2fa", changeAdded, "Finish logging in with a two-factor code"},
+	{"1.0.0", "2026-10-16", http.MethodPost, "/logout/", changeAdded, "End the current session"},
+	{"1.0.0", "2026-10-16", http.MethodPost, refreshPath, changeAdded, "Swap a refresh token for a new session"},
+	{"1.0.0", "2026-10-16", http.MethodGet, oauthPath + "{provider}", changeAdded, "Log in with an OAuth provider"},
+	{"1.0.0", "2026-10-16", http.MethodGet, oauthPath + "{provider}/callback", changeAdded, "Where OAuth providers send users back to"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/schemas/", changeAdded, "List our JSON Schemas"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/schemas/{type}.json", changeAdded, "Fetch a JSON Schema"},
+	{"1.0.0", "2026-10-16", http.MethodPost, "/email/confirm/{token}", changeAdded, "Confirm an email change"},
+	{"1.0.0", "2026-10-16", http.MethodGet, downloadsPrefix, changeAdded, "Download a file through a signed link"},
+	{"1.0.0", "2026-10-16", http.MethodHead, downloadsPrefix, changeAdded, "Check a file through a signed link"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/users/", changeAdded, "Fetch the logged in user"},
+	{"1.0.0", "2026-10-16", http.MethodPut, "/users/{username}/email", changeAdded, "Start changing a user's email"},
+	{"1.0.0", "2026-10-16", http.MethodPost, "/users/{username}/email", changeAdded, "Email a user links to install our app"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/users/{username}/avatar", changeAdded, "Fetch a signed link to a user's avatar"},
+	{"1.0.0", "2026-10-16", http.MethodPut, "/users/{username}/username", changeAdded, "Change a user's username"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/users/{username}/username", changeAdded, "List a user's previous usernames"},
+	{"1.0.0", "2026-10-16", http.MethodPost, "/users/{username}/2fa", changeAdded, "Start enrolling in two-factor authentication"},
+	{"1.0.0", "2026-10-16", http.MethodPut, "/users/{username}/2fa", changeAdded, "Finish enrolling in two-factor authentication"},
+	{"1.0.0", "2026-10-16", http.MethodDelete, "/users/{username}/2fa", changeAdded, "Turn off two-factor authentication"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/csrf/", changeAdded, "Fetch a CSRF token for the current session"},
+	{"1.0.0", "2026-10-16", http.MethodGet, "/sessions/", changeAdded, "List the logged in user's sessions"},
+	{"1.0.0", "2026-10-16", http.MethodDelete, "/sessions/{id}", changeAdded, "End one of the logged in user's sessions"},
+	{"1.0.0", "2026-10-16", http.MethodPut, "/users/{username}/admin", changeAdded, "Make a user an admin"},
+	{"1.0.0", "2026-10-16", http.MethodDelete, "/users/{username}/admin", changeAdded, "Stop a user being an admin"},
+	{"1.0.0", "2026-10-16", http.MethodPut, "/users/{username}/enabled", changeAdded, "Enable a user"},
+	{"1.0.0", "2026-10-16", http.MethodDelete, "/users/{username}/enabled", changeAdded, "Disable a user"},
+	{"1.1.0", "2026-10-16", http.MethodGet, "/changelog/", changeAdded, "List changes to our API, optionally since a given version"},
+	{"1.2.0", "2026-10-16", http.MethodPost, "/login/magic", changeAdded, "Email a one-time link for logging in without a password"},
+	{"1.2.0", "2026-10-16", http.MethodPost, "/login/magic/{token}", changeAdded, "Log in with the token from a magic link"},
+	{"1.3.0", "2026-10-16", http.MethodPut, "/users/password", changeAdded, "Change the logged in user's password"},
+	{"1.3.0", "2026-10-16", http.MethodPut, "/users/{username}/password", changeAdded, "Email a user a link to reset their password"},
+	{"1.3.0", "2026-10-16", http.MethodPost, "/password/reset/{token}", changeAdded, "Choose a new password with a password reset link"},
+	{"1.4.0", "2026-10-16", http.MethodGet, "/sessions/", changeChanged, "Sessions include the client that last used them, and when and where from"},
+	{"1.5.0", "2026-10-16", http.MethodPost, "/users/{username}/impersonate", changeAdded, "Start a read only session acting as a user, for support staff"},
+	{"1.5.0", "2026-10-16", http.MethodGet, "/sessions/", changeChanged, "Sessions say whether support staff are impersonating the user through them"},
+	{"1.6.0", "2026-10-16", http.MethodGet, "/verify/{token}", changeAdded, "Verify a new user's email with the link we sent them"},
+	{"1.6.0", "2026-10-16", http.MethodPost, "/verify/", changeAdded, "Send the logged in user another email verification link"},
+	{"1.6.0", "2026-10-16", http.MethodGet, "/users/", changeChanged, "Users include whether they've verified their email, most routes refuse users who haven't"},
+	{"1.7.0", "2026-10-16", http.MethodPost, "/invites/", changeAdded, "Invite someone to create an account"},
+	{"1.7.0", "2026-10-16", http.MethodGet, "/invites/", changeAdded, "List invites that haven't been accepted yet"},
+	{"1.7.0", "2026-10-16", http.MethodDelete, "/invites/{id}", changeAdded, "Revoke an invite"},
+	{"1.7.0", "2026-10-16", http.MethodPost, "/register/{token}", changeAdded, "Create an account with the link from an invite"},
+	{"1.8.0", "2026-10-16", http.MethodPost, "/users/self/tokens", changeAdded, "Create an API token for scripts and CI"},
+	{"1.8.0", "2026-10-16", http.MethodGet, "/users/self/tokens", changeAdded, "List the logged in user's API tokens"},
+	{"1.8.0", "2026-10-16", http.MethodDelete, "/users/self/tokens/{id}", changeAdded, "Revoke one of the logged in user's API tokens"},
+	{"1.9.0", "2026-10-16", http.MethodPut, "/users/{username}/email", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.9.0", "2026-10-16", http.MethodDelete, "/sessions/{id}", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.9.0", "2026-10-16", http.MethodDelete, "/users/self/tokens/{id}", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.9.0", "2026-10-16", http.MethodPut, "/users/{username}/enabled", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.9.0", "2026-10-16", http.MethodDelete, "/users/{username}/enabled", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.9.0", "2026-10-16", http.MethodDelete, "/invites/{id}", changeChanged, "May be queued and answered with a 202 while our database is unavailable"},
+	{"1.10.0", "2026-10-16", http.MethodPut, "/users/{username}", changeAdded, "Update a user's name, and (for admins) their email"},
+	{"1.11.0", "2026-10-16", http.MethodGet, "/users/all", changeAdded, "Page through every user, for admins"},
+	{"1.12.0", "2026-10-16", http.MethodGet, "/users/search/{name}", changeAdded, "Search the users you can see by name or email"},
+	{"1.13.0", "2026-10-16", http.MethodPost, "/login/", changeChanged, "Session tokens are random strings rather than numbers, older ones must be refreshed"},
+	{"1.14.0", "2026-10-16", http.MethodGet, "/availability", changeAdded, "Check whether a username is free to sign up with"},
+}
+
+// changelogResponse lists changes to our API, newest first.
+type changelogResponse struct {
+	Entries []changelogEntry `json:"entries"`
+}
+
+// changelogHandler lists changes to our API, newest first. Pass ?since=1.2.0 to only list changes made after that
+// release, such as the release a client was last tested against. Like our schemas, this only changes when we deploy.
+func (s *server) changelogHandler(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	if since != "" && !validVersion(since) {
+		s.writeError(w, r, errs.New(errs.Invalid, "since must be a version such as 1.2.0"))
+		return
+	}
+	resp := changelogResponse{Entries: []changelogEntry{}}
+	for i := len(changelog) - 1; i >= 0; i-- {
+		if since != "" && compareVersions(changelog[i].Version, since) <= 0 {
+			continue
+		}
+		resp.Entries = append(resp.Entries, changelog[i])
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// checkChangelog returns an error listing any route on the router without an "added" entry in our changelog, and any
+// entry for a route the router doesn't have (other than for removed routes).
+func checkChangelog(router *mux.Router) error {
+	have := make(map[routeKey]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes without methods (such as our health check) aren't part of the API as such
+			return nil
+		}
+		for _, method := range methods {
+			have[routeKey{method, path}] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	added := make(map[routeKey]bool)
+	removed := make(map[routeKey]bool)
+	for _, entry := range changelog {
+		key := routeKey{entry.Method, entry.Path}
+		switch {
+		case !validVersion(entry.Version):
+			problems = append(problems, fmt.Sprintf("%s %s: invalid version %q", key.method, key.path, entry.Version))
+		case entry.Change == changeAdded:
+			added[key] = true
+			delete(removed, key)
+		case entry.Change == changeRemoved:
+			removed[key] = true
+		case entry.Change != changeChanged:
+			problems = append(problems, fmt.Sprintf("%s %s: unknown change %q", key.method, key.path, entry.Change))
+		}
+	}
+	for key := range have {
+		if !added[key] || removed[key] {
+			problems = append(problems, fmt.Sprintf("%s %s: not in the changelog", key.method, key.path))
+		}
+	}
+	for key := range added {
+		if !have[key] && !removed[key] {
+			problems = append(problems, fmt.Sprintf("%s %s: in the changelog, but there's no such route", key.method, key.path))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("changelog doesn't match our routes: %v", problems)
+	}
+	return nil
+}
+
+// validVersion reports whether v is a version made of dot separated numbers, such as 1.2.0.
+func validVersion(v string) bool {
+	for _, part := range strings.Split(v, ".") {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares two valid versions part by part, returning -1, 0 or 1 as a is older, the same as, or newer
+// than b. Missing parts count as 0, so 1.2 is the same as 1.2.0.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y uint64
+		if i < len(as) {
+			x, _ = strconv.ParseUint(as[i], 10, 32)
+		}
+		if i < len(bs) {
+			y, _ = strconv.ParseUint(bs[i], 10, 32)
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
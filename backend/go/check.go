@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/config"
+	"examples/database/sql"
+	"examples/mailer"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// checkTimeout is how long each step of our self-test may take before it counts as failed
+const checkTimeout = 10 * time.Second
+
+// checkStep is a single step of our self-test. A step returning errSkipped wasn't needed with our config.
+type checkStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// errSkipped marks a step that didn't apply, such as checking a mailer we haven't configured
+var errSkipped = errors.New("skipped")
+
+// runCheck is our self-test, run with `app check`. Rather than starting the server, it checks everything the server
+// needs in order to start and do its job: our config is valid, our database is reachable and has the schema we expect,
+// and our mailer and session cache (if configured) are reachable. It writes a report to out, returning the exit code
+// to use, 0 if every check passed and 1 otherwise.
+//
+// This is intended to run as an init container, or as a gate before deploying, so a bad config or missed schema change
+// stops the deploy instead of surfacing as errors once we're taking traffic.
+func runCheck(out io.Writer) int {
+	fmt.Fprintln(out, "Running self-test")
+
+	// Everything else needs our config, so there's nothing more we can check without it
+	cfg, err := config.FromEnv()
+	if err != nil {
+		fmt.Fprintf(out, "  FAIL  config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(out, "  ok    config")
+
+	// We exit straight after checking, so there's no need to close anything we open along the way
+	var db *sql.DB
+	steps := []checkStep{
+		{"database", func(ctx context.Context) error {
+			// We report what we find rather than waiting for the database to come up, see dbRetry
+			db, err = sql.NewSQLDB(cfg.DatabaseURL, dbPool(cfg), sql.Retry{})
+			return err
+		}},
+		{"schema", func(ctx context.Context) error {
+			if db == nil {
+				return fmt.Errorf("no database connection")
+			}
+			return db.CheckSchema()
+		}},
+		{"shards", func(ctx context.Context) error {
+			if len(cfg.ShardURLs) == 0 {
+				return errSkipped
+			}
+			if db == nil {
+				return fmt.Errorf("no database connection")
+			}
+			_, err := openShards(db, cfg.ShardURLs, dbPool(cfg), sql.Retry{})
+			return err
+		}},
+		{"mailer", func(ctx context.Context) error {
+			if cfg.SMTPAddr == "" {
+				return errSkipped
+			}
+			return mailer.NewSMTP(cfg.SMTPAddr, cfg.MailFrom, cfg.SMTPUsername, cfg.SMTPPassword).Ping(ctx)
+		}},
+		{"session cache", func(ctx context.Context) error {
+			if cfg.RedisURL == "" {
+				return errSkipped
+			}
+			opts, err := redis.ParseURL(cfg.RedisURL)
+			if err != nil {
+				return err
+			}
+			client := redis.NewClient(opts)
+			defer client.Close()
+			return client.Ping(ctx).Err()
+		}},
+		{"downloads", func(ctx context.Context) error {
+			if cfg.DownloadsDir == "" {
+				return errSkipped
+			}
+			info, err := os.Stat(cfg.DownloadsDir)
+			if err == nil && !info.IsDir() {
+				err = fmt.Errorf("%s is not a directory", cfg.DownloadsDir)
+			}
+			return err
+		}},
+	}
+
+	failed := 0
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		err := step.run(ctx)
+		cancel()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Fprintf(out, "  skip  %s: not configured\n", step.name)
+		case err != nil:
+			fmt.Fprintf(out, "  FAIL  %s: %v\n", step.name, err)
+			failed++
+		default:
+			fmt.Fprintf(out, "  ok    %s\n", step.name)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Fprintln(out, "All checks passed")
+	return 0
+}
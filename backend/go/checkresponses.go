@@ -0,0 +1,6 @@
+//go:build !dev
+
+package main
+
+// checkResponses is off outside dev builds, see checkresponses_dev.go.
+const checkResponses = false
@@ -0,0 +1,7 @@
+//go:build dev
+
+package main
+
+// checkResponses turns on checking our responses against their schemas (see validateSchemas). Buffering and checking
+// every response costs more than we'd like to pay in production, so this is only built into dev builds.
+const checkResponses = true
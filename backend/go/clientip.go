@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the IP address of the client that made the request. Behind a reverse proxy or load balancer the
+// connection comes from the proxy rather than the client, so proxies pass the client's address along in the
+// X-Forwarded-For or Forwarded headers. Those headers are trivial for a client to forge though, so we only believe them
+// when the connection came from one of our trusted proxies.
+//
+// Each proxy appends the address it received the request from, so we walk the list from the right (closest to us),
+// skipping our own proxies, and the first address we don't trust is the client. Anything further left was written by
+// the client themselves, and can't be believed.
+func (s *server) clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !s.trusted(peer) {
+		return peer
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !s.trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	// Every hop was one of our own proxies (such as a health check from the load balancer), the left most is as close
+	// to a client as we'll get
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return peer
+}
+
+// remoteIP returns the IP address of whatever is directly connected to us.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Requests over a Unix socket won't have a host:port address, so we'll just use whatever we were given
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trusted reports whether ip belongs to one of our trusted proxies.
+func (s *server) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the chain of client addresses a proxy passed along, from the standard Forwarded header (RFC 7239)
+// if there is one, or the older but more common X-Forwarded-For header otherwise. Entries that aren't an IP address
+// (such as the "unknown" or obfuscated identifiers Forwarded allows) are kept as they are, they'll never be trusted.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, forwardedHost(strings.Trim(value, `"`)))
+			}
+		}
+		return hops
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedHost strips the port and brackets from a Forwarded "for" value, such as "192.0.2.60:443" or
+// "[2001:db8::1]:443".
+func forwardedHost(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+}
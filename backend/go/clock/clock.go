@@ -0,0 +1,88 @@
+// clock keeps how we handle times consistent. Every time we store or send should be in UTC, to the millisecond:
+//   - UTC, so times read back from our database (which hands them out in whatever time zone its connection is set to)
+//     compare and format the same as times we made ourselves, and responses never depend on where a server happens to
+//     be running
+//   - To the millisecond, as that's the finest precision all of our Storers keep (MongoDB keeps milliseconds, PostgreSQL
+//     microseconds, Go nanoseconds), so a time we stored is equal to the same time read back
+//
+// Times only used to measure how long something took (or to set deadlines) don't need any of this, time.Now() is still
+// the right choice there, as only it carries the monotonic clock reading those need.
+package clock
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// Precision is the finest precision we keep times to.
+const Precision = time.Millisecond
+
+// Layout is how times are formatted as text, RFC 3339 in UTC with exactly three fractional digits. A fixed number of
+// digits means formatted times sort the same as the times themselves.
+const Layout = "2006-01-02T15:04:05.000Z07:00"
+
+// Now returns the current time, in UTC to the millisecond. Use it for any time that will be stored or sent.
+func Now() time.Time {
+	return UTC(time.Now())
+}
+
+// UTC returns t in UTC, truncated to the millisecond. The zero time stays the zero time, so "not set" is kept.
+func UTC(t time.Time) time.Time {
+	return t.UTC().Truncate(Precision)
+}
+
+// Format returns t as text, see Layout.
+func Format(t time.Time) string {
+	return UTC(t).Format(Layout)
+}
+
+// Parse reads an RFC 3339 time (with any number of fractional digits, in any time zone), returning it in UTC to the
+// millisecond.
+func Parse(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return UTC(t), nil
+}
+
+// Scan returns a destination for database/sql's Scan, reading a timestamp column into t in UTC to the millisecond. A
+// NULL reads as the zero time.
+//
+//	err := row.Scan(&session.ID, clock.Scan(&session.Expires))
+func Scan(t *time.Time) interface{ Scan(src any) error } {
+	return scanner{t}
+}
+
+// scanner is the destination returned by Scan.
+type scanner struct {
+	t *time.Time
+}
+
+// Scan implements sql.Scanner.
+func (s scanner) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s.t = time.Time{}
+	case time.Time:
+		*s.t = UTC(v)
+	default:
+		return fmt.Errorf("clock: cannot scan %T into a time", src)
+	}
+	return nil
+}
+
+// Value returns t ready to pass to a database/sql query, in UTC to the millisecond. Our PostgreSQL columns would keep
+// microseconds otherwise, so a time passed in as it is wouldn't be equal to the same time read back.
+func Value(t time.Time) driver.Valuer {
+	return value(t)
+}
+
+// value is the query argument returned by Value.
+type value time.Time
+
+// Value implements driver.Valuer.
+func (v value) Value() (driver.Value, error) {
+	return UTC(time.Time(v)), nil
+}
@@ -0,0 +1,104 @@
+// anonymize replaces the personal data (names, emails, usernames, IP addresses, OAuth accounts) in a copy of our
+// databases with made up data, so a production snapshot can seed a staging environment (see sql.Anonymizer). It reads
+// the databases from DATABASE_URL (the home shard) and SHARD_URLS, just as our API does. Run it with:
+//
+//	go run ./cmd/anonymize -confirm staging_copy
+//
+// It rewrites data in place and can't be undone, so -confirm must name the database DATABASE_URL points at, as a
+// check that it's pointed at the copy. Flags:
+//
+//	-confirm NAME     the name of the database DATABASE_URL points at
+//	-password PW      give every User this password, so staging can log in as anyone, rather than no password at all
+//	-seed N           make up the same data for the same snapshot each time, rather than different data each run
+//
+// Each database is anonymized in a transaction of its own, so one that fails is left as it was, but any before it are
+// already anonymized. It's safe to run again over a database that's already anonymized.
+package main
+
+import (
+	"examples/database"
+	"examples/database/sql"
+	"examples/password"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	confirm := flag.String("confirm", "", "The name of the database DATABASE_URL points at, confirming it's a copy")
+	staging := flag.String("password", "", "Give every User this password, rather than none")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Seed for the made up data")
+	flag.Parse()
+
+	urls := []string{os.Getenv("DATABASE_URL")}
+	for _, url := range strings.Split(os.Getenv("SHARD_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if urls[0] == "" {
+		fmt.Fprintln(os.Stderr, "DATABASE_URL must be set")
+		os.Exit(1)
+	}
+	if *confirm == "" {
+		fmt.Fprintln(os.Stderr, "-confirm must name the database DATABASE_URL points at")
+		os.Exit(2)
+	}
+
+	if err := confirmDatabase(urls[0], *confirm); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var user database.User
+	if *staging != "" {
+		if err := password.SetPassword(&user, *staging); err != nil {
+			fmt.Fprintf(os.Stderr, "Error hashing password: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// One Anonymizer for every shard, so a value found on several shards is replaced the same way on each
+	anonymizer := sql.NewAnonymizer(*seed, user.PasswordHash)
+
+	failed := false
+	for i, url := range urls {
+		report, err := anonymize(anonymizer, url)
+		if err != nil {
+			fmt.Printf("  FAIL  shard %d: %v\n", i, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  ok    shard %d: %d users, %d audit entries, %d security events, %d domain events, %d jobs removed\n",
+			i, report.Users, report.AuditEntries, report.SecurityEvents, report.DomainEvents, report.Jobs)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// confirmDatabase checks the database at url is the one named confirm, before we touch anything.
+func confirmDatabase(url, confirm string) error {
+	db, err := sql.NewSQLDB(url, sql.Pool{}, sql.Retry{})
+	if err != nil {
+		return fmt.Errorf("connecting to database: %w", err)
+	}
+	name, err := db.CurrentDatabase()
+	if err != nil {
+		return fmt.Errorf("reading database name: %w", err)
+	}
+	if name != confirm {
+		return fmt.Errorf("DATABASE_URL points at %q, not %q, refusing to anonymize it", name, confirm)
+	}
+	return nil
+}
+
+// anonymize anonymizes the database at url.
+func anonymize(anonymizer *sql.Anonymizer, url string) (sql.AnonymizeReport, error) {
+	db, err := sql.NewSQLDB(url, sql.Pool{}, sql.Retry{})
+	if err != nil {
+		return sql.AnonymizeReport{}, err
+	}
+	return anonymizer.Anonymize(db)
+}
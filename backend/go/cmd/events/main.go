@@ -0,0 +1,108 @@
+// events replays our domain events (see events.go) to a downstream consumer, so it can rebuild its state after an
+// outage. Run it with:
+//
+//	go run ./cmd/events -admin http://localhost:9090 -token <admin token> -after 0 -to http://consumer/events
+//
+// Each event is POSTed to -to as JSON, oldest first, one at a time, stopping at the first the consumer doesn't accept
+// with a 2xx status. Without -to events are printed as JSON lines instead, to pipe into something else. Either way the
+// sequence number of the last event delivered is printed at the end, pass it as -after next time to carry on from
+// there. Consumers should ignore events with a sequence number they've already seen, as replaying can repeat some.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// event is a domain event as our admin listener lists it, the data is passed on untouched.
+type event struct {
+	Seq    int64           `json:"seq"`
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	UserID int64           `json:"userId,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func main() {
+	admin := flag.String("admin", "http://localhost:9090", "Base URL of our admin listener")
+	token := flag.String("token", "", "Our admin token")
+	after := flag.Int64("after", 0, "Replay events after this sequence number")
+	to := flag.String("to", "", "URL to POST each event to, leave empty to print them instead")
+	page := flag.Int("page", 500, "How many events to fetch at a time")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	last, delivered := *after, 0
+	for {
+		events, err := fetch(client, strings.TrimSuffix(*admin, "/"), *token, last, *page)
+		if err != nil {
+			fail(last, delivered, "Unable to fetch events: %v", err)
+		}
+		for _, e := range events {
+			if err := deliver(client, *to, e); err != nil {
+				fail(last, delivered, "Unable to deliver event %d: %v", e.Seq, err)
+			}
+			last = e.Seq
+			delivered++
+		}
+		if len(events) < *page {
+			break
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d events, last sequence number %d\n", delivered, last)
+}
+
+// fetch lists up to limit events after the given sequence number from our admin listener.
+func fetch(client *http.Client, admin, token string, after int64, limit int) ([]event, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/events?after=%d&limit=%d", admin, after, limit), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	var events []event
+	return events, json.NewDecoder(resp.Body).Decode(&events)
+}
+
+// deliver POSTs an event to the consumer at to, or prints it if there isn't one.
+func deliver(client *http.Client, to string, e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		_, err := fmt.Printf("%s\n", body)
+		return err
+	}
+	resp, err := client.Post(to, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("consumer responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fail reports an error along with how far we got, so the replay can be resumed, and exits.
+func fail(last int64, delivered int, format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintf(os.Stderr, "Replayed %d events before stopping, resume with -after %d\n", delivered, last)
+	os.Exit(1)
+}
@@ -0,0 +1,66 @@
+// replay re-sends requests recorded by a dev build of our API (see the recorder package) against a local instance,
+// reporting any whose response status differs from what was recorded. Run it with:
+//
+//	go run ./cmd/replay -dir ./recordings -target http://localhost:8080 -token <session token>
+//
+// Recordings never include credentials, so pass a session token from the local instance with -token to replay
+// requests that need to be logged in. They're replayed in the order they were recorded, one at a time.
+package main
+
+import (
+	"examples/recorder"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "recordings", "Directory of recordings to replay")
+	target := flag.String("target", "http://localhost:8080", "Base URL of the instance to replay against")
+	token := flag.String("token", "", "Session token to send with every request, as a bearer token")
+	delay := flag.Duration("delay", 0, "Time to wait between requests")
+	flag.Parse()
+
+	records, err := recorder.Load(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load recordings: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	mismatches := 0
+	for _, record := range records {
+		req, err := http.NewRequest(record.Method, strings.TrimSuffix(*target, "/")+record.URL, strings.NewReader(record.Body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to build request for %s %s: %v\n", record.Method, record.URL, err)
+			os.Exit(1)
+		}
+		req.Header = record.Header.Clone()
+		if *token != "" {
+			req.Header.Set("Authorization", "Bearer "+*token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to send %s %s: %v\n", record.Method, record.URL, err)
+			os.Exit(1)
+		}
+		resp.Body.Close()
+
+		result := "ok"
+		if resp.StatusCode != record.Response.Status {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%-8s %s %s: recorded %d, got %d\n", result, record.Method, record.URL, record.Response.Status, resp.StatusCode)
+		time.Sleep(*delay)
+	}
+
+	fmt.Printf("Replayed %d requests, %d responses differed\n", len(records), mismatches)
+	if mismatches > 0 {
+		os.Exit(1)
+	}
+}
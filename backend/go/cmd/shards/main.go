@@ -0,0 +1,74 @@
+// shards sets up the databases we spread our Users across (see database/sharded), reading them from DATABASE_URL (the
+// home shard) and SHARD_URLS, just as our API does. Run it with:
+//
+//	go run ./cmd/shards -migrate
+//
+// -migrate applies our migrations (see database/sql/migrations) to any shard that doesn't have them all yet, then
+// prepares each shard's ID sequences so it only hands out IDs belonging to it. Without -migrate each shard is only
+// checked, reporting whether its schema is up to date and its sequences are prepared, exiting with status 1 if any
+// aren't. Run it again after adding a migration, as every shard needs every change, and new tables bring new sequences.
+//
+// The number of shards decides where each User lives, so adding a shard once Users have been created also means moving
+// Users to where their ID now says they belong, which this doesn't do.
+package main
+
+import (
+	"examples/database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	migrate := flag.Bool("migrate", false, "Create missing tables and prepare ID sequences, rather than only checking")
+	flag.Parse()
+
+	urls := []string{os.Getenv("DATABASE_URL")}
+	for _, url := range strings.Split(os.Getenv("SHARD_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if urls[0] == "" {
+		fmt.Fprintln(os.Stderr, "DATABASE_URL must be set")
+		os.Exit(1)
+	}
+
+	failed := false
+	for i, url := range urls {
+		if err := shard(url, i, len(urls), *migrate); err != nil {
+			fmt.Printf("  FAIL  shard %d: %v\n", i, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  ok    shard %d\n", i)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// shard migrates (if asked to) and checks the shard with the given index.
+func shard(url string, index, count int, migrate bool) error {
+	db, err := sql.NewSQLDB(url, sql.Pool{}, sql.Retry{})
+	if err != nil {
+		return err
+	}
+	if migrate {
+		created, err := db.Provision()
+		if err != nil {
+			return err
+		}
+		if created {
+			fmt.Printf("        shard %d: created tables\n", index)
+		}
+		if err := db.PrepareShard(index, count); err != nil {
+			return err
+		}
+	}
+	if err := db.CheckSchema(); err != nil {
+		return err
+	}
+	return db.CheckShard(index, count)
+}
@@ -0,0 +1,997 @@
+// config gathers every setting our service needs into a single struct, read from environment variables. Keeping this
+// in one place means main() doesn't need to know the name of every environment variable, and it's easy to see at a
+// glance what can be configured.
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"examples/clock"
+	"examples/emailaddr"
+	"examples/encryption"
+	"examples/logging"
+	"examples/ratelimit"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways a session token can be handed to the client after logging in
+const (
+	TransportHeader = "header" // Token is returned in the response body, and sent back in the Authorization header
+	TransportCookie = "cookie" // Token is set as a HttpOnly cookie, which the browser sends back automatically
+)
+
+// How sessions are kept track of
+const (
+	SessionModeDatabase = "database" // Sessions are stored in our database, and can be ended at any time
+	SessionModeJWT      = "jwt"      // Sessions are signed tokens held by the client, nothing is stored
+)
+
+// How strictly sessions are bound to the client that logged in, see SessionFingerprint
+const (
+	FingerprintOff     = "off"     // Sessions can be used from anywhere
+	FingerprintLog     = "log"     // Sessions used from a different client are allowed, but logged
+	FingerprintEnforce = "enforce" // Sessions used from a different client are refused
+)
+
+// Where our job queue is kept
+const (
+	JobQueueDatabase = "database" // Jobs are kept in our database, nothing else to run
+	JobQueueRedis    = "redis"    // Jobs are kept in Redis (at REDIS_URL), taking the load off our database
+)
+
+// Where our sessions (and refresh tokens) are kept
+const (
+	SessionStoreDatabase = "database" // Sessions are kept in our database alongside our Users
+	SessionStoreRedis    = "redis"    // Sessions are kept in Redis (at REDIS_URL), taking the busiest writes off our database
+)
+
+// Config contains all the settings for our service.
+type Config struct {
+	TestDependency string // An example of a required setting, read from TEST_ENVIRONMENT_VARIABLE
+	DatabaseURL    string // Connection string for our database, read from DATABASE_URL (may list a standby, see database/sql/failover.go)
+	Port           string // Port the public API listens on, read from PORT (Default 8080)
+	AdminPort      string // Port the admin/ops API listens on, read from ADMIN_PORT (Default 9090)
+
+	// SecretsDir is a directory of secrets, one file per secret (as mounted by Kubernetes, or written by a Vault agent),
+	// read from SECRETS_DIR. When set, our database URL is read from its database_url file instead of DATABASE_URL, and
+	// checked for changes every DBCredentialsInterval, so rotated credentials are picked up without a restart.
+	SecretsDir string
+	// DBCredentialsInterval is how often we check for rotated database credentials, read from DB_CREDENTIALS_INTERVAL
+	// (Default 1m)
+	DBCredentialsInterval time.Duration
+	// Our pool of database connections (for each shard) is limited, so we never open more than our database allows.
+	// Behind PgBouncer, keep DBMaxOpenConns times the number of instances of our API within its pool size, and keep
+	// DBConnMaxLifetime shorter than any timeout PgBouncer (or a load balancer) closes connections after.
+	DBMaxOpenConns    int           // Most connections open at once, read from DB_MAX_OPEN_CONNS (Default 20)
+	DBMaxIdleConns    int           // Most idle connections kept for reuse, read from DB_MAX_IDLE_CONNS (Default 10)
+	DBConnMaxLifetime time.Duration // Connections are replaced once this old, read from DB_CONN_MAX_LIFETIME (Default 30m)
+	DBConnMaxIdleTime time.Duration // Idle connections are closed after this, read from DB_CONN_MAX_IDLE_TIME (Default 5m)
+	// DBPrepareStatements prepares our hottest queries once rather than on every run, read from DB_PREPARE_STATEMENTS
+	// (Default true). Turn it off behind PgBouncer in transaction pooling mode, older versions of which can't keep
+	// prepared statements.
+	DBPrepareStatements bool
+	// Our database often comes up a few seconds after we do (in containers especially), so if we can't reach it when we
+	// start we try again, up to DBConnectAttempts times in all, waiting up to DBConnectBackoff after the first failure
+	// and doubling up to DBConnectMaxBackoff, see sql.Retry. Read from DB_CONNECT_ATTEMPTS (Default 10, 1 to give up
+	// straight away), DB_CONNECT_BACKOFF (Default 500ms) and DB_CONNECT_MAX_BACKOFF (Default 10s).
+	DBConnectAttempts   int
+	DBConnectBackoff    time.Duration
+	DBConnectMaxBackoff time.Duration
+	// WarmUp has us warm up when we start, before reporting ready: opening database connections, loading the Users
+	// with live sessions (up to WarmUpUsers) and their tenants' settings, and generating our schemas, so the first
+	// requests after a deploy aren't slower than the rest. Read from WARM_UP (Default false), WARM_UP_USERS (Default
+	// 100) and WARM_UP_TIMEOUT (Default 30s), after which we give up warming up and report ready anyway.
+	WarmUp        bool
+	WarmUpUsers   int
+	WarmUpTimeout time.Duration
+	// ShardURLs lists further databases to spread our Users across, read from SHARD_URLS as a comma separated list.
+	// DatabaseURL is always the first shard, our home shard, so listing two URLs here splits Users across three
+	// databases. Each must have been prepared with cmd/shards, see database/sharded. Only the home shard's credentials
+	// are rotated from SecretsDir.
+	ShardURLs []string
+	// MigrateOnStart applies any of our migrations the database doesn't have yet as we start, read from
+	// MIGRATE_ON_START (Default false). Instances starting together take turns, so each migration is only applied once.
+	// Only DatabaseURL is migrated, shards are migrated (and any new sequences prepared) with cmd/shards.
+	MigrateOnStart bool
+	// Instead of TCP ports, either listener can use a Unix domain socket, which is handy when running behind a
+	// reverse proxy or sidecar on the same machine. When a socket path is set, the matching port is ignored.
+	SocketPath      string      // Unix socket for the public API, read from SOCKET_PATH
+	AdminSocketPath string      // Unix socket for the admin/ops API, read from ADMIN_SOCKET_PATH
+	SocketMode      os.FileMode // Permissions applied to any socket we create, read from SOCKET_MODE as octal (Default 0660)
+
+	// SessionKey encrypts the credentials stored with each session, read from SESSION_KEY as 32 base64 encoded bytes.
+	// Generate one with `openssl rand -base64 32`
+	SessionKey []byte
+	// SessionKeyID identifies SessionKey among our session keys, read from SESSION_KEY_ID (1-255, Default 1). When
+	// rotating keys, give the new SESSION_KEY a new ID and move the old one to SESSION_OLD_KEYS.
+	SessionKeyID byte
+	// SessionOldKeys are keys that credentials may still be encrypted with, by ID, until they've been re-encrypted with
+	// SessionKey. Read from SESSION_OLD_KEYS as a comma separated list of id=key pairs, keys being base64 encoded
+	SessionOldKeys map[byte][]byte
+	// SessionRekeyInterval is how often sessions still using an old key are re-encrypted with SessionKey, read from
+	// SESSION_REKEY_INTERVAL (Default 1h)
+	SessionRekeyInterval time.Duration
+	// SessionTransport is how session tokens are handed to clients, read from SESSION_TRANSPORT (Default header)
+	SessionTransport string
+	// SessionMode is how sessions are kept track of, read from SESSION_MODE (Default database)
+	SessionMode string
+	// Sessions describes how long sessions last, see readSessionLifespans for the environment variables it is read from
+	Sessions SessionLifespans
+	// JWTLifetime is how long a token lasts in our JWT session mode, read from JWT_LIFETIME (Default 15m). Tokens can't
+	// be revoked, so keep this short.
+	JWTLifetime time.Duration
+	// LockoutThreshold is how many failed logins in a row lock an account, until an admin unlocks it, read from
+	// LOGIN_LOCKOUT_THRESHOLD (Default 5, set to 0 to never lock accounts)
+	LockoutThreshold int
+	// LoginThrottle slows down repeated failed logins from the same email, and LoginThrottleIP from the same IP address,
+	// see ratelimit.Throttle. Each allows a few failures (LOGIN_THROTTLE_FREE, Default 3, and LOGIN_THROTTLE_IP_FREE,
+	// Default 20, as many users may share an address), then waits LOGIN_THROTTLE_BASE (Default 1s) after the next,
+	// doubling with each failure up to LOGIN_THROTTLE_MAX (Default 15m). Set LOGIN_THROTTLE_MAX to 0 to disable
+	// throttling. Throttles are kept in Redis when RATE_LIMIT_SHARED is set.
+	LoginThrottle   ratelimit.Backoff
+	LoginThrottleIP ratelimit.Backoff
+	// SessionRenewAfter is how much of a session's idle timeout (as a percentage) must have passed before using it
+	// pushes its expiration back, read from SESSION_RENEW_AFTER_PERCENT (Default 50). Renewing on every request costs a
+	// database write per request, so it's worth letting a little time pass first. Set to 0 to renew on every request.
+	SessionRenewAfter int
+	// SessionRefreshHint adds hints to the 401 response for an expired session that refreshing it may get the client
+	// going again, read from SESSION_REFRESH_HINT (Default false). See sessionExpired.
+	SessionRefreshHint bool
+	// SessionFingerprint binds database backed sessions to the client that logged in (their User-Agent, and roughly
+	// where their IP address is), read from SESSION_FINGERPRINT as off, log or enforce (Default off). A stolen session
+	// token is then much harder to use from elsewhere. Users whose browser updates, or who move networks, have to log in
+	// again under enforce, so try log first to see how often that would happen. Can be changed by reloading.
+	SessionFingerprint string
+
+	// RedisURL points at a Redis server used to cache session lookups, read from REDIS_URL (e.g.
+	// redis://localhost:6379/0). Running a Redis replica in each region saves authenticated requests a round trip to a
+	// database in another region. Sessions are only cached if this is set. Rate limits, queued jobs and the sessions
+	// themselves can be kept here too, see RateLimitShared, JobQueue and SessionStore.
+	RedisURL string
+	// SessionCacheTTL is the longest a session is cached for, read from SESSION_CACHE_TTL (Default 5m)
+	SessionCacheTTL time.Duration
+	// UserCacheTTL is how long each instance keeps Users it has loaded in memory, read from USER_CACHE_TTL (Default
+	// 5s, 0 turns the cache off). Changes made by another instance take up to this long to be seen, such as a User
+	// being disabled, see database/usercache.
+	UserCacheTTL time.Duration
+	// TenantCacheTTL is how long each instance keeps tenant settings (and which tenants each User belongs to) in memory,
+	// read from TENANT_CACHE_TTL (Default 1m). Changes made through another instance take up to this long to be seen,
+	// see the tenants package.
+	TenantCacheTTL time.Duration
+	// JobQueue is where queued jobs (such as emails to send) are kept, read from JOB_QUEUE (Default database)
+	JobQueue string
+	// SessionStore is where sessions and refresh tokens are kept, read from SESSION_STORE (Default database). Moving them
+	// to Redis logs everyone out, as existing sessions aren't copied across.
+	SessionStore string
+
+	// Each client may make RateLimit requests to the public API every RateLimitWindow, read from RATE_LIMIT (Default 300,
+	// set to 0 to disable rate limiting) and RATE_LIMIT_WINDOW (Default 1m)
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitBurst is how many requests a client may make in quick succession, read from RATE_LIMIT_BURST (Default
+	// RATE_LIMIT). Raise it above RATE_LIMIT to allow short bursts without raising the average rate.
+	RateLimitBurst int
+	// RateLimitWarmUp is how long newly created keys take to reach their full limits, read from RATE_LIMIT_WARM_UP
+	// (Default 0, no warm-up)
+	RateLimitWarmUp time.Duration
+	// RateLimitShared keeps rate limits in Redis (at REDIS_URL), read from RATE_LIMIT_SHARED (Default false). Shared
+	// limits apply across every instance of our API and survive restarts, otherwise each instance keeps its own in
+	// memory, and a rolling deploy hands every client a fresh limit.
+	RateLimitShared bool
+	// BillingEnabled turns on per-plan rate limits, read from BILLING_ENABLED (Default false)
+	BillingEnabled bool
+	// RateLimitPlans gives clients on each billing plan their own limits, read from RATE_LIMIT_PLANS as a comma
+	// separated list of plan=limit or plan=limit:burst pairs (e.g. free=60,pro=600:1000). Plans share RATE_LIMIT_WINDOW
+	// and RATE_LIMIT_WARM_UP, and are only used when BILLING_ENABLED is set.
+	RateLimitPlans map[string]ratelimit.Plan
+
+	// MaxInFlight caps how many requests the public API works on at once, read from MAX_IN_FLIGHT (Default 500, set to 0
+	// for no cap). Requests beyond the cap are turned away with a 503 status rather than queued.
+	MaxInFlight int
+	// MaxInFlightGroups caps requests in flight for groups of routes, read from MAX_IN_FLIGHT_GROUPS as a comma separated
+	// list of group=limit pairs (e.g. users=100,login=20). A route's group is the first segment of its path.
+	MaxInFlightGroups map[string]int
+
+	// TrustedProxies lists the reverse proxies and load balancers in front of us, read from TRUSTED_PROXIES as a comma
+	// separated list of IP addresses or CIDR ranges (e.g. 10.0.0.0/8,192.168.1.10). Only requests arriving from one of
+	// these may tell us the real client IP with the X-Forwarded-For or Forwarded headers, anyone else could simply
+	// make those headers up. Leave empty if clients connect to us directly.
+	TrustedProxies []netip.Prefix
+
+	// QueryWarnThreshold logs a warning for any request making more database calls than this, read from
+	// QUERY_WARN_THRESHOLD (Default 20, set to 0 to disable). Every request's count is also recorded in our metrics. Can
+	// be changed by reloading.
+	QueryWarnThreshold int
+	// MetricsRoutes lists the routes our request metrics are labelled with one by one, read from METRICS_ROUTES as a
+	// comma separated list of route templates (e.g. /login/,/users/{username}). Requests for any other route are
+	// labelled "other", so there are fewer time series to keep. Default every route we serve.
+	MetricsRoutes []string
+
+	// MaintenanceUntil puts the public API into maintenance mode until the given time, read from MAINTENANCE_UNTIL in
+	// RFC 3339 format (e.g. 2024-01-02T15:04:05Z). While in maintenance mode every request gets a 503 status. Can be
+	// changed by reloading.
+	MaintenanceUntil time.Time
+
+	// MirrorURL is a shadow deployment (such as a new version of our API) that copies of our requests are sent to, read
+	// from MIRROR_URL, including any base path it's mounted under. Nothing is mirrored unless this is set, see the
+	// mirror package for what is sent.
+	MirrorURL string
+	// MirrorPercent is the share of requests mirrored to MirrorURL, read from MIRROR_PERCENT (0-100, Default 1). Can be
+	// changed by reloading, set to 0 to pause mirroring.
+	MirrorPercent int
+
+	// DegradedMode keeps us useful while our database is briefly unreachable, rather than answering everything with a
+	// 503, read from DEGRADED_MODE (Default false). Reads are answered with the last copy we served the same client, and
+	// some writes are queued to be applied once it's back (see degraded.go). Can be changed by reloading.
+	DegradedMode bool
+	// DegradedMaxStale is the oldest copy of a read we'll serve in degraded mode, read from DEGRADED_MAX_STALE (Default
+	// 10m). Can be changed by reloading.
+	DegradedMaxStale time.Duration
+
+	// FrontendURL is where our frontend is hosted, used to build links in the emails we send, read from FRONTEND_URL
+	// (Default http://localhost:3000)
+	FrontendURL string
+	// PublicURL is where clients reach our public API, used to build links back to ourselves (such as where OAuth
+	// providers send Users after they sign in), read from PUBLIC_URL (Default http://localhost:8080). Leave BasePath off
+	// the end, it's added for us.
+	PublicURL string
+	// FrontendOrigins are the origins (such as https://app.example.com) our frontend is served from, read from
+	// FRONTEND_ORIGINS as a comma separated list (Default FrontendURL's origin). Used to work out our cookie settings,
+	// and to check they fit with CORSOrigins (see CookieWarnings).
+	FrontendOrigins []string
+	// CORSOrigins are the origins browsers may call our API from, read from CORS_ORIGINS as a comma separated list
+	// (Default *, any origin). Cookies are never sent cross-origin to a wildcard, so list them when using cookies.
+	CORSOrigins []string
+	// Cookies describes our session cookies, see CookieSettings for the environment variables it is read from
+	Cookies CookieSettings
+	// BasePath is the path our whole public API is mounted under, for ingresses that route to services by path prefix
+	// (such as /api/backend), read from BASE_PATH (Default empty, mounted at the root). Requests outside it get a 404,
+	// and the links and cookies we hand out include it.
+	BasePath string
+
+	// OAuth holds the client credentials for each OAuth provider Users may log in with, keyed by provider name. Read from
+	// GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET, and GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET. A provider is only
+	// enabled once its client ID is set.
+	OAuth map[string]OAuthClient
+
+	// Email describes how the addresses Users sign up and change to are checked, see readEmail for the environment
+	// variables it is read from
+	Email emailaddr.Options
+
+	// InstallLinks maps each platform to the link for installing our app on it, read from INSTALL_LINKS as a comma
+	// separated list of platform=link pairs (e.g. ios=https://apps.apple.com/...,android=https://play.google.com/...)
+	InstallLinks map[string]string
+
+	// DownloadsDir is the directory our downloadable files (avatars, exports, etc) are served from, read from
+	// DOWNLOADS_DIR. Downloads are disabled if it isn't set.
+	DownloadsDir string
+
+	// Outgoing email settings. If SMTPAddr is empty, emails are written to our logs instead of being sent.
+	SMTPAddr     string // Address of our SMTP server including port, read from SMTP_ADDR
+	SMTPUsername string // Read from SMTP_USERNAME, leave empty if the SMTP server doesn't require authentication
+	SMTPPassword string // Read from SMTP_PASSWORD
+	MailFrom     string // Address our emails are sent from, read from MAIL_FROM (Default noreply@example.com)
+
+	// OTLPMetrics pushes our metrics to an OpenTelemetry collector, in addition to serving them for Prometheus. This is
+	// enabled by setting either of the standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_METRICS_ENDPOINT
+	// variables, metrics are pushed every OTLPMetricsInterval, read from OTLP_METRICS_INTERVAL (Default 30s)
+	OTLPMetrics         bool
+	OTLPMetricsInterval time.Duration
+	// Tracing exports traces of our requests to an OpenTelemetry collector, enabled by setting either of the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables. See readTraceSampling for how much is
+	// traced, requests failing with a server error always are.
+	Tracing bool
+	// TraceSampleRate is the share of requests traced (0-1) in any group of routes without a rate in TraceSampleRates
+	TraceSampleRate float64
+	// TraceSampleRates is the share of requests traced (0-1) by group of routes, the first segment of a route's path as
+	// for MAX_IN_FLIGHT_GROUPS. Both can be changed while running through our admin endpoints.
+	TraceSampleRates map[string]float64
+
+	// Retention describes how long we keep old records, see readRetention for the environment variables it is read from
+	Retention Retention
+
+	// Log describes where our logs are written, see readLogging for the environment variables it is read from
+	Log logging.Config
+	// LogBufferSize is how many recent log entries we keep in memory for our admin endpoints, read from
+	// LOG_BUFFER_SIZE (Default 1000)
+	LogBufferSize int
+	// ErrorBufferSize is how many recent server side errors we keep in memory for our admin endpoints, read from
+	// ERROR_BUFFER_SIZE (Default 100)
+	ErrorBufferSize int
+
+	// RecordDir is a directory every request to the public API (and its response) is recorded to, for replaying with
+	// cmd/replay, read from RECORD_DIR. Only available in dev builds (go build -tags dev).
+	RecordDir string
+
+	// AdminToken must be sent as a bearer token to use the endpoints under /admin on our admin listener, read from
+	// ADMIN_TOKEN. Those endpoints are disabled if it isn't set. Generate one with `openssl rand -base64 32`
+	AdminToken string
+}
+
+// OAuthClient is the client ID and secret an OAuth provider issued us.
+type OAuthClient struct {
+	ID     string
+	Secret string
+}
+
+// SessionLifespans describes how long sessions last. Users who tick "remember me" when logging in get the longer
+// Remember lifespans, everyone else gets the default ones.
+type SessionLifespans struct {
+	IdleTimeout         time.Duration // How long a session lasts without being used, each use pushes its expiration back
+	MaxLifetime         time.Duration // The absolute limit on a session, no amount of activity extends it past this
+	RememberIdleTimeout time.Duration // IdleTimeout for remembered sessions
+	RememberLifetime    time.Duration // MaxLifetime for remembered sessions, also how long their refresh tokens last
+}
+
+// Retention describes how long we keep each kind of record before it's purged. A max age of 0 keeps records forever.
+type Retention struct {
+	AuditLog     time.Duration // Audit entries older than this are purged
+	EmailChanges time.Duration // Pending email changes are purged once they've been expired this long
+	Interval     time.Duration // How often our retention policies are enforced
+	DryRun       bool          // Only count and log what would be purged, without deleting anything
+}
+
+// FromEnv reads our configuration from environment variables (and CONFIG_FILE, if set), filling in defaults and
+// validating anything required.
+func FromEnv() (Config, error) {
+	// Settings in our config file take precedence, see snapshot.go
+	if err := applyConfigFile(); err != nil {
+		return Config{}, err
+	}
+	cfg := Config{
+		TestDependency: os.Getenv("TEST_ENVIRONMENT_VARIABLE"),
+		DatabaseURL:    os.Getenv("DATABASE_URL"),
+		Port:           getenv("PORT", "8080"),
+		AdminPort:      getenv("ADMIN_PORT", "9090"),
+		SecretsDir:     os.Getenv("SECRETS_DIR"),
+		ShardURLs:      splitList(os.Getenv("SHARD_URLS")),
+
+		SocketPath:      os.Getenv("SOCKET_PATH"),
+		AdminSocketPath: os.Getenv("ADMIN_SOCKET_PATH"),
+
+		FrontendURL: strings.TrimSuffix(getenv("FRONTEND_URL", "http://localhost:3000"), "/"),
+		PublicURL:   strings.TrimSuffix(getenv("PUBLIC_URL", "http://localhost:8080"), "/"),
+
+		DownloadsDir: os.Getenv("DOWNLOADS_DIR"),
+
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		MailFrom:     getenv("MAIL_FROM", "noreply@example.com"),
+
+		SessionTransport:   getenv("SESSION_TRANSPORT", TransportHeader),
+		SessionMode:        getenv("SESSION_MODE", SessionModeDatabase),
+		SessionFingerprint: getenv("SESSION_FINGERPRINT", FingerprintOff),
+		JobQueue:           getenv("JOB_QUEUE", JobQueueDatabase),
+		SessionStore:       getenv("SESSION_STORE", SessionStoreDatabase),
+		RedisURL:           os.Getenv("REDIS_URL"),
+
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+		RecordDir:  os.Getenv("RECORD_DIR"),
+	}
+
+	// Socket permissions are written in octal, just like you would with chmod
+	mode, err := strconv.ParseUint(getenv("SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		return Config{}, fmt.Errorf("SOCKET_MODE must be an octal file mode: %w", err)
+	}
+	cfg.SocketMode = os.FileMode(mode)
+
+	if cfg.BasePath, err = readBasePath(); err != nil {
+		return Config{}, err
+	}
+	if err := readOrigins(&cfg); err != nil {
+		return Config{}, err
+	}
+	if cfg.Cookies, err = readCookies(cfg); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SessionKey, err = base64.StdEncoding.DecodeString(os.Getenv("SESSION_KEY")); err != nil {
+		return Config{}, fmt.Errorf("SESSION_KEY must be base64 encoded: %w", err)
+	}
+	if len(cfg.SessionKey) != encryption.KeySize {
+		return Config{}, fmt.Errorf("SESSION_KEY is required, and must be %d bytes", encryption.KeySize)
+	}
+	if cfg.SessionKeyID, cfg.SessionOldKeys, err = readSessionKeyIDs(); err != nil {
+		return Config{}, err
+	}
+	if cfg.SessionRekeyInterval, err = getenvDuration("SESSION_REKEY_INTERVAL", time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.MigrateOnStart, err = getenvBool("MIGRATE_ON_START", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBCredentialsInterval, err = getenvDuration("DB_CREDENTIALS_INTERVAL", time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBMaxOpenConns, err = getenvInt("DB_MAX_OPEN_CONNS", 20); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBMaxIdleConns, err = getenvInt("DB_MAX_IDLE_CONNS", 10); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnMaxLifetime, err = getenvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnMaxIdleTime, err = getenvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBMaxOpenConns < 1 || cfg.DBMaxIdleConns < 1 {
+		return Config{}, errors.New("DB_MAX_OPEN_CONNS and DB_MAX_IDLE_CONNS must be at least 1")
+	}
+	if cfg.DBConnMaxLifetime <= 0 || cfg.DBConnMaxIdleTime <= 0 {
+		return Config{}, errors.New("DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME must be positive")
+	}
+	if cfg.DBMaxIdleConns > cfg.DBMaxOpenConns {
+		return Config{}, errors.New("DB_MAX_IDLE_CONNS can't be more than DB_MAX_OPEN_CONNS")
+	}
+	if cfg.DBPrepareStatements, err = getenvBool("DB_PREPARE_STATEMENTS", true); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnectAttempts, err = getenvInt("DB_CONNECT_ATTEMPTS", 10); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnectBackoff, err = getenvDuration("DB_CONNECT_BACKOFF", 500*time.Millisecond); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnectMaxBackoff, err = getenvDuration("DB_CONNECT_MAX_BACKOFF", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBConnectAttempts < 1 {
+		return Config{}, errors.New("DB_CONNECT_ATTEMPTS must be at least 1")
+	}
+	if cfg.DBConnectBackoff <= 0 || cfg.DBConnectMaxBackoff < cfg.DBConnectBackoff {
+		return Config{}, errors.New("DB_CONNECT_BACKOFF must be positive, and no more than DB_CONNECT_MAX_BACKOFF")
+	}
+	if cfg.WarmUp, err = getenvBool("WARM_UP", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.WarmUpUsers, err = getenvInt("WARM_UP_USERS", 100); err != nil {
+		return Config{}, err
+	}
+	if cfg.WarmUpTimeout, err = getenvDuration("WARM_UP_TIMEOUT", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.WarmUpUsers < 0 || cfg.WarmUpTimeout <= 0 {
+		return Config{}, errors.New("WARM_UP_USERS must not be negative, and WARM_UP_TIMEOUT must be positive")
+	}
+	if cfg.SessionTransport != TransportHeader && cfg.SessionTransport != TransportCookie {
+		return Config{}, fmt.Errorf("SESSION_TRANSPORT must be %q or %q", TransportHeader, TransportCookie)
+	}
+
+	if cfg.SessionMode != SessionModeDatabase && cfg.SessionMode != SessionModeJWT {
+		return Config{}, fmt.Errorf("SESSION_MODE must be %q or %q", SessionModeDatabase, SessionModeJWT)
+	}
+	switch cfg.SessionFingerprint {
+	case FingerprintOff, FingerprintLog, FingerprintEnforce:
+	default:
+		return Config{}, fmt.Errorf("SESSION_FINGERPRINT must be %q, %q or %q", FingerprintOff, FingerprintLog, FingerprintEnforce)
+	}
+	if cfg.Sessions, err = readSessionLifespans(); err != nil {
+		return Config{}, err
+	}
+	if cfg.JWTLifetime, err = getenvDuration("JWT_LIFETIME", 15*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.JWTLifetime <= 0 {
+		return Config{}, errors.New("JWT_LIFETIME must be positive")
+	}
+
+	if cfg.LockoutThreshold, err = getenvInt("LOGIN_LOCKOUT_THRESHOLD", 5); err != nil {
+		return Config{}, err
+	}
+	if cfg.LockoutThreshold < 0 {
+		return Config{}, errors.New("LOGIN_LOCKOUT_THRESHOLD must not be negative")
+	}
+	if cfg.LoginThrottle.Free, err = getenvInt("LOGIN_THROTTLE_FREE", 3); err != nil {
+		return Config{}, err
+	}
+	if cfg.LoginThrottleIP.Free, err = getenvInt("LOGIN_THROTTLE_IP_FREE", 20); err != nil {
+		return Config{}, err
+	}
+	if cfg.LoginThrottle.Free < 0 || cfg.LoginThrottleIP.Free < 0 {
+		return Config{}, errors.New("LOGIN_THROTTLE_FREE and LOGIN_THROTTLE_IP_FREE must not be negative")
+	}
+	if cfg.LoginThrottle.Base, err = getenvDuration("LOGIN_THROTTLE_BASE", time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.LoginThrottle.Max, err = getenvDuration("LOGIN_THROTTLE_MAX", 15*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.LoginThrottle.Base <= 0 || cfg.LoginThrottle.Max < 0 {
+		return Config{}, errors.New("LOGIN_THROTTLE_BASE must be positive, and LOGIN_THROTTLE_MAX not negative")
+	}
+	cfg.LoginThrottleIP.Base, cfg.LoginThrottleIP.Max = cfg.LoginThrottle.Base, cfg.LoginThrottle.Max
+	if cfg.SessionRenewAfter, err = getenvInt("SESSION_RENEW_AFTER_PERCENT", 50); err != nil {
+		return Config{}, err
+	}
+	if cfg.SessionRenewAfter < 0 || cfg.SessionRenewAfter > 100 {
+		return Config{}, errors.New("SESSION_RENEW_AFTER_PERCENT must be between 0 and 100")
+	}
+	if cfg.SessionRefreshHint, err = getenvBool("SESSION_REFRESH_HINT", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.UserCacheTTL, err = getenvDuration("USER_CACHE_TTL", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.SessionCacheTTL, err = getenvDuration("SESSION_CACHE_TTL", 5*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.TenantCacheTTL, err = getenvDuration("TENANT_CACHE_TTL", time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.RateLimit, err = getenvInt("RATE_LIMIT", 300); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitWindow, err = getenvDuration("RATE_LIMIT_WINDOW", time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitWindow <= 0 {
+		return Config{}, errors.New("RATE_LIMIT_WINDOW must be positive")
+	}
+	if cfg.RateLimitBurst, err = getenvInt("RATE_LIMIT_BURST", cfg.RateLimit); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitWarmUp, err = getenvDuration("RATE_LIMIT_WARM_UP", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitShared, err = getenvBool("RATE_LIMIT_SHARED", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitShared && cfg.RedisURL == "" {
+		return Config{}, errors.New("REDIS_URL is required when RATE_LIMIT_SHARED is set")
+	}
+	if cfg.JobQueue != JobQueueDatabase && cfg.JobQueue != JobQueueRedis {
+		return Config{}, fmt.Errorf("JOB_QUEUE must be %q or %q", JobQueueDatabase, JobQueueRedis)
+	}
+	if cfg.JobQueue == JobQueueRedis && cfg.RedisURL == "" {
+		return Config{}, errors.New("REDIS_URL is required when JOB_QUEUE is redis")
+	}
+	if cfg.SessionStore != SessionStoreDatabase && cfg.SessionStore != SessionStoreRedis {
+		return Config{}, fmt.Errorf("SESSION_STORE must be %q or %q", SessionStoreDatabase, SessionStoreRedis)
+	}
+	if cfg.SessionStore == SessionStoreRedis && cfg.RedisURL == "" {
+		return Config{}, errors.New("REDIS_URL is required when SESSION_STORE is redis")
+	}
+	if cfg.BillingEnabled, err = getenvBool("BILLING_ENABLED", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitPlans, err = readRateLimitPlans(cfg.RateLimitWindow, cfg.RateLimitWarmUp); err != nil {
+		return Config{}, err
+	}
+	if cfg.MaxInFlight, err = getenvInt("MAX_IN_FLIGHT", 500); err != nil {
+		return Config{}, err
+	}
+	if cfg.MaxInFlightGroups, err = readMaxInFlightGroups(); err != nil {
+		return Config{}, err
+	}
+	if cfg.QueryWarnThreshold, err = getenvInt("QUERY_WARN_THRESHOLD", 20); err != nil {
+		return Config{}, err
+	}
+	if cfg.QueryWarnThreshold < 0 {
+		return Config{}, errors.New("QUERY_WARN_THRESHOLD must not be negative")
+	}
+	for _, route := range strings.Split(os.Getenv("METRICS_ROUTES"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			cfg.MetricsRoutes = append(cfg.MetricsRoutes, route)
+		}
+	}
+	if cfg.TrustedProxies, err = readTrustedProxies(); err != nil {
+		return Config{}, err
+	}
+	if until := os.Getenv("MAINTENANCE_UNTIL"); until != "" {
+		if cfg.MaintenanceUntil, err = clock.Parse(until); err != nil {
+			return Config{}, fmt.Errorf("MAINTENANCE_UNTIL must be an RFC 3339 timestamp: %w", err)
+		}
+	}
+
+	if cfg.MirrorURL = os.Getenv("MIRROR_URL"); cfg.MirrorURL != "" {
+		if u, err := url.Parse(cfg.MirrorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, errors.New("MIRROR_URL must be an http or https URL")
+		}
+	}
+	if cfg.MirrorPercent, err = getenvInt("MIRROR_PERCENT", 1); err != nil {
+		return Config{}, err
+	}
+	if cfg.MirrorPercent < 0 || cfg.MirrorPercent > 100 {
+		return Config{}, errors.New("MIRROR_PERCENT must be between 0 and 100")
+	}
+
+	if cfg.DegradedMode, err = getenvBool("DEGRADED_MODE", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.DegradedMaxStale, err = getenvDuration("DEGRADED_MAX_STALE", 10*time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	cfg.OTLPMetrics = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") != ""
+	if cfg.OTLPMetricsInterval, err = getenvDuration("OTLP_METRICS_INTERVAL", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	cfg.Tracing = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	if cfg.TraceSampleRate, cfg.TraceSampleRates, err = readTraceSampling(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.InstallLinks, err = getenvMap("INSTALL_LINKS"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.OAuth, err = readOAuth(); err != nil {
+		return Config{}, err
+	}
+	if cfg.Email, err = readEmail(); err != nil {
+		return Config{}, err
+	}
+	if cfg.Retention, err = readRetention(); err != nil {
+		return Config{}, err
+	}
+	if cfg.Log, err = readLogging(); err != nil {
+		return Config{}, err
+	}
+	if cfg.LogBufferSize, err = getenvInt("LOG_BUFFER_SIZE", 1000); err != nil {
+		return Config{}, err
+	}
+	if cfg.LogBufferSize < 0 {
+		return Config{}, errors.New("LOG_BUFFER_SIZE must not be negative")
+	}
+	if cfg.ErrorBufferSize, err = getenvInt("ERROR_BUFFER_SIZE", 100); err != nil {
+		return Config{}, err
+	}
+	if cfg.ErrorBufferSize < 0 {
+		return Config{}, errors.New("ERROR_BUFFER_SIZE must not be negative")
+	}
+
+	// Validate anything that is required for this service to run
+	if cfg.TestDependency == "" {
+		return Config{}, errors.New("TEST_ENVIRONMENT_VARIABLE is required for this service to run")
+	}
+	// Our operational endpoints should never share a listener with the public API, otherwise they could end up
+	// exposed through the public load balancer
+	if cfg.SocketPath == "" && cfg.AdminSocketPath == "" && cfg.Port == cfg.AdminPort {
+		return Config{}, errors.New("ADMIN_PORT must be different from PORT")
+	}
+	if cfg.SocketPath != "" && cfg.SocketPath == cfg.AdminSocketPath {
+		return Config{}, errors.New("ADMIN_SOCKET_PATH must be different from SOCKET_PATH")
+	}
+	return cfg, nil
+}
+
+// readLogging reads our logging configuration. LOG_OUTPUTS is a comma separated list of "stdout", "file" and "syslog".
+func readLogging() (logging.Config, error) {
+	cfg := logging.Config{
+		Outputs:       strings.Split(getenv("LOG_OUTPUTS", logging.OutputStdout), ","),
+		File:          os.Getenv("LOG_FILE"),
+		SyslogNetwork: os.Getenv("SYSLOG_NETWORK"),
+		SyslogAddress: os.Getenv("SYSLOG_ADDRESS"),
+		SyslogTag:     getenv("SYSLOG_TAG", "examples"),
+	}
+	var err error
+	if cfg.MaxSizeMB, err = getenvInt("LOG_MAX_SIZE_MB", 100); err != nil {
+		return logging.Config{}, err
+	}
+	if cfg.MaxBackups, err = getenvInt("LOG_MAX_BACKUPS", 5); err != nil {
+		return logging.Config{}, err
+	}
+	if cfg.MaxAgeDays, err = getenvInt("LOG_MAX_AGE_DAYS", 28); err != nil {
+		return logging.Config{}, err
+	}
+	if cfg.Compress, err = getenvBool("LOG_COMPRESS", false); err != nil {
+		return logging.Config{}, err
+	}
+	return cfg, nil
+}
+
+// readEmail reads how we check email addresses from EMAIL_STRIP_PLUS_TAGS (Default false), EMAIL_CHECK_MX (Default
+// false), and EMAIL_BLOCKLIST, a comma separated list of disposable email domains to refuse on top of our defaults.
+func readEmail() (emailaddr.Options, error) {
+	var (
+		opts emailaddr.Options
+		err  error
+	)
+	if opts.StripPlusTags, err = getenvBool("EMAIL_STRIP_PLUS_TAGS", false); err != nil {
+		return emailaddr.Options{}, err
+	}
+	if opts.CheckMX, err = getenvBool("EMAIL_CHECK_MX", false); err != nil {
+		return emailaddr.Options{}, err
+	}
+	for _, domain := range strings.Split(os.Getenv("EMAIL_BLOCKLIST"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			opts.Blocklist = append(opts.Blocklist, domain)
+		}
+	}
+	return opts, nil
+}
+
+// readMaxInFlightGroups reads the per group caps on requests in flight from MAX_IN_FLIGHT_GROUPS.
+func readMaxInFlightGroups() (map[string]int, error) {
+	pairs, err := getenvMap("MAX_IN_FLIGHT_GROUPS")
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]int, len(pairs))
+	for group, value := range pairs {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("MAX_IN_FLIGHT_GROUPS limit for %s must be a positive whole number", group)
+		}
+		groups[group] = n
+	}
+	return groups, nil
+}
+
+// defaultTraceSampleRates are used when TRACE_SAMPLE_RATES isn't set: every login is traced, and hardly any of the
+// health checks and metrics scrapes polled every few seconds
+const defaultTraceSampleRates = "login=1,healthz=0.01,readyz=0.01,metrics=0.01"
+
+// readTraceSampling reads how much of our traffic is traced, from TRACE_SAMPLE_RATE (Default 0.1) for any group of
+// routes not listed in TRACE_SAMPLE_RATES, a comma separated list of group=rate pairs (see defaultTraceSampleRates).
+// Rates are between 0 (nothing) and 1 (every request).
+func readTraceSampling() (float64, map[string]float64, error) {
+	rate, err := strconv.ParseFloat(getenv("TRACE_SAMPLE_RATE", "0.1"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, nil, errors.New("TRACE_SAMPLE_RATE must be a number between 0 and 1")
+	}
+	pairs, err := parseMap("TRACE_SAMPLE_RATES", getenv("TRACE_SAMPLE_RATES", defaultTraceSampleRates))
+	if err != nil {
+		return 0, nil, err
+	}
+	groups := make(map[string]float64, len(pairs))
+	for group, value := range pairs {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 || n > 1 {
+			return 0, nil, fmt.Errorf("TRACE_SAMPLE_RATES rate for %s must be a number between 0 and 1", group)
+		}
+		groups[group] = n
+	}
+	return rate, groups, nil
+}
+
+// readOAuth reads the client credentials for each OAuth provider that has a client ID set, from <PROVIDER>_CLIENT_ID
+// and <PROVIDER>_CLIENT_SECRET.
+func readOAuth() (map[string]OAuthClient, error) {
+	clients := make(map[string]OAuthClient)
+	for _, provider := range []string{"google", "github"} {
+		prefix := strings.ToUpper(provider)
+		client := OAuthClient{ID: os.Getenv(prefix + "_CLIENT_ID"), Secret: os.Getenv(prefix + "_CLIENT_SECRET")}
+		if client.ID == "" {
+			continue
+		}
+		if client.Secret == "" {
+			return nil, fmt.Errorf("%s_CLIENT_SECRET is required when %s_CLIENT_ID is set", prefix, prefix)
+		}
+		clients[provider] = client
+	}
+	return clients, nil
+}
+
+// readSessionLifespans reads how long sessions last from SESSION_IDLE_TIMEOUT (Default 30m), SESSION_MAX_LIFETIME
+// (Default 24h), SESSION_REMEMBER_IDLE_TIMEOUT (Default 168h, 7 days) and SESSION_REMEMBER_LIFETIME (Default 720h, 30
+// days). Like our retention policies, these are in Go's duration format, so use hours rather than days.
+func readSessionLifespans() (SessionLifespans, error) {
+	var (
+		cfg SessionLifespans
+		err error
+	)
+	if cfg.IdleTimeout, err = getenvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute); err != nil {
+		return SessionLifespans{}, err
+	}
+	if cfg.MaxLifetime, err = getenvDuration("SESSION_MAX_LIFETIME", 24*time.Hour); err != nil {
+		return SessionLifespans{}, err
+	}
+	if cfg.RememberIdleTimeout, err = getenvDuration("SESSION_REMEMBER_IDLE_TIMEOUT", 7*24*time.Hour); err != nil {
+		return SessionLifespans{}, err
+	}
+	if cfg.RememberLifetime, err = getenvDuration("SESSION_REMEMBER_LIFETIME", 30*24*time.Hour); err != nil {
+		return SessionLifespans{}, err
+	}
+	if cfg.IdleTimeout <= 0 || cfg.MaxLifetime <= 0 || cfg.RememberIdleTimeout <= 0 || cfg.RememberLifetime <= 0 {
+		return SessionLifespans{}, errors.New("session lifespans must be positive")
+	}
+	// An idle timeout longer than the session's lifetime would never come into play, which is probably a mistake
+	if cfg.IdleTimeout > cfg.MaxLifetime {
+		return SessionLifespans{}, errors.New("SESSION_IDLE_TIMEOUT must not be longer than SESSION_MAX_LIFETIME")
+	}
+	if cfg.RememberIdleTimeout > cfg.RememberLifetime {
+		return SessionLifespans{}, errors.New("SESSION_REMEMBER_IDLE_TIMEOUT must not be longer than SESSION_REMEMBER_LIFETIME")
+	}
+	return cfg, nil
+}
+
+// readRetention reads our retention policies from RETENTION_AUDIT_LOG (Default 2160h, 90 days), RETENTION_EMAIL_CHANGES
+// (Default 168h, 7 days), RETENTION_INTERVAL (Default 1h) and RETENTION_DRY_RUN (Default false). Durations are in Go's
+// duration format, which doesn't have days, so use hours.
+func readRetention() (Retention, error) {
+	var (
+		cfg Retention
+		err error
+	)
+	if cfg.AuditLog, err = getenvDuration("RETENTION_AUDIT_LOG", 90*24*time.Hour); err != nil {
+		return Retention{}, err
+	}
+	if cfg.EmailChanges, err = getenvDuration("RETENTION_EMAIL_CHANGES", 7*24*time.Hour); err != nil {
+		return Retention{}, err
+	}
+	if cfg.Interval, err = getenvDuration("RETENTION_INTERVAL", time.Hour); err != nil {
+		return Retention{}, err
+	}
+	if cfg.Interval <= 0 {
+		return Retention{}, errors.New("RETENTION_INTERVAL must be positive")
+	}
+	if cfg.DryRun, err = getenvBool("RETENTION_DRY_RUN", false); err != nil {
+		return Retention{}, err
+	}
+	return cfg, nil
+}
+
+// getenv returns the value of the named environment variable, or the fallback if it is not set.
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// readBasePath reads BASE_PATH, tidied into the form we use it in: starting with a slash but not ending with one, or
+// empty to mount our API at the root.
+func readBasePath() (string, error) {
+	base := strings.TrimSpace(os.Getenv("BASE_PATH"))
+	if base == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(base, "?#%") {
+		return "", errors.New("BASE_PATH must be a plain path, such as /api/backend")
+	}
+	base = path.Clean("/" + base)
+	if base == "/" {
+		return "", nil
+	}
+	return base, nil
+}
+
+// getenvInt returns the value of the named environment variable as an int, or the fallback if it is not set.
+func getenvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a whole number: %w", key, err)
+	}
+	return i, nil
+}
+
+// getenvBool returns the value of the named environment variable as a bool, or the fallback if it is not set.
+func getenvBool(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false: %w", key, err)
+	}
+	return b, nil
+}
+
+// getenvDuration returns the value of the named environment variable as a duration (such as "10m" or "1h30m"), or the
+// fallback if it is not set.
+func getenvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 30s or 10m: %w", key, err)
+	}
+	return d, nil
+}
+
+// getenvMap returns the value of the named environment variable as a map, read from a comma separated list of
+// key=value pairs. Returns an empty map if it is not set.
+func getenvMap(key string) (map[string]string, error) {
+	return parseMap(key, os.Getenv(key))
+}
+
+// parseMap reads a comma separated list of key=value pairs, as found in the named environment variable, into a map.
+func parseMap(key, value string) (map[string]string, error) {
+	m := make(map[string]string)
+	if value == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("%s must be a comma separated list of key=value pairs", key)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// readRateLimitPlans reads RATE_LIMIT_PLANS, every plan shares the given window and warm-up.
+func readRateLimitPlans(window, warmUp time.Duration) (map[string]ratelimit.Plan, error) {
+	values, err := getenvMap("RATE_LIMIT_PLANS")
+	if err != nil {
+		return nil, err
+	}
+	invalid := errors.New("RATE_LIMIT_PLANS must be a comma separated list of plan=limit or plan=limit:burst pairs, with positive limits")
+	plans := make(map[string]ratelimit.Plan, len(values))
+	for name, value := range values {
+		limit, burst, _ := strings.Cut(value, ":")
+		plan := ratelimit.Plan{Window: window, WarmUp: warmUp}
+		if plan.Limit, err = strconv.Atoi(limit); err != nil || plan.Limit <= 0 {
+			return nil, invalid
+		}
+		if burst != "" {
+			if plan.Burst, err = strconv.Atoi(burst); err != nil || plan.Burst <= 0 {
+				return nil, invalid
+			}
+		}
+		plans[name] = plan
+	}
+	return plans, nil
+}
+
+// readSessionKeyIDs reads SESSION_KEY_ID and SESSION_OLD_KEYS, checking no old key shares the current key's ID.
+func readSessionKeyIDs() (byte, map[byte][]byte, error) {
+	id, err := strconv.ParseUint(getenv("SESSION_KEY_ID", "1"), 10, 8)
+	if err != nil || id == 0 {
+		return 0, nil, errors.New("SESSION_KEY_ID must be from 1 to 255")
+	}
+	values, err := getenvMap("SESSION_OLD_KEYS")
+	if err != nil {
+		return 0, nil, err
+	}
+	old := make(map[byte][]byte, len(values))
+	for name, value := range values {
+		oldID, err := strconv.ParseUint(name, 10, 8)
+		if err != nil || oldID == 0 || oldID == id {
+			return 0, nil, errors.New("SESSION_OLD_KEYS IDs must be from 1 to 255, and differ from SESSION_KEY_ID")
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != encryption.KeySize {
+			return 0, nil, fmt.Errorf("SESSION_OLD_KEYS keys must be %d base64 encoded bytes", encryption.KeySize)
+		}
+		old[byte(oldID)] = key
+	}
+	return byte(id), old, nil
+}
+
+// readTrustedProxies reads TRUSTED_PROXIES, accepting single IP addresses as well as CIDR ranges.
+func readTrustedProxies() ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES must be a comma separated list of IP addresses or CIDR ranges: %w", err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES must be a comma separated list of IP addresses or CIDR ranges: %w", err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
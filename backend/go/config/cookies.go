@@ -0,0 +1,192 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// SameSite modes for our session cookies, see CookieSettings
+const (
+	SameSiteAuto   = "auto"   // Worked out from our frontend origins, see readCookies
+	SameSiteLax    = "lax"    // Sent on requests from our own site, and when following a link to us
+	SameSiteStrict = "strict" // Only sent on requests from our own site
+	SameSiteNone   = "none"   // Sent on every request, needed when our frontend is on a different site to us
+)
+
+// CookieSettings describes the session cookies we set when SESSION_TRANSPORT is cookie. Whether browsers send them back
+// depends on where our frontend is hosted compared to us, so by default they're worked out from FrontendOrigins.
+type CookieSettings struct {
+	// Domain the cookies are set for, read from COOKIE_DOMAIN (Default empty, so they're only sent back to our own
+	// host, which is all our API needs)
+	Domain string
+	// SameSite is one of SameSiteLax, SameSiteStrict or SameSiteNone to use for every session cookie, or empty to keep
+	// each cookie's own default (Lax for the session, Strict for the refresh token). Read from COOKIE_SAMESITE (Default
+	// auto, which is none if any frontend origin is a different site to PublicURL, otherwise empty).
+	SameSite string
+}
+
+// readOrigins reads FRONTEND_ORIGINS and CORS_ORIGINS into cfg, which needs FrontendURL and PublicURL already set.
+func readOrigins(cfg *Config) error {
+	// Most of the time our frontend is only hosted in one place, FrontendURL
+	frontend := os.Getenv("FRONTEND_ORIGINS")
+	if frontend == "" {
+		frontend = cfg.FrontendURL
+	}
+	for _, raw := range splitList(frontend) {
+		o, err := origin(raw)
+		if err != nil {
+			return fmt.Errorf("FRONTEND_ORIGINS: %w", err)
+		}
+		cfg.FrontendOrigins = append(cfg.FrontendOrigins, o)
+	}
+
+	for _, raw := range splitList(getenv("CORS_ORIGINS", "*")) {
+		if raw == "*" {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, raw)
+			continue
+		}
+		o, err := origin(raw)
+		if err != nil {
+			return fmt.Errorf("CORS_ORIGINS: %w", err)
+		}
+		cfg.CORSOrigins = append(cfg.CORSOrigins, o)
+	}
+	if _, err := origin(cfg.PublicURL); err != nil {
+		return fmt.Errorf("PUBLIC_URL: %w", err)
+	}
+	return nil
+}
+
+// readCookies reads COOKIE_DOMAIN and COOKIE_SAMESITE, resolving SameSiteAuto against cfg's origins (see readOrigins).
+func readCookies(cfg Config) (CookieSettings, error) {
+	cookies := CookieSettings{
+		// A leading dot is how domains used to be written, browsers ignore it now
+		Domain:   strings.ToLower(strings.TrimPrefix(strings.TrimSpace(os.Getenv("COOKIE_DOMAIN")), ".")),
+		SameSite: strings.ToLower(getenv("COOKIE_SAMESITE", SameSiteAuto)),
+	}
+	if strings.ContainsAny(cookies.Domain, "/:; ") {
+		return CookieSettings{}, errors.New("COOKIE_DOMAIN must be a domain name, such as example.com")
+	}
+	switch cookies.SameSite {
+	case SameSiteLax, SameSiteStrict, SameSiteNone:
+	case SameSiteAuto:
+		cookies.SameSite = ""
+		if len(crossSiteOrigins(cfg)) > 0 {
+			cookies.SameSite = SameSiteNone
+		}
+	default:
+		return CookieSettings{}, fmt.Errorf("COOKIE_SAMESITE must be %q, %q, %q or %q", SameSiteAuto, SameSiteLax, SameSiteStrict, SameSiteNone)
+	}
+	return cookies, nil
+}
+
+// CookieWarnings returns a description of each way our CORS and cookie settings don't fit together, such as cookies
+// browsers will never send back. None of them stop us starting, as the frontend may not need what's broken (a
+// frontend only using header transport doesn't care about cookies), but they're well worth logging.
+func (cfg Config) CookieWarnings() []string {
+	var warnings []string
+	public, _ := url.Parse(cfg.PublicURL)
+	for _, o := range cfg.FrontendOrigins {
+		if !slices.Contains(cfg.CORSOrigins, "*") && !slices.Contains(cfg.CORSOrigins, o) && o != originOf(public) {
+			warnings = append(warnings, fmt.Sprintf("CORS_ORIGINS doesn't include frontend origin %s, browsers will block its requests", o))
+		}
+	}
+	if cfg.SessionTransport != TransportCookie {
+		return warnings
+	}
+
+	if public.Scheme != "https" && !isLocalhost(public.Hostname()) {
+		warnings = append(warnings, "PUBLIC_URL isn't HTTPS, browsers will refuse our session cookies as they're Secure")
+	}
+	for _, o := range cfg.FrontendOrigins {
+		if o != originOf(public) && slices.Contains(cfg.CORSOrigins, "*") {
+			warnings = append(warnings, fmt.Sprintf("browsers won't send our session cookies from %s while CORS_ORIGINS is *, list the frontend origins instead", o))
+		}
+	}
+	if cfg.Cookies.SameSite == SameSiteLax || cfg.Cookies.SameSite == SameSiteStrict {
+		for _, o := range crossSiteOrigins(cfg) {
+			warnings = append(warnings, fmt.Sprintf("COOKIE_SAMESITE=%s stops browsers sending our session cookies from %s, a different site to PUBLIC_URL", cfg.Cookies.SameSite, o))
+		}
+	}
+	if d := cfg.Cookies.Domain; d != "" {
+		if host := public.Hostname(); host != d && !strings.HasSuffix(host, "."+d) {
+			warnings = append(warnings, fmt.Sprintf("COOKIE_DOMAIN %s doesn't cover PUBLIC_URL's host %s, browsers will refuse our session cookies", d, host))
+		}
+	}
+	return warnings
+}
+
+// crossSiteOrigins returns the frontend origins that are a different site to PublicURL. Browsers treat requests from
+// these as third party, only sending SameSite=None cookies with them.
+func crossSiteOrigins(cfg Config) []string {
+	public, err := url.Parse(cfg.PublicURL)
+	if err != nil {
+		return nil
+	}
+	var cross []string
+	for _, o := range cfg.FrontendOrigins {
+		if u, err := url.Parse(o); err == nil && !sameSite(u, public) {
+			cross = append(cross, o)
+		}
+	}
+	return cross
+}
+
+// sameSite reports whether two URLs are the same site as browsers see it: the same scheme, and the same registrable
+// domain (such as app.example.com and api.example.com, but not example.github.io and other.github.io).
+func sameSite(a, b *url.URL) bool {
+	if a.Scheme != b.Scheme {
+		return false
+	}
+	siteA, errA := publicsuffix.EffectiveTLDPlusOne(a.Hostname())
+	siteB, errB := publicsuffix.EffectiveTLDPlusOne(b.Hostname())
+	if errA != nil || errB != nil {
+		// IP addresses and bare hostnames such as localhost are only ever the same site as themselves
+		return a.Hostname() == b.Hostname()
+	}
+	return siteA == siteB
+}
+
+// origin parses a URL, returning just its origin (scheme://host[:port]), as browsers send in the Origin header.
+func origin(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q must be an http or https URL, such as https://example.com", raw)
+	}
+	return originOf(u), nil
+}
+
+// originOf returns a parsed URL's origin.
+func originOf(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// isLocalhost reports whether host is our own machine, where browsers allow Secure cookies over plain HTTP.
+func isLocalhost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// splitList splits a comma separated environment variable, ignoring spaces and empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bufio"
+	"examples/clock"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Our environment variables are fixed once we've started, so settings that can be changed while we're running are read
+// from a file too. CONFIG_FILE names a file of KEY=VALUE lines (blank lines and lines starting with # are ignored),
+// using the same names as our environment variables. The file is read by FromEnv, its values taking precedence over
+// the environment, so it's read again each time our configuration is reloaded (see Snapshot.Reload).
+
+// fileEnv remembers the environment as it was before our config file was applied, so a setting removed from the file
+// goes back to its original value on the next reload, rather than keeping the file's old value.
+var fileEnv struct {
+	mu       sync.Mutex
+	original map[string]*string // nil for variables that weren't set
+}
+
+// applyConfigFile reads the file named by CONFIG_FILE (if any) into our environment.
+func applyConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || key == "CONFIG_FILE" {
+			return fmt.Errorf("CONFIG_FILE line %d must be KEY=VALUE", line)
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+
+	fileEnv.mu.Lock()
+	defer fileEnv.mu.Unlock()
+	if fileEnv.original == nil {
+		fileEnv.original = make(map[string]*string)
+	}
+	// Put back anything an earlier version of the file set, that this version doesn't
+	for key, original := range fileEnv.original {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if original == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *original)
+		}
+		delete(fileEnv.original, key)
+	}
+	for key, value := range values {
+		if _, ok := fileEnv.original[key]; !ok {
+			var original *string
+			if v, set := os.LookupEnv(key); set {
+				original = &v
+			}
+			fileEnv.original[key] = original
+		}
+		os.Setenv(key, value)
+	}
+	return nil
+}
+
+// Snapshot holds our current configuration, which can be replaced with a freshly read one while we're running (see
+// Reload). A Config handed out by Load is never modified afterwards, so a request that loads it once sees the same
+// settings throughout, even if we reload part way through it. Callers must treat it as read only.
+type Snapshot struct {
+	current atomic.Pointer[loadedConfig]
+}
+
+// loadedConfig is a Config, and when it was read.
+type loadedConfig struct {
+	cfg    Config
+	loaded time.Time
+}
+
+// NewSnapshot creates a Snapshot, starting with the given configuration.
+func NewSnapshot(cfg Config) *Snapshot {
+	s := &Snapshot{}
+	s.current.Store(&loadedConfig{cfg: cfg, loaded: clock.Now()})
+	return s
+}
+
+// Load returns our current configuration.
+func (s *Snapshot) Load() *Config {
+	return &s.current.Load().cfg
+}
+
+// Loaded returns our current configuration along with when it was read.
+func (s *Snapshot) Loaded() (*Config, time.Time) {
+	c := s.current.Load()
+	return &c.cfg, c.loaded
+}
+
+// Reload reads our configuration again, and swaps it in if it's valid. If it isn't, we keep the current configuration
+// and return the error. Only settings read through Load at the time they're used are affected, anything set up from
+// our configuration at startup (such as our listeners, or database connection) needs a restart to change.
+func (s *Snapshot) Reload() error {
+	cfg, err := FromEnv()
+	if err != nil {
+		return err
+	}
+	s.current.Store(&loadedConfig{cfg: cfg, loaded: clock.Now()})
+	return nil
+}
+
+// redacted replaces secrets in our configuration
+const redacted = "REDACTED"
+
+// dsnPassword finds the password in a key=value database connection string, or a URL's query
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('[^']*'|[^\s&]+)`)
+
+// Redacted returns a copy of the configuration with every secret (keys, passwords, tokens) replaced, so it can be shown
+// to operators. Add any new secret settings here.
+func (c Config) Redacted() Config {
+	c.DatabaseURL = redactURL(c.DatabaseURL)
+	c.RedisURL = redactURL(c.RedisURL)
+	c.MirrorURL = redactURL(c.MirrorURL)
+	if c.ShardURLs != nil {
+		shards := make([]string, len(c.ShardURLs))
+		for i, url := range c.ShardURLs {
+			shards[i] = redactURL(url)
+		}
+		c.ShardURLs = shards
+	}
+	c.SessionKey = nil
+	if c.SessionOldKeys != nil {
+		old := make(map[byte][]byte, len(c.SessionOldKeys))
+		for id := range c.SessionOldKeys {
+			old[id] = nil
+		}
+		c.SessionOldKeys = old
+	}
+	if c.OAuth != nil {
+		oauth := make(map[string]OAuthClient, len(c.OAuth))
+		for name, client := range c.OAuth {
+			client.Secret = redacted
+			oauth[name] = client
+		}
+		c.OAuth = oauth
+	}
+	if c.SMTPPassword != "" {
+		c.SMTPPassword = redacted
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	return c
+}
+
+// redactURL replaces the password in a URL (which may list several hosts, see database/sql/failover.go), or key=value
+// connection string.
+func redactURL(u string) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return dsnPassword.ReplaceAllString(u, "${1}"+redacted)
+	}
+	authority, path, hasPath := strings.Cut(rest, "/")
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		if user, _, ok := strings.Cut(authority[:at], ":"); ok {
+			authority = user + ":" + redacted + authority[at:]
+		}
+	}
+	u = scheme + "://" + authority
+	if hasPath {
+		u += "/" + path
+	}
+	return dsnPassword.ReplaceAllString(u, "${1}"+redacted)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"examples/config"
+	"net/http"
+)
+
+// sameSiteModes maps our config's SameSite settings to the net/http equivalents.
+var sameSiteModes = map[string]http.SameSite{
+	config.SameSiteLax:    http.SameSiteLaxMode,
+	config.SameSiteStrict: http.SameSiteStrictMode,
+	config.SameSiteNone:   http.SameSiteNoneMode,
+}
+
+// sessionCookie builds one of our session cookies, for the route at path (or under it). sameSite is the cookie's own
+// default, used unless our cookie settings override it, such as when our frontend is on a different site to us and
+// browsers would otherwise never send the cookie back (see config.CookieSettings).
+func (s *server) sessionCookie(name, value, path string, sameSite http.SameSite) *http.Cookie {
+	if mode, ok := sameSiteModes[s.cookies.SameSite]; ok {
+		sameSite = mode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.pathTo(path),
+		Domain:   s.cookies.Domain,
+		HttpOnly: true, // Not readable from JavaScript, so an XSS bug can't steal it
+		Secure:   true, // Only ever sent over HTTPS, which SameSite=None requires anyway
+		SameSite: sameSite,
+	}
+}
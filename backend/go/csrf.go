@@ -0,0 +1,53 @@
+package main
+
+import (
+	"examples/csrf"
+	"examples/errs"
+	"examples/requestctx"
+	"net/http"
+)
+
+// When sessions are delivered by cookie, browsers send them along with requests other sites trick them into making, so
+// every request that changes something must also carry a CSRF token proving it came from our frontend (see the csrf
+// package). Frontends fetch the token for their session from /csrf/ after logging in, and send it back in the
+// X-CSRF-Token header. Tokens are tied to the session token, so a new one is needed after logging in again or
+// refreshing.
+
+// csrfResponse holds the CSRF token for the caller's session.
+type csrfResponse struct {
+	Token  string `json:"token"`
+	Header string `json:"header"` // The header to send the token in
+}
+
+// csrfToken returns the CSRF token for the caller's session. Reading it needs a request our frontend makes itself, as
+// other sites can make a browser send requests but can't read the responses.
+func (s *server) csrfToken(w http.ResponseWriter, r *http.Request) {
+	// Tokens are tied to a session, so mustn't be cached and handed to anyone else
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, r, http.StatusOK, csrfResponse{Token: s.csrf.Token(rawSessionToken(r)), Header: csrf.Header})
+}
+
+// checkCSRF rejects requests that could change something, and were authenticated by our session cookie, unless they
+// carry the CSRF token for that session. Requests authenticated by the Authorization header are let through, as other
+// sites can't make a browser send that header. This must come after our auth middleware, so unauthenticated requests
+// are told they need to log in rather than that they're missing a token.
+func (s *server) checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			// Safe methods never change anything, so forging them gains an attacker nothing
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A replayed write no longer has its session cookie to check the token against, it was checked when queued instead
+		if r.Header.Get("Authorization") != "" || requestctx.Replayed(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.csrf.Valid(rawSessionToken(r), r.Header.Get(csrf.Header)) {
+			s.writeError(w, r, errs.New(errs.Forbidden, "missing or invalid CSRF token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
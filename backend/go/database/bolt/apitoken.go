@@ -0,0 +1,127 @@
+package bolt
+
+import (
+	"errors"
+	"examples/database"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateAPIToken implements Storer, stores a new API token and updates the ID field with the ID that was handed out
+// for it.
+func (db *DB) CreateAPIToken(in *database.APIToken) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		id, err := nextID(bucket(tx, apiTokens))
+		if err != nil {
+			return err
+		}
+		token := *in
+		token.ID = id
+		if err := bucket(tx, apiTokensHash).Put(token.TokenHash, itob(id)); err != nil {
+			return err
+		}
+		if err := put(bucket(tx, apiTokens), itob(id), token); err != nil {
+			return err
+		}
+		in.ID = id
+		return nil
+	}), "bolt.CreateAPIToken")
+}
+
+// ListAPITokens implements Storer, lists a User's API tokens, newest first. Tokens are only listed when a User manages
+// them, so there's no index by User, we read through them all.
+func (db *DB) ListAPITokens(userID int64) ([]database.APIToken, error) {
+	var tokens []database.APIToken
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		tokens, err = all(bucket(tx, apiTokens), func(token database.APIToken) bool { return token.UserID == userID })
+		return err
+	})
+	sort.SliceStable(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.After(tokens[j].Created)
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, wrap(err, "bolt.ListAPITokens")
+}
+
+// GetAPIToken implements Storer, retrieves an unexpired API token by its hash, found through our hash index as this
+// happens on every request made with a token.
+func (db *DB) GetAPIToken(tokenHash []byte) (database.APIToken, error) {
+	var token database.APIToken
+	err := db.view(func(tx *bbolt.Tx) error {
+		id := bucket(tx, apiTokensHash).Get(tokenHash)
+		if id == nil {
+			return database.ErrNotFound
+		}
+		var err error
+		if token, err = get[database.APIToken](bucket(tx, apiTokens), id); err != nil {
+			return err
+		}
+		if !time.Now().Before(token.Expires) {
+			return database.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return database.APIToken{}, wrap(err, "bolt.GetAPIToken")
+	}
+	return token, nil
+}
+
+// TouchAPIToken implements Storer, records when an API token was last used.
+func (db *DB) TouchAPIToken(id int64, used time.Time) error {
+	err := db.update(func(tx *bbolt.Tx) error {
+		token, err := get[database.APIToken](bucket(tx, apiTokens), itob(id))
+		if err != nil {
+			return err
+		}
+		token.LastUsed = used
+		return put(bucket(tx, apiTokens), itob(id), token)
+	})
+	// Like our SQL Storer, touching a token that's gone isn't an error
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return wrap(err, "bolt.TouchAPIToken")
+}
+
+// DeleteAPIToken implements Storer, removes one of a User's API tokens. Naming the User as well as the token means a
+// User can never remove someone else's.
+func (db *DB) DeleteAPIToken(userID, id int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		token, err := get[database.APIToken](bucket(tx, apiTokens), itob(id))
+		if err != nil {
+			return err
+		}
+		if token.UserID != userID {
+			return database.ErrNotFound
+		}
+		return removeAPITokens(tx, []database.APIToken{token})
+	}), "bolt.DeleteAPIToken")
+}
+
+// deleteUserAPITokens deletes every API token belonging to a User, such as when deleting them.
+func deleteUserAPITokens(tx *bbolt.Tx, userID int64) error {
+	tokens, err := all(bucket(tx, apiTokens), func(token database.APIToken) bool { return token.UserID == userID })
+	if err != nil {
+		return err
+	}
+	return removeAPITokens(tx, tokens)
+}
+
+// removeAPITokens deletes API tokens, along with their entries in our hash index.
+func removeAPITokens(tx *bbolt.Tx, tokens []database.APIToken) error {
+	for _, token := range tokens {
+		if err := bucket(tx, apiTokensHash).Delete(token.TokenHash); err != nil {
+			return err
+		}
+		if err := bucket(tx, apiTokens).Delete(itob(token.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package bolt
+
+import (
+	"examples/database"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateAuditEntry implements Storer, adds an entry to the audit log and updates the ID field with the ID that was
+// handed out for it.
+func (db *DB) CreateAuditEntry(in *database.AuditEntry) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		id, err := nextID(bucket(tx, auditLog))
+		if err != nil {
+			return err
+		}
+		entry := *in
+		entry.ID = id
+		if err := put(bucket(tx, auditLog), itob(id), entry); err != nil {
+			return err
+		}
+		in.ID = id
+		return nil
+	}), "bolt.CreateAuditEntry")
+}
+
+// PurgeAuditEntries implements Storer, deletes (or with dryRun, counts) audit entries from before the given time.
+func (db *DB) PurgeAuditEntries(before time.Time, dryRun bool) (int, error) {
+	return purge(db, auditLog, before, dryRun, "bolt.PurgeAuditEntries", func(entry database.AuditEntry) time.Time { return entry.Time })
+}
+
+// updateAuditEntries changes the audit entries by or about a User with fn, which reports whether it changed each one.
+// Returns how many were changed.
+func updateAuditEntries(tx *bbolt.Tx, userID int64, fn func(entry *database.AuditEntry) bool) (int, error) {
+	log := bucket(tx, auditLog)
+	entries, err := all(log, func(entry database.AuditEntry) bool { return entry.ActorID == userID || entry.TargetID == userID })
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, entry := range entries {
+		if !fn(&entry) {
+			continue
+		}
+		if err := put(log, itob(entry.ID), entry); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// AnonymizeAuditEntries implements Storer, clears the IP address and detail of audit entries by or about a User. Their
+// ID is left, once the User record is gone it no longer leads back to anyone.
+func (db *DB) AnonymizeAuditEntries(userID int64) (int, error) {
+	var n int
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = updateAuditEntries(tx, userID, func(entry *database.AuditEntry) bool {
+			// Entries that are already anonymous aren't counted, as in our other Storers
+			if entry.IP == "" && entry.Detail == "" {
+				return false
+			}
+			entry.IP, entry.Detail = "", ""
+			return true
+		})
+		return err
+	})
+	if err != nil {
+		return 0, wrap(err, "bolt.AnonymizeAuditEntries")
+	}
+	return n, nil
+}
+
+// moveAuditEntries attributes audit entries by or about one User to another, such as when merging them.
+func moveAuditEntries(tx *bbolt.Tx, fromID, toID int64) error {
+	_, err := updateAuditEntries(tx, fromID, func(entry *database.AuditEntry) bool {
+		if entry.ActorID == fromID {
+			entry.ActorID = toID
+		}
+		if entry.TargetID == fromID {
+			entry.TargetID = toID
+		}
+		return true
+	})
+	return err
+}
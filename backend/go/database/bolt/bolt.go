@@ -0,0 +1,384 @@
+// bolt provides an embedded implementation of our Storer interface, keeping everything in a single file using bbolt
+// (a key/value store), for edge and demo deployments where running a database server isn't worth it. Only one process
+// can have the file open at a time, so it suits a single instance of our API, not several sharing the same data.
+//
+// A key/value store has no tables, only buckets of keys kept in order. Each of our tables (see database/sql/migrations)
+// is a bucket here, holding a JSON value per row. A few things work differently:
+//   - IDs are keys, encoded so they sort in ID order (see itob), handed out by each bucket's own sequence
+//   - Nothing can be looked up by anything but its key, so lookups we make on every request (Users by email or username,
+//     sessions by token, User, refresh token family or expiry) have index buckets of their own, kept up to date along
+//     with the values they index. Anything rarer reads through the whole bucket, which is quick at the sizes we expect
+//     here.
+//   - Only one change can be made at a time, so every Storer method is a single transaction, and nothing can change
+//     part way through one. WithTx holds a single transaction open for several methods, so nothing else can change
+//     anything until it's done, which suits the short multi-step changes it's meant for.
+//   - Nothing expires by itself, expired sessions (and refresh tokens) stay until ClearExpiredSessions sweeps them away,
+//     as in SQL. Our background tasks already call it regularly.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// openTimeout is how long Open waits for another process to close the file. bbolt locks the file while it's open, so
+// two instances pointed at the same file can't both use it.
+const openTimeout = 5 * time.Second
+
+// unavailableRetryAfter is how long we suggest callers wait before retrying when our file has been closed (such as
+// while we're shutting down), the same as our SQL Storer suggests.
+const unavailableRetryAfter = 5 * time.Second
+
+// Our buckets, named after the tables they stand in for. Index buckets are named after the bucket they index and what
+// they index it by, their keys end with the key of what they point at (see indexKey), and their values are empty.
+const (
+	users               = "users"                  // User ID → userRecord
+	usersEmail          = "users_email"            // Email + User ID
+	usersUsername       = "users_username"         // Username → User ID, usernames are unique
+	usernameHistory     = "usernamehistory"        // User ID + sequence → UsernameChange, so a User's changes are in order
+	sessions            = "sessions"               // Session ID → Session
+	sessionsToken       = "sessions_tokenhash"     // Token hash → session ID, hashes are unique
+	sessionsUser        = "sessions_userid"        // User ID + session ID
+	sessionsFamily      = "sessions_refreshfamily" // Refresh token family + session ID
+	sessionsExpiration  = "sessions_expiration"    // Expiration (Unix milliseconds) + session ID, see ClearExpiredSessions
+	refreshTokens       = "refreshtokens"          // Token hash → refreshRecord
+	refreshTokensFamily = "refreshtokens_familyid" // Family ID + token hash
+	oauthIdentities     = "oauthidentities"        // Provider + subject → User ID
+	emailChanges        = "emailchanges"           // Token hash → EmailChange
+	magicLinks          = "magiclinks"             // Token hash → MagicLink
+	passwordResets      = "passwordresets"         // Token hash → PasswordReset
+	emailVerifications  = "emailverifications"     // Token hash → EmailVerification
+	invites             = "invites"                // Invite ID → Invite
+	auditLog            = "auditlog"               // Entry ID → AuditEntry
+	securityEvents      = "securityevents"         // Event ID → SecurityEvent
+	domainEvents        = "domainevents"           // Seq → DomainEvent
+	dealershipMembers   = "dealershipmembers"      // User ID + dealership ID
+	twoFactor           = "twofactor"              // User ID → twoFactorRecord
+	userDeletions       = "userdeletions"          // User ID → UserDeletion
+	tenantSettings      = "tenantsettings"         // Tenant ID → TenantSettings
+	apiTokens           = "apitokens"              // Token ID → APIToken
+	apiTokensHash       = "apitokens_tokenhash"    // Token hash → token ID, hashes are unique
+)
+
+// ourBuckets lists every bucket, so Open can make sure they all exist.
+var ourBuckets = []string{
+	users, usersEmail, usersUsername, usernameHistory,
+	sessions, sessionsToken, sessionsUser, sessionsFamily, sessionsExpiration,
+	refreshTokens, refreshTokensFamily,
+	oauthIdentities, emailChanges, magicLinks, passwordResets, emailVerifications, invites,
+	auditLog, securityEvents, domainEvents,
+	dealershipMembers, twoFactor, userDeletions, tenantSettings,
+	apiTokens, apiTokensHash,
+}
+
+// DB implements Storer using a bbolt file.
+type DB struct {
+	store *bbolt.DB // Here we simply refer to it as "store" to avoid confusion with our database package
+	tx    *bbolt.Tx // The transaction we're part of, nil unless we were handed to a WithTx callback
+}
+
+// Open opens (or creates) the file at path, and makes sure our buckets exist.
+func Open(path string) (*DB, error) {
+	store, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = store.Update(func(tx *bbolt.Tx) error {
+		for _, name := range ourBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &DB{store: store}, nil
+}
+
+// Close closes our file, waiting for any transactions still running.
+func (db *DB) Close() error {
+	return db.store.Close()
+}
+
+// Ping implements Storer, checks our file is still open.
+func (db *DB) Ping() error {
+	return wrap(db.view(func(tx *bbolt.Tx) error { return nil }), "bolt.Ping")
+}
+
+// WithTx implements Storer, running fn in a single read-write transaction. bbolt only runs one of those at a time, so
+// every other change waits for fn to finish, and bbolt can't give up on a transaction part way through, so ctx is
+// only checked before starting.
+func (db *DB) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var fnErr error
+	err := db.store.Update(func(tx *bbolt.Tx) error {
+		fnErr = fn(&DB{store: db.store, tx: tx})
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return wrap(err, "bolt.WithTx")
+}
+
+// update runs fn in a read-write transaction, or as part of the one we're already part of (see WithTx).
+func (db *DB) update(fn func(tx *bbolt.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+	return db.store.Update(fn)
+}
+
+// view runs fn in a read-only transaction, or as part of the one we're already part of (see WithTx), so it sees the
+// changes made in it so far.
+func (db *DB) view(fn func(tx *bbolt.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+	return db.store.View(fn)
+}
+
+// bucket returns one of our buckets, see Open.
+func bucket(tx *bbolt.Tx, name string) *bbolt.Bucket {
+	return tx.Bucket([]byte(name))
+}
+
+// itob encodes an ID as a key. Keys are kept in byte order, so IDs are encoded big endian to keep them in ID order.
+func itob(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// btoi decodes an ID encoded by itob.
+func btoi(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// nextID hands out the next ID for a bucket, much as a SERIAL column's sequence does in SQL.
+func nextID(b *bbolt.Bucket) (int64, error) {
+	seq, err := b.NextSequence()
+	return int64(seq), err
+}
+
+// indexKey builds the key of an index entry: what's indexed, followed by the key of what it points at. Text is followed
+// by a 0 byte, so one value can't run into another (jo + e@example.com can't be mistaken for joe + @example.com).
+func indexKey(indexed, key []byte) []byte {
+	return append(append(append([]byte{}, indexed...), 0), key...)
+}
+
+// idKey builds an index key from two IDs, such as a User's ID and one of their sessions'. IDs are always 8 bytes, so
+// there's no need for a separator.
+func idKey(a, b int64) []byte {
+	return append(itob(a), itob(b)...)
+}
+
+// withPrefix calls fn with the key and value of each entry in b whose key starts with prefix, in key order. fn
+// mustn't change b, collect what to change and change it afterwards.
+func withPrefix(b *bbolt.Bucket, prefix []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keysWithPrefix returns the keys in b starting with prefix, with the prefix removed, in key order.
+func keysWithPrefix(b *bbolt.Bucket, prefix []byte) [][]byte {
+	var keys [][]byte
+	withPrefix(b, prefix, func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k[len(prefix):]...))
+		return nil
+	})
+	return keys
+}
+
+// deletePrefix deletes every key in b starting with prefix.
+func deletePrefix(b *bbolt.Bucket, prefix []byte) error {
+	for _, k := range keysWithPrefix(b, prefix) {
+		if err := b.Delete(append(append([]byte{}, prefix...), k...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode reads a value we stored.
+func decode[T any](data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// get reads the value under key in b, returning our not found error if there isn't one.
+func get[T any](b *bbolt.Bucket, key []byte) (T, error) {
+	data := b.Get(key)
+	if data == nil {
+		var v T
+		return v, database.ErrNotFound
+	}
+	return decode[T](data)
+}
+
+// put stores v under key in b, replacing anything already there.
+func put(b *bbolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// all reads every value in b for which keep returns true, in key order. Pass nil to keep everything.
+func all[T any](b *bbolt.Bucket, keep func(T) bool) ([]T, error) {
+	var out []T
+	err := b.ForEach(func(k, data []byte) error {
+		v, err := decode[T](data)
+		if err == nil && (keep == nil || keep(v)) {
+			out = append(out, v)
+		}
+		return err
+	})
+	return out, err
+}
+
+// deleteWhere deletes every value in b for which match returns true, returning the values deleted.
+func deleteWhere[T any](b *bbolt.Bucket, match func(T) bool) ([]T, error) {
+	var (
+		keys    [][]byte
+		deleted []T
+	)
+	err := b.ForEach(func(k, data []byte) error {
+		v, err := decode[T](data)
+		if err == nil && match(v) {
+			keys = append(keys, append([]byte{}, k...))
+			deleted = append(deleted, v)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// after reads up to limit values from b with keys after afterID, in key order, for buckets keyed by ID.
+func after[T any](b *bbolt.Bucket, afterID int64, limit int, keep func(T) bool) ([]T, error) {
+	var out []T
+	c := b.Cursor()
+	for k, data := c.Seek(itob(afterID + 1)); k != nil && len(out) < limit; k, data = c.Next() {
+		v, err := decode[T](data)
+		if err != nil {
+			return nil, err
+		}
+		if keep == nil || keep(v) {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+// wrap attaches the failing operation to an error. Using our file once it's closed is marked as Unavailable, so the
+// caller gets a 503 status (and knows to try again) rather than a generic 500 status.
+func wrap(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, bbolt.ErrDatabaseNotOpen) {
+		return &errs.Error{Code: errs.Unavailable, Op: op, Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	return errs.Wrap(err, op)
+}
+
+// purge deletes the values in the named bucket whose time (as returned by when) is before the given time, or with dryRun
+// only counts them.
+func purge[T any](db *DB, name string, before time.Time, dryRun bool, op string, when func(T) time.Time) (int, error) {
+	old := func(v T) bool { return when(v).Before(before) }
+	var n int
+	err := db.update(func(tx *bbolt.Tx) error {
+		var (
+			list []T
+			err  error
+		)
+		if dryRun {
+			list, err = all(bucket(tx, name), old)
+		} else {
+			list, err = deleteWhere(bucket(tx, name), old)
+		}
+		n = len(list)
+		return err
+	})
+	if err != nil {
+		return 0, wrap(err, op)
+	}
+	return n, nil
+}
+
+// tokenRecord holds the fields every emailed token shares (EmailChange, MagicLink, PasswordReset and
+// EmailVerification), so one set of helpers can manage them all. Each is kept under its token hash.
+type tokenRecord struct {
+	UserID  int64
+	Expires time.Time
+}
+
+// deleteUserToken deletes a User's token from one of our token buckets. A User only has one token of each kind, but
+// tokens are kept under their hash, so finding it means reading through them all.
+func deleteUserToken(tx *bbolt.Tx, name string, userID int64) error {
+	_, err := deleteWhere(bucket(tx, name), func(token tokenRecord) bool { return token.UserID == userID })
+	return err
+}
+
+// replaceToken stores a token under its hash, replacing any other token of the same kind for the same User, which stops
+// working.
+func replaceToken(tx *bbolt.Tx, name string, tokenHash []byte, userID int64, token any) error {
+	if err := deleteUserToken(tx, name, userID); err != nil {
+		return err
+	}
+	return put(bucket(tx, name), tokenHash, token)
+}
+
+// useToken removes the unexpired token with the given hash from one of our token buckets, returning it. Returns our
+// not found error if there's no such token, or it has expired.
+func useToken[T any](tx *bbolt.Tx, name string, tokenHash []byte) (T, error) {
+	var token T
+	data := bucket(tx, name).Get(tokenHash)
+	if data == nil {
+		return token, database.ErrNotFound
+	}
+	shared, err := decode[tokenRecord](data)
+	if err != nil {
+		return token, err
+	}
+	if !time.Now().Before(shared.Expires) {
+		return token, database.ErrNotFound
+	}
+	if token, err = decode[T](data); err != nil {
+		return token, err
+	}
+	return token, bucket(tx, name).Delete(tokenHash)
+}
+
+// Session and User methods can be found in their respective files (session.go, user.go)
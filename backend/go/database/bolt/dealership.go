@@ -0,0 +1,91 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// Memberships are kept in our dealershipmembers bucket under the User's ID followed by the dealership's, with nothing
+// stored against them, so a User's dealerships are the keys starting with their ID.
+
+// AddUserToDealership implements Storer, adds a dealership membership. Adding a membership that already exists isn't an
+// error, so this is safe to retry.
+func (db *DB) AddUserToDealership(userID, dealershipID int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return bucket(tx, dealershipMembers).Put(idKey(userID, dealershipID), nil)
+	}), "bolt.AddUserToDealership")
+}
+
+// RemoveUserFromDealership implements Storer, removes a dealership membership.
+func (db *DB) RemoveUserFromDealership(userID, dealershipID int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		members := bucket(tx, dealershipMembers)
+		if members.Get(idKey(userID, dealershipID)) == nil {
+			return database.ErrNotFound
+		}
+		return members.Delete(idKey(userID, dealershipID))
+	}), "bolt.RemoveUserFromDealership")
+}
+
+// userDealerships lists the IDs of the dealerships a User is a member of, in order.
+func userDealerships(tx *bbolt.Tx, userID int64) []int64 {
+	var ids []int64
+	for _, k := range keysWithPrefix(bucket(tx, dealershipMembers), itob(userID)) {
+		ids = append(ids, btoi(k))
+	}
+	return ids
+}
+
+// SharesDealership implements Storer, checks whether two Users are members of any of the same dealerships. We look up
+// the first User's dealerships, then whether the other User is in any of them.
+func (db *DB) SharesDealership(userID, otherID int64) (bool, error) {
+	shares := false
+	err := db.view(func(tx *bbolt.Tx) error {
+		for _, dealershipID := range userDealerships(tx, userID) {
+			if bucket(tx, dealershipMembers).Get(idKey(otherID, dealershipID)) != nil {
+				shares = true
+				break
+			}
+		}
+		return nil
+	})
+	return shares, wrap(err, "bolt.SharesDealership")
+}
+
+// inScope reports whether the User with the given ID is within scope: anyone for the zero scope, otherwise the viewer
+// themselves, or a member of any of the viewer's dealerships.
+func inScope(tx *bbolt.Tx, scope database.UserScope, userID int64) bool {
+	if scope.Everyone() || userID == scope.ViewerID {
+		return true
+	}
+	for _, dealershipID := range scope.Dealerships {
+		if bucket(tx, dealershipMembers).Get(idKey(userID, dealershipID)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ListUserDealerships implements Storer, lists the dealerships a User is a member of.
+func (db *DB) ListUserDealerships(userID int64) ([]int64, error) {
+	var ids []int64
+	err := db.view(func(tx *bbolt.Tx) error {
+		ids = userDealerships(tx, userID)
+		return nil
+	})
+	return ids, wrap(err, "bolt.ListUserDealerships")
+}
+
+// RemoveUserMemberships implements Storer, removes a User from every dealership.
+func (db *DB) RemoveUserMemberships(userID int64) (int, error) {
+	var n int
+	err := db.update(func(tx *bbolt.Tx) error {
+		n = len(userDealerships(tx, userID))
+		return deletePrefix(bucket(tx, dealershipMembers), itob(userID))
+	})
+	if err != nil {
+		return 0, wrap(err, "bolt.RemoveUserMemberships")
+	}
+	return n, nil
+}
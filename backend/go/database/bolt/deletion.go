@@ -0,0 +1,53 @@
+package bolt
+
+import (
+	"examples/database"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// GetUserDeletion implements Storer, retrieves the progress of deleting a User
+func (db *DB) GetUserDeletion(userID int64) (database.UserDeletion, error) {
+	var deletion database.UserDeletion
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		deletion, err = get[database.UserDeletion](bucket(tx, userDeletions), itob(userID))
+		return err
+	})
+	return deletion, wrap(err, "bolt.GetUserDeletion")
+}
+
+// PendingUserDeletions implements Storer, lists deletions still being cleaned up, oldest first
+func (db *DB) PendingUserDeletions(limit int) ([]database.UserDeletion, error) {
+	var list []database.UserDeletion
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		list, err = all(bucket(tx, userDeletions), func(deletion database.UserDeletion) bool {
+			return deletion.Status == database.DeletionPending
+		})
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "bolt.PendingUserDeletions")
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// SaveUserDeletion implements Storer, records progress cleaning up after a deleted User
+func (db *DB) SaveUserDeletion(in *database.UserDeletion) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		deletion, err := get[database.UserDeletion](bucket(tx, userDeletions), itob(in.UserID))
+		if err != nil {
+			return err
+		}
+		// When the deletion was requested never changes
+		deletion.Status, deletion.Step, deletion.Attempts = in.Status, in.Step, in.Attempts
+		deletion.Error, deletion.Completed = in.Error, in.Completed
+		return put(bucket(tx, userDeletions), itob(in.UserID), deletion)
+	}), "bolt.SaveUserDeletion")
+}
@@ -0,0 +1,37 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// AppendDomainEvent implements Storer, adds an event to the end of our event log. Only one write transaction runs at a
+// time, so events always commit in the order their sequence numbers were handed out, and a consumer can never read
+// past an event that isn't visible yet.
+func (db *DB) AppendDomainEvent(in *database.DomainEvent) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		seq, err := nextID(bucket(tx, domainEvents))
+		if err != nil {
+			return err
+		}
+		event := *in
+		event.Seq = seq
+		if err := put(bucket(tx, domainEvents), itob(seq), event); err != nil {
+			return err
+		}
+		in.Seq = seq
+		return nil
+	}), "bolt.AppendDomainEvent")
+}
+
+// ListDomainEvents implements Storer, lists domain events after the given sequence number, oldest first
+func (db *DB) ListDomainEvents(afterSeq int64, limit int) ([]database.DomainEvent, error) {
+	var events []database.DomainEvent
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		events, err = after[database.DomainEvent](bucket(tx, domainEvents), afterSeq, limit, nil)
+		return err
+	})
+	return events, wrap(err, "bolt.ListDomainEvents")
+}
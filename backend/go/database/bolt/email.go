@@ -0,0 +1,42 @@
+package bolt
+
+import (
+	"examples/database"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateEmailChange implements Storer, stores a pending email change. A User can only have one pending change at a
+// time, so it replaces any previous change, whose confirmation link stops working.
+func (db *DB) CreateEmailChange(in *database.EmailChange) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return replaceToken(tx, emailChanges, in.TokenHash, in.UserID, in)
+	}), "bolt.CreateEmailChange")
+}
+
+// ConfirmEmailChange implements Storer, applies a pending email change to its User, removing the pending change so its
+// token can't be used again.
+func (db *DB) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	var change database.EmailChange
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		if change, err = useToken[database.EmailChange](tx, emailChanges, tokenHash); err != nil {
+			return err
+		}
+		// Apply it to the User, following the link proves they own the new address too
+		_, err = updateUser(tx, change.UserID, false, func(record *userRecord) {
+			record.Email, record.EmailVerified = change.NewEmail, true
+		})
+		return err
+	})
+	if err != nil {
+		return database.EmailChange{}, wrap(err, "bolt.ConfirmEmailChange")
+	}
+	return change, nil
+}
+
+// PurgeEmailChanges implements Storer, deletes (or with dryRun, counts) email changes that expired before the given time.
+func (db *DB) PurgeEmailChanges(before time.Time, dryRun bool) (int, error) {
+	return purge(db, emailChanges, before, dryRun, "bolt.PurgeEmailChanges", func(token tokenRecord) time.Time { return token.Expires })
+}
@@ -0,0 +1,100 @@
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"examples/database"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateInvite implements Storer, stores an invite. An email can only have one invite at a time, so inviting someone
+// again replaces the earlier invite (keeping its ID), and the earlier link stops working. There are only ever a handful
+// of invites, so they're kept by ID and read through to find one by email or token.
+func (db *DB) CreateInvite(in *database.Invite) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		b := bucket(tx, invites)
+		existing, err := all(b, func(invite database.Invite) bool { return invite.Email == in.Email })
+		if err != nil {
+			return err
+		}
+		invite := *in
+		if len(existing) > 0 {
+			invite.ID = existing[0].ID
+		} else if invite.ID, err = nextID(b); err != nil {
+			return err
+		}
+		if err := put(b, itob(invite.ID), invite); err != nil {
+			return err
+		}
+		in.ID = invite.ID
+		return nil
+	}), "bolt.CreateInvite")
+}
+
+// ListInvites implements Storer, lists the invites that can still be used, newest first.
+func (db *DB) ListInvites() ([]database.Invite, error) {
+	var list []database.Invite
+	err := db.view(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		var err error
+		list, err = all(bucket(tx, invites), func(invite database.Invite) bool { return now.Before(invite.Expires) })
+		return err
+	})
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.After(list[j].Created)
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, wrap(err, "bolt.ListInvites")
+}
+
+// DeleteInvite implements Storer, removes an invite.
+func (db *DB) DeleteInvite(id int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		if bucket(tx, invites).Get(itob(id)) == nil {
+			return database.ErrNotFound
+		}
+		return bucket(tx, invites).Delete(itob(id))
+	}), "bolt.DeleteInvite")
+}
+
+// UseInvite implements Storer, removes an invite so its token can't be used again, and creates the User it invited in
+// the same transaction, so an invite is never used up without an account to show for it.
+func (db *DB) UseInvite(tokenHash []byte, user *database.User) (database.Invite, error) {
+	var invite database.Invite
+	err := db.update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		found, err := all(bucket(tx, invites), func(invite database.Invite) bool {
+			return bytes.Equal(invite.TokenHash, tokenHash) && now.Before(invite.Expires)
+		})
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return database.ErrNotFound
+		}
+		invite = found[0]
+
+		// The invite was only sent if nobody had the email, but an admin may have created a User with it since
+		if _, err := visibleUserByEmail(tx, invite.Email); err == nil {
+			return database.ErrEmailTaken
+		} else if !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+		if err := bucket(tx, invites).Delete(itob(invite.ID)); err != nil {
+			return err
+		}
+
+		// Following the link we emailed proves they own the address
+		user.Email, user.EmailVerified = invite.Email, true
+		return insertUser(tx, user)
+	})
+	if err != nil {
+		return database.Invite{}, wrap(err, "bolt.UseInvite")
+	}
+	return invite, nil
+}
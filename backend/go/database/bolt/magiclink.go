@@ -0,0 +1,30 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateMagicLink implements Storer, stores a magic link. A User can only have one link at a time, so requesting a new
+// link replaces any earlier one, which stops working.
+func (db *DB) CreateMagicLink(in *database.MagicLink) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return replaceToken(tx, magicLinks, in.TokenHash, in.UserID, in)
+	}), "bolt.CreateMagicLink")
+}
+
+// UseMagicLink implements Storer, removes a magic link so its token can't be used again. Only one write transaction
+// runs at a time, so two requests racing to use the same link can't both succeed.
+func (db *DB) UseMagicLink(tokenHash []byte) (database.MagicLink, error) {
+	var link database.MagicLink
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		link, err = useToken[database.MagicLink](tx, magicLinks, tokenHash)
+		return err
+	})
+	if err != nil {
+		return database.MagicLink{}, wrap(err, "bolt.UseMagicLink")
+	}
+	return link, nil
+}
@@ -0,0 +1,74 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// identityKey is the key of a link to an OAuth identity in our oauthidentities bucket.
+func identityKey(provider, subject string) []byte {
+	return indexKey([]byte(provider), []byte(subject))
+}
+
+// GetUserByIdentity implements Storer, retrieves the User an OAuth identity is linked to
+func (db *DB) GetUserByIdentity(provider, subject string) (database.User, error) {
+	var record userRecord
+	err := db.view(func(tx *bbolt.Tx) error {
+		userID := bucket(tx, oauthIdentities).Get(identityKey(provider, subject))
+		if userID == nil {
+			return database.ErrNotFound
+		}
+		var err error
+		record, err = loadVisibleUser(tx, btoi(userID))
+		return err
+	})
+	if err != nil {
+		return database.User{}, wrap(err, "bolt.GetUserByIdentity")
+	}
+	return record.user(), nil
+}
+
+// LinkIdentity implements Storer, links an OAuth identity to a User
+func (db *DB) LinkIdentity(userID int64, provider, subject string) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		identities := bucket(tx, oauthIdentities)
+		if identities.Get(identityKey(provider, subject)) != nil {
+			return database.ErrIdentityLinked
+		}
+		return identities.Put(identityKey(provider, subject), itob(userID))
+	}), "bolt.LinkIdentity")
+}
+
+// identitiesOf returns the keys of every identity linked to a User. Identities are only looked up by provider and
+// subject, so finding a User's means reading through them all.
+func identitiesOf(tx *bbolt.Tx, userID int64) [][]byte {
+	var keys [][]byte
+	bucket(tx, oauthIdentities).ForEach(func(k, v []byte) error {
+		if btoi(v) == userID {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	return keys
+}
+
+// unlinkIdentities removes every identity linked to a User, such as when deleting them.
+func unlinkIdentities(tx *bbolt.Tx, userID int64) error {
+	for _, k := range identitiesOf(tx, userID) {
+		if err := bucket(tx, oauthIdentities).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveIdentities links every identity linked to one User to another instead, such as when merging them.
+func moveIdentities(tx *bbolt.Tx, fromID, toID int64) error {
+	for _, k := range identitiesOf(tx, fromID) {
+		if err := bucket(tx, oauthIdentities).Put(k, itob(toID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
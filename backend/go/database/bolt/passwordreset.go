@@ -0,0 +1,33 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreatePasswordReset implements Storer, stores a password reset. A User can only have one reset at a time, so starting
+// a new reset stops any earlier link from working.
+func (db *DB) CreatePasswordReset(in *database.PasswordReset) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return replaceToken(tx, passwordResets, in.TokenHash, in.UserID, in)
+	}), "bolt.CreatePasswordReset")
+}
+
+// UsePasswordReset implements Storer, removes a password reset so its token can't be used again, and sets the new
+// password hash in the same transaction. Soft deleted Users can't reset their password.
+func (db *DB) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	var reset database.PasswordReset
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		if reset, err = useToken[database.PasswordReset](tx, passwordResets, tokenHash); err != nil {
+			return err
+		}
+		_, err = updateUser(tx, reset.UserID, true, func(record *userRecord) { record.PasswordHash = passwordHash })
+		return err
+	})
+	if err != nil {
+		return database.PasswordReset{}, wrap(err, "bolt.UsePasswordReset")
+	}
+	return reset, nil
+}
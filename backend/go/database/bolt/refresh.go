@@ -0,0 +1,111 @@
+package bolt
+
+import (
+	"errors"
+	"examples/database"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// refreshRecord is how a RefreshToken is kept in our refreshtokens bucket, under its hash.
+type refreshRecord struct {
+	database.RefreshToken
+	Used bool // Set once the token has been rotated, see RotateRefreshToken
+}
+
+// saveRefreshToken stores a refresh token, indexing it by its family.
+func saveRefreshToken(tx *bbolt.Tx, token refreshRecord) error {
+	if err := bucket(tx, refreshTokensFamily).Put(indexKey([]byte(token.FamilyID), token.TokenHash), nil); err != nil {
+		return err
+	}
+	return put(bucket(tx, refreshTokens), token.TokenHash, token)
+}
+
+// removeRefreshTokens deletes every refresh token for which match returns true, along with its family index entry.
+func removeRefreshTokens(tx *bbolt.Tx, match func(refreshRecord) bool) error {
+	removed, err := deleteWhere(bucket(tx, refreshTokens), match)
+	if err != nil {
+		return err
+	}
+	for _, token := range removed {
+		if err := bucket(tx, refreshTokensFamily).Delete(indexKey([]byte(token.FamilyID), token.TokenHash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRefreshFamily deletes every refresh token in a family, found through our family index.
+func removeRefreshFamily(tx *bbolt.Tx, familyID string) error {
+	prefix := indexKey([]byte(familyID), nil)
+	for _, hash := range keysWithPrefix(bucket(tx, refreshTokensFamily), prefix) {
+		if err := bucket(tx, refreshTokens).Delete(hash); err != nil {
+			return err
+		}
+	}
+	return deletePrefix(bucket(tx, refreshTokensFamily), prefix)
+}
+
+// CreateRefreshToken implements Storer, stores a new unused refresh token.
+func (db *DB) CreateRefreshToken(in *database.RefreshToken) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return saveRefreshToken(tx, refreshRecord{RefreshToken: *in})
+	}), "bolt.CreateRefreshToken")
+}
+
+// RotateRefreshToken implements Storer, swapping a refresh token for its replacement. The old token is only marked as
+// used rather than deleted, so we can still recognise it (and catch whoever copied it) if it's presented again. Only
+// one write transaction runs at a time, so two requests racing to rotate the same token can't both succeed.
+func (db *DB) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	var old, next database.RefreshToken
+	err := db.update(func(tx *bbolt.Tx) error {
+		token, err := get[refreshRecord](bucket(tx, refreshTokens), oldHash)
+		if err != nil {
+			return err
+		}
+		if !time.Now().Before(token.Expires) {
+			return database.ErrNotFound
+		}
+		old = token.RefreshToken
+		if token.Used {
+			return database.ErrRefreshTokenReused
+		}
+		token.Used = true
+		if err := saveRefreshToken(tx, token); err != nil {
+			return err
+		}
+
+		// The replacement expires with the rest of its family, rotating never extends how long a login lasts
+		next = old
+		next.TokenHash = newHash
+		return saveRefreshToken(tx, refreshRecord{RefreshToken: next})
+	})
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		return old, wrap(err, "bolt.RotateRefreshToken")
+	}
+	if err != nil {
+		return database.RefreshToken{}, wrap(err, "bolt.RotateRefreshToken")
+	}
+	return next, nil
+}
+
+// RevokeRefreshFamily implements Storer, deleting a refresh token family along with every session created from it.
+func (db *DB) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	var ids []int64
+	err := db.update(func(tx *bbolt.Tx) error {
+		list, err := indexedSessions(tx, sessionsFamily, indexKey([]byte(familyID), nil))
+		if err != nil {
+			return err
+		}
+		if err := removeSessions(tx, list); err != nil {
+			return err
+		}
+		ids = sessionIDs(list)
+		return removeRefreshFamily(tx, familyID)
+	})
+	if err != nil {
+		return nil, wrap(err, "bolt.RevokeRefreshFamily")
+	}
+	return ids, nil
+}
@@ -0,0 +1,56 @@
+package bolt
+
+import (
+	"examples/clock"
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateSecurityEvent implements Storer, chains the event to the latest one, and adds it to the security event log.
+// Events have to be added one at a time, otherwise two could chain to the same predecessor. Only one write transaction
+// runs at a time, so the last event in our bucket is always the head of the chain.
+//
+// Like MongoDB, nothing stops someone with access to our file changing events, but the hash chain still gives them
+// away.
+func (db *DB) CreateSecurityEvent(in *database.SecurityEvent) error {
+	// Times are stored as text, to the millisecond like our other Storers, so we hash the time as it will be read back
+	in.Time = clock.UTC(in.Time)
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		events := bucket(tx, securityEvents)
+		// There's no head before the first event
+		prevHash := []byte{}
+		if k, data := events.Cursor().Last(); k != nil {
+			head, err := decode[database.SecurityEvent](data)
+			if err != nil {
+				return err
+			}
+			prevHash = head.Hash
+		}
+		id, err := nextID(events)
+		if err != nil {
+			return err
+		}
+
+		event := *in
+		event.ID = id
+		event.PrevHash = prevHash
+		event.Hash = event.ChainHash(prevHash)
+		if err := put(events, itob(id), event); err != nil {
+			return err
+		}
+		*in = event
+		return nil
+	}), "bolt.CreateSecurityEvent")
+}
+
+// ListSecurityEvents implements Storer, lists security events after the given ID, oldest first
+func (db *DB) ListSecurityEvents(afterID int64, limit int) ([]database.SecurityEvent, error) {
+	var events []database.SecurityEvent
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		events, err = after[database.SecurityEvent](bucket(tx, securityEvents), afterID, limit, nil)
+		return err
+	})
+	return events, wrap(err, "bolt.ListSecurityEvents")
+}
@@ -0,0 +1,344 @@
+package bolt
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// expirationKey is a session's key in our sessions_expiration index.
+func expirationKey(session database.Session) []byte {
+	return idKey(session.Expires.UnixMilli(), session.ID)
+}
+
+// unexpired reports whether a session hasn't expired. Expired sessions stay until ClearExpiredSessions next runs, so
+// they're filtered out rather than shown as if still active.
+func unexpired(now time.Time) func(database.Session) bool {
+	return func(session database.Session) bool {
+		return now.Before(session.Expires) && now.Before(session.EndOfLife)
+	}
+}
+
+// saveSession stores a session, keeping our session indexes up to date. old is the session being replaced, nil for a
+// new session.
+func saveSession(tx *bbolt.Tx, old *database.Session, session database.Session) error {
+	if old != nil {
+		if err := bucket(tx, sessionsExpiration).Delete(expirationKey(*old)); err != nil {
+			return err
+		}
+	}
+	if err := bucket(tx, sessionsExpiration).Put(expirationKey(session), nil); err != nil {
+		return err
+	}
+	if err := bucket(tx, sessionsUser).Put(idKey(session.UserID, session.ID), nil); err != nil {
+		return err
+	}
+	// Sessions saved before we handed out tokens don't have one, and can't be found by it
+	if len(session.TokenHash) > 0 {
+		if err := bucket(tx, sessionsToken).Put(session.TokenHash, itob(session.ID)); err != nil {
+			return err
+		}
+	}
+	if session.RefreshFamily != "" {
+		if err := bucket(tx, sessionsFamily).Put(indexKey([]byte(session.RefreshFamily), itob(session.ID)), nil); err != nil {
+			return err
+		}
+	}
+	return put(bucket(tx, sessions), itob(session.ID), session)
+}
+
+// removeSessions deletes sessions, along with their entries in our session indexes.
+func removeSessions(tx *bbolt.Tx, list []database.Session) error {
+	for _, session := range list {
+		if err := bucket(tx, sessionsExpiration).Delete(expirationKey(session)); err != nil {
+			return err
+		}
+		if err := bucket(tx, sessionsUser).Delete(idKey(session.UserID, session.ID)); err != nil {
+			return err
+		}
+		if len(session.TokenHash) > 0 {
+			if err := bucket(tx, sessionsToken).Delete(session.TokenHash); err != nil {
+				return err
+			}
+		}
+		if err := bucket(tx, sessionsFamily).Delete(indexKey([]byte(session.RefreshFamily), itob(session.ID))); err != nil {
+			return err
+		}
+		if err := bucket(tx, sessions).Delete(itob(session.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedSessions reads the sessions an index lists under prefix.
+func indexedSessions(tx *bbolt.Tx, index string, prefix []byte) ([]database.Session, error) {
+	var list []database.Session
+	for _, id := range keysWithPrefix(bucket(tx, index), prefix) {
+		session, err := get[database.Session](bucket(tx, sessions), id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, session)
+	}
+	return list, nil
+}
+
+// sessionIDs returns the IDs of sessions.
+func sessionIDs(list []database.Session) []int64 {
+	var ids []int64
+	for _, session := range list {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+// SaveSession implements Storer, inserts a Session into the database, and also updates the ID field with the ID that was
+// handed out for it.
+func (db *DB) SaveSession(in *database.Session) error {
+	// A new session was last seen when it was created, from where it was created
+	if in.LastSeen.IsZero() {
+		in.LastSeen = in.Created
+	}
+	if in.LastIP == "" {
+		in.LastIP = in.IP
+	}
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		id, err := nextID(bucket(tx, sessions))
+		if err != nil {
+			return err
+		}
+		session := *in
+		session.ID = id
+		if err := saveSession(tx, nil, session); err != nil {
+			return err
+		}
+		in.ID = id
+		return nil
+	}), "bolt.SaveSession")
+}
+
+// LoadSession implements Storer, retrieves a Session from the database by ID.
+func (db *DB) LoadSession(id int64) (database.Session, error) {
+	var session database.Session
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		session, err = get[database.Session](bucket(tx, sessions), itob(id))
+		return err
+	})
+	return session, wrap(err, "bolt.LoadSession")
+}
+
+// LoadSessionByToken implements Storer, retrieves a Session from the database by the hash of its bearer token.
+func (db *DB) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	var session database.Session
+	err := db.view(func(tx *bbolt.Tx) error {
+		id := bucket(tx, sessionsToken).Get(tokenHash)
+		if id == nil {
+			return database.ErrNotFound
+		}
+		var err error
+		session, err = get[database.Session](bucket(tx, sessions), id)
+		return err
+	})
+	return session, wrap(err, "bolt.LoadSessionByToken")
+}
+
+// ListSessionsByUser implements Storer, retrieves every unexpired Session belonging to a User, newest first.
+func (db *DB) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	var list []database.Session
+	err := db.view(func(tx *bbolt.Tx) error {
+		all, err := indexedSessions(tx, sessionsUser, itob(userID))
+		if err != nil {
+			return err
+		}
+		keep := unexpired(time.Now())
+		for _, session := range all {
+			if keep(session) {
+				list = append(list, session)
+			}
+		}
+		return nil
+	})
+	// Sessions are indexed in ID order, which is near enough creation order, but not exactly
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, wrap(err, "bolt.ListSessionsByUser")
+}
+
+// LogoutSession implements Storer, deletes a Session from the database by ID.
+func (db *DB) LogoutSession(id int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		session, err := get[database.Session](bucket(tx, sessions), itob(id))
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return removeSessions(tx, []database.Session{session})
+	}), "bolt.LogoutSession")
+}
+
+// updateSession changes a Session with fn, returning our not found error if it doesn't exist.
+func updateSession(tx *bbolt.Tx, id int64, fn func(session *database.Session)) error {
+	old, err := get[database.Session](bucket(tx, sessions), itob(id))
+	if err != nil {
+		return err
+	}
+	session := old
+	fn(&session)
+	return saveSession(tx, &old, session)
+}
+
+// ExtendSession implements Storer, updates a Session to have a new expiration, never past its end of life.
+func (db *DB) ExtendSession(id int64, lifespan time.Duration) error {
+	err := db.update(func(tx *bbolt.Tx) error {
+		return updateSession(tx, id, func(session *database.Session) {
+			session.Expires = clock.Now().Add(lifespan)
+			if session.Expires.After(session.EndOfLife) {
+				session.Expires = session.EndOfLife
+			}
+		})
+	})
+	// Like our SQL Storer, extending a session that's gone isn't an error
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return wrap(err, "bolt.ExtendSession")
+}
+
+// TouchSession implements Storer, records when and where a Session was last used.
+func (db *DB) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	err := db.update(func(tx *bbolt.Tx) error {
+		return updateSession(tx, id, func(session *database.Session) {
+			session.LastSeen, session.LastIP, session.UserAgent = seen, ip, userAgent
+		})
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return wrap(err, "bolt.TouchSession")
+}
+
+// ListSessionsAfter implements Storer, retrieves a page of unexpired Sessions in ID order.
+func (db *DB) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	var list []database.Session
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		list, err = after(bucket(tx, sessions), afterID, limit, unexpired(time.Now()))
+		return err
+	})
+	return list, wrap(err, "bolt.ListSessionsAfter")
+}
+
+// UpdateSessionCreds implements Storer, replaces a Session's encrypted credentials.
+func (db *DB) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return updateSession(tx, id, func(session *database.Session) { session.EncryptedCreds = encryptedCreds })
+	}), "bolt.UpdateSessionCreds")
+}
+
+// ClearExpiredSessions implements Storer, deletes any Sessions that are expired. Our sessions_expiration index keeps
+// sessions in the order they expire, so the expired ones are all at its start, and we only read as far as the first
+// that hasn't. A session's expiration never passes its end of life (see ExtendSession), so this finds every expired one.
+// Expired refresh tokens are cleared too, though they aren't counted.
+func (db *DB) ClearExpiredSessions() (int, error) {
+	cleared := 0
+	err := db.update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		if err := removeRefreshTokens(tx, func(token refreshRecord) bool { return !now.Before(token.Expires) }); err != nil {
+			return err
+		}
+
+		var expired []database.Session
+		c := bucket(tx, sessionsExpiration).Cursor()
+		for k, _ := c.First(); k != nil && btoi(k[:8]) <= now.UnixMilli(); k, _ = c.Next() {
+			session, err := get[database.Session](bucket(tx, sessions), k[8:])
+			if err != nil {
+				return err
+			}
+			expired = append(expired, session)
+		}
+		cleared = len(expired)
+		return removeSessions(tx, expired)
+	})
+	if err != nil {
+		return 0, wrap(err, "bolt.ClearExpiredSessions")
+	}
+	return cleared, nil
+}
+
+// DeleteUserSessions implements Storer, deletes every session and refresh token belonging to a User.
+func (db *DB) DeleteUserSessions(userID int64) ([]int64, error) {
+	var ids []int64
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		ids, err = deleteUserSessions(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "bolt.DeleteUserSessions")
+	}
+	return ids, nil
+}
+
+// deleteUserSessions does the work of DeleteUserSessions with tx, such as when deleting the User.
+func deleteUserSessions(tx *bbolt.Tx, userID int64) ([]int64, error) {
+	list, err := indexedSessions(tx, sessionsUser, itob(userID))
+	if err != nil {
+		return nil, err
+	}
+	if err := removeSessions(tx, list); err != nil {
+		return nil, err
+	}
+	err = removeRefreshTokens(tx, func(token refreshRecord) bool { return token.UserID == userID })
+	return sessionIDs(list), err
+}
+
+// RevokeSessions implements Storer, deletes a batch of sessions matching a filter along with their refresh token
+// families. Only the listed Users' sessions are read if the filter names any, otherwise we read through every session,
+// applying the filter to each.
+func (db *DB) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	var matched []database.Session
+	err := db.update(func(tx *bbolt.Tx) error {
+		if len(filter.UserIDs) > 0 {
+			for _, userID := range filter.UserIDs {
+				list, err := indexedSessions(tx, sessionsUser, itob(userID))
+				if err != nil {
+					return err
+				}
+				for _, session := range list {
+					if len(matched) < limit && filter.Matches(session) {
+						matched = append(matched, session)
+					}
+				}
+			}
+		} else {
+			var err error
+			if matched, err = after(bucket(tx, sessions), 0, limit, filter.Matches); err != nil {
+				return err
+			}
+		}
+
+		if err := removeSessions(tx, matched); err != nil {
+			return err
+		}
+		for _, session := range matched {
+			if session.RefreshFamily == "" {
+				continue
+			}
+			if err := removeRefreshFamily(tx, session.RefreshFamily); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrap(err, "bolt.RevokeSessions")
+	}
+	return sessionIDs(matched), nil
+}
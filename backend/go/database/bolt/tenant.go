@@ -0,0 +1,49 @@
+package bolt
+
+import (
+	"examples/clock"
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// GetTenantSettings implements Storer, retrieves the settings a tenant has overridden.
+func (db *DB) GetTenantSettings(tenantID int64) (database.TenantSettings, error) {
+	var settings database.TenantSettings
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		settings, err = get[database.TenantSettings](bucket(tx, tenantSettings), itob(tenantID))
+		return err
+	})
+	return settings, wrap(err, "bolt.GetTenantSettings")
+}
+
+// ListTenantSettings implements Storer, lists the settings of every tenant that has overridden any. Our bucket is kept
+// by tenant ID, so they're already in order.
+func (db *DB) ListTenantSettings() ([]database.TenantSettings, error) {
+	var list []database.TenantSettings
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		list, err = all[database.TenantSettings](bucket(tx, tenantSettings), nil)
+		return err
+	})
+	return list, wrap(err, "bolt.ListTenantSettings")
+}
+
+// SaveTenantSettings implements Storer, stores a tenant's settings, replacing any it had before.
+func (db *DB) SaveTenantSettings(in *database.TenantSettings) error {
+	in.Updated = clock.Now()
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return put(bucket(tx, tenantSettings), itob(in.TenantID), in)
+	}), "bolt.SaveTenantSettings")
+}
+
+// DeleteTenantSettings implements Storer, removes a tenant's settings.
+func (db *DB) DeleteTenantSettings(tenantID int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		if bucket(tx, tenantSettings).Get(itob(tenantID)) == nil {
+			return database.ErrNotFound
+		}
+		return bucket(tx, tenantSettings).Delete(itob(tenantID))
+	}), "bolt.DeleteTenantSettings")
+}
@@ -0,0 +1,135 @@
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// twoFactorRecord is how a User's TwoFactor state is kept in our twofactor bucket, under the User's ID. Their recovery
+// codes (by their hashes) are kept in the same record, as in MongoDB, so they're always changed along with the rest.
+type twoFactorRecord struct {
+	database.TwoFactor
+	RecoveryCodes [][]byte
+}
+
+// updateTwoFactor changes a User's two-factor record with fn, returning our not found error if they've never enrolled.
+// fn reports whether it changed anything, nothing is written if not.
+func updateTwoFactor(tx *bbolt.Tx, userID int64, fn func(record *twoFactorRecord) bool) (bool, error) {
+	record, err := get[twoFactorRecord](bucket(tx, twoFactor), itob(userID))
+	if err != nil {
+		return false, err
+	}
+	if !fn(&record) {
+		return false, nil
+	}
+	return true, put(bucket(tx, twoFactor), itob(userID), record)
+}
+
+// GetTwoFactor implements Storer, retrieves a User's two-factor authentication state
+func (db *DB) GetTwoFactor(userID int64) (database.TwoFactor, error) {
+	var record twoFactorRecord
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = get[twoFactorRecord](bucket(tx, twoFactor), itob(userID))
+		return err
+	})
+	if err != nil {
+		return database.TwoFactor{}, wrap(err, "bolt.GetTwoFactor")
+	}
+	return record.TwoFactor, nil
+}
+
+// SaveTwoFactor implements Storer, stores a pending two-factor enrollment. A pending enrollment replaces any earlier
+// one (keeping its recovery codes), but an enabled one is left alone.
+func (db *DB) SaveTwoFactor(in *database.TwoFactor) error {
+	err := db.update(func(tx *bbolt.Tx) error {
+		record, err := get[twoFactorRecord](bucket(tx, twoFactor), itob(in.UserID))
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+		if record.Enabled {
+			return database.ErrTwoFactorEnabled
+		}
+		record.TwoFactor = database.TwoFactor{UserID: in.UserID, EncryptedSecret: in.EncryptedSecret}
+		return put(bucket(tx, twoFactor), itob(in.UserID), record)
+	})
+	if err != nil {
+		return wrap(err, "bolt.SaveTwoFactor")
+	}
+	in.Enabled, in.LastStep = false, 0
+	return nil
+}
+
+// EnableTwoFactor implements Storer, enables a pending two-factor enrollment and replaces the User's recovery codes.
+func (db *DB) EnableTwoFactor(userID int64, codeHashes [][]byte) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateTwoFactor(tx, userID, func(record *twoFactorRecord) bool {
+			record.Enabled, record.RecoveryCodes = true, codeHashes
+			return true
+		})
+		return err
+	}), "bolt.EnableTwoFactor")
+}
+
+// DeleteTwoFactor implements Storer, removes a User's two-factor authentication and recovery codes.
+func (db *DB) DeleteTwoFactor(userID int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		if bucket(tx, twoFactor).Get(itob(userID)) == nil {
+			return database.ErrNotFound
+		}
+		return bucket(tx, twoFactor).Delete(itob(userID))
+	}), "bolt.DeleteTwoFactor")
+}
+
+// UseTwoFactorStep implements Storer, records an accepted code's time step. Only one write transaction runs at a time,
+// so two requests racing to use the same code can't both succeed.
+func (db *DB) UseTwoFactorStep(userID int64, step int64) (bool, error) {
+	var used bool
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		used, err = updateTwoFactor(tx, userID, func(record *twoFactorRecord) bool {
+			if record.LastStep >= step {
+				return false
+			}
+			record.LastStep = step
+			return true
+		})
+		// Like our other Storers, a User who never enrolled simply has no step to use
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, wrap(err, "bolt.UseTwoFactorStep")
+	}
+	return used, nil
+}
+
+// UseRecoveryCode implements Storer, removes a recovery code so it can't be used again.
+func (db *DB) UseRecoveryCode(userID int64, codeHash []byte) (bool, error) {
+	var used bool
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		used, err = updateTwoFactor(tx, userID, func(record *twoFactorRecord) bool {
+			for i, code := range record.RecoveryCodes {
+				if bytes.Equal(code, codeHash) {
+					record.RecoveryCodes = append(record.RecoveryCodes[:i], record.RecoveryCodes[i+1:]...)
+					return true
+				}
+			}
+			return false
+		})
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, wrap(err, "bolt.UseRecoveryCode")
+	}
+	return used, nil
+}
@@ -0,0 +1,528 @@
+package bolt
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// userRecord is how a User is kept in our users bucket. User refuses to be encoded as JSON (see User.MarshalJSON), so
+// its fields are copied into one of these.
+type userRecord struct {
+	ID            int64
+	First         string
+	Last          string
+	Email         string
+	Username      string
+	Role          string
+	PasswordHash  string
+	Enabled       bool
+	FailedLogins  int
+	Locked        bool
+	EmailVerified bool
+	Deleted       *time.Time `json:",omitempty"` // Set once the User is soft deleted, hiding them from every lookup
+}
+
+// user converts a userRecord back into a User.
+func (r userRecord) user() database.User {
+	return database.User{
+		ID:            r.ID,
+		First:         r.First,
+		Last:          r.Last,
+		Email:         r.Email,
+		Username:      r.Username,
+		Role:          r.Role,
+		PasswordHash:  r.PasswordHash,
+		Enabled:       r.Enabled,
+		FailedLogins:  r.FailedLogins,
+		Locked:        r.Locked,
+		EmailVerified: r.EmailVerified,
+	}
+}
+
+// loadUser reads a User's record, deleted or not.
+func loadUser(tx *bbolt.Tx, id int64) (userRecord, error) {
+	return get[userRecord](bucket(tx, users), itob(id))
+}
+
+// loadVisibleUser reads a User's record, returning our not found error if they've been soft deleted.
+func loadVisibleUser(tx *bbolt.Tx, id int64) (userRecord, error) {
+	record, err := loadUser(tx, id)
+	if err == nil && record.Deleted != nil {
+		return userRecord{}, database.ErrNotFound
+	}
+	return record, err
+}
+
+// saveUser stores a User's record, keeping our email and username indexes up to date. old is the record being
+// replaced, nil for a new User. Returns ErrUsernameTaken if another User has the username.
+func saveUser(tx *bbolt.Tx, old *userRecord, record userRecord) error {
+	byEmail, byUsername := bucket(tx, usersEmail), bucket(tx, usersUsername)
+	if record.Username != "" && (old == nil || old.Username != record.Username) {
+		if owner := byUsername.Get([]byte(record.Username)); owner != nil && btoi(owner) != record.ID {
+			return database.ErrUsernameTaken
+		}
+	}
+	if old != nil {
+		if old.Email != record.Email {
+			if err := byEmail.Delete(indexKey([]byte(old.Email), itob(old.ID))); err != nil {
+				return err
+			}
+		}
+		if old.Username != "" && old.Username != record.Username {
+			if err := byUsername.Delete([]byte(old.Username)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := byEmail.Put(indexKey([]byte(record.Email), itob(record.ID)), nil); err != nil {
+		return err
+	}
+	if record.Username != "" {
+		if err := byUsername.Put([]byte(record.Username), itob(record.ID)); err != nil {
+			return err
+		}
+	}
+	return put(bucket(tx, users), itob(record.ID), record)
+}
+
+// updateUser changes a User's record with fn, returning our not found error if they don't exist. With visibleOnly set,
+// soft deleted Users count as not existing.
+func updateUser(tx *bbolt.Tx, id int64, visibleOnly bool, fn func(record *userRecord)) (userRecord, error) {
+	load := loadUser
+	if visibleOnly {
+		load = loadVisibleUser
+	}
+	old, err := load(tx, id)
+	if err != nil {
+		return userRecord{}, err
+	}
+	record := old
+	fn(&record)
+	return record, saveUser(tx, &old, record)
+}
+
+// CreateUser implements Storer, inserts a new User record into the database, the ID field will be generated as part of this process
+func (db *DB) CreateUser(in *database.User) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return insertUser(tx, in)
+	}), "bolt.CreateUser")
+}
+
+// insertUser inserts a User with tx (such as when using an invite), and updates the User with their new ID.
+func insertUser(tx *bbolt.Tx, in *database.User) error {
+	// Usernames other Users have given up stay theirs, new Users can't take them either
+	reserved, err := usernameReserved(tx, in.Username, 0)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return database.ErrUsernameTaken
+	}
+	id, err := nextID(bucket(tx, users))
+	if err != nil {
+		return err
+	}
+	// New users are always enabled, and are regular users until promoted
+	err = saveUser(tx, nil, userRecord{
+		ID:            id,
+		First:         in.First,
+		Last:          in.Last,
+		Email:         in.Email,
+		Username:      in.Username,
+		Role:          database.RoleUser,
+		PasswordHash:  in.PasswordHash,
+		Enabled:       true,
+		EmailVerified: in.EmailVerified,
+	})
+	if err != nil {
+		return err
+	}
+	in.ID, in.Enabled, in.Role = id, true, database.RoleUser
+	return nil
+}
+
+// GetUserByID implements Storer, retrieves a User record by the ID field
+func (db *DB) GetUserByID(id int64) (database.User, error) {
+	var record userRecord
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = loadVisibleUser(tx, id)
+		return err
+	})
+	return record.user(), wrap(err, "bolt.GetUserByID")
+}
+
+// GetUserByEmail implements Storer, retrieves a User record by the Email field. Emails aren't unique (a deleted User
+// may have had it), so this is the first visible User with it.
+func (db *DB) GetUserByEmail(email string) (database.User, error) {
+	var record userRecord
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = visibleUserByEmail(tx, email)
+		return err
+	})
+	return record.user(), wrap(err, "bolt.GetUserByEmail")
+}
+
+// visibleUserByEmail reads the record of the first visible User with an email, found through our email index.
+func visibleUserByEmail(tx *bbolt.Tx, email string) (userRecord, error) {
+	for _, id := range keysWithPrefix(bucket(tx, usersEmail), indexKey([]byte(email), nil)) {
+		if record, err := loadVisibleUser(tx, btoi(id)); !errors.Is(err, database.ErrNotFound) {
+			return record, err
+		}
+	}
+	return userRecord{}, database.ErrNotFound
+}
+
+// GetUserByUsername implements Storer, retrieves a User record by the Username field
+func (db *DB) GetUserByUsername(username string) (database.User, error) {
+	var record userRecord
+	err := db.view(func(tx *bbolt.Tx) error {
+		id := bucket(tx, usersUsername).Get([]byte(username))
+		if id == nil {
+			return database.ErrNotFound
+		}
+		var err error
+		record, err = loadVisibleUser(tx, btoi(id))
+		return err
+	})
+	return record.user(), wrap(err, "bolt.GetUserByUsername")
+}
+
+// usernameReserved reports whether a User other than id (0 for a new User) has given up a username. Having no username
+// reserves nothing.
+func usernameReserved(tx *bbolt.Tx, username string, id int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	changes, err := all(bucket(tx, usernameHistory), func(change database.UsernameChange) bool {
+		return change.Old == username && change.UserID != id
+	})
+	return len(changes) > 0, err
+}
+
+// recordUsernameChange adds a change to a User's username history.
+func recordUsernameChange(tx *bbolt.Tx, change database.UsernameChange) error {
+	history := bucket(tx, usernameHistory)
+	seq, err := nextID(history)
+	if err != nil {
+		return err
+	}
+	return put(history, idKey(change.UserID, seq), change)
+}
+
+// ChangeUsername implements Storer, changes a User's username and records the change.
+func (db *DB) ChangeUsername(id int64, username string) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		old, err := loadUser(tx, id)
+		if err != nil {
+			return err
+		}
+		if old.Username == username {
+			return nil
+		}
+
+		// Usernames other Users have given up stay theirs, a User may only take back one of their own
+		reserved, err := usernameReserved(tx, username, id)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			return database.ErrUsernameTaken
+		}
+
+		record := old
+		record.Username = username
+		if err := saveUser(tx, &old, record); err != nil {
+			return err
+		}
+		return recordUsernameChange(tx, database.UsernameChange{UserID: id, Old: old.Username, New: username, Changed: clock.Now()})
+	}), "bolt.ChangeUsername")
+}
+
+// UsernameReserved implements Storer, reports whether any User has given up a username
+func (db *DB) UsernameReserved(username string) (bool, error) {
+	var reserved bool
+	err := db.view(func(tx *bbolt.Tx) error {
+		var err error
+		reserved, err = usernameReserved(tx, username, 0)
+		return err
+	})
+	return reserved, wrap(err, "bolt.UsernameReserved")
+}
+
+// UsernameHistory implements Storer, lists a User's username changes oldest first
+func (db *DB) UsernameHistory(id int64) ([]database.UsernameChange, error) {
+	var changes []database.UsernameChange
+	err := db.view(func(tx *bbolt.Tx) error {
+		return withPrefix(bucket(tx, usernameHistory), itob(id), func(k, data []byte) error {
+			change, err := decode[database.UsernameChange](data)
+			changes = append(changes, change)
+			return err
+		})
+	})
+	return changes, wrap(err, "bolt.UsernameHistory")
+}
+
+// ListUsers implements Storer, retrieves a page of User records in ID order
+func (db *DB) ListUsers(afterID int64, limit int) ([]database.User, error) {
+	var list []database.User
+	err := db.view(func(tx *bbolt.Tx) error {
+		records, err := after(bucket(tx, users), afterID, limit, notDeleted)
+		for _, record := range records {
+			list = append(list, record.user())
+		}
+		return err
+	})
+	return list, wrap(err, "bolt.ListUsers")
+}
+
+// SearchUsers implements Storer, retrieves User records whose name or email contains query, prefix matches first. Each
+// match's memberships are checked against the scope in the same transaction, before we cut the list down to limit.
+func (db *DB) SearchUsers(query string, scope database.UserScope, limit int) ([]database.User, error) {
+	var prefixed, rest []database.User
+	err := db.view(func(tx *bbolt.Tx) error {
+		records, err := all(bucket(tx, users), notDeleted)
+		for _, record := range records {
+			user := record.user()
+			if !inScope(tx, scope, user.ID) {
+				continue
+			}
+			switch matches, prefix := user.SearchMatch(query); {
+			case prefix:
+				prefixed = append(prefixed, user)
+			case matches:
+				rest = append(rest, user)
+			}
+		}
+		return err
+	})
+	list := append(prefixed, rest...)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, wrap(err, "bolt.SearchUsers")
+}
+
+// CountUsers implements Storer, counts the User records that haven't been deleted
+func (db *DB) CountUsers() (int, error) {
+	var count int
+	err := db.view(func(tx *bbolt.Tx) error {
+		records, err := all(bucket(tx, users), notDeleted)
+		count = len(records)
+		return err
+	})
+	return count, wrap(err, "bolt.CountUsers")
+}
+
+// notDeleted reports whether a User's record is visible, as it hasn't been soft deleted.
+func notDeleted(record userRecord) bool {
+	return record.Deleted == nil
+}
+
+// UpdateUser implements Storer, saves the name and email of a User record
+func (db *DB) UpdateUser(in *database.User) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, in.ID, true, func(record *userRecord) {
+			record.First, record.Last, record.Email = in.First, in.Last, in.Email
+		})
+		return err
+	}), "bolt.UpdateUser")
+}
+
+// SetUserEnabled implements Storer, enables or disables a User record
+func (db *DB) SetUserEnabled(id int64, enabled bool) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, id, false, func(record *userRecord) { record.Enabled = enabled })
+		return err
+	}), "bolt.SetUserEnabled")
+}
+
+// SetUserRole implements Storer, changes the role of a User record
+func (db *DB) SetUserRole(id int64, role string) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, id, true, func(record *userRecord) { record.Role = role })
+		return err
+	}), "bolt.SetUserRole")
+}
+
+// SetPasswordHash implements Storer, replaces the password hash of a User record
+func (db *DB) SetPasswordHash(id int64, hash string) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, id, false, func(record *userRecord) { record.PasswordHash = hash })
+		return err
+	}), "bolt.SetPasswordHash")
+}
+
+// RecordFailedLogin implements Storer, counting the failure and locking the User once they reach the limit
+func (db *DB) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	var record userRecord
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = updateUser(tx, id, false, func(record *userRecord) {
+			record.FailedLogins++
+			record.Locked = record.Locked || (lockAfter > 0 && record.FailedLogins >= lockAfter)
+		})
+		return err
+	})
+	return record.Locked, wrap(err, "bolt.RecordFailedLogin")
+}
+
+// UnlockUser implements Storer, clearing a User's failed logins and unlocking them
+func (db *DB) UnlockUser(id int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, id, false, func(record *userRecord) { record.FailedLogins, record.Locked = 0, false })
+		return err
+	}), "bolt.UnlockUser")
+}
+
+// DeleteUser implements Storer, deletes a User record from the database, along with everything that refers to it.
+func (db *DB) DeleteUser(id int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return deleteUser(tx, id)
+	}), "bolt.DeleteUser")
+}
+
+// deleteUser deletes a User and everything that refers to them, as the foreign keys in our SQL schema do (ON DELETE
+// CASCADE). The audit log, security events, domain events and user deletions outlive the User, so are left alone.
+func deleteUser(tx *bbolt.Tx, id int64) error {
+	record, err := loadUser(tx, id)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := deleteUserSessions(tx, id); err != nil {
+		return err
+	}
+	if err := deletePrefix(bucket(tx, usernameHistory), itob(id)); err != nil {
+		return err
+	}
+	if err := deletePrefix(bucket(tx, dealershipMembers), itob(id)); err != nil {
+		return err
+	}
+	if err := bucket(tx, twoFactor).Delete(itob(id)); err != nil {
+		return err
+	}
+	if err := unlinkIdentities(tx, id); err != nil {
+		return err
+	}
+	for _, tokens := range []string{emailChanges, magicLinks, passwordResets, emailVerifications} {
+		if err := deleteUserToken(tx, tokens, id); err != nil {
+			return err
+		}
+	}
+	if _, err := deleteWhere(bucket(tx, invites), func(invite database.Invite) bool { return invite.InvitedBy == id }); err != nil {
+		return err
+	}
+	if err := deleteUserAPITokens(tx, id); err != nil {
+		return err
+	}
+
+	if err := bucket(tx, usersEmail).Delete(indexKey([]byte(record.Email), itob(id))); err != nil {
+		return err
+	}
+	if record.Username != "" {
+		if err := bucket(tx, usersUsername).Delete([]byte(record.Username)); err != nil {
+			return err
+		}
+	}
+	return bucket(tx, users).Delete(itob(id))
+}
+
+// SoftDeleteUser implements Storer, hides a User and records their pending deletion. They're disabled too, so even
+// something that reads the users bucket directly won't treat them as active.
+func (db *DB) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	now := clock.Now()
+	deletion := database.UserDeletion{UserID: id, Requested: now, Status: database.DeletionPending}
+	err := db.update(func(tx *bbolt.Tx) error {
+		_, err := updateUser(tx, id, true, func(record *userRecord) { record.Deleted, record.Enabled = &now, false })
+		if err != nil {
+			return err
+		}
+		return put(bucket(tx, userDeletions), itob(id), deletion)
+	})
+	if err != nil {
+		return database.UserDeletion{}, wrap(err, "bolt.SoftDeleteUser")
+	}
+	return deletion, nil
+}
+
+// MergeUsers implements Storer, merges one User into another in a single transaction.
+func (db *DB) MergeUsers(keepID, mergeID int64) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		keep, err := loadUser(tx, keepID)
+		if err != nil {
+			return err
+		}
+		merged, err := loadUser(tx, mergeID)
+		if err != nil {
+			return err
+		}
+
+		// Usernames are unique, so the merged User has to give theirs up before the kept User can take it
+		if _, err := updateUser(tx, mergeID, false, func(record *userRecord) { record.Username = "" }); err != nil {
+			return err
+		}
+
+		// Combine the two User records, following our conflict rules
+		_, err = updateUser(tx, keepID, false, func(record *userRecord) {
+			record.Enabled = keep.Enabled && merged.Enabled
+			record.Locked = keep.Locked || merged.Locked
+			if keep.Username == "" {
+				record.Username = merged.Username
+			}
+			if keep.First == "" {
+				record.First = merged.First
+			}
+			if keep.Last == "" {
+				record.Last = merged.Last
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		// Move everything else across. Sessions and email changes aren't moved, deleting the merged User removes them.
+		for _, dealershipID := range keysWithPrefix(bucket(tx, dealershipMembers), itob(mergeID)) {
+			if err := bucket(tx, dealershipMembers).Put(idKey(keepID, btoi(dealershipID)), nil); err != nil {
+				return err
+			}
+		}
+		if err := moveIdentities(tx, mergeID, keepID); err != nil {
+			return err
+		}
+		if err := moveAuditEntries(tx, mergeID, keepID); err != nil {
+			return err
+		}
+		history := bucket(tx, usernameHistory)
+		for _, seq := range keysWithPrefix(history, itob(mergeID)) {
+			change, err := get[database.UsernameChange](history, append(itob(mergeID), seq...))
+			if err != nil {
+				return err
+			}
+			change.UserID = keepID
+			if err := put(history, append(itob(keepID), seq...), change); err != nil {
+				return err
+			}
+		}
+		// If the kept User already had a username, the merged User's is given up, so record that to keep it reserved
+		if keep.Username != "" && merged.Username != "" {
+			err := recordUsernameChange(tx, database.UsernameChange{
+				UserID:  keepID,
+				Old:     merged.Username,
+				New:     keep.Username,
+				Changed: clock.Now(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return deleteUser(tx, mergeID)
+	}), "bolt.MergeUsers")
+}
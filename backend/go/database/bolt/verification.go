@@ -0,0 +1,33 @@
+package bolt
+
+import (
+	"examples/database"
+
+	"go.etcd.io/bbolt"
+)
+
+// CreateEmailVerification implements Storer, stores an email verification. A User can only have one verification at a
+// time, so sending a new one stops any earlier link from working.
+func (db *DB) CreateEmailVerification(in *database.EmailVerification) error {
+	return wrap(db.update(func(tx *bbolt.Tx) error {
+		return replaceToken(tx, emailVerifications, in.TokenHash, in.UserID, in)
+	}), "bolt.CreateEmailVerification")
+}
+
+// VerifyEmail implements Storer, removes an email verification so its token can't be used again, and marks the User's
+// email as verified in the same transaction.
+func (db *DB) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	var verification database.EmailVerification
+	err := db.update(func(tx *bbolt.Tx) error {
+		var err error
+		if verification, err = useToken[database.EmailVerification](tx, emailVerifications, tokenHash); err != nil {
+			return err
+		}
+		_, err = updateUser(tx, verification.UserID, true, func(record *userRecord) { record.EmailVerified = true })
+		return err
+	})
+	if err != nil {
+		return database.EmailVerification{}, wrap(err, "bolt.VerifyEmail")
+	}
+	return verification, nil
+}
@@ -4,7 +4,15 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"examples/errs"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -13,33 +21,347 @@ import (
 // Session contains the information about an active session.
 type Session struct {
 	ID             int64     // This will be generated by the SaveSession method
+	TokenHash      []byte    // SHA-256 of the session's bearer token, the token itself is only ever given to the client
+	UserID         int64     // The User this session belongs to
 	EncryptedCreds []byte    // Note that these are ENCRYPTED, NEVER store credentials in plain text, ever!
+	Created        time.Time // When the user logged in
 	Expires        time.Time // Ideally this would be refreshed with activity
 	EndOfLife      time.Time // Maximum life of token, prevents a user being endlessly logged in
+	IP             string    // IP address the user logged in from
+	RefreshFamily  string    // Refresh token family the session was created from, revoking the family ends the session
+	Remember       bool      // The User asked to be remembered when logging in, so the session has longer lifespans
+	UserAgent      string    // User-Agent of the client that last used the session, to help Users recognise it
+	LastSeen       time.Time // When the session was last used, kept roughly (see TouchSession)
+	LastIP         string    // IP address the session was last used from
+	ImpersonatorID int64     // Admin acting as the User through this session (see impersonate.go), 0 for the User's own
+}
+
+// SessionFilter picks out sessions by who they belong to, when they were created, and where from. Every field that is
+// set must match, fields left empty match every session.
+type SessionFilter struct {
+	UserIDs       []int64      // Sessions belonging to any of these Users
+	CreatedBefore time.Time    // Sessions created before this time
+	IPRange       netip.Prefix // Sessions created from an IP address in this range
+}
+
+// Empty reports whether the filter has no criteria at all, so would match every session.
+func (f SessionFilter) Empty() bool {
+	return len(f.UserIDs) == 0 && f.CreatedBefore.IsZero() && !f.IPRange.IsValid()
+}
+
+// Matches reports whether a session meets every criterion set in the filter, for Storers that can't filter sessions
+// themselves.
+func (f SessionFilter) Matches(s Session) bool {
+	if len(f.UserIDs) > 0 && !slices.Contains(f.UserIDs, s.UserID) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !s.Created.Before(f.CreatedBefore) {
+		return false
+	}
+	if f.IPRange.IsValid() {
+		ip, err := netip.ParseAddr(s.IP)
+		if err != nil || !f.IPRange.Masked().Contains(ip.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+// RefreshToken lets a client get a new access token (a session, or a signed token) without logging in again. Each
+// refresh token can only be used once, using it hands out a replacement (rotation). Every token descended from the same
+// login shares a FamilyID, so if a used token is ever presented again (meaning someone has a copy of it) we can revoke
+// the whole family.
+type RefreshToken struct {
+	TokenHash []byte    // Hash of the token, the token itself is never stored
+	FamilyID  string    // Shared by every token descended from the same login
+	UserID    int64     // The User the token belongs to
+	Expires   time.Time // Rotating a token doesn't extend this, a family expires at the same time as its first token
+	Remember  bool      // The User asked to be remembered when logging in, passed on to sessions created from the family
 }
 
 // User defines common data associated with a user account. This is fairly sparse for this demo API.
 type User struct {
 	ID                 int64  // This will be generated by the CreateUser method
 	First, Last, Email string // Some basic data
+	Username           string // Unique name the User is addressed by in our routes, empty until they choose one
+	Role               string // What the User may do, RoleUser or RoleAdmin, new Users are RoleUser
+	PasswordHash       string // A one-way hash of the user's password, NEVER store the password itself!
+	Enabled            bool   // Disabled users can't log in, and any sessions they already have stop working
+	FailedLogins       int    // Failed login attempts since the User last logged in successfully
+	Locked             bool   // Locked users can't log in until an admin unlocks them, set after too many failed logins
+	EmailVerified      bool   // The User has proven they own Email, until then there's little they can do
 	// Can always add more, and adjust Storer methods as needed
 }
 
-// Storer contains all the CRUD (Create, Read, Update, Delete) methods that any database implementation should have.
-// Note that if you make any changes to either the interface or the interface types, those changes will also need to
-// be made to your specific implementations.
-type Storer interface {
+// ErrUserJSON is returned when something tries to encode a User as JSON, see User.MarshalJSON.
+var ErrUserJSON = errors.New("database.User can't be encoded as JSON, map it to a type describing only what's needed")
+
+// MarshalJSON refuses to encode a User, so one can never end up in a response (or a cache, or a log) with its password
+// hash by accident. Our API describes Users with its own response type instead (userResponse), picking the fields it
+// shares, and shaping them for the API version the client asked for.
+func (User) MarshalJSON() ([]byte, error) {
+	return nil, ErrUserJSON
+}
+
+// SearchMatch reports whether the User's first name, last name or email contains query, ignoring case, and whether one
+// of them starts with it, for Storers that can't search Users themselves (see Storer.SearchUsers).
+func (u User) SearchMatch(query string) (matches, prefix bool) {
+	query = strings.ToLower(query)
+	for _, field := range []string{u.First, u.Last, u.Email} {
+		field = strings.ToLower(field)
+		if strings.HasPrefix(field, query) {
+			return true, true
+		}
+		if strings.Contains(field, query) {
+			matches = true
+		}
+	}
+	return matches, false
+}
+
+// UserScope narrows a search down to the Users someone may see: themselves, and the other members of their
+// dealerships. The zero value doesn't narrow it at all, as admins may see every User.
+type UserScope struct {
+	ViewerID    int64   // User searching, 0 for every User
+	Dealerships []int64 // Dealerships the viewer is a member of, whose members they may see
+}
+
+// Everyone reports whether the scope includes every User.
+func (s UserScope) Everyone() bool {
+	return s.ViewerID == 0
+}
+
+// Roles a User can have
+const (
+	RoleUser  = "user"  // Regular Users
+	RoleAdmin = "admin" // Administrators, who can manage other Users
+)
+
+// UsernameChange records a User changing their username. A username a User has given up is never handed out to anyone
+// else, so nobody can pick up an old username and pass themselves off as its previous owner.
+type UsernameChange struct {
+	UserID  int64     // User who changed their username
+	Old     string    // Username before the change, empty if they didn't have one
+	New     string    // Username after the change
+	Changed time.Time // When the change was made
+}
+
+// TwoFactor is a User's two-factor authentication (2FA) state. Once enabled, logging in takes a code from the User's
+// authenticator app (or one of their recovery codes) as well as their password.
+type TwoFactor struct {
+	UserID          int64  // The User this belongs to
+	EncryptedSecret []byte // The TOTP secret shared with the User's authenticator app, ENCRYPTED like session credentials
+	Enabled         bool   // False while enrolling, until the User proves their app is set up by entering a code
+	LastStep        int64  // Time step of the last code accepted, codes for this step or earlier are refused
+}
+
+// How far along deleting a User is
+const (
+	DeletionPending  = "pending"  // The User is hidden, but the rest of their data is still being cleaned up
+	DeletionComplete = "complete" // Everything has been cleaned up, and the User record itself deleted
+)
+
+// UserDeletion tracks deleting a User. Deleting a User hides them straight away (a soft delete), then cleaning up
+// everything else they left behind (sessions, memberships, files, etc) is done step by step in the background. Each
+// step is recorded as it finishes, so a step that fails is retried without redoing the ones before it.
+type UserDeletion struct {
+	UserID    int64     // The User being deleted, this record outlives the User itself
+	Requested time.Time // When the User was deleted
+	Status    string    // DeletionPending or DeletionComplete
+	Step      string    // The last cleanup step that finished, empty if none have yet
+	Attempts  int       // How many times cleanup has failed
+	Error     string    // Why cleanup last failed, empty if it hasn't
+	Completed time.Time // When cleanup finished, zero until it has
+}
+
+// EmailChange is a pending change to a User's email. The change is only applied once the User confirms it, using the
+// token we sent to the new address, proving they own it.
+type EmailChange struct {
+	TokenHash []byte    // Hash of the confirmation token, we never store the token itself
+	UserID    int64     // User whose email is being changed
+	OldEmail  string    // Email at the time the change was requested, notified once the change is applied
+	NewEmail  string    // Email the User is changing to
+	Expires   time.Time // The change can no longer be confirmed after this time
+}
+
+// MagicLink lets a User log in without their password, using the token we emailed them. Each link works once.
+type MagicLink struct {
+	TokenHash []byte    // Hash of the link's token, we never store the token itself
+	UserID    int64     // User the link logs in
+	Remember  bool      // The User asked to be remembered when requesting the link
+	Expires   time.Time // The link can no longer be used after this time
+}
+
+// EmailVerification lets a new User prove they own their email, using the token we emailed them when their account was
+// created. Each verification works once.
+type EmailVerification struct {
+	TokenHash []byte    // Hash of the verification token, we never store the token itself
+	UserID    int64     // User whose email is being verified
+	Expires   time.Time // The verification can no longer be used after this time
+}
+
+// Invite lets someone create an account with the email they were invited at, using the token we emailed them. Each
+// invite works once.
+type Invite struct {
+	ID        int64     // This will be generated by the CreateInvite method
+	TokenHash []byte    // Hash of the invite's token, we never store the token itself
+	Email     string    // Who was invited, the account they create has this email
+	InvitedBy int64     // Admin who sent the invite
+	Created   time.Time // When the invite was sent
+	Expires   time.Time // The invite can no longer be used after this time
+}
+
+// DomainEvent records a change to our data that other services may want to follow, such as a User being created, in the
+// order the changes happened. Unlike the audit log (who did what) events describe the data itself, so a consumer that
+// missed some can catch up by replaying them from the last one it saw.
+type DomainEvent struct {
+	Seq    int64     // Position in the event log, generated by AppendDomainEvent, events are always added in order
+	Time   time.Time // When the change happened
+	Type   string    // What changed, such as "user.created"
+	UserID int64     // User the change was to, 0 if it wasn't to a User
+	Data   []byte    // JSON describing the change, its shape depends on Type
+}
+
+// PasswordReset lets a User choose a new password without knowing their current one, using the token we emailed them
+// after an admin reset their password. Each reset works once.
+type PasswordReset struct {
+	TokenHash []byte    // Hash of the reset token, we never store the token itself
+	UserID    int64     // User whose password is being reset
+	Expires   time.Time // The reset can no longer be used after this time
+}
+
+// APIToken is a personal access token, letting a User's scripts (such as a CI pipeline) call our API without logging
+// in. A token only carries the permissions (scopes) the User picked for it, and only while the User still has them.
+type APIToken struct {
+	ID        int64     // This will be generated by the CreateAPIToken method
+	UserID    int64     // The User the token acts as
+	Name      string    // What the User called it, so they can tell their tokens apart
+	TokenHash []byte    // Hash of the token, the token itself is only ever shown once, when it's created
+	Scopes    []string  // Permissions the token carries, such as "self:read"
+	Created   time.Time // When the token was created
+	Expires   time.Time // The token stops working after this time
+	LastUsed  time.Time // When the token was last used, to within a few minutes, zero if it never has been
+}
+
+// TenantSettings are the settings a tenant (a dealership) has overridden for its members. Anything left zero isn't
+// overridden, so our own setting applies. A User who belongs to several tenants gets the strictest of their settings.
+type TenantSettings struct {
+	TenantID            int64         // The dealership these settings are for
+	IdleTimeout         time.Duration // How long a session lasts without being used
+	MaxLifetime         time.Duration // The absolute limit on a session
+	RememberIdleTimeout time.Duration // IdleTimeout for sessions where the User asked to be remembered
+	RememberLifetime    time.Duration // MaxLifetime for sessions where the User asked to be remembered
+	PasswordMinLength   int           // The shortest password members may choose, never less than our own minimum
+	AllowedOrigins      []string      // Origins browsers may call us from, on top of our own (see cors)
+	Updated             time.Time     // When the settings were last changed, set by SaveTenantSettings
+}
+
+// AuditEntry records something significant that happened, and who did it. Audit entries are only ever added, never
+// changed, giving a trustworthy history to look back on.
+type AuditEntry struct {
+	ID       int64     // This will be generated by the CreateAuditEntry method
+	Time     time.Time // When it happened
+	ActorID  int64     // User who did it, 0 if it wasn't done by a User (e.g. a background task)
+	Action   string    // What happened, such as "user.install_links"
+	TargetID int64     // User it was done to, if any
+	Detail   string    // Any extra information, such as whether an email was delivered
+	IP       string    // IP address of the client that made the request, empty if it wasn't made by a request
+}
+
+// SecurityEvent records something security relevant (a login, a failed login, a change to 2FA or roles) for security
+// monitoring, kept apart from the audit log so it can be exported to a SIEM. Events are never changed or removed. Each
+// event's hash covers the event before it, so changing or removing an event (or slipping one in) breaks the chain from
+// that event on, which VerifyChain can detect.
+type SecurityEvent struct {
+	ID       int64     // This will be generated by the CreateSecurityEvent method
+	Time     time.Time // When it happened, kept to the microsecond (the most our database keeps)
+	Kind     string    // What happened, such as "login.failure"
+	UserID   int64     // User it happened to, 0 if we don't know (such as a login for an unknown email)
+	IP       string    // IP address of the client that made the request, empty if it wasn't made by a request
+	Detail   string    // Any extra information
+	PrevHash []byte    // Hash of the event before this one, empty for the first event
+	Hash     []byte    // Hash of this event, set by CreateSecurityEvent
+}
+
+// ChainHash returns the hash of the event, chained to the hash of the event before it. Text fields are quoted, so no two
+// different events can produce the same input.
+func (e SecurityEvent) ChainHash(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	fmt.Fprintf(h, "\n%d\n%q\n%d\n%q\n%q", e.Time.UnixMicro(), e.Kind, e.UserID, e.IP, e.Detail)
+	return h.Sum(nil)
+}
+
+// VerifyChain checks each event follows on from the one before, and that its hash is correct. The first event's
+// PrevHash is taken on trust, so a chain can be checked in pages. Returns the ID of the first event that doesn't match,
+// and false, if the chain is broken.
+func VerifyChain(events []SecurityEvent) (int64, bool) {
+	for i, e := range events {
+		if i > 0 && !bytes.Equal(e.PrevHash, events[i-1].Hash) {
+			return e.ID, false
+		}
+		if !bytes.Equal(e.Hash, e.ChainHash(e.PrevHash)) {
+			return e.ID, false
+		}
+	}
+	return 0, true
+}
+
+// SessionStorer is the part of Storer that keeps track of sessions, along with the refresh tokens they're created from.
+// It's split out so sessions can be kept somewhere other than our Users, such as Redis (see database/redis), whose own
+// expiry removes them when they end. Combine a SessionStorer with the Storer keeping everything else using
+// WithSessions.
+type SessionStorer interface {
+	// Ping checks that wherever sessions are kept is reachable and usable
+	Ping() error
+
 	// Session methods
 	// SaveSession stores a session in the database, filling in the ID that can be used to refetch it
 	SaveSession(in *Session) error
 	// LoadSession reads a session back out from the database
 	LoadSession(id int64) (Session, error)
+	// LoadSessionByToken reads back the session whose bearer token has the given hash
+	LoadSessionByToken(tokenHash []byte) (Session, error)
+	// ListSessionsByUser lists a User's unexpired sessions, newest first
+	ListSessionsByUser(userID int64) ([]Session, error)
 	// LogoutSession deletes the record of a given session
 	LogoutSession(id int64) error
 	// ExtendSession extends the expiration to be valid for the specified lifespan added to the current time
 	ExtendSession(id int64, lifespan time.Duration) error
+	// TouchSession records when, and from where, a session was last used
+	TouchSession(id int64, seen time.Time, ip, userAgent string) error
+	// ListSessionsAfter lists up to limit unexpired sessions with an ID greater than afterID, in ID order, so every
+	// session can be worked through a page at a time
+	ListSessionsAfter(afterID int64, limit int) ([]Session, error)
+	// UpdateSessionCreds replaces a session's encrypted credentials, such as after re-encrypting them with a new key
+	UpdateSessionCreds(id int64, encryptedCreds []byte) error
 	// ClearExpiredSessions removes any records that are expired, returns any error and number of sessions cleared
 	ClearExpiredSessions() (int, error)
+	// RevokeSessions deletes up to limit sessions matching the filter, along with the refresh token families they were
+	// created from, so they can't simply be refreshed. Returns the IDs of the sessions deleted, fewer than limit means
+	// there are none left to delete. Call it repeatedly to work through every match in batches.
+	RevokeSessions(filter SessionFilter, limit int) ([]int64, error)
+	// DeleteUserSessions deletes every session and refresh token belonging to a User. Returns the IDs of the sessions
+	// deleted.
+	DeleteUserSessions(userID int64) ([]int64, error)
+
+	// Refresh token methods
+	// CreateRefreshToken stores a new, unused refresh token
+	CreateRefreshToken(in *RefreshToken) error
+	// RotateRefreshToken marks the unexpired refresh token with hash oldHash as used, and stores its replacement with
+	// hash newHash in the same family. Returns the replacement. If the token has already been used, nothing is changed
+	// and ErrRefreshTokenReused is returned along with the token, whose family should then be revoked.
+	RotateRefreshToken(oldHash, newHash []byte) (RefreshToken, error)
+	// RevokeRefreshFamily deletes every refresh token in a family, along with every session created from it. Returns the
+	// IDs of the sessions deleted.
+	RevokeRefreshFamily(familyID string) ([]int64, error)
+}
+
+// UserStorer is the part of Storer that keeps Users themselves, along with the ways they log in (OAuth identities and
+// two-factor authentication).
+type UserStorer interface {
+	// Ping checks that wherever Users are kept is reachable and usable
+	Ping() error
 
 	// User methods
 	// CreateUser inserts a new User record into the database, the ID field will be generated as part of this process
@@ -48,11 +370,242 @@ type Storer interface {
 	GetUserByID(id int64) (User, error)
 	// GetUserByEmail retrieves a User record by the Email field
 	GetUserByEmail(email string) (User, error)
+	// GetUserByUsername retrieves a User record by the Username field
+	GetUserByUsername(username string) (User, error)
+	// ChangeUsername changes a User's username, recording the change in their username history. Returns
+	// ErrUsernameTaken if another User has the username, or had it in the past.
+	ChangeUsername(id int64, username string) error
+	// UsernameHistory lists the changes a User has made to their username, oldest first
+	UsernameHistory(id int64) ([]UsernameChange, error)
+	// UsernameReserved reports whether any User has given up a username. It stays theirs, so nobody else can take it
+	// (CreateUser and ChangeUsername return ErrUsernameTaken), though they may take it back.
+	UsernameReserved(username string) (bool, error)
 	// You can add as many methods as needed, such as GetUserByFirstAndLast, etc
-	// DeleteUser deletes a User record from the database
+	// ListUsers lists up to limit Users with IDs after afterID, in ID order, so every User can be paged through by
+	// passing the ID of the last User of each page to get the next. Deleted Users aren't listed.
+	ListUsers(afterID int64, limit int) ([]User, error)
+	// CountUsers counts every User, apart from deleted ones
+	CountUsers() (int, error)
+	// SearchUsers lists up to limit Users whose first name, last name or email contains query, ignoring case, and who
+	// are within scope. Users with one that starts with query come first, then the rest, each in ID order. Deleted
+	// Users aren't listed. The scope is applied as part of the search, so Users outside it never use up the limit.
+	SearchUsers(query string, scope UserScope, limit int) ([]User, error)
+	// UpdateUser saves changes to a User's name and email (their First, Last and Email). Everything else about a User
+	// has a method of its own, such as ChangeUsername or SetUserRole, so is left as it is. Returns ErrNotFound if the
+	// User doesn't exist, or has been deleted.
+	UpdateUser(in *User) error
+	// SetUserEnabled enables or disables a User record
+	SetUserEnabled(id int64, enabled bool) error
+	// SetUserRole changes a User's role, to RoleUser or RoleAdmin
+	SetUserRole(id int64, role string) error
+	// SetPasswordHash replaces a User's password hash
+	SetPasswordHash(id int64, hash string) error
+	// RecordFailedLogin counts a failed login attempt against a User, locking them once they reach lockAfter consecutive
+	// failures (0 never locks). Returns whether the User is now locked.
+	RecordFailedLogin(id int64, lockAfter int) (bool, error)
+	// UnlockUser clears a User's failed login attempts, unlocking them if they were locked
+	UnlockUser(id int64) error
+	// DeleteUser deletes a User record from the database, along with anything left that refers to it
 	DeleteUser(id int64) error
+	// SoftDeleteUser hides a User, as if they had been deleted, and starts tracking cleaning up after them. The User
+	// isn't returned by any lookup once this is done. Returns ErrNotFound if they don't exist, or are already deleted.
+	SoftDeleteUser(id int64) (UserDeletion, error)
+	// MergeUsers merges the User with ID mergeID into the User with ID keepID, then deletes the merged User. This is
+	// all or nothing, if anything fails neither User is changed. Where the two Users conflict:
+	//   - The kept User's email and password are kept, their name is only filled in from the merged User if empty
+	//   - The kept User's username is kept, or taken from the merged User if they don't have one. Either way the merged
+	//     User's usernames (current and past) join the kept User's history, so they stay reserved.
+	//   - The kept User is disabled (or locked) if either User was, so merging can't be used to get around either
+	//   - The kept User's role is kept, so merging never promotes anyone
+	//   - Dealership memberships are combined
+	//   - Identities linked from OAuth providers are moved to the kept User
+	//   - The kept User's two-factor authentication is kept, the merged User's is removed
+	//   - Audit entries by or about the merged User are attributed to the kept User
+	//   - The merged User's sessions, API tokens and pending email changes are removed, they were created with its
+	//     credentials
+	MergeUsers(keepID, mergeID int64) error
+
+	// OAuth identity methods
+	// GetUserByIdentity retrieves the User an OAuth provider's identity is linked to, by the provider's name and its own
+	// ID (subject) for the User
+	GetUserByIdentity(provider, subject string) (User, error)
+	// LinkIdentity links an OAuth provider's identity to a User, so they can log in with it. Returns
+	// ErrIdentityLinked if the identity is already linked to a User.
+	LinkIdentity(userID int64, provider, subject string) error
+
+	// Two-factor authentication methods
+	// GetTwoFactor retrieves a User's two-factor authentication state, returning ErrNotFound if they've never enrolled
+	GetTwoFactor(userID int64) (TwoFactor, error)
+	// SaveTwoFactor starts (or restarts) enrolling a User in two-factor authentication, storing their new secret with
+	// Enabled false. Returns ErrTwoFactorEnabled if they already have it enabled.
+	SaveTwoFactor(in *TwoFactor) error
+	// EnableTwoFactor enables a User's pending two-factor authentication, along with a fresh set of recovery codes (by
+	// their hashes) replacing any they had before
+	EnableTwoFactor(userID int64, codeHashes [][]byte) error
+	// DeleteTwoFactor disables a User's two-factor authentication, removing their secret and recovery codes
+	DeleteTwoFactor(userID int64) error
+	// UseTwoFactorStep records that a User's code for the given time step has been accepted. Returns false, changing
+	// nothing, if a code for this step or a later one was already accepted.
+	UseTwoFactorStep(userID int64, step int64) (bool, error)
+	// UseRecoveryCode removes the User's recovery code with the given hash, so it can't be used again. Returns false if
+	// they have no such code.
+	UseRecoveryCode(userID int64, codeHash []byte) (bool, error)
+}
+
+// Storer contains all the CRUD (Create, Read, Update, Delete) methods that any database implementation should have.
+// Note that if you make any changes to either the interface or the interface types, those changes will also need to
+// be made to your specific implementations.
+type Storer interface {
+	UserStorer
+	SessionStorer
+
+	// Health methods
+	// Ping checks that the database is reachable and usable, used by our readiness check
+	Ping() error
+
+	// Transaction methods
+	// WithTx runs fn with a Storer whose calls all belong to a single transaction, committed if fn returns nil and rolled
+	// back if it returns an error, so a change made in several steps (such as creating a User along with their invite
+	// and audit entry) is made entirely or not at all. Only calls made through the Storer fn is given are part of the
+	// transaction. Calling WithTx on that Storer joins the transaction already running rather than starting another,
+	// and fn may be run more than once, as some databases retry a transaction that conflicts with another.
+	WithTx(ctx context.Context, fn func(Storer) error) error
+
+	// User deletion methods
+	// GetUserDeletion retrieves the progress of deleting a User
+	GetUserDeletion(userID int64) (UserDeletion, error)
+	// PendingUserDeletions lists up to limit deletions that haven't finished cleaning up, oldest first
+	PendingUserDeletions(limit int) ([]UserDeletion, error)
+	// SaveUserDeletion records progress cleaning up after a deleted User
+	SaveUserDeletion(in *UserDeletion) error
+
+	// Dealership methods
+	// AddUserToDealership makes a User a member of a dealership, doing nothing if they're already a member
+	AddUserToDealership(userID, dealershipID int64) error
+	// RemoveUserFromDealership removes a User from a dealership
+	RemoveUserFromDealership(userID, dealershipID int64) error
+	// SharesDealership reports whether two Users are members of at least one of the same dealerships
+	SharesDealership(userID, otherID int64) (bool, error)
+	// ListUserDealerships lists the IDs of every dealership a User is a member of
+	ListUserDealerships(userID int64) ([]int64, error)
+	// RemoveUserMemberships removes a User from every dealership they're a member of, returning how many that was
+	RemoveUserMemberships(userID int64) (int, error)
+
+	// Audit methods
+	// CreateAuditEntry adds an entry to the audit log, the ID field will be generated as part of this process
+	CreateAuditEntry(in *AuditEntry) error
+	// PurgeAuditEntries deletes audit entries from before the given time, returning how many were deleted. With dryRun
+	// set nothing is deleted, and the count is how many would have been.
+	PurgeAuditEntries(before time.Time, dryRun bool) (int, error)
+	// AnonymizeAuditEntries strips anything identifying (IP addresses, details) from audit entries by or about a User,
+	// returning how many were changed. The entries themselves are kept, so the history of what happened stays intact.
+	AnonymizeAuditEntries(userID int64) (int, error)
+
+	// Security event methods
+	// CreateSecurityEvent adds an event to the security event log, chaining it to the latest event. The ID, PrevHash
+	// and Hash fields will be set as part of this process.
+	CreateSecurityEvent(in *SecurityEvent) error
+	// ListSecurityEvents lists up to limit security events with IDs after afterID, oldest first
+	ListSecurityEvents(afterID int64, limit int) ([]SecurityEvent, error)
+
+	// Domain event methods
+	// AppendDomainEvent adds an event to the end of our event log, setting its Seq. An event is never visible to
+	// ListDomainEvents before one appended earlier.
+	AppendDomainEvent(in *DomainEvent) error
+	// ListDomainEvents lists up to limit events with Seq after afterSeq, oldest first
+	ListDomainEvents(afterSeq int64, limit int) ([]DomainEvent, error)
+
+	// Email change methods
+	// CreateEmailChange stores a pending email change, replacing any other pending change for the same User
+	CreateEmailChange(in *EmailChange) error
+	// ConfirmEmailChange applies the unexpired pending change with the given token hash to its User, and removes it.
+	// Returns the change that was applied.
+	ConfirmEmailChange(tokenHash []byte) (EmailChange, error)
+	// PurgeEmailChanges deletes pending email changes that expired before the given time, returning how many were
+	// deleted. With dryRun set nothing is deleted, and the count is how many would have been.
+	PurgeEmailChanges(before time.Time, dryRun bool) (int, error)
+
+	// Magic link methods
+	// CreateMagicLink stores a magic link, replacing any other link for the same User
+	CreateMagicLink(in *MagicLink) error
+	// UseMagicLink removes the unexpired magic link with the given token hash, returning it so the User can be logged in
+	UseMagicLink(tokenHash []byte) (MagicLink, error)
+
+	// Password reset methods
+	// CreatePasswordReset stores a password reset, replacing any other reset for the same User
+	CreatePasswordReset(in *PasswordReset) error
+	// UsePasswordReset removes the unexpired password reset with the given token hash, and sets its User's password
+	// hash. Returns the reset that was used.
+	UsePasswordReset(tokenHash []byte, passwordHash string) (PasswordReset, error)
+
+	// Email verification methods
+	// CreateEmailVerification stores an email verification, replacing any other verification for the same User
+	CreateEmailVerification(in *EmailVerification) error
+	// VerifyEmail removes the unexpired email verification with the given token hash, and marks its User's email as
+	// verified. Returns the verification that was used.
+	VerifyEmail(tokenHash []byte) (EmailVerification, error)
+
+	// Invite methods
+	// CreateInvite stores an invite, replacing any other invite for the same email
+	CreateInvite(in *Invite) error
+	// ListInvites lists every invite that hasn't expired or been used, newest first
+	ListInvites() ([]Invite, error)
+	// DeleteInvite removes an invite, so its link stops working
+	DeleteInvite(id int64) error
+	// UseInvite removes the unexpired invite with the given token hash, and creates the User it invited, whose Email
+	// and EmailVerified are set from the invite. Returns the invite that was used, or ErrEmailTaken (leaving the invite
+	// in place) if someone has created a User with that email since the invite was sent.
+	UseInvite(tokenHash []byte, user *User) (Invite, error)
+
+	// API token methods
+	// CreateAPIToken stores a new API token, the ID field will be generated as part of this process
+	CreateAPIToken(in *APIToken) error
+	// ListAPITokens lists a User's API tokens, expired or not, newest first
+	ListAPITokens(userID int64) ([]APIToken, error)
+	// GetAPIToken retrieves the unexpired API token with the given hash
+	GetAPIToken(tokenHash []byte) (APIToken, error)
+	// TouchAPIToken records when an API token was last used
+	TouchAPIToken(id int64, used time.Time) error
+	// DeleteAPIToken removes one of a User's API tokens, so it stops working. Returns ErrNotFound if the User has no
+	// token with that ID.
+	DeleteAPIToken(userID, id int64) error
+
+	// Tenant settings methods
+	// GetTenantSettings retrieves the settings a tenant has overridden, returning ErrNotFound if it hasn't overridden any
+	GetTenantSettings(tenantID int64) (TenantSettings, error)
+	// ListTenantSettings lists the settings of every tenant that has overridden any, by tenant ID
+	ListTenantSettings() ([]TenantSettings, error)
+	// SaveTenantSettings stores a tenant's settings, replacing any it had before, and sets Updated
+	SaveTenantSettings(in *TenantSettings) error
+	// DeleteTenantSettings removes a tenant's settings, so our own apply to its members again
+	DeleteTenantSettings(tenantID int64) error
 	// You can always add more methods, such as updating User information, or more CRUD methods for other interface types
 }
 
-// Standarized errors that may be returned
-var ErrNotFound = errors.New(`session not found`)
+// Standarized errors that may be returned, these carry codes from our errs package so handlers know how to respond
+var ErrNotFound = errs.New(errs.NotFound, `not found`)
+
+// ErrConflict is returned when a change would break one of our database's unique constraints. The more specific
+// conflicts below wrap it, so errors.Is(err, ErrConflict) holds for all of them.
+var ErrConflict = errs.New(errs.Conflict, `conflicts with an existing record`)
+
+// ErrIdentityLinked is returned when linking an OAuth identity that is already linked to a User
+var ErrIdentityLinked = conflict(`identity is already linked to a user`)
+
+// ErrUsernameTaken is returned when a username belongs to (or used to belong to) another User
+var ErrUsernameTaken = conflict(`username is already taken`)
+
+// ErrEmailTaken is returned when creating (or changing the email of) a User with an email that already belongs to
+// another User
+var ErrEmailTaken = conflict(`email is already in use`)
+
+// ErrTwoFactorEnabled is returned when enrolling a User in two-factor authentication they already have enabled
+var ErrTwoFactorEnabled = conflict(`two-factor authentication is already enabled`)
+
+// conflict creates a specific kind of ErrConflict, with a message saying what it conflicts with.
+func conflict(message string) error {
+	return &errs.Error{Code: errs.Conflict, Message: message, Err: ErrConflict}
+}
+
+// ErrRefreshTokenReused is returned when a refresh token that has already been used is presented again
+var ErrRefreshTokenReused = errs.New(errs.Unauthorized, `refresh token has already been used`)
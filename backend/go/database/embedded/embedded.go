@@ -0,0 +1,165 @@
+// embedded runs a real PostgreSQL server as a child process, so integration tests and `examples serve --dev` (see
+// devdb_dev.go) can use our SQL Storer without Docker or a locally installed database. The server's binaries are
+// downloaded the first time it's used (into ~/.embedded-postgres-go), after that starting one takes a second or two.
+//
+// A test would typically start one server for its whole package, resetting it between tests:
+//
+//	func TestMain(m *testing.M) {
+//		pg, err := embedded.Start(embedded.Options{})
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//		code := m.Run()
+//		pg.Stop()
+//		os.Exit(code)
+//	}
+//
+// Then each test uses pg.DB(), calling pg.Reset() first so it starts from an empty database.
+package embedded
+
+import (
+	gosql "database/sql"
+	"examples/database/sql"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/lib/pq"
+)
+
+// Options configures an embedded server. The zero value is a throwaway server on a free port.
+type Options struct {
+	// Dir keeps the server's files, leave empty for a temporary directory removed by Stop. Data in Dir/data is kept
+	// between runs, so a dev database keeps its Users across restarts.
+	Dir string
+	// Port to listen on (on localhost only), leave as 0 to pick any free port.
+	Port uint32
+	// Logs receives the server's output, which is discarded if nil.
+	Logs io.Writer
+}
+
+// Server is a running embedded PostgreSQL server, with our schema already applied.
+type Server struct {
+	pg   *embeddedpostgres.EmbeddedPostgres
+	url  string
+	db   *sql.DB
+	temp string // Directory to remove once stopped, if we created one
+}
+
+// Start starts an embedded server, applying our migrations to its database if it doesn't have them all yet.
+func Start(opts Options) (*Server, error) {
+	s := &Server{}
+	if opts.Dir == "" {
+		dir, err := os.MkdirTemp("", "examples-postgres-")
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir, s.temp = dir, dir
+	}
+	if opts.Port == 0 {
+		port, err := freePort()
+		if err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		opts.Port = port
+	}
+	if opts.Logs == nil {
+		opts.Logs = io.Discard
+	}
+
+	config := embeddedpostgres.DefaultConfig().
+		Port(opts.Port).
+		Database("examples").
+		Username("examples").
+		Password("examples").
+		// The runtime directory is wiped on every start, so our data lives beside it rather than inside it
+		RuntimePath(filepath.Join(opts.Dir, "runtime")).
+		DataPath(filepath.Join(opts.Dir, "data")).
+		Logger(opts.Logs)
+	s.pg = embeddedpostgres.NewDatabase(config)
+	if err := s.pg.Start(); err != nil {
+		s.cleanup()
+		return nil, fmt.Errorf("starting embedded postgres: %w", err)
+	}
+	s.url = config.GetConnectionURL() + "?sslmode=disable"
+
+	db, err := sql.NewSQLDB(s.url, sql.Pool{}, sql.Retry{})
+	if err != nil {
+		s.Stop()
+		return nil, err
+	}
+	if _, err := db.Provision(); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// URL returns the server's connection string, as would be set in DATABASE_URL.
+func (s *Server) URL() string {
+	return s.url
+}
+
+// DB returns our SQL Storer, connected to the server.
+func (s *Server) DB() *sql.DB {
+	return s.db
+}
+
+// Reset empties every table and restarts their IDs, so each test starts from the same empty database without paying
+// to start a new server.
+func (s *Server) Reset() error {
+	conn, err := gosql.Open("postgres", s.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema()`)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, pq.QuoteIdentifier(table))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(tables) == 0 {
+		return err
+	}
+	_, err = conn.Exec(`TRUNCATE ` + strings.Join(tables, ", ") + ` RESTART IDENTITY CASCADE`)
+	return err
+}
+
+// Stop stops the server, removing its files if they were in a temporary directory.
+func (s *Server) Stop() error {
+	err := s.pg.Stop()
+	s.cleanup()
+	return err
+}
+
+// cleanup removes our temporary directory, if we made one.
+func (s *Server) cleanup() {
+	if s.temp != "" {
+		os.RemoveAll(s.temp)
+	}
+}
+
+// freePort finds a port nothing is listening on, by asking the OS for one.
+func freePort() (uint32, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return uint32(l.Addr().(*net.TCPAddr).Port), nil
+}
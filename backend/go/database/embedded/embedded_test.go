@@ -0,0 +1,51 @@
+package embedded_test
+
+import (
+	"errors"
+	"examples/database"
+	"examples/database/embedded"
+	"testing"
+)
+
+// start starts a server keeping its data in dir, skipping the test if it can't be started. Starting one can fail
+// through no fault of ours, as its binaries are downloaded the first time it's used.
+func start(t *testing.T, dir string) *embedded.Server {
+	t.Helper()
+	pg, err := embedded.Start(embedded.Options{Dir: dir})
+	if err != nil {
+		t.Skipf("no postgres to test against: %v", err)
+	}
+	return pg
+}
+
+// TestRoundTrip checks a server starts with our schema in place, keeps what's saved to it across a restart (when our
+// schema is applied again, and must leave it as it is), and is emptied by Reset.
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pg := start(t, dir)
+	user := database.User{First: "Round", Last: "Trip", Email: "roundtrip@example.com"}
+	if err := pg.DB().CreateUser(&user); err != nil {
+		pg.Stop()
+		t.Fatalf("creating user: %v", err)
+	}
+	if err := pg.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+
+	pg = start(t, dir)
+	defer pg.Stop()
+	got, err := pg.DB().GetUserByEmail(user.Email)
+	if err != nil {
+		t.Fatalf("loading user after restarting: %v", err)
+	}
+	if got.ID != user.ID || got.First != user.First || got.Last != user.Last {
+		t.Errorf("got user %d %s %s, want %d %s %s", got.ID, got.First, got.Last, user.ID, user.First, user.Last)
+	}
+
+	if err := pg.Reset(); err != nil {
+		t.Fatalf("resetting: %v", err)
+	}
+	if _, err := pg.DB().GetUserByEmail(user.Email); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("loading user after resetting: got %v, want %v", err, database.ErrNotFound)
+	}
+}
@@ -0,0 +1,563 @@
+// instrumented provides a Storer that records metrics about every call made to another Storer, or counts them. This is
+// the decorator pattern: because it implements the same interface it wraps, it can be slotted in front of any
+// implementation (SQL, NoSQL, in-memory) without either side knowing.
+package instrumented
+
+import (
+	"context"
+	"examples/database"
+	"examples/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Storer records metrics for each call (or counts it), then passes it on to the wrapped Storer.
+type Storer struct {
+	next    database.Storer
+	counter *Counter // Only set for a Storer created by Counting
+}
+
+// New wraps a Storer with metrics.
+func New(next database.Storer) *Storer {
+	return &Storer{next: next}
+}
+
+// Counter counts calls made through a Storer created by Counting. It's safe for concurrent use.
+type Counter struct {
+	calls atomic.Int64
+}
+
+// Calls returns how many calls have been counted so far.
+func (c *Counter) Calls() int {
+	return int(c.calls.Load())
+}
+
+// Counting wraps a Storer, counting every call made through it with counter rather than recording metrics. Wrapping
+// our database for each request with its own Counter tells us how many calls each request makes.
+func Counting(next database.Storer, counter *Counter) *Storer {
+	return &Storer{next: next, counter: counter}
+}
+
+// observe records a single call. It is deferred at the start of each method, with errp pointing at that method's named
+// error result so we see the error it eventually returns.
+func (s *Storer) observe(op string, start time.Time, errp *error) {
+	if s.counter != nil {
+		s.counter.calls.Add(1)
+		return
+	}
+	metrics.ObserveDB(op, time.Since(start), *errp)
+}
+
+// Health methods
+
+// Ping implements Storer.
+func (s *Storer) Ping() (err error) {
+	defer s.observe("Ping", time.Now(), &err)
+	return s.next.Ping()
+}
+
+// Transaction methods
+
+// WithTx implements Storer, observing the calls fn makes through the transaction along with the transaction itself.
+func (s *Storer) WithTx(ctx context.Context, fn func(database.Storer) error) (err error) {
+	defer s.observe("WithTx", time.Now(), &err)
+	return s.next.WithTx(ctx, func(tx database.Storer) error {
+		return fn(&Storer{next: tx, counter: s.counter})
+	})
+}
+
+// Session methods
+
+// SaveSession implements Storer.
+func (s *Storer) SaveSession(in *database.Session) (err error) {
+	defer s.observe("SaveSession", time.Now(), &err)
+	return s.next.SaveSession(in)
+}
+
+// LoadSession implements Storer.
+func (s *Storer) LoadSession(id int64) (_ database.Session, err error) {
+	defer s.observe("LoadSession", time.Now(), &err)
+	return s.next.LoadSession(id)
+}
+
+// LoadSessionByToken implements Storer.
+func (s *Storer) LoadSessionByToken(tokenHash []byte) (_ database.Session, err error) {
+	defer s.observe("LoadSessionByToken", time.Now(), &err)
+	return s.next.LoadSessionByToken(tokenHash)
+}
+
+// LogoutSession implements Storer.
+func (s *Storer) LogoutSession(id int64) (err error) {
+	defer s.observe("LogoutSession", time.Now(), &err)
+	return s.next.LogoutSession(id)
+}
+
+// ExtendSession implements Storer.
+func (s *Storer) ExtendSession(id int64, lifespan time.Duration) (err error) {
+	defer s.observe("ExtendSession", time.Now(), &err)
+	return s.next.ExtendSession(id, lifespan)
+}
+
+// TouchSession implements Storer.
+func (s *Storer) TouchSession(id int64, seen time.Time, ip, userAgent string) (err error) {
+	defer s.observe("TouchSession", time.Now(), &err)
+	return s.next.TouchSession(id, seen, ip, userAgent)
+}
+
+// ListSessionsAfter implements Storer.
+func (s *Storer) ListSessionsAfter(afterID int64, limit int) (_ []database.Session, err error) {
+	defer s.observe("ListSessionsAfter", time.Now(), &err)
+	return s.next.ListSessionsAfter(afterID, limit)
+}
+
+// UpdateSessionCreds implements Storer.
+func (s *Storer) UpdateSessionCreds(id int64, encryptedCreds []byte) (err error) {
+	defer s.observe("UpdateSessionCreds", time.Now(), &err)
+	return s.next.UpdateSessionCreds(id, encryptedCreds)
+}
+
+// ClearExpiredSessions implements Storer.
+func (s *Storer) ClearExpiredSessions() (_ int, err error) {
+	defer s.observe("ClearExpiredSessions", time.Now(), &err)
+	return s.next.ClearExpiredSessions()
+}
+
+// RevokeSessions implements Storer.
+func (s *Storer) RevokeSessions(filter database.SessionFilter, limit int) (_ []int64, err error) {
+	defer s.observe("RevokeSessions", time.Now(), &err)
+	return s.next.RevokeSessions(filter, limit)
+}
+
+// ListSessionsByUser implements Storer.
+func (s *Storer) ListSessionsByUser(userID int64) (_ []database.Session, err error) {
+	defer s.observe("ListSessionsByUser", time.Now(), &err)
+	return s.next.ListSessionsByUser(userID)
+}
+
+// DeleteUserSessions implements Storer.
+func (s *Storer) DeleteUserSessions(userID int64) (_ []int64, err error) {
+	defer s.observe("DeleteUserSessions", time.Now(), &err)
+	return s.next.DeleteUserSessions(userID)
+}
+
+// Refresh token methods
+
+// CreateRefreshToken implements Storer.
+func (s *Storer) CreateRefreshToken(in *database.RefreshToken) (err error) {
+	defer s.observe("CreateRefreshToken", time.Now(), &err)
+	return s.next.CreateRefreshToken(in)
+}
+
+// RotateRefreshToken implements Storer.
+func (s *Storer) RotateRefreshToken(oldHash, newHash []byte) (_ database.RefreshToken, err error) {
+	defer s.observe("RotateRefreshToken", time.Now(), &err)
+	return s.next.RotateRefreshToken(oldHash, newHash)
+}
+
+// RevokeRefreshFamily implements Storer.
+func (s *Storer) RevokeRefreshFamily(familyID string) (_ []int64, err error) {
+	defer s.observe("RevokeRefreshFamily", time.Now(), &err)
+	return s.next.RevokeRefreshFamily(familyID)
+}
+
+// User methods
+
+// CreateUser implements Storer.
+func (s *Storer) CreateUser(in *database.User) (err error) {
+	defer s.observe("CreateUser", time.Now(), &err)
+	return s.next.CreateUser(in)
+}
+
+// GetUserByID implements Storer.
+func (s *Storer) GetUserByID(id int64) (_ database.User, err error) {
+	defer s.observe("GetUserByID", time.Now(), &err)
+	return s.next.GetUserByID(id)
+}
+
+// GetUserByEmail implements Storer.
+func (s *Storer) GetUserByEmail(email string) (_ database.User, err error) {
+	defer s.observe("GetUserByEmail", time.Now(), &err)
+	return s.next.GetUserByEmail(email)
+}
+
+// GetUserByUsername implements Storer.
+func (s *Storer) GetUserByUsername(username string) (_ database.User, err error) {
+	defer s.observe("GetUserByUsername", time.Now(), &err)
+	return s.next.GetUserByUsername(username)
+}
+
+// ChangeUsername implements Storer.
+func (s *Storer) ChangeUsername(id int64, username string) (err error) {
+	defer s.observe("ChangeUsername", time.Now(), &err)
+	return s.next.ChangeUsername(id, username)
+}
+
+// UsernameHistory implements Storer.
+func (s *Storer) UsernameHistory(id int64) (_ []database.UsernameChange, err error) {
+	defer s.observe("UsernameHistory", time.Now(), &err)
+	return s.next.UsernameHistory(id)
+}
+
+// UsernameReserved implements Storer.
+func (s *Storer) UsernameReserved(username string) (_ bool, err error) {
+	defer s.observe("UsernameReserved", time.Now(), &err)
+	return s.next.UsernameReserved(username)
+}
+
+// SetUserEnabled implements Storer.
+func (s *Storer) SetUserEnabled(id int64, enabled bool) (err error) {
+	defer s.observe("SetUserEnabled", time.Now(), &err)
+	return s.next.SetUserEnabled(id, enabled)
+}
+
+// ListUsers implements Storer.
+func (s *Storer) ListUsers(afterID int64, limit int) (users []database.User, err error) {
+	defer s.observe("ListUsers", time.Now(), &err)
+	return s.next.ListUsers(afterID, limit)
+}
+
+// SearchUsers implements Storer.
+func (s *Storer) SearchUsers(query string, scope database.UserScope, limit int) (users []database.User, err error) {
+	defer s.observe("SearchUsers", time.Now(), &err)
+	return s.next.SearchUsers(query, scope, limit)
+}
+
+// CountUsers implements Storer.
+func (s *Storer) CountUsers() (count int, err error) {
+	defer s.observe("CountUsers", time.Now(), &err)
+	return s.next.CountUsers()
+}
+
+// UpdateUser implements Storer.
+func (s *Storer) UpdateUser(in *database.User) (err error) {
+	defer s.observe("UpdateUser", time.Now(), &err)
+	return s.next.UpdateUser(in)
+}
+
+// SetUserRole implements Storer.
+func (s *Storer) SetUserRole(id int64, role string) (err error) {
+	defer s.observe("SetUserRole", time.Now(), &err)
+	return s.next.SetUserRole(id, role)
+}
+
+// SetPasswordHash implements Storer.
+func (s *Storer) SetPasswordHash(id int64, hash string) (err error) {
+	defer s.observe("SetPasswordHash", time.Now(), &err)
+	return s.next.SetPasswordHash(id, hash)
+}
+
+// RecordFailedLogin implements Storer.
+func (s *Storer) RecordFailedLogin(id int64, lockAfter int) (_ bool, err error) {
+	defer s.observe("RecordFailedLogin", time.Now(), &err)
+	return s.next.RecordFailedLogin(id, lockAfter)
+}
+
+// UnlockUser implements Storer.
+func (s *Storer) UnlockUser(id int64) (err error) {
+	defer s.observe("UnlockUser", time.Now(), &err)
+	return s.next.UnlockUser(id)
+}
+
+// DeleteUser implements Storer.
+func (s *Storer) DeleteUser(id int64) (err error) {
+	defer s.observe("DeleteUser", time.Now(), &err)
+	return s.next.DeleteUser(id)
+}
+
+// SoftDeleteUser implements Storer.
+func (s *Storer) SoftDeleteUser(id int64) (_ database.UserDeletion, err error) {
+	defer s.observe("SoftDeleteUser", time.Now(), &err)
+	return s.next.SoftDeleteUser(id)
+}
+
+// MergeUsers implements Storer.
+func (s *Storer) MergeUsers(keepID, mergeID int64) (err error) {
+	defer s.observe("MergeUsers", time.Now(), &err)
+	return s.next.MergeUsers(keepID, mergeID)
+}
+
+// OAuth identity methods
+
+// GetUserByIdentity implements Storer.
+func (s *Storer) GetUserByIdentity(provider, subject string) (_ database.User, err error) {
+	defer s.observe("GetUserByIdentity", time.Now(), &err)
+	return s.next.GetUserByIdentity(provider, subject)
+}
+
+// LinkIdentity implements Storer.
+func (s *Storer) LinkIdentity(userID int64, provider, subject string) (err error) {
+	defer s.observe("LinkIdentity", time.Now(), &err)
+	return s.next.LinkIdentity(userID, provider, subject)
+}
+
+// Two-factor authentication methods
+
+// GetTwoFactor implements Storer.
+func (s *Storer) GetTwoFactor(userID int64) (_ database.TwoFactor, err error) {
+	defer s.observe("GetTwoFactor", time.Now(), &err)
+	return s.next.GetTwoFactor(userID)
+}
+
+// SaveTwoFactor implements Storer.
+func (s *Storer) SaveTwoFactor(in *database.TwoFactor) (err error) {
+	defer s.observe("SaveTwoFactor", time.Now(), &err)
+	return s.next.SaveTwoFactor(in)
+}
+
+// EnableTwoFactor implements Storer.
+func (s *Storer) EnableTwoFactor(userID int64, codeHashes [][]byte) (err error) {
+	defer s.observe("EnableTwoFactor", time.Now(), &err)
+	return s.next.EnableTwoFactor(userID, codeHashes)
+}
+
+// DeleteTwoFactor implements Storer.
+func (s *Storer) DeleteTwoFactor(userID int64) (err error) {
+	defer s.observe("DeleteTwoFactor", time.Now(), &err)
+	return s.next.DeleteTwoFactor(userID)
+}
+
+// UseTwoFactorStep implements Storer.
+func (s *Storer) UseTwoFactorStep(userID int64, step int64) (_ bool, err error) {
+	defer s.observe("UseTwoFactorStep", time.Now(), &err)
+	return s.next.UseTwoFactorStep(userID, step)
+}
+
+// UseRecoveryCode implements Storer.
+func (s *Storer) UseRecoveryCode(userID int64, codeHash []byte) (_ bool, err error) {
+	defer s.observe("UseRecoveryCode", time.Now(), &err)
+	return s.next.UseRecoveryCode(userID, codeHash)
+}
+
+// User deletion methods
+
+// GetUserDeletion implements Storer.
+func (s *Storer) GetUserDeletion(userID int64) (_ database.UserDeletion, err error) {
+	defer s.observe("GetUserDeletion", time.Now(), &err)
+	return s.next.GetUserDeletion(userID)
+}
+
+// PendingUserDeletions implements Storer.
+func (s *Storer) PendingUserDeletions(limit int) (_ []database.UserDeletion, err error) {
+	defer s.observe("PendingUserDeletions", time.Now(), &err)
+	return s.next.PendingUserDeletions(limit)
+}
+
+// SaveUserDeletion implements Storer.
+func (s *Storer) SaveUserDeletion(in *database.UserDeletion) (err error) {
+	defer s.observe("SaveUserDeletion", time.Now(), &err)
+	return s.next.SaveUserDeletion(in)
+}
+
+// Dealership methods
+
+// AddUserToDealership implements Storer.
+func (s *Storer) AddUserToDealership(userID, dealershipID int64) (err error) {
+	defer s.observe("AddUserToDealership", time.Now(), &err)
+	return s.next.AddUserToDealership(userID, dealershipID)
+}
+
+// RemoveUserFromDealership implements Storer.
+func (s *Storer) RemoveUserFromDealership(userID, dealershipID int64) (err error) {
+	defer s.observe("RemoveUserFromDealership", time.Now(), &err)
+	return s.next.RemoveUserFromDealership(userID, dealershipID)
+}
+
+// SharesDealership implements Storer.
+func (s *Storer) SharesDealership(userID, otherID int64) (_ bool, err error) {
+	defer s.observe("SharesDealership", time.Now(), &err)
+	return s.next.SharesDealership(userID, otherID)
+}
+
+// ListUserDealerships implements Storer.
+func (s *Storer) ListUserDealerships(userID int64) (_ []int64, err error) {
+	defer s.observe("ListUserDealerships", time.Now(), &err)
+	return s.next.ListUserDealerships(userID)
+}
+
+// RemoveUserMemberships implements Storer.
+func (s *Storer) RemoveUserMemberships(userID int64) (_ int, err error) {
+	defer s.observe("RemoveUserMemberships", time.Now(), &err)
+	return s.next.RemoveUserMemberships(userID)
+}
+
+// Audit methods
+
+// CreateAuditEntry implements Storer.
+func (s *Storer) CreateAuditEntry(in *database.AuditEntry) (err error) {
+	defer s.observe("CreateAuditEntry", time.Now(), &err)
+	return s.next.CreateAuditEntry(in)
+}
+
+// PurgeAuditEntries implements Storer.
+func (s *Storer) PurgeAuditEntries(before time.Time, dryRun bool) (_ int, err error) {
+	defer s.observe("PurgeAuditEntries", time.Now(), &err)
+	return s.next.PurgeAuditEntries(before, dryRun)
+}
+
+// CreateSecurityEvent implements Storer.
+func (s *Storer) CreateSecurityEvent(in *database.SecurityEvent) (err error) {
+	defer s.observe("CreateSecurityEvent", time.Now(), &err)
+	return s.next.CreateSecurityEvent(in)
+}
+
+// ListSecurityEvents implements Storer.
+func (s *Storer) ListSecurityEvents(afterID int64, limit int) (_ []database.SecurityEvent, err error) {
+	defer s.observe("ListSecurityEvents", time.Now(), &err)
+	return s.next.ListSecurityEvents(afterID, limit)
+}
+
+// AnonymizeAuditEntries implements Storer.
+func (s *Storer) AnonymizeAuditEntries(userID int64) (_ int, err error) {
+	defer s.observe("AnonymizeAuditEntries", time.Now(), &err)
+	return s.next.AnonymizeAuditEntries(userID)
+}
+
+// Email change methods
+
+// AppendDomainEvent implements Storer.
+func (s *Storer) AppendDomainEvent(in *database.DomainEvent) (err error) {
+	defer s.observe("AppendDomainEvent", time.Now(), &err)
+	return s.next.AppendDomainEvent(in)
+}
+
+// ListDomainEvents implements Storer.
+func (s *Storer) ListDomainEvents(afterSeq int64, limit int) (_ []database.DomainEvent, err error) {
+	defer s.observe("ListDomainEvents", time.Now(), &err)
+	return s.next.ListDomainEvents(afterSeq, limit)
+}
+
+// CreateEmailChange implements Storer.
+func (s *Storer) CreateEmailChange(in *database.EmailChange) (err error) {
+	defer s.observe("CreateEmailChange", time.Now(), &err)
+	return s.next.CreateEmailChange(in)
+}
+
+// ConfirmEmailChange implements Storer.
+func (s *Storer) ConfirmEmailChange(tokenHash []byte) (_ database.EmailChange, err error) {
+	defer s.observe("ConfirmEmailChange", time.Now(), &err)
+	return s.next.ConfirmEmailChange(tokenHash)
+}
+
+// CreateMagicLink implements Storer.
+func (s *Storer) CreateMagicLink(in *database.MagicLink) (err error) {
+	defer s.observe("CreateMagicLink", time.Now(), &err)
+	return s.next.CreateMagicLink(in)
+}
+
+// UseMagicLink implements Storer.
+func (s *Storer) UseMagicLink(tokenHash []byte) (_ database.MagicLink, err error) {
+	defer s.observe("UseMagicLink", time.Now(), &err)
+	return s.next.UseMagicLink(tokenHash)
+}
+
+// CreatePasswordReset implements Storer.
+func (s *Storer) CreatePasswordReset(in *database.PasswordReset) (err error) {
+	defer s.observe("CreatePasswordReset", time.Now(), &err)
+	return s.next.CreatePasswordReset(in)
+}
+
+// UsePasswordReset implements Storer.
+func (s *Storer) UsePasswordReset(tokenHash []byte, passwordHash string) (_ database.PasswordReset, err error) {
+	defer s.observe("UsePasswordReset", time.Now(), &err)
+	return s.next.UsePasswordReset(tokenHash, passwordHash)
+}
+
+// CreateEmailVerification implements Storer.
+func (s *Storer) CreateEmailVerification(in *database.EmailVerification) (err error) {
+	defer s.observe("CreateEmailVerification", time.Now(), &err)
+	return s.next.CreateEmailVerification(in)
+}
+
+// VerifyEmail implements Storer.
+func (s *Storer) VerifyEmail(tokenHash []byte) (_ database.EmailVerification, err error) {
+	defer s.observe("VerifyEmail", time.Now(), &err)
+	return s.next.VerifyEmail(tokenHash)
+}
+
+// CreateInvite implements Storer.
+func (s *Storer) CreateInvite(in *database.Invite) (err error) {
+	defer s.observe("CreateInvite", time.Now(), &err)
+	return s.next.CreateInvite(in)
+}
+
+// ListInvites implements Storer.
+func (s *Storer) ListInvites() (_ []database.Invite, err error) {
+	defer s.observe("ListInvites", time.Now(), &err)
+	return s.next.ListInvites()
+}
+
+// DeleteInvite implements Storer.
+func (s *Storer) DeleteInvite(id int64) (err error) {
+	defer s.observe("DeleteInvite", time.Now(), &err)
+	return s.next.DeleteInvite(id)
+}
+
+// UseInvite implements Storer.
+func (s *Storer) UseInvite(tokenHash []byte, user *database.User) (_ database.Invite, err error) {
+	defer s.observe("UseInvite", time.Now(), &err)
+	return s.next.UseInvite(tokenHash, user)
+}
+
+// PurgeEmailChanges implements Storer.
+func (s *Storer) PurgeEmailChanges(before time.Time, dryRun bool) (_ int, err error) {
+	defer s.observe("PurgeEmailChanges", time.Now(), &err)
+	return s.next.PurgeEmailChanges(before, dryRun)
+}
+
+// API token methods
+
+// CreateAPIToken implements Storer.
+func (s *Storer) CreateAPIToken(in *database.APIToken) (err error) {
+	defer s.observe("CreateAPIToken", time.Now(), &err)
+	return s.next.CreateAPIToken(in)
+}
+
+// ListAPITokens implements Storer.
+func (s *Storer) ListAPITokens(userID int64) (_ []database.APIToken, err error) {
+	defer s.observe("ListAPITokens", time.Now(), &err)
+	return s.next.ListAPITokens(userID)
+}
+
+// GetAPIToken implements Storer.
+func (s *Storer) GetAPIToken(tokenHash []byte) (_ database.APIToken, err error) {
+	defer s.observe("GetAPIToken", time.Now(), &err)
+	return s.next.GetAPIToken(tokenHash)
+}
+
+// TouchAPIToken implements Storer.
+func (s *Storer) TouchAPIToken(id int64, used time.Time) (err error) {
+	defer s.observe("TouchAPIToken", time.Now(), &err)
+	return s.next.TouchAPIToken(id, used)
+}
+
+// DeleteAPIToken implements Storer.
+func (s *Storer) DeleteAPIToken(userID, id int64) (err error) {
+	defer s.observe("DeleteAPIToken", time.Now(), &err)
+	return s.next.DeleteAPIToken(userID, id)
+}
+
+// Tenant settings methods
+
+// GetTenantSettings implements Storer.
+func (s *Storer) GetTenantSettings(tenantID int64) (_ database.TenantSettings, err error) {
+	defer s.observe("GetTenantSettings", time.Now(), &err)
+	return s.next.GetTenantSettings(tenantID)
+}
+
+// ListTenantSettings implements Storer.
+func (s *Storer) ListTenantSettings() (_ []database.TenantSettings, err error) {
+	defer s.observe("ListTenantSettings", time.Now(), &err)
+	return s.next.ListTenantSettings()
+}
+
+// SaveTenantSettings implements Storer.
+func (s *Storer) SaveTenantSettings(in *database.TenantSettings) (err error) {
+	defer s.observe("SaveTenantSettings", time.Now(), &err)
+	return s.next.SaveTenantSettings(in)
+}
+
+// DeleteTenantSettings implements Storer.
+func (s *Storer) DeleteTenantSettings(tenantID int64) (err error) {
+	defer s.observe("DeleteTenantSettings", time.Now(), &err)
+	return s.next.DeleteTenantSettings(tenantID)
+}
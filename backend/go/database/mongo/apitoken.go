@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// apiTokenDoc is how an APIToken is kept in our apitokens collection.
+type apiTokenDoc struct {
+	ID        int64      `bson:"_id"`
+	UserID    int64      `bson:"userid"`
+	Name      string     `bson:"name"`
+	TokenHash []byte     `bson:"tokenhash"`
+	Scopes    []string   `bson:"scopes"`
+	Created   time.Time  `bson:"created"`
+	Expires   time.Time  `bson:"expires"`
+	LastUsed  *time.Time `bson:"lastused"` // Null until the token is used
+}
+
+// apiToken converts an apiTokenDoc back into an APIToken.
+func (d apiTokenDoc) apiToken() database.APIToken {
+	token := database.APIToken{
+		ID:        d.ID,
+		UserID:    d.UserID,
+		Name:      d.Name,
+		TokenHash: d.TokenHash,
+		Scopes:    d.Scopes,
+		Created:   d.Created,
+		Expires:   d.Expires,
+	}
+	if d.LastUsed != nil {
+		token.LastUsed = *d.LastUsed
+	}
+	return token
+}
+
+// CreateAPIToken implements Storer, stores a new API token and updates the ID field with the ID that was handed out
+// for it.
+func (db *DB) CreateAPIToken(in *database.APIToken) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	id, err := db.nextID(ctx, "apitokens")
+	if err != nil {
+		return wrap(err, "mongo.CreateAPIToken")
+	}
+	// A nil slice would be stored as null rather than an empty list
+	scopes := in.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	_, err = db.store.Collection("apitokens").InsertOne(ctx, apiTokenDoc{
+		ID:        id,
+		UserID:    in.UserID,
+		Name:      in.Name,
+		TokenHash: in.TokenHash,
+		Scopes:    scopes,
+		Created:   in.Created,
+		Expires:   in.Expires,
+	})
+	if err != nil {
+		return wrap(err, "mongo.CreateAPIToken")
+	}
+	in.ID = id
+	return nil
+}
+
+// ListAPITokens implements Storer, lists a User's API tokens, newest first.
+func (db *DB) ListAPITokens(userID int64) ([]database.APIToken, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	tokens, err := findAll(ctx, db.store.Collection("apitokens"), bson.M{"userid": userID},
+		options.Find().SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}}), apiTokenDoc.apiToken)
+	return tokens, wrap(err, "mongo.ListAPITokens")
+}
+
+// GetAPIToken implements Storer, retrieves an unexpired API token by its hash.
+func (db *DB) GetAPIToken(tokenHash []byte) (database.APIToken, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc apiTokenDoc
+	err := db.store.Collection("apitokens").FindOne(ctx,
+		bson.M{"tokenhash": tokenHash, "expires": bson.M{"$gt": time.Now()}}).Decode(&doc)
+	if err != nil {
+		return database.APIToken{}, wrap(notFound(err), "mongo.GetAPIToken")
+	}
+	return doc.apiToken(), nil
+}
+
+// TouchAPIToken implements Storer, records when an API token was last used.
+func (db *DB) TouchAPIToken(id int64, used time.Time) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("apitokens").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastused": used}})
+	return wrap(err, "mongo.TouchAPIToken")
+}
+
+// DeleteAPIToken implements Storer, removes one of a User's API tokens. Naming the User as well as the token means a
+// User can never remove someone else's.
+func (db *DB) DeleteAPIToken(userID, id int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectDeleted(db.store.Collection("apitokens").DeleteOne(ctx, bson.M{"_id": id, "userid": userID})),
+		"mongo.DeleteAPIToken")
+}
@@ -0,0 +1,69 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// auditDoc is how an AuditEntry is kept in our auditlog collection.
+type auditDoc struct {
+	ID       int64     `bson:"_id"`
+	Time     time.Time `bson:"time"`
+	ActorID  int64     `bson:"actorid"`
+	Action   string    `bson:"action"`
+	TargetID int64     `bson:"targetid"`
+	Detail   string    `bson:"detail"`
+	IP       string    `bson:"ip"`
+}
+
+// CreateAuditEntry implements Storer, adds an entry to the audit log and updates the ID field with the ID that was
+// handed out for it.
+func (db *DB) CreateAuditEntry(in *database.AuditEntry) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	id, err := db.nextID(ctx, "auditlog")
+	if err != nil {
+		return wrap(err, "mongo.CreateAuditEntry")
+	}
+	_, err = db.store.Collection("auditlog").InsertOne(ctx, auditDoc{
+		ID:       id,
+		Time:     in.Time,
+		ActorID:  in.ActorID,
+		Action:   in.Action,
+		TargetID: in.TargetID,
+		Detail:   in.Detail,
+		IP:       in.IP,
+	})
+	if err != nil {
+		return wrap(err, "mongo.CreateAuditEntry")
+	}
+	in.ID = id
+	return nil
+}
+
+// PurgeAuditEntries implements Storer, deletes (or with dryRun, counts) audit entries from before the given time.
+func (db *DB) PurgeAuditEntries(before time.Time, dryRun bool) (int, error) {
+	return db.purge("auditlog", "time", before, dryRun, "mongo.PurgeAuditEntries")
+}
+
+// AnonymizeAuditEntries implements Storer, clears the IP address and detail of audit entries by or about a User. Their
+// ID is left, once the User record is gone it no longer leads back to anyone.
+func (db *DB) AnonymizeAuditEntries(userID int64) (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	result, err := db.store.Collection("auditlog").UpdateMany(ctx,
+		bson.M{
+			"$and": bson.A{
+				bson.M{"$or": bson.A{bson.M{"actorid": userID}, bson.M{"targetid": userID}}},
+				bson.M{"$or": bson.A{bson.M{"ip": bson.M{"$ne": ""}}, bson.M{"detail": bson.M{"$ne": ""}}}},
+			},
+		},
+		bson.M{"$set": bson.M{"ip": "", "detail": ""}},
+	)
+	if err != nil {
+		return 0, wrap(err, "mongo.AnonymizeAuditEntries")
+	}
+	return int(result.ModifiedCount), nil
+}
@@ -0,0 +1,83 @@
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// membershipDoc is how a dealership membership is kept in our dealershipmembers collection.
+type membershipDoc struct {
+	DealershipID int64 `bson:"dealershipid"`
+	UserID       int64 `bson:"userid"`
+}
+
+// AddUserToDealership implements Storer, adds a dealership membership. Adding a membership that already exists isn't an
+// error, so this is safe to retry.
+func (db *DB) AddUserToDealership(userID, dealershipID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(db.addMembership(ctx, userID, dealershipID), "mongo.AddUserToDealership")
+}
+
+// addMembership adds a dealership membership with ctx, which may be a transaction (such as when merging Users). An
+// upsert that finds the membership already there changes nothing.
+func (db *DB) addMembership(ctx context.Context, userID, dealershipID int64) error {
+	membership := bson.M{"dealershipid": dealershipID, "userid": userID}
+	_, err := db.store.Collection("dealershipmembers").UpdateOne(ctx, membership,
+		bson.M{"$setOnInsert": membership}, options.Update().SetUpsert(true))
+	// Two upserts of the same membership at once can both try to insert it, the loser finds it's already there
+	if duplicateKey(err, "dealershipmembers_dealershipid_userid") {
+		return nil
+	}
+	return err
+}
+
+// RemoveUserFromDealership implements Storer, removes a dealership membership.
+func (db *DB) RemoveUserFromDealership(userID, dealershipID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectDeleted(db.store.Collection("dealershipmembers").DeleteOne(ctx,
+		bson.M{"dealershipid": dealershipID, "userid": userID})), "mongo.RemoveUserFromDealership")
+}
+
+// SharesDealership implements Storer, checks whether two Users are members of any of the same dealerships. There are
+// no joins here, so we look up the first User's dealerships, then whether the other User is in any of them.
+func (db *DB) SharesDealership(userID, otherID int64) (bool, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	dealerships, err := db.userDealerships(ctx, userID)
+	if err != nil || len(dealerships) == 0 {
+		return false, wrap(err, "mongo.SharesDealership")
+	}
+	n, err := db.store.Collection("dealershipmembers").CountDocuments(ctx,
+		bson.M{"userid": otherID, "dealershipid": bson.M{"$in": dealerships}}, options.Count().SetLimit(1))
+	return n > 0, wrap(err, "mongo.SharesDealership")
+}
+
+// ListUserDealerships implements Storer, lists the dealerships a User is a member of.
+func (db *DB) ListUserDealerships(userID int64) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	ids, err := db.userDealerships(ctx, userID)
+	return ids, wrap(err, "mongo.ListUserDealerships")
+}
+
+// userDealerships lists the IDs of the dealerships a User is a member of, in order, with ctx.
+func (db *DB) userDealerships(ctx context.Context, userID int64) ([]int64, error) {
+	return findAll(ctx, db.store.Collection("dealershipmembers"), bson.M{"userid": userID},
+		options.Find().SetSort(bson.D{{Key: "dealershipid", Value: 1}}),
+		func(doc membershipDoc) int64 { return doc.DealershipID })
+}
+
+// RemoveUserMemberships implements Storer, removes a User from every dealership.
+func (db *DB) RemoveUserMemberships(userID int64) (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	result, err := db.store.Collection("dealershipmembers").DeleteMany(ctx, bson.M{"userid": userID})
+	if err != nil {
+		return 0, wrap(err, "mongo.RemoveUserMemberships")
+	}
+	return int(result.DeletedCount), nil
+}
@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deletionDoc is how a UserDeletion is kept in our userdeletions collection, identified by the User's ID.
+type deletionDoc struct {
+	UserID    int64      `bson:"_id"`
+	Requested time.Time  `bson:"requested"`
+	Status    string     `bson:"status"`
+	Step      string     `bson:"step"`
+	Attempts  int        `bson:"attempts"`
+	Error     string     `bson:"error"`
+	Completed *time.Time `bson:"completed"` // Null until cleanup has finished
+}
+
+// newDeletionDoc describes a UserDeletion as a deletionDoc.
+func newDeletionDoc(in database.UserDeletion) deletionDoc {
+	doc := deletionDoc{
+		UserID:    in.UserID,
+		Requested: in.Requested,
+		Status:    in.Status,
+		Step:      in.Step,
+		Attempts:  in.Attempts,
+		Error:     in.Error,
+	}
+	if !in.Completed.IsZero() {
+		doc.Completed = &in.Completed
+	}
+	return doc
+}
+
+// deletion converts a deletionDoc back into a UserDeletion.
+func (d deletionDoc) deletion() database.UserDeletion {
+	out := database.UserDeletion{
+		UserID:    d.UserID,
+		Requested: d.Requested,
+		Status:    d.Status,
+		Step:      d.Step,
+		Attempts:  d.Attempts,
+		Error:     d.Error,
+	}
+	if d.Completed != nil {
+		out.Completed = *d.Completed
+	}
+	return out
+}
+
+// GetUserDeletion implements Storer, retrieves the progress of deleting a User
+func (db *DB) GetUserDeletion(userID int64) (database.UserDeletion, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc deletionDoc
+	if err := db.store.Collection("userdeletions").FindOne(ctx, bson.M{"_id": userID}).Decode(&doc); err != nil {
+		return database.UserDeletion{}, wrap(notFound(err), "mongo.GetUserDeletion")
+	}
+	return doc.deletion(), nil
+}
+
+// PendingUserDeletions implements Storer, lists deletions still being cleaned up, oldest first
+func (db *DB) PendingUserDeletions(limit int) ([]database.UserDeletion, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	deletions, err := findAll(ctx, db.store.Collection("userdeletions"), bson.M{"status": database.DeletionPending},
+		options.Find().SetSort(bson.D{{Key: "requested", Value: 1}}).SetLimit(int64(limit)), deletionDoc.deletion)
+	return deletions, wrap(err, "mongo.PendingUserDeletions")
+}
+
+// SaveUserDeletion implements Storer, records progress cleaning up after a deleted User
+func (db *DB) SaveUserDeletion(in *database.UserDeletion) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	doc := newDeletionDoc(*in)
+	return wrap(expectMatched(db.store.Collection("userdeletions").UpdateOne(ctx, bson.M{"_id": in.UserID}, bson.M{"$set": bson.M{
+		"status":    doc.Status,
+		"step":      doc.Step,
+		"attempts":  doc.Attempts,
+		"error":     doc.Error,
+		"completed": doc.Completed,
+	}})), "mongo.SaveUserDeletion")
+}
@@ -0,0 +1,61 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// domainEventDoc is how a DomainEvent is kept in our domainevents collection. Its data is kept as the JSON bytes we were
+// given, rather than converted to a document, so it reads back exactly as it was written.
+type domainEventDoc struct {
+	Seq    int64     `bson:"_id"`
+	Time   time.Time `bson:"time"`
+	Type   string    `bson:"type"`
+	UserID int64     `bson:"userid"`
+	Data   []byte    `bson:"data"`
+}
+
+// AppendDomainEvent implements Storer, adds an event to the end of our event log. Sequence numbers are handed out in a
+// transaction along with inserting the event, so the next append conflicts with ours until we commit, and events
+// always commit in the order their sequence numbers were handed out. Without this an event could become visible after
+// a later one, and a consumer that had already read past it would never see it.
+func (db *DB) AppendDomainEvent(in *database.DomainEvent) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	var seq int64
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var err error
+		if seq, err = db.nextID(ctx, "domainevents"); err != nil {
+			return err
+		}
+		_, err = db.store.Collection("domainevents").InsertOne(ctx, domainEventDoc{
+			Seq:    seq,
+			Time:   in.Time,
+			Type:   in.Type,
+			UserID: in.UserID,
+			Data:   in.Data,
+		})
+		return err
+	})
+	if err != nil {
+		return wrap(err, "mongo.AppendDomainEvent")
+	}
+	in.Seq = seq
+	return nil
+}
+
+// ListDomainEvents implements Storer, lists domain events after the given sequence number, oldest first
+func (db *DB) ListDomainEvents(afterSeq int64, limit int) ([]database.DomainEvent, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	events, err := findAll(ctx, db.store.Collection("domainevents"), bson.M{"_id": bson.M{"$gt": afterSeq}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)),
+		func(doc domainEventDoc) database.DomainEvent {
+			return database.DomainEvent{Seq: doc.Seq, Time: doc.Time, Type: doc.Type, UserID: doc.UserID, Data: doc.Data}
+		})
+	return events, wrap(err, "mongo.ListDomainEvents")
+}
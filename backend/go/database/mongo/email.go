@@ -0,0 +1,68 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// emailChangeDoc is how an EmailChange is kept in our emailchanges collection.
+type emailChangeDoc struct {
+	TokenHash []byte    `bson:"tokenhash"`
+	UserID    int64     `bson:"userid"`
+	OldEmail  string    `bson:"oldemail"`
+	NewEmail  string    `bson:"newemail"`
+	Expires   time.Time `bson:"expires"`
+}
+
+// CreateEmailChange implements Storer, stores a pending email change. A User can only have one pending change at a
+// time, so it replaces any previous change, whose confirmation link stops working.
+func (db *DB) CreateEmailChange(in *database.EmailChange) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("emailchanges").ReplaceOne(ctx, bson.M{"userid": in.UserID}, emailChangeDoc{
+		TokenHash: in.TokenHash,
+		UserID:    in.UserID,
+		OldEmail:  in.OldEmail,
+		NewEmail:  in.NewEmail,
+		Expires:   in.Expires,
+	}, options.Replace().SetUpsert(true))
+	return wrap(err, "mongo.CreateEmailChange")
+}
+
+// ConfirmEmailChange implements Storer, applies a pending email change to its User, removing the pending change so its
+// token can't be used again.
+func (db *DB) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc emailChangeDoc
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		// Remove the pending change, only if it hasn't expired
+		err := db.store.Collection("emailchanges").FindOneAndDelete(ctx,
+			bson.M{"tokenhash": tokenHash, "expires": bson.M{"$gt": time.Now()}}).Decode(&doc)
+		if err != nil {
+			return notFound(err)
+		}
+		// Apply it to the User, following the link proves they own the new address too
+		return expectMatched(db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": doc.UserID},
+			bson.M{"$set": bson.M{"email": doc.NewEmail, "emailverified": true}}))
+	})
+	if err != nil {
+		return database.EmailChange{}, wrap(err, "mongo.ConfirmEmailChange")
+	}
+	return database.EmailChange{
+		TokenHash: doc.TokenHash,
+		UserID:    doc.UserID,
+		OldEmail:  doc.OldEmail,
+		NewEmail:  doc.NewEmail,
+		Expires:   doc.Expires,
+	}, nil
+}
+
+// PurgeEmailChanges implements Storer, deletes (or with dryRun, counts) email changes that expired before the given time.
+func (db *DB) PurgeEmailChanges(before time.Time, dryRun bool) (int, error) {
+	return db.purge("emailchanges", "expires", before, dryRun, "mongo.PurgeEmailChanges")
+}
@@ -0,0 +1,153 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes are the indexes a collection needs, beyond the one MongoDB always keeps on _id.
+type collectionIndexes struct {
+	collection string
+	indexes    []mongo.IndexModel
+}
+
+// index describes an index on the given fields (in order, ascending), with the given name.
+func index(name string, fields ...string) mongo.IndexModel {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: 1})
+	}
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name)}
+}
+
+// unique describes a unique index on the given fields, with the given name. Our duplicateKey checks use the name to
+// tell which rule was broken, like a constraint's name in SQL.
+func unique(name string, fields ...string) mongo.IndexModel {
+	model := index(name, fields...)
+	model.Options.SetUnique(true)
+	return model
+}
+
+// expires describes a TTL index on a time field, with the given name. MongoDB removes each document once the time in
+// the field has passed (checking about once a minute), so expired tokens clean themselves up.
+func expires(name, field string) mongo.IndexModel {
+	model := index(name, field)
+	model.Options.SetExpireAfterSeconds(0)
+	return model
+}
+
+// ourIndexes lists every index we need, the equivalent of the constraints and indexes in our SQL migrations.
+var ourIndexes = []collectionIndexes{
+	{"users", []mongo.IndexModel{
+		index("users_email", "email"),
+		// Users without a username don't have the field at all, and only Users with one need it to be unique
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("users_username").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"username": bson.M{"$type": "string"}}),
+		},
+	}},
+	{"sessions", []mongo.IndexModel{
+		// Sessions created before we handed out tokens don't have one, they simply expire
+		{
+			Keys: bson.D{{Key: "tokenhash", Value: 1}},
+			Options: options.Index().SetName("sessions_tokenhash").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"tokenhash": bson.M{"$type": "binData"}}),
+		},
+		index("sessions_userid", "userid"),
+		index("sessions_refreshfamily", "refreshfamily"),
+		// A session's expiration never passes its end of life (see ExtendSession), so this removes every expired one
+		expires("sessions_expiration", "expiration"),
+	}},
+	{"usernamehistory", []mongo.IndexModel{
+		index("usernamehistory_userid", "userid"),
+		index("usernamehistory_oldusername", "oldusername"),
+	}},
+	{"refreshtokens", []mongo.IndexModel{
+		index("refreshtokens_familyid", "familyid"),
+		index("refreshtokens_userid", "userid"),
+		expires("refreshtokens_expires", "expires"),
+	}},
+	{"oauthidentities", []mongo.IndexModel{
+		unique("oauthidentities_provider_subject", "provider", "subject"),
+		index("oauthidentities_userid", "userid"),
+	}},
+	// Expired email changes are kept until our retention policy purges them (see PurgeEmailChanges), so aren't removed
+	// by a TTL index like our other tokens
+	{"emailchanges", []mongo.IndexModel{
+		unique("emailchanges_tokenhash", "tokenhash"),
+		unique("emailchanges_userid", "userid"),
+		index("emailchanges_expires", "expires"),
+	}},
+	{"magiclinks", []mongo.IndexModel{
+		unique("magiclinks_tokenhash", "tokenhash"),
+		unique("magiclinks_userid", "userid"),
+		expires("magiclinks_expires", "expires"),
+	}},
+	{"passwordresets", []mongo.IndexModel{
+		unique("passwordresets_tokenhash", "tokenhash"),
+		unique("passwordresets_userid", "userid"),
+		expires("passwordresets_expires", "expires"),
+	}},
+	{"emailverifications", []mongo.IndexModel{
+		unique("emailverifications_tokenhash", "tokenhash"),
+		unique("emailverifications_userid", "userid"),
+		expires("emailverifications_expires", "expires"),
+	}},
+	{"invites", []mongo.IndexModel{
+		unique("invites_tokenhash", "tokenhash"),
+		unique("invites_email", "email"),
+		index("invites_invitedby", "invitedby"),
+		expires("invites_expires", "expires"),
+	}},
+	{"auditlog", []mongo.IndexModel{
+		// Our retention policy purges old audit entries by time
+		index("auditlog_time", "time"),
+		index("auditlog_actorid", "actorid"),
+		index("auditlog_targetid", "targetid"),
+	}},
+	{"dealershipmembers", []mongo.IndexModel{
+		unique("dealershipmembers_dealershipid_userid", "dealershipid", "userid"),
+		index("dealershipmembers_userid", "userid"),
+	}},
+	// Expired API tokens are kept until their User deletes them, so they can still see which ones have expired
+	{"apitokens", []mongo.IndexModel{
+		unique("apitokens_tokenhash", "tokenhash"),
+		index("apitokens_userid", "userid"),
+	}},
+	{"userdeletions", []mongo.IndexModel{
+		index("userdeletions_status", "status", "requested"),
+	}},
+}
+
+// EnsureIndexes creates any of our indexes that don't exist yet, which also creates their collections. Creating an
+// index that already exists does nothing, so this is safe to run every time we connect.
+func (db *DB) EnsureIndexes(ctx context.Context) error {
+	for _, c := range ourIndexes {
+		if _, err := db.store.Collection(c.collection).Indexes().CreateMany(ctx, c.indexes); err != nil {
+			return fmt.Errorf("creating indexes on %s: %w", c.collection, wrap(err, "mongo.EnsureIndexes"))
+		}
+	}
+	// Collections can't be created inside a transaction before MongoDB 4.4, so we create the rest up front
+	existing, err := db.store.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return wrap(err, "mongo.EnsureIndexes")
+	}
+	have := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		have[name] = true
+	}
+	for _, name := range []string{"counters", "twofactor", "securityevents", "domainevents"} {
+		if have[name] {
+			continue
+		}
+		if err := db.store.CreateCollection(ctx, name); err != nil {
+			return wrap(err, "mongo.EnsureIndexes")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// inviteDoc is how an Invite is kept in our invites collection.
+type inviteDoc struct {
+	ID        int64     `bson:"_id"`
+	TokenHash []byte    `bson:"tokenhash"`
+	Email     string    `bson:"email"`
+	InvitedBy int64     `bson:"invitedby"`
+	Created   time.Time `bson:"created"`
+	Expires   time.Time `bson:"expires"`
+}
+
+// invite converts an inviteDoc back into an Invite.
+func (d inviteDoc) invite() database.Invite {
+	return database.Invite{
+		ID:        d.ID,
+		TokenHash: d.TokenHash,
+		Email:     d.Email,
+		InvitedBy: d.InvitedBy,
+		Created:   d.Created,
+		Expires:   d.Expires,
+	}
+}
+
+// CreateInvite implements Storer, stores an invite. An email can only have one invite at a time, so inviting someone
+// again replaces the earlier invite (keeping its ID), and the earlier link stops working.
+func (db *DB) CreateInvite(in *database.Invite) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	id, err := db.nextID(ctx, "invites")
+	if err != nil {
+		return wrap(err, "mongo.CreateInvite")
+	}
+	var doc inviteDoc
+	err = db.store.Collection("invites").FindOneAndUpdate(
+		ctx,
+		bson.M{"email": in.Email},
+		bson.M{
+			"$set":         bson.M{"tokenhash": in.TokenHash, "invitedby": in.InvitedBy, "created": in.Created, "expires": in.Expires},
+			"$setOnInsert": bson.M{"_id": id},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return wrap(err, "mongo.CreateInvite")
+	}
+	in.ID = doc.ID
+	return nil
+}
+
+// ListInvites implements Storer, lists the invites that can still be used, newest first.
+func (db *DB) ListInvites() ([]database.Invite, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	invites, err := findAll(ctx, db.store.Collection("invites"), bson.M{"expires": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}}), inviteDoc.invite)
+	return invites, wrap(err, "mongo.ListInvites")
+}
+
+// DeleteInvite implements Storer, removes an invite.
+func (db *DB) DeleteInvite(id int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectDeleted(db.store.Collection("invites").DeleteOne(ctx, bson.M{"_id": id})), "mongo.DeleteInvite")
+}
+
+// UseInvite implements Storer, removes an invite so its token can't be used again, and creates the User it invited in
+// the same transaction, so an invite is never used up without an account to show for it.
+func (db *DB) UseInvite(tokenHash []byte, user *database.User) (database.Invite, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc inviteDoc
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		err := db.store.Collection("invites").FindOneAndDelete(ctx,
+			bson.M{"tokenhash": tokenHash, "expires": bson.M{"$gt": time.Now()}}).Decode(&doc)
+		if err != nil {
+			return notFound(err)
+		}
+
+		// The invite was only sent if nobody had the email, but an admin may have created a User with it since
+		taken, err := db.store.Collection("users").CountDocuments(ctx,
+			bson.M{"email": doc.Email, "deleted": nil}, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return database.ErrEmailTaken
+		}
+
+		// Following the link we emailed proves they own the address
+		user.Email, user.EmailVerified = doc.Email, true
+		return db.insertUser(ctx, user)
+	})
+	if err != nil {
+		return database.Invite{}, wrap(err, "mongo.UseInvite")
+	}
+	return doc.invite(), nil
+}
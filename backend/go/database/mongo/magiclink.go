@@ -0,0 +1,45 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// magicLinkDoc is how a MagicLink is kept in our magiclinks collection.
+type magicLinkDoc struct {
+	TokenHash []byte    `bson:"tokenhash"`
+	UserID    int64     `bson:"userid"`
+	Remember  bool      `bson:"remember"`
+	Expires   time.Time `bson:"expires"`
+}
+
+// CreateMagicLink implements Storer, stores a magic link. A User can only have one link at a time, so requesting a new
+// link replaces any earlier one, which stops working.
+func (db *DB) CreateMagicLink(in *database.MagicLink) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("magiclinks").ReplaceOne(ctx, bson.M{"userid": in.UserID}, magicLinkDoc{
+		TokenHash: in.TokenHash,
+		UserID:    in.UserID,
+		Remember:  in.Remember,
+		Expires:   in.Expires,
+	}, options.Replace().SetUpsert(true))
+	return wrap(err, "mongo.CreateMagicLink")
+}
+
+// UseMagicLink implements Storer, removes a magic link so its token can't be used again. Finding and deleting the link
+// in one operation means two requests racing to use the same link can't both succeed.
+func (db *DB) UseMagicLink(tokenHash []byte) (database.MagicLink, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc magicLinkDoc
+	err := db.store.Collection("magiclinks").FindOneAndDelete(ctx,
+		bson.M{"tokenhash": tokenHash, "expires": bson.M{"$gt": time.Now()}}).Decode(&doc)
+	if err != nil {
+		return database.MagicLink{}, wrap(notFound(err), "mongo.UseMagicLink")
+	}
+	return database.MagicLink{TokenHash: doc.TokenHash, UserID: doc.UserID, Remember: doc.Remember, Expires: doc.Expires}, nil
+}
@@ -0,0 +1,260 @@
+// mongo provides a MongoDB implementation of our Storer interface, showing our interface isn't tied to SQL. Each of our
+// tables (see database/sql/migrations) is a collection here, holding a document per row with the same field names, so
+// the two are easy to compare. A few things work differently in a document store:
+//   - IDs are still numbers, as our routes and tokens expect, handed out from a counters collection (see nextID)
+//   - Expired sessions and tokens are removed by MongoDB itself, through TTL indexes (see EnsureIndexes)
+//   - There are no foreign keys, so deleting a User removes everything that refers to them itself (see deleteUser)
+//   - Changes spanning several documents use transactions, which need MongoDB running as a replica set. A single node
+//     replica set is enough for development, start mongod with --replSet and run rs.initiate() once.
+package mongo
+
+import (
+	"context"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// unavailableRetryAfter is how long we suggest callers wait before retrying when our database can't be reached, the
+// same as our SQL Storer suggests.
+const unavailableRetryAfter = 5 * time.Second
+
+// operationTimeout bounds how long any one Storer method may take. Our Storer interface doesn't take a context, so
+// without this a method could wait forever on a server that never answers.
+const operationTimeout = 10 * time.Second
+
+// defaultDatabase is the database we use when the connection string doesn't name one.
+const defaultDatabase = "examples"
+
+// DB implements Storer using a MongoDB database.
+type DB struct {
+	client *mongo.Client
+	store  *mongo.Database      // Here we simply refer to it as "store" to avoid confusion with our database package
+	tx     mongo.SessionContext // The transaction we're part of, nil unless we were handed to a WithTx callback
+}
+
+// NewMongoDB connects to MongoDB using url (such as mongodb://localhost:27017/examples?replicaSet=rs0), using the
+// database named in its path, and makes sure our indexes exist.
+func NewMongoDB(url string) (*DB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	// Connect doesn't wait for a server, so ensure connection is usable
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	db := &DB{client: client, store: client.Database(databaseName(url))}
+	if err := db.EnsureIndexes(ctx); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return db, nil
+}
+
+// databaseName returns the database named in the path of a connection string, or defaultDatabase if there isn't one.
+func databaseName(connection string) string {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return defaultDatabase
+	}
+	if name := strings.TrimPrefix(u.Path, "/"); name != "" {
+		return name
+	}
+	return defaultDatabase
+}
+
+// Close disconnects from MongoDB.
+func (db *DB) Close() error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return db.client.Disconnect(ctx)
+}
+
+// Ping implements Storer, checks that our primary can still be reached, as that's where every write goes.
+func (db *DB) Ping() error {
+	ctx, cancel := db.context()
+	defer cancel()
+	if err := db.client.Ping(ctx, readpref.Primary()); err != nil {
+		return &errs.Error{Code: errs.Unavailable, Op: "mongo.Ping", Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	return nil
+}
+
+// context returns the context a Storer method runs its operations with, see operationTimeout. When we're part of a
+// transaction it carries the transaction's session, so every operation run with it is part of the transaction too.
+func (db *DB) context() (context.Context, context.CancelFunc) {
+	if db.tx != nil {
+		return context.WithTimeout(db.tx, operationTimeout)
+	}
+	return context.WithTimeout(context.Background(), operationTimeout)
+}
+
+// transaction runs fn in a transaction, committing if it returns nil and aborting otherwise. Every operation in fn must
+// use the context it's given, or it won't be part of the transaction. A transaction that conflicts with another (both
+// changing the same document) is retried from the start, so fn may run more than once, and shouldn't keep anything
+// from an earlier run.
+//
+// When we're already part of a transaction (see WithTx), fn simply runs as part of it. MongoDB can't nest transactions,
+// so anything fn changes is only undone if the whole transaction is.
+func (db *DB) transaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error {
+	if db.tx != nil {
+		return fn(mongo.NewSessionContext(ctx, db.tx))
+	}
+	session, err := db.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// WithTx implements Storer, running fn in a single MongoDB transaction (see transaction).
+func (db *DB) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	var fnErr error
+	err := db.transaction(ctx, func(tx mongo.SessionContext) error {
+		fnErr = fn(&DB{client: db.client, store: db.store, tx: tx})
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return wrap(err, "mongo.WithTx")
+}
+
+// counter is a document in our counters collection, holding the last ID handed out for another collection.
+type counter struct {
+	Seq  int64  `bson:"seq"`
+	Hash []byte `bson:"hash,omitempty"` // Only used by the security event chain, see CreateSecurityEvent
+}
+
+// nextID hands out the next ID for a collection, much as a SERIAL column's sequence does in SQL. Like a sequence, an ID
+// is never handed out twice, even if the document it was for is never inserted.
+func (db *DB) nextID(ctx context.Context, collection string) (int64, error) {
+	var out counter
+	err := db.store.Collection("counters").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": collection},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&out)
+	return out.Seq, err
+}
+
+// findAll runs a query, converting each document it finds with convert.
+func findAll[D, T any](ctx context.Context, c *mongo.Collection, filter any, opts *options.FindOptions, convert func(D) T) ([]T, error) {
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var out []T
+	for cursor.Next(ctx) {
+		var doc D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		out = append(out, convert(doc))
+	}
+	return out, cursor.Err()
+}
+
+// expectMatched checks an update matched at least one document, returning our not found error if not. It takes the
+// error from the update too, so it can be called directly on UpdateOne's return values.
+func expectMatched(result *mongo.UpdateResult, err error) error {
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return database.ErrNotFound
+	}
+	return nil
+}
+
+// expectDeleted checks a delete removed at least one document, returning our not found error if not.
+func expectDeleted(result *mongo.DeleteResult, err error) error {
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return database.ErrNotFound
+	}
+	return nil
+}
+
+// notFound turns the driver's error for finding no document into our not found error, leaving others as they are.
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return database.ErrNotFound
+	}
+	return err
+}
+
+// wrap attaches the failing operation to an error. Errors caused by being unable to reach our database are marked as
+// Unavailable, so the caller gets a 503 status (and knows to try again) rather than a generic 500 status.
+func wrap(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if unavailable(err) {
+		return &errs.Error{Code: errs.Unavailable, Op: op, Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	// As with our SQL Storer, a unique index we didn't expect to break still conflicts with an existing record
+	if mongo.IsDuplicateKeyError(err) {
+		return errs.Wrap(fmt.Errorf("%w: %v", database.ErrConflict, err), op)
+	}
+	return errs.Wrap(err, op)
+}
+
+// unavailable reports whether an error was caused by a problem reaching the database, rather than by the operation
+// itself. Timeouts count, as they're most often a server that can't be selected (such as during an election).
+func unavailable(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, mongo.ErrClientDisconnected) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// duplicateKey reports whether an error was caused by breaking the named unique index.
+func duplicateKey(err error, index string) bool {
+	var serverErr mongo.ServerError
+	return mongo.IsDuplicateKeyError(err) && errors.As(err, &serverErr) && strings.Contains(serverErr.Error(), "index: "+index+" ")
+}
+
+// purge deletes documents from collection whose field is before the given time, or with dryRun only counts them.
+func (db *DB) purge(collection, field string, before time.Time, dryRun bool, op string) (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	filter := bson.M{field: bson.M{"$lt": before}}
+	if dryRun {
+		n, err := db.store.Collection(collection).CountDocuments(ctx, filter)
+		return int(n), wrap(err, op)
+	}
+	result, err := db.store.Collection(collection).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, wrap(err, op)
+	}
+	return int(result.DeletedCount), nil
+}
+
+// Session and User methods can be found in their respective files (session.go, user.go)
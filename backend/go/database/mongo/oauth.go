@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"examples/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// identityDoc is how a link to an OAuth identity is kept in our oauthidentities collection.
+type identityDoc struct {
+	Provider string `bson:"provider"`
+	Subject  string `bson:"subject"`
+	UserID   int64  `bson:"userid"`
+}
+
+// GetUserByIdentity implements Storer, retrieves the User an OAuth identity is linked to
+func (db *DB) GetUserByIdentity(provider, subject string) (database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var identity identityDoc
+	err := db.store.Collection("oauthidentities").FindOne(ctx, bson.M{"provider": provider, "subject": subject}).Decode(&identity)
+	if err != nil {
+		return database.User{}, wrap(notFound(err), "mongo.GetUserByIdentity")
+	}
+	user, err := db.findUser(ctx, visible(identity.UserID))
+	return user, wrap(err, "mongo.GetUserByIdentity")
+}
+
+// LinkIdentity implements Storer, links an OAuth identity to a User
+func (db *DB) LinkIdentity(userID int64, provider, subject string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("oauthidentities").InsertOne(ctx, identityDoc{Provider: provider, Subject: subject, UserID: userID})
+	// Breaking our unique index means the identity is already linked
+	if duplicateKey(err, "oauthidentities_provider_subject") {
+		return wrap(database.ErrIdentityLinked, "mongo.LinkIdentity")
+	}
+	return wrap(err, "mongo.LinkIdentity")
+}
@@ -0,0 +1,60 @@
+package mongo
+
+import (
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tokenDoc is how a single use token belonging to a User is kept, in our passwordresets and emailverifications
+// collections, which need nothing more.
+type tokenDoc struct {
+	TokenHash []byte    `bson:"tokenhash"`
+	UserID    int64     `bson:"userid"`
+	Expires   time.Time `bson:"expires"`
+}
+
+// replaceToken stores a token in a collection, replacing any other token for the same User, which stops working.
+func (db *DB) replaceToken(collection string, doc tokenDoc) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection(collection).ReplaceOne(ctx, bson.M{"userid": doc.UserID}, doc, options.Replace().SetUpsert(true))
+	return err
+}
+
+// useToken removes the unexpired token with the given hash from a collection, then applies update to its User (unless
+// they've been deleted) in the same transaction. Returns the token that was used.
+func (db *DB) useToken(collection string, tokenHash []byte, update bson.M) (tokenDoc, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc tokenDoc
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		err := db.store.Collection(collection).FindOneAndDelete(ctx,
+			bson.M{"tokenhash": tokenHash, "expires": bson.M{"$gt": time.Now()}}).Decode(&doc)
+		if err != nil {
+			return notFound(err)
+		}
+		return expectMatched(db.store.Collection("users").UpdateOne(ctx, visible(doc.UserID), update))
+	})
+	return doc, err
+}
+
+// CreatePasswordReset implements Storer, stores a password reset. A User can only have one reset at a time, so starting
+// a new reset stops any earlier link from working.
+func (db *DB) CreatePasswordReset(in *database.PasswordReset) error {
+	return wrap(db.replaceToken("passwordresets", tokenDoc{TokenHash: in.TokenHash, UserID: in.UserID, Expires: in.Expires}),
+		"mongo.CreatePasswordReset")
+}
+
+// UsePasswordReset implements Storer, removes a password reset so its token can't be used again, and sets the new
+// password hash in the same transaction.
+func (db *DB) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	doc, err := db.useToken("passwordresets", tokenHash, bson.M{"$set": bson.M{"passwordhash": passwordHash}})
+	if err != nil {
+		return database.PasswordReset{}, wrap(err, "mongo.UsePasswordReset")
+	}
+	return database.PasswordReset{TokenHash: doc.TokenHash, UserID: doc.UserID, Expires: doc.Expires}, nil
+}
@@ -0,0 +1,112 @@
+package mongo
+
+import (
+	"errors"
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// refreshTokenDoc is how a RefreshToken is kept in our refreshtokens collection, identified by its hash.
+type refreshTokenDoc struct {
+	TokenHash []byte    `bson:"_id"`
+	FamilyID  string    `bson:"familyid"`
+	UserID    int64     `bson:"userid"`
+	Expires   time.Time `bson:"expires"`
+	Used      bool      `bson:"used"`
+	Remember  bool      `bson:"remember"`
+}
+
+// refreshToken converts a refreshTokenDoc back into a RefreshToken.
+func (d refreshTokenDoc) refreshToken() database.RefreshToken {
+	return database.RefreshToken{
+		TokenHash: d.TokenHash,
+		FamilyID:  d.FamilyID,
+		UserID:    d.UserID,
+		Expires:   d.Expires,
+		Remember:  d.Remember,
+	}
+}
+
+// newRefreshTokenDoc describes an unused RefreshToken as a refreshTokenDoc.
+func newRefreshTokenDoc(in database.RefreshToken) refreshTokenDoc {
+	return refreshTokenDoc{
+		TokenHash: in.TokenHash,
+		FamilyID:  in.FamilyID,
+		UserID:    in.UserID,
+		Expires:   in.Expires,
+		Remember:  in.Remember,
+	}
+}
+
+// CreateRefreshToken implements Storer, stores a new unused refresh token.
+func (db *DB) CreateRefreshToken(in *database.RefreshToken) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("refreshtokens").InsertOne(ctx, newRefreshTokenDoc(*in))
+	return wrap(err, "mongo.CreateRefreshToken")
+}
+
+// RotateRefreshToken implements Storer, swapping a refresh token for its replacement. The old token is only marked as
+// used rather than deleted, so we can still recognise it (and catch whoever copied it) if it's presented again. Marking
+// it used and reading whether it already was happen in one operation, and two transactions racing to rotate the same
+// token conflict, so only one of them can succeed.
+func (db *DB) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var old, next database.RefreshToken
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var doc refreshTokenDoc
+		err := db.store.Collection("refreshtokens").FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": oldHash, "expires": bson.M{"$gt": time.Now()}},
+			bson.M{"$set": bson.M{"used": true}},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&doc)
+		if err != nil {
+			return notFound(err)
+		}
+		old = doc.refreshToken()
+		if doc.Used {
+			return database.ErrRefreshTokenReused
+		}
+
+		// The replacement expires with the rest of its family, rotating never extends how long a login lasts
+		next = old
+		next.TokenHash = newHash
+		_, err = db.store.Collection("refreshtokens").InsertOne(ctx, newRefreshTokenDoc(next))
+		return err
+	})
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		return old, wrap(err, "mongo.RotateRefreshToken")
+	}
+	if err != nil {
+		return database.RefreshToken{}, wrap(err, "mongo.RotateRefreshToken")
+	}
+	return next, nil
+}
+
+// RevokeRefreshFamily implements Storer, deleting a refresh token family along with every session created from it.
+func (db *DB) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var ids []int64
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var err error
+		if ids, err = db.sessionIDs(ctx, bson.M{"refreshfamily": familyID}); err != nil {
+			return err
+		}
+		if _, err := db.store.Collection("sessions").DeleteMany(ctx, bson.M{"refreshfamily": familyID}); err != nil {
+			return err
+		}
+		_, err = db.store.Collection("refreshtokens").DeleteMany(ctx, bson.M{"familyid": familyID})
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "mongo.RevokeRefreshFamily")
+	}
+	return ids, nil
+}
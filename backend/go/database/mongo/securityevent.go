@@ -0,0 +1,97 @@
+package mongo
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// securityEventDoc is how a SecurityEvent is kept in our securityevents collection.
+type securityEventDoc struct {
+	ID       int64     `bson:"_id"`
+	Time     time.Time `bson:"time"`
+	Kind     string    `bson:"kind"`
+	UserID   int64     `bson:"userid"`
+	IP       string    `bson:"ip"`
+	Detail   string    `bson:"detail"`
+	PrevHash []byte    `bson:"prevhash"`
+	Hash     []byte    `bson:"hash"`
+}
+
+// securityEvent converts a securityEventDoc back into a SecurityEvent.
+func (d securityEventDoc) securityEvent() database.SecurityEvent {
+	return database.SecurityEvent{
+		ID:       d.ID,
+		Time:     d.Time,
+		Kind:     d.Kind,
+		UserID:   d.UserID,
+		IP:       d.IP,
+		Detail:   d.Detail,
+		PrevHash: d.PrevHash,
+		Hash:     d.Hash,
+	}
+}
+
+// CreateSecurityEvent implements Storer, chains the event to the latest one, and adds it to the security event log.
+// Events have to be added one at a time, otherwise two could chain to the same predecessor. Rather than a lock, the
+// head of the chain (the last ID handed out, and the latest hash) is kept in a single counters document, which every
+// transaction adding an event changes, so two at once conflict and one is retried once the other has committed.
+//
+// Unlike SQL, nothing stops someone with direct access to our database changing events, but the hash chain still
+// gives them away.
+func (db *DB) CreateSecurityEvent(in *database.SecurityEvent) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	// Our database keeps times to the millisecond, so we hash the time as it will be read back
+	in.Time = clock.UTC(in.Time)
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var head counter
+		err := db.store.Collection("counters").FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": "securityevents"},
+			bson.M{"$inc": bson.M{"seq": 1}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+		).Decode(&head)
+		// There's no head before the first event
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		in.ID = head.Seq + 1
+		in.PrevHash = head.Hash
+		if in.PrevHash == nil {
+			in.PrevHash = []byte{}
+		}
+		in.Hash = in.ChainHash(in.PrevHash)
+		if _, err := db.store.Collection("counters").UpdateOne(ctx, bson.M{"_id": "securityevents"},
+			bson.M{"$set": bson.M{"hash": in.Hash}}); err != nil {
+			return err
+		}
+		_, err = db.store.Collection("securityevents").InsertOne(ctx, securityEventDoc{
+			ID:       in.ID,
+			Time:     in.Time,
+			Kind:     in.Kind,
+			UserID:   in.UserID,
+			IP:       in.IP,
+			Detail:   in.Detail,
+			PrevHash: in.PrevHash,
+			Hash:     in.Hash,
+		})
+		return err
+	})
+	return wrap(err, "mongo.CreateSecurityEvent")
+}
+
+// ListSecurityEvents implements Storer, lists security events after the given ID, oldest first
+func (db *DB) ListSecurityEvents(afterID int64, limit int) ([]database.SecurityEvent, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	events, err := findAll(ctx, db.store.Collection("securityevents"), bson.M{"_id": bson.M{"$gt": afterID}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)), securityEventDoc.securityEvent)
+	return events, wrap(err, "mongo.ListSecurityEvents")
+}
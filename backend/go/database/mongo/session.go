@@ -0,0 +1,290 @@
+package mongo
+
+import (
+	"examples/clock"
+	"examples/database"
+	"net/netip"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionDoc is how a Session is kept in our sessions collection.
+type sessionDoc struct {
+	ID             int64     `bson:"_id"`
+	TokenHash      []byte    `bson:"tokenhash"`
+	UserID         int64     `bson:"userid"`
+	EncryptedCreds []byte    `bson:"encryptedcreds"`
+	Created        time.Time `bson:"created"`
+	Expiration     time.Time `bson:"expiration"`
+	EndOfLife      time.Time `bson:"endoflife"`
+	IP             string    `bson:"ip"`
+	RefreshFamily  string    `bson:"refreshfamily"`
+	Remember       bool      `bson:"remember"`
+	UserAgent      string    `bson:"useragent"`
+	LastSeen       time.Time `bson:"lastseen"`
+	LastIP         string    `bson:"lastip"`
+	Impersonator   int64     `bson:"impersonator"`
+}
+
+// session converts a sessionDoc back into a Session.
+func (d sessionDoc) session() database.Session {
+	return database.Session{
+		ID:             d.ID,
+		TokenHash:      d.TokenHash,
+		UserID:         d.UserID,
+		EncryptedCreds: d.EncryptedCreds,
+		Created:        d.Created,
+		Expires:        d.Expiration,
+		EndOfLife:      d.EndOfLife,
+		IP:             d.IP,
+		RefreshFamily:  d.RefreshFamily,
+		Remember:       d.Remember,
+		UserAgent:      d.UserAgent,
+		LastSeen:       d.LastSeen,
+		LastIP:         d.LastIP,
+		ImpersonatorID: d.Impersonator,
+	}
+}
+
+// unexpired matches sessions that haven't expired. The TTL index removes expired sessions, but only about once a
+// minute, so they're filtered out here rather than shown as if still active.
+func unexpired(now time.Time) bson.M {
+	return bson.M{"expiration": bson.M{"$gt": now}, "endoflife": bson.M{"$gt": now}}
+}
+
+// SaveSession implements Storer, inserts a Session into the database, and also updates the ID field with the ID that was
+// handed out for it.
+func (db *DB) SaveSession(in *database.Session) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	// A new session was last seen when it was created, from where it was created
+	if in.LastSeen.IsZero() {
+		in.LastSeen = in.Created
+	}
+	if in.LastIP == "" {
+		in.LastIP = in.IP
+	}
+	id, err := db.nextID(ctx, "sessions")
+	if err != nil {
+		return wrap(err, "mongo.SaveSession")
+	}
+	_, err = db.store.Collection("sessions").InsertOne(ctx, sessionDoc{
+		ID:             id,
+		TokenHash:      in.TokenHash,
+		UserID:         in.UserID,
+		EncryptedCreds: in.EncryptedCreds,
+		Created:        in.Created,
+		Expiration:     in.Expires,
+		EndOfLife:      in.EndOfLife,
+		IP:             in.IP,
+		RefreshFamily:  in.RefreshFamily,
+		Remember:       in.Remember,
+		UserAgent:      in.UserAgent,
+		LastSeen:       in.LastSeen,
+		LastIP:         in.LastIP,
+		Impersonator:   in.ImpersonatorID,
+	})
+	if err != nil {
+		return wrap(err, "mongo.SaveSession")
+	}
+	in.ID = id
+	return nil
+}
+
+// LoadSession implements Storer, retrieves a Session from the database by ID.
+func (db *DB) LoadSession(id int64) (database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc sessionDoc
+	if err := db.store.Collection("sessions").FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return database.Session{}, wrap(notFound(err), "mongo.LoadSession")
+	}
+	return doc.session(), nil
+}
+
+// LoadSessionByToken implements Storer, retrieves a Session from the database by the hash of its bearer token.
+func (db *DB) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc sessionDoc
+	if err := db.store.Collection("sessions").FindOne(ctx, bson.M{"tokenhash": tokenHash}).Decode(&doc); err != nil {
+		return database.Session{}, wrap(notFound(err), "mongo.LoadSessionByToken")
+	}
+	return doc.session(), nil
+}
+
+// ListSessionsByUser implements Storer, retrieves every unexpired Session belonging to a User, newest first.
+func (db *DB) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	filter := unexpired(time.Now())
+	filter["userid"] = userID
+	sessions, err := findAll(ctx, db.store.Collection("sessions"), filter,
+		options.Find().SetSort(bson.D{{Key: "created", Value: -1}}), sessionDoc.session)
+	return sessions, wrap(err, "mongo.ListSessionsByUser")
+}
+
+// LogoutSession implements Storer, deletes a Session from the database by ID.
+func (db *DB) LogoutSession(id int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("sessions").DeleteOne(ctx, bson.M{"_id": id})
+	return wrap(err, "mongo.LogoutSession")
+}
+
+// ExtendSession implements Storer, updates a Session to have a new expiration. The update is a pipeline, so the new
+// expiration can be capped at the session's end of life without reading it first.
+func (db *DB) ExtendSession(id int64, lifespan time.Duration) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("sessions").UpdateOne(ctx, bson.M{"_id": id}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"expiration": bson.M{"$min": bson.A{clock.Now().Add(lifespan), "$endoflife"}}}}},
+	})
+	return wrap(err, "mongo.ExtendSession")
+}
+
+// TouchSession implements Storer, records when and where a Session was last used.
+func (db *DB) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("sessions").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"lastseen": seen, "lastip": ip, "useragent": userAgent}})
+	return wrap(err, "mongo.TouchSession")
+}
+
+// ListSessionsAfter implements Storer, retrieves a page of unexpired Sessions in ID order.
+func (db *DB) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	filter := unexpired(time.Now())
+	filter["_id"] = bson.M{"$gt": afterID}
+	sessions, err := findAll(ctx, db.store.Collection("sessions"), filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)), sessionDoc.session)
+	return sessions, wrap(err, "mongo.ListSessionsAfter")
+}
+
+// UpdateSessionCreds implements Storer, replaces a Session's encrypted credentials.
+func (db *DB) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("sessions").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"encryptedcreds": encryptedCreds}})), "mongo.UpdateSessionCreds")
+}
+
+// ClearExpiredSessions implements Storer, deletes any Sessions that are expired. Our TTL indexes do this for us in the
+// background, but calling this clears them straight away, and counts them. Expired refresh tokens are cleared too,
+// though they aren't counted.
+func (db *DB) ClearExpiredSessions() (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	now := time.Now()
+	if _, err := db.store.Collection("refreshtokens").DeleteMany(ctx, bson.M{"expires": bson.M{"$lt": now}}); err != nil {
+		return 0, wrap(err, "mongo.ClearExpiredSessions")
+	}
+	result, err := db.store.Collection("sessions").DeleteMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"expiration": bson.M{"$lt": now}},
+		bson.M{"endoflife": bson.M{"$lt": now}},
+	}})
+	if err != nil {
+		return 0, wrap(err, "mongo.ClearExpiredSessions")
+	}
+	return int(result.DeletedCount), nil
+}
+
+// sessionIDs finds the IDs of the sessions matching a filter. MongoDB can't return what a delete removed, so we find
+// the sessions first, in the same transaction as we delete them.
+func (db *DB) sessionIDs(ctx mongo.SessionContext, filter any) ([]int64, error) {
+	return findAll(ctx, db.store.Collection("sessions"), filter,
+		options.Find().SetProjection(bson.M{"_id": 1}), func(doc sessionDoc) int64 { return doc.ID })
+}
+
+// DeleteUserSessions implements Storer, deletes every session and refresh token belonging to a User.
+func (db *DB) DeleteUserSessions(userID int64) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var ids []int64
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var err error
+		if ids, err = db.sessionIDs(ctx, bson.M{"userid": userID}); err != nil {
+			return err
+		}
+		if _, err := db.store.Collection("refreshtokens").DeleteMany(ctx, bson.M{"userid": userID}); err != nil {
+			return err
+		}
+		_, err = db.store.Collection("sessions").DeleteMany(ctx, bson.M{"userid": userID})
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "mongo.DeleteUserSessions")
+	}
+	return ids, nil
+}
+
+// RevokeSessions implements Storer, deletes a batch of sessions matching a filter along with their refresh token
+// families. MongoDB can't compare IP addresses (ours are kept as text, as in SQL), so a filter on an IP range is applied
+// here as we read through the sessions matching everything else.
+func (db *DB) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+
+	// Each criterion is only applied when set
+	query := bson.M{}
+	if len(filter.UserIDs) > 0 {
+		query["userid"] = bson.M{"$in": filter.UserIDs}
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query["created"] = bson.M{"$lt": filter.CreatedBefore}
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "ip": 1, "refreshfamily": 1})
+	if !filter.IPRange.IsValid() {
+		opts.SetLimit(int64(limit))
+	}
+	ipRange := filter.IPRange.Masked()
+
+	var ids []int64
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		cursor, err := db.store.Collection("sessions").Find(ctx, query, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		ids = nil
+		var families []string
+		for len(ids) < limit && cursor.Next(ctx) {
+			var doc sessionDoc
+			if err := cursor.Decode(&doc); err != nil {
+				return err
+			}
+			if filter.IPRange.IsValid() {
+				ip, err := netip.ParseAddr(doc.IP)
+				if err != nil || !ipRange.Contains(ip.Unmap()) {
+					continue
+				}
+			}
+			ids = append(ids, doc.ID)
+			if doc.RefreshFamily != "" {
+				families = append(families, doc.RefreshFamily)
+			}
+		}
+		if err := cursor.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if _, err := db.store.Collection("sessions").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+		if len(families) > 0 {
+			if _, err := db.store.Collection("refreshtokens").DeleteMany(ctx, bson.M{"familyid": bson.M{"$in": families}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrap(err, "mongo.RevokeSessions")
+	}
+	return ids, nil
+}
@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"examples/clock"
+	"examples/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tenantSettingsDoc is how TenantSettings are kept in our tenantsettings collection, identified by their tenant.
+// Durations are kept in seconds, as in SQL.
+type tenantSettingsDoc struct {
+	TenantID            int64     `bson:"_id"`
+	IdleTimeout         int64     `bson:"idletimeout"`
+	MaxLifetime         int64     `bson:"maxlifetime"`
+	RememberIdleTimeout int64     `bson:"rememberidletimeout"`
+	RememberLifetime    int64     `bson:"rememberlifetime"`
+	PasswordMinLength   int       `bson:"passwordminlength"`
+	AllowedOrigins      []string  `bson:"allowedorigins"`
+	Updated             time.Time `bson:"updated"`
+}
+
+// tenantSettings converts a tenantSettingsDoc back into TenantSettings.
+func (d tenantSettingsDoc) tenantSettings() database.TenantSettings {
+	return database.TenantSettings{
+		TenantID:            d.TenantID,
+		IdleTimeout:         time.Duration(d.IdleTimeout) * time.Second,
+		MaxLifetime:         time.Duration(d.MaxLifetime) * time.Second,
+		RememberIdleTimeout: time.Duration(d.RememberIdleTimeout) * time.Second,
+		RememberLifetime:    time.Duration(d.RememberLifetime) * time.Second,
+		PasswordMinLength:   d.PasswordMinLength,
+		AllowedOrigins:      d.AllowedOrigins,
+		Updated:             d.Updated,
+	}
+}
+
+// GetTenantSettings implements Storer, retrieves the settings a tenant has overridden.
+func (db *DB) GetTenantSettings(tenantID int64) (database.TenantSettings, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc tenantSettingsDoc
+	if err := db.store.Collection("tenantsettings").FindOne(ctx, bson.M{"_id": tenantID}).Decode(&doc); err != nil {
+		return database.TenantSettings{}, wrap(notFound(err), "mongo.GetTenantSettings")
+	}
+	return doc.tenantSettings(), nil
+}
+
+// ListTenantSettings implements Storer, lists the settings of every tenant that has overridden any.
+func (db *DB) ListTenantSettings() ([]database.TenantSettings, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	list, err := findAll(ctx, db.store.Collection("tenantsettings"), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}), tenantSettingsDoc.tenantSettings)
+	return list, wrap(err, "mongo.ListTenantSettings")
+}
+
+// SaveTenantSettings implements Storer, stores a tenant's settings, replacing any it had before.
+func (db *DB) SaveTenantSettings(in *database.TenantSettings) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	in.Updated = clock.Now()
+	_, err := db.store.Collection("tenantsettings").ReplaceOne(ctx, bson.M{"_id": in.TenantID}, tenantSettingsDoc{
+		TenantID:            in.TenantID,
+		IdleTimeout:         int64(in.IdleTimeout / time.Second),
+		MaxLifetime:         int64(in.MaxLifetime / time.Second),
+		RememberIdleTimeout: int64(in.RememberIdleTimeout / time.Second),
+		RememberLifetime:    int64(in.RememberLifetime / time.Second),
+		PasswordMinLength:   in.PasswordMinLength,
+		AllowedOrigins:      in.AllowedOrigins,
+		Updated:             in.Updated,
+	}, options.Replace().SetUpsert(true))
+	return wrap(err, "mongo.SaveTenantSettings")
+}
+
+// DeleteTenantSettings implements Storer, removes a tenant's settings.
+func (db *DB) DeleteTenantSettings(tenantID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectDeleted(db.store.Collection("tenantsettings").DeleteOne(ctx, bson.M{"_id": tenantID})), "mongo.DeleteTenantSettings")
+}
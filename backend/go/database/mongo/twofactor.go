@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"examples/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// twoFactorDoc is how a User's TwoFactor state is kept in our twofactor collection, identified by the User's ID. Their
+// recovery codes (by their hashes) are kept in the same document, rather than a collection of their own as in SQL, so
+// they're always changed along with the rest.
+type twoFactorDoc struct {
+	UserID          int64    `bson:"_id"`
+	EncryptedSecret []byte   `bson:"encryptedsecret"`
+	Enabled         bool     `bson:"enabled"`
+	LastStep        int64    `bson:"laststep"`
+	RecoveryCodes   [][]byte `bson:"recoverycodes"`
+}
+
+// GetTwoFactor implements Storer, retrieves a User's two-factor authentication state
+func (db *DB) GetTwoFactor(userID int64) (database.TwoFactor, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var doc twoFactorDoc
+	if err := db.store.Collection("twofactor").FindOne(ctx, bson.M{"_id": userID}).Decode(&doc); err != nil {
+		return database.TwoFactor{}, wrap(notFound(err), "mongo.GetTwoFactor")
+	}
+	return database.TwoFactor{
+		UserID:          doc.UserID,
+		EncryptedSecret: doc.EncryptedSecret,
+		Enabled:         doc.Enabled,
+		LastStep:        doc.LastStep,
+	}, nil
+}
+
+// SaveTwoFactor implements Storer, stores a pending two-factor enrollment. A pending enrollment replaces any earlier
+// one, but an enabled one is left alone: it doesn't match our filter, so the upsert tries to insert a second document
+// for the User, which breaks the unique index on _id.
+func (db *DB) SaveTwoFactor(in *database.TwoFactor) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.store.Collection("twofactor").UpdateOne(
+		ctx,
+		bson.M{"_id": in.UserID, "enabled": false},
+		bson.M{
+			"$set":         bson.M{"encryptedsecret": in.EncryptedSecret, "enabled": false, "laststep": 0},
+			"$setOnInsert": bson.M{"recoverycodes": bson.A{}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if duplicateKey(err, "_id_") {
+		return wrap(database.ErrTwoFactorEnabled, "mongo.SaveTwoFactor")
+	}
+	if err != nil {
+		return wrap(err, "mongo.SaveTwoFactor")
+	}
+	in.Enabled, in.LastStep = false, 0
+	return nil
+}
+
+// EnableTwoFactor implements Storer, enables a pending two-factor enrollment and replaces the User's recovery codes.
+func (db *DB) EnableTwoFactor(userID int64, codeHashes [][]byte) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	// A nil slice would be stored as null rather than an empty list
+	if codeHashes == nil {
+		codeHashes = [][]byte{}
+	}
+	return wrap(expectMatched(db.store.Collection("twofactor").UpdateOne(ctx, bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"enabled": true, "recoverycodes": codeHashes}})), "mongo.EnableTwoFactor")
+}
+
+// DeleteTwoFactor implements Storer, removes a User's two-factor authentication and recovery codes.
+func (db *DB) DeleteTwoFactor(userID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectDeleted(db.store.Collection("twofactor").DeleteOne(ctx, bson.M{"_id": userID})), "mongo.DeleteTwoFactor")
+}
+
+// UseTwoFactorStep implements Storer, records an accepted code's time step. Checking and updating the last step in a
+// single update means two requests racing to use the same code can't both succeed.
+func (db *DB) UseTwoFactorStep(userID int64, step int64) (bool, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	result, err := db.store.Collection("twofactor").UpdateOne(ctx,
+		bson.M{"_id": userID, "laststep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"laststep": step}})
+	if err != nil {
+		return false, wrap(err, "mongo.UseTwoFactorStep")
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// UseRecoveryCode implements Storer, removes a recovery code so it can't be used again. The User's document only
+// matches while they still have the code, so two requests racing to use it can't both succeed.
+func (db *DB) UseRecoveryCode(userID int64, codeHash []byte) (bool, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	result, err := db.store.Collection("twofactor").UpdateOne(ctx,
+		bson.M{"_id": userID, "recoverycodes": codeHash},
+		bson.M{"$pull": bson.M{"recoverycodes": codeHash}})
+	if err != nil {
+		return false, wrap(err, "mongo.UseRecoveryCode")
+	}
+	return result.ModifiedCount > 0, nil
+}
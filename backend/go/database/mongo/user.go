@@ -0,0 +1,474 @@
+package mongo
+
+import (
+	"context"
+	"examples/clock"
+	"examples/database"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userDoc is how a User is kept in our users collection. Users without a username don't have the field at all, so our
+// unique index on it skips them (see EnsureIndexes), as a NULL username is skipped in SQL.
+type userDoc struct {
+	ID            int64      `bson:"_id"`
+	First         string     `bson:"first"`
+	Last          string     `bson:"last"`
+	Email         string     `bson:"email"`
+	Username      string     `bson:"username,omitempty"`
+	Role          string     `bson:"role"`
+	PasswordHash  string     `bson:"passwordhash"`
+	Enabled       bool       `bson:"enabled"`
+	FailedLogins  int        `bson:"failedlogins"`
+	Locked        bool       `bson:"locked"`
+	EmailVerified bool       `bson:"emailverified"`
+	Deleted       *time.Time `bson:"deleted,omitempty"` // Set once the User is soft deleted, hiding them from every lookup
+}
+
+// user converts a userDoc back into a User.
+func (d userDoc) user() database.User {
+	return database.User{
+		ID:            d.ID,
+		First:         d.First,
+		Last:          d.Last,
+		Email:         d.Email,
+		Username:      d.Username,
+		Role:          d.Role,
+		PasswordHash:  d.PasswordHash,
+		Enabled:       d.Enabled,
+		FailedLogins:  d.FailedLogins,
+		Locked:        d.Locked,
+		EmailVerified: d.EmailVerified,
+	}
+}
+
+// usernameChangeDoc is how a UsernameChange is kept in our usernamehistory collection.
+type usernameChangeDoc struct {
+	UserID      int64     `bson:"userid"`
+	OldUsername string    `bson:"oldusername"`
+	NewUsername string    `bson:"newusername"`
+	Changed     time.Time `bson:"changed"`
+}
+
+// visible matches the User with the given ID, unless they've been soft deleted. A missing field matches nil, so Users
+// that were never deleted match too.
+func visible(id int64) bson.M {
+	return bson.M{"_id": id, "deleted": nil}
+}
+
+// CreateUser implements Storer, inserts a new User record into the database, the ID field will be generated as part of this process
+func (db *DB) CreateUser(in *database.User) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(db.insertUser(ctx, in), "mongo.CreateUser")
+}
+
+// insertUser inserts a User with ctx, which may be a transaction (such as when using an invite), and updates the User
+// with their new ID.
+func (db *DB) insertUser(ctx context.Context, in *database.User) error {
+	// Usernames other Users have given up stay theirs, new Users can't take them either
+	reserved, err := db.usernameReserved(ctx, in.Username, 0)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return database.ErrUsernameTaken
+	}
+	id, err := db.nextID(ctx, "users")
+	if err != nil {
+		return err
+	}
+	// New users are always enabled, and are regular users until promoted
+	_, err = db.store.Collection("users").InsertOne(ctx, userDoc{
+		ID:            id,
+		First:         in.First,
+		Last:          in.Last,
+		Email:         in.Email,
+		Username:      in.Username,
+		Role:          database.RoleUser,
+		PasswordHash:  in.PasswordHash,
+		Enabled:       true,
+		EmailVerified: in.EmailVerified,
+	})
+	if duplicateKey(err, "users_username") {
+		return database.ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	in.ID, in.Enabled, in.Role = id, true, database.RoleUser
+	return nil
+}
+
+// usernameReserved reports whether a User other than id (0 for a new User) has given up a username, with ctx, which
+// may be a transaction. Having no username reserves nothing.
+func (db *DB) usernameReserved(ctx context.Context, username string, id int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	reserved, err := db.store.Collection("usernamehistory").CountDocuments(ctx,
+		bson.M{"oldusername": username, "userid": bson.M{"$ne": id}}, options.Count().SetLimit(1))
+	return reserved > 0, err
+}
+
+// findUser finds the User matching a filter, returning our not found error if there isn't one.
+func (db *DB) findUser(ctx context.Context, filter bson.M) (database.User, error) {
+	var doc userDoc
+	if err := db.store.Collection("users").FindOne(ctx, filter).Decode(&doc); err != nil {
+		return database.User{}, notFound(err)
+	}
+	return doc.user(), nil
+}
+
+// GetUserByID implements Storer, retrieves a User record by the ID field
+func (db *DB) GetUserByID(id int64) (database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	user, err := db.findUser(ctx, visible(id))
+	return user, wrap(err, "mongo.GetUserByID")
+}
+
+// GetUserByEmail implements Storer, retrieves a User record by the Email field
+func (db *DB) GetUserByEmail(email string) (database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	user, err := db.findUser(ctx, bson.M{"email": email, "deleted": nil})
+	return user, wrap(err, "mongo.GetUserByEmail")
+}
+
+// GetUserByUsername implements Storer, retrieves a User record by the Username field
+func (db *DB) GetUserByUsername(username string) (database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	user, err := db.findUser(ctx, bson.M{"username": username, "deleted": nil})
+	return user, wrap(err, "mongo.GetUserByUsername")
+}
+
+// setUsername sets a User's username, or removes it if empty, so they're skipped by our unique index.
+func setUsername(username string) bson.M {
+	if username == "" {
+		return bson.M{"$unset": bson.M{"username": ""}}
+	}
+	return bson.M{"$set": bson.M{"username": username}}
+}
+
+// ChangeUsername implements Storer, changes a User's username and records the change in a single transaction. Two
+// changes to the same User at once conflict, so they can't both record the same old username.
+func (db *DB) ChangeUsername(id int64, username string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		user, err := db.findUser(ctx, bson.M{"_id": id})
+		if err != nil {
+			return err
+		}
+		if user.Username == username {
+			return nil
+		}
+
+		// Usernames other Users have given up stay theirs, a User may only take back one of their own
+		reserved, err := db.usernameReserved(ctx, username, id)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			return database.ErrUsernameTaken
+		}
+
+		_, err = db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": id}, setUsername(username))
+		if duplicateKey(err, "users_username") {
+			return database.ErrUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+		_, err = db.store.Collection("usernamehistory").InsertOne(ctx, usernameChangeDoc{
+			UserID:      id,
+			OldUsername: user.Username,
+			NewUsername: username,
+			Changed:     clock.Now(),
+		})
+		return err
+	})
+	return wrap(err, "mongo.ChangeUsername")
+}
+
+// UsernameReserved implements Storer, reports whether any User has given up a username
+func (db *DB) UsernameReserved(username string) (bool, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	reserved, err := db.usernameReserved(ctx, username, 0)
+	return reserved, wrap(err, "mongo.UsernameReserved")
+}
+
+// UsernameHistory implements Storer, lists a User's username changes oldest first
+func (db *DB) UsernameHistory(id int64) ([]database.UsernameChange, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	changes, err := findAll(ctx, db.store.Collection("usernamehistory"), bson.M{"userid": id},
+		options.Find().SetSort(bson.D{{Key: "changed", Value: 1}}),
+		func(doc usernameChangeDoc) database.UsernameChange {
+			return database.UsernameChange{UserID: doc.UserID, Old: doc.OldUsername, New: doc.NewUsername, Changed: doc.Changed}
+		})
+	return changes, wrap(err, "mongo.UsernameHistory")
+}
+
+// ListUsers implements Storer, retrieves a page of User records in ID order
+func (db *DB) ListUsers(afterID int64, limit int) ([]database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	users, err := findAll(ctx, db.store.Collection("users"), bson.M{"_id": bson.M{"$gt": afterID}, "deleted": nil},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)), userDoc.user)
+	return users, wrap(err, "mongo.ListUsers")
+}
+
+// SearchUsers implements Storer, retrieves User records whose name or email contains query, prefix matches first. Mongo
+// can't sort by how a document matched, so prefix matches are found first, then the rest are found to fill up to limit.
+// There are no joins here either, so for a narrower scope we look up who's in it first, then only search those Users.
+func (db *DB) SearchUsers(query string, scope database.UserScope, limit int) ([]database.User, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	matching := func(pattern string) bson.A {
+		regex := bson.M{"$regex": pattern, "$options": "i"}
+		return bson.A{bson.M{"first": regex}, bson.M{"last": regex}, bson.M{"email": regex}}
+	}
+	byID := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	quoted := regexp.QuoteMeta(query)
+	prefixed := bson.M{"$or": matching("^" + quoted), "deleted": nil}
+	rest := bson.M{
+		"$and":    bson.A{bson.M{"$or": matching(quoted)}, bson.M{"$nor": matching("^" + quoted)}},
+		"deleted": nil,
+	}
+	if !scope.Everyone() {
+		inScope := []int64{scope.ViewerID}
+		if len(scope.Dealerships) > 0 {
+			members, err := findAll(ctx, db.store.Collection("dealershipmembers"),
+				bson.M{"dealershipid": bson.M{"$in": scope.Dealerships}}, options.Find(),
+				func(doc membershipDoc) int64 { return doc.UserID })
+			if err != nil {
+				return nil, wrap(err, "mongo.SearchUsers")
+			}
+			inScope = append(inScope, members...)
+		}
+		prefixed["_id"], rest["_id"] = bson.M{"$in": inScope}, bson.M{"$in": inScope}
+	}
+
+	users, err := findAll(ctx, db.store.Collection("users"), prefixed, byID.SetLimit(int64(limit)), userDoc.user)
+	if err != nil || len(users) >= limit {
+		return users, wrap(err, "mongo.SearchUsers")
+	}
+	more, err := findAll(ctx, db.store.Collection("users"), rest, byID.SetLimit(int64(limit-len(users))), userDoc.user)
+	return append(users, more...), wrap(err, "mongo.SearchUsers")
+}
+
+// CountUsers implements Storer, counts the User records that haven't been deleted
+func (db *DB) CountUsers() (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	n, err := db.store.Collection("users").CountDocuments(ctx, bson.M{"deleted": nil})
+	return int(n), wrap(err, "mongo.CountUsers")
+}
+
+// UpdateUser implements Storer, saves the name and email of a User record
+func (db *DB) UpdateUser(in *database.User) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("users").UpdateOne(ctx, visible(in.ID),
+		bson.M{"$set": bson.M{"first": in.First, "last": in.Last, "email": in.Email}})), "mongo.UpdateUser")
+}
+
+// SetUserEnabled implements Storer, enables or disables a User record
+func (db *DB) SetUserEnabled(id int64, enabled bool) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"enabled": enabled}})), "mongo.SetUserEnabled")
+}
+
+// SetUserRole implements Storer, changes the role of a User record
+func (db *DB) SetUserRole(id int64, role string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("users").UpdateOne(ctx, visible(id),
+		bson.M{"$set": bson.M{"role": role}})), "mongo.SetUserRole")
+}
+
+// SetPasswordHash implements Storer, replaces the password hash of a User record
+func (db *DB) SetPasswordHash(id int64, hash string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"passwordhash": hash}})), "mongo.SetPasswordHash")
+}
+
+// RecordFailedLogin implements Storer, counting the failure and locking the User in a single update, so concurrent
+// attempts can't slip past the limit. The update is a pipeline, so whether to lock can be worked out from the count.
+func (db *DB) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	failed := bson.M{"$add": bson.A{"$failedlogins", 1}}
+	var doc userDoc
+	err := db.store.Collection("users").FindOneAndUpdate(ctx, bson.M{"_id": id}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failedlogins": failed,
+			"locked": bson.M{"$or": bson.A{
+				"$locked",
+				bson.M{"$and": bson.A{lockAfter > 0, bson.M{"$gte": bson.A{failed, lockAfter}}}},
+			}},
+		}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	if err != nil {
+		return false, wrap(notFound(err), "mongo.RecordFailedLogin")
+	}
+	return doc.Locked, nil
+}
+
+// UnlockUser implements Storer, clearing a User's failed logins and unlocking them
+func (db *DB) UnlockUser(id int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(expectMatched(db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"failedlogins": 0, "locked": false}})), "mongo.UnlockUser")
+}
+
+// DeleteUser implements Storer, deletes a User record from the database, along with everything that refers to it.
+func (db *DB) DeleteUser(id int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		return db.deleteUser(ctx, id)
+	}), "mongo.DeleteUser")
+}
+
+// userReferences lists the fields in each collection that refer to a User, removed along with the User as the
+// foreign keys in our SQL schema are (ON DELETE CASCADE). The audit log, security events, domain events and user
+// deletions outlive the User, so aren't listed.
+var userReferences = []struct{ collection, field string }{
+	{"sessions", "userid"},
+	{"refreshtokens", "userid"},
+	{"usernamehistory", "userid"},
+	{"oauthidentities", "userid"},
+	{"emailchanges", "userid"},
+	{"magiclinks", "userid"},
+	{"passwordresets", "userid"},
+	{"emailverifications", "userid"},
+	{"invites", "invitedby"},
+	{"dealershipmembers", "userid"},
+	{"twofactor", "_id"},
+	{"apitokens", "userid"},
+}
+
+// deleteUser deletes a User and everything that refers to them, with ctx, which should be a transaction so nothing is
+// left behind if we fail part way.
+func (db *DB) deleteUser(ctx context.Context, id int64) error {
+	for _, ref := range userReferences {
+		if _, err := db.store.Collection(ref.collection).DeleteMany(ctx, bson.M{ref.field: id}); err != nil {
+			return err
+		}
+	}
+	_, err := db.store.Collection("users").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// SoftDeleteUser implements Storer, hides a User and records their pending deletion in a single transaction. They're
+// disabled too, so even something that reads the users collection directly won't treat them as active.
+func (db *DB) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	// Times are kept to the millisecond, so we return the time as it will be read back
+	now := clock.Now()
+	deletion := database.UserDeletion{UserID: id, Requested: now, Status: database.DeletionPending}
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		err := expectMatched(db.store.Collection("users").UpdateOne(ctx, visible(id),
+			bson.M{"$set": bson.M{"deleted": now, "enabled": false}}))
+		if err != nil {
+			return err
+		}
+		_, err = db.store.Collection("userdeletions").InsertOne(ctx, newDeletionDoc(deletion))
+		return err
+	})
+	if err != nil {
+		return database.UserDeletion{}, wrap(err, "mongo.SoftDeleteUser")
+	}
+	return deletion, nil
+}
+
+// MergeUsers implements Storer, merges one User into another in a single transaction. Both User documents are changed,
+// so anything changing either of them at the same time conflicts with us, and one of us is retried.
+func (db *DB) MergeUsers(keepID, mergeID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	err := db.transaction(ctx, func(ctx mongo.SessionContext) error {
+		keep, err := db.findUser(ctx, bson.M{"_id": keepID})
+		if err != nil {
+			return err
+		}
+		merged, err := db.findUser(ctx, bson.M{"_id": mergeID})
+		if err != nil {
+			return err
+		}
+
+		// Usernames are unique, so the merged User has to give theirs up before the kept User can take it
+		if _, err := db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": mergeID}, setUsername("")); err != nil {
+			return err
+		}
+
+		// Combine the two User records, following our conflict rules
+		set := bson.M{
+			"enabled": keep.Enabled && merged.Enabled,
+			"locked":  keep.Locked || merged.Locked,
+		}
+		if keep.Username == "" && merged.Username != "" {
+			set["username"] = merged.Username
+		}
+		if keep.First == "" {
+			set["first"] = merged.First
+		}
+		if keep.Last == "" {
+			set["last"] = merged.Last
+		}
+		if _, err := db.store.Collection("users").UpdateOne(ctx, bson.M{"_id": keepID}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+
+		// Move everything else across. Sessions and email changes aren't moved, deleting the merged User removes them.
+		dealerships, err := db.userDealerships(ctx, mergeID)
+		if err != nil {
+			return err
+		}
+		for _, dealershipID := range dealerships {
+			if err := db.addMembership(ctx, keepID, dealershipID); err != nil {
+				return err
+			}
+		}
+		moves := []struct{ collection, field string }{
+			{"auditlog", "actorid"},
+			{"auditlog", "targetid"},
+			{"oauthidentities", "userid"},
+			{"usernamehistory", "userid"},
+		}
+		for _, move := range moves {
+			if _, err := db.store.Collection(move.collection).UpdateMany(ctx,
+				bson.M{move.field: mergeID}, bson.M{"$set": bson.M{move.field: keepID}}); err != nil {
+				return err
+			}
+		}
+		// If the kept User already had a username, the merged User's is given up, so record that to keep it reserved
+		if keep.Username != "" && merged.Username != "" {
+			if _, err := db.store.Collection("usernamehistory").InsertOne(ctx, usernameChangeDoc{
+				UserID:      keepID,
+				OldUsername: merged.Username,
+				NewUsername: keep.Username,
+				Changed:     clock.Now(),
+			}); err != nil {
+				return err
+			}
+		}
+		return db.deleteUser(ctx, mergeID)
+	})
+	return wrap(err, "mongo.MergeUsers")
+}
@@ -0,0 +1,24 @@
+package mongo
+
+import (
+	"examples/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CreateEmailVerification implements Storer, stores an email verification. A User can only have one verification at a
+// time, so sending a new link stops any earlier one from working.
+func (db *DB) CreateEmailVerification(in *database.EmailVerification) error {
+	return wrap(db.replaceToken("emailverifications", tokenDoc{TokenHash: in.TokenHash, UserID: in.UserID, Expires: in.Expires}),
+		"mongo.CreateEmailVerification")
+}
+
+// VerifyEmail implements Storer, removes an email verification so its token can't be used again, and marks the User's
+// email as verified in the same transaction.
+func (db *DB) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	doc, err := db.useToken("emailverifications", tokenHash, bson.M{"$set": bson.M{"emailverified": true}})
+	if err != nil {
+		return database.EmailVerification{}, wrap(err, "mongo.VerifyEmail")
+	}
+	return database.EmailVerification{TokenHash: doc.TokenHash, UserID: doc.UserID, Expires: doc.Expires}, nil
+}
@@ -0,0 +1,151 @@
+// redis provides a Redis implementation of our SessionStorer interface, so sessions (and the refresh tokens they're
+// created from) can be kept apart from our Users, taking the busiest writes off our database. Combine it with the
+// Storer keeping everything else using database.WithSessions.
+//
+// Each session and refresh token is a JSON value under a key of its own, which Redis removes itself once it expires
+// (sessions a little after, see expiredGrace), so expired sessions never need clearing out. Renewing a session pushes
+// its key's expiry back with it. What Redis can't do for us is look sessions up by anything but their key, so we keep
+// sets of keys alongside (each User's sessions, each refresh token family's sessions and tokens) for the lookups our
+// Storer needs. Those sets expire once everything in them has, and anything in them that's already expired is simply
+// skipped.
+//
+// Redis should be set up to keep its data (appendonly yes), or everyone is logged out whenever it restarts.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"examples/errs"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// unavailableRetryAfter is how long we suggest callers wait before retrying when Redis can't be reached, the same as
+// our SQL Storer suggests.
+const unavailableRetryAfter = 5 * time.Second
+
+// operationTimeout bounds how long any one Storer method may take. Redis answers in well under a millisecond, so this
+// only matters when it's in trouble.
+const operationTimeout = 2 * time.Second
+
+// expiredGrace is how long a session's key outlives the session. A client using a session that has just expired is
+// then told so (and that refreshing may help), rather than that the session never existed.
+const expiredGrace = time.Hour
+
+// maxAttempts is how many times a change is tried before giving up, when other changes to the same keys keep beating
+// it (see watch).
+const maxAttempts = 3
+
+// Our Redis keys, all under one prefix so they can't collide with anything else kept in the same Redis (such as our
+// session cache or job queue).
+const (
+	prefix               = "sessionstore:"
+	seqKey               = prefix + "seq"             // The last session ID handed out
+	indexKey             = prefix + "sessions"        // Sorted set of every session's ID, scored by ID
+	sessionPrefix        = prefix + "session:"        // + session ID, the session itself
+	sessionTokenPrefix   = prefix + "sessiontoken:"   // + token hash (hex encoded), the ID of the session it belongs to
+	userPrefix           = prefix + "user:"           // + User ID, set of the User's session IDs
+	userFamiliesPrefix   = prefix + "userfamilies:"   // + User ID, set of the User's refresh token families
+	familySessionsPrefix = prefix + "familysessions:" // + family ID, set of IDs of sessions created from the family
+	familyTokensPrefix   = prefix + "familytokens:"   // + family ID, set of the family's token hashes (hex encoded)
+	tokenPrefix          = prefix + "refresh:"        // + token hash (hex encoded), the refresh token itself
+)
+
+// keepUntil makes a key last at least a given number of milliseconds, leaving it alone if it already lasts longer. Our
+// sets only need to last as long as the longest lived thing in them.
+var keepUntil = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -1 or ttl < tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// DB implements SessionStorer using Redis.
+type DB struct {
+	client *redis.Client
+}
+
+// New creates a SessionStorer keeping sessions in Redis, using a client that may be shared with the rest of our API.
+func New(client *redis.Client) *DB {
+	return &DB{client: client}
+}
+
+// Ping implements SessionStorer, checks that Redis can still be reached.
+func (db *DB) Ping() error {
+	ctx, cancel := db.context()
+	defer cancel()
+	if err := db.client.Ping(ctx).Err(); err != nil {
+		return &errs.Error{Code: errs.Unavailable, Op: "redis.Ping", Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	return nil
+}
+
+// context returns the context a Storer method runs its operations with, see operationTimeout.
+func (db *DB) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), operationTimeout)
+}
+
+// watch runs fn as an optimistic transaction on keys: fn reads what it needs, then writes its changes in a MULTI block,
+// which fails if any of keys changed in between. fn is then run again from the start, up to maxAttempts times.
+func (db *DB) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err = db.client.Watch(ctx, fn, keys...); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
+
+// extend adds a call to keepUntil to a pipeline, so key lasts until at least until.
+func extend(ctx context.Context, pipe redis.Pipeliner, key string, until time.Time) {
+	// Scripts can't be loaded part way through a pipeline, so the script is sent whole each time
+	keepUntil.Eval(ctx, pipe, []string{key}, ttlUntil(until).Milliseconds())
+}
+
+// ttlUntil returns how long a key should last so it expires at the given time. A time already passed gives the shortest
+// expiry Redis allows, as 0 would mean the key never expires.
+func ttlUntil(t time.Time) time.Duration {
+	return max(time.Until(t), time.Millisecond)
+}
+
+// id formats an ID as it's kept in our keys and sets.
+func id(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// decode reads a JSON value we stored.
+func decode[T any](b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// wrap attaches the failing operation to an error. Errors caused by being unable to reach Redis are marked as
+// Unavailable, so the caller gets a 503 status (and knows to try again) rather than a generic 500 status.
+func wrap(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if unavailable(err) {
+		return &errs.Error{Code: errs.Unavailable, Op: op, Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	return errs.Wrap(err, op)
+}
+
+// unavailable reports whether an error was caused by a problem reaching Redis, rather than by the operation itself.
+func unavailable(err error) bool {
+	if errors.Is(err, redis.ErrClosed) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Session and refresh token methods can be found in their respective files (session.go, refresh.go)
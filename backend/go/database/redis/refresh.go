@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"examples/database"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// refreshRecord is how a RefreshToken is kept, along with whether it's been used.
+type refreshRecord struct {
+	database.RefreshToken
+	Used bool
+}
+
+// tokenKey returns the key a refresh token is kept under.
+func tokenKey(tokenHash []byte) string {
+	return tokenPrefix + hex.EncodeToString(tokenHash)
+}
+
+// setToken adds storing a refresh token to a pipeline, expiring with the token, and records it in its family's and its
+// User's sets.
+func setToken(ctx context.Context, pipe redis.Pipeliner, record refreshRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	token := record.RefreshToken
+	pipe.Set(ctx, tokenKey(token.TokenHash), b, ttlUntil(token.Expires))
+	pipe.SAdd(ctx, familyTokensPrefix+token.FamilyID, hex.EncodeToString(token.TokenHash))
+	extend(ctx, pipe, familyTokensPrefix+token.FamilyID, token.Expires)
+	pipe.SAdd(ctx, userFamiliesPrefix+id(token.UserID), token.FamilyID)
+	extend(ctx, pipe, userFamiliesPrefix+id(token.UserID), token.Expires)
+	return nil
+}
+
+// CreateRefreshToken implements SessionStorer, stores a new unused refresh token.
+func (db *DB) CreateRefreshToken(in *database.RefreshToken) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	_, err := db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return setToken(ctx, pipe, refreshRecord{RefreshToken: *in})
+	})
+	return wrap(err, "redis.CreateRefreshToken")
+}
+
+// RotateRefreshToken implements SessionStorer, swapping a refresh token for its replacement. The old token is only
+// marked as used rather than deleted, so we can still recognise it (and catch whoever copied it) if it's presented
+// again. The old token is watched while it's swapped, so of two requests racing to rotate the same token, only one
+// succeeds and the other sees it already used.
+func (db *DB) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	key := tokenKey(oldHash)
+	var old, next database.RefreshToken
+	err := db.watch(ctx, func(tx *redis.Tx) error {
+		b, err := tx.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return database.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		record, err := decode[refreshRecord](b)
+		if err != nil {
+			return err
+		}
+		old = record.RefreshToken
+		if record.Used {
+			return database.ErrRefreshTokenReused
+		}
+
+		// The replacement expires with the rest of its family, rotating never extends how long a login lasts
+		next = old
+		next.TokenHash = newHash
+		record.Used = true
+		used, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, used, redis.SetArgs{KeepTTL: true})
+			return setToken(ctx, pipe, refreshRecord{RefreshToken: next})
+		})
+		return err
+	}, key)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		return old, wrap(err, "redis.RotateRefreshToken")
+	}
+	if err != nil {
+		return database.RefreshToken{}, wrap(err, "redis.RotateRefreshToken")
+	}
+	return next, nil
+}
+
+// RevokeRefreshFamily implements SessionStorer, deleting a refresh token family along with every session created from
+// it.
+func (db *DB) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	ids, err := db.client.SMembers(ctx, familySessionsPrefix+familyID).Result()
+	if err != nil {
+		return nil, wrap(err, "redis.RevokeRefreshFamily")
+	}
+	sessions, _, err := db.loadSessions(ctx, ids)
+	if err != nil {
+		return nil, wrap(err, "redis.RevokeRefreshFamily")
+	}
+	if err := db.removeSessions(ctx, sessions); err != nil {
+		return nil, wrap(err, "redis.RevokeRefreshFamily")
+	}
+	if err := db.removeFamilies(ctx, []string{familyID}); err != nil {
+		return nil, wrap(err, "redis.RevokeRefreshFamily")
+	}
+	return sessionIDs(sessions), nil
+}
+
+// removeFamilies deletes every token in the given refresh token families, along with the families' sets. A family's
+// sessions should be removed first (see removeSessions), as afterwards we no longer know which they were.
+func (db *DB) removeFamilies(ctx context.Context, families []string) error {
+	for _, familyID := range families {
+		hashes, err := db.client.SMembers(ctx, familyTokensPrefix+familyID).Result()
+		if err != nil {
+			return err
+		}
+		keys := []string{familyTokensPrefix + familyID, familySessionsPrefix + familyID}
+		for _, hash := range hashes {
+			keys = append(keys, tokenPrefix+hash)
+		}
+		if err := db.client.Del(ctx, keys...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
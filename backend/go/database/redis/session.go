@@ -0,0 +1,446 @@
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pageSize is how many sessions we read at a time when working through every session
+const pageSize = 500
+
+// sessionKey returns the key a session is kept under.
+func sessionKey(sessionID int64) string {
+	return sessionPrefix + id(sessionID)
+}
+
+// sessionTokenKey returns the key a session's ID is kept under, for looking it up by its token.
+func sessionTokenKey(tokenHash []byte) string {
+	return sessionTokenPrefix + hex.EncodeToString(tokenHash)
+}
+
+// unexpired reports whether a session is still valid. Our keys outlive their sessions a little (see expiredGrace), so
+// anything listing sessions skips the expired ones.
+func unexpired(session database.Session, now time.Time) bool {
+	return now.Before(session.Expires) && now.Before(session.EndOfLife)
+}
+
+// setSession adds storing a session to a pipeline, expiring with the session (plus expiredGrace).
+func setSession(ctx context.Context, pipe redis.Pipeliner, session database.Session) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, sessionKey(session.ID), b, ttlUntil(session.Expires.Add(expiredGrace)))
+	return nil
+}
+
+// SaveSession implements SessionStorer, stores a Session, and also updates the ID field with the ID that was handed out
+// for it.
+func (db *DB) SaveSession(in *database.Session) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	// A new session was last seen when it was created, from where it was created
+	if in.LastSeen.IsZero() {
+		in.LastSeen = in.Created
+	}
+	if in.LastIP == "" {
+		in.LastIP = in.IP
+	}
+	sessionID, err := db.client.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return wrap(err, "redis.SaveSession")
+	}
+	session := *in
+	session.ID = sessionID
+	_, err = db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := setSession(ctx, pipe, session); err != nil {
+			return err
+		}
+		pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(sessionID), Member: id(sessionID)})
+		// A session can be renewed up to its end of life, so that's how long its token and our sets need to remember it
+		pipe.Set(ctx, sessionTokenKey(session.TokenHash), id(sessionID), ttlUntil(session.EndOfLife.Add(expiredGrace)))
+		pipe.SAdd(ctx, userPrefix+id(session.UserID), id(sessionID))
+		extend(ctx, pipe, userPrefix+id(session.UserID), session.EndOfLife.Add(expiredGrace))
+		if session.RefreshFamily != "" {
+			pipe.SAdd(ctx, familySessionsPrefix+session.RefreshFamily, id(sessionID))
+			extend(ctx, pipe, familySessionsPrefix+session.RefreshFamily, session.EndOfLife.Add(expiredGrace))
+		}
+		return nil
+	})
+	if err != nil {
+		return wrap(err, "redis.SaveSession")
+	}
+	in.ID = sessionID
+	return nil
+}
+
+// LoadSession implements SessionStorer, retrieves a Session by ID.
+func (db *DB) LoadSession(sessionID int64) (database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	b, err := db.client.Get(ctx, sessionKey(sessionID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return database.Session{}, wrap(database.ErrNotFound, "redis.LoadSession")
+	}
+	if err != nil {
+		return database.Session{}, wrap(err, "redis.LoadSession")
+	}
+	session, err := decode[database.Session](b)
+	return session, wrap(err, "redis.LoadSession")
+}
+
+// LoadSessionByToken implements SessionStorer, retrieves a Session by the hash of its bearer token.
+func (db *DB) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	sessionID, err := db.client.Get(ctx, sessionTokenKey(tokenHash)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return database.Session{}, wrap(database.ErrNotFound, "redis.LoadSessionByToken")
+	}
+	if err != nil {
+		return database.Session{}, wrap(err, "redis.LoadSessionByToken")
+	}
+	return db.LoadSession(sessionID)
+}
+
+// loadSessions reads the sessions with the given IDs, in the same order. Sessions that no longer exist are left out,
+// and their IDs returned as missing.
+func (db *DB) loadSessions(ctx context.Context, ids []string) (sessions []database.Session, missing []string, err error) {
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, sessionID := range ids {
+		keys[i] = sessionPrefix + sessionID
+	}
+	values, err := db.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		session, err := decode[database.Session]([]byte(s))
+		if err != nil {
+			return nil, nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, missing, nil
+}
+
+// userSessions reads every session a User has, including expired ones we haven't removed yet.
+func (db *DB) userSessions(ctx context.Context, userID int64) ([]database.Session, error) {
+	ids, err := db.client.SMembers(ctx, userPrefix+id(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions, missing, err := db.loadSessions(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Forget sessions Redis has already removed. This is only tidying up, so failing to isn't an error.
+	if len(missing) > 0 {
+		db.client.SRem(ctx, userPrefix+id(userID), missing)
+	}
+	return sessions, nil
+}
+
+// ListSessionsByUser implements SessionStorer, retrieves every unexpired Session belonging to a User, newest first.
+func (db *DB) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	all, err := db.userSessions(ctx, userID)
+	if err != nil {
+		return nil, wrap(err, "redis.ListSessionsByUser")
+	}
+	now := time.Now()
+	var sessions []database.Session
+	for _, session := range all {
+		if unexpired(session, now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Created.Equal(sessions[j].Created) {
+			return sessions[i].Created.After(sessions[j].Created)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// removeSessions deletes sessions, along with every mention of them in our sets.
+func (db *DB) removeSessions(ctx context.Context, sessions []database.Session) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	_, err := db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, session := range sessions {
+			pipe.Del(ctx, sessionKey(session.ID), sessionTokenKey(session.TokenHash))
+			pipe.ZRem(ctx, indexKey, id(session.ID))
+			pipe.SRem(ctx, userPrefix+id(session.UserID), id(session.ID))
+			if session.RefreshFamily != "" {
+				pipe.SRem(ctx, familySessionsPrefix+session.RefreshFamily, id(session.ID))
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// sessionIDs returns the IDs of sessions.
+func sessionIDs(sessions []database.Session) []int64 {
+	ids := make([]int64, len(sessions))
+	for i, session := range sessions {
+		ids[i] = session.ID
+	}
+	return ids
+}
+
+// LogoutSession implements SessionStorer, deletes a Session by ID.
+func (db *DB) LogoutSession(sessionID int64) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	sessions, _, err := db.loadSessions(ctx, []string{id(sessionID)})
+	if err != nil {
+		return wrap(err, "redis.LogoutSession")
+	}
+	return wrap(db.removeSessions(ctx, sessions), "redis.LogoutSession")
+}
+
+// update changes a Session with fn, returning ErrNotFound if it doesn't exist. The session is watched while it's
+// changed, so a change made at the same time (such as logging it out) isn't undone.
+func (db *DB) update(ctx context.Context, sessionID int64, fn func(session *database.Session)) error {
+	key := sessionKey(sessionID)
+	return db.watch(ctx, func(tx *redis.Tx) error {
+		b, err := tx.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return database.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		session, err := decode[database.Session](b)
+		if err != nil {
+			return err
+		}
+		fn(&session)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return setSession(ctx, pipe, session)
+		})
+		return err
+	}, key)
+}
+
+// ExtendSession implements SessionStorer, updates a Session to have a new expiration, never past its end of life.
+func (db *DB) ExtendSession(sessionID int64, lifespan time.Duration) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	err := db.update(ctx, sessionID, func(session *database.Session) {
+		session.Expires = clock.Now().Add(lifespan)
+		if session.Expires.After(session.EndOfLife) {
+			session.Expires = session.EndOfLife
+		}
+	})
+	// Like our SQL Storer, extending a session that's gone isn't an error
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return wrap(err, "redis.ExtendSession")
+}
+
+// TouchSession implements SessionStorer, records when and where a Session was last used.
+func (db *DB) TouchSession(sessionID int64, seen time.Time, ip, userAgent string) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	err := db.update(ctx, sessionID, func(session *database.Session) {
+		session.LastSeen = seen
+		session.LastIP = ip
+		session.UserAgent = userAgent
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return wrap(err, "redis.TouchSession")
+}
+
+// UpdateSessionCreds implements SessionStorer, replaces a Session's encrypted credentials.
+func (db *DB) UpdateSessionCreds(sessionID int64, encryptedCreds []byte) error {
+	ctx, cancel := db.context()
+	defer cancel()
+	return wrap(db.update(ctx, sessionID, func(session *database.Session) {
+		session.EncryptedCreds = encryptedCreds
+	}), "redis.UpdateSessionCreds")
+}
+
+// pageAfter reads a page of up to limit sessions with IDs after afterID, in ID order, including expired ones we
+// haven't removed yet. Also returns the last ID looked at (afterID if there were none), to carry on from, and the IDs
+// of sessions Redis has already removed.
+func (db *DB) pageAfter(ctx context.Context, afterID int64, limit int) ([]database.Session, int64, []string, error) {
+	ids, err := db.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+		Min:   "(" + id(afterID),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, afterID, nil, err
+	}
+	sessions, missing, err := db.loadSessions(ctx, ids)
+	if err != nil {
+		return nil, afterID, nil, err
+	}
+	last, err := strconv.ParseInt(ids[len(ids)-1], 10, 64)
+	return sessions, last, missing, err
+}
+
+// ListSessionsAfter implements SessionStorer, retrieves a page of unexpired Sessions in ID order.
+func (db *DB) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	now := time.Now()
+	var sessions []database.Session
+	// Expired sessions are skipped, so keep reading until we've filled the page (or run out), as a short page would
+	// look like the last one
+	for len(sessions) < limit {
+		page, last, _, err := db.pageAfter(ctx, afterID, limit-len(sessions))
+		if err != nil {
+			return nil, wrap(err, "redis.ListSessionsAfter")
+		}
+		if last == afterID {
+			break
+		}
+		for _, session := range page {
+			if unexpired(session, now) {
+				sessions = append(sessions, session)
+			}
+		}
+		afterID = last
+	}
+	return sessions, nil
+}
+
+// ClearExpiredSessions implements SessionStorer, deletes any Sessions that are expired. Redis removes them itself soon
+// after (see expiredGrace), but calling this removes them straight away, and tidies away our record of sessions Redis
+// has already removed. Both are counted.
+func (db *DB) ClearExpiredSessions() (int, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	now := time.Now()
+	cleared := 0
+	var afterID int64
+	for {
+		page, last, missing, err := db.pageAfter(ctx, afterID, pageSize)
+		if err != nil {
+			return cleared, wrap(err, "redis.ClearExpiredSessions")
+		}
+		if last == afterID {
+			return cleared, nil
+		}
+		var expired []database.Session
+		for _, session := range page {
+			if !unexpired(session, now) {
+				expired = append(expired, session)
+			}
+		}
+		if err := db.removeSessions(ctx, expired); err != nil {
+			return cleared, wrap(err, "redis.ClearExpiredSessions")
+		}
+		if len(missing) > 0 {
+			if err := db.client.ZRem(ctx, indexKey, missing).Err(); err != nil {
+				return cleared, wrap(err, "redis.ClearExpiredSessions")
+			}
+		}
+		cleared += len(expired) + len(missing)
+		afterID = last
+	}
+}
+
+// RevokeSessions implements SessionStorer, deletes a batch of sessions matching a filter along with their refresh token
+// families. Redis can't search our sessions, so they're read through (only the listed Users' sessions, if the filter
+// names any) and the filter applied to each. Unlike our database, the sessions found aren't locked while they're
+// deleted, but a session created in the meantime would only be caught by the next batch.
+func (db *DB) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	var matched []database.Session
+	keep := func(sessions []database.Session) {
+		for _, session := range sessions {
+			if len(matched) < limit && filter.Matches(session) {
+				matched = append(matched, session)
+			}
+		}
+	}
+	if len(filter.UserIDs) > 0 {
+		for _, userID := range filter.UserIDs {
+			sessions, err := db.userSessions(ctx, userID)
+			if err != nil {
+				return nil, wrap(err, "redis.RevokeSessions")
+			}
+			keep(sessions)
+		}
+	} else {
+		var afterID int64
+		for len(matched) < limit {
+			page, last, _, err := db.pageAfter(ctx, afterID, pageSize)
+			if err != nil {
+				return nil, wrap(err, "redis.RevokeSessions")
+			}
+			if last == afterID {
+				break
+			}
+			keep(page)
+			afterID = last
+		}
+	}
+
+	var families []string
+	for _, session := range matched {
+		if session.RefreshFamily != "" {
+			families = append(families, session.RefreshFamily)
+		}
+	}
+	if err := db.removeSessions(ctx, matched); err != nil {
+		return nil, wrap(err, "redis.RevokeSessions")
+	}
+	if err := db.removeFamilies(ctx, families); err != nil {
+		return nil, wrap(err, "redis.RevokeSessions")
+	}
+	return sessionIDs(matched), nil
+}
+
+// DeleteUserSessions implements SessionStorer, deletes every session and refresh token belonging to a User.
+func (db *DB) DeleteUserSessions(userID int64) ([]int64, error) {
+	ctx, cancel := db.context()
+	defer cancel()
+	sessions, err := db.userSessions(ctx, userID)
+	if err != nil {
+		return nil, wrap(err, "redis.DeleteUserSessions")
+	}
+	if err := db.removeSessions(ctx, sessions); err != nil {
+		return nil, wrap(err, "redis.DeleteUserSessions")
+	}
+	families, err := db.client.SMembers(ctx, userFamiliesPrefix+id(userID)).Result()
+	if err != nil {
+		return nil, wrap(err, "redis.DeleteUserSessions")
+	}
+	if err := db.removeFamilies(ctx, families); err != nil {
+		return nil, wrap(err, "redis.DeleteUserSessions")
+	}
+	if err := db.client.Del(ctx, userPrefix+id(userID), userFamiliesPrefix+id(userID)).Err(); err != nil {
+		return nil, wrap(err, "redis.DeleteUserSessions")
+	}
+	return sessionIDs(sessions), nil
+}
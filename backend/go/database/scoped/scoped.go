@@ -0,0 +1,670 @@
+// scoped provides a Storer that only lets a viewer see and change the Users they're allowed to, based on dealership
+// membership. Users can only see themselves and other members of their dealerships, admins can see everyone.
+//
+// Enforcing this here rather than in each handler means a handler can't forget to check: every User record it loads
+// or changes goes through these filters. Any User the viewer isn't allowed to see is reported as not found, so we never
+// reveal that a User exists in another dealership.
+package scoped
+
+import (
+	"context"
+	"examples/database"
+	"time"
+)
+
+// Storer filters User access for a single viewer, then passes calls on to the wrapped Storer. Methods that don't
+// involve another User's record (sessions, audit entries, etc) are passed straight through.
+type Storer struct {
+	next   database.Storer
+	viewer int64 // ID of the User making requests, 0 means nobody (who can see no Users at all)
+	admin  bool  // Admins may see every User
+}
+
+// New wraps a Storer, limiting it to the Users the viewer is allowed to see.
+func New(next database.Storer, viewerID int64, admin bool) *Storer {
+	return &Storer{next: next, viewer: viewerID, admin: admin}
+}
+
+// visible reports whether the viewer is allowed to see the User with the given ID, returning our not found error if not.
+func (s *Storer) visible(userID int64) error {
+	if s.admin || (s.viewer != 0 && s.viewer == userID) {
+		return nil
+	}
+	if s.viewer == 0 {
+		return database.ErrNotFound
+	}
+	shares, err := s.next.SharesDealership(s.viewer, userID)
+	if err != nil {
+		return err
+	}
+	if !shares {
+		return database.ErrNotFound
+	}
+	return nil
+}
+
+// Health methods
+
+// Ping implements Storer.
+func (s *Storer) Ping() error {
+	return s.next.Ping()
+}
+
+// Transaction methods
+
+// WithTx implements Storer, limiting the transaction to the Users the viewer is allowed to see too.
+func (s *Storer) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	return s.next.WithTx(ctx, func(tx database.Storer) error {
+		return fn(New(tx, s.viewer, s.admin))
+	})
+}
+
+// Session methods
+
+// SaveSession implements Storer.
+func (s *Storer) SaveSession(in *database.Session) error {
+	return s.next.SaveSession(in)
+}
+
+// LoadSession implements Storer.
+func (s *Storer) LoadSession(id int64) (database.Session, error) {
+	return s.next.LoadSession(id)
+}
+
+// LoadSessionByToken implements Storer.
+func (s *Storer) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	return s.next.LoadSessionByToken(tokenHash)
+}
+
+// ListSessionsByUser implements Storer, only listing sessions of Users visible to the viewer.
+func (s *Storer) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	if err := s.visible(userID); err != nil {
+		return nil, err
+	}
+	return s.next.ListSessionsByUser(userID)
+}
+
+// LogoutSession implements Storer.
+func (s *Storer) LogoutSession(id int64) error {
+	return s.next.LogoutSession(id)
+}
+
+// ExtendSession implements Storer.
+func (s *Storer) ExtendSession(id int64, lifespan time.Duration) error {
+	return s.next.ExtendSession(id, lifespan)
+}
+
+// TouchSession implements Storer.
+func (s *Storer) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	return s.next.TouchSession(id, seen, ip, userAgent)
+}
+
+// ListSessionsAfter implements Storer, only for admins as it lists everyone's sessions.
+func (s *Storer) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListSessionsAfter(afterID, limit)
+}
+
+// UpdateSessionCreds implements Storer.
+func (s *Storer) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	return s.next.UpdateSessionCreds(id, encryptedCreds)
+}
+
+// ClearExpiredSessions implements Storer.
+func (s *Storer) ClearExpiredSessions() (int, error) {
+	return s.next.ClearExpiredSessions()
+}
+
+// RevokeSessions implements Storer, only available to admins, as a filter can match sessions belonging to any User.
+func (s *Storer) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.RevokeSessions(filter, limit)
+}
+
+// DeleteUserSessions implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) DeleteUserSessions(userID int64) ([]int64, error) {
+	if err := s.visible(userID); err != nil {
+		return nil, err
+	}
+	return s.next.DeleteUserSessions(userID)
+}
+
+// Refresh token methods
+
+// CreateRefreshToken implements Storer.
+func (s *Storer) CreateRefreshToken(in *database.RefreshToken) error {
+	return s.next.CreateRefreshToken(in)
+}
+
+// RotateRefreshToken implements Storer.
+func (s *Storer) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	return s.next.RotateRefreshToken(oldHash, newHash)
+}
+
+// RevokeRefreshFamily implements Storer.
+func (s *Storer) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	return s.next.RevokeRefreshFamily(familyID)
+}
+
+// User methods
+
+// CreateUser implements Storer.
+func (s *Storer) CreateUser(in *database.User) error {
+	return s.next.CreateUser(in)
+}
+
+// GetUserByID implements Storer, only returning Users visible to the viewer.
+func (s *Storer) GetUserByID(id int64) (database.User, error) {
+	if err := s.visible(id); err != nil {
+		return database.User{}, err
+	}
+	return s.next.GetUserByID(id)
+}
+
+// GetUserByEmail implements Storer, only returning Users visible to the viewer.
+func (s *Storer) GetUserByEmail(email string) (database.User, error) {
+	user, err := s.next.GetUserByEmail(email)
+	if err != nil {
+		return database.User{}, err
+	}
+	if err := s.visible(user.ID); err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByUsername implements Storer, only returning Users visible to the viewer.
+func (s *Storer) GetUserByUsername(username string) (database.User, error) {
+	user, err := s.next.GetUserByUsername(username)
+	if err != nil {
+		return database.User{}, err
+	}
+	if err := s.visible(user.ID); err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+// ChangeUsername implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) ChangeUsername(id int64, username string) error {
+	if err := s.visible(id); err != nil {
+		return err
+	}
+	return s.next.ChangeUsername(id, username)
+}
+
+// UsernameHistory implements Storer, only returning the history of Users visible to the viewer.
+func (s *Storer) UsernameHistory(id int64) ([]database.UsernameChange, error) {
+	if err := s.visible(id); err != nil {
+		return nil, err
+	}
+	return s.next.UsernameHistory(id)
+}
+
+// UsernameReserved implements Storer. It says nothing about who gave the username up, so is the same for every viewer.
+func (s *Storer) UsernameReserved(username string) (bool, error) {
+	return s.next.UsernameReserved(username)
+}
+
+// ListUsers implements Storer, only for admins as it lists every User.
+func (s *Storer) ListUsers(afterID int64, limit int) ([]database.User, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListUsers(afterID, limit)
+}
+
+// SearchUsers implements Storer, only listing Users visible to the viewer. Anyone but an admin searches within the
+// viewer's own scope, whatever scope they asked for, so the Storer below leaves out the Users they can't see before
+// cutting the results down to limit.
+func (s *Storer) SearchUsers(query string, scope database.UserScope, limit int) ([]database.User, error) {
+	if s.admin {
+		return s.next.SearchUsers(query, scope, limit)
+	}
+	if s.viewer == 0 {
+		return nil, nil
+	}
+	dealerships, err := s.next.ListUserDealerships(s.viewer)
+	if err != nil {
+		return nil, err
+	}
+	return s.next.SearchUsers(query, database.UserScope{ViewerID: s.viewer, Dealerships: dealerships}, limit)
+}
+
+// CountUsers implements Storer, only for admins as it counts every User.
+func (s *Storer) CountUsers() (int, error) {
+	if !s.admin {
+		return 0, database.ErrNotFound
+	}
+	return s.next.CountUsers()
+}
+
+// UpdateUser implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) UpdateUser(in *database.User) error {
+	if err := s.visible(in.ID); err != nil {
+		return err
+	}
+	return s.next.UpdateUser(in)
+}
+
+// SetUserEnabled implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) SetUserEnabled(id int64, enabled bool) error {
+	if err := s.visible(id); err != nil {
+		return err
+	}
+	return s.next.SetUserEnabled(id, enabled)
+}
+
+// SetUserRole implements Storer, only available to admins, so nobody can promote themselves.
+func (s *Storer) SetUserRole(id int64, role string) error {
+	if !s.admin {
+		return database.ErrNotFound
+	}
+	return s.next.SetUserRole(id, role)
+}
+
+// SetPasswordHash implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) SetPasswordHash(id int64, hash string) error {
+	if err := s.visible(id); err != nil {
+		return err
+	}
+	return s.next.SetPasswordHash(id, hash)
+}
+
+// RecordFailedLogin implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	if err := s.visible(id); err != nil {
+		return false, err
+	}
+	return s.next.RecordFailedLogin(id, lockAfter)
+}
+
+// UnlockUser implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) UnlockUser(id int64) error {
+	if err := s.visible(id); err != nil {
+		return err
+	}
+	return s.next.UnlockUser(id)
+}
+
+// DeleteUser implements Storer, only allowing Users visible to the viewer to be deleted.
+func (s *Storer) DeleteUser(id int64) error {
+	if err := s.visible(id); err != nil {
+		return err
+	}
+	return s.next.DeleteUser(id)
+}
+
+// SoftDeleteUser implements Storer, only allowing Users visible to the viewer to be deleted.
+func (s *Storer) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	if err := s.visible(id); err != nil {
+		return database.UserDeletion{}, err
+	}
+	return s.next.SoftDeleteUser(id)
+}
+
+// MergeUsers implements Storer, only allowing Users visible to the viewer to be merged.
+func (s *Storer) MergeUsers(keepID, mergeID int64) error {
+	if err := s.visible(keepID); err != nil {
+		return err
+	}
+	if err := s.visible(mergeID); err != nil {
+		return err
+	}
+	return s.next.MergeUsers(keepID, mergeID)
+}
+
+// OAuth identity methods
+
+// GetUserByIdentity implements Storer, only returning Users visible to the viewer.
+func (s *Storer) GetUserByIdentity(provider, subject string) (database.User, error) {
+	user, err := s.next.GetUserByIdentity(provider, subject)
+	if err != nil {
+		return database.User{}, err
+	}
+	if err := s.visible(user.ID); err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+// LinkIdentity implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) LinkIdentity(userID int64, provider, subject string) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.LinkIdentity(userID, provider, subject)
+}
+
+// Two-factor authentication methods
+
+// GetTwoFactor implements Storer, only returning the state of Users visible to the viewer.
+func (s *Storer) GetTwoFactor(userID int64) (database.TwoFactor, error) {
+	if err := s.visible(userID); err != nil {
+		return database.TwoFactor{}, err
+	}
+	return s.next.GetTwoFactor(userID)
+}
+
+// SaveTwoFactor implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) SaveTwoFactor(in *database.TwoFactor) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.SaveTwoFactor(in)
+}
+
+// EnableTwoFactor implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) EnableTwoFactor(userID int64, codeHashes [][]byte) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.EnableTwoFactor(userID, codeHashes)
+}
+
+// DeleteTwoFactor implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) DeleteTwoFactor(userID int64) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.DeleteTwoFactor(userID)
+}
+
+// UseTwoFactorStep implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) UseTwoFactorStep(userID int64, step int64) (bool, error) {
+	if err := s.visible(userID); err != nil {
+		return false, err
+	}
+	return s.next.UseTwoFactorStep(userID, step)
+}
+
+// UseRecoveryCode implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) UseRecoveryCode(userID int64, codeHash []byte) (bool, error) {
+	if err := s.visible(userID); err != nil {
+		return false, err
+	}
+	return s.next.UseRecoveryCode(userID, codeHash)
+}
+
+// User deletion methods
+
+// GetUserDeletion implements Storer, only returning the deletions of Users visible to the viewer. Once a User has been
+// deleted nobody can see them, so in practice only admins can check on a deletion.
+func (s *Storer) GetUserDeletion(userID int64) (database.UserDeletion, error) {
+	if err := s.visible(userID); err != nil {
+		return database.UserDeletion{}, err
+	}
+	return s.next.GetUserDeletion(userID)
+}
+
+// PendingUserDeletions implements Storer, only available to admins, as it lists deletions for every User.
+func (s *Storer) PendingUserDeletions(limit int) ([]database.UserDeletion, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.PendingUserDeletions(limit)
+}
+
+// SaveUserDeletion implements Storer, only allowing changes to the deletions of Users visible to the viewer.
+func (s *Storer) SaveUserDeletion(in *database.UserDeletion) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.SaveUserDeletion(in)
+}
+
+// Dealership methods
+
+// AddUserToDealership implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) AddUserToDealership(userID, dealershipID int64) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.AddUserToDealership(userID, dealershipID)
+}
+
+// RemoveUserFromDealership implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) RemoveUserFromDealership(userID, dealershipID int64) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.RemoveUserFromDealership(userID, dealershipID)
+}
+
+// SharesDealership implements Storer.
+func (s *Storer) SharesDealership(userID, otherID int64) (bool, error) {
+	return s.next.SharesDealership(userID, otherID)
+}
+
+// ListUserDealerships implements Storer, only listing memberships of Users visible to the viewer.
+func (s *Storer) ListUserDealerships(userID int64) ([]int64, error) {
+	if err := s.visible(userID); err != nil {
+		return nil, err
+	}
+	return s.next.ListUserDealerships(userID)
+}
+
+// RemoveUserMemberships implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) RemoveUserMemberships(userID int64) (int, error) {
+	if err := s.visible(userID); err != nil {
+		return 0, err
+	}
+	return s.next.RemoveUserMemberships(userID)
+}
+
+// Audit methods
+
+// CreateAuditEntry implements Storer.
+func (s *Storer) CreateAuditEntry(in *database.AuditEntry) error {
+	return s.next.CreateAuditEntry(in)
+}
+
+// PurgeAuditEntries implements Storer.
+func (s *Storer) PurgeAuditEntries(before time.Time, dryRun bool) (int, error) {
+	return s.next.PurgeAuditEntries(before, dryRun)
+}
+
+// AnonymizeAuditEntries implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) AnonymizeAuditEntries(userID int64) (int, error) {
+	if err := s.visible(userID); err != nil {
+		return 0, err
+	}
+	return s.next.AnonymizeAuditEntries(userID)
+}
+
+// Security event methods
+
+// CreateSecurityEvent implements Storer. Events are recorded by us about whatever happened, not by the viewer.
+func (s *Storer) CreateSecurityEvent(in *database.SecurityEvent) error {
+	return s.next.CreateSecurityEvent(in)
+}
+
+// ListSecurityEvents implements Storer, only admins can see security events.
+func (s *Storer) ListSecurityEvents(afterID int64, limit int) ([]database.SecurityEvent, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListSecurityEvents(afterID, limit)
+}
+
+// AppendDomainEvent implements Storer.
+func (s *Storer) AppendDomainEvent(in *database.DomainEvent) error {
+	return s.next.AppendDomainEvent(in)
+}
+
+// ListDomainEvents implements Storer, only admins can see domain events, as they describe every User.
+func (s *Storer) ListDomainEvents(afterSeq int64, limit int) ([]database.DomainEvent, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListDomainEvents(afterSeq, limit)
+}
+
+// Email change methods
+
+// CreateEmailChange implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) CreateEmailChange(in *database.EmailChange) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.CreateEmailChange(in)
+}
+
+// ConfirmEmailChange implements Storer. Confirming is done with a token rather than by a logged in viewer, so the
+// token itself is the permission.
+func (s *Storer) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	return s.next.ConfirmEmailChange(tokenHash)
+}
+
+// CreateMagicLink implements Storer, only allowing links for Users visible to the viewer.
+func (s *Storer) CreateMagicLink(in *database.MagicLink) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.CreateMagicLink(in)
+}
+
+// UseMagicLink implements Storer. Magic links are used by someone who isn't logged in yet, so the token itself is the
+// permission.
+func (s *Storer) UseMagicLink(tokenHash []byte) (database.MagicLink, error) {
+	return s.next.UseMagicLink(tokenHash)
+}
+
+// CreatePasswordReset implements Storer, only allowing resets for Users visible to the viewer.
+func (s *Storer) CreatePasswordReset(in *database.PasswordReset) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.CreatePasswordReset(in)
+}
+
+// UsePasswordReset implements Storer. Resets are used by someone who can't log in, so the token itself is the
+// permission.
+func (s *Storer) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	return s.next.UsePasswordReset(tokenHash, passwordHash)
+}
+
+// CreateEmailVerification implements Storer, only allowing verifications for Users visible to the viewer.
+func (s *Storer) CreateEmailVerification(in *database.EmailVerification) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.CreateEmailVerification(in)
+}
+
+// VerifyEmail implements Storer. Verifying is done by following a link from an email, so the token itself is the
+// permission.
+func (s *Storer) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	return s.next.VerifyEmail(tokenHash)
+}
+
+// CreateInvite implements Storer, only admins can invite people.
+func (s *Storer) CreateInvite(in *database.Invite) error {
+	if !s.admin {
+		return database.ErrNotFound
+	}
+	return s.next.CreateInvite(in)
+}
+
+// ListInvites implements Storer, only admins can see invites.
+func (s *Storer) ListInvites() ([]database.Invite, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListInvites()
+}
+
+// DeleteInvite implements Storer, only admins can revoke invites.
+func (s *Storer) DeleteInvite(id int64) error {
+	if !s.admin {
+		return database.ErrNotFound
+	}
+	return s.next.DeleteInvite(id)
+}
+
+// UseInvite implements Storer. Invites are used by someone who doesn't have an account yet, so the token itself is the
+// permission.
+func (s *Storer) UseInvite(tokenHash []byte, user *database.User) (database.Invite, error) {
+	return s.next.UseInvite(tokenHash, user)
+}
+
+// PurgeEmailChanges implements Storer.
+func (s *Storer) PurgeEmailChanges(before time.Time, dryRun bool) (int, error) {
+	return s.next.PurgeEmailChanges(before, dryRun)
+}
+
+// API token methods
+
+// CreateAPIToken implements Storer, only allowing tokens for Users visible to the viewer.
+func (s *Storer) CreateAPIToken(in *database.APIToken) error {
+	if err := s.visible(in.UserID); err != nil {
+		return err
+	}
+	return s.next.CreateAPIToken(in)
+}
+
+// ListAPITokens implements Storer, only listing tokens of Users visible to the viewer.
+func (s *Storer) ListAPITokens(userID int64) ([]database.APIToken, error) {
+	if err := s.visible(userID); err != nil {
+		return nil, err
+	}
+	return s.next.ListAPITokens(userID)
+}
+
+// GetAPIToken implements Storer. Tokens are looked up before anyone is logged in (the token is how they log in), so
+// the token itself is the permission.
+func (s *Storer) GetAPIToken(tokenHash []byte) (database.APIToken, error) {
+	return s.next.GetAPIToken(tokenHash)
+}
+
+// TouchAPIToken implements Storer.
+func (s *Storer) TouchAPIToken(id int64, used time.Time) error {
+	return s.next.TouchAPIToken(id, used)
+}
+
+// DeleteAPIToken implements Storer, only allowing changes to Users visible to the viewer.
+func (s *Storer) DeleteAPIToken(userID, id int64) error {
+	if err := s.visible(userID); err != nil {
+		return err
+	}
+	return s.next.DeleteAPIToken(userID, id)
+}
+
+// Tenant settings methods
+
+// GetTenantSettings implements Storer, only available to admins, as tenant settings are managed by us rather than by
+// the tenants themselves.
+func (s *Storer) GetTenantSettings(tenantID int64) (database.TenantSettings, error) {
+	if !s.admin {
+		return database.TenantSettings{}, database.ErrNotFound
+	}
+	return s.next.GetTenantSettings(tenantID)
+}
+
+// ListTenantSettings implements Storer, only available to admins.
+func (s *Storer) ListTenantSettings() ([]database.TenantSettings, error) {
+	if !s.admin {
+		return nil, database.ErrNotFound
+	}
+	return s.next.ListTenantSettings()
+}
+
+// SaveTenantSettings implements Storer, only available to admins.
+func (s *Storer) SaveTenantSettings(in *database.TenantSettings) error {
+	if !s.admin {
+		return database.ErrNotFound
+	}
+	return s.next.SaveTenantSettings(in)
+}
+
+// DeleteTenantSettings implements Storer, only available to admins.
+func (s *Storer) DeleteTenantSettings(tenantID int64) error {
+	if !s.admin {
+		return database.ErrNotFound
+	}
+	return s.next.DeleteTenantSettings(tenantID)
+}
@@ -0,0 +1,251 @@
+// sessioncache puts a fast shared cache (Redis) in front of our session lookups. Every authenticated request loads its
+// session, so when our API runs in several regions against a database in just one of them, each request would pay a
+// cross-region round trip. With a Redis replica in each region, most of those lookups never leave the region.
+//
+// Our database remains the source of truth. Sessions are written to the database first and then cached, and anything
+// that changes or removes a session (logging out, renewing it) drops it from the cache, so the next lookup reads the
+// current state from the database. If Redis is slow or down, we simply fall back to the database.
+package sessioncache
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"examples/database"
+	"examples/metrics"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cacheTimeout is how long we'll wait on Redis before giving up and asking the database instead. Redis should answer in
+// well under a millisecond, anything slower than this means it's struggling.
+const cacheTimeout = 100 * time.Millisecond
+
+// Storer caches sessions in Redis, passing every other method straight through to the wrapped Storer.
+type Storer struct {
+	database.Storer
+	client *redis.Client
+	maxTTL time.Duration // Longest a session is cached for, even if it's valid for longer
+	tx     *txSessions   // Set on the Storer handed to a WithTx callback
+}
+
+// txSessions tracks the sessions a transaction changed, see WithTx.
+type txSessions struct {
+	forgotten []int64
+}
+
+// New wraps a Storer, caching sessions in Redis for up to maxTTL. A shorter maxTTL limits how long the cache can hold a
+// session whose removal it missed (say, if Redis was unreachable when the session was logged out).
+func New(next database.Storer, client *redis.Client, maxTTL time.Duration) *Storer {
+	return &Storer{Storer: next, client: client, maxTTL: maxTTL}
+}
+
+// key returns the Redis key a session is cached under.
+func key(id int64) string {
+	return "session:" + strconv.FormatInt(id, 10)
+}
+
+// tokenKey returns the Redis key the ID of the session a token belongs to is cached under.
+func tokenKey(tokenHash []byte) string {
+	return "sessiontoken:" + hex.EncodeToString(tokenHash)
+}
+
+// WithTx implements Storer. Sessions changed in the transaction are dropped from the cache as they're changed, and
+// again once it's over, in case a lookup outside the transaction cached them again before it committed. Sessions saved
+// in the transaction aren't cached, as the transaction may yet be rolled back.
+func (s *Storer) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	tx := &txSessions{}
+	err := s.Storer.WithTx(ctx, func(inner database.Storer) error {
+		return fn(&Storer{Storer: inner, client: s.client, maxTTL: s.maxTTL, tx: tx})
+	})
+	for _, id := range tx.forgotten {
+		s.forget(id)
+	}
+	return err
+}
+
+// SaveSession implements Storer, saving the session to the database then caching it.
+func (s *Storer) SaveSession(in *database.Session) error {
+	if err := s.Storer.SaveSession(in); err != nil {
+		return err
+	}
+	s.store(*in)
+	return nil
+}
+
+// LoadSession implements Storer, reading the session from the cache if it's there, or from the database (and caching
+// it) if not.
+func (s *Storer) LoadSession(id int64) (database.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	b, err := s.client.Get(ctx, key(id)).Bytes()
+	if err == nil {
+		var session database.Session
+		if err := json.Unmarshal(b, &session); err == nil {
+			metrics.ObserveCache("session", "hit")
+			return session, nil
+		}
+	}
+	if err != nil && !errors.Is(err, redis.Nil) {
+		metrics.ObserveCache("session", "error")
+	} else {
+		metrics.ObserveCache("session", "miss")
+	}
+
+	session, err := s.Storer.LoadSession(id)
+	if err != nil {
+		return database.Session{}, err
+	}
+	s.store(session)
+	return session, nil
+}
+
+// LoadSessionByToken implements Storer, finding which session the token belongs to from the cache if it's there, then
+// loading it as LoadSession does. A token only ever belongs to one session, so which one is never dropped from the
+// cache, once a session is logged out it simply isn't found.
+func (s *Storer) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	id, err := s.client.Get(ctx, tokenKey(tokenHash)).Int64()
+	if err == nil {
+		return s.LoadSession(id)
+	}
+	if !errors.Is(err, redis.Nil) {
+		metrics.ObserveCache("session", "error")
+	} else {
+		metrics.ObserveCache("session", "miss")
+	}
+
+	session, err := s.Storer.LoadSessionByToken(tokenHash)
+	if err != nil {
+		return database.Session{}, err
+	}
+	s.store(session)
+	return session, nil
+}
+
+// LogoutSession implements Storer, deleting the session from the database then dropping it from the cache.
+func (s *Storer) LogoutSession(id int64) error {
+	if err := s.Storer.LogoutSession(id); err != nil {
+		return err
+	}
+	s.forget(id)
+	return nil
+}
+
+// ExtendSession implements Storer, extending the session in the database then dropping it from the cache, so the next
+// lookup picks up its new expiration.
+func (s *Storer) ExtendSession(id int64, lifespan time.Duration) error {
+	if err := s.Storer.ExtendSession(id, lifespan); err != nil {
+		return err
+	}
+	s.forget(id)
+	return nil
+}
+
+// TouchSession implements Storer, updating the session in the database then dropping it from the cache, so the next
+// lookup picks up where it was last seen.
+func (s *Storer) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	if err := s.Storer.TouchSession(id, seen, ip, userAgent); err != nil {
+		return err
+	}
+	s.forget(id)
+	return nil
+}
+
+// UpdateSessionCreds implements Storer, updating the session in the database then dropping it from the cache, so the
+// next lookup picks up its new credentials.
+func (s *Storer) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	if err := s.Storer.UpdateSessionCreds(id, encryptedCreds); err != nil {
+		return err
+	}
+	s.forget(id)
+	return nil
+}
+
+// RevokeRefreshFamily implements Storer, revoking the family in the database then dropping every session it deleted
+// from the cache, so a revoked session stops working immediately rather than once its cache entry expires.
+func (s *Storer) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	ids, err := s.Storer.RevokeRefreshFamily(familyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.forget(id)
+	}
+	return ids, nil
+}
+
+// RevokeSessions implements Storer, revoking the sessions in the database then dropping them from the cache.
+func (s *Storer) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	ids, err := s.Storer.RevokeSessions(filter, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.forget(id)
+	}
+	return ids, nil
+}
+
+// DeleteUserSessions implements Storer, deleting the User's sessions in the database then dropping them from the cache.
+func (s *Storer) DeleteUserSessions(userID int64) ([]int64, error) {
+	ids, err := s.Storer.DeleteUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.forget(id)
+	}
+	return ids, nil
+}
+
+// Note that deleting a User also deletes their sessions from the database, without dropping them from the cache. That's
+// safe, as our auth middleware loads the User on every request and rejects sessions whose User no longer exists, and
+// the cached sessions expire on their own shortly after.
+
+// store caches a session, and which session its token belongs to, until it expires or for maxTTL if that's sooner.
+// Failing to cache a session isn't an error, the next lookup will just go to the database.
+func (s *Storer) store(session database.Session) {
+	if s.tx != nil {
+		return
+	}
+	ttl := time.Until(session.Expires)
+	if ttl > s.maxTTL {
+		ttl = s.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key(session.ID), b, ttl)
+		if len(session.TokenHash) > 0 {
+			pipe.Set(ctx, tokenKey(session.TokenHash), session.ID, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.ObserveCache("session", "error")
+	}
+}
+
+// forget drops a session from the cache.
+func (s *Storer) forget(id int64) {
+	if s.tx != nil {
+		s.tx.forgotten = append(s.tx.forgotten, id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := s.client.Del(ctx, key(id)).Err(); err != nil {
+		metrics.ObserveCache("session", "error")
+	}
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// splitStorer keeps sessions in a SessionStorer of their own, and everything else in a Storer, see WithSessions.
+type splitStorer struct {
+	Storer
+	sessions SessionStorer
+}
+
+// WithSessions combines a Storer with a SessionStorer, keeping sessions (and refresh tokens) in sessions and everything
+// else in users. Whatever users has for keeping sessions goes unused. A User's sessions are still removed along with
+// them: deleting a User, or merging them into another, deletes their sessions from sessions too.
+func WithSessions(users Storer, sessions SessionStorer) Storer {
+	return &splitStorer{Storer: users, sessions: sessions}
+}
+
+// Ping implements Storer, checking both our Users and our sessions can be reached.
+func (s *splitStorer) Ping() error {
+	return errors.Join(s.Storer.Ping(), s.sessions.Ping())
+}
+
+// DeleteUser implements Storer, deleting the User then their sessions, which their deletion can't reach.
+func (s *splitStorer) DeleteUser(id int64) error {
+	if err := s.Storer.DeleteUser(id); err != nil {
+		return err
+	}
+	_, err := s.sessions.DeleteUserSessions(id)
+	return err
+}
+
+// MergeUsers implements Storer, merging the Users then deleting the merged User's sessions, as MergeUsers would have.
+func (s *splitStorer) MergeUsers(keepID, mergeID int64) error {
+	if err := s.Storer.MergeUsers(keepID, mergeID); err != nil {
+		return err
+	}
+	_, err := s.sessions.DeleteUserSessions(mergeID)
+	return err
+}
+
+// SaveSession implements Storer.
+func (s *splitStorer) SaveSession(in *Session) error {
+	return s.sessions.SaveSession(in)
+}
+
+// LoadSession implements Storer.
+func (s *splitStorer) LoadSession(id int64) (Session, error) {
+	return s.sessions.LoadSession(id)
+}
+
+// LoadSessionByToken implements Storer.
+func (s *splitStorer) LoadSessionByToken(tokenHash []byte) (Session, error) {
+	return s.sessions.LoadSessionByToken(tokenHash)
+}
+
+// ListSessionsByUser implements Storer.
+func (s *splitStorer) ListSessionsByUser(userID int64) ([]Session, error) {
+	return s.sessions.ListSessionsByUser(userID)
+}
+
+// LogoutSession implements Storer.
+func (s *splitStorer) LogoutSession(id int64) error {
+	return s.sessions.LogoutSession(id)
+}
+
+// ExtendSession implements Storer.
+func (s *splitStorer) ExtendSession(id int64, lifespan time.Duration) error {
+	return s.sessions.ExtendSession(id, lifespan)
+}
+
+// TouchSession implements Storer.
+func (s *splitStorer) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	return s.sessions.TouchSession(id, seen, ip, userAgent)
+}
+
+// ListSessionsAfter implements Storer.
+func (s *splitStorer) ListSessionsAfter(afterID int64, limit int) ([]Session, error) {
+	return s.sessions.ListSessionsAfter(afterID, limit)
+}
+
+// UpdateSessionCreds implements Storer.
+func (s *splitStorer) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	return s.sessions.UpdateSessionCreds(id, encryptedCreds)
+}
+
+// ClearExpiredSessions implements Storer.
+func (s *splitStorer) ClearExpiredSessions() (int, error) {
+	return s.sessions.ClearExpiredSessions()
+}
+
+// RevokeSessions implements Storer.
+func (s *splitStorer) RevokeSessions(filter SessionFilter, limit int) ([]int64, error) {
+	return s.sessions.RevokeSessions(filter, limit)
+}
+
+// DeleteUserSessions implements Storer.
+func (s *splitStorer) DeleteUserSessions(userID int64) ([]int64, error) {
+	return s.sessions.DeleteUserSessions(userID)
+}
+
+// CreateRefreshToken implements Storer.
+func (s *splitStorer) CreateRefreshToken(in *RefreshToken) error {
+	return s.sessions.CreateRefreshToken(in)
+}
+
+// RotateRefreshToken implements Storer.
+func (s *splitStorer) RotateRefreshToken(oldHash, newHash []byte) (RefreshToken, error) {
+	return s.sessions.RotateRefreshToken(oldHash, newHash)
+}
+
+// RevokeRefreshFamily implements Storer.
+func (s *splitStorer) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	return s.sessions.RevokeRefreshFamily(familyID)
+}
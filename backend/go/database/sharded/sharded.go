@@ -0,0 +1,773 @@
+// sharded provides a Storer that spreads our Users across several databases (shards), each holding a share of the
+// Users along with everything belonging to them (sessions, refresh tokens, two-factor, dealership memberships, pending
+// email changes, etc). This shows how our Storer interface lets us scale out without any handler noticing: they still
+// see a single Storer.
+//
+// Every record is found from its ID. Each shard hands out IDs from its own residue class (shard i of N only ever hands
+// out IDs where ID % N == i, see sql.DB.PrepareShard), so the ID alone says which shard holds a User, or a session. New
+// Users are placed by hashing their email, so Users are spread evenly and the same email always lands on the same
+// shard (where its unique constraint catches a race between two signups).
+//
+// Anything that isn't tied to a single User (the audit log, security events, domain events) lives on shard 0, the home
+// shard, so it can still be listed in order. Lookups by something other than ID (email, username, a token) ask each
+// shard in turn, and listings ask every shard at once and merge what they say.
+//
+// Some things only a single database can promise are weaker here:
+//   - Usernames and emails are only unique within a shard by constraint, across shards we check before writing, which
+//     leaves a small window for two Users to claim the same one at once.
+//   - Users on different shards can't be merged, as that can't be done in a single transaction.
+//   - WithTx holds a transaction open on every shard, and commits them one after another, so if one shard fails to
+//     commit after another has, the transaction is only partly kept. Nothing is kept if fn fails.
+//   - The number of shards is fixed once Users have been created, as it decides where they live. Adding a shard means
+//     moving Users to where their ID now says they belong, which is left to a dedicated rebalancing tool.
+package sharded
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storer routes each call to the shard that holds the records involved. See the package docs.
+type Storer struct {
+	shards []database.Storer
+}
+
+// New creates a Storer spreading Users across the given shards, in order, so shards[i] must be the database prepared as
+// shard i. The first shard is our home shard, holding everything that isn't tied to a single User.
+func New(shards []database.Storer) *Storer {
+	return &Storer{shards: shards}
+}
+
+// home returns the shard holding everything that isn't tied to a single User.
+func (s *Storer) home() database.Storer {
+	return s.shards[0]
+}
+
+// shardFor returns the shard holding the record with the given ID (a User, a session, or an invite).
+func (s *Storer) shardFor(id int64) database.Storer {
+	return s.shards[uint64(id)%uint64(len(s.shards))]
+}
+
+// shardForEmail returns the shard a new User with the given email is created on.
+func (s *Storer) shardForEmail(email string) database.Storer {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(email)))
+	return s.shards[h.Sum64()%uint64(len(s.shards))]
+}
+
+// each calls fn on every shard at once, returning what each said in shard order, or the first error (again in shard
+// order) if any failed.
+func each[T any](shards []database.Storer, fn func(database.Storer) (T, error)) ([]T, error) {
+	results := make([]T, len(shards))
+	failures := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard database.Storer) {
+			defer wg.Done()
+			results[i], failures[i] = fn(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range failures {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// find asks each shard in turn until one finds what we're looking for, returning our not found error if none do. This
+// is sequential rather than asking every shard at once, as some lookups use up what they find (a token), and must only
+// do so on the shard that has it.
+func find[T any](shards []database.Storer, fn func(database.Storer) (T, error)) (T, error) {
+	for _, shard := range shards {
+		found, err := fn(shard)
+		if errors.Is(err, errs.NotFound) {
+			continue
+		}
+		return found, err
+	}
+	var none T
+	return none, database.ErrNotFound
+}
+
+// concat joins what each shard listed into a single list.
+func concat[T any](lists [][]T) []T {
+	var all []T
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// sum adds up a count from every shard, such as how many rows a cleanup removed.
+func sum(counts []int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// Ping implements Storer, checking every shard is reachable.
+func (s *Storer) Ping() error {
+	_, err := each(s.shards, func(shard database.Storer) (struct{}, error) {
+		return struct{}{}, shard.Ping()
+	})
+	return err
+}
+
+// WithTx implements Storer, running fn with a Storer routing each call to its shard's part of the transaction. We can't
+// know up front which shards fn needs, so every shard has a transaction started for it (see the package docs for what
+// that promises).
+func (s *Storer) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	return s.withTx(ctx, nil, fn)
+}
+
+// withTx starts a transaction on the next shard after those already joined, then on the rest in turn, running fn once
+// every shard has one. Each transaction is committed once everything after it is done, so the last shard commits first.
+func (s *Storer) withTx(ctx context.Context, joined []database.Storer, fn func(database.Storer) error) error {
+	if len(joined) == len(s.shards) {
+		return fn(New(joined))
+	}
+	return s.shards[len(joined)].WithTx(ctx, func(tx database.Storer) error {
+		// Clipped, as a retried transaction (see database.Storer) mustn't share what the first attempt appended
+		return s.withTx(ctx, append(slices.Clip(joined), tx), fn)
+	})
+}
+
+// SaveSession implements Storer, a session lives alongside its User, so is given an ID on their shard.
+func (s *Storer) SaveSession(in *database.Session) error {
+	return s.shardFor(in.UserID).SaveSession(in)
+}
+
+// LoadSession implements Storer.
+func (s *Storer) LoadSession(id int64) (database.Session, error) {
+	return s.shardFor(id).LoadSession(id)
+}
+
+// LoadSessionByToken implements Storer, asking each shard in turn.
+func (s *Storer) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	return find(s.shards, func(shard database.Storer) (database.Session, error) {
+		return shard.LoadSessionByToken(tokenHash)
+	})
+}
+
+// ListSessionsByUser implements Storer.
+func (s *Storer) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	return s.shardFor(userID).ListSessionsByUser(userID)
+}
+
+// LogoutSession implements Storer.
+func (s *Storer) LogoutSession(id int64) error {
+	return s.shardFor(id).LogoutSession(id)
+}
+
+// ExtendSession implements Storer.
+func (s *Storer) ExtendSession(id int64, lifespan time.Duration) error {
+	return s.shardFor(id).ExtendSession(id, lifespan)
+}
+
+// TouchSession implements Storer.
+func (s *Storer) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	return s.shardFor(id).TouchSession(id, seen, ip, userAgent)
+}
+
+// ListSessionsAfter implements Storer, listing a page from every shard and keeping the lowest IDs. Each shard's page is
+// already in ID order, so this is the same page a single database would have listed.
+func (s *Storer) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	pages, err := each(s.shards, func(shard database.Storer) ([]database.Session, error) {
+		return shard.ListSessionsAfter(afterID, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessions := concat(pages)
+	slices.SortFunc(sessions, func(a, b database.Session) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+// UpdateSessionCreds implements Storer.
+func (s *Storer) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	return s.shardFor(id).UpdateSessionCreds(id, encryptedCreds)
+}
+
+// ClearExpiredSessions implements Storer, clearing them from every shard.
+func (s *Storer) ClearExpiredSessions() (int, error) {
+	counts, err := each(s.shards, func(shard database.Storer) (int, error) {
+		return shard.ClearExpiredSessions()
+	})
+	return sum(counts), err
+}
+
+// RevokeSessions implements Storer, revoking from one shard after another until we've revoked a full batch, so a batch
+// is never larger than it would be with a single database.
+func (s *Storer) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	var revoked []int64
+	for _, shard := range s.shards {
+		if len(revoked) >= limit {
+			break
+		}
+		ids, err := shard.RevokeSessions(filter, limit-len(revoked))
+		revoked = append(revoked, ids...)
+		if err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// DeleteUserSessions implements Storer.
+func (s *Storer) DeleteUserSessions(userID int64) ([]int64, error) {
+	return s.shardFor(userID).DeleteUserSessions(userID)
+}
+
+// CreateRefreshToken implements Storer, a refresh token lives alongside its User.
+func (s *Storer) CreateRefreshToken(in *database.RefreshToken) error {
+	return s.shardFor(in.UserID).CreateRefreshToken(in)
+}
+
+// RotateRefreshToken implements Storer.
+func (s *Storer) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	return find(s.shards, func(shard database.Storer) (database.RefreshToken, error) {
+		return shard.RotateRefreshToken(oldHash, newHash)
+	})
+}
+
+// RevokeRefreshFamily implements Storer. A family only ever belongs to one User, but all we have is its ID, so every
+// shard is asked to revoke it.
+func (s *Storer) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	revoked, err := each(s.shards, func(shard database.Storer) ([]int64, error) {
+		return shard.RevokeRefreshFamily(familyID)
+	})
+	return concat(revoked), err
+}
+
+// CreateUser implements Storer, creating the User on the shard their email hashes to. That shard's constraints catch
+// an email or username already in use there, the others are checked first.
+func (s *Storer) CreateUser(in *database.User) error {
+	shard := s.shardForEmail(in.Email)
+	if err := s.checkAvailable(shard, in.Email, in.Username); err != nil {
+		return err
+	}
+	return shard.CreateUser(in)
+}
+
+// checkAvailable checks no shard apart from skip already has a User with the given email or username, or has a User who
+// gave the username up (either may be empty, to skip checking it). skip checks its own Users as it saves them.
+func (s *Storer) checkAvailable(skip database.Storer, email, username string) error {
+	for _, shard := range s.shards {
+		if shard == skip {
+			continue
+		}
+		if email != "" {
+			if _, err := shard.GetUserByEmail(email); err == nil {
+				return database.ErrEmailTaken
+			} else if !errors.Is(err, errs.NotFound) {
+				return err
+			}
+		}
+		if username != "" {
+			if _, err := shard.GetUserByUsername(username); err == nil {
+				return database.ErrUsernameTaken
+			} else if !errors.Is(err, errs.NotFound) {
+				return err
+			}
+			if reserved, err := shard.UsernameReserved(username); err != nil {
+				return err
+			} else if reserved {
+				return database.ErrUsernameTaken
+			}
+		}
+	}
+	return nil
+}
+
+// GetUserByID implements Storer.
+func (s *Storer) GetUserByID(id int64) (database.User, error) {
+	return s.shardFor(id).GetUserByID(id)
+}
+
+// GetUserByEmail implements Storer. The shard the email hashes to is the most likely to have them, so we ask it first,
+// but a User who has changed their email since signing up stays where they were created.
+func (s *Storer) GetUserByEmail(email string) (database.User, error) {
+	likely := s.shardForEmail(email)
+	user, err := likely.GetUserByEmail(email)
+	if !errors.Is(err, errs.NotFound) {
+		return user, err
+	}
+	return find(s.shards, func(shard database.Storer) (database.User, error) {
+		if shard == likely {
+			return database.User{}, database.ErrNotFound
+		}
+		return shard.GetUserByEmail(email)
+	})
+}
+
+// GetUserByUsername implements Storer.
+func (s *Storer) GetUserByUsername(username string) (database.User, error) {
+	return find(s.shards, func(shard database.Storer) (database.User, error) {
+		return shard.GetUserByUsername(username)
+	})
+}
+
+// ChangeUsername implements Storer, checking the username isn't in use on another shard first.
+func (s *Storer) ChangeUsername(id int64, username string) error {
+	shard := s.shardFor(id)
+	if err := s.checkAvailable(shard, "", username); err != nil {
+		return err
+	}
+	return shard.ChangeUsername(id, username)
+}
+
+// UsernameHistory implements Storer.
+func (s *Storer) UsernameHistory(id int64) ([]database.UsernameChange, error) {
+	return s.shardFor(id).UsernameHistory(id)
+}
+
+// UsernameReserved implements Storer, checking every shard as the User who gave it up may be on any of them.
+func (s *Storer) UsernameReserved(username string) (bool, error) {
+	for _, shard := range s.shards {
+		if reserved, err := shard.UsernameReserved(username); reserved || err != nil {
+			return reserved, err
+		}
+	}
+	return false, nil
+}
+
+// SetUserEnabled implements Storer.
+func (s *Storer) SetUserEnabled(id int64, enabled bool) error {
+	return s.shardFor(id).SetUserEnabled(id, enabled)
+}
+
+// ListUsers implements Storer, listing a page from every shard and keeping the lowest IDs, just as ListSessionsAfter
+// does.
+func (s *Storer) ListUsers(afterID int64, limit int) ([]database.User, error) {
+	pages, err := each(s.shards, func(shard database.Storer) ([]database.User, error) {
+		return shard.ListUsers(afterID, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := concat(pages)
+	slices.SortFunc(users, func(a, b database.User) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// SearchUsers implements Storer, searching every shard and keeping the best matches, prefix matches first then the
+// lowest IDs, just as each shard orders them. The scope lists the viewer's dealerships rather than leaving each shard
+// to look them up, as memberships are kept alongside their User, so most shards wouldn't have the viewer's.
+func (s *Storer) SearchUsers(query string, scope database.UserScope, limit int) ([]database.User, error) {
+	found, err := each(s.shards, func(shard database.Storer) ([]database.User, error) {
+		return shard.SearchUsers(query, scope, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := concat(found)
+	slices.SortFunc(users, func(a, b database.User) int {
+		_, aPrefix := a.SearchMatch(query)
+		_, bPrefix := b.SearchMatch(query)
+		if aPrefix != bPrefix {
+			if aPrefix {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// CountUsers implements Storer, counting them on every shard.
+func (s *Storer) CountUsers() (int, error) {
+	counts, err := each(s.shards, func(shard database.Storer) (int, error) {
+		return shard.CountUsers()
+	})
+	return sum(counts), err
+}
+
+// UpdateUser implements Storer.
+func (s *Storer) UpdateUser(in *database.User) error {
+	return s.shardFor(in.ID).UpdateUser(in)
+}
+
+// SetUserRole implements Storer.
+func (s *Storer) SetUserRole(id int64, role string) error {
+	return s.shardFor(id).SetUserRole(id, role)
+}
+
+// SetPasswordHash implements Storer.
+func (s *Storer) SetPasswordHash(id int64, hash string) error {
+	return s.shardFor(id).SetPasswordHash(id, hash)
+}
+
+// RecordFailedLogin implements Storer.
+func (s *Storer) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	return s.shardFor(id).RecordFailedLogin(id, lockAfter)
+}
+
+// UnlockUser implements Storer.
+func (s *Storer) UnlockUser(id int64) error {
+	return s.shardFor(id).UnlockUser(id)
+}
+
+// DeleteUser implements Storer.
+func (s *Storer) DeleteUser(id int64) error {
+	return s.shardFor(id).DeleteUser(id)
+}
+
+// SoftDeleteUser implements Storer.
+func (s *Storer) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	return s.shardFor(id).SoftDeleteUser(id)
+}
+
+// MergeUsers implements Storer. Merging moves everything one User owns to the other in a single transaction, which
+// can't span two databases, so only Users on the same shard can be merged.
+func (s *Storer) MergeUsers(keepID, mergeID int64) error {
+	shard := s.shardFor(keepID)
+	if shard != s.shardFor(mergeID) {
+		return errs.New(errs.Conflict, "these users are kept in different databases, so can't be merged")
+	}
+	return shard.MergeUsers(keepID, mergeID)
+}
+
+// GetUserByIdentity implements Storer.
+func (s *Storer) GetUserByIdentity(provider, subject string) (database.User, error) {
+	return find(s.shards, func(shard database.Storer) (database.User, error) {
+		return shard.GetUserByIdentity(provider, subject)
+	})
+}
+
+// LinkIdentity implements Storer, checking the identity isn't linked to a User on another shard first.
+func (s *Storer) LinkIdentity(userID int64, provider, subject string) error {
+	shard := s.shardFor(userID)
+	for _, other := range s.shards {
+		if other == shard {
+			continue
+		}
+		if _, err := other.GetUserByIdentity(provider, subject); err == nil {
+			return database.ErrIdentityLinked
+		} else if !errors.Is(err, errs.NotFound) {
+			return err
+		}
+	}
+	return shard.LinkIdentity(userID, provider, subject)
+}
+
+// GetTwoFactor implements Storer.
+func (s *Storer) GetTwoFactor(userID int64) (database.TwoFactor, error) {
+	return s.shardFor(userID).GetTwoFactor(userID)
+}
+
+// SaveTwoFactor implements Storer.
+func (s *Storer) SaveTwoFactor(in *database.TwoFactor) error {
+	return s.shardFor(in.UserID).SaveTwoFactor(in)
+}
+
+// EnableTwoFactor implements Storer.
+func (s *Storer) EnableTwoFactor(userID int64, codeHashes [][]byte) error {
+	return s.shardFor(userID).EnableTwoFactor(userID, codeHashes)
+}
+
+// DeleteTwoFactor implements Storer.
+func (s *Storer) DeleteTwoFactor(userID int64) error {
+	return s.shardFor(userID).DeleteTwoFactor(userID)
+}
+
+// UseTwoFactorStep implements Storer.
+func (s *Storer) UseTwoFactorStep(userID int64, step int64) (bool, error) {
+	return s.shardFor(userID).UseTwoFactorStep(userID, step)
+}
+
+// UseRecoveryCode implements Storer.
+func (s *Storer) UseRecoveryCode(userID int64, codeHash []byte) (bool, error) {
+	return s.shardFor(userID).UseRecoveryCode(userID, codeHash)
+}
+
+// GetUserDeletion implements Storer.
+func (s *Storer) GetUserDeletion(userID int64) (database.UserDeletion, error) {
+	return s.shardFor(userID).GetUserDeletion(userID)
+}
+
+// PendingUserDeletions implements Storer, listing from every shard and keeping the oldest.
+func (s *Storer) PendingUserDeletions(limit int) ([]database.UserDeletion, error) {
+	pages, err := each(s.shards, func(shard database.Storer) ([]database.UserDeletion, error) {
+		return shard.PendingUserDeletions(limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	deletions := concat(pages)
+	slices.SortStableFunc(deletions, func(a, b database.UserDeletion) int {
+		return a.Requested.Compare(b.Requested)
+	})
+	if len(deletions) > limit {
+		deletions = deletions[:limit]
+	}
+	return deletions, nil
+}
+
+// SaveUserDeletion implements Storer.
+func (s *Storer) SaveUserDeletion(in *database.UserDeletion) error {
+	return s.shardFor(in.UserID).SaveUserDeletion(in)
+}
+
+// AddUserToDealership implements Storer. Dealerships themselves aren't stored by us, so a membership is just kept
+// alongside its User.
+func (s *Storer) AddUserToDealership(userID, dealershipID int64) error {
+	return s.shardFor(userID).AddUserToDealership(userID, dealershipID)
+}
+
+// RemoveUserFromDealership implements Storer.
+func (s *Storer) RemoveUserFromDealership(userID, dealershipID int64) error {
+	return s.shardFor(userID).RemoveUserFromDealership(userID, dealershipID)
+}
+
+// SharesDealership implements Storer. Two Users on the same shard are checked there, otherwise we compare their lists.
+func (s *Storer) SharesDealership(userID, otherID int64) (bool, error) {
+	shard := s.shardFor(userID)
+	if shard == s.shardFor(otherID) {
+		return shard.SharesDealership(userID, otherID)
+	}
+	mine, err := shard.ListUserDealerships(userID)
+	if err != nil {
+		return false, err
+	}
+	theirs, err := s.shardFor(otherID).ListUserDealerships(otherID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range mine {
+		if slices.Contains(theirs, id) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListUserDealerships implements Storer.
+func (s *Storer) ListUserDealerships(userID int64) ([]int64, error) {
+	return s.shardFor(userID).ListUserDealerships(userID)
+}
+
+// RemoveUserMemberships implements Storer.
+func (s *Storer) RemoveUserMemberships(userID int64) (int, error) {
+	return s.shardFor(userID).RemoveUserMemberships(userID)
+}
+
+// CreateAuditEntry implements Storer, the audit log is kept on our home shard.
+func (s *Storer) CreateAuditEntry(in *database.AuditEntry) error {
+	return s.home().CreateAuditEntry(in)
+}
+
+// PurgeAuditEntries implements Storer.
+func (s *Storer) PurgeAuditEntries(before time.Time, dryRun bool) (int, error) {
+	return s.home().PurgeAuditEntries(before, dryRun)
+}
+
+// AnonymizeAuditEntries implements Storer.
+func (s *Storer) AnonymizeAuditEntries(userID int64) (int, error) {
+	return s.home().AnonymizeAuditEntries(userID)
+}
+
+// CreateSecurityEvent implements Storer, security events are kept on our home shard.
+func (s *Storer) CreateSecurityEvent(in *database.SecurityEvent) error {
+	return s.home().CreateSecurityEvent(in)
+}
+
+// ListSecurityEvents implements Storer.
+func (s *Storer) ListSecurityEvents(afterID int64, limit int) ([]database.SecurityEvent, error) {
+	return s.home().ListSecurityEvents(afterID, limit)
+}
+
+// AppendDomainEvent implements Storer, domain events are kept on our home shard, so they have a single order.
+func (s *Storer) AppendDomainEvent(in *database.DomainEvent) error {
+	return s.home().AppendDomainEvent(in)
+}
+
+// ListDomainEvents implements Storer.
+func (s *Storer) ListDomainEvents(afterSeq int64, limit int) ([]database.DomainEvent, error) {
+	return s.home().ListDomainEvents(afterSeq, limit)
+}
+
+// CreateEmailChange implements Storer, a pending change is kept alongside its User, so confirming it can update them
+// in the same transaction.
+func (s *Storer) CreateEmailChange(in *database.EmailChange) error {
+	if err := s.checkAvailable(s.shardFor(in.UserID), in.NewEmail, ""); err != nil {
+		return err
+	}
+	return s.shardFor(in.UserID).CreateEmailChange(in)
+}
+
+// ConfirmEmailChange implements Storer.
+func (s *Storer) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	return find(s.shards, func(shard database.Storer) (database.EmailChange, error) {
+		return shard.ConfirmEmailChange(tokenHash)
+	})
+}
+
+// PurgeEmailChanges implements Storer, purging them from every shard.
+func (s *Storer) PurgeEmailChanges(before time.Time, dryRun bool) (int, error) {
+	counts, err := each(s.shards, func(shard database.Storer) (int, error) {
+		return shard.PurgeEmailChanges(before, dryRun)
+	})
+	return sum(counts), err
+}
+
+// CreateMagicLink implements Storer.
+func (s *Storer) CreateMagicLink(in *database.MagicLink) error {
+	return s.shardFor(in.UserID).CreateMagicLink(in)
+}
+
+// UseMagicLink implements Storer.
+func (s *Storer) UseMagicLink(tokenHash []byte) (database.MagicLink, error) {
+	return find(s.shards, func(shard database.Storer) (database.MagicLink, error) {
+		return shard.UseMagicLink(tokenHash)
+	})
+}
+
+// CreatePasswordReset implements Storer.
+func (s *Storer) CreatePasswordReset(in *database.PasswordReset) error {
+	return s.shardFor(in.UserID).CreatePasswordReset(in)
+}
+
+// UsePasswordReset implements Storer.
+func (s *Storer) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	return find(s.shards, func(shard database.Storer) (database.PasswordReset, error) {
+		return shard.UsePasswordReset(tokenHash, passwordHash)
+	})
+}
+
+// CreateEmailVerification implements Storer.
+func (s *Storer) CreateEmailVerification(in *database.EmailVerification) error {
+	return s.shardFor(in.UserID).CreateEmailVerification(in)
+}
+
+// VerifyEmail implements Storer.
+func (s *Storer) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	return find(s.shards, func(shard database.Storer) (database.EmailVerification, error) {
+		return shard.VerifyEmail(tokenHash)
+	})
+}
+
+// CreateInvite implements Storer. An invite refers to the admin who sent it, so is kept alongside them, and whoever
+// accepts it is created there too. Inviting an email again only replaces an earlier invite sent from the same shard,
+// so we revoke any others first.
+func (s *Storer) CreateInvite(in *database.Invite) error {
+	shard := s.shardFor(in.InvitedBy)
+	invites, err := s.ListInvites()
+	if err != nil {
+		return err
+	}
+	for _, invite := range invites {
+		if strings.EqualFold(invite.Email, in.Email) && s.shardFor(invite.ID) != shard {
+			if err := s.DeleteInvite(invite.ID); err != nil && !errors.Is(err, errs.NotFound) {
+				return err
+			}
+		}
+	}
+	return shard.CreateInvite(in)
+}
+
+// ListInvites implements Storer, listing from every shard, newest first.
+func (s *Storer) ListInvites() ([]database.Invite, error) {
+	lists, err := each(s.shards, func(shard database.Storer) ([]database.Invite, error) {
+		return shard.ListInvites()
+	})
+	if err != nil {
+		return nil, err
+	}
+	invites := concat(lists)
+	slices.SortFunc(invites, func(a, b database.Invite) int {
+		if c := b.Created.Compare(a.Created); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return invites, nil
+}
+
+// DeleteInvite implements Storer.
+func (s *Storer) DeleteInvite(id int64) error {
+	return s.shardFor(id).DeleteInvite(id)
+}
+
+// UseInvite implements Storer, creating the new User on the shard the invite was kept on.
+func (s *Storer) UseInvite(tokenHash []byte, user *database.User) (database.Invite, error) {
+	if err := s.checkAvailable(nil, "", user.Username); err != nil {
+		return database.Invite{}, err
+	}
+	return find(s.shards, func(shard database.Storer) (database.Invite, error) {
+		return shard.UseInvite(tokenHash, user)
+	})
+}
+
+// CreateAPIToken implements Storer, a token lives alongside its User, so is given an ID on their shard.
+func (s *Storer) CreateAPIToken(in *database.APIToken) error {
+	return s.shardFor(in.UserID).CreateAPIToken(in)
+}
+
+// ListAPITokens implements Storer.
+func (s *Storer) ListAPITokens(userID int64) ([]database.APIToken, error) {
+	return s.shardFor(userID).ListAPITokens(userID)
+}
+
+// GetAPIToken implements Storer, asking each shard in turn.
+func (s *Storer) GetAPIToken(tokenHash []byte) (database.APIToken, error) {
+	return find(s.shards, func(shard database.Storer) (database.APIToken, error) {
+		return shard.GetAPIToken(tokenHash)
+	})
+}
+
+// TouchAPIToken implements Storer.
+func (s *Storer) TouchAPIToken(id int64, used time.Time) error {
+	return s.shardFor(id).TouchAPIToken(id, used)
+}
+
+// DeleteAPIToken implements Storer.
+func (s *Storer) DeleteAPIToken(userID, id int64) error {
+	return s.shardFor(userID).DeleteAPIToken(userID, id)
+}
+
+// GetTenantSettings implements Storer, tenant settings are kept on our home shard.
+func (s *Storer) GetTenantSettings(tenantID int64) (database.TenantSettings, error) {
+	return s.home().GetTenantSettings(tenantID)
+}
+
+// ListTenantSettings implements Storer.
+func (s *Storer) ListTenantSettings() ([]database.TenantSettings, error) {
+	return s.home().ListTenantSettings()
+}
+
+// SaveTenantSettings implements Storer.
+func (s *Storer) SaveTenantSettings(in *database.TenantSettings) error {
+	return s.home().SaveTenantSettings(in)
+}
+
+// DeleteTenantSettings implements Storer.
+func (s *Storer) DeleteTenantSettings(tenantID int64) error {
+	return s.home().DeleteTenantSettings(tenantID)
+}
@@ -0,0 +1,557 @@
+package sql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"examples/database"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Made up names for anonymized Users, combined at random
+var (
+	fakeFirstNames = []string{
+		"Ava", "Ben", "Chloe", "Daniel", "Ella", "Finn", "Grace", "Harry", "Isla", "Jack", "Kate", "Leo", "Mia", "Noah",
+		"Olivia", "Priya", "Quinn", "Ruby", "Sam", "Tara", "Uma", "Victor", "Willow", "Xavier", "Yara", "Zach",
+	}
+	fakeLastNames = []string{
+		"Adams", "Brown", "Clarke", "Davies", "Evans", "Fisher", "Green", "Hughes", "Iqbal", "Jones", "Khan", "Lewis",
+		"Martin", "Nguyen", "Owen", "Patel", "Reid", "Smith", "Taylor", "Walker", "Wilson", "Young",
+	}
+)
+
+// Personal data found in free text, such as audit entry details
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	ipv4Pattern   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	quotedPattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+)
+
+// Anonymizer replaces the personal data in a copy of our database (names, emails, usernames, IP addresses, OAuth
+// accounts) with made up data, so a production snapshot can seed a staging environment. Each distinct value is always
+// replaced by the same made up value, in every table and in every database anonymized by the same Anonymizer (such as
+// each of our shards), so whatever matched before still matches: a User's email and their pending email change, the
+// usernames in a User's history, a session's IP address and the security events from it.
+//
+// Along the way anything that would let production credentials work against the copy is made useless: password
+// hashes are replaced (with the hash of a staging password, or none at all), token hashes are scrambled, recovery codes
+// and queued jobs (emails to real addresses among them) are removed. Sessions and 2FA secrets are encrypted with our production
+// keys, so stay unreadable as long as staging has keys of its own.
+type Anonymizer struct {
+	rng          *rand.Rand
+	passwordHash string // Given to every User, empty for none
+	seq          int    // Numbers made up values, keeping them unique
+
+	names     map[int64][2]string // First and last name, by User ID
+	emails    map[string]string   // By lower cased email
+	usernames map[string]string
+	ips       map[string]string
+	subjects  map[string]string // By provider and subject, separated by a space
+}
+
+// AnonymizeReport says how much an Anonymizer changed in a database.
+type AnonymizeReport struct {
+	Users          int // Users renamed
+	AuditEntries   int // Audit entries whose IP address or detail was rewritten
+	SecurityEvents int // Security events whose IP address or detail was rewritten, and their chain rehashed
+	DomainEvents   int // Domain events whose data was rewritten
+	Jobs           int // Queued jobs removed
+}
+
+// NewAnonymizer creates an Anonymizer making up data with the given seed, giving every User passwordHash (which may be
+// empty, leaving Users without a password).
+func NewAnonymizer(seed int64, passwordHash string) *Anonymizer {
+	return &Anonymizer{
+		rng:          rand.New(rand.NewSource(seed)),
+		passwordHash: passwordHash,
+		names:        make(map[int64][2]string),
+		emails:       make(map[string]string),
+		usernames:    make(map[string]string),
+		ips:          make(map[string]string),
+		subjects:     make(map[string]string),
+	}
+}
+
+// Anonymize rewrites the personal data in db, in a single transaction, so it's anonymized entirely or not at all.
+// NEVER run this against anything but a copy, there's no undoing it.
+func (a *Anonymizer) Anonymize(db *DB) (AnonymizeReport, error) {
+	var report AnonymizeReport
+	tx, err := db.pool.Begin()
+	if err != nil {
+		return report, wrap(err, "sql.Anonymize")
+	}
+	defer tx.Rollback()
+	steps := []func(*sql.Tx, *AnonymizeReport) error{
+		a.collect, a.rewriteColumns, a.rewriteAuditLog, a.rewriteSecurityEvents, a.rewriteDomainEvents, a.revokeCredentials,
+	}
+	for _, step := range steps {
+		if err := step(tx, &report); err != nil {
+			return report, wrap(err, "sql.Anonymize")
+		}
+	}
+	return report, wrap(tx.Commit(), "sql.Anonymize")
+}
+
+// CurrentDatabase returns the name of the database we're connected to, so tools can confirm they've been pointed at the
+// one they meant to be.
+func (db *DB) CurrentDatabase() (string, error) {
+	var name string
+	err := db.storage.QueryRow(`SELECT current_database()`).Scan(&name)
+	return name, wrap(err, "sql.CurrentDatabase")
+}
+
+// collect makes up a replacement for every personal value in the database's columns, and loads them into temporary
+// tables for rewriteColumns to join against.
+func (a *Anonymizer) collect(tx *sql.Tx, _ *AnonymizeReport) error {
+	type user struct {
+		id                    int64
+		first, last, email    string
+		username              sql.NullString
+		newEmail, newUsername string
+	}
+	rows, err := tx.Query(`SELECT id, email, username FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.email, &u.username); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Users first, so their emails and usernames are made up from their made up names where we can
+	for i := range users {
+		u := &users[i]
+		u.first, u.last = a.name()
+		a.names[u.id] = [2]string{u.first, u.last}
+		u.newEmail = a.email(u.email, u.first, u.last)
+		if u.username.Valid {
+			u.newUsername = a.username(u.username.String, u.first, u.last)
+		}
+	}
+
+	columns := []struct {
+		query string
+		anon  func(string) string
+	}{
+		{`SELECT oldemail FROM emailchanges UNION SELECT newemail FROM emailchanges UNION SELECT email FROM invites`,
+			func(v string) string { return a.email(v, "", "") }},
+		{`SELECT oldusername FROM usernamehistory UNION SELECT newusername FROM usernamehistory`,
+			func(v string) string { return a.username(v, "", "") }},
+		{`SELECT ip FROM sessions UNION SELECT lastip FROM sessions UNION SELECT ip FROM auditlog UNION SELECT ip FROM securityevents`,
+			a.ip},
+		{`SELECT provider || ' ' || subject FROM oauthidentities`, a.subject},
+	}
+	for _, column := range columns {
+		values, err := distinct(tx, column.query)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if v != "" {
+				column.anon(v)
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`CREATE TEMPORARY TABLE anonymizedusers (
+    id       INTEGER PRIMARY KEY,
+    first    TEXT    NOT NULL,
+    last     TEXT    NOT NULL,
+    email    TEXT    NOT NULL,
+    username TEXT
+) ON COMMIT DROP`); err != nil {
+		return err
+	}
+	err = copyRows(tx, "anonymizedusers", []string{"id", "first", "last", "email", "username"}, len(users), func(i int) []any {
+		u := users[i]
+		var username any
+		if u.username.Valid {
+			username = u.newUsername
+		}
+		return []any{u.id, u.first, u.last, u.newEmail, username}
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`CREATE TEMPORARY TABLE anonymized (
+    kind TEXT NOT NULL,
+    old  TEXT NOT NULL,
+    new  TEXT NOT NULL,
+    PRIMARY KEY (kind, old)
+) ON COMMIT DROP`); err != nil {
+		return err
+	}
+	var mappings [][3]string
+	for kind, values := range map[string]map[string]string{"email": a.emails, "username": a.usernames, "ip": a.ips, "subject": a.subjects} {
+		for old, new := range values {
+			mappings = append(mappings, [3]string{kind, old, new})
+		}
+	}
+	return copyRows(tx, "anonymized", []string{"kind", "old", "new"}, len(mappings), func(i int) []any {
+		return []any{mappings[i][0], mappings[i][1], mappings[i][2]}
+	})
+}
+
+// rewriteColumns replaces every personal value held in a column of its own with what collect made up for it.
+func (a *Anonymizer) rewriteColumns(tx *sql.Tx, report *AnonymizeReport) error {
+	// Usernames and emails are unique, so clear them first, in case a made up one matches one we haven't replaced yet.
+	// Emails can't be NULL, so each User's ID stands in for theirs until then.
+	if _, err := tx.Exec(`UPDATE users SET username = NULL, email = id::text`); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`UPDATE users SET first = a.first, last = a.last, email = a.email, username = a.username, passwordhash = $1
+		FROM anonymizedusers a WHERE users.id = a.id`, a.passwordHash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	report.Users = int(n)
+
+	for _, stmt := range []string{
+		`UPDATE usernamehistory SET oldusername = m.new FROM anonymized m WHERE m.kind = 'username' AND m.old = oldusername`,
+		`UPDATE usernamehistory SET newusername = m.new FROM anonymized m WHERE m.kind = 'username' AND m.old = newusername`,
+		`UPDATE emailchanges SET oldemail = m.new FROM anonymized m WHERE m.kind = 'email' AND m.old = lower(oldemail)`,
+		`UPDATE emailchanges SET newemail = m.new FROM anonymized m WHERE m.kind = 'email' AND m.old = lower(newemail)`,
+		`UPDATE invites SET email = m.new FROM anonymized m WHERE m.kind = 'email' AND m.old = lower(email)`,
+		`UPDATE sessions SET ip = m.new FROM anonymized m WHERE m.kind = 'ip' AND m.old = ip`,
+		`UPDATE sessions SET lastip = m.new FROM anonymized m WHERE m.kind = 'ip' AND m.old = lastip`,
+		`UPDATE oauthidentities SET subject = m.new FROM anonymized m WHERE m.kind = 'subject' AND m.old = provider || ' ' || subject`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteAuditLog replaces the IP address of every audit entry, and any personal data in its detail.
+func (a *Anonymizer) rewriteAuditLog(tx *sql.Tx, report *AnonymizeReport) error {
+	type entry struct {
+		id         int64
+		ip, detail string
+	}
+	rows, err := tx.Query(`SELECT id, ip, detail FROM auditlog WHERE ip <> '' OR detail <> '' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var changed []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.ip, &e.detail); err != nil {
+			rows.Close()
+			return err
+		}
+		ip, detail := a.ip(e.ip), a.scrub(e.detail)
+		if ip != e.ip || detail != e.detail {
+			changed = append(changed, entry{e.id, ip, detail})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range changed {
+		if _, err := tx.Exec(`UPDATE auditlog SET ip = $2, detail = $3 WHERE id = $1`, e.id, e.ip, e.detail); err != nil {
+			return err
+		}
+	}
+	report.AuditEntries = len(changed)
+	return nil
+}
+
+// rewriteSecurityEvents replaces the IP address of every security event, and any personal data in its detail. Events
+// are append-only, so their trigger is disabled while they're rewritten, and the hash chain is worked out again from
+// the first event so it still verifies.
+func (a *Anonymizer) rewriteSecurityEvents(tx *sql.Tx, report *AnonymizeReport) error {
+	rows, err := tx.Query(`SELECT id, time, kind, userid, ip, detail, prevhash, hash FROM securityevents ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var events []database.SecurityEvent
+	for rows.Next() {
+		var e database.SecurityEvent
+		if err := rows.Scan(&e.ID, &e.Time, &e.Kind, &e.UserID, &e.IP, &e.Detail, &e.PrevHash, &e.Hash); err != nil {
+			rows.Close()
+			return err
+		}
+		// Read as ListSecurityEvents reads them, so the time is hashed just as it was
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(`ALTER TABLE securityevents DISABLE TRIGGER securityevents_append_only`); err != nil {
+		return err
+	}
+	prev := events[0].PrevHash
+	for _, e := range events {
+		e.IP = a.ip(e.IP)
+		e.Detail = a.scrub(e.Detail)
+		e.PrevHash = prev
+		e.Hash = e.ChainHash(prev)
+		prev = e.Hash
+		if _, err := tx.Exec(`UPDATE securityevents SET ip = $2, detail = $3, prevhash = $4, hash = $5 WHERE id = $1`,
+			e.ID, e.IP, e.Detail, e.PrevHash, e.Hash); err != nil {
+			return err
+		}
+	}
+	report.SecurityEvents = len(events)
+	_, err = tx.Exec(`ALTER TABLE securityevents ENABLE TRIGGER securityevents_append_only`)
+	return err
+}
+
+// rewriteDomainEvents replaces the personal data in each domain event's data, such as the Users carried by user.*
+// events.
+func (a *Anonymizer) rewriteDomainEvents(tx *sql.Tx, report *AnonymizeReport) error {
+	type event struct {
+		seq  int64
+		data []byte
+	}
+	rows, err := tx.Query(`SELECT seq, userid, data FROM domainevents ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	var changed []event
+	for rows.Next() {
+		var (
+			e      event
+			userID int64
+			data   any
+		)
+		if err := rows.Scan(&e.seq, &userID, &e.data); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal(e.data, &data); err != nil {
+			rows.Close()
+			return fmt.Errorf("domain event %d: %w", e.seq, err)
+		}
+		anonymized, err := json.Marshal(a.scrubJSON(data, userID))
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if string(anonymized) != string(e.data) {
+			changed = append(changed, event{e.seq, anonymized})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range changed {
+		if _, err := tx.Exec(`UPDATE domainevents SET data = $2 WHERE seq = $1`, e.seq, e.data); err != nil {
+			return err
+		}
+	}
+	report.DomainEvents = len(changed)
+	return nil
+}
+
+// revokeCredentials makes sure nothing issued in production works against the copy. Token hashes are scrambled (they
+// stay unique, as each includes the hash it replaces) rather than removed, so everything referring to them survives.
+func (a *Anonymizer) revokeCredentials(tx *sql.Tx, report *AnonymizeReport) error {
+	tables := []string{
+		"sessions", "refreshtokens", "magiclinks", "passwordresets", "emailverifications", "emailchanges", "invites", "apitokens",
+	}
+	for _, table := range tables {
+		if _, err := tx.Exec(`UPDATE ` + table + ` SET tokenhash = sha256(convert_to(random()::text || encode(tokenhash, 'hex'), 'UTF8'))`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM recoverycodes`); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM jobs`)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	report.Jobs = int(n)
+	return err
+}
+
+// name makes up a first and last name.
+func (a *Anonymizer) name() (string, string) {
+	return fakeFirstNames[a.rng.Intn(len(fakeFirstNames))], fakeLastNames[a.rng.Intn(len(fakeLastNames))]
+}
+
+// next returns the next number for a made up value.
+func (a *Anonymizer) next() int {
+	a.seq++
+	return a.seq
+}
+
+// email returns the made up replacement for an email, making one up from first and last (or made up names, if they're
+// empty) the first time it's seen. Emails are matched case insensitively, as our lookups are.
+func (a *Anonymizer) email(old, first, last string) string {
+	key := strings.ToLower(old)
+	if fake, ok := a.emails[key]; ok {
+		return fake
+	}
+	if first == "" {
+		first, last = a.name()
+	}
+	fake := fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), a.next())
+	a.emails[key] = fake
+	return fake
+}
+
+// username returns the made up replacement for a username, making one up as email does.
+func (a *Anonymizer) username(old, first, last string) string {
+	if fake, ok := a.usernames[old]; ok {
+		return fake
+	}
+	if first == "" {
+		first, last = a.name()
+	}
+	fake := fmt.Sprintf("%s%s%d", strings.ToLower(first), strings.ToLower(last[:1]), a.next())
+	a.usernames[old] = fake
+	return fake
+}
+
+// ip returns the made up replacement for an IP address (or anything else in an IP address column), from the private
+// 10.0.0.0/8 range so it can't be anyone's real address. Empty stays empty.
+func (a *Anonymizer) ip(old string) string {
+	if old == "" {
+		return ""
+	}
+	if fake, ok := a.ips[old]; ok {
+		return fake
+	}
+	n := len(a.ips) + 1
+	fake := fmt.Sprintf("10.%d.%d.%d", n>>16&0xff, n>>8&0xff, n&0xff)
+	a.ips[old] = fake
+	return fake
+}
+
+// subject returns the made up replacement for an OAuth identity, given as its provider and subject separated by a
+// space, returning the made up subject.
+func (a *Anonymizer) subject(old string) string {
+	if fake, ok := a.subjects[old]; ok {
+		return fake
+	}
+	fake := "anonymized-" + strconv.Itoa(a.next())
+	a.subjects[old] = fake
+	return fake
+}
+
+// scrub replaces the personal data we can recognise in free text: emails, IPv4 addresses (along with any CIDR prefix
+// length, which is kept), and quoted usernames we've replaced elsewhere (as audit entries quote them).
+func (a *Anonymizer) scrub(text string) string {
+	text = emailPattern.ReplaceAllStringFunc(text, func(email string) string { return a.email(email, "", "") })
+	text = ipv4Pattern.ReplaceAllStringFunc(text, a.ip)
+	return quotedPattern.ReplaceAllStringFunc(text, func(quoted string) string {
+		if name, err := strconv.Unquote(quoted); err == nil {
+			if fake, ok := a.usernames[name]; ok {
+				return strconv.Quote(fake)
+			}
+		}
+		return quoted
+	})
+}
+
+// scrubJSON replaces the personal data in a decoded JSON value. Objects describing a User (see userResponse) have
+// their names replaced with the made up names of the User they describe (by their "id", or the event's User), and
+// their email and username as everywhere else. Any other text is scrubbed.
+func (a *Anonymizer) scrubJSON(v any, userID int64) any {
+	switch v := v.(type) {
+	case map[string]any:
+		id := userID
+		if n, ok := v["id"].(float64); ok {
+			id = int64(n)
+		}
+		for key, value := range v {
+			s, isString := value.(string)
+			switch {
+			case isString && key == "email":
+				v[key] = a.email(s, "", "")
+			case isString && key == "username" && s != "":
+				v[key] = a.username(s, "", "")
+			case isString && (key == "first" || key == "last"):
+				names, ok := a.names[id]
+				if !ok {
+					first, last := a.name()
+					names = [2]string{first, last}
+				}
+				if key == "first" {
+					v[key] = names[0]
+				} else {
+					v[key] = names[1]
+				}
+			default:
+				v[key] = a.scrubJSON(value, userID)
+			}
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = a.scrubJSON(v[i], userID)
+		}
+		return v
+	case string:
+		return a.scrub(v)
+	default:
+		return v
+	}
+}
+
+// distinct returns the text values a query selects, such as every email in a column.
+func distinct(tx *sql.Tx, query string) ([]string, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// copyRows bulk loads n rows into a table with COPY, row returning the values of each.
+func copyRows(tx *sql.Tx, table string, columns []string, n int, row func(i int) []any) error {
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := stmt.Exec(row(i)...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
@@ -0,0 +1,97 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// apiTokenColumns lists the columns we select for an APIToken, in the order scanAPIToken expects them
+const apiTokenColumns = `id, userid, name, tokenhash, scopes, created, expires, lastused`
+
+// scanAPIToken reads a row selected with apiTokenColumns into an APIToken. A token that's never been used has no
+// lastused, which reads as the zero time.
+func scanAPIToken(row interface{ Scan(dest ...any) error }) (database.APIToken, error) {
+	var token database.APIToken
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.TokenHash,
+		pq.Array(&token.Scopes),
+		clock.Scan(&token.Created),
+		clock.Scan(&token.Expires),
+		clock.Scan(&token.LastUsed),
+	)
+	return token, err
+}
+
+// CreateAPIToken implements Storer, stores a new API token and updates the ID field with the ID that was handed out
+// for it.
+func (db *DB) CreateAPIToken(in *database.APIToken) error {
+	scopes := in.Scopes
+	if scopes == nil {
+		// A nil slice would be stored as NULL rather than an empty array
+		scopes = []string{}
+	}
+	err := db.storage.QueryRow(
+		`INSERT INTO apitokens(userid, name, tokenhash, scopes, created, expires) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		in.UserID,
+		in.Name,
+		in.TokenHash,
+		pq.Array(scopes),
+		clock.Value(in.Created),
+		clock.Value(in.Expires),
+	).Scan(&in.ID)
+	return wrap(err, "sql.CreateAPIToken")
+}
+
+// ListAPITokens implements Storer, lists a User's API tokens, newest first.
+func (db *DB) ListAPITokens(userID int64) ([]database.APIToken, error) {
+	rows, err := db.storage.Query(`SELECT `+apiTokenColumns+` FROM apitokens WHERE userid = $1 ORDER BY created DESC, id DESC`, userID)
+	if err != nil {
+		return nil, wrap(err, "sql.ListAPITokens")
+	}
+	defer rows.Close()
+
+	var tokens []database.APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListAPITokens")
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, wrap(rows.Err(), "sql.ListAPITokens")
+}
+
+// GetAPIToken implements Storer, retrieves an unexpired API token by its hash.
+func (db *DB) GetAPIToken(tokenHash []byte) (database.APIToken, error) {
+	token, err := scanAPIToken(db.storage.QueryRow(
+		`SELECT `+apiTokenColumns+` FROM apitokens WHERE tokenhash = $1 AND expires > current_timestamp`,
+		tokenHash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.APIToken{}, wrap(database.ErrNotFound, "sql.GetAPIToken")
+	}
+	if err != nil {
+		return database.APIToken{}, wrap(err, "sql.GetAPIToken")
+	}
+	return token, nil
+}
+
+// TouchAPIToken implements Storer, records when an API token was last used.
+func (db *DB) TouchAPIToken(id int64, used time.Time) error {
+	_, err := db.storage.Exec(`UPDATE apitokens SET lastused = $1 WHERE id = $2`, clock.Value(used), id)
+	return wrap(err, "sql.TouchAPIToken")
+}
+
+// DeleteAPIToken implements Storer, removes one of a User's API tokens. Naming the User as well as the token means a
+// User can never remove someone else's.
+func (db *DB) DeleteAPIToken(userID, id int64) error {
+	return wrap(expectRows(db.storage.Exec(`DELETE FROM apitokens WHERE id = $1 AND userid = $2`, id, userID)), "sql.DeleteAPIToken")
+}
@@ -0,0 +1,41 @@
+package sql
+
+import (
+	"examples/clock"
+	"examples/database"
+	"time"
+)
+
+// CreateAuditEntry implements Storer, adds an entry to the audit log and updates the ID field with the ID that is
+// returned from insertion.
+func (db *DB) CreateAuditEntry(in *database.AuditEntry) error {
+	err := db.storage.QueryRow(
+		`INSERT INTO auditlog(time, actorid, action, targetid, detail, ip) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		clock.Value(in.Time),
+		in.ActorID,
+		in.Action,
+		in.TargetID,
+		in.Detail,
+		in.IP,
+	).Scan(&in.ID)
+	return wrap(err, "sql.CreateAuditEntry")
+}
+
+// PurgeAuditEntries implements Storer, deletes (or with dryRun, counts) audit entries from before the given time.
+func (db *DB) PurgeAuditEntries(before time.Time, dryRun bool) (int, error) {
+	return db.purge("auditlog", "time", before, dryRun, "sql.PurgeAuditEntries")
+}
+
+// AnonymizeAuditEntries implements Storer, clears the IP address and detail of audit entries by or about a User. Their
+// ID is left, once the User record is gone it no longer leads back to anyone.
+func (db *DB) AnonymizeAuditEntries(userID int64) (int, error) {
+	result, err := db.storage.Exec(
+		`UPDATE auditlog SET ip = '', detail = '' WHERE (actorid = $1 OR targetid = $1) AND (ip <> '' OR detail <> '')`,
+		userID,
+	)
+	if err != nil {
+		return 0, wrap(err, "sql.AnonymizeAuditEntries")
+	}
+	n, err := result.RowsAffected()
+	return int(n), wrap(err, "sql.AnonymizeAuditEntries")
+}
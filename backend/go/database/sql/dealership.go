@@ -0,0 +1,65 @@
+package sql
+
+// AddUserToDealership implements Storer, adds a dealership membership. Adding a membership that already exists isn't an
+// error, so this is safe to retry.
+func (db *DB) AddUserToDealership(userID, dealershipID int64) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO dealershipmembers(dealershipid, userid) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		dealershipID,
+		userID,
+	)
+	return wrap(err, "sql.AddUserToDealership")
+}
+
+// RemoveUserFromDealership implements Storer, removes a dealership membership.
+func (db *DB) RemoveUserFromDealership(userID, dealershipID int64) error {
+	result, err := db.storage.Exec(
+		`DELETE FROM dealershipmembers WHERE dealershipid = $1 AND userid = $2`,
+		dealershipID,
+		userID,
+	)
+	return wrap(expectRows(result, err), "sql.RemoveUserFromDealership")
+}
+
+// SharesDealership implements Storer, checks whether two Users are members of any of the same dealerships.
+func (db *DB) SharesDealership(userID, otherID int64) (bool, error) {
+	var shares bool
+	err := db.storage.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM dealershipmembers a
+			JOIN dealershipmembers b ON a.dealershipid = b.dealershipid
+			WHERE a.userid = $1 AND b.userid = $2
+		)`,
+		userID,
+		otherID,
+	).Scan(&shares)
+	return shares, wrap(err, "sql.SharesDealership")
+}
+
+// ListUserDealerships implements Storer, lists the dealerships a User is a member of.
+func (db *DB) ListUserDealerships(userID int64) ([]int64, error) {
+	rows, err := db.storage.Query(`SELECT dealershipid FROM dealershipmembers WHERE userid = $1 ORDER BY dealershipid`, userID)
+	if err != nil {
+		return nil, wrap(err, "sql.ListUserDealerships")
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, wrap(err, "sql.ListUserDealerships")
+		}
+		ids = append(ids, id)
+	}
+	return ids, wrap(rows.Err(), "sql.ListUserDealerships")
+}
+
+// RemoveUserMemberships implements Storer, removes a User from every dealership.
+func (db *DB) RemoveUserMemberships(userID int64) (int, error) {
+	result, err := db.storage.Exec(`DELETE FROM dealershipmembers WHERE userid = $1`, userID)
+	if err != nil {
+		return 0, wrap(err, "sql.RemoveUserMemberships")
+	}
+	n, err := result.RowsAffected()
+	return int(n), wrap(err, "sql.RemoveUserMemberships")
+}
@@ -0,0 +1,70 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// deletionColumns lists the columns we select for a UserDeletion, in the order scanDeletion expects them
+const deletionColumns = `userid, requested, status, step, attempts, error, completed`
+
+// scanDeletion reads a row selected with deletionColumns into a UserDeletion.
+func scanDeletion(row interface{ Scan(dest ...any) error }) (database.UserDeletion, error) {
+	var out database.UserDeletion
+	err := row.Scan(&out.UserID, clock.Scan(&out.Requested), &out.Status, &out.Step, &out.Attempts, &out.Error, clock.Scan(&out.Completed))
+	return out, err
+}
+
+// GetUserDeletion implements Storer, retrieves the progress of deleting a User
+func (db *DB) GetUserDeletion(userID int64) (database.UserDeletion, error) {
+	deletion, err := scanDeletion(db.storage.QueryRow(`SELECT `+deletionColumns+` FROM userdeletions WHERE userid = $1`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.UserDeletion{}, wrap(database.ErrNotFound, "sql.GetUserDeletion")
+	}
+	if err != nil {
+		return database.UserDeletion{}, wrap(err, "sql.GetUserDeletion")
+	}
+	return deletion, nil
+}
+
+// PendingUserDeletions implements Storer, lists deletions still being cleaned up, oldest first
+func (db *DB) PendingUserDeletions(limit int) ([]database.UserDeletion, error) {
+	rows, err := db.storage.Query(
+		`SELECT `+deletionColumns+` FROM userdeletions WHERE status = $1 ORDER BY requested LIMIT $2`,
+		database.DeletionPending,
+		limit,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.PendingUserDeletions")
+	}
+	defer rows.Close()
+	var deletions []database.UserDeletion
+	for rows.Next() {
+		deletion, err := scanDeletion(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.PendingUserDeletions")
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, wrap(rows.Err(), "sql.PendingUserDeletions")
+}
+
+// SaveUserDeletion implements Storer, records progress cleaning up after a deleted User
+func (db *DB) SaveUserDeletion(in *database.UserDeletion) error {
+	var completed sql.NullTime
+	if !in.Completed.IsZero() {
+		completed = sql.NullTime{Time: clock.UTC(in.Completed), Valid: true}
+	}
+	result, err := db.storage.Exec(
+		`UPDATE userdeletions SET status = $2, step = $3, attempts = $4, error = $5, completed = $6 WHERE userid = $1`,
+		in.UserID,
+		in.Status,
+		in.Step,
+		in.Attempts,
+		in.Error,
+		completed,
+	)
+	return wrap(expectRows(result, err), "sql.SaveUserDeletion")
+}
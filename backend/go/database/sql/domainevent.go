@@ -0,0 +1,57 @@
+package sql
+
+import (
+	"examples/clock"
+	"examples/database"
+)
+
+// domainEventLock is the advisory lock held while appending a domain event. Sequence numbers are handed out when a row
+// is inserted, not when it's committed, so without it an event could become visible after a later one. A consumer that
+// had already read past it would then never see it.
+const domainEventLock = 0xe7e47
+
+// AppendDomainEvent implements Storer, adds an event to the end of our event log.
+func (db *DB) AppendDomainEvent(in *database.DomainEvent) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.AppendDomainEvent")
+	}
+	defer tx.Rollback()
+	// Held until the transaction ends, so events commit in the order their sequence numbers were handed out
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, domainEventLock); err != nil {
+		return wrap(err, "sql.AppendDomainEvent")
+	}
+	err = tx.QueryRow(
+		`INSERT INTO domainevents(time, type, userid, data) VALUES ($1, $2, $3, $4) RETURNING seq`,
+		clock.Value(in.Time),
+		in.Type,
+		in.UserID,
+		in.Data,
+	).Scan(&in.Seq)
+	if err != nil {
+		return wrap(err, "sql.AppendDomainEvent")
+	}
+	return wrap(tx.Commit(), "sql.AppendDomainEvent")
+}
+
+// ListDomainEvents implements Storer, lists domain events after the given sequence number, oldest first
+func (db *DB) ListDomainEvents(afterSeq int64, limit int) ([]database.DomainEvent, error) {
+	rows, err := db.storage.Query(
+		`SELECT seq, time, type, userid, data FROM domainevents WHERE seq > $1 ORDER BY seq LIMIT $2`,
+		afterSeq,
+		limit,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.ListDomainEvents")
+	}
+	defer rows.Close()
+	var events []database.DomainEvent
+	for rows.Next() {
+		var e database.DomainEvent
+		if err := rows.Scan(&e.Seq, clock.Scan(&e.Time), &e.Type, &e.UserID, &e.Data); err != nil {
+			return nil, wrap(err, "sql.ListDomainEvents")
+		}
+		events = append(events, e)
+	}
+	return events, wrap(rows.Err(), "sql.ListDomainEvents")
+}
@@ -0,0 +1,75 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"time"
+)
+
+// CreateEmailChange implements Storer, stores a pending email change. A User can only have one pending change at a
+// time, so any previous change is removed, and its confirmation link stops working.
+func (db *DB) CreateEmailChange(in *database.EmailChange) error {
+	// Both statements should succeed or fail together, so we'll run them in a transaction
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.CreateEmailChange")
+	}
+	// Rollback does nothing once the transaction has been committed, so it's safe to always defer it
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM emailchanges WHERE userid = $1`, in.UserID); err != nil {
+		return wrap(err, "sql.CreateEmailChange")
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO emailchanges(tokenhash, userid, oldemail, newemail, expires) VALUES ($1, $2, $3, $4, $5)`,
+		in.TokenHash,
+		in.UserID,
+		in.OldEmail,
+		in.NewEmail,
+		clock.Value(in.Expires),
+	); err != nil {
+		return wrap(err, "sql.CreateEmailChange")
+	}
+	return wrap(tx.Commit(), "sql.CreateEmailChange")
+}
+
+// ConfirmEmailChange implements Storer, applies a pending email change to its User, removing the pending change so its
+// token can't be used again.
+func (db *DB) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.EmailChange{}, wrap(err, "sql.ConfirmEmailChange")
+	}
+	defer tx.Rollback()
+
+	// Remove the pending change, only if it hasn't expired
+	change := database.EmailChange{TokenHash: tokenHash}
+	err = tx.QueryRow(
+		`DELETE FROM emailchanges WHERE tokenhash = $1 AND expires > current_timestamp RETURNING userid, oldemail, newemail, expires`,
+		tokenHash,
+	).Scan(&change.UserID, &change.OldEmail, &change.NewEmail, clock.Scan(&change.Expires))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.EmailChange{}, wrap(database.ErrNotFound, "sql.ConfirmEmailChange")
+	}
+	if err != nil {
+		return database.EmailChange{}, wrap(err, "sql.ConfirmEmailChange")
+	}
+
+	// Apply it to the User, following the link proves they own the new address too
+	result, err := tx.Exec(`UPDATE users SET email = $1, emailverified = TRUE WHERE id = $2`, change.NewEmail, change.UserID)
+	if uniqueViolation(err, "users_email_key") {
+		// Someone else signed up with (or changed to) the new address since this change was requested
+		return database.EmailChange{}, wrap(database.ErrEmailTaken, "sql.ConfirmEmailChange")
+	}
+	if err := expectRows(result, err); err != nil {
+		return database.EmailChange{}, wrap(err, "sql.ConfirmEmailChange")
+	}
+	return change, wrap(tx.Commit(), "sql.ConfirmEmailChange")
+}
+
+// PurgeEmailChanges implements Storer, deletes (or with dryRun, counts) email changes that expired before the given time.
+func (db *DB) PurgeEmailChanges(before time.Time, dryRun bool) (int, error) {
+	return db.purge("emailchanges", "expires", before, dryRun, "sql.PurgeEmailChanges")
+}
@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// inviteColumns lists the columns we select for an Invite, in the order scanInvite expects them
+const inviteColumns = `id, tokenhash, email, invitedby, created, expires`
+
+// scanInvite reads a row selected with inviteColumns into an Invite.
+func scanInvite(row interface{ Scan(dest ...any) error }) (database.Invite, error) {
+	var invite database.Invite
+	err := row.Scan(&invite.ID, &invite.TokenHash, &invite.Email, &invite.InvitedBy, clock.Scan(&invite.Created), clock.Scan(&invite.Expires))
+	return invite, err
+}
+
+// CreateInvite implements Storer, stores an invite. An email can only have one invite at a time, so inviting someone
+// again stops any earlier link from working.
+func (db *DB) CreateInvite(in *database.Invite) error {
+	err := db.storage.QueryRow(
+		`INSERT INTO invites(tokenhash, email, invitedby, created, expires) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (email) DO UPDATE SET tokenhash = EXCLUDED.tokenhash, invitedby = EXCLUDED.invitedby,
+			created = EXCLUDED.created, expires = EXCLUDED.expires
+		RETURNING id`,
+		in.TokenHash,
+		in.Email,
+		in.InvitedBy,
+		clock.Value(in.Created),
+		clock.Value(in.Expires),
+	).Scan(&in.ID)
+	return wrap(err, "sql.CreateInvite")
+}
+
+// ListInvites implements Storer, lists the invites that can still be used, newest first.
+func (db *DB) ListInvites() ([]database.Invite, error) {
+	rows, err := db.storage.Query(`SELECT ` + inviteColumns + ` FROM invites WHERE expires > current_timestamp ORDER BY created DESC, id DESC`)
+	if err != nil {
+		return nil, wrap(err, "sql.ListInvites")
+	}
+	defer rows.Close()
+
+	var invites []database.Invite
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListInvites")
+		}
+		invites = append(invites, invite)
+	}
+	return invites, wrap(rows.Err(), "sql.ListInvites")
+}
+
+// DeleteInvite implements Storer, removes an invite.
+func (db *DB) DeleteInvite(id int64) error {
+	return wrap(expectRows(db.storage.Exec(`DELETE FROM invites WHERE id = $1`, id)), "sql.DeleteInvite")
+}
+
+// UseInvite implements Storer, removes an invite so its token can't be used again, and creates the User it invited in
+// the same transaction, so an invite is never used up without an account to show for it.
+func (db *DB) UseInvite(tokenHash []byte, user *database.User) (database.Invite, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.Invite{}, wrap(err, "sql.UseInvite")
+	}
+	defer tx.Rollback()
+
+	invite, err := scanInvite(tx.QueryRow(
+		`DELETE FROM invites WHERE tokenhash = $1 AND expires > current_timestamp RETURNING `+inviteColumns,
+		tokenHash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.Invite{}, wrap(database.ErrNotFound, "sql.UseInvite")
+	}
+	if err != nil {
+		return database.Invite{}, wrap(err, "sql.UseInvite")
+	}
+
+	// The invite was only sent if nobody had the email, but an admin may have created a User with it since
+	var taken bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND deleted IS NULL)`, invite.Email).Scan(&taken); err != nil {
+		return database.Invite{}, wrap(err, "sql.UseInvite")
+	}
+	if taken {
+		return database.Invite{}, wrap(database.ErrEmailTaken, "sql.UseInvite")
+	}
+
+	// Following the link we emailed proves they own the address
+	user.Email, user.EmailVerified = invite.Email, true
+	if err := insertUser(tx, user); err != nil {
+		return database.Invite{}, wrap(err, "sql.UseInvite")
+	}
+	return invite, wrap(tx.Commit(), "sql.UseInvite")
+}
@@ -0,0 +1,60 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/jobs"
+	"strconv"
+	"time"
+)
+
+// PushJob implements jobs.Store, adds a job to our jobs table.
+func (db *DB) PushJob(ctx context.Context, job jobs.Job) error {
+	_, err := db.storage.ExecContext(ctx,
+		`INSERT INTO jobs(kind, payload, runat) VALUES ($1, $2, $3)`,
+		job.Kind,
+		[]byte(job.Payload),
+		clock.Value(job.RunAt),
+	)
+	return wrap(err, "sql.PushJob")
+}
+
+// ClaimJob implements jobs.Store, leases the job that's been due the longest. SKIP LOCKED lets several workers claim
+// jobs at once, each passing over any job another worker is in the middle of claiming rather than waiting on it.
+func (db *DB) ClaimJob(ctx context.Context, lease time.Duration) (jobs.Job, bool, error) {
+	var (
+		job     jobs.Job
+		id      int64
+		payload []byte
+	)
+	err := db.storage.QueryRowContext(ctx,
+		`UPDATE jobs SET runat = current_timestamp + $1 * interval '1 millisecond', attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM jobs WHERE runat <= current_timestamp ORDER BY runat LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING id, kind, payload, attempts, runat`,
+		lease.Milliseconds(),
+	).Scan(&id, &job.Kind, &payload, &job.Attempts, clock.Scan(&job.RunAt))
+	if errors.Is(err, sql.ErrNoRows) {
+		return jobs.Job{}, false, nil
+	}
+	if err != nil {
+		return jobs.Job{}, false, wrap(err, "sql.ClaimJob")
+	}
+	job.ID = strconv.FormatInt(id, 10)
+	job.Payload = payload
+	return job, true, nil
+}
+
+// AckJob implements jobs.Store, deletes a finished job.
+func (db *DB) AckJob(ctx context.Context, id string) error {
+	_, err := db.storage.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, id)
+	return wrap(err, "sql.AckJob")
+}
+
+// RetryJob implements jobs.Store, sets when a job should next be claimed.
+func (db *DB) RetryJob(ctx context.Context, id string, at time.Time) error {
+	_, err := db.storage.ExecContext(ctx, `UPDATE jobs SET runat = $1 WHERE id = $2`, clock.Value(at), id)
+	return wrap(err, "sql.RetryJob")
+}
@@ -0,0 +1,39 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// CreateMagicLink implements Storer, stores a magic link. A User can only have one link at a time, so requesting a new
+// link stops any earlier one from working.
+func (db *DB) CreateMagicLink(in *database.MagicLink) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO magiclinks(tokenhash, userid, remember, expires) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (userid) DO UPDATE SET tokenhash = EXCLUDED.tokenhash, remember = EXCLUDED.remember, expires = EXCLUDED.expires`,
+		in.TokenHash,
+		in.UserID,
+		in.Remember,
+		clock.Value(in.Expires),
+	)
+	return wrap(err, "sql.CreateMagicLink")
+}
+
+// UseMagicLink implements Storer, removes a magic link so its token can't be used again. Deleting and returning the link
+// in one statement means two requests racing to use the same link can't both succeed.
+func (db *DB) UseMagicLink(tokenHash []byte) (database.MagicLink, error) {
+	link := database.MagicLink{TokenHash: tokenHash}
+	err := db.storage.QueryRow(
+		`DELETE FROM magiclinks WHERE tokenhash = $1 AND expires > current_timestamp RETURNING userid, remember, expires`,
+		tokenHash,
+	).Scan(&link.UserID, &link.Remember, clock.Scan(&link.Expires))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.MagicLink{}, wrap(database.ErrNotFound, "sql.UseMagicLink")
+	}
+	if err != nil {
+		return database.MagicLink{}, wrap(err, "sql.UseMagicLink")
+	}
+	return link, nil
+}
@@ -0,0 +1,40 @@
+package sql_test
+
+import (
+	"examples/database/embedded"
+	"examples/database/sql"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// pg is the PostgreSQL server our integration tests share, or nil if it couldn't be started
+var pg *embedded.Server
+
+// pgErr is why pg couldn't be started
+var pgErr error
+
+// TestMain starts one embedded server for the whole package. Starting it can fail through no fault of ours (the first
+// run downloads its binaries), so rather than failing every test we skip the ones that need it, see postgres.
+func TestMain(m *testing.M) {
+	pg, pgErr = embedded.Start(embedded.Options{})
+	code := m.Run()
+	if pg != nil {
+		if err := pg.Stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "stopping embedded postgres: %v\n", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// postgres returns our SQL Storer on an empty database, skipping the test or benchmark if we have no server.
+func postgres(tb testing.TB) *sql.DB {
+	tb.Helper()
+	if pg == nil {
+		tb.Skipf("no postgres to test against: %v", pgErr)
+	}
+	if err := pg.Reset(); err != nil {
+		tb.Fatalf("resetting database: %v", err)
+	}
+	return pg.DB()
+}
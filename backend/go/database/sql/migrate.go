@@ -0,0 +1,208 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// migrationFiles holds our migrations, a pair of files for each change to our schema: NNNN_name.up.sql making the
+// change, and NNNN_name.down.sql undoing it. Versions start at 1 and go up by one with each migration.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationName matches the name of a migration file, capturing its version, name and direction
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLock is the key of the advisory lock held while migrating, so only one of several instances starting at
+// once migrates our database, and the rest wait for it to finish. It's an arbitrary number, just one nothing else uses.
+const migrationLock = 7275286
+
+// migration is a single change to our schema.
+type migration struct {
+	version  int
+	name     string
+	up, down string // SQL making the change, and undoing it
+}
+
+// ourMigrations lists every migration in version order, read from migrationFiles once when we start.
+var ourMigrations = mustLoadMigrations()
+
+// mustLoadMigrations reads our migrations from migrationFiles. They're built into our binary, so anything wrong with
+// them is a programming mistake, and panics rather than waiting to be found when migrating.
+func mustLoadMigrations() []migration {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			panic(fmt.Sprintf("migration %s isn't named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name()))
+		}
+		version, _ := strconv.Atoi(match[1])
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			panic(fmt.Sprintf("migration %d has two names, %s and %s", version, m.name, match[2]))
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join("migrations", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			panic(fmt.Sprintf("migration %d_%s needs both an up and a down file", m.version, m.name))
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			panic(fmt.Sprintf("migration %d_%s is out of sequence, expected version %d", m.version, m.name, i+1))
+		}
+	}
+	return migrations
+}
+
+// LatestMigration returns the version of our newest migration, the version Migrate brings our database up to.
+func LatestMigration() int {
+	return len(ourMigrations)
+}
+
+// Migrate applies any of our migrations our database doesn't have yet, in order, returning how many it applied. Each
+// migration is applied in its own transaction, so one that fails leaves our database as the one before left it.
+//
+// A database provisioned before we had migrations (it has our users table, but no record of any migrations) is
+// recorded as already having our initial migration, which is the schema it was provisioned with.
+func (db *DB) Migrate() (int, error) {
+	return db.MigrateTo(LatestMigration())
+}
+
+// MigrateTo applies migrations, or undoes them, until our database is at the given version, returning how many it
+// applied or undid. Version 0 undoes every migration, removing all of our tables and the data in them.
+func (db *DB) MigrateTo(version int) (int, error) {
+	if version < 0 || version > LatestMigration() {
+		return 0, fmt.Errorf("migration %d doesn't exist, our newest is %d", version, LatestMigration())
+	}
+	ctx := context.Background()
+	// Advisory locks belong to a connection, so every step needs to use the same one
+	conn, err := db.pool.Conn(ctx)
+	if err != nil {
+		return 0, wrap(err, "sql.MigrateTo")
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return 0, wrap(err, "sql.MigrateTo")
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	current, err := prepareMigrations(ctx, conn)
+	if err != nil {
+		return 0, wrap(err, "sql.MigrateTo")
+	}
+	var steps int
+	for ; current < version; current++ {
+		m := ourMigrations[current]
+		if err := applyMigration(ctx, conn, m.up, `INSERT INTO schemamigrations (version, name, applied) VALUES ($1, $2, current_timestamp)`,
+			m.version, m.name); err != nil {
+			return steps, wrap(fmt.Errorf("applying migration %d_%s: %w", m.version, m.name, err), "sql.MigrateTo")
+		}
+		steps++
+	}
+	for ; current > version; current-- {
+		m := ourMigrations[current-1]
+		if err := applyMigration(ctx, conn, m.down, `DELETE FROM schemamigrations WHERE version = $1`, m.version); err != nil {
+			return steps, wrap(fmt.Errorf("undoing migration %d_%s: %w", m.version, m.name, err), "sql.MigrateTo")
+		}
+		steps++
+	}
+	// Our hot queries may only have become valid now (see statements.prepare)
+	db.statements.prepare(db.pool)
+	return steps, nil
+}
+
+// MigrationVersion returns the version of the newest migration our database has, 0 if it has none.
+func (db *DB) MigrationVersion() (int, error) {
+	var version int
+	err := db.storage.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schemamigrations`).Scan(&version)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" { // undefined_table, we've never migrated
+		return 0, nil
+	}
+	return version, wrap(err, "sql.MigrationVersion")
+}
+
+// prepareMigrations creates the table recording which migrations we've applied if it doesn't exist yet, returning the
+// version our database is at.
+func prepareMigrations(ctx context.Context, conn *sql.Conn) (int, error) {
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schemamigrations (
+    version INTEGER                  PRIMARY KEY,
+    name    TEXT                     NOT NULL,
+    applied TIMESTAMP WITH TIME ZONE NOT NULL
+)`); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schemamigrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > LatestMigration() {
+		return 0, fmt.Errorf("database is at migration %d, newer than any we know of (%d), it was migrated by a newer version of us", version, LatestMigration())
+	}
+	if version > 0 {
+		return version, nil
+	}
+
+	// Provisioned before we had migrations, so it has our initial schema
+	var provisioned bool
+	if err := conn.QueryRowContext(ctx, `SELECT to_regclass('users') IS NOT NULL`).Scan(&provisioned); err != nil {
+		return 0, err
+	}
+	if !provisioned {
+		return 0, nil
+	}
+	initial := ourMigrations[0]
+	if _, err := conn.ExecContext(ctx, `INSERT INTO schemamigrations (version, name, applied) VALUES ($1, $2, current_timestamp)`,
+		initial.version, initial.name); err != nil {
+		return 0, err
+	}
+	return initial.version, nil
+}
+
+// applyMigration runs a migration's SQL along with the statement recording it, in a single transaction.
+func applyMigration(ctx context.Context, conn *sql.Conn, body, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,24 @@
+-- Removes everything our initial schema created, and every row along with it. Only for development, or a database
+-- that's about to be thrown away.
+
+DROP TABLE IF EXISTS apitokens;
+DROP TABLE IF EXISTS tenantsettings;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS userdeletions;
+DROP TABLE IF EXISTS recoverycodes;
+DROP TABLE IF EXISTS twofactor;
+DROP TABLE IF EXISTS dealershipmembers;
+DROP TABLE IF EXISTS domainevents;
+DROP TABLE IF EXISTS securityevents;
+DROP FUNCTION IF EXISTS securityevents_append_only();
+DROP TABLE IF EXISTS auditlog;
+DROP TABLE IF EXISTS emailverifications;
+DROP TABLE IF EXISTS invites;
+DROP TABLE IF EXISTS passwordresets;
+DROP TABLE IF EXISTS magiclinks;
+DROP TABLE IF EXISTS emailchanges;
+DROP TABLE IF EXISTS oauthidentities;
+DROP TABLE IF EXISTS refreshtokens;
+DROP TABLE IF EXISTS usernamehistory;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
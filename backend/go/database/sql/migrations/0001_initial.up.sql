@@ -0,0 +1,229 @@
+-- Our initial schema, as databases were provisioned before we had migrations. Databases provisioned back then are
+-- recorded as already having this migration (see Migrate), so it must never change, later changes need a migration of
+-- their own.
+
+------ Tables ------
+
+-- Users, a simple table for storing User records
+-- Deleted Users have deleted set until they're cleaned up (see userdeletions), and are hidden from every lookup
+CREATE TABLE users (
+    id           SERIAL   PRIMARY KEY,
+    first        TEXT     NOT NULL,
+    last         TEXT     NOT NULL,
+    email        TEXT     NOT NULL,
+    username     TEXT     UNIQUE,
+    role         TEXT     NOT NULL DEFAULT 'user',
+    passwordhash TEXT     NOT NULL,
+    enabled      BOOLEAN  NOT NULL DEFAULT TRUE,
+    failedlogins INTEGER  NOT NULL DEFAULT 0,
+    locked       BOOLEAN  NOT NULL DEFAULT FALSE,
+    -- Users created before we verified emails keep working, new Users are always inserted with this set explicitly
+    emailverified BOOLEAN NOT NULL DEFAULT TRUE,
+    deleted      TIMESTAMP WITH TIME ZONE
+);
+
+-- Sessions, a simple table for storing encrypted credentials and expiration
+-- Sessions are removed along with the User they belong to
+CREATE TABLE sessions (
+    id             SERIAL                     PRIMARY KEY,
+    userid         INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    encryptedcreds BYTEA                      NOT NULL,
+    created        TIMESTAMP WITH TIME ZONE   NOT NULL,
+    expiration     TIMESTAMP WITH TIME ZONE   NOT NULL,
+    endoflife      TIMESTAMP WITH TIME ZONE   NOT NULL,
+    ip             TEXT                       NOT NULL DEFAULT '',
+    refreshfamily  TEXT                       NOT NULL DEFAULT '',
+    remember       BOOLEAN                    NOT NULL DEFAULT FALSE,
+    useragent      TEXT                       NOT NULL DEFAULT '',
+    lastseen       TIMESTAMP WITH TIME ZONE   NOT NULL DEFAULT current_timestamp,
+    lastip         TEXT                       NOT NULL DEFAULT '',
+    impersonator   INTEGER                    NOT NULL DEFAULT 0
+);
+
+-- Username history, every change each User has made to their username. Usernames here stay reserved for their User.
+CREATE TABLE usernamehistory (
+    userid      INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    oldusername TEXT                       NOT NULL DEFAULT '',
+    newusername TEXT                       NOT NULL,
+    changed     TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+CREATE INDEX usernamehistory_userid ON usernamehistory(userid);
+CREATE INDEX usernamehistory_oldusername ON usernamehistory(oldusername);
+
+-- Refresh tokens, single use tokens for getting a new session without logging in again
+-- Every token descended from the same login shares a family, so a reused token can revoke them all
+CREATE TABLE refreshtokens (
+    tokenhash BYTEA                      PRIMARY KEY,
+    familyid  TEXT                       NOT NULL,
+    userid    INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL,
+    used      BOOLEAN                    NOT NULL DEFAULT FALSE,
+    remember  BOOLEAN                    NOT NULL DEFAULT FALSE
+);
+CREATE INDEX refreshtokens_familyid ON refreshtokens(familyid);
+
+-- OAuth identities, which accounts with OAuth providers (Google, GitHub) each User can log in with
+CREATE TABLE oauthidentities (
+    provider TEXT      NOT NULL,
+    subject  TEXT      NOT NULL,
+    userid   INTEGER   NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (provider, subject)
+);
+
+-- Email changes, pending changes to a User's email waiting to be confirmed
+CREATE TABLE emailchanges (
+    tokenhash BYTEA                      PRIMARY KEY,
+    userid    INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    oldemail  TEXT                       NOT NULL,
+    newemail  TEXT                       NOT NULL,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- Magic links, for logging in without a password. Each User has at most one link at a time.
+CREATE TABLE magiclinks (
+    tokenhash BYTEA                      PRIMARY KEY,
+    userid    INTEGER                    NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    remember  BOOLEAN                    NOT NULL DEFAULT FALSE,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- Password resets started by an admin, each User has at most one at a time
+CREATE TABLE passwordresets (
+    tokenhash BYTEA                      PRIMARY KEY,
+    userid    INTEGER                    NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- Invites, letting someone create an account with the email they were invited at, one per email
+CREATE TABLE invites (
+    id        SERIAL                     PRIMARY KEY,
+    tokenhash BYTEA                      NOT NULL UNIQUE,
+    email     TEXT                       NOT NULL UNIQUE,
+    invitedby INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created   TIMESTAMP WITH TIME ZONE   NOT NULL,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- Email verifications, the link we email new Users to prove they own their address, one per User
+CREATE TABLE emailverifications (
+    tokenhash BYTEA                      PRIMARY KEY,
+    userid    INTEGER                    NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- Audit log, an append-only history of significant actions
+CREATE TABLE auditlog (
+    id       SERIAL                     PRIMARY KEY,
+    time     TIMESTAMP WITH TIME ZONE   NOT NULL,
+    actorid  INTEGER                    NOT NULL,
+    action   TEXT                       NOT NULL,
+    targetid INTEGER                    NOT NULL,
+    detail   TEXT                       NOT NULL,
+    ip       TEXT                       NOT NULL DEFAULT ''
+);
+-- Our retention policy purges old audit entries by time
+CREATE INDEX auditlog_time ON auditlog(time);
+
+-- Security events, an append-only log with each event's hash chained to the one before (see database.SecurityEvent).
+-- There's no foreign key on userid, as events outlive the Users they're about.
+CREATE TABLE securityevents (
+    id       SERIAL                     PRIMARY KEY,
+    time     TIMESTAMP WITH TIME ZONE   NOT NULL,
+    kind     TEXT                       NOT NULL,
+    userid   INTEGER                    NOT NULL DEFAULT 0,
+    ip       TEXT                       NOT NULL DEFAULT '',
+    detail   TEXT                       NOT NULL DEFAULT '',
+    prevhash BYTEA                      NOT NULL,
+    hash     BYTEA                      NOT NULL UNIQUE
+);
+-- Refuse to change or remove security events, even for someone with direct access to our database (short of dropping
+-- this trigger, which the hash chain would then give away)
+CREATE FUNCTION securityevents_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'security events are append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER securityevents_append_only BEFORE UPDATE OR DELETE ON securityevents
+    FOR EACH ROW EXECUTE FUNCTION securityevents_append_only();
+
+-- Domain events, changes to our data in the order they happened, for other services to follow (see DomainEvent)
+CREATE TABLE domainevents (
+    seq    BIGSERIAL                  PRIMARY KEY,
+    time   TIMESTAMP WITH TIME ZONE   NOT NULL,
+    type   TEXT                       NOT NULL,
+    userid INTEGER                    NOT NULL DEFAULT 0,
+    data   JSONB                      NOT NULL
+);
+
+-- Dealership members, which dealerships each User belongs to. Users may only see other Users that share a dealership.
+-- Dealerships themselves are identified by ID only, their details are managed elsewhere.
+CREATE TABLE dealershipmembers (
+    dealershipid INTEGER   NOT NULL,
+    userid       INTEGER   NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (dealershipid, userid)
+);
+
+-- Two-factor authentication, each User's TOTP secret (encrypted) and whether they've finished enrolling
+CREATE TABLE twofactor (
+    userid          INTEGER   PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    encryptedsecret BYTEA     NOT NULL,
+    enabled         BOOLEAN   NOT NULL DEFAULT FALSE,
+    laststep        BIGINT    NOT NULL DEFAULT 0
+);
+
+-- Recovery codes, single use codes for logging in when a User doesn't have their authenticator app
+CREATE TABLE recoverycodes (
+    userid   INTEGER   NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    codehash BYTEA     NOT NULL,
+    PRIMARY KEY (userid, codehash)
+);
+
+-- User deletions, the progress of cleaning up after each deleted User. These outlive the User, so they can be checked
+-- on once the User record itself is gone.
+CREATE TABLE userdeletions (
+    userid    INTEGER                    PRIMARY KEY,
+    requested TIMESTAMP WITH TIME ZONE   NOT NULL,
+    status    TEXT                       NOT NULL,
+    step      TEXT                       NOT NULL DEFAULT '',
+    attempts  INTEGER                    NOT NULL DEFAULT 0,
+    error     TEXT                       NOT NULL DEFAULT '',
+    completed TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX userdeletions_status ON userdeletions(status, requested);
+
+-- Job queue, work to be done outside of a request (see the jobs package). Claimed jobs have runat pushed back by their
+-- lease, so a job whose worker dies is claimed again once the lease runs out.
+CREATE TABLE jobs (
+    id       BIGSERIAL                  PRIMARY KEY,
+    kind     TEXT                       NOT NULL,
+    payload  BYTEA                      NOT NULL,
+    attempts INTEGER                    NOT NULL DEFAULT 0,
+    runat    TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+CREATE INDEX jobs_runat ON jobs(runat);
+
+-- Tenant settings, the settings each tenant (dealership) has overridden for its members. Durations are in seconds, and
+-- anything left at 0 (or empty) isn't overridden, so our own setting applies.
+CREATE TABLE tenantsettings (
+    tenantid            INTEGER                    PRIMARY KEY,
+    idletimeout         BIGINT                     NOT NULL DEFAULT 0,
+    maxlifetime         BIGINT                     NOT NULL DEFAULT 0,
+    rememberidletimeout BIGINT                     NOT NULL DEFAULT 0,
+    rememberlifetime    BIGINT                     NOT NULL DEFAULT 0,
+    passwordminlength   INTEGER                    NOT NULL DEFAULT 0,
+    allowedorigins      TEXT[]                     NOT NULL DEFAULT '{}',
+    updated             TIMESTAMP WITH TIME ZONE   NOT NULL
+);
+
+-- API tokens, personal access tokens Users create for their scripts. Scopes are permission names (see authz.go).
+CREATE TABLE apitokens (
+    id        SERIAL                     PRIMARY KEY,
+    userid    INTEGER                    NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name      TEXT                       NOT NULL,
+    tokenhash BYTEA                      NOT NULL UNIQUE,
+    scopes    TEXT[]                     NOT NULL DEFAULT '{}',
+    created   TIMESTAMP WITH TIME ZONE   NOT NULL,
+    expires   TIMESTAMP WITH TIME ZONE   NOT NULL,
+    lastused  TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX apitokens_userid ON apitokens(userid);
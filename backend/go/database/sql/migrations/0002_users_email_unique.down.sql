@@ -0,0 +1,3 @@
+-- Allows Users to share an email again, leaving it to our application to check.
+
+DROP INDEX users_email_key;
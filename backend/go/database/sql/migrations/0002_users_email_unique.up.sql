@@ -0,0 +1,6 @@
+-- Each email belongs to at most one User. We check this before creating or changing a User, but two requests can both
+-- pass that check at once, this closes the gap. Emails are matched case insensitively, as our lookups are, and deleted
+-- Users are exempt so their address can be used again straight away.
+--
+-- Databases that already have two Users sharing an email need them merged first (see MergeUsers), or this fails.
+CREATE UNIQUE INDEX users_email_key ON users(lower(email)) WHERE deleted IS NULL;
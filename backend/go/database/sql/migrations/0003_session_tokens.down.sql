@@ -0,0 +1,4 @@
+-- Goes back to clients presenting session IDs. Tokens handed out since stop working, clients refresh to get an ID.
+
+DROP INDEX sessions_tokenhash;
+ALTER TABLE sessions DROP COLUMN tokenhash;
@@ -0,0 +1,5 @@
+-- Sessions are looked up by the hash of a random bearer token, rather than clients presenting their (guessable) ID.
+-- Existing sessions have no token to look them up by, so are ended: clients get a new one by refreshing as usual.
+DELETE FROM sessions;
+ALTER TABLE sessions ADD COLUMN tokenhash BYTEA NOT NULL;
+CREATE UNIQUE INDEX sessions_tokenhash ON sessions(tokenhash);
@@ -0,0 +1,40 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/database"
+)
+
+// GetUserByIdentity implements Storer, retrieves the User an OAuth identity is linked to
+func (db *DB) GetUserByIdentity(provider, subject string) (database.User, error) {
+	user, err := scanUser(db.storage.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = (SELECT userid FROM oauthidentities WHERE provider = $1 AND subject = $2) AND deleted IS NULL`,
+		provider,
+		subject,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, wrap(database.ErrNotFound, "sql.GetUserByIdentity")
+	}
+	if err != nil {
+		return database.User{}, wrap(err, "sql.GetUserByIdentity")
+	}
+	return user, nil
+}
+
+// LinkIdentity implements Storer, links an OAuth identity to a User
+func (db *DB) LinkIdentity(userID int64, provider, subject string) error {
+	result, err := db.storage.Exec(
+		`INSERT INTO oauthidentities(provider, subject, userid) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		provider,
+		subject,
+		userID,
+	)
+	// Nothing being inserted means the identity is already linked
+	if err := expectRows(result, err); errors.Is(err, database.ErrNotFound) {
+		return wrap(database.ErrIdentityLinked, "sql.LinkIdentity")
+	} else if err != nil {
+		return wrap(err, "sql.LinkIdentity")
+	}
+	return nil
+}
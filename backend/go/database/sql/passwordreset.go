@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// CreatePasswordReset implements Storer, stores a password reset. A User can only have one reset at a time, so starting
+// a new reset stops any earlier link from working.
+func (db *DB) CreatePasswordReset(in *database.PasswordReset) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO passwordresets(tokenhash, userid, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (userid) DO UPDATE SET tokenhash = EXCLUDED.tokenhash, expires = EXCLUDED.expires`,
+		in.TokenHash,
+		in.UserID,
+		clock.Value(in.Expires),
+	)
+	return wrap(err, "sql.CreatePasswordReset")
+}
+
+// UsePasswordReset implements Storer, removes a password reset so its token can't be used again, and sets the new
+// password hash in the same transaction.
+func (db *DB) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.PasswordReset{}, wrap(err, "sql.UsePasswordReset")
+	}
+	defer tx.Rollback()
+
+	reset := database.PasswordReset{TokenHash: tokenHash}
+	err = tx.QueryRow(
+		`DELETE FROM passwordresets WHERE tokenhash = $1 AND expires > current_timestamp RETURNING userid, expires`,
+		tokenHash,
+	).Scan(&reset.UserID, clock.Scan(&reset.Expires))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.PasswordReset{}, wrap(database.ErrNotFound, "sql.UsePasswordReset")
+	}
+	if err != nil {
+		return database.PasswordReset{}, wrap(err, "sql.UsePasswordReset")
+	}
+
+	result, err := tx.Exec(`UPDATE users SET passwordhash = $1 WHERE id = $2 AND deleted IS NULL`, passwordHash, reset.UserID)
+	if err := expectRows(result, err); err != nil {
+		return database.PasswordReset{}, wrap(err, "sql.UsePasswordReset")
+	}
+	return reset, wrap(tx.Commit(), "sql.UsePasswordReset")
+}
@@ -0,0 +1,208 @@
+package sql
+
+import (
+	"examples/errs"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Methods that list or search take filters and sort orders that often come straight from a request, so rather than
+// concatenating SQL as we go, they build their queries with the query type below. Callers only ever name fields and
+// pick from our operators, and every name is checked against an allowlist of fields for that query. Values are always
+// passed as parameters, so nothing a user supplies ever ends up in the SQL itself.
+
+// fields maps the names a query may filter or sort by to the SQL expression behind each. Both sides are always
+// constants from our own code.
+type fields map[string]string
+
+// operator compares a field with a value in a filter.
+type operator string
+
+// Operators we support in filters
+const (
+	opEq     operator = "="
+	opNe     operator = "<>"
+	opLt     operator = "<"
+	opLe     operator = "<="
+	opGt     operator = ">"
+	opGe     operator = ">="
+	opLike   operator = "ILIKE" // Case insensitive pattern match, escape user input with likeEscaper or likePattern
+	opIn     operator = "IN"    // Value is a slice, matching any of its elements
+	opWithin operator = "<<="   // Value is an IP address range, matching addresses within it
+)
+
+// operators lists every operator we support, as our operator type is only a string, and so could be converted from
+// anything.
+var operators = map[operator]bool{
+	opEq: true, opNe: true, opLt: true, opLe: true, opGt: true, opGe: true, opLike: true, opIn: true, opWithin: true,
+}
+
+// query builds a SELECT statement from a fixed base, adding filters, a sort order and a limit. Mistakes (such as an
+// unknown field) are remembered and returned from build, so calls can be chained without checking each one.
+type query struct {
+	base   string // Start of the statement, such as "SELECT id FROM users"
+	fields fields
+	where  []string
+	order  []string
+	args   []any
+	limit  int
+	offset int
+	err    error
+}
+
+// newQuery starts a query from a base with no WHERE clause, filters are added to it by the methods below.
+func newQuery(base string, fields fields) *query {
+	return &query{base: base, fields: fields}
+}
+
+// require adds a fixed condition, such as "deleted IS NULL". Conditions must be constants from our own code, with
+// each ? in one replaced by a parameter holding the next of values, for conditions filter can't express (such as a
+// subquery). Anything comparing a field with a value goes through filter.
+func (q *query) require(condition string, values ...any) *query {
+	if n := strings.Count(condition, "?"); n != len(values) {
+		q.fail(fmt.Errorf("condition %q takes %d values, got %d", condition, n, len(values)))
+		return q
+	}
+	for _, value := range values {
+		condition = strings.Replace(condition, "?", q.param(value), 1)
+	}
+	q.where = append(q.where, condition)
+	return q
+}
+
+// param adds a value as a parameter, returning its placeholder.
+func (q *query) param(value any) string {
+	q.args = append(q.args, value)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// filter only includes rows where field compares with value using op.
+func (q *query) filter(field string, op operator, value any) *query {
+	if cond, ok := q.compare([]string{field}, op, value, "filter"); ok {
+		q.where = append(q.where, cond)
+	}
+	return q
+}
+
+// filterAny only includes rows where at least one of fields compares with value using op, such as a search matching
+// any of a User's names.
+func (q *query) filterAny(fields []string, op operator, value any) *query {
+	if cond, ok := q.compare(fields, op, value, "filter"); ok {
+		q.where = append(q.where, cond)
+	}
+	return q
+}
+
+// compare builds the condition that at least one of fields compares with value using op, with value as a single
+// parameter however many fields there are. verb is what the condition is for, for our error if a field is unknown.
+func (q *query) compare(fields []string, op operator, value any, verb string) (string, bool) {
+	exprs := make([]string, len(fields))
+	for i, field := range fields {
+		expr, ok := q.fields[field]
+		if !ok {
+			q.fail(errs.New(errs.Invalid, fmt.Sprintf("can't %s by %q", verb, field)))
+			return "", false
+		}
+		exprs[i] = expr
+	}
+	if !operators[op] {
+		q.fail(fmt.Errorf("unsupported operator %q", op))
+		return "", false
+	}
+	if op == opIn {
+		value = pq.Array(value)
+	}
+	placeholder := q.param(value)
+	for i, expr := range exprs {
+		if op == opIn {
+			exprs[i] = expr + " = ANY(" + placeholder + ")"
+		} else {
+			exprs[i] = expr + " " + string(op) + " " + placeholder
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], true
+	}
+	return "(" + strings.Join(exprs, " OR ") + ")", true
+}
+
+// orderBy sorts by field, after any fields already sorted by.
+func (q *query) orderBy(field string, desc bool) *query {
+	expr, ok := q.fields[field]
+	if !ok {
+		q.fail(errs.New(errs.Invalid, fmt.Sprintf("can't sort by %q", field)))
+		return q
+	}
+	if desc {
+		expr += " DESC"
+	}
+	q.order = append(q.order, expr)
+	return q
+}
+
+// orderByMatch sorts rows where at least one of fields compares with value using op first, after any fields already
+// sorted by, such as search results that start with what was searched for.
+func (q *query) orderByMatch(fields []string, op operator, value any) *query {
+	if cond, ok := q.compare(fields, op, value, "sort"); ok {
+		q.order = append(q.order, cond+" DESC")
+	}
+	return q
+}
+
+// page limits the query to n rows (n <= 0 means no limit), skipping the first offset.
+func (q *query) page(n, offset int) *query {
+	if offset < 0 {
+		q.fail(errs.New(errs.Invalid, "offset can't be negative"))
+		return q
+	}
+	q.limit, q.offset = n, offset
+	return q
+}
+
+// fail remembers the first mistake made building the query.
+func (q *query) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// build returns the finished statement and its parameters.
+func (q *query) build() (string, []any, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	var b strings.Builder
+	b.WriteString(q.base)
+	// Copied, so building twice gives the same result
+	args := append([]any(nil), q.args...)
+	if len(q.where) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(q.where, " AND "))
+	}
+	if len(q.order) > 0 {
+		b.WriteString(" ORDER BY ")
+		b.WriteString(strings.Join(q.order, ", "))
+	}
+	// Limits are numbers we've checked, but go in as parameters anyway, keeping the statement the same whatever they are
+	if q.limit > 0 {
+		args = append(args, q.limit)
+		fmt.Fprintf(&b, " LIMIT $%d", len(args))
+	}
+	if q.offset > 0 {
+		args = append(args, q.offset)
+		fmt.Fprintf(&b, " OFFSET $%d", len(args))
+	}
+	return b.String(), args, nil
+}
+
+// likeEscaper escapes the characters with special meaning in LIKE patterns, backslash being the default escape
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern builds a pattern for opLike matching anything containing s. Any wildcards in s are escaped, so a search
+// for "50%" only matches "50%", rather than everything starting "50".
+func likePattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
@@ -0,0 +1,165 @@
+package sql
+
+import (
+	"errors"
+	"examples/errs"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// testFields are the fields our test queries may filter and sort by
+var testFields = fields{
+	"id":    "id",
+	"name":  "name",
+	"email": "email",
+	"ip":    "NULLIF(ip, '')::inet",
+}
+
+// TestQueryBuild checks the statements and parameters our query builder produces, in particular that whatever a
+// caller passes in only ever ends up as a parameter, never in the SQL itself.
+func TestQueryBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(q *query) *query
+		sql   string
+		args  []any
+	}{
+		{
+			name:  "no filters",
+			build: func(q *query) *query { return q },
+			sql:   `SELECT id FROM t`,
+		},
+		{
+			name:  "required condition",
+			build: func(q *query) *query { return q.require("deleted IS NULL") },
+			sql:   `SELECT id FROM t WHERE deleted IS NULL`,
+		},
+		{
+			name: "required condition with values",
+			build: func(q *query) *query {
+				return q.filter("id", opGt, 1).require("(id = ? OR name IN (SELECT name FROM u WHERE x = ?))", 2, 3)
+			},
+			sql:  `SELECT id FROM t WHERE id > $1 AND (id = $2 OR name IN (SELECT name FROM u WHERE x = $3))`,
+			args: []any{1, 2, 3},
+		},
+		{
+			name: "each operator",
+			build: func(q *query) *query {
+				return q.filter("id", opEq, 1).filter("id", opNe, 2).filter("id", opLt, 3).filter("id", opLe, 4).
+					filter("id", opGt, 5).filter("id", opGe, 6).filter("ip", opWithin, "10.0.0.0/8")
+			},
+			sql: `SELECT id FROM t WHERE id = $1 AND id <> $2 AND id < $3 AND id <= $4 AND id > $5 AND id >= $6 ` +
+				`AND NULLIF(ip, '')::inet <<= $7`,
+			args: []any{1, 2, 3, 4, 5, 6, "10.0.0.0/8"},
+		},
+		{
+			name:  "in",
+			build: func(q *query) *query { return q.filter("id", opIn, []int64{1, 2}) },
+			sql:   `SELECT id FROM t WHERE id = ANY($1)`,
+			args:  []any{pq.Array([]int64{1, 2})},
+		},
+		{
+			name:  "injection in a value stays a parameter",
+			build: func(q *query) *query { return q.filter("name", opEq, "x'; DROP TABLE users; --") },
+			sql:   `SELECT id FROM t WHERE name = $1`,
+			args:  []any{"x'; DROP TABLE users; --"},
+		},
+		{
+			name: "any of several fields shares one parameter",
+			build: func(q *query) *query {
+				return q.filterAny([]string{"name", "email"}, opLike, "%a%").filter("id", opGt, 7)
+			},
+			sql:  `SELECT id FROM t WHERE (name ILIKE $1 OR email ILIKE $1) AND id > $2`,
+			args: []any{"%a%", 7},
+		},
+		{
+			name: "sort order",
+			build: func(q *query) *query {
+				return q.orderByMatch([]string{"name"}, opLike, "a%").orderBy("email", true).orderBy("id", false)
+			},
+			sql:  `SELECT id FROM t ORDER BY name ILIKE $1 DESC, email DESC, id`,
+			args: []any{"a%"},
+		},
+		{
+			name: "placeholders are numbered in order, limit and offset last",
+			build: func(q *query) *query {
+				return q.page(10, 20).orderByMatch([]string{"name"}, opLike, "b%").filter("id", opGt, 3).require("deleted IS NULL")
+			},
+			sql:  `SELECT id FROM t WHERE id > $2 AND deleted IS NULL ORDER BY name ILIKE $1 DESC LIMIT $3 OFFSET $4`,
+			args: []any{"b%", 3, 10, 20},
+		},
+		{
+			name:  "no limit",
+			build: func(q *query) *query { return q.page(0, 0) },
+			sql:   `SELECT id FROM t`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sql, args, err := test.build(newQuery(`SELECT id FROM t`, testFields)).build()
+			if err != nil {
+				t.Fatalf("build failed: %v", err)
+			}
+			if sql != test.sql {
+				t.Errorf("got SQL %q, want %q", sql, test.sql)
+			}
+			if len(args) != len(test.args) || (len(args) > 0 && !reflect.DeepEqual(args, test.args)) {
+				t.Errorf("got args %#v, want %#v", args, test.args)
+			}
+		})
+	}
+}
+
+// TestQueryRejects checks that names and operators we don't know are refused, rather than ending up in the SQL.
+func TestQueryRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(q *query) *query
+		invalid bool // Whether the mistake is the caller's (a bad field in a request), rather than ours
+	}{
+		{"unknown filter field", func(q *query) *query { return q.filter("password", opEq, "x") }, true},
+		{"injection as a filter field", func(q *query) *query { return q.filter("id = id OR 1", opEq, 1) }, true},
+		{"unknown of several fields", func(q *query) *query { return q.filterAny([]string{"id", "role"}, opEq, 1) }, true},
+		{"unknown sort field", func(q *query) *query { return q.orderBy("passwordhash", false) }, true},
+		{"injection as a sort field", func(q *query) *query { return q.orderBy("id; DROP TABLE users", true) }, true},
+		{"unknown match sort field", func(q *query) *query { return q.orderByMatch([]string{"role"}, opLike, "a%") }, true},
+		{"negative offset", func(q *query) *query { return q.page(10, -1) }, true},
+		{"too few condition values", func(q *query) *query { return q.require("id = ? OR id = ?", 1) }, false},
+		{"too many condition values", func(q *query) *query { return q.require("deleted IS NULL", 1) }, false},
+		{"unknown operator", func(q *query) *query { return q.filter("id", operator("LIKE"), 1) }, false},
+		{"injection as an operator", func(q *query) *query { return q.filter("id", operator("= 1 OR 1 ="), 1) }, false},
+		{"first mistake kept", func(q *query) *query { return q.orderBy("x", false).filter("id", operator("~"), 1) }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sql, args, err := test.build(newQuery(`SELECT id FROM t`, testFields)).build()
+			if err == nil {
+				t.Fatalf("built %q %v, want an error", sql, args)
+			}
+			if invalid := errors.Is(err, errs.Invalid); invalid != test.invalid {
+				t.Errorf("got error %v, invalid %v, want invalid %v", err, invalid, test.invalid)
+			}
+		})
+	}
+}
+
+// TestLikePattern checks wildcards in what's searched for are matched literally.
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", `%%`},
+		{"bob", `%bob%`},
+		{"50%", `%50\%%`},
+		{"a_b", `%a\_b%`},
+		{`back\slash`, `%back\\slash%`},
+		{`\%_`, `%\\\%\_%`},
+	}
+	for _, test := range tests {
+		if got := likePattern(test.in); got != test.want {
+			t.Errorf("likePattern(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
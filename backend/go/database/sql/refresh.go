@@ -0,0 +1,97 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// CreateRefreshToken implements Storer, stores a new unused refresh token.
+func (db *DB) CreateRefreshToken(in *database.RefreshToken) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO refreshtokens(tokenhash, familyid, userid, expires, remember) VALUES ($1, $2, $3, $4, $5)`,
+		in.TokenHash,
+		in.FamilyID,
+		in.UserID,
+		clock.Value(in.Expires),
+		in.Remember,
+	)
+	return wrap(err, "sql.CreateRefreshToken")
+}
+
+// RotateRefreshToken implements Storer, swapping a refresh token for its replacement. The old token is only marked as
+// used rather than deleted, so we can still recognise it (and catch whoever copied it) if it's presented again.
+func (db *DB) RotateRefreshToken(oldHash, newHash []byte) (database.RefreshToken, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.RefreshToken{}, wrap(err, "sql.RotateRefreshToken")
+	}
+	defer tx.Rollback()
+
+	// Lock the old token, so two requests racing to rotate it can't both succeed
+	old := database.RefreshToken{TokenHash: oldHash}
+	var used bool
+	err = tx.QueryRow(
+		`SELECT familyid, userid, expires, remember, used FROM refreshtokens WHERE tokenhash = $1 AND expires > current_timestamp FOR UPDATE`,
+		oldHash,
+	).Scan(&old.FamilyID, &old.UserID, clock.Scan(&old.Expires), &old.Remember, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.RefreshToken{}, wrap(database.ErrNotFound, "sql.RotateRefreshToken")
+	}
+	if err != nil {
+		return database.RefreshToken{}, wrap(err, "sql.RotateRefreshToken")
+	}
+	if used {
+		return old, wrap(database.ErrRefreshTokenReused, "sql.RotateRefreshToken")
+	}
+
+	if _, err := tx.Exec(`UPDATE refreshtokens SET used = TRUE WHERE tokenhash = $1`, oldHash); err != nil {
+		return database.RefreshToken{}, wrap(err, "sql.RotateRefreshToken")
+	}
+	// The replacement expires with the rest of its family, rotating never extends how long a login lasts
+	next := old
+	next.TokenHash = newHash
+	if _, err := tx.Exec(
+		`INSERT INTO refreshtokens(tokenhash, familyid, userid, expires, remember) VALUES ($1, $2, $3, $4, $5)`,
+		next.TokenHash,
+		next.FamilyID,
+		next.UserID,
+		clock.Value(next.Expires),
+		next.Remember,
+	); err != nil {
+		return database.RefreshToken{}, wrap(err, "sql.RotateRefreshToken")
+	}
+	return next, wrap(tx.Commit(), "sql.RotateRefreshToken")
+}
+
+// RevokeRefreshFamily implements Storer, deleting a refresh token family along with every session created from it.
+func (db *DB) RevokeRefreshFamily(familyID string) ([]int64, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return nil, wrap(err, "sql.RevokeRefreshFamily")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM sessions WHERE refreshfamily = $1 RETURNING id`, familyID)
+	if err != nil {
+		return nil, wrap(err, "sql.RevokeRefreshFamily")
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, wrap(err, "sql.RevokeRefreshFamily")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrap(err, "sql.RevokeRefreshFamily")
+	}
+
+	if _, err := tx.Exec(`DELETE FROM refreshtokens WHERE familyid = $1`, familyID); err != nil {
+		return nil, wrap(err, "sql.RevokeRefreshFamily")
+	}
+	return ids, wrap(tx.Commit(), "sql.RevokeRefreshFamily")
+}
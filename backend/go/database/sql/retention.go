@@ -0,0 +1,20 @@
+package sql
+
+import "time"
+
+// purge deletes rows from table whose column is before the given time, or with dryRun only counts them. Both table and
+// column are always constants from our own code, never anything a user supplied, so building the query from them is
+// safe.
+func (db *DB) purge(table, column string, before time.Time, dryRun bool, op string) (int, error) {
+	if dryRun {
+		var n int
+		err := db.storage.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE `+column+` < $1`, before).Scan(&n)
+		return n, wrap(err, op)
+	}
+	result, err := db.storage.Exec(`DELETE FROM `+table+` WHERE `+column+` < $1`, before)
+	if err != nil {
+		return 0, wrap(err, op)
+	}
+	n, err := result.RowsAffected()
+	return int(n), wrap(err, op)
+}
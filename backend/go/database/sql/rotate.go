@@ -0,0 +1,115 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// When our database password is rotated, we need to start using the new one without restarting (and dropping every
+// request in flight). RotateCredentials swaps in a new database URL, which every connection opened from then on uses.
+// Connections already open with the old credentials carry on with whatever they're doing, and are closed as they're
+// returned to the pool rather than reused, so the pool drains over to the new credentials gradually. The old password
+// needs to keep working until that's done, which is usually a matter of seconds.
+
+// rotatingConnector opens connections with whichever failoverConnector it currently has, implementing driver.Connector.
+type rotatingConnector struct {
+	mu         sync.RWMutex
+	current    *failoverConnector
+	generation atomic.Uint64 // Increased on each rotation, connections from an earlier generation are stale
+}
+
+// newRotatingConnector creates a rotatingConnector, starting out with the given connector.
+func newRotatingConnector(c *failoverConnector) *rotatingConnector {
+	return &rotatingConnector{current: c}
+}
+
+// Connect implements driver.Connector.
+func (r *rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	r.mu.RLock()
+	c, generation := r.current, r.generation.Load()
+	r.mu.RUnlock()
+	conn, err := c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(pqConn)
+	if !ok {
+		// Never expected, pq's connections implement all of these
+		conn.Close()
+		return nil, errors.New("connection doesn't support the interfaces we need")
+	}
+	return &generationConn{pqConn: pc, generation: generation, rotator: r}, nil
+}
+
+// Driver implements driver.Connector.
+func (r *rotatingConnector) Driver() driver.Driver {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.Driver()
+}
+
+// rotate swaps in a new connector, marking every connection opened before now as stale.
+func (r *rotatingConnector) rotate(c *failoverConnector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = c
+	r.generation.Add(1)
+}
+
+// pqConn is everything database/sql makes use of on pq's connections. Our wrapper needs to implement each of these too,
+// or database/sql would fall back to slower ways of doing things (such as preparing every query).
+type pqConn interface {
+	driver.Conn
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// generationConn is a connection that knows which generation of credentials it was opened with.
+type generationConn struct {
+	pqConn
+	generation uint64
+	rotator    *rotatingConnector
+}
+
+// stale reports whether the connection was opened before our credentials were last rotated.
+func (c *generationConn) stale() bool {
+	return c.generation != c.rotator.generation.Load()
+}
+
+// ResetSession implements driver.SessionResetter, database/sql calls this before reusing a connection from the pool.
+func (c *generationConn) ResetSession(ctx context.Context) error {
+	if c.stale() {
+		return driver.ErrBadConn
+	}
+	return c.pqConn.ResetSession(ctx)
+}
+
+// IsValid implements driver.Validator, database/sql calls this before putting a connection back in the pool.
+func (c *generationConn) IsValid() bool {
+	return !c.stale() && c.pqConn.IsValid()
+}
+
+// RotateCredentials switches our connection pool over to a new database URL (with new credentials, or even new hosts),
+// without interrupting queries in flight. A connection is opened with the new URL first, so a bad URL is reported and
+// we carry on with the old one.
+func (db *DB) RotateCredentials(ctx context.Context, url string) error {
+	next, err := newFailoverConnector(url)
+	if err != nil {
+		return wrap(err, "sql.RotateCredentials")
+	}
+	conn, err := next.Connect(ctx)
+	if err != nil {
+		return wrap(err, "sql.RotateCredentials")
+	}
+	conn.Close()
+	db.connector.rotate(next)
+	return nil
+}
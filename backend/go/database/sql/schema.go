@@ -0,0 +1,71 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// createTable matches each CREATE TABLE statement in our migrations, capturing the table name and its body
+var createTable = regexp.MustCompile(`(?s)CREATE TABLE (\w+) \((.*?)\n\);`)
+
+// addColumn matches each column added to an existing table in our migrations, capturing the table and column names
+var addColumn = regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+
+// expectedColumns reads our migrations, returning the columns of each table they create, and each column they add to
+// a table afterwards. Only columns are checked, so migrations removing tables or columns aren't followed.
+func expectedColumns() map[string][]string {
+	tables := make(map[string][]string)
+	for _, m := range ourMigrations {
+		for _, match := range createTable.FindAllStringSubmatch(m.up, -1) {
+			for _, line := range strings.Split(match[2], "\n") {
+				fields := strings.Fields(line)
+				// Skip blank lines, comments and table constraints, everything else starts with a column name
+				if len(fields) == 0 || strings.HasPrefix(fields[0], "--") || strings.EqualFold(fields[0], "PRIMARY") {
+					continue
+				}
+				tables[match[1]] = append(tables[match[1]], fields[0])
+			}
+		}
+		for _, match := range addColumn.FindAllStringSubmatch(m.up, -1) {
+			tables[match[1]] = append(tables[match[1]], match[2])
+		}
+	}
+	return tables
+}
+
+// CheckSchema compares our database against our migrations, returning an error listing any tables or columns it's
+// missing. This catches a database that hasn't had our newest migrations applied yet (see Migrate).
+func (db *DB) CheckSchema() error {
+	rows, err := db.storage.Query(`SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`)
+	if err != nil {
+		return wrap(err, "sql.CheckSchema")
+	}
+	defer rows.Close()
+	have := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return wrap(err, "sql.CheckSchema")
+		}
+		have[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return wrap(err, "sql.CheckSchema")
+	}
+
+	var missing []string
+	for table, columns := range expectedColumns() {
+		for _, column := range columns {
+			if !have[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("database is missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// securityEventLock is the advisory lock held while adding a security event. Each event is chained to the latest one,
+// so adding them has to happen one at a time, otherwise two events could both chain to the same predecessor.
+const securityEventLock = 0x5ec0e7
+
+// CreateSecurityEvent implements Storer, chains the event to the latest one, and adds it to the security event log.
+func (db *DB) CreateSecurityEvent(in *database.SecurityEvent) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.CreateSecurityEvent")
+	}
+	defer tx.Rollback()
+	// Held until the transaction ends
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, securityEventLock); err != nil {
+		return wrap(err, "sql.CreateSecurityEvent")
+	}
+	prev := []byte{}
+	err = tx.QueryRow(`SELECT hash FROM securityevents ORDER BY id DESC LIMIT 1`).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return wrap(err, "sql.CreateSecurityEvent")
+	}
+
+	// We keep times to the millisecond (see the clock package), so we hash the time as it will be read back
+	in.Time = clock.UTC(in.Time)
+	in.PrevHash = prev
+	in.Hash = in.ChainHash(prev)
+	err = tx.QueryRow(
+		`INSERT INTO securityevents(time, kind, userid, ip, detail, prevhash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		in.Time,
+		in.Kind,
+		in.UserID,
+		in.IP,
+		in.Detail,
+		in.PrevHash,
+		in.Hash,
+	).Scan(&in.ID)
+	if err != nil {
+		return wrap(err, "sql.CreateSecurityEvent")
+	}
+	return wrap(tx.Commit(), "sql.CreateSecurityEvent")
+}
+
+// ListSecurityEvents implements Storer, lists security events after the given ID, oldest first
+func (db *DB) ListSecurityEvents(afterID int64, limit int) ([]database.SecurityEvent, error) {
+	rows, err := db.storage.Query(
+		`SELECT id, time, kind, userid, ip, detail, prevhash, hash FROM securityevents WHERE id > $1 ORDER BY id LIMIT $2`,
+		afterID,
+		limit,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.ListSecurityEvents")
+	}
+	defer rows.Close()
+	var events []database.SecurityEvent
+	for rows.Next() {
+		var e database.SecurityEvent
+		if err := rows.Scan(&e.ID, &e.Time, &e.Kind, &e.UserID, &e.IP, &e.Detail, &e.PrevHash, &e.Hash); err != nil {
+			return nil, wrap(err, "sql.ListSecurityEvents")
+		}
+		// Events from before we kept times to the millisecond were hashed to the microsecond, so the time is read as
+		// it is rather than with clock.Scan, which would break their hashes
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	return events, wrap(rows.Err(), "sql.ListSecurityEvents")
+}
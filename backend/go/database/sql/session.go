@@ -1,72 +1,299 @@
 package sql
 
 import (
+	"database/sql"
+	"errors"
+	"examples/clock"
 	"examples/database"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// sessionColumns lists the columns we select for a Session, in the order scanSession expects them
+const sessionColumns = `id, tokenhash, userid, encryptedcreds, created, expiration, endoflife, ip, refreshfamily, remember, useragent, lastseen, lastip, impersonator`
+
+// Our session queries run on nearly every request, so are prepared (see hotQueries)
+const (
+	saveSessionQuery        = `INSERT INTO sessions(tokenhash, userid, encryptedcreds, created, expiration, endoflife, ip, refreshfamily, remember, useragent, lastseen, lastip, impersonator) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`
+	loadSessionQuery        = `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+	loadSessionByTokenQuery = `SELECT ` + sessionColumns + ` FROM sessions WHERE tokenhash = $1`
+)
+
+// scanSession reads a row selected with sessionColumns into a Session.
+func scanSession(row interface{ Scan(dest ...any) error }) (database.Session, error) {
+	var session database.Session
+	err := row.Scan(
+		&session.ID,
+		&session.TokenHash,
+		&session.UserID,
+		&session.EncryptedCreds,
+		clock.Scan(&session.Created),
+		clock.Scan(&session.Expires),
+		clock.Scan(&session.EndOfLife),
+		&session.IP,
+		&session.RefreshFamily,
+		&session.Remember,
+		&session.UserAgent,
+		clock.Scan(&session.LastSeen),
+		&session.LastIP,
+		&session.ImpersonatorID,
+	)
+	return session, err
+}
+
 // SaveSession implements Storer, inserts a Session into the database, and also updates the ID field with the ID that is returned from insertion.
 func (db *DB) SaveSession(in *database.Session) error {
+	// A new session was last seen when it was created, from where it was created
+	if in.LastSeen.IsZero() {
+		in.LastSeen = in.Created
+	}
+	if in.LastIP == "" {
+		in.LastIP = in.IP
+	}
 	// Insert session into database, and update the session with returned ID
-	return db.storage.QueryRow(`INSERT INTO sessions(encryptedcreds, expiration, endoflife) VALUES ($1, $2, $3) RETURNING id`,
+	err := db.queryRow(saveSessionQuery,
+		in.TokenHash,
+		in.UserID,
 		in.EncryptedCreds,
-		in.Expires,
-		in.EndOfLife,
+		clock.Value(in.Created),
+		clock.Value(in.Expires),
+		clock.Value(in.EndOfLife),
+		in.IP,
+		in.RefreshFamily,
+		in.Remember,
+		in.UserAgent,
+		clock.Value(in.LastSeen),
+		in.LastIP,
+		in.ImpersonatorID,
 	).Scan(&in.ID)
+	return wrap(err, "sql.SaveSession")
 }
 
 // LoadSession implements Storer, retrieves a Session from the database by ID.
 func (db *DB) LoadSession(id int64) (database.Session, error) {
-	// Prepare session
-	var session database.Session
 	// Load the first record that is found (Since we're querying by ID, this should only ever return 1 anyway, and an error if not found)
-	err := db.storage.QueryRow(
-		`SELECT * FROM sessions WHERE id = $1`,
-		id,
-	).Scan(
-		&session.ID,
-		&session.EncryptedCreds,
-		&session.Expires,
-		&session.EndOfLife,
-	)
-	if err != nil {
+	session, err := scanSession(db.queryRow(loadSessionQuery, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		// Most common error is simply no rows, return an empty session, and our not found error
-		return database.Session{}, database.ErrNotFound
-		// TODO (IME): There are other possible errors that can be returned, however for this demo, this is perfectly fine.
-		// We may wish to handle other errors differently (For example if we can't reach our database, we may wish to return
-		// a 500 or a 503 status to the frontend denote the user isn't doing anything wrong.)
+		return database.Session{}, wrap(database.ErrNotFound, "sql.LoadSession")
+	}
+	if err != nil {
+		// Anything else means something went wrong talking to our database, the user isn't doing anything wrong
+		return database.Session{}, wrap(err, "sql.LoadSession")
 	}
 	// Return session
 	return session, nil
 }
 
+// LoadSessionByToken implements Storer, retrieves a Session from the database by the hash of its bearer token.
+func (db *DB) LoadSessionByToken(tokenHash []byte) (database.Session, error) {
+	session, err := scanSession(db.queryRow(loadSessionByTokenQuery, tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.Session{}, wrap(database.ErrNotFound, "sql.LoadSessionByToken")
+	}
+	if err != nil {
+		return database.Session{}, wrap(err, "sql.LoadSessionByToken")
+	}
+	return session, nil
+}
+
+// ListSessionsByUser implements Storer, retrieves every unexpired Session belonging to a User. Expired sessions may
+// linger until ClearExpiredSessions next runs, so they're filtered out here rather than shown as if still active.
+func (db *DB) ListSessionsByUser(userID int64) ([]database.Session, error) {
+	rows, err := db.storage.Query(
+		`SELECT `+sessionColumns+` FROM sessions
+		WHERE userid = $1 AND expiration > current_timestamp AND endoflife > current_timestamp
+		ORDER BY created DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.ListSessionsByUser")
+	}
+	defer rows.Close()
+	var sessions []database.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListSessionsByUser")
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, wrap(rows.Err(), "sql.ListSessionsByUser")
+}
+
 // LogoutSession implements Storer, deletes a Session from the database by ID.
 func (db *DB) LogoutSession(id int64) error {
 	// Delete session record from database, here we intentionally discard the returned output, as we only care if there was an error.
 	_, err := db.storage.Exec(`DELETE FROM sessions WHERE id = $1`, id)
-	return err
+	return wrap(err, "sql.LogoutSession")
 }
 
 // ExtendSession implements Storer, updates a Session record to have a new expiration. We intentially discard returned output as we are
 // only concerned if there was an error.
 func (db *DB) ExtendSession(id int64, lifespan time.Duration) error {
-	// Refresh the expiration
+	// Refresh the expiration, never pushing it past the session's end of life
 	_, err := db.storage.Exec(
-		`UPDATE sessions SET expiration = $1 WHERE id = $2`,
-		time.Now().Add(lifespan),
+		`UPDATE sessions SET expiration = LEAST($1, endoflife) WHERE id = $2`,
+		clock.Now().Add(lifespan),
 		id,
 	)
-	return err
+	return wrap(err, "sql.ExtendSession")
+}
+
+// TouchSession implements Storer, records when and where a Session was last used.
+func (db *DB) TouchSession(id int64, seen time.Time, ip, userAgent string) error {
+	_, err := db.storage.Exec(
+		`UPDATE sessions SET lastseen = $1, lastip = $2, useragent = $3 WHERE id = $4`,
+		clock.Value(seen),
+		ip,
+		userAgent,
+		id,
+	)
+	return wrap(err, "sql.TouchSession")
+}
+
+// ListSessionsAfter implements Storer, retrieves a page of unexpired Sessions in ID order.
+func (db *DB) ListSessionsAfter(afterID int64, limit int) ([]database.Session, error) {
+	rows, err := db.storage.Query(
+		`SELECT `+sessionColumns+` FROM sessions
+		WHERE id > $1 AND expiration > current_timestamp AND endoflife > current_timestamp
+		ORDER BY id LIMIT $2`,
+		afterID,
+		limit,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.ListSessionsAfter")
+	}
+	defer rows.Close()
+	var sessions []database.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListSessionsAfter")
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, wrap(rows.Err(), "sql.ListSessionsAfter")
+}
+
+// UpdateSessionCreds implements Storer, replaces a Session's encrypted credentials.
+func (db *DB) UpdateSessionCreds(id int64, encryptedCreds []byte) error {
+	return wrap(expectRows(db.storage.Exec(`UPDATE sessions SET encryptedcreds = $1 WHERE id = $2`, encryptedCreds, id)), "sql.UpdateSessionCreds")
 }
 
 // ClearExpiredSessions implements Storer, deletes any Session records that are expired. Ideally this would be called from a background task
-// at regular intervals to keep the database free of useless records.
+// at regular intervals to keep the database free of useless records. Expired refresh tokens are cleared too, though
+// they aren't counted.
 func (db *DB) ClearExpiredSessions() (int, error) {
+	if _, err := db.storage.Exec(`DELETE FROM refreshtokens WHERE expires < current_timestamp`); err != nil {
+		return 0, wrap(err, "sql.ClearExpiredSessions")
+	}
 	// Delete expired session records from database
 	result, err := db.storage.Exec(`DELETE FROM sessions WHERE expiration < current_timestamp OR endoflife < current_timestamp`)
 	if err != nil {
-		return 0, nil
+		return 0, wrap(err, "sql.ClearExpiredSessions")
 	}
 	ra, err := result.RowsAffected()
-	return int(ra), err
+	return int(ra), wrap(err, "sql.ClearExpiredSessions")
+}
+
+// DeleteUserSessions implements Storer, deletes every session and refresh token belonging to a User.
+func (db *DB) DeleteUserSessions(userID int64) ([]int64, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return nil, wrap(err, "sql.DeleteUserSessions")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM refreshtokens WHERE userid = $1`, userID); err != nil {
+		return nil, wrap(err, "sql.DeleteUserSessions")
+	}
+	rows, err := tx.Query(`DELETE FROM sessions WHERE userid = $1 RETURNING id`, userID)
+	if err != nil {
+		return nil, wrap(err, "sql.DeleteUserSessions")
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, wrap(err, "sql.DeleteUserSessions")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrap(err, "sql.DeleteUserSessions")
+	}
+	return ids, wrap(tx.Commit(), "sql.DeleteUserSessions")
+}
+
+// sessionFields are the fields sessions can be filtered and sorted by. IPs are stored as text (and may be empty), so
+// they're only cast to compare with a range once we know there's something to cast.
+var sessionFields = fields{
+	"id":      "id",
+	"userid":  "userid",
+	"created": "created",
+	"ip":      "NULLIF(ip, '')::inet",
+}
+
+// RevokeSessions implements Storer, deletes a batch of sessions matching a filter along with their refresh token
+// families. Keeping each batch small means we never hold locks on a large part of the sessions table at once.
+func (db *DB) RevokeSessions(filter database.SessionFilter, limit int) ([]int64, error) {
+	// Each criterion is only applied when set
+	q := newQuery(`SELECT id FROM sessions`, sessionFields)
+	if len(filter.UserIDs) > 0 {
+		q.filter("userid", opIn, filter.UserIDs)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		q.filter("created", opLt, filter.CreatedBefore)
+	}
+	if filter.IPRange.IsValid() {
+		q.filter("ip", opWithin, filter.IPRange.Masked().String())
+	}
+	selected, args, err := q.page(limit, 0).build()
+	if err != nil {
+		return nil, wrap(err, "sql.RevokeSessions")
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return nil, wrap(err, "sql.RevokeSessions")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM sessions WHERE id IN (`+selected+`) RETURNING id, refreshfamily`, args...)
+	if err != nil {
+		return nil, wrap(err, "sql.RevokeSessions")
+	}
+	var (
+		ids      []int64
+		families []string
+	)
+	for rows.Next() {
+		var (
+			id     int64
+			family string
+		)
+		if err := rows.Scan(&id, &family); err != nil {
+			rows.Close()
+			return nil, wrap(err, "sql.RevokeSessions")
+		}
+		ids = append(ids, id)
+		if family != "" {
+			families = append(families, family)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrap(err, "sql.RevokeSessions")
+	}
+
+	if len(families) > 0 {
+		if _, err := tx.Exec(`DELETE FROM refreshtokens WHERE familyid = ANY($1)`, pq.Array(families)); err != nil {
+			return nil, wrap(err, "sql.RevokeSessions")
+		}
+	}
+	return ids, wrap(tx.Commit(), "sql.RevokeSessions")
 }
@@ -0,0 +1,115 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Provision brings the database up to date by applying our migrations (see Migrate), reporting whether it created our
+// tables (it checks for our users table first). This is how new shards are set up (see cmd/shards).
+func (db *DB) Provision() (bool, error) {
+	var exists bool
+	if err := db.storage.QueryRow(`SELECT to_regclass('users') IS NOT NULL`).Scan(&exists); err != nil {
+		return false, wrap(err, "sql.Provision")
+	}
+	if _, err := db.Migrate(); err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// shardSequence describes one of our ID sequences, as PrepareShard and CheckShard see it.
+type shardSequence struct {
+	name      string
+	increment int64
+	next      int64 // The ID it will hand out next
+}
+
+// sequences lists every sequence our tables use for their IDs.
+func (db *DB) sequences() ([]shardSequence, error) {
+	rows, err := db.storage.Query(`SELECT sequencename, increment_by FROM pg_sequences WHERE schemaname = current_schema() ORDER BY sequencename`)
+	if err != nil {
+		return nil, err
+	}
+	var sequences []shardSequence
+	for rows.Next() {
+		var seq shardSequence
+		if err := rows.Scan(&seq.name, &seq.increment); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sequences = append(sequences, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A sequence that's never been used (or was just set) hands out its last value next, rather than the one after
+	for i, seq := range sequences {
+		var (
+			last   int64
+			called bool
+		)
+		if err := db.storage.QueryRow(`SELECT last_value, is_called FROM `+pq.QuoteIdentifier(seq.name)).Scan(&last, &called); err != nil {
+			return nil, err
+		}
+		sequences[i].next = last
+		if called {
+			sequences[i].next = last + seq.increment
+		}
+	}
+	return sequences, nil
+}
+
+// PrepareShard sets up our database as shard index of count (see database/sharded), so every ID it hands out from now
+// on is in its own residue class: ID % count == index. Each sequence steps by count, starting from the first such ID
+// after any it has already handed out, so it's safe to run again, and on a database that already has data (which keeps
+// its IDs, so only makes sense for the first shard, or before the shard holds any Users).
+func (db *DB) PrepareShard(index, count int) error {
+	if count < 1 || index < 0 || index >= count {
+		return fmt.Errorf("shard %d of %d doesn't exist", index, count)
+	}
+	sequences, err := db.sequences()
+	if err != nil {
+		return wrap(err, "sql.PrepareShard")
+	}
+	n := int64(count)
+	for _, seq := range sequences {
+		// Round up to the next ID in our residue class
+		next := seq.next + (int64(index)-seq.next%n+n)%n
+		if next < 1 {
+			next += n
+		}
+		name := pq.QuoteIdentifier(seq.name)
+		if _, err := db.storage.Exec(fmt.Sprintf(`ALTER SEQUENCE %s INCREMENT BY %d`, name, n)); err != nil {
+			return wrap(err, "sql.PrepareShard")
+		}
+		if _, err := db.storage.Exec(`SELECT setval($1::regclass, $2, false)`, name, next); err != nil {
+			return wrap(err, "sql.PrepareShard")
+		}
+	}
+	return nil
+}
+
+// CheckShard checks our database has been prepared as shard index of count by PrepareShard, returning an error listing
+// any sequences that would hand out IDs belonging to another shard. Routing Users by ID depends on this, so we check
+// every shard before using it.
+func (db *DB) CheckShard(index, count int) error {
+	sequences, err := db.sequences()
+	if err != nil {
+		return wrap(err, "sql.CheckShard")
+	}
+	var wrong []string
+	for _, seq := range sequences {
+		if seq.increment != int64(count) || seq.next%int64(count) != int64(index) {
+			wrong = append(wrong, seq.name)
+		}
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("database isn't prepared as shard %d of %d, check sequences %s", index, count, strings.Join(wrong, ", "))
+	}
+	return nil
+}
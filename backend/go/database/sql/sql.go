@@ -2,31 +2,215 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
 
 	// Load postgres driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// unavailableRetryAfter is how long we suggest callers wait before retrying when our database can't be reached.
+// Most outages we see are brief (a restart or failover), so a few seconds is a reasonable guess.
+const unavailableRetryAfter = 5 * time.Second
+
 // DB implements Storer using a PostGreSQL database.
 type DB struct {
-	storage *sql.DB // Here we simply refer to it as "storage" to avoid common naming conflicts
+	storage    querier            // Here we simply refer to it as "storage" to avoid common naming conflicts
+	pool       *sql.DB            // Our connections, storage is the same unless we're part of a transaction (see WithTx)
+	tx         *sql.Tx            // The transaction we're part of, nil unless we were handed to a WithTx callback
+	connector  *rotatingConnector // Opens storage's connections, see RotateCredentials
+	statements *statements        // Our hot queries prepared, nil if we don't prepare them (see Pool.NoPrepare)
+}
+
+// querier runs our queries, either our connection pool (a *sql.DB) or a transaction (a *sql.Tx).
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Pool limits our pool of database connections. Left to itself database/sql opens as many connections as there are
+// queries in flight and keeps them forever, which under load can open more than our database (or PgBouncer in front of
+// it) allows, and keeps using connections to a server long after it's been replaced. A zero field is left at
+// database/sql's default.
+type Pool struct {
+	MaxOpen     int           // Most connections open at once, in use or idle
+	MaxIdle     int           // Most idle connections kept open for reuse, no more than MaxOpen
+	MaxLifetime time.Duration // Connections are closed once they're this old, even if they're still being reused
+	MaxIdleTime time.Duration // Idle connections are closed once they've been idle this long
+	// NoPrepare runs our hot queries unprepared (see hotQueries). Prepared statements belong to a connection, so they
+	// don't work behind PgBouncer in transaction pooling mode (before 1.21), which hands each transaction any connection.
+	NoPrepare bool
+}
+
+// apply sets the pool's limits on db.
+func (p Pool) apply(db *sql.DB) {
+	if p.MaxOpen > 0 {
+		db.SetMaxOpenConns(p.MaxOpen)
+	}
+	if p.MaxIdle > 0 {
+		db.SetMaxIdleConns(p.MaxIdle)
+	}
+	if p.MaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.MaxLifetime)
+	}
+	if p.MaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.MaxIdleTime)
+	}
 }
 
-// NewSQLDB creates a new database connection for use.
-func NewSQLDB(url string) (*DB, error) {
+// Retry is how NewSQLDB waits for a database that can't be reached yet, such as one starting up alongside us in a
+// container environment. After each failed attempt we wait for up to Base, doubling after each further failure up to
+// Max. Half of each wait is random (jitter), so instances starting together don't all retry in step. The zero Retry
+// tries once.
+type Retry struct {
+	Attempts int           // Most attempts to connect, including the first
+	Base     time.Duration // Longest wait after the first failed attempt
+	Max      time.Duration // Longest wait after any attempt
+	// OnRetry, if set, is called before each wait with why the attempt failed, so callers can say what we're waiting on
+	OnRetry func(err error, wait time.Duration)
+}
+
+// wait returns how long to wait after the given failed attempt, counting from 1.
+func (r Retry) wait(attempt int) time.Duration {
+	limit := r.Base
+	for i := 1; i < attempt && limit < r.Max; i++ {
+		limit *= 2
+	}
+	limit = min(limit, r.Max)
+	return limit/2 + time.Duration(rand.Int63n(int64(limit/2)+1))
+}
+
+// NewSQLDB creates a new database connection for use, with its pool limited by pool. The URL may list several hosts,
+// see failover.go. If the database can't be reached, we try again as retry allows. Any other error (such as our
+// credentials being refused) won't fix itself, so is returned straight away.
+func NewSQLDB(url string, pool Pool, retry Retry) (*DB, error) {
 	// Connect to database with supplied URL
-	db, err := sql.Open("postgres", url)
+	failover, err := newFailoverConnector(url)
 	if err != nil {
 		return nil, err
 	}
+	connector := newRotatingConnector(failover)
+	db := sql.OpenDB(connector)
+	pool.apply(db)
 	// Ensure connection is usable
-	if err := db.Ping(); err != nil {
-		db.Close()
-		return nil, err
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			break
+		}
+		if attempt >= retry.Attempts || !unavailable(err) {
+			db.Close()
+			return nil, err
+		}
+		wait := retry.wait(attempt)
+		if retry.OnRetry != nil {
+			retry.OnRetry(err, wait)
+		}
+		time.Sleep(wait)
+	}
+	var prepared *statements
+	if !pool.NoPrepare {
+		prepared = &statements{prepared: make(map[string]*sql.Stmt)}
+		prepared.prepare(db)
 	}
 	// Usable connection, return it for use
-	return &DB{storage: db}, nil
+	return &DB{storage: db, pool: db, connector: connector, statements: prepared}, nil
+}
+
+// Ping implements Storer, checks that our database connection is still usable.
+func (db *DB) Ping() error {
+	if err := db.pool.Ping(); err != nil {
+		return &errs.Error{Code: errs.Unavailable, Op: "sql.Ping", Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	return nil
+}
+
+// Warm opens n connections ahead of time, so the first requests we serve don't each wait on a new one. They're handed
+// back to our pool for reuse, which keeps up to Pool.MaxIdle of them.
+func (db *DB) Warm(ctx context.Context, n int) error {
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	// Each connection is held until we're done, otherwise the next would simply reuse it
+	for i := 0; i < n; i++ {
+		conn, err := db.pool.Conn(ctx)
+		if err != nil {
+			return wrap(err, "sql.Warm")
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return wrap(err, "sql.Warm")
+		}
+	}
+	return nil
+}
+
+// expectRows checks the result of an UPDATE or DELETE affected at least one row, returning our not found error if not.
+// It takes the error from Exec too, so it can be called directly on Exec's return values.
+func expectRows(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return database.ErrNotFound
+	}
+	return nil
+}
+
+// wrap attaches the failing operation to an error. Errors caused by being unable to reach our database are marked as
+// Unavailable, so the caller gets a 503 status (and knows to try again) rather than a generic 500 status.
+func wrap(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if unavailable(err) {
+		return &errs.Error{Code: errs.Unavailable, Op: op, Err: err, RetryAfter: unavailableRetryAfter}
+	}
+	// Unique constraints we expect to break are mapped to their own errors where they're broken, any others still
+	// conflict with an existing record rather than being our fault
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errs.Wrap(fmt.Errorf("%w: %v", database.ErrConflict, err), op)
+	}
+	return errs.Wrap(err, op)
+}
+
+// unavailable reports whether an error was caused by a problem reaching the database, rather than by the query itself.
+func unavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// Postgres error classes 08 (Connection Exception) and 57 (Operator Intervention, e.g. the server shutting down)
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57")
+}
+
+// uniqueViolation reports whether an error was caused by breaking the named unique constraint.
+func uniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
 }
 
 // Session and User methods can be found in their respective files (session.go, user.go)
@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// hotQueries are run for nearly every request: each authenticated request loads its session and its User, and each
+// login saves a session. We prepare them once rather than have them parsed and planned every time. pq also needs two
+// round trips to run a query with arguments that isn't prepared (one to have it parsed, one to run it), where a
+// prepared one takes one, which is most of what these queries cost.
+var hotQueries = []string{
+	loadSessionQuery,
+	loadSessionByTokenQuery,
+	saveSessionQuery,
+	getUserByIDQuery,
+	getUserByEmailQuery,
+	getUserByUsernameQuery,
+}
+
+// statements holds our hot queries, prepared. database/sql prepares each again on every connection it's used on, so
+// they survive connections being replaced (see Pool.MaxLifetime and RotateCredentials).
+type statements struct {
+	mu       sync.RWMutex
+	prepared map[string]*sql.Stmt // By query
+}
+
+// prepare prepares any of our hot queries that aren't already. A query that fails to prepare, usually because our
+// schema is behind and hasn't been migrated yet, is simply run unprepared, Migrate calls this again once it's done.
+func (s *statements) prepare(pool *sql.DB) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, query := range hotQueries {
+		if s.prepared[query] != nil {
+			continue
+		}
+		if stmt, err := pool.Prepare(query); err == nil {
+			s.prepared[query] = stmt
+		}
+	}
+}
+
+// get returns the prepared statement for a query, nil if it isn't one we've prepared.
+func (s *statements) get(query string) *sql.Stmt {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.prepared[query]
+}
+
+// queryRow runs a query expected to return at most one row, using its prepared statement if we have one. In a
+// transaction the statement is run on the transaction's connection.
+func (db *DB) queryRow(query string, args ...any) *sql.Row {
+	stmt := db.statements.get(query)
+	if stmt == nil {
+		return db.storage.QueryRow(query, args...)
+	}
+	if db.tx != nil {
+		return db.tx.Stmt(stmt).QueryRow(args...)
+	}
+	return stmt.QueryRow(args...)
+}
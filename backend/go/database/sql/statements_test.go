@@ -0,0 +1,78 @@
+package sql_test
+
+import (
+	"crypto/sha256"
+	"examples/database"
+	"examples/database/sql"
+	"testing"
+	"time"
+)
+
+// pools are the two ways of running our hot queries we compare: prepared once (our default), and parsed afresh on
+// every call (Pool.NoPrepare, for PgBouncer in transaction pooling mode).
+var pools = []struct {
+	name string
+	pool sql.Pool
+}{
+	{"prepared", sql.Pool{}},
+	{"unprepared", sql.Pool{NoPrepare: true}},
+}
+
+// connect opens a connection pool of our own to the embedded server, so each benchmark only measures its own kind of
+// query.
+func connect(b *testing.B, pool sql.Pool) *sql.DB {
+	b.Helper()
+	db, err := sql.NewSQLDB(pg.URL(), pool, sql.Retry{})
+	if err != nil {
+		b.Fatalf("connecting: %v", err)
+	}
+	return db
+}
+
+// BenchmarkGetUserByID compares loading a User with our prepared statement against the same query unprepared, the
+// lookup nearly every authenticated request makes.
+func BenchmarkGetUserByID(b *testing.B) {
+	user := database.User{First: "Bench", Last: "Mark", Email: "bench@example.com"}
+	if err := postgres(b).CreateUser(&user); err != nil {
+		b.Fatalf("creating user: %v", err)
+	}
+	for _, p := range pools {
+		b.Run(p.name, func(b *testing.B) {
+			db := connect(b, p.pool)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetUserByID(user.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoadSessionByToken compares loading a session by its token with our prepared statement against the same
+// query unprepared, the other lookup every authenticated request makes.
+func BenchmarkLoadSessionByToken(b *testing.B) {
+	db := postgres(b)
+	user := database.User{First: "Bench", Last: "Mark", Email: "bench@example.com"}
+	if err := db.CreateUser(&user); err != nil {
+		b.Fatalf("creating user: %v", err)
+	}
+	hash := sha256.Sum256([]byte("bench"))
+	now := time.Now()
+	session := database.Session{TokenHash: hash[:], UserID: user.ID, Created: now, Expires: now.Add(time.Hour),
+		EndOfLife: now.Add(time.Hour), IP: "127.0.0.1"}
+	if err := db.SaveSession(&session); err != nil {
+		b.Fatalf("saving session: %v", err)
+	}
+	for _, p := range pools {
+		b.Run(p.name, func(b *testing.B) {
+			db := connect(b, p.pool)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.LoadSessionByToken(hash[:]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
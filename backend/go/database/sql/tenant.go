@@ -0,0 +1,102 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// tenantSettingsColumns lists the columns we select for TenantSettings, in the order scanTenantSettings expects them
+const tenantSettingsColumns = `tenantid, idletimeout, maxlifetime, rememberidletimeout, rememberlifetime, passwordminlength, allowedorigins, updated`
+
+// scanTenantSettings reads a row selected with tenantSettingsColumns into TenantSettings. Durations are kept in seconds.
+func scanTenantSettings(row interface{ Scan(dest ...any) error }) (database.TenantSettings, error) {
+	var settings database.TenantSettings
+	var idle, max, rememberIdle, rememberMax int64
+	err := row.Scan(
+		&settings.TenantID,
+		&idle,
+		&max,
+		&rememberIdle,
+		&rememberMax,
+		&settings.PasswordMinLength,
+		pq.Array(&settings.AllowedOrigins),
+		clock.Scan(&settings.Updated),
+	)
+	settings.IdleTimeout = time.Duration(idle) * time.Second
+	settings.MaxLifetime = time.Duration(max) * time.Second
+	settings.RememberIdleTimeout = time.Duration(rememberIdle) * time.Second
+	settings.RememberLifetime = time.Duration(rememberMax) * time.Second
+	return settings, err
+}
+
+// GetTenantSettings implements Storer, retrieves the settings a tenant has overridden.
+func (db *DB) GetTenantSettings(tenantID int64) (database.TenantSettings, error) {
+	settings, err := scanTenantSettings(db.storage.QueryRow(
+		`SELECT `+tenantSettingsColumns+` FROM tenantsettings WHERE tenantid = $1`,
+		tenantID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.TenantSettings{}, wrap(database.ErrNotFound, "sql.GetTenantSettings")
+	}
+	if err != nil {
+		return database.TenantSettings{}, wrap(err, "sql.GetTenantSettings")
+	}
+	return settings, nil
+}
+
+// ListTenantSettings implements Storer, lists the settings of every tenant that has overridden any.
+func (db *DB) ListTenantSettings() ([]database.TenantSettings, error) {
+	rows, err := db.storage.Query(`SELECT ` + tenantSettingsColumns + ` FROM tenantsettings ORDER BY tenantid`)
+	if err != nil {
+		return nil, wrap(err, "sql.ListTenantSettings")
+	}
+	defer rows.Close()
+
+	var list []database.TenantSettings
+	for rows.Next() {
+		settings, err := scanTenantSettings(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListTenantSettings")
+		}
+		list = append(list, settings)
+	}
+	return list, wrap(rows.Err(), "sql.ListTenantSettings")
+}
+
+// SaveTenantSettings implements Storer, stores a tenant's settings, replacing any it had before.
+func (db *DB) SaveTenantSettings(in *database.TenantSettings) error {
+	in.Updated = clock.Now()
+	origins := in.AllowedOrigins
+	if origins == nil {
+		// A nil slice would be stored as NULL rather than an empty array
+		origins = []string{}
+	}
+	_, err := db.storage.Exec(
+		`INSERT INTO tenantsettings(tenantid, idletimeout, maxlifetime, rememberidletimeout, rememberlifetime,
+			passwordminlength, allowedorigins, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (tenantid) DO UPDATE SET idletimeout = EXCLUDED.idletimeout, maxlifetime = EXCLUDED.maxlifetime,
+			rememberidletimeout = EXCLUDED.rememberidletimeout, rememberlifetime = EXCLUDED.rememberlifetime,
+			passwordminlength = EXCLUDED.passwordminlength, allowedorigins = EXCLUDED.allowedorigins,
+			updated = EXCLUDED.updated`,
+		in.TenantID,
+		int64(in.IdleTimeout/time.Second),
+		int64(in.MaxLifetime/time.Second),
+		int64(in.RememberIdleTimeout/time.Second),
+		int64(in.RememberLifetime/time.Second),
+		in.PasswordMinLength,
+		pq.Array(origins),
+		clock.Value(in.Updated),
+	)
+	return wrap(err, "sql.SaveTenantSettings")
+}
+
+// DeleteTenantSettings implements Storer, removes a tenant's settings.
+func (db *DB) DeleteTenantSettings(tenantID int64) error {
+	return wrap(expectRows(db.storage.Exec(`DELETE FROM tenantsettings WHERE tenantid = $1`, tenantID)), "sql.DeleteTenantSettings")
+}
@@ -0,0 +1,106 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/database"
+)
+
+// GetTwoFactor implements Storer, retrieves a User's two-factor authentication state
+func (db *DB) GetTwoFactor(userID int64) (database.TwoFactor, error) {
+	out := database.TwoFactor{UserID: userID}
+	err := db.storage.QueryRow(
+		`SELECT encryptedsecret, enabled, laststep FROM twofactor WHERE userid = $1`,
+		userID,
+	).Scan(&out.EncryptedSecret, &out.Enabled, &out.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.TwoFactor{}, wrap(database.ErrNotFound, "sql.GetTwoFactor")
+	}
+	if err != nil {
+		return database.TwoFactor{}, wrap(err, "sql.GetTwoFactor")
+	}
+	return out, nil
+}
+
+// SaveTwoFactor implements Storer, stores a pending two-factor enrollment. A pending enrollment replaces any earlier
+// one, but an enabled one is left alone.
+func (db *DB) SaveTwoFactor(in *database.TwoFactor) error {
+	result, err := db.storage.Exec(
+		`INSERT INTO twofactor(userid, encryptedsecret, enabled, laststep) VALUES ($1, $2, FALSE, 0)
+		ON CONFLICT (userid) DO UPDATE SET encryptedsecret = excluded.encryptedsecret, laststep = 0 WHERE NOT twofactor.enabled`,
+		in.UserID,
+		in.EncryptedSecret,
+	)
+	// Nothing being inserted or updated means the User already has it enabled
+	if err := expectRows(result, err); errors.Is(err, database.ErrNotFound) {
+		return wrap(database.ErrTwoFactorEnabled, "sql.SaveTwoFactor")
+	} else if err != nil {
+		return wrap(err, "sql.SaveTwoFactor")
+	}
+	in.Enabled, in.LastStep = false, 0
+	return nil
+}
+
+// EnableTwoFactor implements Storer, enables a pending two-factor enrollment and replaces the User's recovery codes.
+func (db *DB) EnableTwoFactor(userID int64, codeHashes [][]byte) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.EnableTwoFactor")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE twofactor SET enabled = TRUE WHERE userid = $1`, userID)
+	if err := expectRows(result, err); err != nil {
+		return wrap(err, "sql.EnableTwoFactor")
+	}
+	if _, err := tx.Exec(`DELETE FROM recoverycodes WHERE userid = $1`, userID); err != nil {
+		return wrap(err, "sql.EnableTwoFactor")
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO recoverycodes(userid, codehash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return wrap(err, "sql.EnableTwoFactor")
+		}
+	}
+	return wrap(tx.Commit(), "sql.EnableTwoFactor")
+}
+
+// DeleteTwoFactor implements Storer, removes a User's two-factor authentication and recovery codes.
+func (db *DB) DeleteTwoFactor(userID int64) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.DeleteTwoFactor")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recoverycodes WHERE userid = $1`, userID); err != nil {
+		return wrap(err, "sql.DeleteTwoFactor")
+	}
+	result, err := tx.Exec(`DELETE FROM twofactor WHERE userid = $1`, userID)
+	if err := expectRows(result, err); err != nil {
+		return wrap(err, "sql.DeleteTwoFactor")
+	}
+	return wrap(tx.Commit(), "sql.DeleteTwoFactor")
+}
+
+// UseTwoFactorStep implements Storer, records an accepted code's time step. Checking and updating the last step in a
+// single statement means two requests racing to use the same code can't both succeed.
+func (db *DB) UseTwoFactorStep(userID int64, step int64) (bool, error) {
+	result, err := db.storage.Exec(`UPDATE twofactor SET laststep = $2 WHERE userid = $1 AND laststep < $2`, userID, step)
+	if err := expectRows(result, err); errors.Is(err, database.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, wrap(err, "sql.UseTwoFactorStep")
+	}
+	return true, nil
+}
+
+// UseRecoveryCode implements Storer, removes a recovery code so it can't be used again.
+func (db *DB) UseRecoveryCode(userID int64, codeHash []byte) (bool, error) {
+	result, err := db.storage.Exec(`DELETE FROM recoverycodes WHERE userid = $1 AND codehash = $2`, userID, codeHash)
+	if err := expectRows(result, err); errors.Is(err, database.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, wrap(err, "sql.UseRecoveryCode")
+	}
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"examples/database"
+)
+
+// txn is a transaction one of our methods makes several changes in, see begin.
+type txn interface {
+	querier
+	Commit() error
+	Rollback() error
+}
+
+// WithTx implements Storer, running fn in a single PostgreSQL transaction. Once a statement in a transaction fails,
+// PostgreSQL refuses every statement after it, so fn should give up and return the first error it gets.
+func (db *DB) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return wrap(err, "sql.WithTx")
+	}
+	defer tx.Rollback()
+	inner := &DB{storage: tx, pool: db.pool, tx: tx, connector: db.connector, statements: db.statements}
+	if err := fn(inner); err != nil {
+		return err
+	}
+	return wrap(tx.Commit(), "sql.WithTx")
+}
+
+// begin starts a transaction for a method making several changes that must all be made, or none of them. When we're
+// already part of a transaction (see WithTx) a savepoint stands in for one, so the method can still undo its own
+// changes without undoing the rest of the transaction, and its changes are only kept if the transaction commits.
+func (db *DB) begin() (txn, error) {
+	if db.tx == nil {
+		return db.pool.Begin()
+	}
+	if _, err := db.tx.Exec(`SAVEPOINT storer`); err != nil {
+		return nil, err
+	}
+	return &savepoint{Tx: db.tx}, nil
+}
+
+// savepoint stands in for a transaction inside one that's already running, see begin.
+type savepoint struct {
+	*sql.Tx
+	done bool
+}
+
+// Commit keeps the changes made since the savepoint, as part of the transaction it's in.
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.Tx.Exec(`RELEASE SAVEPOINT storer`)
+	return err
+}
+
+// Rollback undoes the changes made since the savepoint, leaving the rest of the transaction it's in as it was. Like
+// sql.Tx's, it does nothing once Commit (or Rollback) has been called, so it can be deferred.
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.Tx.Exec(`ROLLBACK TO SAVEPOINT storer`)
+	return err
+}
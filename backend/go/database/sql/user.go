@@ -1,37 +1,109 @@
 package sql
 
-import "examples/database"
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+
+	"github.com/lib/pq"
+)
+
+// userColumns lists the columns we select for a User, in the order scanUser expects them
+const userColumns = `id, first, last, email, COALESCE(username, ''), role, passwordhash, enabled, failedlogins, locked, emailverified`
+
+// Our User lookups run on nearly every request, so are prepared (see hotQueries)
+const (
+	getUserByIDQuery       = `SELECT ` + userColumns + ` FROM users WHERE id = $1 AND deleted IS NULL`
+	getUserByEmailQuery    = `SELECT ` + userColumns + ` FROM users WHERE email = $1 AND deleted IS NULL`
+	getUserByUsernameQuery = `SELECT ` + userColumns + ` FROM users WHERE username = $1 AND deleted IS NULL`
+)
+
+// scanUser reads a row selected with userColumns into a User. Keeping this in one place means adding a field to User
+// only requires changing userColumns and this function, rather than every query.
+func scanUser(row interface{ Scan(dest ...any) error }) (database.User, error) {
+	var user database.User
+	err := row.Scan(
+		&user.ID,
+		&user.First,
+		&user.Last,
+		&user.Email,
+		&user.Username,
+		&user.Role,
+		&user.PasswordHash,
+		&user.Enabled,
+		&user.FailedLogins,
+		&user.Locked,
+		&user.EmailVerified,
+	)
+	return user, err
+}
 
 // CreateUser implements Storer, inserts a new User record into the database, the ID field will be generated as part of this process
 func (db *DB) CreateUser(in *database.User) error {
-	// Insert User into database, and update the User with returned ID
-	return db.storage.QueryRow(`INSERT INTO users(first, last, email) VALUES ($1, $2, $3) RETURNING id`,
+	return wrap(insertUser(db.storage, in), "sql.CreateUser")
+}
+
+// insertUser inserts a User with q, our database or a transaction (such as when using an invite), and updates the User
+// with the returned ID.
+func insertUser(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}, in *database.User) error {
+	// Usernames other Users have given up stay theirs, new Users can't take them either
+	reserved, err := usernameReserved(q, in.Username, 0)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return database.ErrUsernameTaken
+	}
+	// New users are always enabled, and are regular users until promoted.
+	// Users without a username store NULL rather than '', as only NULLs are exempt from being unique
+	err = q.QueryRow(`INSERT INTO users(first, last, email, username, passwordhash, emailverified) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6) RETURNING id, enabled, role`,
 		in.First,
 		in.Last,
 		in.Email,
-	).Scan(&in.ID)
+		in.Username,
+		in.PasswordHash,
+		in.EmailVerified,
+	).Scan(&in.ID, &in.Enabled, &in.Role)
+	if uniqueViolation(err, "users_username_key") {
+		return database.ErrUsernameTaken
+	}
+	if uniqueViolation(err, "users_email_key") {
+		return database.ErrEmailTaken
+	}
+	return err
+}
+
+// usernameReserved reports whether a User other than id (0 for a new User) has given up a username, with q, our database
+// or a transaction. Having no username reserves nothing.
+func usernameReserved(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}, username string, id int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	var reserved bool
+	err := q.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM usernamehistory WHERE oldusername = $1 AND userid <> $2)`,
+		username,
+		id,
+	).Scan(&reserved)
+	return reserved, err
 }
 
 // GetUserByID implements Storer, retrieves a User record by the ID field
 func (db *DB) GetUserByID(id int64) (database.User, error) {
-	// Prepare a User type
-	var user database.User
 	// Load the first record that is found (Since we're querying by ID, this should only ever return 1 anyway, and an error if not found)
-	err := db.storage.QueryRow(
-		`SELECT * FROM users WHERE id = $1`,
-		id,
-	).Scan(
-		&user.ID,
-		&user.First,
-		&user.Last,
-		&user.Email,
-	)
-	if err != nil {
+	user, err := scanUser(db.queryRow(getUserByIDQuery, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		// Most common error is simply no rows, return an empty user, and our not found error
-		return database.User{}, database.ErrNotFound
-		// TODO (IME): There are other possible errors that can be returned, however for this demo, this is perfectly fine.
-		// We may wish to handle other errors differently (For example if we can't reach our database, we may wish to return
-		// a 500 or a 503 status to the frontend denote the user isn't doing anything wrong.)
+		return database.User{}, wrap(database.ErrNotFound, "sql.GetUserByID")
+	}
+	if err != nil {
+		// Anything else means something went wrong talking to our database, the user isn't doing anything wrong
+		return database.User{}, wrap(err, "sql.GetUserByID")
 	}
 	// Return user
 	return user, nil
@@ -39,29 +111,340 @@ func (db *DB) GetUserByID(id int64) (database.User, error) {
 
 // GetUserByEmail implements Storer, retrieves a User record by the Email field
 func (db *DB) GetUserByEmail(email string) (database.User, error) {
-	// Prepare a User type
-	var user database.User
 	// Load the first record that is found
-	err := db.storage.QueryRow(
-		`SELECT * FROM users WHERE email = $1`,
-		email,
-	).Scan(
-		&user.ID,
-		&user.First,
-		&user.Last,
-		&user.Email,
-	)
-	if err != nil {
+	user, err := scanUser(db.queryRow(getUserByEmailQuery, email))
+	if errors.Is(err, sql.ErrNoRows) {
 		// Most common error is simply no rows, return an empty user, and our not found error
-		return database.User{}, database.ErrNotFound
+		return database.User{}, wrap(database.ErrNotFound, "sql.GetUserByEmail")
+	}
+	if err != nil {
+		return database.User{}, wrap(err, "sql.GetUserByEmail")
 	}
 	// Return user
 	return user, nil
 }
 
+// GetUserByUsername implements Storer, retrieves a User record by the Username field
+func (db *DB) GetUserByUsername(username string) (database.User, error) {
+	user, err := scanUser(db.queryRow(getUserByUsernameQuery, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, wrap(database.ErrNotFound, "sql.GetUserByUsername")
+	}
+	if err != nil {
+		return database.User{}, wrap(err, "sql.GetUserByUsername")
+	}
+	return user, nil
+}
+
+// ChangeUsername implements Storer, changes a User's username and records the change in a single transaction
+func (db *DB) ChangeUsername(id int64, username string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.ChangeUsername")
+	}
+	defer tx.Rollback()
+
+	// Lock the User while we change them, so two changes at once can't both record the same old username
+	var old sql.NullString
+	err = tx.QueryRow(`SELECT username FROM users WHERE id = $1 FOR UPDATE`, id).Scan(&old)
+	if errors.Is(err, sql.ErrNoRows) {
+		return wrap(database.ErrNotFound, "sql.ChangeUsername")
+	}
+	if err != nil {
+		return wrap(err, "sql.ChangeUsername")
+	}
+	if old.String == username {
+		return nil
+	}
+
+	// Usernames other Users have given up stay theirs, a User may only take back one of their own
+	reserved, err := usernameReserved(tx, username, id)
+	if err != nil {
+		return wrap(err, "sql.ChangeUsername")
+	}
+	if reserved {
+		return wrap(database.ErrUsernameTaken, "sql.ChangeUsername")
+	}
+
+	_, err = tx.Exec(`UPDATE users SET username = $1 WHERE id = $2`, username, id)
+	if uniqueViolation(err, "users_username_key") {
+		return wrap(database.ErrUsernameTaken, "sql.ChangeUsername")
+	}
+	if err != nil {
+		return wrap(err, "sql.ChangeUsername")
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO usernamehistory(userid, oldusername, newusername, changed) VALUES ($1, $2, $3, current_timestamp)`,
+		id,
+		old.String,
+		username,
+	); err != nil {
+		return wrap(err, "sql.ChangeUsername")
+	}
+	return wrap(tx.Commit(), "sql.ChangeUsername")
+}
+
+// UsernameReserved implements Storer, reports whether any User has given up a username
+func (db *DB) UsernameReserved(username string) (bool, error) {
+	reserved, err := usernameReserved(db.storage, username, 0)
+	return reserved, wrap(err, "sql.UsernameReserved")
+}
+
+// UsernameHistory implements Storer, lists a User's username changes oldest first
+func (db *DB) UsernameHistory(id int64) ([]database.UsernameChange, error) {
+	rows, err := db.storage.Query(
+		`SELECT oldusername, newusername, changed FROM usernamehistory WHERE userid = $1 ORDER BY changed`,
+		id,
+	)
+	if err != nil {
+		return nil, wrap(err, "sql.UsernameHistory")
+	}
+	defer rows.Close()
+	var changes []database.UsernameChange
+	for rows.Next() {
+		change := database.UsernameChange{UserID: id}
+		if err := rows.Scan(&change.Old, &change.New, clock.Scan(&change.Changed)); err != nil {
+			return nil, wrap(err, "sql.UsernameHistory")
+		}
+		changes = append(changes, change)
+	}
+	return changes, wrap(rows.Err(), "sql.UsernameHistory")
+}
+
+// userFields are the fields Users can be filtered and sorted by.
+var userFields = fields{
+	"id":    "id",
+	"first": "first",
+	"last":  "last",
+	"email": "email",
+}
+
+// ListUsers implements Storer, retrieves a page of User records in ID order
+func (db *DB) ListUsers(afterID int64, limit int) ([]database.User, error) {
+	query, args, err := newQuery(`SELECT `+userColumns+` FROM users`, userFields).
+		require("deleted IS NULL").
+		filter("id", opGt, afterID).
+		orderBy("id", false).
+		page(limit, 0).
+		build()
+	if err != nil {
+		return nil, wrap(err, "sql.ListUsers")
+	}
+	rows, err := db.storage.Query(query, args...)
+	if err != nil {
+		return nil, wrap(err, "sql.ListUsers")
+	}
+	defer rows.Close()
+	var users []database.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.ListUsers")
+		}
+		users = append(users, user)
+	}
+	return users, wrap(rows.Err(), "sql.ListUsers")
+}
+
+// SearchUsers implements Storer, retrieves User records whose name or email contains query, prefix matches first. The
+// scope is a condition of the same query, joining our dealership memberships, so it's applied before the limit.
+func (db *DB) SearchUsers(query string, scope database.UserScope, limit int) ([]database.User, error) {
+	names := []string{"first", "last", "email"}
+	q := newQuery(`SELECT `+userColumns+` FROM users`, userFields).
+		require("deleted IS NULL").
+		filterAny(names, opLike, likePattern(query))
+	if !scope.Everyone() {
+		q.require(`(id = ? OR id IN (SELECT userid FROM dealershipmembers WHERE dealershipid = ANY(?)))`,
+			scope.ViewerID, pq.Array(scope.Dealerships))
+	}
+	selected, args, err := q.
+		orderByMatch(names, opLike, likeEscaper.Replace(query)+"%").
+		orderBy("id", false).
+		page(limit, 0).
+		build()
+	if err != nil {
+		return nil, wrap(err, "sql.SearchUsers")
+	}
+	rows, err := db.storage.Query(selected, args...)
+	if err != nil {
+		return nil, wrap(err, "sql.SearchUsers")
+	}
+	defer rows.Close()
+	var users []database.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrap(err, "sql.SearchUsers")
+		}
+		users = append(users, user)
+	}
+	return users, wrap(rows.Err(), "sql.SearchUsers")
+}
+
+// CountUsers implements Storer, counts the User records that haven't been deleted
+func (db *DB) CountUsers() (int, error) {
+	var count int
+	err := db.storage.QueryRow(`SELECT count(*) FROM users WHERE deleted IS NULL`).Scan(&count)
+	return count, wrap(err, "sql.CountUsers")
+}
+
+// UpdateUser implements Storer, saves the name and email of a User record
+func (db *DB) UpdateUser(in *database.User) error {
+	result, err := db.storage.Exec(`UPDATE users SET first = $1, last = $2, email = $3 WHERE id = $4 AND deleted IS NULL`,
+		in.First, in.Last, in.Email, in.ID)
+	if uniqueViolation(err, "users_email_key") {
+		return wrap(database.ErrEmailTaken, "sql.UpdateUser")
+	}
+	return wrap(expectRows(result, err), "sql.UpdateUser")
+}
+
+// SetUserEnabled implements Storer, enables or disables a User record
+func (db *DB) SetUserEnabled(id int64, enabled bool) error {
+	result, err := db.storage.Exec(`UPDATE users SET enabled = $1 WHERE id = $2`, enabled, id)
+	return wrap(expectRows(result, err), "sql.SetUserEnabled")
+}
+
+// SetUserRole implements Storer, changes the role of a User record
+func (db *DB) SetUserRole(id int64, role string) error {
+	result, err := db.storage.Exec(`UPDATE users SET role = $1 WHERE id = $2 AND deleted IS NULL`, role, id)
+	return wrap(expectRows(result, err), "sql.SetUserRole")
+}
+
+// SetPasswordHash implements Storer, replaces the password hash of a User record
+func (db *DB) SetPasswordHash(id int64, hash string) error {
+	result, err := db.storage.Exec(`UPDATE users SET passwordhash = $1 WHERE id = $2`, hash, id)
+	return wrap(expectRows(result, err), "sql.SetPasswordHash")
+}
+
+// RecordFailedLogin implements Storer, counting the failure and locking the User in a single statement, so concurrent
+// attempts can't slip past the limit
+func (db *DB) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	var locked bool
+	err := db.storage.QueryRow(
+		`UPDATE users SET failedlogins = failedlogins + 1, locked = locked OR ($2 > 0 AND failedlogins + 1 >= $2) WHERE id = $1 RETURNING locked`,
+		id,
+		lockAfter,
+	).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, wrap(database.ErrNotFound, "sql.RecordFailedLogin")
+	}
+	return locked, wrap(err, "sql.RecordFailedLogin")
+}
+
+// UnlockUser implements Storer, clearing a User's failed logins and unlocking them
+func (db *DB) UnlockUser(id int64) error {
+	result, err := db.storage.Exec(`UPDATE users SET failedlogins = 0, locked = FALSE WHERE id = $1`, id)
+	return wrap(expectRows(result, err), "sql.UnlockUser")
+}
+
 // DeleteUser implements Storer, deletes a User record from the database
 func (db *DB) DeleteUser(id int64) error {
 	// Delete User record from database, here we intentionally discard the returned output, as we only care if there was an error.
 	_, err := db.storage.Exec(`DELETE FROM users WHERE id = $1`, id)
-	return err
+	return wrap(err, "sql.DeleteUser")
+}
+
+// SoftDeleteUser implements Storer, hides a User and records their pending deletion in a single transaction. They're
+// disabled too, so even something that reads the users table directly won't treat them as active.
+func (db *DB) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.UserDeletion{}, wrap(err, "sql.SoftDeleteUser")
+	}
+	defer tx.Rollback()
+
+	deletion := database.UserDeletion{UserID: id, Status: database.DeletionPending}
+	err = tx.QueryRow(
+		`UPDATE users SET deleted = current_timestamp, enabled = FALSE WHERE id = $1 AND deleted IS NULL RETURNING deleted`,
+		id,
+	).Scan(clock.Scan(&deletion.Requested))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.UserDeletion{}, wrap(database.ErrNotFound, "sql.SoftDeleteUser")
+	}
+	if err != nil {
+		return database.UserDeletion{}, wrap(err, "sql.SoftDeleteUser")
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO userdeletions(userid, requested, status) VALUES ($1, $2, $3)`,
+		deletion.UserID,
+		clock.Value(deletion.Requested),
+		deletion.Status,
+	); err != nil {
+		return database.UserDeletion{}, wrap(err, "sql.SoftDeleteUser")
+	}
+	return deletion, wrap(tx.Commit(), "sql.SoftDeleteUser")
+}
+
+// MergeUsers implements Storer, merges one User into another in a single transaction.
+func (db *DB) MergeUsers(keepID, mergeID int64) error {
+	tx, err := db.begin()
+	if err != nil {
+		return wrap(err, "sql.MergeUsers")
+	}
+	// Rollback does nothing once the transaction has been committed, so it's safe to always defer it
+	defer tx.Rollback()
+
+	// Usernames are unique, so the merged User has to give theirs up before the kept User can take it
+	var keepName, mergeName sql.NullString
+	err = tx.QueryRow(
+		`SELECT keep.username, merged.username FROM users keep, users merged WHERE keep.id = $1 AND merged.id = $2 FOR UPDATE`,
+		keepID,
+		mergeID,
+	).Scan(&keepName, &mergeName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return wrap(database.ErrNotFound, "sql.MergeUsers")
+	}
+	if err != nil {
+		return wrap(err, "sql.MergeUsers")
+	}
+	if _, err := tx.Exec(`UPDATE users SET username = NULL WHERE id = $1`, mergeID); err != nil {
+		return wrap(err, "sql.MergeUsers")
+	}
+
+	// Combine the two User records, following our conflict rules. This also checks both Users exist.
+	result, err := tx.Exec(
+		`UPDATE users SET
+			username = COALESCE(users.username, $3),
+			first = CASE WHEN users.first = '' THEN merged.first ELSE users.first END,
+			last = CASE WHEN users.last = '' THEN merged.last ELSE users.last END,
+			enabled = users.enabled AND merged.enabled,
+			locked = users.locked OR merged.locked
+		FROM users merged
+		WHERE users.id = $1 AND merged.id = $2`,
+		keepID,
+		mergeID,
+		mergeName,
+	)
+	if err := expectRows(result, err); err != nil {
+		return wrap(err, "sql.MergeUsers")
+	}
+
+	// Move everything else across. Sessions and email changes aren't moved, deleting the merged User removes them.
+	statements := []string{
+		`INSERT INTO dealershipmembers(dealershipid, userid) SELECT dealershipid, $1 FROM dealershipmembers WHERE userid = $2 ON CONFLICT DO NOTHING`,
+		`UPDATE auditlog SET actorid = $1 WHERE actorid = $2`,
+		`UPDATE auditlog SET targetid = $1 WHERE targetid = $2`,
+		`UPDATE oauthidentities SET userid = $1 WHERE userid = $2`,
+		`UPDATE usernamehistory SET userid = $1 WHERE userid = $2`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, keepID, mergeID); err != nil {
+			return wrap(err, "sql.MergeUsers")
+		}
+	}
+	// If the kept User already had a username, the merged User's is given up, so record that to keep it reserved
+	if keepName.Valid && mergeName.Valid {
+		if _, err := tx.Exec(
+			`INSERT INTO usernamehistory(userid, oldusername, newusername, changed) VALUES ($1, $2, $3, current_timestamp)`,
+			keepID,
+			mergeName.String,
+			keepName.String,
+		); err != nil {
+			return wrap(err, "sql.MergeUsers")
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, mergeID); err != nil {
+		return wrap(err, "sql.MergeUsers")
+	}
+	return wrap(tx.Commit(), "sql.MergeUsers")
 }
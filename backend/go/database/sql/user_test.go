@@ -0,0 +1,64 @@
+package sql_test
+
+import (
+	"errors"
+	"examples/database"
+	"slices"
+	"testing"
+)
+
+// TestCreateUserEmailTaken checks our unique index on lower(email) refuses a second User whose email only differs
+// in case, and that we turn its violation into ErrEmailTaken rather than returning Postgres's error as it is.
+func TestCreateUserEmailTaken(t *testing.T) {
+	db := postgres(t)
+
+	first := database.User{First: "Dup", Last: "One", Email: "Dup@Example.com"}
+	if err := db.CreateUser(&first); err != nil {
+		t.Fatalf("creating first user: %v", err)
+	}
+	second := database.User{First: "Dup", Last: "Two", Email: "dup@example.com"}
+	if err := db.CreateUser(&second); !errors.Is(err, database.ErrEmailTaken) {
+		t.Fatalf("creating second user: got %v, want %v", err, database.ErrEmailTaken)
+	}
+
+	// The index only covers Users who haven't been deleted, so once the first User is their email is free again
+	if _, err := db.SoftDeleteUser(first.ID); err != nil {
+		t.Fatalf("deleting first user: %v", err)
+	}
+	if err := db.CreateUser(&second); err != nil {
+		t.Fatalf("creating second user after deleting the first: %v", err)
+	}
+}
+
+// TestSearchUsersScope checks a scoped search only lists the viewer and the other members of their dealerships, and
+// that Users outside the scope don't use up the limit.
+func TestSearchUsersScope(t *testing.T) {
+	db := postgres(t)
+
+	// Created in this order, so the outsider's ID comes between the viewer's and the member's
+	viewer := database.User{First: "Scope", Last: "Viewer", Email: "viewer@example.com"}
+	outsider := database.User{First: "Scope", Last: "Outsider", Email: "outsider@example.com"}
+	member := database.User{First: "Scope", Last: "Member", Email: "member@example.com"}
+	for _, user := range []*database.User{&viewer, &outsider, &member} {
+		if err := db.CreateUser(user); err != nil {
+			t.Fatalf("creating %s: %v", user.Email, err)
+		}
+	}
+	for _, user := range []database.User{viewer, member} {
+		if err := db.AddUserToDealership(user.ID, 1); err != nil {
+			t.Fatalf("adding %s to dealership: %v", user.Email, err)
+		}
+	}
+
+	users, err := db.SearchUsers("scope", database.UserScope{ViewerID: viewer.ID, Dealerships: []int64{1}}, 2)
+	if err != nil {
+		t.Fatalf("searching: %v", err)
+	}
+	var got []int64
+	for _, user := range users {
+		got = append(got, user.ID)
+	}
+	if want := []int64{viewer.ID, member.ID}; !slices.Equal(got, want) {
+		t.Errorf("got Users %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"examples/clock"
+	"examples/database"
+)
+
+// CreateEmailVerification implements Storer, stores an email verification. A User can only have one verification at a
+// time, so sending a new link stops any earlier one from working.
+func (db *DB) CreateEmailVerification(in *database.EmailVerification) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO emailverifications(tokenhash, userid, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (userid) DO UPDATE SET tokenhash = EXCLUDED.tokenhash, expires = EXCLUDED.expires`,
+		in.TokenHash,
+		in.UserID,
+		clock.Value(in.Expires),
+	)
+	return wrap(err, "sql.CreateEmailVerification")
+}
+
+// VerifyEmail implements Storer, removes an email verification so its token can't be used again, and marks the User's
+// email as verified in the same transaction.
+func (db *DB) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return database.EmailVerification{}, wrap(err, "sql.VerifyEmail")
+	}
+	defer tx.Rollback()
+
+	verification := database.EmailVerification{TokenHash: tokenHash}
+	err = tx.QueryRow(
+		`DELETE FROM emailverifications WHERE tokenhash = $1 AND expires > current_timestamp RETURNING userid, expires`,
+		tokenHash,
+	).Scan(&verification.UserID, clock.Scan(&verification.Expires))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.EmailVerification{}, wrap(database.ErrNotFound, "sql.VerifyEmail")
+	}
+	if err != nil {
+		return database.EmailVerification{}, wrap(err, "sql.VerifyEmail")
+	}
+
+	result, err := tx.Exec(`UPDATE users SET emailverified = TRUE WHERE id = $1 AND deleted IS NULL`, verification.UserID)
+	if err := expectRows(result, err); err != nil {
+		return database.EmailVerification{}, wrap(err, "sql.VerifyEmail")
+	}
+	return verification, wrap(tx.Commit(), "sql.VerifyEmail")
+}
@@ -0,0 +1,197 @@
+// usercache keeps Users we've loaded by ID in memory for a few seconds. Our auth middleware loads the logged in User on
+// every request (so disabling them locks them out straight away), which for a busy client making several requests at
+// once means several identical lookups in flight together. Those are collapsed into a single lookup (singleflight), and
+// its result reused by requests arriving within the next few seconds.
+//
+// Anything that changes a User through this Storer drops them from the cache, so this instance always sees its own
+// changes. Changes made by another instance of our API are seen once the cached copy expires, so keep the TTL short:
+// it's the longest a disabled User could carry on using another instance.
+package usercache
+
+import (
+	"context"
+	"examples/database"
+	"examples/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Storer caches Users loaded by ID, passing every other method straight through to the wrapped Storer.
+type Storer struct {
+	database.Storer
+	ttl time.Duration
+
+	group singleflight.Group // Collapses concurrent loads of the same User
+
+	mu         sync.Mutex
+	users      map[int64]cached
+	generation uint64    // Bumped whenever a User is dropped, so a load that raced the change isn't cached
+	swept      time.Time // When expired Users were last cleared out
+}
+
+// cached is a User along with when we stop trusting our copy.
+type cached struct {
+	user    database.User
+	expires time.Time
+}
+
+// New wraps a Storer, caching Users loaded by ID for ttl.
+func New(next database.Storer, ttl time.Duration) *Storer {
+	return &Storer{Storer: next, ttl: ttl, users: make(map[int64]cached)}
+}
+
+// GetUserByID implements Storer, returning our cached copy of the User if it's fresh, otherwise loading them (once,
+// however many requests are asking at the same time) and caching them.
+func (s *Storer) GetUserByID(id int64) (database.User, error) {
+	s.mu.Lock()
+	entry, ok := s.users[id]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		metrics.ObserveCache("user", "hit")
+		return entry.user, nil
+	}
+	metrics.ObserveCache("user", "miss")
+
+	loaded, err, _ := s.group.Do(strconv.FormatInt(id, 10), func() (any, error) {
+		s.mu.Lock()
+		generation := s.generation
+		s.mu.Unlock()
+		user, err := s.Storer.GetUserByID(id)
+		// Errors aren't cached, so a User who doesn't exist yet can be found as soon as they do
+		if err == nil {
+			s.store(user, generation, time.Now())
+		}
+		return user, err
+	})
+	return loaded.(database.User), err
+}
+
+// store caches a User, unless any User was dropped since we started loading them, in which case what we loaded may
+// already be out of date.
+func (s *Storer) store(user database.User, generation uint64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return
+	}
+	s.users[user.ID] = cached{user: user, expires: now.Add(s.ttl)}
+	// Users we haven't seen for a while would otherwise stay in memory forever
+	if now.Sub(s.swept) > s.ttl {
+		for id, entry := range s.users {
+			if now.After(entry.expires) {
+				delete(s.users, id)
+			}
+		}
+		s.swept = now
+	}
+}
+
+// forget drops Users from the cache, after they've been changed.
+func (s *Storer) forget(ids ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.users, id)
+	}
+	s.generation++
+}
+
+// forgetAll drops every User from the cache.
+func (s *Storer) forgetAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[int64]cached)
+	s.generation++
+}
+
+// WithTx implements Storer. Calls made in the transaction go straight to the wrapped Storer, so they see the
+// transaction's own changes rather than our cached copies. We can't tell which Users it changed, so once it's over
+// every User is dropped from the cache.
+func (s *Storer) WithTx(ctx context.Context, fn func(database.Storer) error) error {
+	defer s.forgetAll()
+	return s.Storer.WithTx(ctx, fn)
+}
+
+// ChangeUsername implements Storer, dropping the User from the cache.
+func (s *Storer) ChangeUsername(id int64, username string) error {
+	defer s.forget(id)
+	return s.Storer.ChangeUsername(id, username)
+}
+
+// UpdateUser implements Storer, dropping the User from the cache.
+func (s *Storer) UpdateUser(in *database.User) error {
+	defer s.forget(in.ID)
+	return s.Storer.UpdateUser(in)
+}
+
+// SetUserEnabled implements Storer, dropping the User from the cache.
+func (s *Storer) SetUserEnabled(id int64, enabled bool) error {
+	defer s.forget(id)
+	return s.Storer.SetUserEnabled(id, enabled)
+}
+
+// SetUserRole implements Storer, dropping the User from the cache.
+func (s *Storer) SetUserRole(id int64, role string) error {
+	defer s.forget(id)
+	return s.Storer.SetUserRole(id, role)
+}
+
+// SetPasswordHash implements Storer, dropping the User from the cache.
+func (s *Storer) SetPasswordHash(id int64, hash string) error {
+	defer s.forget(id)
+	return s.Storer.SetPasswordHash(id, hash)
+}
+
+// RecordFailedLogin implements Storer, dropping the User from the cache.
+func (s *Storer) RecordFailedLogin(id int64, lockAfter int) (bool, error) {
+	defer s.forget(id)
+	return s.Storer.RecordFailedLogin(id, lockAfter)
+}
+
+// UnlockUser implements Storer, dropping the User from the cache.
+func (s *Storer) UnlockUser(id int64) error {
+	defer s.forget(id)
+	return s.Storer.UnlockUser(id)
+}
+
+// DeleteUser implements Storer, dropping the User from the cache.
+func (s *Storer) DeleteUser(id int64) error {
+	defer s.forget(id)
+	return s.Storer.DeleteUser(id)
+}
+
+// SoftDeleteUser implements Storer, dropping the User from the cache.
+func (s *Storer) SoftDeleteUser(id int64) (database.UserDeletion, error) {
+	defer s.forget(id)
+	return s.Storer.SoftDeleteUser(id)
+}
+
+// MergeUsers implements Storer, dropping both Users from the cache.
+func (s *Storer) MergeUsers(keepID, mergeID int64) error {
+	defer s.forget(keepID, mergeID)
+	return s.Storer.MergeUsers(keepID, mergeID)
+}
+
+// ConfirmEmailChange implements Storer, dropping the User whose email changed from the cache.
+func (s *Storer) ConfirmEmailChange(tokenHash []byte) (database.EmailChange, error) {
+	change, err := s.Storer.ConfirmEmailChange(tokenHash)
+	s.forget(change.UserID)
+	return change, err
+}
+
+// UsePasswordReset implements Storer, dropping the User whose password changed from the cache.
+func (s *Storer) UsePasswordReset(tokenHash []byte, passwordHash string) (database.PasswordReset, error) {
+	reset, err := s.Storer.UsePasswordReset(tokenHash, passwordHash)
+	s.forget(reset.UserID)
+	return reset, err
+}
+
+// VerifyEmail implements Storer, dropping the User whose email was verified from the cache.
+func (s *Storer) VerifyEmail(tokenHash []byte) (database.EmailVerification, error) {
+	verification, err := s.Storer.VerifyEmail(tokenHash)
+	s.forget(verification.UserID)
+	return verification, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"examples/config"
+	"examples/database/sql"
+	"examples/secrets"
+	"log"
+	"time"
+)
+
+// databaseURLSecret is the name of the secret holding our database URL, credentials included
+const databaseURLSecret = "database_url"
+
+// credentialRotator switches our database connections over to a new URL without a restart, such as *sql.DB.
+type credentialRotator interface {
+	RotateCredentials(ctx context.Context, url string) error
+}
+
+// dbPool returns the limits on our pool of connections to each database, from our configuration.
+func dbPool(cfg config.Config) sql.Pool {
+	return sql.Pool{
+		MaxOpen:     cfg.DBMaxOpenConns,
+		MaxIdle:     cfg.DBMaxIdleConns,
+		MaxLifetime: cfg.DBConnMaxLifetime,
+		MaxIdleTime: cfg.DBConnMaxIdleTime,
+		NoPrepare:   !cfg.DBPrepareStatements,
+	}
+}
+
+// dbRetry is how long we keep trying to reach our database when we start, as configured, saying what we're waiting on.
+func dbRetry(cfg config.Config) sql.Retry {
+	return sql.Retry{
+		Attempts: cfg.DBConnectAttempts,
+		Base:     cfg.DBConnectBackoff,
+		Max:      cfg.DBConnectMaxBackoff,
+		OnRetry: func(err error, wait time.Duration) {
+			log.Printf("Unable to reach database, retrying in %s: %v", wait.Round(time.Millisecond), err)
+		},
+	}
+}
+
+// fetchDatabaseURL reads our database URL from a secrets provider.
+func fetchDatabaseURL(ctx context.Context, provider secrets.Provider) (string, error) {
+	return provider.Secret(ctx, databaseURLSecret)
+}
+
+// rotateDBCredentials is a background task that checks our secrets provider for a new database URL, such as after our
+// database password has been rotated, and switches our connections over to it (see registerTasks). If the new URL
+// doesn't work we carry on with the old one, and try again next time, so a rotation that's only half done (the secret
+// updated before the password) fixes itself once it's finished.
+func (s *server) rotateDBCredentials(ctx context.Context) error {
+	url, err := fetchDatabaseURL(ctx, s.secrets)
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to fetch database credentials: %v", err)
+		return err
+	}
+	if url == s.dbURL {
+		return nil
+	}
+	if err := s.dbCredentials.RotateCredentials(ctx, url); err != nil {
+		s.logger.Printf("ERROR: Unable to switch to rotated database credentials, carrying on with the old ones: %v", err)
+		return err
+	}
+	s.dbURL = url
+	s.logger.Printf("INFO: Switched to rotated database credentials, old connections will close once they're done")
+	return nil
+}
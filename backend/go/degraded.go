@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"examples/config"
+	"examples/csrf"
+	"examples/recorder"
+	"examples/requestctx"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Degraded mode (see config.DegradedMode) keeps us useful while our database is briefly unreachable, such as during a
+// failover, rather than answering every logged in request with a 503:
+//
+//   - Reads are answered with the last copy of the same response we served the same client, if it's recent enough
+//     (config.DegradedMaxStale), marked with a Warning header so the client knows it may be out of date.
+//   - Writes to the routes in deferrableWrites are queued as a job, and answered with a 202 and a Warning header. Once
+//     our database is back the job replays the request through our routes, just as if the client had sent it again.
+//     The client's credentials aren't queued with it, only the hash of their session (or API token) to load it by.
+//     Signed tokens can't be loaded again (they aren't kept anywhere), so in JWT mode writes aren't queued.
+//
+// Anything else gets its 503 as usual. Both only step in when a request has already failed with a 503, so while our
+// database is up nothing changes but the copies we keep. A queued write can only help if our job queue doesn't live in
+// the database that's unavailable, so set JOB_QUEUE=redis to have writes queued (otherwise they get their 503).
+//
+// Copies are kept per credential, so they're only ever served to whoever they were first served to, but anyone whose
+// access was revoked in the meantime can still see their own copies while our database is unavailable. Logging out
+// throws away the session's copies.
+
+// Warning headers (RFC 7234) for responses served in degraded mode
+const (
+	staleWarning    = `110 - "Response is Stale"`
+	deferredWarning = `199 - "Database unavailable, request queued"`
+)
+
+// maxStaleBody is the largest response we keep a copy of, and maxStaleBytes how much we keep altogether, the least
+// recently stored copies being dropped first.
+const (
+	maxStaleBody  = 64 << 10
+	maxStaleBytes = 32 << 20
+)
+
+// maxDeferredBody is the largest request body we'll queue a write with.
+const maxDeferredBody = 64 << 10
+
+// deferredJob is the kind of job replaying a write queued in degraded mode.
+const deferredJob = "deferred-request"
+
+// deferrableWrites lists the routes whose writes may be queued in degraded mode. Only routes answered with nothing
+// but a status belong here, as the client gets nothing back from a queued write, and only ones that are safe to apply
+// a little late. Anything handling secrets (passwords, 2FA codes) doesn't, as we'd be keeping them in our job queue.
+var deferrableWrites = map[routeKey]bool{
+	{http.MethodPut, "/users/{username}/email"}:      true,
+	{http.MethodDelete, "/sessions/{id}"}:            true,
+	{http.MethodDelete, "/users/self/tokens/{id}"}:   true,
+	{http.MethodPut, "/users/{username}/enabled"}:    true,
+	{http.MethodDelete, "/users/{username}/enabled"}: true,
+	{http.MethodDelete, "/invites/{id}"}:             true,
+}
+
+// deferredRequest is the payload of a deferredJob, the request as the client sent it, less its credentials.
+type deferredRequest struct {
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"` // Including our base path, as our routes expect
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	RemoteAddr string      `json:"remoteAddr"`
+	TokenHash  []byte      `json:"tokenHash,omitempty"` // Hash of the session or API token the request was sent with
+	APIToken   bool        `json:"apiToken,omitempty"`  // Whether TokenHash is an API token's
+}
+
+// degraded is our degraded mode middleware, it must come before our auth middleware, as authenticating needs our
+// database too.
+func (s *server) degraded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config.Load()
+		// A replayed write that fails again is retried by our job queue, rather than being queued a second time
+		if !cfg.DegradedMode || requestctx.Replayed(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet:
+			s.serveStale(w, r, next, cfg.DegradedMaxStale)
+		case deferrableWrites[routeKey{r.Method, routeTemplate(r)}]:
+			s.deferWrite(w, r, next)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveStale serves a read, keeping a copy of it if it succeeds, or serving the copy we kept last time if it fails
+// with a 503.
+func (s *server) serveStale(w http.ResponseWriter, r *http.Request, next http.Handler, maxStale time.Duration) {
+	credential := rawSessionToken(r)
+	if credential == "" {
+		// Not logged in, so there's nothing to keep, it'll be turned away
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := staleKey(credential, r)
+	buf := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(buf, r)
+
+	switch {
+	case buf.status == http.StatusServiceUnavailable:
+		if kept, ok := s.stale.get(key, maxStale); ok {
+			for name, values := range kept.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Warning", staleWarning)
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(kept.stored).Seconds())))
+			w.WriteHeader(http.StatusOK)
+			w.Write(kept.body)
+			return
+		}
+	case buf.status == http.StatusOK && buf.body.Len() <= maxStaleBody:
+		header := buf.header.Clone()
+		header.Del("Set-Cookie")
+		header.Del("X-Request-ID")
+		s.stale.put(key, header, bytes.Clone(buf.body.Bytes()))
+	}
+	buf.sendTo(w)
+}
+
+// staleKey is what we keep a copy of a read under: who asked for it, and everything that shapes the response.
+func staleKey(credential string, r *http.Request) string {
+	return string(hashToken(credential)) + "\x00" + r.Header.Get(apiVersionHeader) + "\x00" + r.Header.Get("Accept") +
+		"\x00" + r.URL.RequestURI()
+}
+
+// deferWrite serves a write, queueing it to be replayed later if it fails with a 503.
+func (s *server) deferWrite(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	// Read at most one byte more than we'd queue, so we know whether the body is too large without reading it all
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeferredBody+1))
+	if err != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if len(body) > maxDeferredBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		next.ServeHTTP(w, r)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	buf := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(buf, r)
+
+	// Only writes we can authenticate again without their credentials are queued (see replayAs)
+	replay, ok := s.replayAs(r)
+	if buf.status == http.StatusServiceUnavailable && ok {
+		header := recorder.SanitizeHeader(r.Header)
+		// So our logs tie the replay back to this request
+		if id := requestctx.RequestID(r.Context()); id != "" {
+			header.Set("X-Request-ID", id)
+		}
+		err := s.jobs.Enqueue(r.Context(), deferredJob, deferredRequest{
+			Method:     r.Method,
+			URI:        s.pathTo(r.URL.RequestURI()),
+			Header:     header,
+			Body:       body,
+			RemoteAddr: r.RemoteAddr,
+			TokenHash:  replay.TokenHash,
+			APIToken:   replay.APIToken,
+		})
+		if err == nil {
+			s.logger.Printf("WARNING: Queued %s %s to replay once our database is available", r.Method, routeTemplate(r))
+			w.Header().Set("Warning", deferredWarning)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		s.logger.Printf("ERROR: Unable to queue %s %s while our database is unavailable: %v", r.Method, routeTemplate(r), err)
+	}
+	buf.sendTo(w)
+}
+
+// replayAs works out how a write can be authenticated when replayed, without keeping the credentials it was sent with:
+// by the hash of its session or API token. Returns false if it can't be, as it was sent with a signed token or without
+// a credential at all, or without the CSRF token its session cookie needs. That can only be checked against the cookie
+// itself, so is checked now rather than when replayed.
+func (s *server) replayAs(r *http.Request) (requestctx.Replay, bool) {
+	if hash, ok := apiTokenOf(r); ok {
+		return requestctx.Replay{TokenHash: hash, APIToken: true}, true
+	}
+	raw := rawSessionToken(r)
+	if raw == "" || s.sessionMode == config.SessionModeJWT {
+		return requestctx.Replay{}, false
+	}
+	if r.Header.Get("Authorization") == "" && !s.csrf.Valid(raw, r.Header.Get(csrf.Header)) {
+		return requestctx.Replay{}, false
+	}
+	return requestctx.Replay{TokenHash: hashToken(raw)}, true
+}
+
+// replayDeferredJob replays a write queued in degraded mode through our routes, so it's authenticated, authorized and
+// validated again just like when it was first sent. If it fails with a 503 again the job is retried, but any other
+// failure (such as the session having expired since) is only logged, as retrying won't help.
+func (s *server) replayDeferredJob(ctx context.Context, payload json.RawMessage) error {
+	var req deferredRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	ctx = requestctx.WithReplay(ctx, requestctx.Replay{TokenHash: req.TokenHash, APIToken: req.APIToken})
+	r, err := http.NewRequestWithContext(ctx, req.Method, req.URI, bytes.NewReader(req.Body))
+	if err != nil {
+		return err
+	}
+	r.Header = req.Header
+	r.RemoteAddr = req.RemoteAddr
+
+	s.replayOnce.Do(func() { s.replayTo = s.routes() })
+	buf := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	s.replayTo.ServeHTTP(buf, r)
+	switch {
+	case buf.status == http.StatusServiceUnavailable:
+		return fmt.Errorf("replaying %s %s: still unavailable", req.Method, r.URL.Path)
+	case buf.status >= http.StatusBadRequest:
+		s.logger.Printf("WARNING: Queued %s %s failed when replayed with a %d: %s", req.Method, r.URL.Path, buf.status,
+			bytes.TrimSpace(buf.body.Bytes()))
+	}
+	return nil
+}
+
+// staleCopy is a copy of a successful read.
+type staleCopy struct {
+	key    string
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// staleCache keeps copies of reads for degraded mode, up to a limit on their total size, dropping the least recently
+// stored first. It's safe for concurrent use.
+type staleCache struct {
+	mu      sync.Mutex
+	limit   int
+	size    int
+	order   *list.List // Of *staleCopy, most recently stored first
+	entries map[string]*list.Element
+}
+
+// newStaleCache creates a staleCache keeping up to limit bytes of response bodies.
+func newStaleCache(limit int) *staleCache {
+	return &staleCache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the copy kept under key, if there is one no older than maxAge.
+func (c *staleCache) get(key string, maxAge time.Duration) (staleCopy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return staleCopy{}, false
+	}
+	kept := e.Value.(*staleCopy)
+	if time.Since(kept.stored) > maxAge {
+		return staleCopy{}, false
+	}
+	return *kept, true
+}
+
+// put keeps a copy under key, replacing any copy already there.
+func (c *staleCache) put(key string, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&staleCopy{key: key, header: header, body: body, stored: time.Now()})
+	c.size += len(body)
+	for c.size > c.limit {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget throws away every copy kept for a credential, such as when its session is logged out of.
+func (c *staleCache) forget(credential string) {
+	prefix := string(hashToken(credential)) + "\x00"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+}
+
+// remove drops a copy, the caller must hold c.mu.
+func (c *staleCache) remove(e *list.Element) {
+	kept := c.order.Remove(e).(*staleCopy)
+	delete(c.entries, kept.key)
+	c.size -= len(kept.body)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"examples/ratelimit"
+	"examples/requestctx"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestReplaySkipsRateLimit checks a write replayed after degraded mode queued it isn't rate limited a second time, as
+// the client's request was already let through when it first arrived.
+func TestReplaySkipsRateLimit(t *testing.T) {
+	deps := testDeps(t, boltDB(t))
+	deps.RateLimiter = ratelimit.NewFixedWindow(1, time.Minute)
+	s, err := NewServer(deps)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	handler := s.routes()
+
+	if w := serve(handler, "", http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(handler, "", http.MethodGet, "/", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(requestctx.WithReplay(r.Context(), requestctx.Replay{}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("replayed request: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleting a User happens in two parts. The User is hidden straight away (a soft delete), so they can't log in and
+// nobody can find them, then a background task (cascadeDeletions) works through cleaning up everything they left
+// behind. Doing the cleanup in the background keeps the request fast however much there is to clean up, and lets a
+// step that fails (such as our blob store being unreachable) be retried later without anyone having to notice.
+
+// deletionBatchSize is how many deletions cascadeDeletions works through on each run
+const deletionBatchSize = 50
+
+// deletionStep is one part of cleaning up after a deleted User. Steps must be safe to run more than once, a step that
+// fails part way through is run again from the start.
+type deletionStep struct {
+	name string // Recorded as the deletion's progress once the step finishes, such as "sessions"
+	run  func(userID int64) error
+}
+
+// deletionSteps lists every step of cleaning up after a deleted User, in the order they're run. Adding a step for
+// something new a User can own is a matter of adding an entry here, before the final "user" step.
+func (s *server) deletionSteps() []deletionStep {
+	return []deletionStep{
+		{name: "sessions", run: func(userID int64) error {
+			_, err := s.db.DeleteUserSessions(userID)
+			return err
+		}},
+		{name: "memberships", run: func(userID int64) error {
+			_, err := s.db.RemoveUserMemberships(userID)
+			return err
+		}},
+		{name: "audit", run: func(userID int64) error {
+			_, err := s.db.AnonymizeAuditEntries(userID)
+			return err
+		}},
+		{name: "blobs", run: s.deleteUserBlobs},
+		// Deleting the User record last also removes anything left that refers to it (identities, 2FA, etc)
+		{name: "user", run: s.db.DeleteUser},
+	}
+}
+
+// deletionResponse describes the progress of deleting a User.
+type deletionResponse struct {
+	UserID    int64      `json:"userId"`
+	Requested time.Time  `json:"requested"`
+	Status    string     `json:"status"`              // "pending" or "complete"
+	Step      string     `json:"step,omitempty"`      // The last cleanup step that finished
+	Attempts  int        `json:"attempts,omitempty"`  // How many times cleanup has failed
+	Error     string     `json:"error,omitempty"`     // Why cleanup last failed
+	Completed *time.Time `json:"completed,omitempty"` // When cleanup finished
+}
+
+// newDeletionResponse describes a UserDeletion for clients.
+func newDeletionResponse(deletion database.UserDeletion) deletionResponse {
+	resp := deletionResponse{
+		UserID:    deletion.UserID,
+		Requested: deletion.Requested,
+		Status:    deletion.Status,
+		Step:      deletion.Step,
+		Attempts:  deletion.Attempts,
+		Error:     deletion.Error,
+	}
+	if !deletion.Completed.IsZero() {
+		resp.Completed = &deletion.Completed
+	}
+	return resp
+}
+
+// userDelete deletes a User. They're hidden straight away, and everything else is cleaned up in the background, so we
+// respond with where to check on the cleanup's progress.
+func (s *server) userDelete(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.unscoped(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	deletion, err := s.unscoped(r).SoftDeleteUser(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.delete", user.ID, "")
+	s.publish(r, eventUserDeleted, user.ID, userDeletedEvent{ID: user.ID})
+	// 202 Accepted, as the cleanup hasn't happened yet
+	w.Header().Set("Location", fmt.Sprintf("/admin/deletions/%d", user.ID))
+	s.writeJSON(w, r, http.StatusAccepted, newDeletionResponse(deletion))
+}
+
+// userDeletion reports the progress of deleting the User with the ID in the {id} path parameter. Deleted Users can no
+// longer be looked up by their username, so deletions are found by ID instead.
+func (s *server) userDeletion(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		s.writeError(w, r, errs.New(errs.Invalid, "user ID must be a number"))
+		return
+	}
+	deletion, err := s.unscoped(r).GetUserDeletion(id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, newDeletionResponse(deletion))
+}
+
+// cascadeDeletions is a background task that cleans up after deleted Users (see registerTasks). A deletion that fails
+// part way is picked up again on the next run, so only failing to find pending deletions fails the task.
+func (s *server) cascadeDeletions(ctx context.Context) error {
+	deletions, err := s.db.PendingUserDeletions(deletionBatchSize)
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to list pending user deletions: %v", err)
+		return err
+	}
+	for _, deletion := range deletions {
+		s.runDeletion(deletion)
+	}
+	return nil
+}
+
+// runDeletion works through the cleanup steps for a deleted User, picking up after the last step that finished. Each
+// step is recorded as it finishes, and a failing step stops the cleanup until the next run.
+func (s *server) runDeletion(deletion database.UserDeletion) {
+	steps := s.deletionSteps()
+	// Skip the steps that finished on an earlier run
+	next := 0
+	for i, step := range steps {
+		if step.name == deletion.Step {
+			next = i + 1
+		}
+	}
+
+	for _, step := range steps[next:] {
+		if err := step.run(deletion.UserID); err != nil {
+			deletion.Attempts++
+			deletion.Error = fmt.Sprintf("%s: %v", step.name, err)
+			s.logger.Printf("ERROR: Unable to clean up %s for deleted user %d (attempt %d): %v", step.name, deletion.UserID, deletion.Attempts, err)
+			s.saveDeletion(&deletion)
+			return
+		}
+		deletion.Step = step.name
+		deletion.Error = ""
+		if step.name == steps[len(steps)-1].name {
+			deletion.Status = database.DeletionComplete
+			deletion.Completed = clock.Now()
+		}
+		if !s.saveDeletion(&deletion) {
+			return
+		}
+	}
+	s.logger.Printf("INFO: Finished cleaning up deleted user %d", deletion.UserID)
+}
+
+// saveDeletion records a deletion's progress, reporting whether it was saved. Failing to save progress isn't fatal, the
+// steps are safe to run again, but there's no point carrying on until we can.
+func (s *server) saveDeletion(deletion *database.UserDeletion) bool {
+	if err := s.db.SaveUserDeletion(deletion); err != nil {
+		s.logger.Printf("ERROR: Unable to record progress deleting user %d: %v", deletion.UserID, err)
+		return false
+	}
+	return true
+}
+
+// deleteUserBlobs deletes a User's files from our blob store. Blob stores we can't delete from (such as a read only
+// mount) are skipped, their files aren't reachable without a signed link anyway.
+func (s *server) deleteUserBlobs(userID int64) error {
+	remover, ok := s.blobs.(blobRemover)
+	if !ok {
+		return nil
+	}
+	for _, name := range []string{"avatars/" + strconv.FormatInt(userID, 10)} {
+		if err := remover.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !dev
+
+package main
+
+import "errors"
+
+// startDevDatabase is unavailable outside dev builds, see devdb_dev.go.
+func startDevDatabase() error {
+	return errors.New("the embedded dev database is only available in dev builds, build with -tags dev")
+}
@@ -0,0 +1,40 @@
+//go:build dev
+
+package main
+
+import (
+	"examples/database/embedded"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// devDatabaseDir is where `serve --dev` keeps its database, relative to where we're run from, so its data survives
+// restarts. Delete it to start again from an empty database.
+const devDatabaseDir = ".devdb"
+
+// startDevDatabase starts an embedded PostgreSQL server for `serve --dev` (see the embedded package), pointing
+// DATABASE_URL at it so the rest of our startup uses it like any other database. It's stopped when we're interrupted
+// (Ctrl-C) or terminated, as it's a separate process that would otherwise carry on without us.
+func startDevDatabase() error {
+	pg, err := embedded.Start(embedded.Options{Dir: devDatabaseDir})
+	if err != nil {
+		return err
+	}
+	os.Setenv("DATABASE_URL", pg.URL())
+	// Shards need databases of their own, which a dev database doesn't have
+	os.Unsetenv("SHARD_URLS")
+	fmt.Fprintf(os.Stderr, "Using embedded dev database at %s (data kept in %s)\n", pg.URL(), devDatabaseDir)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		if err := pg.Stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to stop embedded dev database: %v\n", err)
+		}
+		os.Exit(0)
+	}()
+	return nil
+}
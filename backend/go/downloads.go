@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"examples/errs"
+	"examples/signedurl"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadsPrefix is where files in our blob store are served from. Files are organised by what they are, such as
+// avatars/{userID} for avatars and exports/{name} for data exports.
+const downloadsPrefix = "/downloads/"
+
+// blobRemover is implemented by blob stores we can delete files from, such as when cleaning up after a deleted User.
+type blobRemover interface {
+	Remove(name string) error
+}
+
+// dirBlobs is a blob store backed by a plain directory, which unlike os.DirFS can also delete files.
+type dirBlobs struct {
+	fs.FS
+	dir string
+}
+
+// newDirBlobs creates a blob store serving the files in dir.
+func newDirBlobs(dir string) dirBlobs {
+	return dirBlobs{FS: os.DirFS(dir), dir: dir}
+}
+
+// Remove implements blobRemover, deleting a file from the directory.
+func (b dirBlobs) Remove(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Remove(filepath.Join(b.dir, filepath.FromSlash(name)))
+}
+
+// signedURLLifetime is how long a download link works for. Anyone holding the link can use it, so keep this short, a
+// client should ask for a fresh link each time it needs one rather than saving them.
+const signedURLLifetime = 5 * time.Minute
+
+// signDownload returns a signed link to a file in our blob store, such as "avatars/12".
+func (s *server) signDownload(name string) string {
+	// Only the path our router sees is signed, as that's all signedURL gets to check (see basepath.go)
+	return s.pathTo(s.urlSigner.Sign(downloadsPrefix+name, time.Now().Add(signedURLLifetime)))
+}
+
+// signedURL only lets requests through whose URL we signed (see signDownload), and which haven't expired. Downloads
+// are protected by this rather than our auth middleware, so serving a large file doesn't need a session lookup.
+func (s *server) signedURL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch err := s.urlSigner.Verify(r.URL, time.Now()); {
+		case errors.Is(err, signedurl.ErrExpired):
+			s.writeError(w, r, errs.New(errs.Forbidden, "this link has expired, please request a new one"))
+			return
+		case err != nil:
+			s.writeError(w, r, errs.New(errs.Forbidden, "this link is invalid"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// download serves a file from our blob store. Only reachable through signedURL, so whoever is asking was handed a link
+// to this exact file.
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	notFound := errs.New(errs.NotFound, "file not found")
+	name := strings.TrimPrefix(r.URL.Path, downloadsPrefix)
+	// fs.ValidPath rejects anything trying to escape the blob store, such as "../"
+	if s.blobs == nil || !fs.ValidPath(name) {
+		s.writeError(w, r, notFound)
+		return
+	}
+	f, err := s.blobs.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.writeError(w, r, notFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "download"))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "download"))
+		return
+	}
+	if info.IsDir() {
+		s.writeError(w, r, notFound)
+		return
+	}
+
+	// The link is only valid for a short time, so there's no point caching the file for longer, and shared caches
+	// shouldn't keep it at all
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(signedURLLifetime.Seconds())))
+	// An ETag lets a client resuming a download check the file hasn't changed since it started (with If-Range), so it
+	// never stitches together pieces of two different files
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+
+	// http.ServeContent takes care of Range and If-Range requests, letting an interrupted download of a large export
+	// resume where it left off rather than starting again, along with conditional requests and the Content-Type. It
+	// needs to seek around the file, which files from a plain directory can do.
+	if content, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime(), content)
+		return
+	}
+
+	// Blob stores that can't seek can still be downloaded in one go, just without resuming
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if _, err := io.Copy(w, f); err != nil {
+		// We've already started sending the file, so all we can do is log it
+		s.logger.Printf("WARNING: Unable to finish download of %s: %v", name, err)
+	}
+}
+
+// userAvatar redirects to a signed link for a User's avatar, so it can be shown with a plain <img> tag.
+func (s *server) userAvatar(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, s.signDownload("avatars/"+strconv.FormatInt(user.ID, 10)), http.StatusSeeOther)
+}
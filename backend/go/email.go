@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// emailChangeLifetime is how long a user has to confirm a change of email
+const emailChangeLifetime = 24 * time.Hour
+
+// emailJob is the kind of job that sends an email, its payload is a mailer.Message
+const emailJob = "email"
+
+// emailChangeRequest is the body expected when changing a user's email.
+type emailChangeRequest struct {
+	Email string `json:"email"`
+}
+
+// userEmail starts changing a user's email. Nothing changes straight away, instead we email a confirmation link to the
+// new address, and the change is only applied once it's followed (see confirmEmail). This proves the user actually
+// owns the new address, and stops a typo from locking them out of their account.
+func (s *server) userEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// Users may only change their own email
+	if self, _ := requestctx.User(r.Context()); self.ID != user.ID {
+		s.writeError(w, r, errs.New(errs.Forbidden, "you may only change your own email"))
+		return
+	}
+
+	var req emailChangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	email, err := s.emails.Validate(r.Context(), req.Email)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	req.Email = email
+	if err := s.emailAvailable(r, req.Email); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// Store the pending change, along with the hash of the token we're about to send
+	token, hash, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "userEmail"))
+		return
+	}
+	change := database.EmailChange{
+		TokenHash: hash,
+		UserID:    user.ID,
+		OldEmail:  user.Email,
+		NewEmail:  req.Email,
+		Expires:   clock.Now().Add(emailChangeLifetime),
+	}
+	if err := s.dbFor(r).CreateEmailChange(&change); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+
+	// Send the confirmation link to the new address
+	if err := s.mailer.Send(r.Context(), mailer.Message{
+		To:      change.NewEmail,
+		Subject: "Confirm your new email",
+		Body: fmt.Sprintf("Someone (hopefully you!) asked to change the email on your account to this address.\n\n"+
+			"To confirm the change, visit %s/email/confirm/%s within the next 24 hours.\n\n"+
+			"If this wasn't you, you can safely ignore this email.", s.frontendURL, token),
+	}); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	// 202 Accepted, as the change won't happen until it's confirmed
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// confirmEmail applies a pending email change, using the token we emailed to the new address. Once applied, we let the
+// old address know, so the real owner of the account finds out if this wasn't them.
+func (s *server) confirmEmail(w http.ResponseWriter, r *http.Request) {
+	change, err := s.unscoped(r).ConfirmEmailChange(hashToken(mux.Vars(r)["token"]))
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.NotFound, "this link is invalid or has expired"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.publishUser(r, eventUserEmailChanged, change.UserID)
+
+	// The change has been made, so there's no need to hold up the response while we notify the old address. Failing to
+	// queue the email shouldn't fail the request either, but it is worth logging.
+	if err := s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+		To:      change.OldEmail,
+		Subject: "Your email has been changed",
+		Body: fmt.Sprintf("The email on your account has been changed to %s.\n\n"+
+			"If this wasn't you, please contact support immediately.", change.NewEmail),
+	}); err != nil {
+		s.logger.Printf("ERROR: Unable to notify old address of email change for user %d: %v", change.UserID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userByEmail looks up a User by their email, in its canonical form (see the emailaddr package). Users who signed up
+// before we canonicalized addresses may be stored as they typed it, so if there's no User with the canonical form we
+// look for the address exactly as given too.
+func (s *server) userByEmail(r *http.Request, email string) (database.User, error) {
+	email = strings.TrimSpace(email)
+	canonical, err := s.emails.Canonical(email)
+	if err != nil {
+		canonical = email
+	}
+	user, err := s.unscoped(r).GetUserByEmail(canonical)
+	if errors.Is(err, errs.NotFound) && canonical != email {
+		return s.unscoped(r).GetUserByEmail(email)
+	}
+	return user, err
+}
+
+// emailAvailable returns a Conflict error if the email already belongs to a user.
+func (s *server) emailAvailable(r *http.Request, email string) error {
+	_, err := s.userByEmail(r, email)
+	if err == nil {
+		return database.ErrEmailTaken
+	}
+	if errors.Is(err, errs.NotFound) {
+		return nil
+	}
+	return err
+}
+
+// sendEmailJob sends an email queued as an emailJob, it's retried by the queue if sending fails.
+func (s *server) sendEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var msg mailer.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, msg)
+}
@@ -0,0 +1,205 @@
+// emailaddr checks and canonicalizes the email addresses Users sign up and change to. Email addresses are surprisingly
+// loose: the same mailbox can be written as Jane@Example.com, jane@example.com, or (with some providers)
+// jane+newsletter@example.com, and domains may be written in Unicode or in their ASCII (punycode) form. Storing every
+// address in one canonical form means one mailbox can only ever belong to one User, and Users can log in however they
+// happen to type their address.
+//
+// Beyond the syntax, we can optionally check the domain can actually receive email (it has MX records), and turn away
+// throwaway addresses from disposable email services, which are mostly used to dodge per-User limits.
+package emailaddr
+
+import (
+	"context"
+	"errors"
+	"examples/errs"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// lookupTimeout caps how long we wait on DNS when checking a domain's MX records
+const lookupTimeout = 3 * time.Second
+
+// Providers whose mailboxes ignore anything after a + in the local part (the part before the @), so jane+news@ and
+// jane@ are the same mailbox. Only these have their tags stripped, elsewhere a + may be a meaningful part of the
+// address. The value is the domain to canonicalize to, for providers with more than one domain for the same mailboxes.
+var plusTagProviders = map[string]string{
+	"gmail.com":      "gmail.com",
+	"googlemail.com": "gmail.com",
+	"outlook.com":    "outlook.com",
+	"hotmail.com":    "hotmail.com",
+	"live.com":       "live.com",
+	"fastmail.com":   "fastmail.com",
+	"protonmail.com": "protonmail.com",
+	"proton.me":      "proton.me",
+	"icloud.com":     "icloud.com",
+}
+
+// Providers whose mailboxes also ignore dots in the local part, so j.a.n.e@ and jane@ are the same mailbox
+var dotlessProviders = map[string]bool{
+	"gmail.com": true,
+}
+
+// defaultBlocklist holds well known disposable email domains. It's far from complete (new ones appear every day), so
+// add any others you see being used through Options.Blocklist.
+var defaultBlocklist = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"guerrillamail.net",
+	"mailinator.com",
+	"maildrop.cc",
+	"mintemail.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// Options configures a Validator.
+type Options struct {
+	StripPlusTags bool     // Strip + tags from addresses with providers known to ignore them (see plusTagProviders)
+	CheckMX       bool     // Check the domain can receive email, which needs a DNS lookup
+	Blocklist     []string // Disposable email domains to refuse, on top of our defaults. Subdomains are refused too.
+}
+
+// Validator canonicalizes and validates email addresses. It's safe for concurrent use.
+type Validator struct {
+	stripPlusTags bool
+	checkMX       bool
+	blocked       map[string]bool
+	resolver      *net.Resolver
+}
+
+// New creates a Validator with the given options.
+func New(opts Options) *Validator {
+	v := &Validator{
+		stripPlusTags: opts.StripPlusTags,
+		checkMX:       opts.CheckMX,
+		blocked:       make(map[string]bool),
+		resolver:      net.DefaultResolver,
+	}
+	for _, domain := range append(defaultBlocklist, opts.Blocklist...) {
+		// Canonicalize blocked domains the same way as addresses, so a Unicode entry still matches
+		if ascii, err := idna.Lookup.ToASCII(strings.TrimSpace(domain)); err == nil && ascii != "" {
+			v.blocked[strings.ToLower(ascii)] = true
+		}
+	}
+	return v
+}
+
+// Canonical returns the canonical form of an address: lowercased, with its domain in ASCII (punycode) form, and with
+// any + tag stripped if enabled and the provider ignores them. Only the syntax is checked, use Validate for new
+// addresses. Returns an errs.Invalid error if the address isn't valid.
+func (v *Validator) Canonical(addr string) (string, error) {
+	invalid := errs.New(errs.Invalid, "a valid email is required")
+	addr = strings.TrimSpace(addr)
+	// ParseAddress accepts a display name too ("Jane <jane@example.com>"), we only want the bare address
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr || parsed.Name != "" {
+		return "", invalid
+	}
+	at := strings.LastIndex(addr, "@")
+	local, domain := addr[:at], addr[at+1:]
+
+	// Lookup applies the same mapping browsers do, which lowercases the domain along the way
+	domain, err = idna.Lookup.ToASCII(domain)
+	if err != nil || !strings.Contains(domain, ".") {
+		return "", invalid
+	}
+	domain = strings.ToLower(domain)
+	// Strictly speaking the local part is case sensitive, but in practice no provider treats it that way, and Users
+	// expect to be able to log in however they capitalize their address
+	local = strings.ToLower(local)
+
+	if v.stripPlusTags {
+		if canonical, ok := plusTagProviders[domain]; ok {
+			domain = canonical
+			local, _, _ = strings.Cut(local, "+")
+			if dotlessProviders[domain] {
+				local = strings.ReplaceAll(local, ".", "")
+			}
+			if local == "" {
+				return "", invalid
+			}
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+// Validate checks an address a User is signing up or changing to, returning its canonical form. On top of the syntax
+// checks made by Canonical, the address is refused if its domain is on our disposable email blocklist, or (if enabled)
+// can't receive email.
+func (v *Validator) Validate(ctx context.Context, addr string) (string, error) {
+	canonical, err := v.Canonical(addr)
+	if err != nil {
+		return "", err
+	}
+	domain := canonical[strings.LastIndex(canonical, "@")+1:]
+	if v.isBlocked(domain) {
+		return "", errs.New(errs.Invalid, "disposable email addresses aren't allowed, please use a permanent address")
+	}
+	if v.checkMX {
+		if err := v.receivesMail(ctx, domain); err != nil {
+			return "", err
+		}
+	}
+	return canonical, nil
+}
+
+// isBlocked reports whether a domain, or any domain it's a subdomain of, is on our blocklist.
+func (v *Validator) isBlocked(domain string) bool {
+	for {
+		if v.blocked[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return false
+		}
+		domain = parent
+	}
+}
+
+// receivesMail checks that a domain can receive email. That usually means it has MX records, but without any, mail is
+// delivered straight to the domain's own address (RFC 5321 section 5.1), so having an address is enough too.
+func (v *Validator) receivesMail(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	mx, err := v.resolver.LookupMX(ctx, domain)
+	if err == nil {
+		// A single MX record of "." is a "null MX" (RFC 7505), the domain explicitly doesn't accept email
+		if len(mx) == 1 && mx[0].Host == "." {
+			return errs.New(errs.Invalid, "that email domain doesn't accept email")
+		}
+		if len(mx) > 0 {
+			return nil
+		}
+	}
+	if err == nil || notFound(err) {
+		if _, err = v.resolver.LookupHost(ctx, domain); err == nil {
+			return nil
+		}
+	}
+	if notFound(err) {
+		return errs.New(errs.Invalid, "that email domain can't receive email")
+	}
+	// Anything else is a problem with DNS rather than with the address, we'd rather let the occasional bad address
+	// through than turn Users away because our resolver is having a bad day
+	return nil
+}
+
+// notFound reports whether a DNS error means the name definitely doesn't exist (or has no records of the type asked
+// for), rather than the lookup failing.
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
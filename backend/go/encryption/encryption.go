@@ -0,0 +1,55 @@
+// encryption provides authenticated encryption for anything sensitive we need to store, such as the credentials kept
+// alongside each session. We use AES-256-GCM, which both hides the contents and detects any tampering with them.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// KeySize is the size of key required, in bytes (AES-256)
+const KeySize = 32
+
+// Box encrypts and decrypts data with a single key.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox creates a Box from a KeySize byte key. Keys should be generated randomly (e.g. `openssl rand -base64 32`) and
+// kept somewhere safe, anything encrypted with a key can't be decrypted without it.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts plaintext. The random nonce used is stored at the start of the returned ciphertext.
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// Appending to nonce gives us nonce followed by the ciphertext, in a single slice
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts ciphertext created by Seal, returning an error if it was created with a different key or tampered with.
+func (b *Box) Open(ciphertext []byte) ([]byte, error) {
+	size := b.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("ciphertext too short")
+	}
+	return b.aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+}
@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Keyring encrypts with its newest key, and decrypts with whichever of its keys was used, so keys can be rotated without
+// losing access to anything encrypted before. Each key has an ID (1-255) that's stored as the first byte of everything
+// it seals, telling us which key to open it with.
+//
+// To rotate keys, add a new key with a new ID as the current key, keeping the old one around until everything sealed
+// with it has been resealed (see Reseal).
+type Keyring struct {
+	current byte
+	boxes   map[byte]*Box
+}
+
+// NewKeyring creates a Keyring that seals with the key with the current ID, and opens with any of the given keys.
+func NewKeyring(current byte, keys map[byte][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("no key with the current ID %d", current)
+	}
+	k := &Keyring{current: current, boxes: make(map[byte]*Box, len(keys))}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, errors.New("key IDs must be from 1 to 255")
+		}
+		box, err := NewBox(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		k.boxes[id] = box
+	}
+	return k, nil
+}
+
+// Seal encrypts plaintext with the current key, prefixed with its ID.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	ciphertext, err := k.boxes[k.current].Seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{k.current}, ciphertext...), nil
+}
+
+// Open decrypts ciphertext created by Seal with any of our keys. Ciphertext sealed by a plain Box before we had key IDs
+// is opened too, by trying each key in turn (AES-GCM won't open anything sealed with a different key, so this is safe).
+func (k *Keyring) Open(ciphertext []byte) ([]byte, error) {
+	plaintext, _, err := k.open(ciphertext)
+	return plaintext, err
+}
+
+// Reseal re-encrypts ciphertext with the current key, reporting false (and returning nil) if it already was.
+func (k *Keyring) Reseal(ciphertext []byte) ([]byte, bool, error) {
+	plaintext, current, err := k.open(ciphertext)
+	if err != nil || current {
+		return nil, false, err
+	}
+	resealed, err := k.Seal(plaintext)
+	if err != nil {
+		return nil, false, err
+	}
+	return resealed, true, nil
+}
+
+// open decrypts ciphertext, also reporting whether it was sealed with the current key.
+func (k *Keyring) open(ciphertext []byte) ([]byte, bool, error) {
+	if len(ciphertext) > 0 {
+		if box, ok := k.boxes[ciphertext[0]]; ok {
+			if plaintext, err := box.Open(ciphertext[1:]); err == nil {
+				return plaintext, ciphertext[0] == k.current, nil
+			}
+		}
+	}
+	// Without a known key ID, this may be from before we had them
+	for _, box := range k.boxes {
+		if plaintext, err := box.Open(ciphertext); err == nil {
+			return plaintext, false, nil
+		}
+	}
+	return nil, false, errors.New("ciphertext wasn't sealed with any of our keys, or was tampered with")
+}
@@ -0,0 +1,102 @@
+// errorlog keeps the most recent server side errors in memory, along with enough context (request ID, route, where in
+// our code it came from) to start investigating. It's no replacement for a proper error tracking or APM service, but it
+// means a quick look at our admin endpoint can answer "what's been going wrong?" when one isn't available.
+package errorlog
+
+import (
+	"examples/clock"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFrames limits how much of the stack we keep for each error
+const maxFrames = 16
+
+// Record describes a single error.
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Code      string    `json:"code"`
+	Op        string    `json:"op,omitempty"`     // Operation that failed, such as "sql.LoadSession", if known
+	UserID    int64     `json:"userId,omitempty"` // User the operation was performed for, if known
+	Error     string    `json:"error"`            // The full error, including any underlying cause
+	Stack     []string  `json:"stack"`            // Where the error was handled, innermost call first
+}
+
+// Ring holds up to a fixed number of the most recent errors, the oldest are dropped as new ones arrive. It is safe to
+// use from multiple goroutines.
+type Ring struct {
+	mu      sync.Mutex
+	records []Record // Used as a circular buffer once full
+	next    int      // Where the next record will be written
+	total   uint64   // Every error ever recorded, including those since dropped
+}
+
+// NewRing returns a Ring holding up to size errors.
+func NewRing(size int) *Ring {
+	return &Ring{records: make([]Record, 0, size)}
+}
+
+// Add records an error. The stack is captured here, skip is the number of callers to leave out of it (0 starts with
+// whoever called Add), so helpers that report errors on behalf of others can leave themselves out.
+func (r *Ring) Add(rec Record, skip int) {
+	if rec.Time.IsZero() {
+		rec.Time = clock.Now()
+	}
+	rec.Stack = stack(skip + 2)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total++
+	if cap(r.records) == 0 {
+		return
+	}
+	if len(r.records) < cap(r.records) {
+		r.records = append(r.records, rec)
+	} else {
+		r.records[r.next] = rec
+	}
+	r.next = (r.next + 1) % cap(r.records)
+}
+
+// Recent returns up to n of the most recent errors, newest first, along with the total number of errors recorded
+// since we started.
+func (r *Ring) Recent(n int) ([]Record, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > len(r.records) {
+		n = len(r.records)
+	}
+	out := make([]Record, 0, n)
+	for i := 1; i <= n; i++ {
+		// next is where we'll write, so the newest record is just before it
+		out = append(out, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return out, r.total
+}
+
+// stack returns the current call stack as "function file:line" strings, skipping the given number of frames.
+func stack(skip int) []string {
+	pcs := make([]uintptr, maxFrames)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []string
+	for {
+		frame, more := frames.Next()
+		// Once we reach the http package we're into our middleware chain and the server itself, which is the same for
+		// every error so isn't worth keeping
+		if strings.HasPrefix(frame.Function, "net/http.") {
+			break
+		}
+		out = append(out, frame.Function+" "+frame.File+":"+strconv.Itoa(frame.Line))
+		if !more {
+			break
+		}
+	}
+	return out
+}
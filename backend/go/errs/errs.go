@@ -0,0 +1,185 @@
+// errs defines the error codes shared between our database layer, our handlers and our API responses. Rather than every
+// layer inventing its own errors (and every handler guessing which status code to return), errors carry a Code that
+// travels with them all the way up to the response.
+//
+// Errors from this package work with the standard errors.Is and errors.As functions:
+//
+//	if errors.Is(err, errs.NotFound) { ... }
+//
+//	var e *errs.Error
+//	if errors.As(err, &e) { log.Println(e.Op, e.UserID) }
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Code categorises an error. Codes are errors themselves, so they can be used directly as the target of errors.Is.
+type Code string
+
+// Error implements the error interface.
+func (c Code) Error() string {
+	return string(c)
+}
+
+// Our error codes, keep these generic so they map cleanly to HTTP status codes (and any other transport we add later)
+const (
+	Internal        Code = "internal"          // Something went wrong on our end, nothing the caller can do about it
+	Invalid         Code = "invalid"           // The request was malformed or failed validation
+	Unauthorized    Code = "unauthorized"      // The caller isn't authenticated
+	Forbidden       Code = "forbidden"         // The caller is authenticated, but isn't allowed to do this
+	NotFound        Code = "not_found"         // The requested record doesn't exist
+	Conflict        Code = "conflict"          // The request conflicts with an existing record (e.g. duplicate email)
+	TooManyRequests Code = "too_many_requests" // The caller has been rate limited
+	Locked          Code = "locked"            // The account has been locked, such as after too many failed logins
+	Unavailable     Code = "unavailable"       // A dependency (such as our database) is currently unreachable
+)
+
+// Error is an error with a Code, and optionally some context about where it happened and who it happened to.
+type Error struct {
+	Code    Code   // Category of the error, defaults to Internal if empty
+	Op      string // Operation that failed, such as "sql.LoadSession"
+	UserID  int64  // User the operation was performed for, if known
+	Message string // Message safe to show to the caller
+	Err     error  // Underlying error, if any. This is never shown to the caller.
+
+	// RetryAfter is how long the caller should wait before trying again, if known. Mostly useful for TooManyRequests
+	// and Unavailable errors, where it is sent back as a Retry-After header.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface, describing the error along with any context it carries.
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Op != "" {
+		b.WriteString(e.Op)
+		b.WriteString(": ")
+	}
+	if e.UserID != 0 {
+		fmt.Fprintf(&b, "user %d: ", e.UserID)
+	}
+	switch {
+	case e.Message != "" && e.Err != nil:
+		fmt.Fprintf(&b, "%s: %v", e.Message, e.Err)
+	case e.Message != "":
+		b.WriteString(e.Message)
+	case e.Err != nil:
+		b.WriteString(e.Err.Error())
+	default:
+		b.WriteString(string(CodeOf(e)))
+	}
+	return b.String()
+}
+
+// Unwrap allows errors.Is and errors.As to inspect the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether this error has the target Code, allowing errors.Is(err, errs.NotFound).
+func (e *Error) Is(target error) bool {
+	code, ok := target.(Code)
+	return ok && e.Code == code
+}
+
+// New creates an error with the given code and a message that is safe to show to the caller.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap attaches the name of the failing operation to an error. If the error doesn't already carry a Code it will be
+// treated as Internal. Wrapping a nil error returns nil, so this can be used directly on return values.
+func Wrap(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: CodeOf(err), Op: op, Err: err}
+}
+
+// WrapCode is like Wrap, but also sets the Code of the error.
+func WrapCode(err error, code Code, op string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Op: op, Err: err}
+}
+
+// WithUser attaches the ID of the user an operation was performed for, which is very helpful when reading logs.
+func WithUser(err error, userID int64) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: CodeOf(err), UserID: userID, Err: err}
+}
+
+// WithRetryAfter attaches how long the caller should wait before trying the request again.
+func WithRetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: CodeOf(err), Err: err, RetryAfter: d}
+}
+
+// RetryAfterOf returns the outermost RetryAfter duration in the chain, or zero if there is none.
+func RetryAfterOf(err error) time.Duration {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if e, ok := e.(*Error); ok && e.RetryAfter > 0 {
+			return e.RetryAfter
+		}
+	}
+	return 0
+}
+
+// CodeOf returns the Code of the outermost error in the chain that has one, or Internal if there is none.
+func CodeOf(err error) Code {
+	for err != nil {
+		switch e := err.(type) {
+		case Code:
+			return e
+		case *Error:
+			if e.Code != "" {
+				return e.Code
+			}
+		}
+		err = errors.Unwrap(err)
+	}
+	return Internal
+}
+
+// MessageOf returns the outermost caller-safe message in the chain, falling back to a generic message for the Code.
+func MessageOf(err error) string {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if e, ok := e.(*Error); ok && e.Message != "" {
+			return e.Message
+		}
+	}
+	return http.StatusText(HTTPStatus(CodeOf(err)))
+}
+
+// HTTPStatus maps a Code to the HTTP status code our API responds with.
+func HTTPStatus(code Code) int {
+	switch code {
+	case Invalid:
+		return http.StatusBadRequest
+	case Unauthorized:
+		return http.StatusUnauthorized
+	case Forbidden:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case TooManyRequests:
+		return http.StatusTooManyRequests
+	case Locked:
+		return http.StatusLocked
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
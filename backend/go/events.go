@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Types of domain event (see database.DomainEvent). Every user.* event apart from user.deleted and user.merged carries
+// the User as they are after the change, described just as our API describes them (userResponse), so a consumer can
+// keep its copy up to date by saving whatever the latest event says.
+const (
+	eventUserCreated         = "user.created"
+	eventUserEmailChanged    = "user.email_changed"
+	eventUserEmailVerified   = "user.email_verified"
+	eventUserNameChanged     = "user.name_changed"
+	eventUserUsernameChanged = "user.username_changed"
+	eventUserRoleChanged     = "user.role_changed"
+	eventUserEnabled         = "user.enabled"
+	eventUserDisabled        = "user.disabled"
+	eventUserDeleted         = "user.deleted"      // Carries userDeletedEvent
+	eventUserMerged          = "user.merged"       // Carries userMergedEvent
+	eventDealershipJoined    = "dealership.joined" // Carries dealershipMemberEvent
+	eventDealershipLeft      = "dealership.left"   // Carries dealershipMemberEvent
+)
+
+// userDeletedEvent is the data for eventUserDeleted.
+type userDeletedEvent struct {
+	ID int64 `json:"id"`
+}
+
+// userMergedEvent is the data for eventUserMerged, the merged User no longer exists, their data now belongs to Into.
+type userMergedEvent struct {
+	ID   int64 `json:"id"`
+	Into int64 `json:"into"`
+}
+
+// dealershipMemberEvent is the data for eventDealershipJoined and eventDealershipLeft.
+type dealershipMemberEvent struct {
+	UserID       int64 `json:"userId"`
+	DealershipID int64 `json:"dealershipId"`
+}
+
+// Limits on how many domain events are listed at once
+const (
+	defaultEventPage = 100
+	maxEventPage     = 1000
+)
+
+// publish records a domain event. Like audit, the change has already been made by the time we record it, so failing to
+// record it is logged rather than failing the request. Consumers relying on events should reconcile occasionally.
+func (s *server) publish(r *http.Request, kind string, userID int64, data any) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to encode domain event %q for user %d: %v", kind, userID, err)
+		return
+	}
+	event := database.DomainEvent{
+		Time:   clock.Now(),
+		Type:   kind,
+		UserID: userID,
+		Data:   encoded,
+	}
+	if err := s.unscoped(r).AppendDomainEvent(&event); err != nil {
+		s.logger.Printf("ERROR: Unable to record domain event %q for user %d: %v", kind, userID, err)
+	}
+}
+
+// publishUser records a domain event carrying the User as they are now, loading them afresh so the event reflects
+// every change made so far, not just the one the caller knows about.
+func (s *server) publishUser(r *http.Request, kind string, userID int64) {
+	user, err := s.unscoped(r).GetUserByID(userID)
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to load user %d for domain event %q: %v", userID, kind, err)
+		return
+	}
+	s.publish(r, kind, userID, newUserResponse(user))
+}
+
+// domainEventResponse describes a domain event.
+type domainEventResponse struct {
+	Seq    int64           `json:"seq"`
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	UserID int64           `json:"userId,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// listDomainEvents lists our domain events, oldest first. Pass ?after= with the sequence number of the last event
+// already seen to carry on from there, and ?limit= for how many to list at once (up to 1000). An empty list means
+// there's nothing newer yet. cmd/events uses this to replay events to a consumer.
+func (s *server) listDomainEvents(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			s.writeError(w, r, errs.New(errs.Invalid, "after must be an event sequence number"))
+			return
+		}
+	}
+	limit := defaultEventPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxEventPage {
+			s.writeError(w, r, errs.New(errs.Invalid, "limit must be between 1 and 1000"))
+			return
+		}
+	}
+
+	events, err := s.unscoped(r).ListDomainEvents(after, limit)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]domainEventResponse, 0, len(events))
+	for _, e := range events {
+		resp = append(resp, domainEventResponse{
+			Seq:    e.Seq,
+			Time:   e.Time,
+			Type:   e.Type,
+			UserID: e.UserID,
+			Data:   e.Data,
+		})
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
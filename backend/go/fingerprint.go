@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"examples/config"
+	"examples/database"
+	"fmt"
+	"net/http"
+	"net/netip"
+)
+
+// Session fingerprints bind a database backed session to the client that logged in, so a session token copied from a
+// User's browser (or leaked in a log) is refused when used from somewhere else. Every session records a fingerprint
+// when it's created, kept in its encrypted credentials so it can't be changed, and how strictly it's checked is up to
+// SESSION_FINGERPRINT. Sessions created before we kept fingerprints have none, and are allowed until they end.
+//
+// A fingerprint is only a speed bump, not proof of who's calling. An attacker who can steal a token can often see the
+// User-Agent too, and share an address range with their victim. It does stop a token being replayed from the other
+// side of the world though.
+
+// Fingerprints cover the network a client's address is in rather than the address itself, as phones and home
+// connections change address often, but rarely network.
+const (
+	fingerprintPrefixIPv4 = 24
+	fingerprintPrefixIPv6 = 48
+)
+
+// fingerprint identifies the client making a request by its User-Agent, and the network its IP address is in.
+func (s *server) fingerprint(r *http.Request) string {
+	network := s.clientIP(r)
+	if addr, err := netip.ParseAddr(network); err == nil {
+		addr = addr.Unmap()
+		bits := fingerprintPrefixIPv6
+		if addr.Is4() {
+			bits = fingerprintPrefixIPv4
+		}
+		if prefix, err := addr.Prefix(bits); err == nil {
+			network = prefix.String()
+		}
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent() + "\x00" + network))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// fingerprintAllowed reports whether a session may be used by the client making a request, depending on
+// SESSION_FINGERPRINT. Mismatches are logged unless fingerprints are off, so operators can see how often they happen
+// before enforcing them.
+func (s *server) fingerprintAllowed(r *http.Request, session database.Session, creds sessionCreds) bool {
+	mode := s.config.Load().SessionFingerprint
+	if mode == config.FingerprintOff || creds.Fingerprint == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(creds.Fingerprint), []byte(s.fingerprint(r))) == 1 {
+		return true
+	}
+	if mode == config.FingerprintLog {
+		s.logger.Printf("WARNING: Session %d used from a different client (%s) than it was created by", session.ID, s.clientIP(r))
+		return true
+	}
+	s.logger.Printf("WARNING: Refused session %d, used from a different client (%s) than it was created by", session.ID, s.clientIP(r))
+	s.securityEvent(r, eventFingerprintMismatch, session.UserID, fmt.Sprintf("session %d refused", session.ID))
+	return false
+}
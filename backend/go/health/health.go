@@ -0,0 +1,167 @@
+// health runs the readiness checks for our dependencies (database, etc) in the background, keeping a short history of
+// results for each. The history lets operators tell a dependency that is flapping (repeatedly failing and recovering)
+// apart from one that is hard down, which usually have very different causes.
+package health
+
+import (
+	"context"
+	"examples/clock"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CheckFunc checks a single dependency, returning an error if it isn't usable.
+type CheckFunc func(ctx context.Context) error
+
+// Possible states of a dependency
+const (
+	StatusUp       = "up"       // The latest check passed
+	StatusDown     = "down"     // The latest check failed
+	StatusFlapping = "flapping" // The dependency has repeatedly switched between up and down recently
+)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Time     time.Time     `json:"time"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// Report describes the state of a single dependency.
+type Report struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	History []Result `json:"history,omitempty"` // Oldest first, only included in verbose reports
+}
+
+// Checker runs a set of named checks at a regular interval, remembering the most recent results for each.
+type Checker struct {
+	interval      time.Duration // How often each check runs
+	timeout       time.Duration // How long a single check may take before it counts as failed
+	historySize   int           // How many results to keep for each check
+	flapThreshold int           // How many up/down transitions within the history count as flapping
+
+	mu      sync.RWMutex
+	checks  map[string]CheckFunc
+	history map[string][]Result // Oldest first, at most historySize long
+}
+
+// NewChecker creates a Checker. Add checks with Add, then call Run in its own goroutine.
+func NewChecker(interval time.Duration) *Checker {
+	return &Checker{
+		interval:      interval,
+		timeout:       5 * time.Second,
+		historySize:   20,
+		flapThreshold: 4,
+		checks:        make(map[string]CheckFunc),
+		history:       make(map[string][]Result),
+	}
+}
+
+// Add registers a check with the given name. Checks should all be added before calling Run.
+func (c *Checker) Add(name string, check CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Run runs every check immediately, then again every interval until ctx is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce runs every check a single time, recording the results.
+func (c *Checker) runOnce(ctx context.Context) {
+	c.mu.RLock()
+	checks := make(map[string]CheckFunc, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.RUnlock()
+
+	for name, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		start := time.Now()
+		err := check(checkCtx)
+		cancel()
+		result := Result{Time: clock.UTC(start), OK: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		c.record(name, result)
+	}
+}
+
+// record adds a result to a check's history, dropping the oldest result once the history is full.
+func (c *Checker) record(name string, result Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := append(c.history[name], result)
+	if len(history) > c.historySize {
+		history = history[len(history)-c.historySize:]
+	}
+	c.history[name] = history
+}
+
+// Ready reports whether the latest result of every check passed. A check that hasn't run yet counts as not ready.
+func (c *Checker) Ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name := range c.checks {
+		history := c.history[name]
+		if len(history) == 0 || !history[len(history)-1].OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports describes the state of every check. Verbose reports include each check's recent history.
+func (c *Checker) Reports(verbose bool) []Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	reports := make([]Report, 0, len(c.checks))
+	for name := range c.checks {
+		history := c.history[name]
+		report := Report{Name: name, Status: c.status(history)}
+		if verbose {
+			report.History = append([]Result(nil), history...)
+		}
+		reports = append(reports, report)
+	}
+	// Maps have no order, so sort by name to keep our reports consistent
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// status works out the state of a dependency from its history.
+func (c *Checker) status(history []Result) string {
+	if len(history) == 0 {
+		return StatusDown
+	}
+	// Count how many times the result switched between passing and failing
+	transitions := 0
+	for i := 1; i < len(history); i++ {
+		if history[i].OK != history[i-1].OK {
+			transitions++
+		}
+	}
+	if transitions >= c.flapThreshold {
+		return StatusFlapping
+	}
+	if history[len(history)-1].OK {
+		return StatusUp
+	}
+	return StatusDown
+}
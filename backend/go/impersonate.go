@@ -0,0 +1,86 @@
+package main
+
+import (
+	"examples/config"
+	"examples/database"
+	"examples/errs"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// impersonationLifetime is the longest an impersonation session lasts. They're for looking into a problem, not for
+// working as someone else all day.
+const impersonationLifetime = time.Hour
+
+// impersonationPermissions are all an impersonation session is allowed, whatever the impersonated User could do
+// themselves. Support staff need to see what the User sees, not change their password or 2FA on their behalf.
+var impersonationPermissions = []permission{permSelfRead, permUsersRead}
+
+// impersonationResponse is returned after starting an impersonation session.
+type impersonationResponse struct {
+	Token     string       `json:"token"`
+	Expires   time.Time    `json:"expires"`
+	EndOfLife time.Time    `json:"endOfLife"`
+	User      userResponse `json:"user"` // The User being impersonated
+}
+
+// impersonate starts a session acting as another User, so support staff can see exactly what the User sees while
+// debugging a problem of theirs. The session records who the real actor is, anything audited while using it is
+// attributed to them, and the User can see it among their sessions. It's read only (see impersonationPermissions),
+// short lived, and has no refresh token.
+//
+// The token is always returned in the response body rather than as a cookie, so it doesn't replace the admin's own
+// session, and is used as a bearer token.
+func (s *server) impersonate(w http.ResponseWriter, r *http.Request) {
+	if s.sessionMode != config.SessionModeDatabase {
+		s.writeError(w, r, errs.New(errs.Invalid, "impersonation needs database backed sessions"))
+		return
+	}
+	admin, _ := requestctx.User(r.Context())
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if user.ID == admin.ID {
+		s.writeError(w, r, errs.New(errs.Invalid, "you can't impersonate yourself"))
+		return
+	}
+	// Impersonating another admin would hand over their permissions, which is what promoting is for
+	if user.Role == database.RoleAdmin {
+		s.writeError(w, r, errs.New(errs.Forbidden, "admins can't be impersonated"))
+		return
+	}
+	if !user.Enabled {
+		s.writeError(w, r, errs.New(errs.Invalid, "disabled users can't be impersonated"))
+		return
+	}
+
+	session, token, err := s.newSession(r, user, database.RefreshToken{})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	session.ImpersonatorID = admin.ID
+	if end := session.Created.Add(impersonationLifetime); session.EndOfLife.After(end) {
+		session.EndOfLife = end
+	}
+	if session.Expires.After(session.EndOfLife) {
+		session.Expires = session.EndOfLife
+	}
+	if err := s.unscoped(r).SaveSession(&session); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+
+	s.audit(r, "user.impersonate", user.ID, fmt.Sprintf("session %d", session.ID))
+	s.securityEvent(r, eventImpersonation, user.ID, fmt.Sprintf("by user %d, session %d", admin.ID, session.ID))
+	s.writeJSON(w, r, http.StatusCreated, impersonationResponse{
+		Token:     token,
+		Expires:   session.Expires,
+		EndOfLife: session.EndOfLife,
+		User:      newUserResponse(user),
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"examples/errs"
+	"examples/mailer"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"sort"
+	"text/template"
+)
+
+// installLinksTemplate is the body of the email sending a user links to install our app. Templates are parsed once at
+// startup, template.Must panics if there's a mistake in one, so we'll find out immediately rather than on first use.
+var installLinksTemplate = template.Must(template.New("installLinks").Parse(`Hi {{.First}},
+
+Here are the links to install our app:
+{{range .Links}}
+  {{.Platform}}: {{.URL}}
+{{- end}}
+
+See you there!
+`))
+
+// installLink is a single link in our install links email.
+type installLink struct {
+	Platform, URL string
+}
+
+// installLinksRequest is the body expected when sending install links. Platforms is optional, leave it out to send links
+// for every platform.
+type installLinksRequest struct {
+	Platforms []string `json:"platforms"`
+}
+
+// sendInstallLinks emails a user the links to install our app on each platform. Each recipient may only be sent a few
+// of these emails in a short period, and whether the email was delivered is recorded in our audit log.
+func (s *server) sendInstallLinks(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// Users may only send install links to themselves
+	if self, _ := requestctx.User(r.Context()); self.ID != user.ID {
+		s.writeError(w, r, errs.New(errs.Forbidden, "you may only send install links to yourself"))
+		return
+	}
+
+	// A body is optional, without one we'll send every link
+	var req installLinksRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	if len(req.Platforms) == 0 {
+		for platform := range s.installLinks {
+			req.Platforms = append(req.Platforms, platform)
+		}
+	}
+	if len(req.Platforms) == 0 {
+		s.writeError(w, r, errs.New(errs.Unavailable, "no install links are configured"))
+		return
+	}
+	// Sort the platforms so our email lists them in a consistent order
+	sort.Strings(req.Platforms)
+	links := make([]installLink, 0, len(req.Platforms))
+	for _, platform := range req.Platforms {
+		url, ok := s.installLinks[platform]
+		if !ok {
+			s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("unknown platform %q", platform)))
+			return
+		}
+		links = append(links, installLink{Platform: platform, URL: url})
+	}
+
+	// Limit emails per recipient, so this can't be used to flood someone's inbox
+	if s.recipientLimiter != nil {
+		if ok, retryAfter := s.recipientLimiter.Allow(user.Email); !ok {
+			err := errs.New(errs.TooManyRequests, "install links were sent recently, please check your email")
+			err.RetryAfter = retryAfter
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	if err := installLinksTemplate.Execute(&body, struct {
+		First string
+		Links []installLink
+	}{user.First, links}); err != nil {
+		s.writeError(w, r, errs.Wrap(err, "sendInstallLinks"))
+		return
+	}
+	err = s.mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Install our app",
+		Body:    body.String(),
+	})
+
+	// Record whether the email was delivered either way, it's very helpful when a user says they never got it
+	if err != nil {
+		s.audit(r, "user.install_links", user.ID, fmt.Sprintf("failed: %v", err))
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.install_links", user.ID, fmt.Sprintf("sent %v", req.Platforms))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"examples/password"
+	"examples/requestctx"
+	"examples/username"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// inviteLifetime is how long someone has to accept an invite. Admins can always invite them again.
+const inviteLifetime = 7 * 24 * time.Hour
+
+// inviteRequest is the body expected when inviting someone.
+type inviteRequest struct {
+	Email string `json:"email"`
+}
+
+// inviteResponse describes an invite. The token is only ever emailed to whoever was invited, never returned here.
+type inviteResponse struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	InvitedBy int64     `json:"invitedBy"` // ID of the admin who sent the invite
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// newInviteResponse describes an invite for clients.
+func newInviteResponse(invite database.Invite) inviteResponse {
+	return inviteResponse{
+		ID:        invite.ID,
+		Email:     invite.Email,
+		InvitedBy: invite.InvitedBy,
+		Created:   invite.Created,
+		Expires:   invite.Expires,
+	}
+}
+
+// registerRequest is the body expected when creating an account with an invite. There's no email, the account gets
+// the one the invite was sent to.
+type registerRequest struct {
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	Username string `json:"username,omitempty"` // Optional, Users can choose one later
+	Password string `json:"password"`
+}
+
+// createInvite invites someone to create an account, emailing them a link to do so. Inviting an email again replaces
+// the earlier invite, so only the newest link works.
+func (s *server) createInvite(w http.ResponseWriter, r *http.Request) {
+	admin, _ := requestctx.User(r.Context())
+	var req inviteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	email, err := s.emails.Validate(r.Context(), req.Email)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.emailAvailable(r, email); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "createInvite"))
+		return
+	}
+	now := clock.Now()
+	invite := database.Invite{
+		TokenHash: hash,
+		Email:     email,
+		InvitedBy: admin.ID,
+		Created:   now,
+		Expires:   now.Add(inviteLifetime),
+	}
+	// The invite and its audit entry are created together, so there's never an invite nobody is recorded creating
+	err = s.dbFor(r).WithTx(r.Context(), func(tx database.Storer) error {
+		if err := tx.CreateInvite(&invite); err != nil {
+			return err
+		}
+		entry := s.auditEntry(r, "invite.create", 0, fmt.Sprintf("invite %d for %s", invite.ID, invite.Email))
+		return tx.CreateAuditEntry(&entry)
+	})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+		To:      invite.Email,
+		Subject: "You've been invited",
+		Body: fmt.Sprintf("You've been invited to create an account.\n\n"+
+			"To accept, visit %s/register/%s within the next 7 days.\n\n"+
+			"If you weren't expecting this, you can safely ignore this email.", s.frontendURL, token),
+	}); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusCreated, newInviteResponse(invite))
+}
+
+// listInvites lists the invites that haven't been accepted or expired yet, newest first.
+func (s *server) listInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := s.dbFor(r).ListInvites()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]inviteResponse, 0, len(invites))
+	for _, invite := range invites {
+		resp = append(resp, newInviteResponse(invite))
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// deleteInvite revokes an invite, such as one sent to the wrong address, so its link stops working.
+func (s *server) deleteInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		s.writeError(w, r, errs.New(errs.Invalid, "invite ID must be a positive number"))
+		return
+	}
+	if err := s.dbFor(r).DeleteInvite(id); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "invite.delete", 0, fmt.Sprintf("invite %d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// register creates an account using the token from an invite email, for the email the invite was sent to. Following
+// the link proves they own the address, so there's no need to verify it again. They log in as usual afterwards.
+func (s *server) register(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	req.Username = username.Normalize(req.Username)
+	if req.Username != "" {
+		if err := username.Validate(req.Username); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	if err := password.Validate(req.Password); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	user := database.User{First: req.First, Last: req.Last, Username: req.Username}
+	if err := password.SetPassword(&user, req.Password); err != nil {
+		s.writeError(w, r, errs.Wrap(err, "register"))
+		return
+	}
+	invite, err := s.unscoped(r).UseInvite(hashToken(mux.Vars(r)["token"]), &user)
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.NotFound, "this invite is invalid or has expired"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "user.register", user.ID, fmt.Sprintf("invite %d from user %d", invite.ID, invite.InvitedBy))
+	s.publish(r, eventUserCreated, user.ID, newUserResponse(user))
+	s.writeJSON(w, r, http.StatusCreated, newUserResponse(user))
+}
@@ -0,0 +1,144 @@
+// jobs is a queue of work to be done outside of a request, such as sending emails. Handlers enqueue a job and return
+// straight away, and a worker picks it up shortly after, retrying it with a backoff if it fails. Unlike our background
+// tasks (see the tasks package), which run on a schedule, jobs run once for each time they're enqueued.
+//
+// Where jobs are kept is up to the Store. Small deployments can keep them in our database (see database/sql), while
+// larger ones can move them to Redis (see RedisStore), without any change to the code enqueuing or handling them.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/metrics"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Job is a single piece of work waiting in the queue.
+type Job struct {
+	ID       string          // Assigned by the Store when the job is pushed
+	Kind     string          // Picks the Handler that runs the job, such as "email"
+	Payload  json.RawMessage // Whatever the Handler needs to run the job, as JSON
+	Attempts int             // How many times the job has been claimed, including the current attempt
+	RunAt    time.Time       // The job won't be claimed before this time
+}
+
+// Store keeps our queued jobs. Claiming a job leases it to the worker for a while rather than removing it, so a job
+// whose worker dies part way through is claimed again once its lease runs out, rather than lost.
+type Store interface {
+	// PushJob adds a job to the queue, to be run once its RunAt time has passed
+	PushJob(ctx context.Context, job Job) error
+	// ClaimJob takes the next job that's due, leasing it for the given duration. Returns false if no job is due
+	ClaimJob(ctx context.Context, lease time.Duration) (Job, bool, error)
+	// AckJob removes a finished job from the queue
+	AckJob(ctx context.Context, id string) error
+	// RetryJob puts a claimed job back in the queue, to be claimed again at the given time
+	RetryJob(ctx context.Context, id string, at time.Time) error
+}
+
+// Handler runs a single job, returning an error if it should be retried.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+// Logger is where the queue logs jobs that fail.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Some reasonable defaults, a job is given up on after maxAttempts, with increasing waits between each attempt
+const (
+	maxAttempts  = 5
+	lease        = 5 * time.Minute // Longest we expect a job to take, it's run again if not finished by then
+	pollInterval = time.Second     // How long the worker waits before checking again when the queue is empty
+)
+
+// Queue enqueues jobs to a Store, and runs them with the Handler registered for their kind.
+type Queue struct {
+	store  Store
+	logger Logger
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// New creates a Queue keeping its jobs in the given Store. Register a Handler for each kind of job with Handle, then
+// call Run in its own goroutine.
+func New(store Store, logger Logger) *Queue {
+	return &Queue{store: store, logger: logger, handlers: make(map[string]Handler)}
+}
+
+// Handle registers the Handler for a kind of job.
+func (q *Queue) Handle(kind string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = h
+}
+
+// Enqueue adds a job of the given kind to the queue, to be run as soon as a worker is free. The payload is encoded as
+// JSON, and handed to the job's Handler.
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding %s job: %w", kind, err)
+	}
+	return q.store.PushJob(ctx, Job{Kind: kind, Payload: b, RunAt: clock.Now()})
+}
+
+// Run claims and runs jobs one at a time until ctx is cancelled. Several workers (in this instance or others) can run
+// against the same Store, each job is only claimed by one of them at a time.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		job, ok, err := q.store.ClaimJob(ctx, lease)
+		if err != nil && ctx.Err() == nil {
+			q.logger.Printf("ERROR: Unable to claim a job: %v", err)
+		}
+		if err != nil || !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		q.run(ctx, job)
+	}
+}
+
+// run runs a single claimed job, then removes it from the queue or schedules its retry.
+func (q *Queue) run(ctx context.Context, job Job) {
+	q.mu.RLock()
+	h, ok := q.handlers[job.Kind]
+	q.mu.RUnlock()
+
+	start := time.Now()
+	var err error
+	if ok {
+		err = h(ctx, job.Payload)
+	} else {
+		err = errors.New("no handler registered")
+	}
+	metrics.ObserveJob("queue_"+job.Kind, time.Since(start), err)
+
+	if err == nil {
+		if err := q.store.AckJob(ctx, job.ID); err != nil {
+			q.logger.Printf("ERROR: Unable to remove finished %s job %s: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+	if job.Attempts >= maxAttempts {
+		q.logger.Printf("ERROR: Giving up on %s job %s after %d attempts: %v", job.Kind, job.ID, job.Attempts, err)
+		if err := q.store.AckJob(ctx, job.ID); err != nil {
+			q.logger.Printf("ERROR: Unable to remove failed %s job %s: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+	// Wait longer after each failed attempt: 1s, 4s, 9s, 16s...
+	retryAt := clock.Now().Add(time.Duration(job.Attempts*job.Attempts) * time.Second)
+	q.logger.Printf("WARN: %s job %s failed (attempt %d), retrying: %v", job.Kind, job.ID, job.Attempts, err)
+	if err := q.store.RetryJob(ctx, job.ID, retryAt); err != nil {
+		// The job will be claimed again once its lease runs out anyway
+		q.logger.Printf("ERROR: Unable to schedule retry of %s job %s: %v", job.Kind, job.ID, err)
+	}
+}
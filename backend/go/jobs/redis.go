@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Our Redis keys. Jobs due to run are kept in a sorted set scored by when they're due (in Unix milliseconds), with each
+// job's details in a hash of its own.
+const (
+	dueKey    = "jobs:due"
+	jobPrefix = "jobs:job:"
+	idKey     = "jobs:id"
+)
+
+// claimJob finds the first job that's due, and leases it by pushing its due time back by the lease. Doing this in a
+// script makes it atomic, so two workers can't both claim the same job. Time is read from Redis rather than passed in,
+// so instances with slightly different clocks still agree.
+//
+// Returns the job's ID, kind, payload and attempts, or nil if no job is due.
+var claimJob = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, 1)
+if #ids == 0 then
+	return false
+end
+local id = ids[1]
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[1]), id)
+local key = ARGV[2] .. id
+local attempts = redis.call('HINCRBY', key, 'attempts', 1)
+local job = redis.call('HMGET', key, 'kind', 'payload')
+return {id, job[1] or '', job[2] or '', attempts}
+`)
+
+// RedisStore keeps jobs in Redis, for deployments with too many jobs to comfortably keep them in our database.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a Store keeping jobs in Redis.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// PushJob implements Store.
+func (s *RedisStore) PushJob(ctx context.Context, job Job) error {
+	id, err := s.client.Incr(ctx, idKey).Result()
+	if err != nil {
+		return fmt.Errorf("redis.PushJob: %w", err)
+	}
+	key := strconv.FormatInt(id, 10)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, jobPrefix+key, "kind", job.Kind, "payload", []byte(job.Payload), "attempts", 0)
+		pipe.ZAdd(ctx, dueKey, redis.Z{Score: float64(job.RunAt.UnixMilli()), Member: key})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis.PushJob: %w", err)
+	}
+	return nil
+}
+
+// ClaimJob implements Store.
+func (s *RedisStore) ClaimJob(ctx context.Context, lease time.Duration) (Job, bool, error) {
+	res, err := claimJob.Run(ctx, s.client, []string{dueKey}, lease.Milliseconds(), jobPrefix).Slice()
+	if errors.Is(err, redis.Nil) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, fmt.Errorf("redis.ClaimJob: %w", err)
+	}
+	if len(res) != 4 {
+		return Job{}, false, fmt.Errorf("redis.ClaimJob: unexpected reply %v", res)
+	}
+	id, _ := res[0].(string)
+	kind, _ := res[1].(string)
+	payload, _ := res[2].(string)
+	attempts, _ := res[3].(int64)
+	return Job{ID: id, Kind: kind, Payload: []byte(payload), Attempts: int(attempts)}, true, nil
+}
+
+// AckJob implements Store.
+func (s *RedisStore) AckJob(ctx context.Context, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, dueKey, id)
+		pipe.Del(ctx, jobPrefix+id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis.AckJob: %w", err)
+	}
+	return nil
+}
+
+// RetryJob implements Store.
+func (s *RedisStore) RetryJob(ctx context.Context, id string, at time.Time) error {
+	// XX only updates a job that's still queued, rather than bringing back one that's been removed
+	err := s.client.ZAddXX(ctx, dueKey, redis.Z{Score: float64(at.UnixMilli()), Member: id}).Err()
+	if err != nil {
+		return fmt.Errorf("redis.RetryJob: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// jsonschema generates JSON Schemas from our Go request and response types. Publishing these lets a frontend validate
+// forms, and contract tests check responses, against exactly the same definitions our backend uses, without anyone
+// having to keep a hand written copy in sync. We also validate requests (and in dev builds, responses) against them at
+// runtime, see Validate.
+//
+// Only the parts of Go's type system our request and response types actually use are supported: structs (using their
+// json tags), strings, numbers, bools, slices, maps with string keys, pointers and time.Time.
+package jsonschema
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Draft is the version of JSON Schema we generate
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is a JSON Schema, ready to be encoded as JSON.
+type Schema map[string]any
+
+// For generates the schema for v's type, with the given ID (the URL it's published at).
+func For(id string, v any) Schema {
+	s := schemaOf(reflect.TypeOf(v))
+	s["$schema"] = Draft
+	s["$id"] = id
+	return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf generates the schema for a single type.
+func schemaOf(t reflect.Type) Schema {
+	if t == timeType {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json sends []byte as a base64 string
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return Schema{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		// Anything else (such as an interface) could hold any value
+		return Schema{}
+	}
+}
+
+// structSchema generates the schema for a struct, following the same rules encoding/json does for which fields are
+// included and what they're called. Fields without omitempty are required, as they're always present in our JSON.
+// Unknown properties are disallowed, matching how our API decodes request bodies.
+func structSchema(t reflect.Type) Schema {
+	properties := Schema{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			required = append(required, name)
+		}
+	}
+	return Schema{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,176 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Violation is one way a JSON document doesn't match its schema.
+type Violation struct {
+	Pointer string `json:"pointer"` // JSON Pointer (RFC 6901) to the offending value, "" is the whole document
+	Message string `json:"message"`
+}
+
+// ValidationError lists every way a JSON document doesn't match its schema.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		parts = append(parts, fmt.Sprintf("%q: %s", v.Pointer, v.Message))
+	}
+	return "schema violations: " + strings.Join(parts, ", ")
+}
+
+// Validate checks the JSON document in data against s, returning a *ValidationError listing every violation if it
+// doesn't match. Only the keywords For generates are understood, so this isn't a general purpose validator.
+func Validate(s Schema, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Numbers are kept as written, so we can tell integers apart from other numbers
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return &ValidationError{Violations: []Violation{{Pointer: "", Message: "invalid JSON: " + err.Error()}}}
+	}
+	if dec.More() {
+		return &ValidationError{Violations: []Violation{{Pointer: "", Message: "invalid JSON: unexpected data after the document"}}}
+	}
+	var v validator
+	v.validate(s, doc, "")
+	if len(v.violations) > 0 {
+		return &ValidationError{Violations: v.violations}
+	}
+	return nil
+}
+
+// validator collects violations as it walks a document.
+type validator struct {
+	violations []Violation
+}
+
+func (v *validator) fail(pointer, format string, args ...any) {
+	v.violations = append(v.violations, Violation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// validate checks a single value against its schema, and any values inside it against theirs.
+func (v *validator) validate(s Schema, value any, pointer string) {
+	switch s["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			v.fail(pointer, "expected an object, got %s", kindOf(value))
+			return
+		}
+		v.validateObject(s, obj, pointer)
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			v.fail(pointer, "expected an array, got %s", kindOf(value))
+			return
+		}
+		if itemSchema, ok := s["items"].(Schema); ok {
+			for i, item := range items {
+				v.validate(itemSchema, item, pointer+"/"+strconv.Itoa(i))
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			v.fail(pointer, "expected a string, got %s", kindOf(value))
+			return
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				v.fail(pointer, "expected an RFC 3339 date-time")
+			}
+		}
+		if s["contentEncoding"] == "base64" {
+			if _, err := base64.StdEncoding.DecodeString(str); err != nil {
+				v.fail(pointer, "expected base64")
+			}
+		}
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			v.fail(pointer, "expected an integer, got %s", kindOf(value))
+			return
+		}
+		if _, err := n.Int64(); err != nil {
+			v.fail(pointer, "expected an integer, got %s", n)
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			v.fail(pointer, "expected a number, got %s", kindOf(value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(pointer, "expected a boolean, got %s", kindOf(value))
+		}
+	}
+	// A schema without a type (such as for an interface) accepts anything
+}
+
+// validateObject checks an object's properties, in a stable order so violations are always listed the same way.
+func (v *validator) validateObject(s Schema, obj map[string]any, pointer string) {
+	properties, _ := s["properties"].(Schema)
+	if required, ok := s["required"].([]string); ok {
+		for _, name := range required {
+			if _, ok := obj[name]; !ok {
+				v.fail(pointer+"/"+escape(name), "missing required property")
+			}
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := pointer + "/" + escape(name)
+		if propSchema, ok := properties[name].(Schema); ok {
+			v.validate(propSchema, obj[name], child)
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(child, "unknown property")
+			}
+		case Schema:
+			v.validate(additional, obj[name], child)
+		}
+	}
+}
+
+// escape escapes a property name for use in a JSON Pointer.
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// kindOf describes the JSON type of a decoded value, for our violation messages.
+func kindOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
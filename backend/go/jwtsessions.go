@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"examples/errs"
+	"examples/requestctx"
+	"examples/token"
+	"net/http"
+	"time"
+)
+
+// Our JWT session mode, selected with SESSION_MODE=jwt. Rather than storing sessions in our database, login hands the
+// client a signed token (see the token package) that our authJWT middleware checks on each request. This sits alongside
+// our database backed sessions (sessions.go, and auth in middleware.go) so the two approaches can be compared.
+
+// authJWT checks that the request carries a valid, unexpired token we issued, rejecting it with a 401 status otherwise.
+// Checking the token itself never touches the database, but we still load the User, so that disabling or deleting a
+// User locks them out straight away rather than once their token expires.
+func (s *server) authJWT(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.tokens.Verify(rawSessionToken(r))
+		if errors.Is(err, token.ErrExpired) {
+			s.sessionExpired(w, r)
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, errs.New(errs.Unauthorized, "not logged in"))
+			return
+		}
+		userID, _ := claims.UserID()
+		user, err := s.activeUser(r, userID)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		// Tokens are never renewed on use, they last until they expire and are then refreshed
+		setSessionExpiresIn(w, time.Until(claims.ExpiresAt.Time))
+		next.ServeHTTP(w, r.WithContext(requestctx.WithUser(r.Context(), user)))
+	})
+}
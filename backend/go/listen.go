@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// listen opens the listener our webserver will accept connections on. If a socket path is supplied we'll listen on a
+// Unix domain socket (with the given permissions), otherwise we'll listen on the given TCP port.
+func listen(port, socketPath string, mode os.FileMode) (net.Listener, error) {
+	if socketPath == "" {
+		return net.Listen("tcp", ":"+port)
+	}
+
+	// A socket file left behind by a previous run (e.g. after a crash) would stop us from listening, so we'll clean
+	// it up first. Any error other than the file not existing is worth reporting.
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Restrict who can connect to our socket, typically just our user and the reverse proxy's group
+	if err := os.Chmod(socketPath, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
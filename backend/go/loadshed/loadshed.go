@@ -0,0 +1,69 @@
+// loadshed caps how many requests we work on at once. When we're already at the cap, new requests are turned away
+// straight away rather than queued: a queued request holds its connection (and eventually a database connection) while
+// it waits, so under a traffic spike queueing just means every request slows down until they all time out. Turning
+// some away keeps the rest fast, and the ones turned away can retry once the spike has passed.
+package loadshed
+
+import "sync"
+
+// Shedder tracks the requests in flight, overall and for each group of routes. It's safe for concurrent use.
+type Shedder struct {
+	overall chan struct{}            // One slot per request allowed in flight, nil if there's no overall cap
+	groups  map[string]chan struct{} // Slots for each group that has its own cap
+}
+
+// New creates a Shedder allowing up to limit requests in flight overall (0 for no overall cap), and up to groups[name]
+// requests in flight in each named group. Groups without an entry only count towards the overall cap.
+func New(limit int, groups map[string]int) *Shedder {
+	s := &Shedder{groups: make(map[string]chan struct{})}
+	if limit > 0 {
+		s.overall = make(chan struct{}, limit)
+	}
+	for name, n := range groups {
+		if n > 0 {
+			s.groups[name] = make(chan struct{}, n)
+		}
+	}
+	return s
+}
+
+// Acquire takes a slot for a request in the given group, returning false if either the group or the overall cap has
+// been reached. Otherwise, call the returned function once the request is finished, to free its slots.
+func (s *Shedder) Acquire(group string) (release func(), ok bool) {
+	// Take the group's slot first, a busy group shouldn't use up overall slots that other groups could be using
+	groupSlots := s.groups[group]
+	if !take(groupSlots) {
+		return nil, false
+	}
+	if !take(s.overall) {
+		give(groupSlots)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			give(s.overall)
+			give(groupSlots)
+		})
+	}, true
+}
+
+// take claims a slot without waiting, a nil channel means there's no cap so always succeeds.
+func take(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// give frees a slot claimed by take.
+func give(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
@@ -0,0 +1,124 @@
+// logging builds the destination our logs are written to. Logs can be sent to any combination of stdout, a rotating
+// log file and syslog at the same time, so bare-metal deployments can keep a local copy of their logs without ever
+// filling up the disk.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Possible log outputs
+const (
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+	OutputSyslog = "syslog"
+)
+
+// Config describes where logs should be written.
+type Config struct {
+	Outputs []string // Any combination of OutputStdout, OutputFile and OutputSyslog
+
+	// Rotating file settings, only used when OutputFile is selected
+	File       string // Path to the log file
+	MaxSizeMB  int    // Size a log file may grow to before it is rotated
+	MaxBackups int    // Number of rotated files to keep, older files are deleted
+	MaxAgeDays int    // Number of days to keep rotated files, older files are deleted
+	Compress   bool   // Whether rotated files are gzipped
+
+	// Syslog settings, only used when OutputSyslog is selected
+	SyslogNetwork string // Network to reach syslog over ("udp", "tcp"), leave empty to use the local syslog daemon
+	SyslogAddress string // Address of a remote syslog server, leave empty to use the local syslog daemon
+	SyslogTag     string // Tag each syslog entry is written with
+}
+
+// New opens every configured output, and returns a single writer that writes to all of them. The returned Closer
+// should be closed before we exit, including on a fatal error, to flush and release any files or connections.
+func New(cfg Config) (Fanout, io.Closer, error) {
+	var (
+		writers Fanout
+		closers multiCloser
+	)
+	for _, output := range cfg.Outputs {
+		switch output = strings.TrimSpace(output); output {
+		case OutputStdout:
+			writers = append(writers, Destination{Name: output, Writer: os.Stdout})
+		case OutputFile:
+			if cfg.File == "" {
+				closers.Close()
+				return nil, nil, fmt.Errorf("a log file path is required for the %q output", OutputFile)
+			}
+			// lumberjack takes care of rotating the file when it gets too large, and cleaning up old files
+			file := &lumberjack.Logger{
+				Filename:   cfg.File,
+				MaxSize:    cfg.MaxSizeMB,
+				MaxBackups: cfg.MaxBackups,
+				MaxAge:     cfg.MaxAgeDays,
+				Compress:   cfg.Compress,
+			}
+			writers = append(writers, Destination{Name: output, Writer: file})
+			closers = append(closers, file)
+		case OutputSyslog:
+			w, err := openSyslog(cfg.SyslogNetwork, cfg.SyslogAddress, cfg.SyslogTag)
+			if err != nil {
+				closers.Close()
+				return nil, nil, fmt.Errorf("unable to connect to syslog: %w", err)
+			}
+			writers = append(writers, Destination{Name: output, Writer: w})
+			closers = append(closers, w)
+		default:
+			closers.Close()
+			return nil, nil, fmt.Errorf("unknown log output %q", output)
+		}
+	}
+	// Never silently throw our logs away, fall back to stdout if nothing was selected
+	if len(writers) == 0 {
+		writers = append(writers, Destination{Name: OutputStdout, Writer: os.Stdout})
+	}
+	return writers, closers, nil
+}
+
+// Destination is one of the places a Fanout writes to, named so an error can say which one failed.
+type Destination struct {
+	Name string
+	io.Writer
+}
+
+// Fanout writes everything to every one of its destinations. Unlike io.MultiWriter, which stops at the first
+// destination that fails, one broken destination (a full disk, a syslog server that's gone away) never silences the
+// rest. Each destination that fails is reported in the error returned, by name.
+type Fanout []Destination
+
+// Write writes p to every destination, returning an error for each that failed, or wrote less than all of p.
+func (f Fanout) Write(p []byte) (int, error) {
+	var failed []error
+	for _, d := range f {
+		n, err := d.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("log output %s: %w", d.Name, err))
+		}
+	}
+	return len(p), errors.Join(failed...)
+}
+
+// multiCloser closes several outputs at once, returning the first error encountered.
+type multiCloser []io.Closer
+
+// Close closes every output, even if an earlier one fails.
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
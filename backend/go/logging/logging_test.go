@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingWriter fails every write, like a file on a full disk
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+// TestFanoutWritesPastFailures checks a destination that fails doesn't stop the rest being written to, and that the
+// error names it.
+func TestFanoutWritesPastFailures(t *testing.T) {
+	var before, after bytes.Buffer
+	f := Fanout{{Name: "before", Writer: &before}, {Name: "file", Writer: failingWriter{}}, {Name: "after", Writer: &after}}
+	n, err := f.Write([]byte("hello\n"))
+	if n != len("hello\n") {
+		t.Errorf("wrote %d bytes, want %d", n, len("hello\n"))
+	}
+	if err == nil || !strings.Contains(err.Error(), "log output file: no space left on device") {
+		t.Errorf("got error %v, want one naming the file output", err)
+	}
+	if before.String() != "hello\n" || after.String() != "hello\n" {
+		t.Errorf("destinations got %q and %q, want both to get %q", before.String(), after.String(), "hello\n")
+	}
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"examples/clock"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from least to most severe
+const (
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// levelRank orders our levels, so entries can be filtered by a minimum level
+var levelRank = map[string]int{LevelInfo: 0, LevelWarning: 1, LevelError: 2}
+
+// AtLeast reports whether level is at least as severe as min. Unknown levels are treated as info.
+func AtLeast(level, min string) bool {
+	return levelRank[level] >= levelRank[min]
+}
+
+// Entry is a single structured log entry held by a Ring.
+type Entry struct {
+	Seq       uint64    `json:"seq"`                 // Increases by one for every entry, so readers can tell if they missed any
+	Time      time.Time `json:"time"`                // When the entry was recorded
+	Level     string    `json:"level"`               // One of LevelInfo, LevelWarning or LevelError
+	Route     string    `json:"route,omitempty"`     // Route template of the request the entry is about, if any
+	RequestID string    `json:"requestId,omitempty"` // ID of the request the entry is about, if any
+	Message   string    `json:"message"`
+}
+
+// Ring keeps the most recent log entries in memory, and passes new entries on to anyone subscribed. This lets us show
+// recent activity from our admin endpoints without needing shell access to wherever our logs are written.
+//
+// A Ring is also an io.Writer, so it can sit alongside our other log outputs and pick up every line our logger writes.
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry // Used as a circular buffer once full
+	next    int     // Where the next entry will be written
+	seq     uint64
+	subs    map[chan Entry]struct{}
+}
+
+// NewRing returns a Ring holding up to size entries.
+func NewRing(size int) *Ring {
+	return &Ring{entries: make([]Entry, 0, size), subs: make(map[chan Entry]struct{})}
+}
+
+// Write implements io.Writer, recording a line from our logger. Our log lines mark their level with a prefix such as
+// "ERROR:", lines without one are recorded as info.
+func (r *Ring) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	level := LevelInfo
+	switch {
+	case strings.Contains(line, "ERROR:"):
+		level = LevelError
+	case strings.Contains(line, "WARNING:"):
+		level = LevelWarning
+	}
+	r.Record(Entry{Level: level, Message: line})
+	return len(p), nil
+}
+
+// Record adds an entry, filling in its sequence number and (if unset) time, then passes it on to every subscriber.
+// Subscribers that aren't keeping up miss entries rather than slowing down whoever is logging.
+func (r *Ring) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = clock.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.Seq = r.seq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+	} else if cap(r.entries) > 0 {
+		r.entries[r.next] = e
+	}
+	if cap(r.entries) > 0 {
+		r.next = (r.next + 1) % cap(r.entries)
+	}
+	for sub := range r.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// Recent returns up to n of the most recent entries, oldest first.
+func (r *Ring) Recent(n int) []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > len(r.entries) {
+		n = len(r.entries)
+	}
+	out := make([]Entry, 0, n)
+	// Until the buffer is full the oldest entry is at the start, afterwards it's wherever we'll write next
+	start := 0
+	if len(r.entries) == cap(r.entries) {
+		start = r.next
+	}
+	for i := len(r.entries) - n; i < len(r.entries); i++ {
+		out = append(out, r.entries[(start+i)%len(r.entries)])
+	}
+	return out
+}
+
+// Subscribe returns a channel receiving every entry recorded from now on. Call the returned function once finished,
+// to stop receiving entries.
+func (r *Ring) Subscribe() (<-chan Entry, func()) {
+	sub := make(chan Entry, 64)
+	r.mu.Lock()
+	r.subs[sub] = struct{}{}
+	r.mu.Unlock()
+	return sub, func() {
+		r.mu.Lock()
+		delete(r.subs, sub)
+		r.mu.Unlock()
+	}
+}
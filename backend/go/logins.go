@@ -0,0 +1,59 @@
+package main
+
+import (
+	"examples/errs"
+	"examples/loginstats"
+	"examples/metrics"
+	"net/http"
+	"time"
+)
+
+// How login attempts are counted for our dashboards: per minute, for the last day
+const (
+	loginStatsWidth  = time.Minute
+	loginStatsWindow = 24 * time.Hour
+)
+
+// countLogin counts a login attempt, both for our admin endpoint and for Prometheus.
+func (s *server) countLogin(result loginstats.Result) {
+	s.logins.Record(result)
+	metrics.ObserveLogin(string(result))
+}
+
+// loginStatsResponse is our login attempts over a span of time, see loginStats.
+type loginStatsResponse struct {
+	Bucket  time.Duration       `json:"bucketNs"` // How much time each bucket covers
+	Buckets []loginstats.Bucket `json:"buckets"`
+	Total   loginstats.Counts   `json:"total"`
+}
+
+// loginStats counts login successes, failures and lockouts over time, for security dashboards to chart without
+// querying our security events. Pass ?since= for how far back to go (default 1h, up to 24h) and ?bucket= for how much
+// time each count covers (default 1m, a whole number of minutes), both as durations such as "30m". Counts are only
+// for this instance, and start again when it restarts.
+func (s *server) loginStats(w http.ResponseWriter, r *http.Request) {
+	since, width := time.Hour, loginStatsWidth
+	for name, d := range map[string]*time.Duration{"since": &since, "bucket": &width} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d, err = time.ParseDuration(v); err != nil {
+			s.writeError(w, r, errs.New(errs.Invalid, name+" must be a duration, such as 30m"))
+			return
+		}
+	}
+	buckets, err := s.logins.Buckets(since, width)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := loginStatsResponse{Bucket: width, Buckets: buckets}
+	for _, b := range buckets {
+		resp.Total.Successes += b.Successes
+		resp.Total.Failures += b.Failures
+		resp.Total.Lockouts += b.Lockouts
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,127 @@
+// loginstats counts login attempts (successes, failures and lockouts) in buckets of time, so security dashboards can
+// chart them without querying our audit log or security events. Counts are kept in memory for a fixed window (a day,
+// as we use it), and only for this instance: with several instances running, add up what each reports, or use the
+// logins_total Prometheus metric which counts the same attempts and is summed across instances for you.
+package loginstats
+
+import (
+	"examples/clock"
+	"examples/errs"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of a login attempt.
+type Result string
+
+// Outcomes we count. An attempt that locks an account is counted as a failure and as a lockout.
+const (
+	Success Result = "success" // The User finished logging in, including any 2FA step
+	Failure Result = "failure" // A wrong password or 2FA code, an unknown account, or an attempt on a locked account
+	Lockout Result = "lockout" // An account was locked after too many failures in a row
+)
+
+// Counts are how many attempts had each result.
+type Counts struct {
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+	Lockouts  int `json:"lockouts"`
+}
+
+// add counts one attempt with the given result.
+func (c *Counts) add(result Result) {
+	switch result {
+	case Success:
+		c.Successes++
+	case Failure:
+		c.Failures++
+	case Lockout:
+		c.Lockouts++
+	}
+}
+
+// merge adds another set of counts to these.
+func (c *Counts) merge(other Counts) {
+	c.Successes += other.Successes
+	c.Failures += other.Failures
+	c.Lockouts += other.Lockouts
+}
+
+// Bucket is the attempts made in a span of time, starting at Start.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Counts
+}
+
+// Counter counts login attempts in buckets of a fixed width, keeping a fixed number of the most recent buckets. It is
+// safe to use from multiple goroutines.
+type Counter struct {
+	width time.Duration
+
+	mu      sync.Mutex
+	buckets []Bucket // Used as a circular buffer, each bucket's slot is decided by its start time
+}
+
+// New returns a Counter with buckets of the given width, keeping enough of them to cover window.
+func New(width, window time.Duration) *Counter {
+	return &Counter{width: width, buckets: make([]Bucket, max(1, int(window/width)))}
+}
+
+// Width is how long each of our buckets covers, Buckets can only combine whole buckets.
+func (c *Counter) Width() time.Duration {
+	return c.width
+}
+
+// Window is how far back we keep counts.
+func (c *Counter) Window() time.Duration {
+	return c.width * time.Duration(len(c.buckets))
+}
+
+// Record counts a login attempt made now.
+func (c *Counter) Record(result Result) {
+	start := clock.Now().Truncate(c.width)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := &c.buckets[c.slot(start)]
+	// Anything still in the slot is from a bucket that's since fallen out of our window
+	if !b.Start.Equal(start) {
+		*b = Bucket{Start: start}
+	}
+	b.add(result)
+}
+
+// slot returns where the bucket starting at start is kept.
+func (c *Counter) slot(start time.Time) int {
+	n := start.UnixNano() / int64(c.width)
+	return int(n % int64(len(c.buckets)))
+}
+
+// Buckets returns the attempts made over the last since, in buckets of the given width (a multiple of Width), oldest
+// first. Buckets nobody tried to log in during are included with zero counts, so charts don't skip over them. The
+// newest bucket is still filling up.
+func (c *Counter) Buckets(since, width time.Duration) ([]Bucket, error) {
+	if width <= 0 || width%c.width != 0 {
+		return nil, errs.New(errs.Invalid, fmt.Sprintf("bucket must be a multiple of %s", c.width))
+	}
+	if since <= 0 || since > c.Window() {
+		return nil, errs.New(errs.Invalid, fmt.Sprintf("since must be between %s and %s", c.width, c.Window()))
+	}
+
+	now := clock.Now()
+	end := now.Truncate(width).Add(width)
+	start := now.Add(-since).Truncate(width)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []Bucket
+	for t := start; t.Before(end); t = t.Add(width) {
+		b := Bucket{Start: t}
+		for sub := t; sub.Before(t.Add(width)); sub = sub.Add(c.width) {
+			if kept := c.buckets[c.slot(sub)]; kept.Start.Equal(sub) {
+				b.merge(kept.Counts)
+			}
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
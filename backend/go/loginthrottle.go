@@ -0,0 +1,56 @@
+package main
+
+import (
+	"examples/errs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Failed logins are throttled twice over (see ratelimit.Throttle). By email, so one account can't have passwords guessed
+// quickly however many addresses the guesses come from, and by IP address, so one address can't guess a few passwords
+// for each of many accounts. Locking accounts (see failedLogin) stops guessing too, but only after the damage is done,
+// and lets anyone lock someone else out. Throttling slows guessing down long before that.
+
+// loginThrottleKey is the key we throttle an email by, so changing its case doesn't earn another attempt.
+func loginThrottleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginThrottle responds with 429 Too Many Requests if logging in with this email, or from this client, must wait,
+// returning false. Otherwise the login can go ahead.
+func (s *server) checkLoginThrottle(w http.ResponseWriter, r *http.Request, email string) bool {
+	var wait time.Duration
+	if s.loginThrottle != nil {
+		wait = s.loginThrottle.Wait(loginThrottleKey(email))
+	}
+	if s.loginThrottleIP != nil {
+		wait = max(wait, s.loginThrottleIP.Wait(s.clientIP(r)))
+	}
+	if wait <= 0 {
+		return true
+	}
+	err := errs.New(errs.TooManyRequests, "too many failed logins, please wait before trying again")
+	err.RetryAfter = wait
+	s.writeError(w, r, err)
+	return false
+}
+
+// throttleFailedLogin counts a failed login against the email, and the client.
+func (s *server) throttleFailedLogin(r *http.Request, email string) {
+	if s.loginThrottle != nil {
+		s.loginThrottle.Fail(loginThrottleKey(email))
+	}
+	if s.loginThrottleIP != nil {
+		s.loginThrottleIP.Fail(s.clientIP(r))
+	}
+}
+
+// resetLoginThrottle forgets failed logins for the email, once someone has given its password. The client's failures
+// are kept, otherwise an attacker could keep guessing passwords for other accounts by logging in to their own between
+// guesses.
+func (s *server) resetLoginThrottle(email string) {
+	if s.loginThrottle != nil {
+		s.loginThrottle.Reset(loginThrottleKey(email))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"examples/errs"
+	"examples/logging"
+	"examples/requestctx"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// How our log stream keeps its WebSocket healthy
+const (
+	logStreamWriteTimeout = 10 * time.Second // Give up on a client that can't keep up with writes
+	logStreamPingInterval = 30 * time.Second // Ping the client this often, so idle connections aren't closed by proxies
+	logStreamBacklog      = 50               // Recent entries sent when a client first connects, unless ?backlog= is given
+)
+
+// logStreamUpgrader turns a HTTP request into a WebSocket. Its default origin check only accepts same-origin requests,
+// which is what we want, as there's no reason for a web page elsewhere to connect to our admin listener.
+var logStreamUpgrader = websocket.Upgrader{}
+
+// accessLog records every request (its route, status and how long it took) in our log ring, so operators watching the
+// live log tail can see traffic as it happens. These records only go to the ring, not our other log outputs, as writing
+// a line per request there would drown out everything else.
+func (s *server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.logRing == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		level := logging.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = logging.LevelError
+		case rec.status >= 400:
+			level = logging.LevelWarning
+		}
+		// Middleware on a mux router runs after the route is matched, so we can record the route rather than the raw
+		// path, which keeps usernames and tokens out of the ring and lets operators filter by endpoint
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		s.logRing.Record(logging.Entry{
+			Level:     level,
+			Route:     route,
+			RequestID: requestctx.RequestID(r.Context()),
+			Message:   fmt.Sprintf("%s %s %d %s", r.Method, route, rec.status, time.Since(start).Round(time.Millisecond)),
+		})
+	})
+}
+
+// statusWriter wraps a http.ResponseWriter, remembering the status code that was written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before passing it on.
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes on flushing to the wrapped http.ResponseWriter, for handlers that stream their response.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes on taking over the connection to the wrapped http.ResponseWriter, for WebSocket upgrades.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// logFilter picks which log entries a client of our log stream wants to see.
+type logFilter struct {
+	level string // Minimum level to send
+	route string // Only send entries whose route starts with this, empty for every entry
+}
+
+// matches reports whether the entry passes the filter.
+func (f logFilter) matches(e logging.Entry) bool {
+	if !logging.AtLeast(e.Level, f.level) {
+		return false
+	}
+	return f.route == "" || strings.HasPrefix(e.Route, f.route)
+}
+
+// streamLogs tails our log ring over a WebSocket, sending each entry as a JSON message as it's recorded. Clients may
+// filter what they're sent with these query parameters:
+//
+//   - level: only send entries at least this severe (info, warning or error, Default info)
+//   - route: only send entries for routes starting with this, such as /users/
+//   - backlog: how many recent entries to send first (Default 50)
+//
+// A client that can't keep up will miss entries rather than slow us down, the seq field of each entry shows any gaps.
+func (s *server) streamLogs(w http.ResponseWriter, r *http.Request) {
+	if s.logRing == nil {
+		s.writeError(w, r, errs.New(errs.NotFound, "log tailing is not enabled"))
+		return
+	}
+	query := r.URL.Query()
+	filter := logFilter{level: query.Get("level"), route: query.Get("route")}
+	switch filter.level {
+	case "":
+		filter.level = logging.LevelInfo
+	case logging.LevelInfo, logging.LevelWarning, logging.LevelError:
+	default:
+		s.writeError(w, r, errs.New(errs.Invalid, "level must be info, warning or error"))
+		return
+	}
+	backlog := logStreamBacklog
+	if value := query.Get("backlog"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.writeError(w, r, errs.New(errs.Invalid, "backlog must be a positive number"))
+			return
+		}
+		backlog = n
+	}
+
+	// Subscribe before reading the backlog, so nothing recorded in between is missed
+	entries, unsubscribe := s.logRing.Subscribe()
+	defer unsubscribe()
+
+	// The upgrader writes its own error response if the request isn't a valid WebSocket handshake
+	conn, err := logStreamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// We never expect messages from the client, but we need to keep reading to notice when it disconnects
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e logging.Entry) error {
+		conn.SetWriteDeadline(time.Now().Add(logStreamWriteTimeout))
+		return conn.WriteJSON(e)
+	}
+	var lastSeq uint64
+	for _, e := range s.logRing.Recent(backlog) {
+		lastSeq = e.Seq
+		if !filter.matches(e) {
+			continue
+		}
+		if err := send(e); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(logStreamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-entries:
+			// Skip anything we already sent as part of the backlog
+			if e.Seq <= lastSeq || !filter.matches(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(logStreamWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
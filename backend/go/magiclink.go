@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// magicLinkLifetime is how long a magic link can be used for. Links sit in an inbox, so they're kept short.
+const magicLinkLifetime = 15 * time.Minute
+
+// magicLinkRequest is the body expected when asking for a magic link.
+type magicLinkRequest struct {
+	Email    string `json:"email"`
+	Remember bool   `json:"remember,omitempty"` // "Remember me", applied once the link is used
+}
+
+// requestMagicLink emails a User a link that logs them in without their password. We respond the same way whether or
+// not the email has an account (and send the email from our job queue, so the response takes just as long), so this
+// can't be used to find out who has an account with us.
+func (s *server) requestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req magicLinkRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if req.Email == "" {
+		s.writeError(w, r, errs.New(errs.Invalid, "email is required"))
+		return
+	}
+
+	user, err := s.userByEmail(r, req.Email)
+	if errors.Is(err, errs.NotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// Users who couldn't log in anyway don't get a link, but aren't told so either
+	if !user.Enabled || user.Locked {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	// Limit emails per recipient, so this can't be used to flood someone's inbox. Only Users with an account can hit
+	// the limit, so saying they have would give them away, we skip sending the email and respond as usual instead
+	if s.recipientLimiter != nil {
+		if ok, _ := s.recipientLimiter.Allow(user.Email); !ok {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "requestMagicLink"))
+		return
+	}
+	link := database.MagicLink{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Remember:  req.Remember,
+		Expires:   clock.Now().Add(magicLinkLifetime),
+	}
+	if err := s.unscoped(r).CreateMagicLink(&link); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if err := s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Someone (hopefully you!) asked for a link to log in to your account.\n\n"+
+			"To log in, visit %s/login/magic/%s within the next 15 minutes. The link only works once.\n\n"+
+			"If this wasn't you, you can safely ignore this email.", s.frontendURL, token),
+	}); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.magic_link", user.ID, "sent")
+	// 202 Accepted, as the User isn't logged in until they use the link
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// magicLogin logs a User in with the token from their magic link, just as if they'd given their password. Users with
+// two-factor authentication still need to complete that step.
+func (s *server) magicLogin(w http.ResponseWriter, r *http.Request) {
+	invalid := errs.New(errs.Unauthorized, "this link is invalid or has expired")
+	link, err := s.unscoped(r).UseMagicLink(hashToken(mux.Vars(r)["token"]))
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, invalid)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	user, err := s.unscoped(r).GetUserByID(link.UserID)
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, invalid)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, link.UserID))
+		return
+	}
+	// The account may have been locked or disabled since the link was sent
+	if user.Locked {
+		s.writeError(w, r, errs.New(errs.Locked, "account locked after too many failed logins, please contact support"))
+		return
+	}
+	if !user.Enabled {
+		s.writeError(w, r, errs.New(errs.Forbidden, "account disabled"))
+		return
+	}
+	s.continueLogin(w, r, user, link.Remember)
+}
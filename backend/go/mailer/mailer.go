@@ -0,0 +1,105 @@
+// mailer sends emails on behalf of our API, such as password resets or account verification links.
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Message is a single plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. As with our Storer interface, any implementation can be swapped in (SMTP, a third party API,
+// or simply logging emails during local development).
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTP sends emails through an SMTP server.
+type SMTP struct {
+	addr string    // Address of the SMTP server, including port (e.g. smtp.example.com:587)
+	from string    // Address our emails are sent from
+	auth smtp.Auth // Credentials for the SMTP server, may be nil if the server doesn't require authentication
+}
+
+// NewSMTP creates a Mailer that sends through the SMTP server at addr. Leave username empty if the server doesn't
+// require authentication.
+func NewSMTP(addr, from, username, password string) *SMTP {
+	m := &SMTP{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send implements Mailer.
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	// net/smtp doesn't accept a context, so the best we can do is check we haven't already been cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Never allow header injection through any of the values we place in headers
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid email headers")
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.from, msg.To, msg.Subject, msg.Body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(body))
+}
+
+// Ping connects to the SMTP server and checks it will accept our credentials, without sending anything.
+func (m *SMTP) Ping(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(m.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	// Just like SendMail, upgrade to TLS when the server supports it, as our credentials are only sent over TLS
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Logger is the logging behaviour our Log mailer needs.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Log is a Mailer that writes emails to a log instead of sending them, useful for local development where there's no
+// SMTP server available.
+type Log struct {
+	Logger Logger
+}
+
+// Send implements Mailer.
+func (m Log) Send(ctx context.Context, msg Message) error {
+	m.Logger.Printf("INFO: Email to %s, subject %q:\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
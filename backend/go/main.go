@@ -1,158 +1,383 @@
 package main
 
 import (
+	"context"
+	"examples/breaker"
+	"examples/config"
+	"examples/csrf"
 	"examples/database"
+	"examples/database/instrumented"
+	redisstore "examples/database/redis"
+	"examples/database/sessioncache"
 	"examples/database/sql"
+	"examples/database/usercache"
+	"examples/emailaddr"
+	"examples/encryption"
+	"examples/errorlog"
+	"examples/jobs"
+	"examples/loadshed"
+	"examples/logging"
+	"examples/mailer"
+	"examples/metrics"
+	"examples/mirror"
+	"examples/oauth"
+	"examples/ratelimit"
+	"examples/secrets"
+	"examples/signedurl"
+	"examples/token"
+	"examples/tracing"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
 )
 
-type server struct {
-	// Specify dependencies here
-	// loggers, external API clients, etc
-	testDependency string
-	// We'll want an implementation of a logger, we'll use standard package for this
-	logger log.Logger
-	// We'll also have a database dependency
-	db database.Storer
-}
-
+// main only composes our dependencies and starts the server, all of the actual behaviour lives on the server type
+// (see server.go) so it can be built and exercised without needing real environment variables or a real database.
 func main() {
-	// Retrieve any needed values from environment variables and include them in the server struct, and also validate them, or check if they're missing
-	testEnvVar := os.Getenv("TEST_ENVIRONMENT_VARIABLE")
-	if testEnvVar == "" {
+	// `app check` runs our self-test instead of starting the server (see check.go)
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Stdout))
+	}
+	// `app migrate` applies our migrations instead (see migrate.go)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Stdout, os.Args[2:]))
+	}
+	// `app serve` is the same as plain `app`, apart from accepting flags. `app serve --dev` runs against an embedded
+	// database instead of DATABASE_URL, so contributors can run everything locally without Docker (dev builds only)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		flags := flag.NewFlagSet("serve", flag.ExitOnError)
+		dev := flags.Bool("dev", false, "Run against an embedded PostgreSQL server (dev builds only)")
+		flags.Parse(os.Args[2:])
+		if *dev {
+			if err := startDevDatabase(); err != nil {
+				panic(fmt.Sprintf("Error starting dev database: %v", err))
+			}
+		}
+	}
+
+	// Retrieve any needed values from environment variables, the config package also validates them, or checks if they're missing
+	cfg, err := config.FromEnv()
+	if err != nil {
 		// Here we use panic(), which will stop further execution. You should never use a panic intentionally after service initialization.
-		panic("TEST_ENVIRONMENT_VARIABLE is required for this service to run")
+		panic(fmt.Sprintf("Invalid configuration: %v", err))
+	}
+	// Some settings can be changed while we're running by reloading our configuration, which swaps in a new snapshot
+	snapshot := config.NewSnapshot(cfg)
+
+	// Our database URL comes from our secrets provider if we have one, so it can be rotated while we're running
+	var provider secrets.Provider
+	dbURL := cfg.DatabaseURL
+	if cfg.SecretsDir != "" {
+		provider = secrets.NewDir(cfg.SecretsDir)
+		if dbURL, err = fetchDatabaseURL(context.Background(), provider); err != nil {
+			panic(fmt.Sprintf("Error fetching database URL: %v", err))
+		}
 	}
 
 	// We'll also need to initialize our Database connection, we'll be using the SQL implementation of our Storer interface
-	db, err := sql.NewSQLDB(os.Getenv("DATABASE_URL"))
+	db, err := sql.NewSQLDB(dbURL, dbPool(cfg), dbRetry(cfg))
 	if err != nil {
 		// Again we'll use a panic here, as if we cannot connect to our database, this API won't be able to function
 		panic(fmt.Sprintf("Error connecting to database: %v", err))
 	}
+	// Bring our schema up to date if we've been asked to, otherwise that's left to whoever deploys us (see migrate.go)
+	if cfg.MigrateOnStart {
+		if _, err := db.Migrate(); err != nil {
+			panic(fmt.Sprintf("Error migrating database: %v", err))
+		}
+	}
+
+	// Connect to Redis if we have it, it's shared by our session cache and rate limits
+	var rdb *redis.Client
+	if cfg.RedisURL != "" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid REDIS_URL: %v", err))
+		}
+		rdb = redis.NewClient(opts)
+	}
+
+	// Warm up before we report ready if we've been asked to, opening as many connections as our pool keeps idle
+	var warmUp WarmUp
+	if cfg.WarmUp {
+		warmUp = WarmUp{Timeout: cfg.WarmUpTimeout, Pool: db, Connections: cfg.DBMaxIdleConns, Users: cfg.WarmUpUsers}
+	}
+
+	// Queued jobs are kept in our database, unless we've been asked to move them to Redis
+	var jobStore jobs.Store = db
+	if cfg.JobQueue == config.JobQueueRedis {
+		jobStore = jobs.NewRedisStore(rdb)
+	}
+
+	// Spread our Users across several databases if we've been given more than one
+	base, err := openShards(db, cfg.ShardURLs, dbPool(cfg), dbRetry(cfg))
+	if err != nil {
+		panic(fmt.Sprintf("Error connecting to shards: %v", err))
+	}
+	// Keep sessions in Redis instead if we've been asked to, leaving our database with just our Users and the like
+	if cfg.SessionStore == config.SessionStoreRedis {
+		base = database.WithSessions(base, redisstore.New(rdb))
+	}
+
+	// Wrap our database so we record metrics about every call made to it
+	var store database.Storer = instrumented.New(base)
+	// Cache session lookups in Redis if we have it, so authenticated requests don't all need to reach our database. There's
+	// no need when our sessions already live there.
+	if rdb != nil && cfg.SessionStore != config.SessionStoreRedis {
+		store = sessioncache.New(store, rdb, cfg.SessionCacheTTL)
+	}
+	// Keep Users we've just loaded in memory for a moment, as every authenticated request loads its User
+	if cfg.UserCacheTTL > 0 {
+		store = usercache.New(store, cfg.UserCacheTTL)
+	}
+
+	// Open our log outputs, depending on config this may be any combination of stdout, a rotating file and syslog
+	logOutput, logCloser, err := logging.New(cfg.Log)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening log outputs: %v", err))
+	}
+	// Our outputs may buffer, so are closed however we exit. A deferred Close covers panics, but not os.Exit, so we
+	// exit through fatal below rather than log.Fatal. Either can happen first, or both at once, so we only close once.
+	closeLogs := sync.OnceValue(logCloser.Close)
+	defer closeLogs()
+	// Keep our most recent log entries in memory too, so operators can watch them from our admin endpoints
+	logRing := logging.NewRing(cfg.LogBufferSize)
+	// Init our logger with standard package, writing to every output we opened above
+	logOutput = append(logOutput, logging.Destination{Name: "ring", Writer: logRing})
+	logger := log.New(logOutput, "logger: ", log.Lshortfile)
+	// fatal logs why we can't go on, then exits once our log outputs are closed
+	fatal := func(v ...any) {
+		logger.Output(2, fmt.Sprintln(v...))
+		closeLogs()
+		os.Exit(1)
+	}
+	// Settings that don't fit together are worth knowing about, even if they don't stop us starting
+	for _, warning := range cfg.CookieWarnings() {
+		logger.Printf("WARNING: %s", warning)
+	}
+
+	// Push our metrics to an OpenTelemetry collector too, if one is configured
+	if cfg.OTLPMetrics {
+		shutdown, err := metrics.StartOTLP(context.Background(), cfg.OTLPMetricsInterval)
+		if err != nil {
+			panic(fmt.Sprintf("Error starting OTLP metrics exporter: %v", err))
+		}
+		defer shutdown(context.Background())
+	}
+	// Likewise our traces, sampled by route so we see every login but hardly any health checks
+	var sampler *tracing.Sampler
+	if cfg.Tracing {
+		sampler = tracing.NewSampler(cfg.TraceSampleRate, cfg.TraceSampleRates)
+		shutdown, err := tracing.Start(context.Background(), sampler)
+		if err != nil {
+			panic(fmt.Sprintf("Error starting OTLP trace exporter: %v", err))
+		}
+		defer shutdown(context.Background())
+	}
 
-	// Combine all our connections and settings into a single struct that we can use to make handler methods on
-	s := server{
-		// Init our logger with standard package, we'll just output to console using os.Stdout
-		logger:         *log.New(os.Stdout, "logger: ", log.Lshortfile),
-		testDependency: testEnvVar,
-		db:             db,
+	// Session credentials are encrypted with our session key, any old keys are kept around to decrypt sessions from
+	// before the key was rotated
+	keys := map[byte][]byte{cfg.SessionKeyID: cfg.SessionKey}
+	for id, key := range cfg.SessionOldKeys {
+		keys[id] = key
+	}
+	encrypter, err := encryption.NewKeyring(cfg.SessionKeyID, keys)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating encrypter: %v", err))
+	}
+
+	// Downloads are served from a plain directory, any fs.FS will do though (such as one backed by object storage)
+	var blobs fs.FS
+	if cfg.DownloadsDir != "" {
+		blobs = newDirBlobs(cfg.DownloadsDir)
+	}
+
+	// Build each OAuth provider we have credentials for, they send Users back to our callback endpoint once signed in
+	providers := make(map[string]*oauth.Provider)
+	for name, client := range cfg.OAuth {
+		provider, err := oauth.New(name, client.ID, client.Secret, cfg.PublicURL+cfg.BasePath+oauthPath+name+"/callback")
+		if err != nil {
+			panic(fmt.Sprintf("Error creating OAuth provider: %v", err))
+		}
+		providers[name] = provider
+	}
+
+	// Emails are sent through SMTP if we have a server configured, otherwise we'll just log them. Either way, the SMTP
+	// server is wrapped in a circuit breaker so an outage doesn't pile up requests waiting on it, and while the breaker is
+	// open we'll fall back to logging emails so their contents aren't lost entirely.
+	var mail mailer.Mailer = mailer.Log{Logger: logger}
+	if cfg.SMTPAddr != "" {
+		smtp := mailer.NewSMTP(cfg.SMTPAddr, cfg.MailFrom, cfg.SMTPUsername, cfg.SMTPPassword)
+		mail = breaker.Mailer(smtp, mail, breaker.DefaultSettings("mailer"))
+	}
+
+	// Our client for external APIs, again wrapped in a circuit breaker so a struggling dependency fails fast
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: breaker.Transport(http.DefaultTransport, breaker.DefaultSettings("external-api")),
+	}
+
+	// Rate limiting is optional, a limit of 0 disables it. Per-plan limits only apply once billing is enabled.
+	var limiter ratelimit.Limiter
+	if cfg.RateLimit > 0 {
+		var plans map[string]ratelimit.Plan
+		if cfg.BillingEnabled {
+			plans = cfg.RateLimitPlans
+		}
+		def := ratelimit.Plan{
+			Limit:  cfg.RateLimit,
+			Window: cfg.RateLimitWindow,
+			Burst:  cfg.RateLimitBurst,
+			WarmUp: cfg.RateLimitWarmUp,
+		}
+		// Shared limits live in Redis, so they apply across every instance and survive restarts
+		if cfg.RateLimitShared {
+			limiter = ratelimit.NewRedisTokenBucket(rdb, def, plans)
+		} else {
+			limiter = ratelimit.NewTokenBucket(def, plans)
+		}
+	}
+
+	// Failed logins are throttled by email and by IP address, sharing counts through Redis just like our rate limits
+	var loginThrottle, loginThrottleIP ratelimit.Throttle
+	if cfg.LoginThrottle.Max > 0 {
+		if cfg.RateLimitShared {
+			loginThrottle = ratelimit.NewRedisThrottle(rdb, "login", cfg.LoginThrottle)
+			loginThrottleIP = ratelimit.NewRedisThrottle(rdb, "login-ip", cfg.LoginThrottleIP)
+		} else {
+			loginThrottle = ratelimit.NewMemoryThrottle(cfg.LoginThrottle)
+			loginThrottleIP = ratelimit.NewMemoryThrottle(cfg.LoginThrottleIP)
+		}
 	}
 
-	// Create a GoRoutine that can run in the background for any async tasks
+	// Cap how many requests we work on at once, so a traffic spike can't exhaust our database connections
+	var shedder *loadshed.Shedder
+	if cfg.MaxInFlight > 0 || len(cfg.MaxInFlightGroups) > 0 {
+		shedder = loadshed.New(cfg.MaxInFlight, cfg.MaxInFlightGroups)
+	}
+
+	// Copy a share of our traffic to a shadow deployment, if one is configured
+	var shadow *mirror.Mirror
+	if cfg.MirrorURL != "" {
+		target, err := url.Parse(cfg.MirrorURL)
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing MIRROR_URL: %v", err))
+		}
+		shadow = mirror.New(target)
+	}
+
+	// Hand every dependency to our constructor, which validates them and wires them together
+	s, err := NewServer(Deps{
+		TestDependency:   cfg.TestDependency,
+		Logger:           logger,
+		DB:               store,
+		Encrypter:        encrypter,
+		SessionTransport: cfg.SessionTransport,
+		Cookies:          cfg.Cookies,
+		CORSOrigins:      cfg.CORSOrigins,
+		SessionMode:      cfg.SessionMode,
+		// Session tokens are signed with a key derived from our session key, just like download links
+		Tokens:                token.NewIssuer(cfg.SessionKey, cfg.JWTLifetime),
+		SessionRenewAfter:     cfg.SessionRenewAfter,
+		SessionRefreshHint:    cfg.SessionRefreshHint,
+		Sessions:              cfg.Sessions,
+		TenantCacheTTL:        cfg.TenantCacheTTL,
+		LockoutThreshold:      cfg.LockoutThreshold,
+		FrontendURL:           cfg.FrontendURL,
+		BasePath:              cfg.BasePath,
+		Emails:                emailaddr.New(cfg.Email),
+		OAuth:                 providers,
+		Mailer:                mail,
+		JobStore:              jobStore,
+		Secrets:               provider,
+		DBCredentials:         db,
+		DBCredentialsInterval: cfg.DBCredentialsInterval,
+		DatabaseURL:           dbURL,
+		InstallLinks:          cfg.InstallLinks,
+		Blobs:                 blobs,
+		// Download links are signed with a key derived from our session key, so there's no extra secret to manage
+		URLSigner: signedurl.New(cfg.SessionKey),
+		// As are CSRF tokens
+		CSRF: csrf.New(cfg.SessionKey),
+		// Nobody needs install links more than a few times an hour, any more than that is likely abuse
+		RecipientLimiter: ratelimit.NewFixedWindow(3, time.Hour),
+		// A signup form checks a few times as someone types, far more than this is someone working through a list
+		AvailabilityLimiter: ratelimit.NewFixedWindow(30, time.Minute),
+		LoginThrottle:       loginThrottle,
+		LoginThrottleIP:     loginThrottleIP,
+		HTTPClient:          client,
+		RateLimiter:         limiter,
+		Shedder:             shedder,
+		Mirror:              shadow,
+		Sampler:             sampler,
+		TrustedProxies:      cfg.TrustedProxies,
+		LogRing:             logRing,
+		ErrorLog:            errorlog.NewRing(cfg.ErrorBufferSize),
+		AdminToken:          cfg.AdminToken,
+		Retention:           cfg.Retention,
+		RekeyInterval:       cfg.SessionRekeyInterval,
+		RecordDir:           cfg.RecordDir,
+		Config:              snapshot,
+		WarmUp:              warmUp,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Error creating server: %v", err))
+	}
+
+	// Create a GoRoutine that runs our background tasks, each on its own schedule (see registerTasks)
+	go s.tasks.Run(context.Background())
+	// And another that works through our job queue (see registerJobs)
+	go s.jobs.Run(context.Background())
+	// And another that sends copies of our requests to our shadow deployment
+	if s.mirror != nil {
+		go s.mirror.Run(context.Background())
+	}
+	// Check our dependencies in the background, for our readiness endpoint. We warm up first if we've been asked to,
+	// and as no check has run until then we don't report ready until we're warmed up (see warm)
+	go func() {
+		s.warm(context.Background())
+		s.health.Run(context.Background())
+	}()
+	// Reload our configuration whenever we're sent SIGHUP (e.g. `kill -HUP <pid>`), such as after editing CONFIG_FILE
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		// Using an open ended for loop can be dangerous, but this case it is perfect, so long as we include a time.Sleep
-		for {
-			// Specify the time interval this background task should run at (In our case, 10 minutes)
-			time.Sleep(time.Minute * 10)
-			// Here I'll need to keep our database clean of expired login sessions
-			count, err := s.db.ClearExpiredSessions()
-			if err != nil {
-				s.logger.Println("ERROR: Unable to clear expired login sessions: %v", err)
-				// We'll skip to next loop iteration
+		for range hup {
+			if err := snapshot.Reload(); err != nil {
+				logger.Printf("ERROR: Unable to reload configuration, keeping the current one: %v", err)
 				continue
 			}
-			// If we didn't encounter an error, operation was successful, let's still log it:
-			s.logger.Println("INFO: Cleared %d expired login sessions", count)
+			logger.Printf("INFO: Reloaded configuration")
 		}
-	}() // Adding "()" immediately after this anonymous goroutine starts it.
-
-	// Cross Origin Resource Sharing (CORS)
-	// This allows a frontend to communicate with a backend that is hosted at a different URL.
-	//
-	// By default, if you have a frontend hosted at https://myCoolWebsite.com, and you try to make an API call
-	// to your API hosted at https://myAwesomeAPI.com, you'll encounter CORS errors.
-	//
-	// Most modern web browsers (Chrome, Firefox, Safari, Edge, Opera, etc) accomplish this by performing a
-	// "pre-flight" request using the OPTIONS http verb to check CORS options.
-	//
-	// Note that API testing tools like Postman (allows you to make requests to your backend) will not send a
-	// pre-flight request, and will never encounter CORS errors, so be sure to test with a frontend before ever
-	// pushing something straight to production.
-	//
-	// Here's we'll use a Middleware function that only uses standard library
-	// Middleware allows us to wrap a Handler function, it is perfect for performing actions such as authentication checks, or
-	// in this case handling CORS configuration.
-	cors := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Here we can specify what Origins are allowed. (Example: An Origin could be our frontend hosted at https://myCoolWebsite.com")
-			// For testing purposes, we'll use the wildcard "*" to allow any Origin. This SHOULD NOT be present in a production-ready service!
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			// Here we specify allowed headers, including any custom headers you may wish to be included in a request
-			w.Header().Set("Access-Control-Allow-Headers", strings.Join([]string{"Content-Type", "Authorization"}, ","))
-			// Here you'll specify what HTTP methods (verbs) your API allows.
-			// Note that http.MethodOptions may need to be explicity allowed for CORS pre-flight requests.
-			w.Header().Set("Access-Control-Allow-Methods", strings.Join([]string{http.MethodGet, http.MethodOptions}, ","))
-
-			// Typically in an API, the http.MethodOptions verb will only be used for CORS, so we'll explicitly return nothing in
-			// the event of an OPTIONS call. Otherwise we'll serve the wrapped handler
-			if r.Method == http.MethodOptions {
-				return
-			}
-			next.ServeHTTP(w, r)
-		})
-	}
-
-	// Set up a Router, I'll use Gorilla Mux, although you can use standard library Mux, or other routers such as Chi
-	// In this case since we're doing a RESTful API, GorillaMux allows us to easily use parameters included in the path
-	// (such as "/users/{username}", we'll be able to easily retrieve the username)
-	router := mux.NewRouter()
-	// GorillaMux also gives us a handy Use method, which is perfect for Middleware! Any request that is handled by this
-	// router, will execute any middleware before the actual endpoint.
-	// Apply any Middleware you need to your Router with the Use method (In this case we'll use our CORS middleware)
-	router.Use(cors)
-
-	// Standard Health Check endpoint that just returns a 200 status and empty response body, useful for simply checking if your API is running
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
-
-	// Set up a Login endpoint to authenticate with your service
-	router.HandleFunc("/login/", s.login).Methods(http.MethodPost)
-
-	// We'll make a Subrouter to secure our endpoints
-	loggedin := router.PathPrefix("").Subrouter()
-	// Apply our Middleware that checks authentication for every endpoint
-	// loggedin.Use(s.auth) // TODO (IME): Need to create an example implmentation of this.
-
-	// Hook up our endpoints
-	// We'll need a logout endpoint
-	loggedin.HandleFunc("/logout/", s.logout).Methods(http.MethodPost)
-
-	// Here's an example of a typical REST style API
-	// Users API
-	loggedin.HandleFunc("/users/", s.userInfoSelf).Methods(http.MethodGet)
-	// TODO (IME): Finish creating a REST API
-	// loggedin.HandleFunc("/users/{username}", s.userInfoOther).Methods(http.MethodGet)
-	// loggedin.HandleFunc("/users/{username}/exists", s.userExists).Methods(http.MethodGet)
-	// loggedin.HandleFunc("/users/search/{name}", s.userSearch).Methods(http.MethodGet)
-	// loggedin.HandleFunc("/users/password", s.resetPasswordSelf).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/password", s.resetPasswordOther).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/email", s.sendInstallLinks).Methods(http.MethodPost)
-	// loggedin.HandleFunc("/users/", s.userAdd).Methods(http.MethodPost)
-	// loggedin.HandleFunc("/users/{username}", s.userRemove).Methods(http.MethodDelete)
-	// loggedin.HandleFunc("/users/{username}/dealership/{cid}", s.userAddToDealership).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/dealership/{cid}", s.userRemoveFromDealership).Methods(http.MethodDelete)
-	// loggedin.HandleFunc("/users/{username}/email", s.userEmail).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/enabled", s.userEnable).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/enabled", s.userDisable).Methods(http.MethodDelete)
-	// loggedin.HandleFunc("/users/{username}/lock", s.userUnlock).Methods(http.MethodDelete)
-	// loggedin.HandleFunc("/users/{username}/admin", s.userPromote).Methods(http.MethodPut)
-	// loggedin.HandleFunc("/users/{username}/admin", s.userDemote).Methods(http.MethodDelete)
-
-	// Start the webserver
-	// Allow environment to set the port
-	port := ":" + os.Getenv("PORT")
-	if port == ":" {
-		// Default to port 8080 if no port is specified
-		port = ":8080"
-	}
-	// It's a good idea to wrap your http.ListenAndServe call in a Fatal or Critical logger call, as when ListenAndServe
+	}()
+
+	// Open our listeners, each is either a TCP port or a Unix socket depending on our config
+	publicListener, err := listen(cfg.Port, cfg.SocketPath, cfg.SocketMode)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening public listener: %v", err))
+	}
+	adminListener, err := listen(cfg.AdminPort, cfg.AdminSocketPath, cfg.SocketMode)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening admin listener: %v", err))
+	}
+
+	// Start the admin/ops webserver in the background, on its own listener
+	go func() {
+		fatal(http.Serve(adminListener, s.adminRoutes()))
+	}()
+
+	// Start the public webserver
+	// It's a good idea to wrap your http.Serve call in a Fatal or Critical logger call, as when Serve
 	// returns, it means your API is no longer running!
-	s.logger.Fatalln(http.ListenAndServe(port, router))
+	fatal(http.Serve(publicListener, s.routes()))
 }
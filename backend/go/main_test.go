@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"examples/config"
+	"examples/csrf"
+	"examples/database"
+	"examples/database/bolt"
+	"examples/database/embedded"
+	"examples/encryption"
+	"examples/jobs"
+	"examples/mailer"
+	"examples/signedurl"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminToken is the token our test server's admin endpoints expect
+const testAdminToken = "test-admin-token"
+
+// pg is the PostgreSQL server our integration tests share, or nil if it couldn't be started
+var pg *embedded.Server
+
+// pgErr is why pg couldn't be started
+var pgErr error
+
+// TestMain starts one embedded server for the whole package. Starting it can fail through no fault of ours (the first
+// run downloads its binaries), so rather than failing every test we skip the ones that need it, see newTestServer.
+func TestMain(m *testing.M) {
+	pg, pgErr = embedded.Start(embedded.Options{})
+	code := m.Run()
+	if pg != nil {
+		if err := pg.Stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "stopping embedded postgres: %v\n", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// newTestServer builds a server on an empty PostgreSQL database, with just enough dependencies to serve requests. The
+// test is skipped if we have no database.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	if pg == nil {
+		t.Skipf("no postgres to test against: %v", pgErr)
+	}
+	if err := pg.Reset(); err != nil {
+		t.Fatalf("resetting database: %v", err)
+	}
+	s, err := NewServer(testDeps(t, pg.DB()))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	return s
+}
+
+// boltDB opens an empty Bolt database, for tests that don't need PostgreSQL. It's closed once the test is done.
+func boltDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testDeps returns just enough dependencies for a server on db to serve requests, for tests to change as they need.
+func testDeps(t *testing.T, db database.Storer) Deps {
+	t.Helper()
+	keyring, err := encryption.NewKeyring(1, map[byte][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	return Deps{
+		TestDependency:   "test",
+		Logger:           logger,
+		DB:               db,
+		Encrypter:        keyring,
+		JobStore:         discardJobs{},
+		SessionTransport: config.TransportHeader,
+		Sessions: config.SessionLifespans{
+			IdleTimeout:         time.Hour,
+			MaxLifetime:         time.Hour,
+			RememberIdleTimeout: time.Hour,
+			RememberLifetime:    time.Hour,
+		},
+		URLSigner:  signedurl.New([]byte("test")),
+		CSRF:       csrf.New([]byte("test")),
+		Mailer:     mailer.Log{Logger: logger},
+		AdminToken: testAdminToken,
+		Config:     config.NewSnapshot(config.Config{SessionKey: []byte("test")}),
+	}
+}
+
+// serve sends a request with a JSON body to handler, authenticated with token if it isn't empty.
+func serve(handler http.Handler, token, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// discardJobs is a job store that drops every job it's given, our tests don't run any.
+type discardJobs struct{}
+
+func (discardJobs) PushJob(ctx context.Context, job jobs.Job) error { return nil }
+
+func (discardJobs) ClaimJob(ctx context.Context, lease time.Duration) (jobs.Job, bool, error) {
+	return jobs.Job{}, false, nil
+}
+
+func (discardJobs) AckJob(ctx context.Context, id string) error { return nil }
+
+func (discardJobs) RetryJob(ctx context.Context, id string, at time.Time) error { return nil }
@@ -0,0 +1,210 @@
+// metrics collects Prometheus metrics about our API, and provides the handler that serves them for scraping.
+package metrics
+
+import (
+	"examples/errs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// requests counts every request served, labelled by HTTP method, route (see Routes) and response status code
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests served.",
+	}, []string{"method", "route", "code"})
+	// duration records how long requests take to serve, labelled by HTTP method and route
+	duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// dbOperations counts every call made to our database, labelled by Storer method and result
+	dbOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_operations_total",
+		Help: "Total number of database operations, by result.",
+	}, []string{"op", "result"})
+	// dbDuration records how long database calls take, labelled by Storer method
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_operation_duration_seconds",
+		Help:    "Time taken by database operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+
+	// requestDBCalls records how many database calls each request makes, labelled by route template. A route whose
+	// count grows with the size of its data is usually an N+1 pattern (one call per item, rather than one for them all).
+	requestDBCalls = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_db_operations",
+		Help:    "Number of database operations made while serving each HTTP request.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	}, []string{"route"})
+
+	// requestsShed counts requests turned away to shed load, labelled by route group
+	requestsShed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Total number of HTTP requests turned away to shed load.",
+	}, []string{"group"})
+
+	// requestsMirrored counts requests copied to our shadow deployment (see the mirror package), labelled by result:
+	// whether the shadow's status matched ours ("match" or "mismatch"), it couldn't be reached ("error"), or the copy was
+	// never sent ("dropped" when our queue was full, "skipped" when the body was too large)
+	requestsMirrored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_mirrored_total",
+		Help: "Total number of HTTP requests mirrored to a shadow deployment, by result.",
+	}, []string{"result"})
+
+	// cacheLookups counts lookups in each of our caches, labelled by result (hit, miss or error)
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_operations_total",
+		Help: "Total number of cache operations, by result.",
+	}, []string{"cache", "result"})
+
+	// logins counts login attempts, labelled by result (success, failure or lockout, see the loginstats package)
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logins_total",
+		Help: "Total number of login attempts, by result.",
+	}, []string{"result"})
+
+	// jobRuns counts every run of each background job, labelled by result
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_runs_total",
+		Help: "Total number of background job runs, by result.",
+	}, []string{"job", "result"})
+	// jobDuration records how long each background job takes to run
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "job_duration_seconds",
+		Help:    "Time taken by background job runs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"job"})
+	// retentionPurged counts records purged (or with dry_run, that would have been) by each retention policy
+	retentionPurged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "retention_records_purged_total",
+		Help: "Total number of records purged by retention policies.",
+	}, []string{"policy", "dry_run"})
+	// jobLastSuccess records when each background job last succeeded, handy for alerting on jobs that stop working
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_last_success_timestamp_seconds",
+		Help: "Unix time each background job last succeeded.",
+	}, []string{"job"})
+)
+
+// Handler serves all registered metrics in the Prometheus text format. This should only ever be served on the admin
+// listener, never on the public API.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveDB records a single database operation. The result label is "ok", or the error code from our errs package, so
+// it stays a small, fixed set of values.
+func ObserveDB(op string, took time.Duration, err error) {
+	dbOperations.WithLabelValues(op, result(err)).Inc()
+	dbDuration.WithLabelValues(op).Observe(took.Seconds())
+}
+
+// ObserveRequestDBCalls records how many database calls a request made.
+func ObserveRequestDBCalls(route string, calls int) {
+	requestDBCalls.WithLabelValues(route).Observe(float64(calls))
+}
+
+// ObserveShed records a request turned away to shed load.
+func ObserveShed(group string) {
+	requestsShed.WithLabelValues(group).Inc()
+}
+
+// ObserveMirror records a single request mirrored to our shadow deployment, see requestsMirrored for the results.
+func ObserveMirror(result string) {
+	requestsMirrored.WithLabelValues(result).Inc()
+}
+
+// ObserveCache records a single cache operation, result should be "hit", "miss" or "error".
+func ObserveCache(cache, result string) {
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// ObserveLogin records a single login attempt, result should be "success", "failure" or "lockout".
+func ObserveLogin(result string) {
+	logins.WithLabelValues(result).Inc()
+}
+
+// ObserveJob records a single run of a background job.
+func ObserveJob(job string, took time.Duration, err error) {
+	jobRuns.WithLabelValues(job, result(err)).Inc()
+	jobDuration.WithLabelValues(job).Observe(took.Seconds())
+	if err == nil {
+		jobLastSuccess.WithLabelValues(job).SetToCurrentTime()
+	}
+}
+
+// ObservePurge records the number of records a retention policy purged, or would have purged in a dry run.
+func ObservePurge(policy string, count int, dryRun bool) {
+	retentionPurged.WithLabelValues(policy, strconv.FormatBool(dryRun)).Add(float64(count))
+}
+
+// result turns an error into a metric label.
+func result(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return string(errs.CodeOf(err))
+}
+
+// Other is the label for a route or HTTP method that isn't on our list, see Routes.
+const Other = "other"
+
+// methods lists the HTTP methods we label requests with, anything else (which the client is free to make up) is Other.
+var methods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// Routes lists the route templates (such as "/users/{username}") our request metrics may be labelled with, an
+// allowlist. Every distinct label value is a time series of its own, so labelling by raw path would let anyone make us
+// keep as many as they like, just by sending requests for made up paths (as anyone scanning for vulnerable endpoints
+// does). Requests for any route not on the list, or that didn't match a route at all, are labelled Other instead.
+type Routes map[string]bool
+
+// Label returns the label for a request for the given route template.
+func (rs Routes) Label(template string) string {
+	if rs[template] {
+		return template
+	}
+	return Other
+}
+
+// Middleware returns middleware recording metrics for every request passing through it, labelled by the route
+// template route returns for it (see Label).
+func (rs Routes) Middleware(route func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Wrap the ResponseWriter so we can find out what status code the handler wrote
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+			method := r.Method
+			if !methods[method] {
+				method = Other
+			}
+			label := rs.Label(route(r))
+			requests.WithLabelValues(method, label, strconv.Itoa(rec.status)).Inc()
+			duration.WithLabelValues(method, label).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// statusRecorder wraps a http.ResponseWriter, remembering the status code that was written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before passing it on.
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	promBridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// StartOTLP pushes all of our metrics to an OpenTelemetry collector every interval, for deployments that use a
+// collector rather than a Prometheus server. Our metrics are still recorded with the Prometheus client, a bridge reads
+// them and converts them to OpenTelemetry metrics, so they're identical whichever way they're collected.
+//
+// Where to send metrics is configured with the standard OpenTelemetry environment variables, such as
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS. The returned function flushes any remaining metrics
+// and stops exporting, it should be called on shutdown.
+func StartOTLP(ctx context.Context, interval time.Duration) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		// Read everything registered with the Prometheus client, which is all of our metrics
+		sdkmetric.WithProducer(promBridge.NewMetricProducer()),
+	)
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	return provider.Shutdown, nil
+}
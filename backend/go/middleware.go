@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/csrf"
+	"examples/database"
+	"examples/errs"
+	"examples/metrics"
+	"examples/mirror"
+	"examples/requestctx"
+	"examples/signedurl"
+	"examples/tracing"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// validRequestID matches request IDs we're willing to accept from a client or upstream proxy. Anything else (too long,
+// or containing characters that could mess up our logs) is replaced with an ID of our own.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID gives every request an ID, which is included in our logs and returned in the X-Request-ID header. When a
+// user reports a problem, the ID lets us find exactly what happened. If a proxy in front of us already assigned an
+// ID we'll keep using it, so the request can be followed through every service it passes through.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(requestctx.WithRequestID(r.Context(), id)))
+	})
+}
+
+// Cross Origin Resource Sharing (CORS)
+// This allows a frontend to communicate with a backend that is hosted at a different URL.
+//
+// By default, if you have a frontend hosted at https://myCoolWebsite.com, and you try to make an API call
+// to your API hosted at https://myAwesomeAPI.com, you'll encounter CORS errors.
+//
+// Most modern web browsers (Chrome, Firefox, Safari, Edge, Opera, etc) accomplish this by performing a
+// "pre-flight" request using the OPTIONS http verb to check CORS options.
+//
+// Note that API testing tools like Postman (allows you to make requests to your backend) will not send a
+// pre-flight request, and will never encounter CORS errors, so be sure to test with a frontend before ever
+// pushing something straight to production.
+//
+// Here's we'll use a Middleware function that only uses standard library
+// Middleware allows us to wrap a Handler function, it is perfect for performing actions such as authentication checks, or
+// in this case handling CORS configuration.
+func (s *server) cors(next http.Handler) http.Handler {
+	anyOrigin := len(s.corsOrigins) == 0 || slices.Contains(s.corsOrigins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Here we can specify what Origins are allowed. (Example: An Origin could be our frontend hosted at https://myCoolWebsite.com")
+		// By default we use the wildcard "*" to allow any Origin, set CORS_ORIGINS to list them instead. Browsers never
+		// send cookies to a wildcard, so listing them is required when sessions are delivered by cookie.
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// Only one origin can be allowed per response, so we echo back the caller's if it's on our list. The response
+			// now depends on the Origin header, which caches need to know.
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); origin != "" && s.originAllowed(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		// Here we specify allowed headers, including any custom headers you may wish to be included in a request
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join([]string{"Content-Type", "Authorization", csrf.Header, apiVersionHeader}, ","))
+		// Here you'll specify what HTTP methods (verbs) your API allows.
+		// Note that http.MethodOptions may need to be explicity allowed for CORS pre-flight requests.
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions}, ","))
+		// Browsers only let frontends read a few standard response headers, any others they need have to be listed here
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join([]string{sessionExpiresInHeader, sessionRefreshHeader, apiVersionHeader}, ","))
+
+		// Typically in an API, the http.MethodOptions verb will only be used for CORS, so we'll explicitly return nothing in
+		// the event of an OPTIONS call. Otherwise we'll serve the wrapped handler
+		if r.Method == http.MethodOptions {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed reports whether browsers may call us from origin, either because it's on our own list or because a
+// tenant has allowed it (see the tenants package). If the tenants' origins can't be loaded only our own are allowed.
+func (s *server) originAllowed(origin string) bool {
+	if slices.Contains(s.corsOrigins, strings.ToLower(origin)) {
+		return true
+	}
+	allowed, err := s.tenants.OriginAllowed(origin)
+	if err != nil {
+		s.logger.Printf("WARNING: Unable to check tenants' allowed origins: %v", err)
+	}
+	return allowed
+}
+
+// maintenance turns every request away with a 503 status while we're in a maintenance window, telling clients exactly
+// when the window ends with a Retry-After header.
+func (s *server) maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if remaining := time.Until(s.config.Load().MaintenanceUntil); remaining > 0 {
+			err := errs.New(errs.Unavailable, "down for scheduled maintenance")
+			err.RetryAfter = remaining
+			s.writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadShedRetryAfter is how long we suggest clients wait before retrying a request we turned away to shed load. Spikes
+// usually pass quickly, and clients retrying at slightly different times spreads the load back out.
+const loadShedRetryAfter = time.Second
+
+// shedLoad turns away requests with a 503 status once we're already working on as many requests as we allow, overall
+// or for the route's group (see routeGroup).
+func (s *server) shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.shedder == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		group := routeGroup(r)
+		release, ok := s.shedder.Acquire(group)
+		if !ok {
+			metrics.ObserveShed(group)
+			err := errs.New(errs.Unavailable, "server is busy, please try again shortly")
+			err.RetryAfter = loadShedRetryAfter
+			s.writeError(w, r, err)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unlessReplayed skips middleware for writes replayed after degraded mode queued them (see replayDeferredJob). The
+// client's request was already counted in our metrics, and let through our load shedding and rate limit, when it first
+// arrived. Doing it again would count it twice, and could turn away the very write the client is waiting on as we
+// recover.
+func unlessReplayed(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestctx.Replayed(r.Context()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// mirrorTraffic copies a share of requests (config.MirrorPercent) to our shadow deployment once we've responded to them,
+// see the mirror package. The body is read here so it can be copied, and the handler is given an identical one.
+func (s *server) mirrorTraffic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Writes replayed after degraded mode queued them were already mirrored when they first arrived
+		if s.mirror == nil || requestctx.Replayed(r.Context()) || !mirror.Sampled(s.config.Load().MirrorPercent) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Read at most one byte more than we'd mirror, so we know whether the body is too large without reading it all
+		var body []byte
+		if r.Body != nil && r.ContentLength <= mirror.MaxBody {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, mirror.MaxBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		rec := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		uri, ok := mirroredURI(r)
+		if !ok || r.ContentLength > mirror.MaxBody || len(body) > mirror.MaxBody {
+			metrics.ObserveMirror("skipped")
+			return
+		}
+		s.mirror.Send(mirror.Request{
+			Method: r.Method,
+			URI:    uri,
+			Header: r.Header,
+			Body:   body,
+			Status: rec.status,
+		})
+	})
+}
+
+// secretPathVars are path parameters carrying one-time secrets, such as the tokens in links we email to Users
+var secretPathVars = []string{"token"}
+
+// redactedPathVar replaces secret path parameters in the requests we mirror
+const redactedPathVar = "REDACTED"
+
+// mirroredURI returns the path and query of a request to mirror, with the secrets in them redacted: the tokens from our
+// emailed links (see secretPathVars) and the signatures of signed download URLs. Using either would be just as
+// effective from the shadow as from the User it was meant for, so they're never passed on. Returns false if the path
+// can't be rebuilt without its secrets, in which case the request mustn't be mirrored at all.
+func mirroredURI(r *http.Request) (string, bool) {
+	u := *r.URL
+	signedurl.Redact(&u)
+	route, vars := mux.CurrentRoute(r), mux.Vars(r)
+	secret := false
+	for _, name := range secretPathVars {
+		if _, ok := vars[name]; ok {
+			secret = true
+		}
+	}
+	if !secret {
+		return u.RequestURI(), true
+	}
+	if route == nil {
+		return "", false
+	}
+	pairs := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		if slices.Contains(secretPathVars, name) {
+			value = redactedPathVar
+		}
+		pairs = append(pairs, name, value)
+	}
+	path, err := route.URLPath(pairs...)
+	if err != nil {
+		return "", false
+	}
+	u.Path, u.RawPath = path.Path, path.RawPath
+	return u.RequestURI(), true
+}
+
+// routeGroup returns the group a request's route belongs to for load shedding and trace sampling, which is the first
+// segment of its path template, such as "users" for /users/{username}/email.
+func routeGroup(r *http.Request) string {
+	group, _, _ := strings.Cut(strings.TrimPrefix(routeTemplate(r), "/"), "/")
+	return group
+}
+
+// routeTemplate returns the path template of a request's route, or its path if no route matched.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// allowMetricRoutes fills in the allowlist of routes our request metrics are labelled with (see metrics.Routes): every
+// route on router, or only those in config.MetricsRoutes if it's set. Listing a route we don't serve is logged, as
+// it's most likely a typo.
+func (s *server) allowMetricRoutes(router *mux.Router, routes metrics.Routes) {
+	served := make(map[string]bool)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// Routes without a path (such as a PathPrefix("") subrouter) are never a request's route
+		if template, err := route.GetPathTemplate(); err == nil && template != "" {
+			served[template] = true
+		}
+		return nil
+	})
+	only := s.config.Load().MetricsRoutes
+	if len(only) == 0 {
+		maps.Copy(routes, served)
+		return
+	}
+	for _, template := range only {
+		if !served[template] {
+			s.logger.Printf("WARNING: METRICS_ROUTES lists %s, which isn't one of our routes", template)
+			continue
+		}
+		routes[template] = true
+	}
+}
+
+// traceRequests starts a span for every request, continuing the caller's trace if they sent a traceparent header. It
+// needs to know the route, so must run on a router after matching. The span is sampled at the rate for the route's
+// group (see the tracing package), and is marked as failed when we respond with a server error so it's exported
+// whatever the rate.
+func (s *server) traceRequests(next http.Handler) http.Handler {
+	if s.sampler == nil {
+		return next
+	}
+	tracer := otel.Tracer("examples")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				tracing.GroupKey.String(routeGroup(r)),
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("request.id", requestctx.RequestID(r.Context())),
+			),
+		)
+		defer span.End()
+		rec := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// rateLimit turns away clients that have made too many requests with a 429 status, telling them how long until their
+// limit resets with a Retry-After header.
+func (s *server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := s.limiter.Allow(s.clientIP(r)); !ok {
+			err := errs.New(errs.TooManyRequests, "too many requests, please slow down")
+			err.RetryAfter = retryAfter
+			s.writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth checks that the request belongs to a valid, unexpired session, rejecting it with a 401 status otherwise.
+// Sessions are renewed as they're used, so an active user isn't logged out part way through what they're doing.
+func (s *server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unauthorized := errs.New(errs.Unauthorized, "not logged in")
+		tokenHash, ok := sessionToken(r)
+		if !ok {
+			s.writeError(w, r, unauthorized)
+			return
+		}
+		session, err := s.unscoped(r).LoadSessionByToken(tokenHash)
+		if errors.Is(err, errs.NotFound) {
+			s.writeError(w, r, unauthorized)
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		// Expired sessions are cleared by a background task, but that only runs every so often
+		now := clock.Now()
+		if now.After(session.Expires) || now.After(session.EndOfLife) {
+			s.sessionExpired(w, r)
+			return
+		}
+
+		// The credentials stored with the session were encrypted by us at login, so they should always decrypt and name the
+		// session's user. Anything else means the session record has been tampered with, or was created with a key we no
+		// longer use, either way we won't trust it.
+		creds, ok := s.sessionCredsOf(session)
+		if !ok {
+			s.writeError(w, r, unauthorized)
+			return
+		}
+		// Sessions may be bound to the client that logged in, see fingerprint.go
+		if !s.fingerprintAllowed(r, session, creds) {
+			s.writeError(w, r, unauthorized)
+			return
+		}
+
+		// Check the user is still allowed in. Doing this on every request means disabling a user locks them out
+		// immediately, rather than whenever their session happens to end.
+		user, err := s.activeUser(r, session.UserID)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		expires := session.Expires
+		// Failing to renew isn't a reason to fail the request, the session is still valid for now
+		if idle, _, err := s.sessionLifespans(session.UserID, session.Remember); err != nil {
+			s.logger.Printf("WARNING: Unable to renew session %d: %v", session.ID, err)
+		} else if s.shouldRenew(session, idle, now) {
+			if err := s.unscoped(r).ExtendSession(session.ID, idle); err != nil {
+				s.logger.Printf("WARNING: Unable to renew session %d: %v", session.ID, err)
+			} else {
+				expires = now.Add(idle)
+			}
+		}
+		if expires.After(session.EndOfLife) {
+			expires = session.EndOfLife
+		}
+		setSessionExpiresIn(w, expires.Sub(now))
+		// Like renewing, failing to record where the session was used isn't a reason to fail the request
+		if ip, agent := s.clientIP(r), userAgentOf(r); s.shouldTouch(session, ip, agent, now) {
+			if err := s.unscoped(r).TouchSession(session.ID, now, ip, agent); err != nil {
+				s.logger.Printf("WARNING: Unable to record use of session %d: %v", session.ID, err)
+			} else {
+				session.LastSeen, session.LastIP, session.UserAgent = now, ip, agent
+			}
+		}
+		// Pass the user and session along to our handlers, so they don't need to load them again
+		ctx := requestctx.WithUser(r.Context(), user)
+		ctx = requestctx.WithSession(ctx, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sessionExpiresInHeader tells clients how many whole seconds their session has left, unless it's used (and so renewed)
+// before then. Frontends can use it to refresh the session, or warn the User, before it ends part way through whatever
+// they're doing.
+const sessionExpiresInHeader = "X-Session-Expires-In"
+
+// sessionRefreshHeader names where an expired session can be refreshed, see sessionExpired.
+const sessionRefreshHeader = "X-Session-Refresh"
+
+// setSessionExpiresIn sets our X-Session-Expires-In header.
+func setSessionExpiresIn(w http.ResponseWriter, left time.Duration) {
+	w.Header().Set(sessionExpiresInHeader, strconv.Itoa(int(math.Max(0, left.Seconds()))))
+}
+
+// sessionExpired responds to a request made with a session that has expired. If enabled, the response hints that
+// refreshing may get the client going again: a WWW-Authenticate header saying the token has expired (as OAuth does, see
+// RFC 6750), and an X-Session-Refresh header with our refresh endpoint. A frontend can then refresh and retry the
+// request, without having to treat every 401 as a reason to try refreshing.
+func (s *server) sessionExpired(w http.ResponseWriter, r *http.Request) {
+	if s.sessionRefreshHint {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="session expired"`)
+		w.Header().Set(sessionRefreshHeader, s.pathTo(refreshPath))
+	}
+	s.writeError(w, r, errs.New(errs.Unauthorized, "session expired"))
+}
+
+// activeUser loads a logged in User, returning an Unauthorized error if they no longer exist, or a Forbidden error if
+// they've been disabled.
+func (s *server) activeUser(r *http.Request, id int64) (database.User, error) {
+	user, err := s.unscoped(r).GetUserByID(id)
+	if errors.Is(err, errs.NotFound) {
+		return database.User{}, errs.New(errs.Unauthorized, "not logged in")
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	if !user.Enabled {
+		return database.User{}, errs.New(errs.Forbidden, "account disabled")
+	}
+	return user, nil
+}
+
+// sessionCredsOf decrypts a session's credentials, reporting whether they decrypt and belong to the session's user.
+func (s *server) sessionCredsOf(session database.Session) (sessionCreds, bool) {
+	plaintext, err := s.encrypter.Open(session.EncryptedCreds)
+	if err != nil {
+		return sessionCreds{}, false
+	}
+	var creds sessionCreds
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return sessionCreds{}, false
+	}
+	return creds, creds.UserID == session.UserID
+}
+
+// sessionTouchInterval is how often we record that a session is still being used. Users only need a rough idea of when
+// each session was last used to recognise it, so there's no need for a database write on every request.
+const sessionTouchInterval = 5 * time.Minute
+
+// maxUserAgentLength is the most of a User-Agent we keep, real ones are well under this
+const maxUserAgentLength = 512
+
+// userAgentOf returns the request's User-Agent, cut short if it's unreasonably long.
+func userAgentOf(r *http.Request) string {
+	agent := r.UserAgent()
+	if len(agent) > maxUserAgentLength {
+		agent = strings.ToValidUTF8(agent[:maxUserAgentLength], "")
+	}
+	return agent
+}
+
+// shouldTouch reports whether we should record a session's use, because it hasn't been recorded recently, or it's being
+// used from a different address or client than last time.
+func (s *server) shouldTouch(session database.Session, ip, userAgent string, now time.Time) bool {
+	return now.Sub(session.LastSeen) >= sessionTouchInterval || session.LastIP != ip || session.UserAgent != userAgent
+}
+
+// shouldRenew reports whether enough of a session's idle timeout has passed that it should be renewed. Rather than
+// writing a new expiration to the database on every request, we only do so once the configured percentage of the idle
+// timeout (idle, see sessionLifespans) has passed, turning one UPDATE per request into an occasional one.
+func (s *server) shouldRenew(session database.Session, idle time.Duration, now time.Time) bool {
+	// Once a session's expiration has caught up with its end of life, renewing can't extend it any further
+	if !session.Expires.Before(session.EndOfLife) {
+		return false
+	}
+	elapsed := idle - session.Expires.Sub(now)
+	return elapsed*100 >= idle*time.Duration(s.sessionRenewAfter)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"examples/config"
+	"examples/database/sql"
+	"examples/secrets"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// runMigrate applies our migrations (see database/sql/migrations) to our database, run with `app migrate`. It's for
+// deploys that migrate as a step of their own, such as a Kubernetes job, rather than setting MIGRATE_ON_START. Flags:
+//
+//	-status    only report which migration our database is at
+//	-to N      migrate up or down to version N rather than up to our newest, -to 0 undoes every migration
+//
+// It writes a report to out, returning the exit code to use, 0 if it succeeded and 1 otherwise.
+func runMigrate(out io.Writer, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	status := flags.Bool("status", false, "Only report which migration the database is at")
+	to := flags.Int("to", sql.LatestMigration(), "Migrate up or down to this version (0 undoes every migration)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		fmt.Fprintf(out, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	// Just as when we start, our database URL comes from our secrets provider if we have one
+	dbURL := cfg.DatabaseURL
+	if cfg.SecretsDir != "" {
+		if dbURL, err = fetchDatabaseURL(context.Background(), secrets.NewDir(cfg.SecretsDir)); err != nil {
+			fmt.Fprintf(out, "Error fetching database URL: %v\n", err)
+			return 1
+		}
+	}
+	db, err := sql.NewSQLDB(dbURL, dbPool(cfg), dbRetry(cfg))
+	if err != nil {
+		fmt.Fprintf(out, "Error connecting to database: %v\n", err)
+		return 1
+	}
+
+	before, err := db.MigrationVersion()
+	if err != nil {
+		fmt.Fprintf(out, "Error reading migration version: %v\n", err)
+		return 1
+	}
+	if *status {
+		fmt.Fprintf(out, "Database is at migration %d of %d\n", before, sql.LatestMigration())
+		return 0
+	}
+	steps, err := db.MigrateTo(*to)
+	if err != nil {
+		fmt.Fprintf(out, "Error migrating database after %d steps: %v\n", steps, err)
+		return 1
+	}
+	fmt.Fprintf(out, "Database migrated from %d to %d, %d steps\n", before, *to, steps)
+	return 0
+}
@@ -0,0 +1,147 @@
+// mirror sends copies of real requests to a shadow deployment (dark traffic), so a new version of our API can be tried
+// against production traffic before any client depends on it. Copies are sent in the background once we've responded,
+// and the shadow's responses are thrown away: all we keep is whether its status matched ours, counted in our metrics
+// (http_requests_mirrored_total), which is usually enough to spot a handler the new version broke.
+//
+// Copies are sanitized just as our request recordings are (see the recorder package): credentials are dropped and
+// secret looking JSON fields are redacted. Secrets in a URL are redacted before it's handed to us, by whoever knows
+// which parts of their routes are secret: for our API, the tokens in links we email and the signatures of download
+// links (see mirroredURI). The shadow sees who's calling no more than a stranger would, so most of what it answers for
+// authenticated routes is a 401, and it's the unauthenticated routes (and how every route handles bad input) that get
+// the most useful comparison.
+//
+// The shadow must have its own database, and shouldn't send email: it's handed real signups, password resets and so
+// on. Each copy carries the Header below, so the shadow can tell mirrored traffic apart.
+//
+// Mirroring never slows us down. Copies wait in a bounded queue for a few workers to send them, and when the queue is
+// full (because the shadow is slow or down) further copies are dropped.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"examples/metrics"
+	"examples/recorder"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header is set on every request we mirror, so the shadow knows it's not real traffic
+const Header = "X-Mirrored-Request"
+
+// MaxBody is the largest request body we mirror. Requests with larger bodies aren't mirrored at all, as a body cut off
+// part way would only tell us how the shadow handles broken input.
+const MaxBody = 64 << 10
+
+// Sizing of our queue and how many copies are sent at once, plenty for the small share of traffic worth mirroring
+const (
+	queueSize = 1000
+	workers   = 4
+	timeout   = 5 * time.Second
+)
+
+// droppedHeaders are removed on top of those recorder.SanitizeHeader drops. CSRF tokens are only useful alongside the
+// cookie they were issued with, which we've dropped, and the rest describe our connection, not the shadow's.
+var droppedHeaders = []string{"X-CSRF-Token", "Connection", "Content-Length", "Transfer-Encoding", "Upgrade"}
+
+// Request is a copy of a request we've served, along with the status we responded with.
+type Request struct {
+	Method string
+	URI    string // Path and query, such as /users/?page=2, with any base path of ours and any secrets already removed
+	Header http.Header
+	Body   []byte
+	Status int // Our response's status, which the shadow's is compared against
+}
+
+// Mirror sends copies of requests to a shadow deployment. It's safe for concurrent use.
+type Mirror struct {
+	target *url.URL
+	client *http.Client
+	queue  chan Request
+}
+
+// New creates a Mirror sending copies to target, the shadow's address including any base path it's mounted under (such
+// as https://shadow.internal/api). Nothing is sent until Run is called.
+func New(target *url.URL) *Mirror {
+	return &Mirror{
+		target: target,
+		client: &http.Client{
+			Timeout: timeout,
+			// We compare the shadow's own response, not wherever it would send us
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		queue: make(chan Request, queueSize),
+	}
+}
+
+// Sampled picks whether to mirror a request, returning true for roughly percent out of every 100 calls.
+func Sampled(percent int) bool {
+	return rand.Intn(100) < percent
+}
+
+// Send queues a copy of a request to be mirrored, without waiting. The copy is dropped if the queue is full. The request
+// is sanitized here, so nothing secret sits in our queue.
+func (m *Mirror) Send(req Request) {
+	header := recorder.SanitizeHeader(req.Header)
+	for _, name := range droppedHeaders {
+		header.Del(name)
+	}
+	header.Set(Header, "true")
+	req.Header = header
+	if len(req.Body) > 0 {
+		req.Body = []byte(recorder.SanitizeBody(req.Body))
+	}
+
+	select {
+	case m.queue <- req:
+	default:
+		metrics.ObserveMirror("dropped")
+	}
+}
+
+// Run sends queued copies until ctx is cancelled.
+func (m *Mirror) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-m.queue:
+					metrics.ObserveMirror(m.send(ctx, req))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// send sends a single copy to the shadow, returning how its response compared to ours: "match", "mismatch" or "error".
+func (m *Mirror) send(ctx context.Context, req Request) string {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := http.NewRequestWithContext(ctx, req.Method, strings.TrimSuffix(m.target.String(), "/")+req.URI, bytes.NewReader(req.Body))
+	if err != nil {
+		return "error"
+	}
+	out.Header = req.Header
+	resp, err := m.client.Do(out)
+	if err != nil {
+		return "error"
+	}
+	// Read the body so the connection can be reused, we don't need what's in it
+	io.Copy(io.Discard, io.LimitReader(resp.Body, MaxBody))
+	resp.Body.Close()
+	if resp.StatusCode != req.Status {
+		return "mismatch"
+	}
+	return "match"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"examples/config"
+	"examples/mirror"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMirrorRedactsSecrets checks the one-time secrets in our URLs never reach the shadow: the tokens in emailed links,
+// and the signatures of download links.
+func TestMirrorRedactsSecrets(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.RequestURI
+	}))
+	defer shadow.Close()
+	target, err := url.Parse(shadow.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := mirror.New(target)
+	go m.Run(ctx)
+
+	deps := testDeps(t, boltDB(t))
+	deps.Mirror = m
+	deps.Config = config.NewSnapshot(config.Config{SessionKey: []byte("test"), MirrorPercent: 100})
+	s, err := NewServer(deps)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	handler := s.routes()
+
+	tests := []struct {
+		method, uri, want string
+	}{
+		{http.MethodPost, "/login/magic/s3cr3t-t0ken", "/login/magic/REDACTED"},
+		{http.MethodGet, "/verify/s3cr3t-t0ken", "/verify/REDACTED"},
+		{http.MethodGet, "/downloads/exports/1.csv?expires=1700000000&signature=s3cr3t-t0ken",
+			"/downloads/exports/1.csv?expires=REDACTED&signature=REDACTED"},
+	}
+	for _, test := range tests {
+		serve(handler, "", test.method, test.uri, `{}`)
+		select {
+		case got := <-mirrored:
+			if strings.Contains(got, "s3cr3t") || got != test.want {
+				t.Errorf("%s %s was mirrored as %s, want %s", test.method, test.uri, got, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s wasn't mirrored", test.method, test.uri)
+		}
+	}
+}
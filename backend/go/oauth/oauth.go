@@ -0,0 +1,152 @@
+// oauth lets Users log in with an account they already have elsewhere (Google or GitHub), rather than a password. It
+// wraps golang.org/x/oauth2, adding what each provider needs to tell us who the User is once they've signed in.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// Providers we support
+const (
+	Google = "google"
+	GitHub = "github"
+)
+
+// Identity is what a provider tells us about a User who has signed in with it.
+type Identity struct {
+	Subject       string // The provider's own ID for the User, this never changes even if their email does
+	Email         string
+	EmailVerified bool // Whether the provider has checked the User owns Email
+	First, Last   string
+}
+
+// Provider sends Users to sign in with a provider, then finds out who they are once they're sent back to us.
+type Provider struct {
+	config   *oauth2.Config
+	identify func(ctx context.Context, client *http.Client) (Identity, error)
+}
+
+// New creates a Provider by name (Google or GitHub), using the client credentials the provider issued us.
+// redirectURL is where the provider sends Users back to once they've signed in, it must match the URL registered
+// with the provider exactly.
+func New(name, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	config := &oauth2.Config{ClientID: clientID, ClientSecret: clientSecret, RedirectURL: redirectURL}
+	p := &Provider{config: config}
+	switch name {
+	case Google:
+		config.Endpoint = endpoints.Google
+		config.Scopes = []string{"openid", "email", "profile"}
+		p.identify = identifyGoogle
+	case GitHub:
+		config.Endpoint = endpoints.GitHub
+		config.Scopes = []string{"read:user", "user:email"}
+		p.identify = identifyGitHub
+	default:
+		return nil, fmt.Errorf("unknown OAuth provider %q", name)
+	}
+	return p, nil
+}
+
+// AuthCodeURL returns the URL to send a User to, to sign in with the provider. The state is handed back to us
+// unchanged when they return, so we can check it was us that sent them.
+func (p *Provider) AuthCodeURL(state string) string {
+	return p.config.AuthCodeURL(state)
+}
+
+// Exchange swaps the code a User was sent back to us with for an access token, then uses it to find out who they are.
+// Every call to the provider is made with client.
+func (p *Provider) Exchange(ctx context.Context, client *http.Client, code string) (Identity, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return Identity{}, err
+	}
+	return p.identify(ctx, p.config.Client(ctx, token))
+}
+
+// getJSON fetches a URL with an authenticated client, decoding the JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// identifyGoogle reads the signed in User from Google's OpenID Connect userinfo endpoint.
+func identifyGoogle(ctx context.Context, client *http.Client) (Identity, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return Identity{}, err
+	}
+	if info.Sub == "" {
+		return Identity{}, errors.New("google returned no subject")
+	}
+	return Identity{
+		Subject:       info.Sub,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		First:         info.GivenName,
+		Last:          info.FamilyName,
+	}, nil
+}
+
+// identifyGitHub reads the signed in User from GitHub's API. GitHub only has a single name field, so we split it at
+// the first space, and the email on a GitHub profile may be hidden, so we look for the User's verified primary email.
+func identifyGitHub(ctx context.Context, client *http.Client) (Identity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return Identity{}, err
+	}
+	if user.ID == 0 {
+		return Identity{}, errors.New("github returned no user ID")
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{Subject: strconv.FormatInt(user.ID, 10)}
+	identity.First, identity.Last, _ = strings.Cut(user.Name, " ")
+	if identity.First == "" {
+		identity.First = user.Login
+	}
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email, identity.EmailVerified = e.Email, e.Verified
+		}
+	}
+	return identity, nil
+}
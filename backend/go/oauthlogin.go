@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"examples/oauth"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Logging in with an OAuth provider (Google or GitHub) takes two requests. First the User's browser visits
+// /login/oauth/{provider}, which sends them off to sign in with the provider. Once they have, the provider sends them
+// back to /login/oauth/{provider}/callback with a code, which we swap for who they are, and log them in just as if they
+// had used a password.
+const (
+	// oauthStateCookie holds the random state we send to the provider, so the callback can check it was us that sent
+	// the User there. Without this, someone could trick a User into logging in to the attacker's account.
+	oauthStateCookie = "oauth_state"
+	// oauthPath is where our OAuth endpoints live, the state cookie is only sent there
+	oauthPath = "/login/oauth/"
+)
+
+// oauthProvider looks up the provider named in the request, returning a NotFound error if it isn't enabled.
+func (s *server) oauthProvider(r *http.Request) (string, *oauth.Provider, error) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := s.oauth[name]
+	if !ok {
+		return "", nil, errs.New(errs.NotFound, "unknown login provider")
+	}
+	return name, provider, nil
+}
+
+// oauthLogin sends the User off to sign in with an OAuth provider.
+func (s *server) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	_, provider, err := s.oauthProvider(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	state, _, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "oauthLogin"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     s.pathTo(oauthPath),
+		MaxAge:   600, // Signing in with the provider shouldn't take more than a few minutes
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode, // Lax still sends the cookie when the provider redirects the User back to us
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusFound)
+}
+
+// oauthCallback is where the provider sends the User back to once they've signed in. We find (or create) the User
+// their provider identity belongs to, then log them in.
+//
+// An identity we haven't seen before is linked to the User with the same email, but only if the provider has verified
+// the User owns that email, otherwise anyone could sign up with a provider using someone else's email and take over
+// their account. If no User has that email, one is created, without a password, so they can only log in with the
+// provider.
+func (s *server) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	name, provider, err := s.oauthProvider(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// Check the state we were sent back matches the one we sent, then forget it so it can't be used again
+	query := r.URL.Query()
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "invalid login state, please try again"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: s.pathTo(oauthPath), MaxAge: -1, HttpOnly: true, Secure: true})
+
+	// The User may have declined to sign in, in which case the provider tells us why rather than sending a code
+	if query.Get("error") != "" || query.Get("code") == "" {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "login was cancelled or failed"))
+		return
+	}
+	identity, err := provider.Exchange(r.Context(), s.client, query.Get("code"))
+	if err != nil {
+		s.writeError(w, r, &errs.Error{Code: errs.Unauthorized, Message: "unable to log in with " + name, Err: err})
+		return
+	}
+
+	user, err := s.oauthUser(r, name, identity)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if !user.Enabled {
+		s.writeError(w, r, errs.New(errs.Forbidden, "account disabled"))
+		return
+	}
+	// Signing in with a provider stands in for the password, Users with two-factor authentication still need a code.
+	// There's no "remember me" box on the provider's sign in page, so these logins get our default session lifespans.
+	s.continueLogin(w, r, user, false)
+}
+
+// oauthUser returns the User a provider identity belongs to, linking it to an existing User or creating a new User if
+// it isn't linked to anyone yet.
+func (s *server) oauthUser(r *http.Request, provider string, identity oauth.Identity) (database.User, error) {
+	user, err := s.unscoped(r).GetUserByIdentity(provider, identity.Subject)
+	if err == nil || !errors.Is(err, errs.NotFound) {
+		return user, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return database.User{}, errs.New(errs.Forbidden, "your "+provider+" account doesn't have a verified email")
+	}
+	action := "user.oauth_link"
+	user, err = s.userByEmail(r, identity.Email)
+	if errors.Is(err, errs.NotFound) {
+		// Providers only hand out addresses they've verified, so there's no need to check the domain, just store it in
+		// canonical form like any other address
+		email, err := s.emails.Canonical(identity.Email)
+		if err != nil {
+			return database.User{}, err
+		}
+		// Without a password hash, no password will ever match, so this User can only log in with the provider
+		user = database.User{First: identity.First, Last: identity.Last, Email: email, EmailVerified: true}
+		if err := s.unscoped(r).CreateUser(&user); err != nil {
+			return database.User{}, err
+		}
+		action = "user.oauth_signup"
+		s.publish(r, eventUserCreated, user.ID, newUserResponse(user))
+	} else if err != nil {
+		return database.User{}, err
+	}
+
+	if err := s.unscoped(r).LinkIdentity(user.ID, provider, identity.Subject); err != nil {
+		return database.User{}, errs.WithUser(err, user.ID)
+	}
+	s.audit(r, action, user.ID, provider)
+	return user, nil
+}
@@ -0,0 +1,162 @@
+// password hashes and checks User passwords. Passwords are hashed with argon2id, which is deliberately slow and uses a
+// lot of memory, so anyone who gets hold of our hashes can only try a handful of guesses a second.
+//
+// Hashes are stored in the standard PHC string format, which records the parameters each hash was made with:
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//
+// so the parameters can be raised over time without breaking existing passwords. Users created before we moved to
+// argon2id have bcrypt hashes, which are still accepted, and should be rehashed (see NeedsRehash) the next time the
+// User logs in.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"examples/database"
+	"examples/errs"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Our argon2id parameters, following the OWASP recommendation of 19 MiB of memory and 2 iterations
+const (
+	memory     = 19 * 1024 // In KiB
+	iterations = 2
+	threads    = 1
+	keyLen     = 32
+	saltLen    = 16
+)
+
+// MinLength is the shortest password we'll accept
+const MinLength = 8
+
+// ErrMismatch is returned when a password doesn't match a User's hash
+var ErrMismatch = errors.New("password does not match")
+
+// dummyHash is checked against when a User has no password (or doesn't exist), so a check takes the same time either
+// way. Skipping the check would let an attacker work out which emails have accounts just by timing our responses.
+var dummyHash = mustHash("not a real password")
+
+// Policy is what a new password must meet. Tenants can make ours stricter for their members (see the tenants package),
+// but never weaker.
+type Policy struct {
+	MinLength int // The shortest password accepted
+}
+
+// DefaultPolicy is the policy for Users whose tenants haven't chosen a stricter one
+var DefaultPolicy = Policy{MinLength: MinLength}
+
+// Validate checks a new password meets the policy, returning an Invalid error describing the problem if not. A policy
+// asking for less than our own MinLength is held to MinLength anyway.
+func (p Policy) Validate(password string) error {
+	minLength := max(p.MinLength, MinLength)
+	if len(password) < minLength {
+		return errs.New(errs.Invalid, fmt.Sprintf("password must be at least %d characters", minLength))
+	}
+	return nil
+}
+
+// Validate checks a new password meets our default policy, returning an Invalid error describing the problem if not.
+func Validate(password string) error {
+	return DefaultPolicy.Validate(password)
+}
+
+// SetPassword hashes a password, storing the hash on the User. The User still needs saving afterwards. New passwords
+// should be checked with Validate first.
+func SetPassword(user *database.User, password string) error {
+	hash, err := hash(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	return nil
+}
+
+// CheckPassword checks a password against the User's hash, returning ErrMismatch if it doesn't match. Users without a
+// password (such as those who only log in with an OAuth provider) never match.
+func CheckPassword(user database.User, password string) error {
+	if user.PasswordHash == "" {
+		verify(dummyHash, password)
+		return ErrMismatch
+	}
+	ok, err := verify(user.PasswordHash, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash reports whether a hash was made with an older algorithm or weaker parameters than we use now, so should
+// be replaced by calling SetPassword once the User's password has been checked.
+func NeedsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, prefix())
+}
+
+// prefix is the start of every hash made with our current parameters.
+func prefix() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$", argon2.Version, memory, iterations, threads)
+}
+
+// hash hashes a password with a new random salt.
+func hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, keyLen)
+	return prefix() + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+// mustHash hashes a password, panicking on error. Only used to build dummyHash.
+func mustHash(password string) string {
+	h, err := hash(password)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// verify reports whether a password matches a hash, using whichever algorithm the hash was made with.
+func verify(encoded, password string) (bool, error) {
+	if strings.HasPrefix(encoded, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	// $argon2id$v=19$m=...,t=...,p=...$salt$hash splits into an empty string followed by 5 parts
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("unrecognised password hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	got := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
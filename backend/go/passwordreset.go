@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"examples/password"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// passwordResetLifetime is how long a user has to use a password reset link
+const passwordResetLifetime = time.Hour
+
+// passwordChangeRequest is the body expected when a User changes their own password.
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// passwordResetRequest is the body expected when choosing a new password with a reset link.
+type passwordResetRequest struct {
+	Password string `json:"password"`
+}
+
+// resetPasswordSelf changes the logged in User's password. They need to give their current password too, so someone
+// who finds a logged in device left unattended can't take over the account. Wrong guesses count towards locking the
+// account, just like failed logins.
+func (s *server) resetPasswordSelf(w http.ResponseWriter, r *http.Request) {
+	user, ok := requestctx.User(r.Context())
+	if !ok {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "not logged in"))
+		return
+	}
+	var req passwordChangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// The User's tenants may ask for longer passwords than we do
+	policy, err := s.tenants.PasswordPolicy(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "resetPasswordSelf"), user.ID))
+		return
+	}
+	if err := policy.Validate(req.NewPassword); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	err = password.CheckPassword(user, req.CurrentPassword)
+	if errors.Is(err, password.ErrMismatch) {
+		invalid := errs.New(errs.Unauthorized, "current password is incorrect")
+		locked := errs.New(errs.Locked, "account locked after too many failed logins, please contact support")
+		s.failedLogin(w, r, user, invalid, locked)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "resetPasswordSelf"), user.ID))
+		return
+	}
+
+	if err := password.SetPassword(&user, req.NewPassword); err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "resetPasswordSelf"), user.ID))
+		return
+	}
+	if err := s.dbFor(r).SetPasswordHash(user.ID, user.PasswordHash); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.password", user.ID, "changed")
+	s.securityEvent(r, eventPasswordChanged, user.ID, "changed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetPasswordOther starts resetting another User's password, such as when they've forgotten it and contacted support.
+// Admins never choose (or see) the new password, instead we email the User a link to choose one themselves.
+func (s *server) resetPasswordOther(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "resetPasswordOther"))
+		return
+	}
+	reset := database.PasswordReset{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Expires:   clock.Now().Add(passwordResetLifetime),
+	}
+	if err := s.dbFor(r).CreatePasswordReset(&reset); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if err := s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("An administrator has started resetting the password on your account.\n\n"+
+			"To choose a new password, visit %s/password/reset/%s within the next hour.\n\n"+
+			"If you didn't ask for this, please contact support.", s.frontendURL, token),
+	}); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.password_reset", user.ID, "sent")
+	// 202 Accepted, as the password won't change until the User chooses a new one
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// confirmPasswordReset sets a new password using the token from a password reset email. Whoever knew the old password
+// may still be logged in, so every session the User has is ended, and the account is unlocked in case failed logins
+// were the reason for the reset.
+func (s *server) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// We only learn who the User is as their token is used, so their tenants' password policies can't be applied here,
+	// only our own
+	if err := password.Validate(req.Password); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// Hashing doesn't depend on who the User is, so we can hash before we know
+	var hashed database.User
+	if err := password.SetPassword(&hashed, req.Password); err != nil {
+		s.writeError(w, r, errs.Wrap(err, "confirmPasswordReset"))
+		return
+	}
+
+	reset, err := s.unscoped(r).UsePasswordReset(hashToken(mux.Vars(r)["token"]), hashed.PasswordHash)
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.NotFound, "this link is invalid or has expired"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if _, err := s.unscoped(r).DeleteUserSessions(reset.UserID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, reset.UserID))
+		return
+	}
+	if err := s.unscoped(r).UnlockUser(reset.UserID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, reset.UserID))
+		return
+	}
+	s.audit(r, "user.password", reset.UserID, "reset")
+	s.securityEvent(r, eventPasswordChanged, reset.UserID, "reset")
+	w.WriteHeader(http.StatusNoContent)
+}
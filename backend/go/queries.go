@@ -0,0 +1,31 @@
+package main
+
+import (
+	"examples/database/instrumented"
+	"examples/metrics"
+	"examples/requestctx"
+	"net/http"
+)
+
+// countQueries counts the database calls made while handling each request, recording the count in our metrics and
+// logging a warning for any request making more than our threshold. A handler that makes a call for every item it
+// returns (an N+1 pattern) looks fine with a handful of test records, and only falls over once real data arrives, so
+// this flags it early. Calls are counted by the database returned from s.unscoped and s.dbFor, so only calls made
+// through those are seen. Counts are labelled by route just as our other request metrics are (see metrics.Routes).
+func (s *server) countQueries(routes metrics.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counter := &instrumented.Counter{}
+			next.ServeHTTP(w, r.WithContext(requestctx.WithQueryCounter(r.Context(), counter)))
+
+			// Middleware on a mux router runs after the route is matched, so we can label by route rather than raw path
+			route := routeTemplate(r)
+			calls := counter.Calls()
+			metrics.ObserveRequestDBCalls(routes.Label(route), calls)
+			if threshold := s.config.Load().QueryWarnThreshold; threshold > 0 && calls > threshold {
+				s.logger.Printf("WARNING: %s %s made %d database calls (more than %d), this may be an N+1 pattern [request %s]",
+					r.Method, route, calls, threshold, requestctx.RequestID(r.Context()))
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle slows down repeated failures, such as wrong passwords, rather than limiting every request. Each key gets a
+// few failures for free, after which every failure makes it wait exponentially longer before its next attempt. That
+// barely affects someone who mistypes their password, but makes guessing thousands of passwords impractical.
+type Throttle interface {
+	// Wait reports how long key must wait before its next attempt, 0 if it may try now
+	Wait(key string) time.Duration
+	// Fail records a failed attempt by key, returning how long it must now wait
+	Fail(key string) time.Duration
+	// Reset forgets key's failures, such as after it succeeds
+	Reset(key string)
+}
+
+// Backoff describes how quickly a Throttle backs off.
+type Backoff struct {
+	Free int           // Failures allowed before we start making the key wait
+	Base time.Duration // Wait after the first failure beyond Free, doubling with each failure after that
+	Max  time.Duration // Longest we'll make a key wait
+}
+
+// delay is how long a key must wait after the given number of failures.
+func (b Backoff) delay(failures int) time.Duration {
+	if failures <= b.Free {
+		return 0
+	}
+	d := b.Base
+	for i := b.Free + 1; i < failures && d < b.Max; i++ {
+		d *= 2
+	}
+	return min(d, b.Max)
+}
+
+// forget is how long a key must go without failing before its failures are forgotten. This is twice the longest wait,
+// so a key can't start afresh just by waiting out its current delay.
+func (b Backoff) forget() time.Duration {
+	return 2 * b.Max
+}
+
+// MemoryThrottle is an in-memory Throttle. Like our other in-memory limiters, each instance of our API keeps its own
+// counts, so an attacker spreading attempts across instances gets each instance's free failures. RedisThrottle shares
+// counts between instances.
+type MemoryThrottle struct {
+	backoff Backoff
+
+	mu        sync.Mutex
+	keys      map[string]*failures
+	lastSweep time.Time
+}
+
+// failures tracks a single key's failures.
+type failures struct {
+	count int
+	last  time.Time // When the key last failed
+	until time.Time // When the key may try again
+}
+
+// NewMemoryThrottle creates an in-memory Throttle backing off as given.
+func NewMemoryThrottle(backoff Backoff) *MemoryThrottle {
+	return &MemoryThrottle{
+		backoff:   backoff,
+		keys:      make(map[string]*failures),
+		lastSweep: time.Now(),
+	}
+}
+
+// Wait implements Throttle.
+func (t *MemoryThrottle) Wait(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.keys[key]
+	if !ok {
+		return 0
+	}
+	return max(0, time.Until(f.until))
+}
+
+// Fail implements Throttle.
+func (t *MemoryThrottle) Fail(key string) time.Duration {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+
+	f, ok := t.keys[key]
+	if !ok || now.Sub(f.last) > t.backoff.forget() {
+		f = &failures{}
+		t.keys[key] = f
+	}
+	f.count++
+	f.last = now
+	delay := t.backoff.delay(f.count)
+	f.until = now.Add(delay)
+	return delay
+}
+
+// Reset implements Throttle.
+func (t *MemoryThrottle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, key)
+}
+
+// sweep throws away keys whose failures have been forgotten, keeping memory use bounded by how many keys are currently
+// failing. t.mu must be held.
+func (t *MemoryThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.backoff.forget() {
+		return
+	}
+	t.lastSweep = now
+	for key, f := range t.keys {
+		if now.Sub(f.last) > t.backoff.forget() {
+			delete(t.keys, key)
+		}
+	}
+}
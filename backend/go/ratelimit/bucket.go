@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// warmUpFloor is the fraction of its plan's limits a brand new key starts with during warm-up
+const warmUpFloor = 0.1
+
+// Plan describes the limits applied to a group of clients.
+type Plan struct {
+	Limit  int           // Requests allowed per Window, on average
+	Window time.Duration // Period Limit applies to
+	// Burst is how many requests may be made in quick succession before being held to the average rate, set it above
+	// Limit to allow short bursts of activity. Defaults to Limit.
+	Burst int
+	// WarmUp is how long newly created keys take to reach their full limits. Brand new keys start at a tenth of them,
+	// rising steadily over this period, so a freshly created key can't immediately be used at full volume (handy
+	// against signup abuse). Leave 0 to disable warm-up.
+	WarmUp time.Duration
+}
+
+// Client describes who a request should be limited as.
+type Client struct {
+	Key     string    // Identifies the client, such as their IP address or API key
+	Plan    string    // Billing plan the client is on, empty for our default plan
+	Created time.Time // When the client's key was created, for warm-up. Leave zero if unknown, to skip warm-up.
+}
+
+// TokenBucket is an in-memory Limiter giving each key a bucket of tokens. Each request takes a token, and tokens
+// refill steadily at the plan's average rate, up to its burst size. Unlike FixedWindow, a client can't double their
+// limit by making requests either side of a window boundary, and short bursts can be allowed without raising the
+// average rate.
+//
+// Like FixedWindow, each instance of our API keeps its own buckets, and they're lost on restart. RedisTokenBucket keeps
+// them in Redis instead, sharing them between instances.
+type TokenBucket struct {
+	plans map[string]Plan // Limits for each billing plan, only used if not empty
+	def   Plan            // Limits for everyone not on one of plans
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket holds a single key's tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// NewTokenBucket creates a Limiter applying the default plan to every client, or the matching entry of plans to any
+// client on a billing plan (see AllowClient). Pass nil plans when billing isn't enabled.
+func NewTokenBucket(def Plan, plans map[string]Plan) *TokenBucket {
+	return &TokenBucket{
+		plans:     plans,
+		def:       def,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow implements Limiter, limiting the key under our default plan.
+func (l *TokenBucket) Allow(key string) (bool, time.Duration) {
+	return l.AllowClient(Client{Key: key})
+}
+
+// AllowClient decides whether a request from the client should be allowed, applying the limits of their plan (and
+// warm-up, if their key is new).
+func (l *TokenBucket) AllowClient(c Client) (bool, time.Duration) {
+	now := time.Now()
+	rate, burst := limits(l.def, l.plans, c, now)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	key := bucketKey(c)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		// The client can try again as soon as another token has refilled
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limits returns the rate (in requests per second) and bucket size the client is held to, applying the limits of their
+// plan (and warm-up, if their key is new).
+func limits(def Plan, plans map[string]Plan, c Client, now time.Time) (rate, burst float64) {
+	plan, ok := plans[c.Plan]
+	if !ok {
+		plan = def
+	}
+	rate, burst = plan.rate(), plan.burst()
+	if plan.WarmUp > 0 && !c.Created.IsZero() {
+		if age := now.Sub(c.Created); age < plan.WarmUp {
+			scale := math.Max(warmUpFloor, float64(age)/float64(plan.WarmUp))
+			rate, burst = rate*scale, math.Max(1, burst*scale)
+		}
+	}
+	return rate, burst
+}
+
+// bucketKey identifies the client's bucket. Buckets are keyed by plan too, so a client changing plan starts with a fresh
+// bucket.
+func bucketKey(c Client) string {
+	return c.Plan + "\x00" + c.Key
+}
+
+// sweep throws away buckets that have had time to refill completely, as a fresh bucket would be identical. This keeps
+// memory use bounded by how many clients are currently active. l.mu must be held.
+func (l *TokenBucket) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.def.Window {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		// Once idle for as long as the slowest possible refill, the bucket is certainly full
+		if now.Sub(b.last) > l.longestRefill() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// longestRefill is the longest any bucket can take to refill from empty.
+func (l *TokenBucket) longestRefill() time.Duration {
+	longest := l.def.refill()
+	for _, plan := range l.plans {
+		if refill := plan.refill(); refill > longest {
+			longest = refill
+		}
+	}
+	return longest
+}
+
+// rate is the plan's average rate, in requests per second.
+func (p Plan) rate() float64 {
+	return float64(p.Limit) / p.Window.Seconds()
+}
+
+// burst is the plan's bucket size.
+func (p Plan) burst() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// refill is how long the plan's bucket takes to refill from empty, at the slowest (warm-up) rate.
+func (p Plan) refill() time.Duration {
+	return time.Duration(p.burst() / (p.rate() * warmUpFloor) * float64(time.Second))
+}
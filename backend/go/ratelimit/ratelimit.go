@@ -0,0 +1,58 @@
+// ratelimit limits how many requests a single client may make in a given window of time, protecting our API (and our
+// database behind it) from being overwhelmed by any one caller.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter decides whether a request from the client identified by key should be allowed. When a request is refused,
+// it also reports how long the client should wait before trying again, which we send back as a Retry-After header.
+type Limiter interface {
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+// FixedWindow is a simple in-memory Limiter allowing each key a set number of requests per window. Every key shares the
+// same window, so the whole table can be thrown away at the end of each window, keeping memory use bounded.
+//
+// Since counts are kept in memory, each instance of our API keeps its own counts. That's fine for a single instance,
+// but a shared store (such as Redis) would be needed to enforce limits across several instances.
+type FixedWindow struct {
+	limit  int           // Requests allowed per key per window
+	window time.Duration // Length of each window
+
+	mu     sync.Mutex
+	start  time.Time      // When the current window started
+	counts map[string]int // Requests made by each key in the current window
+}
+
+// NewFixedWindow creates a Limiter allowing limit requests per key every window.
+func NewFixedWindow(limit int, window time.Duration) *FixedWindow {
+	return &FixedWindow{
+		limit:  limit,
+		window: window,
+		start:  time.Now(),
+		counts: make(map[string]int),
+	}
+}
+
+// Allow implements Limiter.
+func (l *FixedWindow) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Start a fresh window if the current one is over
+	now := time.Now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+
+	if l.counts[key] >= l.limit {
+		// The client can try again as soon as the current window ends
+		return false, l.start.Add(l.window).Sub(now)
+	}
+	l.counts[key]++
+	return true, 0
+}
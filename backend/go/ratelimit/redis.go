@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout is how long we'll wait on Redis before limiting the request in memory instead. Redis should answer in
+// well under a millisecond, anything slower than this means it's struggling.
+const redisTimeout = 100 * time.Millisecond
+
+// takeToken refills a bucket for the time since it was last used, then takes a token from it if there's one to take.
+// Doing this in a script makes it atomic, so concurrent requests from several instances can't both take the last token.
+// Time is read from Redis rather than passed in, so instances with slightly different clocks still agree. Buckets expire
+// once they'd have refilled completely, as a fresh bucket would be identical.
+//
+// Returns whether a token was taken, and the tokens left (as a string, as Redis truncates numbers returned by scripts
+// to integers).
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {taken, tostring(tokens)}
+`)
+
+// RedisTokenBucket is a TokenBucket keeping its buckets in Redis, so every instance of our API shares them and they
+// survive restarts. Without this, each instance enforces its own limits (letting a client make several times their
+// limit by spreading requests across instances), and every deploy hands every client a full bucket.
+//
+// If Redis is slow or down, requests are limited by an in-memory TokenBucket instead, so our limits keep working per
+// instance until Redis is back.
+type RedisTokenBucket struct {
+	client   *redis.Client
+	plans    map[string]Plan
+	def      Plan
+	fallback *TokenBucket
+}
+
+// NewRedisTokenBucket creates a Limiter just like NewTokenBucket, keeping its buckets in Redis.
+func NewRedisTokenBucket(client *redis.Client, def Plan, plans map[string]Plan) *RedisTokenBucket {
+	return &RedisTokenBucket{
+		client:   client,
+		plans:    plans,
+		def:      def,
+		fallback: NewTokenBucket(def, plans),
+	}
+}
+
+// Allow implements Limiter, limiting the key under our default plan.
+func (l *RedisTokenBucket) Allow(key string) (bool, time.Duration) {
+	return l.AllowClient(Client{Key: key})
+}
+
+// AllowClient decides whether a request from the client should be allowed, just like TokenBucket.AllowClient.
+func (l *RedisTokenBucket) AllowClient(c Client) (bool, time.Duration) {
+	rate, burst := limits(l.def, l.plans, c, time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	result, err := takeToken.Run(ctx, l.client, []string{"ratelimit:" + bucketKey(c)},
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.FormatFloat(burst, 'f', -1, 64),
+	).Slice()
+	if err != nil || len(result) != 2 {
+		return l.fallback.AllowClient(c)
+	}
+	taken, _ := result[0].(int64)
+	left, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return l.fallback.AllowClient(c)
+	}
+	if taken == 1 {
+		return true, 0
+	}
+	// The client can try again as soon as another token has refilled
+	return false, time.Duration((1 - tokens) / rate * float64(time.Second))
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// recordFailure counts a failure against a key, and blocks it for the delay we work out from the count. The count
+// expires once the key has gone long enough without failing for its failures to be forgotten, and the block once the
+// delay is up, so Redis tidies up after us.
+//
+// KEYS[1] is the count, KEYS[2] the block. ARGV holds our Backoff: free failures, base and max delays (in milliseconds),
+// and how long until failures are forgotten. Returns the delay in milliseconds.
+var recordFailure = redis.NewScript(`
+local free = tonumber(ARGV[1])
+local base = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+
+local count = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+if count <= free then
+	return 0
+end
+local delay = math.min(max, base * 2 ^ (count - free - 1))
+redis.call('SET', KEYS[2], 1, 'PX', math.ceil(delay))
+return math.ceil(delay)
+`)
+
+// RedisThrottle is a Throttle keeping its counts in Redis, so every instance of our API shares them and they survive
+// restarts. Otherwise an attacker could get several times the free failures by spreading attempts across instances.
+//
+// If Redis is slow or down, failures are counted by an in-memory MemoryThrottle instead, so we keep throttling per
+// instance until Redis is back.
+type RedisThrottle struct {
+	client   *redis.Client
+	prefix   string // Keeps this throttle's keys apart from any other's
+	backoff  Backoff
+	fallback *MemoryThrottle
+}
+
+// NewRedisThrottle creates a Throttle just like NewMemoryThrottle, keeping its counts in Redis under the given prefix.
+// Throttles backing off differently (such as by IP address and by account) need different prefixes.
+func NewRedisThrottle(client *redis.Client, prefix string, backoff Backoff) *RedisThrottle {
+	return &RedisThrottle{
+		client:   client,
+		prefix:   "throttle:" + prefix + ":",
+		backoff:  backoff,
+		fallback: NewMemoryThrottle(backoff),
+	}
+}
+
+// Wait implements Throttle.
+func (t *RedisThrottle) Wait(key string) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ttl, err := t.client.PTTL(ctx, t.prefix+"block:"+key).Result()
+	if err != nil {
+		return t.fallback.Wait(key)
+	}
+	// Missing keys report a negative TTL, as do keys without an expiry (which we never set)
+	return max(0, ttl, t.fallback.Wait(key))
+}
+
+// Fail implements Throttle.
+func (t *RedisThrottle) Fail(key string) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	delay, err := recordFailure.Run(ctx, t.client, []string{t.prefix + "count:" + key, t.prefix + "block:" + key},
+		t.backoff.Free,
+		t.backoff.Base.Milliseconds(),
+		t.backoff.Max.Milliseconds(),
+		t.backoff.forget().Milliseconds(),
+	).Int64()
+	if err != nil {
+		return t.fallback.Fail(key)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// Reset implements Throttle.
+func (t *RedisThrottle) Reset(key string) {
+	t.fallback.Reset(key)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// Failing to reset only means waiting out the failures, not worth failing the caller over
+	t.client.Del(ctx, t.prefix+"count:"+key, t.prefix+"block:"+key)
+}
@@ -0,0 +1,13 @@
+//go:build !dev
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// recordRequests is unavailable outside dev builds, see record_dev.go.
+func recordRequests(dir string) (func(http.Handler) http.Handler, error) {
+	return nil, errors.New("request recording is only available in dev builds, build with -tags dev")
+}
@@ -0,0 +1,14 @@
+//go:build dev
+
+package main
+
+import (
+	"examples/recorder"
+	"net/http"
+)
+
+// recordRequests returns middleware recording every request to dir, for replaying later with cmd/replay. Recording is
+// only built into dev builds (go build -tags dev), so it can never be switched on in production by accident.
+func recordRequests(dir string) (func(http.Handler) http.Handler, error) {
+	return recorder.Middleware(dir)
+}
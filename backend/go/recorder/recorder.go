@@ -0,0 +1,188 @@
+// recorder saves requests and their responses to disk, and reads them back again, so a bug seen in the wild can be
+// reproduced by replaying the exact requests that caused it against a local instance (see cmd/replay).
+//
+// Recordings are sanitized before they're written: credentials (Authorization headers, cookies) are dropped, and any
+// JSON field that looks secret (passwords, tokens) is redacted. Even so, recordings contain user data such as emails,
+// so treat them with the same care as a database dump.
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"examples/clock"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxBody is the most of each request and response body we keep, anything beyond this is cut off
+const maxBody = 64 << 10
+
+// redacted replaces anything we won't write to disk
+const redacted = "[REDACTED]"
+
+// droppedHeaders are never recorded, as they carry credentials
+var droppedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// secretFields are redacted from JSON bodies, matched case insensitively against any part of the field name
+var secretFields = []string{"password", "token", "secret"}
+
+// Record is a single recorded request, along with the response we sent.
+type Record struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"` // Path and query, such as /users/?page=2
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body,omitempty"`
+	Response Response    `json:"response"`
+}
+
+// Response is the response we sent to a recorded request.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Middleware records every request passing through it, writing each to its own JSON file in dir. Files are named by
+// the time and a sequence number, so listing the directory gives them back in the order they arrived.
+func Middleware(dir string) (func(http.Handler) http.Handler, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	var seq atomic.Uint64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Read the body so we can record it, then hand the handler an identical copy
+			body, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			record := Record{
+				Time:   clock.Now(),
+				Method: r.Method,
+				URL:    r.URL.RequestURI(),
+				Header: SanitizeHeader(r.Header),
+				Body:   SanitizeBody(body),
+				Response: Response{
+					Status: rec.status,
+					Header: SanitizeHeader(w.Header()),
+					Body:   SanitizeBody(rec.body.Bytes()),
+				},
+			}
+			name := fmt.Sprintf("%s-%06d.json", record.Time.UTC().Format("20060102T150405.000"), seq.Add(1))
+			// Recording is a debugging aid, so failing to save a recording never fails the request
+			if b, err := json.MarshalIndent(record, "", "  "); err == nil {
+				os.WriteFile(filepath.Join(dir, name), b, 0o600)
+			}
+		})
+	}, nil
+}
+
+// Load reads every recording in dir, in the order they were recorded.
+func Load(dir string) ([]Record, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(names))
+	// Glob returns names sorted, and our names sort in the order they were recorded
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var record Record
+		if err := json.Unmarshal(b, &record); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// recordingWriter wraps a http.ResponseWriter, keeping a copy of the status and (up to maxBody of) the body written.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status code before passing it on.
+func (w *recordingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write keeps a copy of the body before passing it on.
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if room := maxBody - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// SanitizeHeader returns a copy of the header without any credentials. Our traffic mirror (see the mirror package)
+// sanitizes requests the same way before sending them on.
+func SanitizeHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range droppedHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// SanitizeBody returns the body as a string, with secret fields redacted if it's JSON. Bodies that aren't JSON are kept
+// as they are, cut off at maxBody.
+func SanitizeBody(body []byte) string {
+	if len(body) > maxBody {
+		body = body[:maxBody]
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	b, err := json.Marshal(redact(v))
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// redact replaces the value of any secret looking field, anywhere in a decoded JSON value.
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if secret(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	}
+	return v
+}
+
+// secret reports whether a JSON field name looks like it holds a secret.
+func secret(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range secretFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/config"
+	"examples/database"
+	"examples/errs"
+	"net/http"
+	"time"
+)
+
+// Refresh tokens let a client swap its short lived access token (a session, or a signed token) for a new one without
+// logging in again. Each refresh token can only be used once, using it returns a replacement alongside the new access
+// token. Every refresh token descended from the same login belongs to one family, so if a refresh token is ever used a
+// second time (meaning someone else has a copy of it) we revoke the whole family, logging out both the thief and the
+// User, who can simply log in again.
+const (
+	// refreshCookie is the name of the cookie holding the refresh token, when sessions are delivered by cookie
+	refreshCookie = "refresh"
+	// refreshPath is where refresh tokens are used, the refresh cookie is only ever sent to this path
+	refreshPath = "/token/refresh"
+	// refreshTokenLifetime is how long a login can be kept going with refresh tokens, unless the User asked to be
+	// remembered (then it's our remembered session lifetime). Rotating a refresh token doesn't extend this, once it's up
+	// the User needs to log in again.
+	refreshTokenLifetime = 14 * 24 * time.Hour
+)
+
+// refreshRequest is the body expected by the refresh endpoint, when sessions are delivered by header.
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// createRefreshToken starts a family of refresh tokens for a User who has just logged in, returning the first token
+// along with its record.
+func (s *server) createRefreshToken(r *http.Request, userID int64, family string, remember bool) (string, database.RefreshToken, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", database.RefreshToken{}, errs.Wrap(err, "createRefreshToken")
+	}
+	lifetime := refreshTokenLifetime
+	if remember {
+		// Remembered logins last as long as the User's remembered sessions may
+		if _, lifetime, err = s.sessionLifespans(userID, true); err != nil {
+			return "", database.RefreshToken{}, errs.WithUser(err, userID)
+		}
+	}
+	in := database.RefreshToken{
+		TokenHash: hash,
+		FamilyID:  family,
+		UserID:    userID,
+		Expires:   clock.Now().Add(lifetime),
+		Remember:  remember,
+	}
+	if err := s.unscoped(r).CreateRefreshToken(&in); err != nil {
+		return "", database.RefreshToken{}, errs.WithUser(err, userID)
+	}
+	return token, in, nil
+}
+
+// issueTokens creates a new access token for a User, belonging to the family of the refresh token they were just given
+// (current), and hands it to the client along with the refresh token itself. The kind of access token depends on our
+// session mode.
+func (s *server) issueTokens(w http.ResponseWriter, r *http.Request, user database.User, refresh string, current database.RefreshToken) {
+	if s.sessionMode == config.SessionModeJWT {
+		signed, expires, err := s.tokens.Issue(user.ID, user.Email, current.FamilyID)
+		if err != nil {
+			s.writeError(w, r, errs.Wrap(err, "issueTokens"))
+			return
+		}
+		// Tokens aren't renewed as they're used, so a token's expiry is also its end of life
+		s.deliverTokens(w, r, signed, refresh, loginResponse{
+			Expires:        expires,
+			EndOfLife:      expires,
+			RefreshExpires: current.Expires,
+			Remember:       current.Remember,
+		})
+		return
+	}
+
+	session, token, err := s.createSession(r, user, current)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.deliverTokens(w, r, token, refresh, loginResponse{
+		Expires:        session.Expires,
+		EndOfLife:      session.EndOfLife,
+		RefreshExpires: current.Expires,
+		Remember:       current.Remember,
+	})
+}
+
+// refreshToken swaps a refresh token for a new access token and a new refresh token, responding just like login. The
+// refresh token is read from our refresh cookie when sessions are delivered by cookie, otherwise from the request body.
+func (s *server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if s.sessionTransport == config.TransportCookie {
+		if cookie, err := r.Cookie(refreshCookie); err == nil {
+			token = cookie.Value
+		}
+	} else {
+		var req refreshRequest
+		if err := decodeJSON(r, &req); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		token = req.RefreshToken
+	}
+	if token == "" {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "refresh token is required"))
+		return
+	}
+
+	next, hash, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "refreshToken"))
+		return
+	}
+	rotated, err := s.unscoped(r).RotateRefreshToken(hashToken(token), hash)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		// Someone has used this token before, so either this request or the earlier one came from someone who copied it.
+		// We can't tell which, so we end every session in the family.
+		if err := s.revokeRefreshFamily(r, rotated.FamilyID); err != nil {
+			s.writeError(w, r, errs.WithUser(err, rotated.UserID))
+			return
+		}
+		s.audit(r, "token.refresh_reused", rotated.UserID, "revoked refresh token family")
+		s.securityEvent(r, eventRefreshTokenReused, rotated.UserID, "revoked refresh token family")
+		s.writeError(w, r, errs.New(errs.Unauthorized, "refresh token has already been used"))
+		return
+	}
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "invalid or expired refresh token"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// Users who have been disabled or deleted since logging in can't refresh their way back in
+	user, err := s.activeUser(r, rotated.UserID)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.issueTokens(w, r, user, next, rotated)
+}
+
+// revokeRefreshFamily revokes a family of refresh tokens, along with every session created from it.
+func (s *server) revokeRefreshFamily(r *http.Request, family string) error {
+	_, err := s.unscoped(r).RevokeRefreshFamily(family)
+	return err
+}
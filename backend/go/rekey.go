@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/database"
+)
+
+// rekeyBatchSize is how many sessions rekeySessions loads at a time.
+const rekeyBatchSize = 500
+
+// rekeySessions is a background task that re-encrypts the credentials of any session still using an old key with our
+// newest one (see registerTasks). Once a run completes without finding any, the old keys are no longer needed and can be
+// removed from SESSION_OLD_KEYS, without logging anyone out. Sessions whose credentials can't be decrypted at all are
+// left alone, they're already refused by our auth middleware and will be cleared once they expire.
+func (s *server) rekeySessions(ctx context.Context) error {
+	var afterID int64
+	var rekeyed, undecryptable int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sessions, err := s.db.ListSessionsAfter(afterID, rekeyBatchSize)
+		if err != nil {
+			s.logger.Printf("ERROR: Unable to list sessions to re-encrypt: %v", err)
+			return err
+		}
+		for _, session := range sessions {
+			afterID = session.ID
+			resealed, changed, err := s.encrypter.Reseal(session.EncryptedCreds)
+			if err != nil {
+				undecryptable++
+				continue
+			}
+			if !changed {
+				continue
+			}
+			err = s.db.UpdateSessionCreds(session.ID, resealed)
+			if errors.Is(err, database.ErrNotFound) {
+				// Logged out since we listed it
+				continue
+			}
+			if err != nil {
+				s.logger.Printf("ERROR: Unable to re-encrypt session %d: %v", session.ID, err)
+				return err
+			}
+			rekeyed++
+		}
+		if len(sessions) < rekeyBatchSize {
+			break
+		}
+	}
+	s.logger.Printf("INFO: Re-encrypted %d sessions with the newest key, %d sessions couldn't be decrypted", rekeyed, undecryptable)
+	return nil
+}
@@ -0,0 +1,117 @@
+// requestctx stores and retrieves the values our middleware works out about a request (who is logged in, which session
+// they're using, the request's ID, etc) in the request's context. This is the single contract between our middleware
+// and our handlers: middleware sets these once, and handlers read them rather than re-parsing headers or reloading
+// records themselves.
+package requestctx
+
+import (
+	"context"
+	"examples/database"
+	"examples/database/instrumented"
+)
+
+// key is a private type for our context keys, so they can never clash with keys set by any other package
+type key int
+
+// Keys for each value we store
+const (
+	userKey key = iota
+	sessionKey
+	requestIDKey
+	tenantKey
+	queryCounterKey
+	apiTokenKey
+	replayKey
+)
+
+// WithUser returns a copy of ctx carrying the authenticated user.
+func WithUser(ctx context.Context, user database.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// User returns the authenticated user, if there is one. This is only set for requests that passed our auth middleware.
+func User(ctx context.Context) (database.User, bool) {
+	user, ok := ctx.Value(userKey).(database.User)
+	return user, ok
+}
+
+// WithSession returns a copy of ctx carrying the session the request was authenticated with.
+func WithSession(ctx context.Context, session database.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session the request was authenticated with, if there is one.
+func Session(ctx context.Context) (database.Session, bool) {
+	session, ok := ctx.Value(sessionKey).(database.Session)
+	return session, ok
+}
+
+// WithAPIToken returns a copy of ctx carrying the API token the request was authenticated with.
+func WithAPIToken(ctx context.Context, token database.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// APIToken returns the API token the request was authenticated with, if there is one. Requests authenticated with a
+// session (or a JWT) don't have one.
+func APIToken(ctx context.Context) (database.APIToken, bool) {
+	token, ok := ctx.Value(apiTokenKey).(database.APIToken)
+	return token, ok
+}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID of the request, or an empty string if it doesn't have one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithTenant returns a copy of ctx carrying the ID of the tenant (e.g. the dealership) the request is acting within.
+func WithTenant(ctx context.Context, tenantID int64) context.Context {
+	return context.WithValue(ctx, tenantKey, tenantID)
+}
+
+// Tenant returns the ID of the tenant the request is acting within, if there is one.
+func Tenant(ctx context.Context) (int64, bool) {
+	tenantID, ok := ctx.Value(tenantKey).(int64)
+	return tenantID, ok
+}
+
+// WithQueryCounter returns a copy of ctx carrying the counter for database calls made while handling the request.
+func WithQueryCounter(ctx context.Context, counter *instrumented.Counter) context.Context {
+	return context.WithValue(ctx, queryCounterKey, counter)
+}
+
+// QueryCounter returns the counter for database calls made while handling the request, if there is one.
+func QueryCounter(ctx context.Context) (*instrumented.Counter, bool) {
+	counter, ok := ctx.Value(queryCounterKey).(*instrumented.Counter)
+	return counter, ok
+}
+
+// Replay describes a request we queued earlier that is being replayed. The credentials it was sent with aren't kept
+// while it's queued, only the hash of its token, which our auth middleware loads its session (or API token) by again.
+type Replay struct {
+	TokenHash []byte // Empty for requests queued before we stopped keeping their credentials, which still have them
+	APIToken  bool   // Whether TokenHash is an API token's, rather than a session's
+}
+
+// WithReplay returns a copy of ctx marking the request as a replay of one we queued earlier, rather than one a client
+// has just sent.
+func WithReplay(ctx context.Context, replay Replay) context.Context {
+	return context.WithValue(ctx, replayKey, replay)
+}
+
+// Replayed reports whether the request is a replay of one we queued earlier (see WithReplay).
+func Replayed(ctx context.Context) bool {
+	_, replayed := ReplayOf(ctx)
+	return replayed
+}
+
+// ReplayOf returns what we know of a replayed request (see WithReplay), if it is one.
+func ReplayOf(ctx context.Context) (Replay, bool) {
+	replay, ok := ctx.Value(replayKey).(Replay)
+	return replay, ok
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"examples/errorlog"
+	"examples/errs"
+	"examples/jsonschema"
+	"examples/requestctx"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// errorResponse is the body we send back whenever a request fails, so a frontend can always handle errors the same way.
+type errorResponse struct {
+	Error struct {
+		Code    errs.Code `json:"code"`    // Machine readable, one of the codes from the errs package
+		Message string    `json:"message"` // Human readable, safe to show to a user
+		// Where a request body didn't match its schema, every way it didn't (see validateSchemas)
+		Violations []jsonschema.Violation `json:"violations,omitempty"`
+	} `json:"error"`
+}
+
+// writeJSON encodes v as the JSON response body with the given status code, shaped for the API version the client
+// asked for (see versions.go).
+func (s *server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	// Encode before sending anything, so a response we can't encode (such as a database.User that was never mapped to a
+	// response type) becomes an error rather than a success with half a body
+	body, err := json.Marshal(forVersion(v, requestedVersion(r)))
+	if err != nil {
+		s.logger.Printf("ERROR: [%s] Unable to encode response to %s %s: %v", requestctx.RequestID(r.Context()), r.Method, r.URL.Path, err)
+		var resp errorResponse
+		resp.Error.Code = errs.Internal
+		resp.Error.Message = http.StatusText(http.StatusInternalServerError)
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(resp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// maxBodySize limits how large a request body we're willing to read, so a client can't exhaust our memory
+const maxBodySize = 1 << 20 // 1MB
+
+// decodeJSON reads the JSON request body into v, returning an Invalid error if the body isn't what we expect.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	// Rejecting unknown fields catches typos in field names, which would otherwise be silently ignored
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &errs.Error{Code: errs.Invalid, Message: "invalid request body", Err: err}
+	}
+	return nil
+}
+
+// writeError responds with the status code and message matching the error's Code. The full error (including any
+// underlying cause) is only ever logged, never sent to the caller.
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errs.CodeOf(err)
+	status := errs.HTTPStatus(code)
+	// Server side errors are worth logging, client errors are part of normal operation. So is turning requests away on
+	// purpose (e.g. during maintenance), which we can spot as an Unavailable error with no underlying cause.
+	deliberate := code == errs.Unavailable && errors.Unwrap(err) == nil
+	if status >= http.StatusInternalServerError && !deliberate {
+		s.logger.Printf("ERROR: [%s] %s %s: %v", requestctx.RequestID(r.Context()), r.Method, r.URL.Path, err)
+		s.recordError(r, err)
+	}
+
+	// Let the caller know when it is worth trying again, well behaved clients will wait at least this long
+	if retry := errs.RetryAfterOf(err); retry > 0 {
+		setRetryAfter(w, retry)
+	}
+
+	var resp errorResponse
+	resp.Error.Code = code
+	resp.Error.Message = errs.MessageOf(err)
+	var invalid *jsonschema.ValidationError
+	if errors.As(err, &invalid) {
+		resp.Error.Violations = invalid.Violations
+	}
+	s.writeJSON(w, r, status, resp)
+}
+
+// setRetryAfter sets the Retry-After header. The header is in whole seconds, so we round up to make sure a client
+// waiting exactly that long won't be turned away again.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// recordError keeps the error in our recent errors ring, for our admin errors endpoint.
+func (s *server) recordError(r *http.Request, err error) {
+	if s.errorLog == nil {
+		return
+	}
+	rec := errorlog.Record{
+		RequestID: requestctx.RequestID(r.Context()),
+		Method:    r.Method,
+		Route:     r.URL.Path,
+		Code:      string(errs.CodeOf(err)),
+		Error:     err.Error(),
+	}
+	// Prefer the route template, it keeps usernames and tokens out of the ring
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			rec.Route = template
+		}
+	}
+	var e *errs.Error
+	if errors.As(err, &e) {
+		rec.Op, rec.UserID = e.Op, e.UserID
+	}
+	// Leave ourselves and writeError out of the stack, it should start with whoever hit the error
+	s.errorLog.Add(rec, 2)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/metrics"
+	"fmt"
+	"time"
+)
+
+// retentionPolicy describes how long we keep one kind of record. Adding a policy for a new table is a matter of adding
+// a Purge method for it to our Storer, and an entry to retentionPolicies.
+type retentionPolicy struct {
+	name   string        // Used in our logs and metrics, such as "audit_log"
+	maxAge time.Duration // Records older than this are purged, 0 keeps them forever
+	// purge deletes records from before the given time (or only counts them, in a dry run), returning how many
+	purge func(before time.Time, dryRun bool) (int, error)
+}
+
+// retentionPolicies lists every retention policy we enforce.
+func (s *server) retentionPolicies() []retentionPolicy {
+	return []retentionPolicy{
+		{name: "audit_log", maxAge: s.retention.AuditLog, purge: s.db.PurgeAuditEntries},
+		{name: "email_changes", maxAge: s.retention.EmailChanges, purge: s.db.PurgeEmailChanges},
+	}
+}
+
+// enforceRetention is a background task that purges old records according to our retention policies (see
+// registerTasks). Every policy is applied even if an earlier one fails, the task fails if any of them did.
+//
+// Turn on dry run mode when introducing or shortening a policy, to check how much it would purge before anything is
+// actually deleted.
+func (s *server) enforceRetention(ctx context.Context) error {
+	var failed []error
+	for _, policy := range s.retentionPolicies() {
+		if policy.maxAge <= 0 {
+			continue
+		}
+		if err := s.applyRetention(policy, time.Now()); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// applyRetention runs a single retention policy, recording metrics and logging the outcome.
+func (s *server) applyRetention(policy retentionPolicy, now time.Time) error {
+	start := time.Now()
+	count, err := policy.purge(now.Add(-policy.maxAge), s.retention.DryRun)
+	metrics.ObserveJob("retention_"+policy.name, time.Since(start), err)
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to apply %s retention policy: %v", policy.name, err)
+		return fmt.Errorf("%s: %w", policy.name, err)
+	}
+	metrics.ObservePurge(policy.name, count, s.retention.DryRun)
+	if s.retention.DryRun {
+		s.logger.Printf("INFO: Dry run, %s retention policy would purge %d records older than %s", policy.name, count, policy.maxAge)
+		return nil
+	}
+	s.logger.Printf("INFO: Purged %d %s records older than %s", count, policy.name, policy.maxAge)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"examples/clock"
+	"examples/errs"
+	"examples/tracing"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSamplingOverride is the longest a sampling override may last before our configured rates apply again. Tracing
+// everything is for looking into a problem, and shouldn't be forgotten about.
+const maxSamplingOverride = 24 * time.Hour
+
+// samplingResponse lists the rates our requests are traced at, by group of routes.
+type samplingResponse struct {
+	Default   float64                             `json:"default"`   // For groups without a rate of their own
+	Groups    map[string]float64                  `json:"groups"`    // Configured rates
+	Overrides map[string]samplingOverrideResponse `json:"overrides"` // Replacing configured rates for now
+}
+
+// samplingOverrideResponse describes a rate set while we're running.
+type samplingOverrideResponse struct {
+	Rate    float64    `json:"rate"`
+	Expires *time.Time `json:"expires,omitempty"` // Missing if it lasts until it's removed
+}
+
+// samplingOverrideRequest is the body expected when overriding a group's sampling rate.
+type samplingOverrideRequest struct {
+	Rate             float64 `json:"rate"`                       // Between 0 (nothing) and 1 (every request)
+	ExpiresInMinutes int     `json:"expiresInMinutes,omitempty"` // Defaults to lasting until removed, up to a day
+}
+
+// newSamplingResponse describes a Sampler's rates for clients.
+func newSamplingResponse(rates tracing.Rates) samplingResponse {
+	resp := samplingResponse{
+		Default:   rates.Default,
+		Groups:    rates.Groups,
+		Overrides: make(map[string]samplingOverrideResponse, len(rates.Overrides)),
+	}
+	for group, o := range rates.Overrides {
+		override := samplingOverrideResponse{Rate: o.Rate}
+		if !o.Expires.IsZero() {
+			override.Expires = &o.Expires
+		}
+		resp.Overrides[group] = override
+	}
+	return resp
+}
+
+// requireTracing returns an error if tracing is disabled, as there are no rates to show or change.
+func (s *server) requireTracing() error {
+	if s.sampler == nil {
+		return errs.New(errs.Invalid, "tracing is disabled, set OTEL_EXPORTER_OTLP_ENDPOINT to enable it")
+	}
+	return nil
+}
+
+// showSampling lists the rates our requests are traced at.
+func (s *server) showSampling(w http.ResponseWriter, r *http.Request) {
+	if err := s.requireTracing(); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, newSamplingResponse(s.sampler.Rates()))
+}
+
+// overrideSampling changes the rate the group of routes in the {group} path parameter is traced at (or "default" for
+// every group without its own rate), such as tracing every request to a route that's misbehaving. Overrides only last
+// until we restart, as they're for the moment rather than something to keep.
+func (s *server) overrideSampling(w http.ResponseWriter, r *http.Request) {
+	if err := s.requireTracing(); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var req samplingOverrideRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if req.Rate < 0 || req.Rate > 1 {
+		s.writeError(w, r, errs.New(errs.Invalid, "rate must be between 0 and 1"))
+		return
+	}
+	lasts := time.Duration(req.ExpiresInMinutes) * time.Minute
+	if lasts < 0 || lasts > maxSamplingOverride {
+		s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("expiresInMinutes must be between 1 and %d", int(maxSamplingOverride.Minutes()))))
+		return
+	}
+	group := mux.Vars(r)["group"]
+	detail := fmt.Sprintf("group %s rate %g", group, req.Rate)
+	var expires time.Time
+	if lasts > 0 {
+		expires = clock.Now().Add(lasts)
+		detail += " for " + lasts.String()
+	}
+	s.sampler.Override(group, req.Rate, expires)
+	s.audit(r, "tracing.sampling_override", 0, detail)
+	s.writeJSON(w, r, http.StatusOK, newSamplingResponse(s.sampler.Rates()))
+}
+
+// removeSamplingOverride goes back to tracing the group of routes in the {group} path parameter at its configured rate.
+func (s *server) removeSamplingOverride(w http.ResponseWriter, r *http.Request) {
+	if err := s.requireTracing(); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	group := mux.Vars(r)["group"]
+	if !s.sampler.RemoveOverride(group) {
+		s.writeError(w, r, errs.New(errs.NotFound, "that group's sampling rate isn't overridden"))
+		return
+	}
+	s.audit(r, "tracing.sampling_reset", 0, fmt.Sprintf("group %s", group))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"examples/errs"
+	"examples/jsonschema"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// routeSchema names the schemas (from schemaTypes) a route's request and response bodies should match.
+type routeSchema struct {
+	request   string         // Schema for the request body, empty if the route doesn't take one
+	responses map[int]string // Schema for the response body by status code, error responses always use "error"
+}
+
+// routeSchemas lists the schemas for every route with a JSON body. Add new routes here as they're created, alongside
+// their types in schemaTypes, and routes() will check every schema named here exists.
+var routeSchemas = map[routeKey]routeSchema{
+	{http.MethodPost, "/login/"}: {
+		request:   "login-request",
+		responses: map[int]string{http.StatusOK: "login-response", http.StatusAccepted: "2fa-challenge"},
+	},
+	{http.MethodPost, "/login/2fa"}: {
+		request:   "2fa-login",
+		responses: map[int]string{http.StatusOK: "login-response"},
+	},
+	{http.MethodPost, "/login/magic"}: {
+		request: "magic-link",
+	},
+	{http.MethodPost, "/login/magic/{token}"}: {
+		responses: map[int]string{http.StatusOK: "login-response", http.StatusAccepted: "2fa-challenge"},
+	},
+	{http.MethodPost, refreshPath}: {
+		request:   "refresh",
+		responses: map[int]string{http.StatusOK: "login-response"},
+	},
+	{http.MethodGet, "/users/"}: {
+		responses: map[int]string{http.StatusOK: "user"},
+	},
+	{http.MethodPut, "/users/{username}"}: {
+		request:   "user-update",
+		responses: map[int]string{http.StatusOK: "user"},
+	},
+	{http.MethodPut, "/users/{username}/email"}: {
+		request: "email-change",
+	},
+	{http.MethodPost, "/users/{username}/email"}: {
+		request: "install-links",
+	},
+	{http.MethodPut, "/users/{username}/username"}: {
+		request:   "username",
+		responses: map[int]string{http.StatusOK: "user"},
+	},
+	{http.MethodGet, "/users/{username}/username"}: {
+		responses: map[int]string{http.StatusOK: "username-history"},
+	},
+	{http.MethodPost, "/users/{username}/2fa"}: {
+		responses: map[int]string{http.StatusOK: "2fa-enroll"},
+	},
+	{http.MethodPut, "/users/{username}/2fa"}: {
+		request:   "2fa-code",
+		responses: map[int]string{http.StatusOK: "2fa-enabled"},
+	},
+	{http.MethodDelete, "/users/{username}/2fa"}: {
+		request: "2fa-code",
+	},
+	{http.MethodGet, "/csrf/"}: {
+		responses: map[int]string{http.StatusOK: "csrf"},
+	},
+	{http.MethodGet, "/sessions/"}: {
+		responses: map[int]string{http.StatusOK: "sessions"},
+	},
+	{http.MethodPut, "/users/password"}: {
+		request: "password-change",
+	},
+	{http.MethodPost, "/password/reset/{token}"}: {
+		request: "password-reset",
+	},
+	{http.MethodPost, "/users/{username}/impersonate"}: {
+		responses: map[int]string{http.StatusCreated: "impersonation"},
+	},
+	{http.MethodGet, "/users/all"}: {
+		responses: map[int]string{http.StatusOK: "users-page"},
+	},
+	{http.MethodGet, "/users/search/{name}"}: {
+		responses: map[int]string{http.StatusOK: "users"},
+	},
+	{http.MethodPost, "/invites/"}: {
+		request:   "invite-create",
+		responses: map[int]string{http.StatusCreated: "invite"},
+	},
+	{http.MethodGet, "/invites/"}: {
+		responses: map[int]string{http.StatusOK: "invites"},
+	},
+	{http.MethodPost, "/users/self/tokens"}: {
+		request:   "api-token-create",
+		responses: map[int]string{http.StatusCreated: "api-token"},
+	},
+	{http.MethodGet, "/users/self/tokens"}: {
+		responses: map[int]string{http.StatusOK: "api-tokens"},
+	},
+	{http.MethodPost, "/register/{token}"}: {
+		request:   "register",
+		responses: map[int]string{http.StatusCreated: "user"},
+	},
+	{http.MethodGet, "/changelog/"}: {
+		responses: map[int]string{http.StatusOK: "changelog"},
+	},
+	{http.MethodGet, "/availability"}: {
+		responses: map[int]string{http.StatusOK: "availability"},
+	},
+
+	// Admin routes, see adminRoutes
+	{http.MethodPost, "/admin/users/"}: {
+		request:   "user-add",
+		responses: map[int]string{http.StatusCreated: "user"},
+	},
+	{http.MethodDelete, "/admin/users/{username}"}: {
+		responses: map[int]string{http.StatusAccepted: "deletion"},
+	},
+	{http.MethodGet, "/admin/deletions/{id}"}: {
+		responses: map[int]string{http.StatusOK: "deletion"},
+	},
+	{http.MethodGet, "/admin/events"}: {
+		responses: map[int]string{http.StatusOK: "domain-events"},
+	},
+	{http.MethodPost, "/admin/sessions/revoke"}: {
+		request:   "session-revoke",
+		responses: map[int]string{http.StatusOK: "session-revoked"},
+	},
+	{http.MethodGet, "/admin/tasks"}: {
+		responses: map[int]string{http.StatusOK: "tasks"},
+	},
+	{http.MethodGet, "/admin/security-events/verify"}: {
+		responses: map[int]string{http.StatusOK: "security-chain"},
+	},
+	{http.MethodGet, "/admin/metrics/logins"}: {
+		responses: map[int]string{http.StatusOK: "login-stats"},
+	},
+	{http.MethodGet, "/admin/tenants/"}: {
+		responses: map[int]string{http.StatusOK: "tenant-settings-list"},
+	},
+	{http.MethodGet, "/admin/tenants/{id}"}: {
+		responses: map[int]string{http.StatusOK: "tenant-settings"},
+	},
+	{http.MethodPut, "/admin/tenants/{id}"}: {
+		request:   "tenant-settings-request",
+		responses: map[int]string{http.StatusOK: "tenant-settings"},
+	},
+	{http.MethodGet, "/admin/tracing/sampling"}: {
+		responses: map[int]string{http.StatusOK: "sampling"},
+	},
+	{http.MethodPut, "/admin/tracing/sampling/{group}"}: {
+		request:   "sampling-override",
+		responses: map[int]string{http.StatusOK: "sampling"},
+	},
+}
+
+// checkRouteSchemas returns an error listing any schema named in routeSchemas that isn't in schemaTypes.
+func checkRouteSchemas() error {
+	var missing []string
+	for key, rs := range routeSchemas {
+		names := []string{rs.request}
+		for _, name := range rs.responses {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if _, ok := schemaTypes[name]; name != "" && !ok {
+				missing = append(missing, fmt.Sprintf("%s %s: %s", key.method, key.path, name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("routes using unknown schemas: %v", missing)
+	}
+	return nil
+}
+
+// generatedSchemas keeps each schema schemaFor has generated, by name. Generating one walks its type by reflection,
+// which is worth doing only once rather than for every request we validate.
+var generatedSchemas sync.Map
+
+// schemaFor returns the schema with the given name, generating it the first time it's needed. The schema returned is
+// shared, so mustn't be changed.
+func schemaFor(name string) jsonschema.Schema {
+	if schema, ok := generatedSchemas.Load(name); ok {
+		return schema.(jsonschema.Schema)
+	}
+	schema, _ := generatedSchemas.LoadOrStore(name, jsonschema.For("/schemas/"+name+".json", schemaTypes[name]))
+	return schema.(jsonschema.Schema)
+}
+
+// validateSchemas checks request bodies against the schema for their route, rejecting any that don't match with a 400
+// listing where each problem is (as a JSON Pointer), before they reach a handler. Our schemas are public, so checking
+// them before a request is authenticated gives nothing away. Requests without a body are left for the handler to deal
+// with, as some routes only need one some of the time.
+//
+// In dev builds (go build -tags dev) responses are checked against their schemas too, and any that don't match are
+// replaced with a 500 listing the problems. A handler drifting from the schemas we publish then shows up the first time
+// it's exercised, rather than when a frontend trips over it.
+func (s *server) validateSchemas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Middleware on a mux router runs after the route is matched, so we can find which route this is
+		current := mux.CurrentRoute(r)
+		if current == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := current.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rs, ok := routeSchemas[routeKey{r.Method, path}]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rs.request != "" && r.Body != nil {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+			if err != nil {
+				s.writeError(w, r, &errs.Error{Code: errs.Invalid, Message: "invalid request body", Err: err})
+				return
+			}
+			if len(bytes.TrimSpace(body)) > 0 {
+				if err := jsonschema.Validate(schemaFor(rs.request), body); err != nil {
+					s.writeError(w, r, &errs.Error{Code: errs.Invalid, Message: "request body doesn't match its schema", Err: err})
+					return
+				}
+			}
+			// Put the body back for the handler to decode
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		if !checkResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		buf := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+		s.checkResponse(w, r, rs, buf)
+	})
+}
+
+// checkResponse validates a buffered response against its schema, then sends it on, or sends a 500 in its place if it
+// doesn't match.
+func (s *server) checkResponse(w http.ResponseWriter, r *http.Request, rs routeSchema, buf *bufferedWriter) {
+	name := rs.responses[buf.status]
+	if buf.status >= http.StatusBadRequest {
+		name = "error"
+	}
+	isJSON := strings.HasPrefix(buf.header.Get("Content-Type"), "application/json")
+	if name != "" && isJSON {
+		if err := jsonschema.Validate(schemaFor(name), buf.body.Bytes()); err != nil {
+			s.writeError(w, r, &errs.Error{
+				Code:    errs.Internal,
+				Message: "response doesn't match its schema",
+				Err:     fmt.Errorf("%d response doesn't match %q: %w", buf.status, name, err),
+			})
+			return
+		}
+	} else if name != "" || (isJSON && buf.body.Len() > 0) {
+		// A response we have a schema for that isn't JSON, or JSON we don't have a schema for, is drift too
+		s.writeError(w, r, &errs.Error{
+			Code:    errs.Internal,
+			Message: "response doesn't match its schema",
+			Err:     fmt.Errorf("%d response has no schema, or isn't JSON", buf.status),
+		})
+		return
+	}
+	buf.sendTo(w)
+}
+
+// bufferedWriter holds on to a response, so it can be checked before being sent.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header         { return w.header }
+func (w *bufferedWriter) WriteHeader(status int)      { w.status = status }
+func (w *bufferedWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+
+// sendTo sends the buffered response on to the client.
+func (w *bufferedWriter) sendTo(client http.ResponseWriter) {
+	for key, values := range w.header {
+		client.Header()[key] = values
+	}
+	client.WriteHeader(w.status)
+	client.Write(w.body.Bytes())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"examples/errs"
+	"examples/jsonschema"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// schemaTypes lists every request and response type we publish a JSON Schema for, by the name it's published under. Add
+// new request and response types here as they're created.
+var schemaTypes = map[string]any{
+	"error":                   errorResponse{},
+	"changelog":               changelogResponse{},
+	"availability":            availabilityResponse{},
+	"login-request":           loginRequest{},
+	"login-response":          loginResponse{},
+	"refresh":                 refreshRequest{},
+	"2fa-login":               twoFactorLoginRequest{},
+	"magic-link":              magicLinkRequest{},
+	"2fa-challenge":           twoFactorChallengeResponse{},
+	"2fa-enroll":              twoFactorEnrollResponse{},
+	"2fa-code":                twoFactorCodeRequest{},
+	"2fa-enabled":             twoFactorEnabledResponse{},
+	"csrf":                    csrfResponse{},
+	"email-change":            emailChangeRequest{},
+	"password-change":         passwordChangeRequest{},
+	"password-reset":          passwordResetRequest{},
+	"install-links":           installLinksRequest{},
+	"user":                    userResponse{},
+	"user-add":                userAddRequest{},
+	"user-update":             userUpdateRequest{},
+	"users-page":              usersPageResponse{},
+	"users":                   []userResponse{},
+	"invite-create":           inviteRequest{},
+	"invite":                  inviteResponse{},
+	"invites":                 []inviteResponse{},
+	"api-token-create":        apiTokenRequest{},
+	"api-token":               apiTokenResponse{},
+	"api-tokens":              []apiTokenResponse{},
+	"register":                registerRequest{},
+	"deletion":                deletionResponse{},
+	"sessions":                []sessionResponse{},
+	"session-revoke":          sessionRevokeRequest{},
+	"session-revoked":         sessionRevokeResponse{},
+	"tasks":                   tasksResponse{},
+	"security-chain":          securityChainResponse{},
+	"login-stats":             loginStatsResponse{},
+	"domain-events":           []domainEventResponse{},
+	"impersonation":           impersonationResponse{},
+	"username":                usernameChangeRequest{},
+	"username-history":        []usernameChangeResponse{},
+	"tenant-settings-request": tenantSettingsRequest{},
+	"tenant-settings":         tenantSettingsResponse{},
+	"tenant-settings-list":    []tenantSettingsResponse{},
+	"sampling":                samplingResponse{},
+	"sampling-override":       samplingOverrideRequest{},
+}
+
+// schemaIndexResponse lists the names of every schema we publish.
+type schemaIndexResponse struct {
+	Schemas []string `json:"schemas"`
+}
+
+// schemaIndex lists every schema we publish, each can be fetched from /schemas/{name}.json.
+func (s *server) schemaIndex(w http.ResponseWriter, r *http.Request) {
+	resp := schemaIndexResponse{Schemas: make([]string, 0, len(schemaTypes))}
+	for name := range schemaTypes {
+		resp.Schemas = append(resp.Schemas, name)
+	}
+	sort.Strings(resp.Schemas)
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// schema serves the JSON Schema for one of our request or response types. Schemas only change when we deploy, so
+// clients are welcome to cache them for a while.
+func (s *server) schema(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["type"]
+	v, ok := schemaTypes[name]
+	if !ok {
+		s.writeError(w, r, errs.New(errs.NotFound, "no schema with that name"))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	s.writeJSON(w, r, http.StatusOK, jsonschema.For(s.pathTo("/schemas/"+name+".json"), v))
+}
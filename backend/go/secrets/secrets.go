@@ -0,0 +1,53 @@
+// secrets fetches secrets (such as our database credentials) from wherever they're kept, rather than from environment
+// variables. Environment variables are fixed once we've started, so rotating a secret kept in one means a restart.
+// Secrets fetched from a Provider can be fetched again, picking up a rotated secret while we're running.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when the Provider doesn't have a secret with the given name
+var ErrNotFound = errors.New("no secret with that name")
+
+// Provider fetches secrets by name. As with our Storer interface, any implementation can be swapped in (a secrets
+// manager's API, or files written by an agent).
+type Provider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// Dir reads secrets from files in a directory, one file per secret named after it. This is how Kubernetes and Docker
+// mount secrets, and how agents for secrets managers (such as Vault Agent) usually hand them over, rewriting the files
+// when a secret is rotated.
+type Dir struct {
+	path string
+}
+
+// NewDir creates a Provider reading secrets from files in the directory at path.
+func NewDir(path string) *Dir {
+	return &Dir{path: path}
+}
+
+// Secret implements Provider. Surrounding whitespace (such as a trailing newline) is trimmed.
+func (d *Dir) Secret(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	// Names are never paths, so a name can't be used to read files outside the directory
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	b, err := os.ReadFile(filepath.Join(d.path, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
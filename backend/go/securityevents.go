@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of security event. Our audit log records everything significant that happens, security events are the subset a
+// security team watches for (see database.SecurityEvent), exported to their SIEM from our admin listener.
+const (
+	eventLoginSuccess        = "login.success"
+	eventLoginFailure        = "login.failure"
+	eventAccountLocked       = "account.locked"
+	eventPasswordChanged     = "password.changed"
+	eventTwoFactorEnabled    = "2fa.enabled"
+	eventTwoFactorDisabled   = "2fa.disabled"
+	eventRecoveryCodeUsed    = "2fa.recovery_code"
+	eventRoleChanged         = "role.changed"
+	eventRefreshTokenReused  = "token.reused"
+	eventFingerprintMismatch = "session.fingerprint_mismatch"
+	eventImpersonation       = "session.impersonation"
+	eventAPITokenCreated     = "apitoken.created"
+	eventAPITokenRevoked     = "apitoken.revoked"
+)
+
+// eventSeverity is how serious each kind of event is on the CEF scale of 0 (least) to 10, anything not listed is 3
+var eventSeverity = map[string]int{
+	eventLoginSuccess:        1,
+	eventLoginFailure:        4,
+	eventAccountLocked:       7,
+	eventPasswordChanged:     5,
+	eventTwoFactorEnabled:    3,
+	eventTwoFactorDisabled:   6,
+	eventRecoveryCodeUsed:    6,
+	eventRoleChanged:         8,
+	eventRefreshTokenReused:  9,
+	eventFingerprintMismatch: 7,
+	eventImpersonation:       8,
+	eventAPITokenCreated:     5,
+	eventAPITokenRevoked:     3,
+}
+
+// securityEventBatch is how many events we load at a time while exporting or verifying
+const securityEventBatch = 500
+
+// securityEvent records a security event about a User (0 if we don't know who). Like audit, the event has already
+// happened by the time we record it, so failing to record it is logged rather than failing the request.
+func (s *server) securityEvent(r *http.Request, kind string, userID int64, detail string) {
+	event := database.SecurityEvent{
+		Time:   clock.Now(),
+		Kind:   kind,
+		UserID: userID,
+		IP:     s.clientIP(r),
+		Detail: detail,
+	}
+	if err := s.unscoped(r).CreateSecurityEvent(&event); err != nil {
+		s.logger.Printf("ERROR: Unable to record security event %q for user %d: %v", kind, userID, err)
+	}
+}
+
+// securityEventResponse is a security event as we export it as JSON, one per line.
+type securityEventResponse struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Severity int       `json:"severity"`
+	UserID   int64     `json:"userId,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prevHash"` // Hex encoded
+	Hash     string    `json:"hash"`     // Hex encoded
+}
+
+// severityOf returns how serious a kind of event is.
+func severityOf(kind string) int {
+	if severity, ok := eventSeverity[kind]; ok {
+		return severity
+	}
+	return 3
+}
+
+// exportSecurityEvents streams our security events, oldest first, for loading into a SIEM. Pass ?after= with the ID of
+// the last event already exported to carry on from there, and ?format=cef for Common Event Format rather than JSON
+// lines. Each event carries its hash and the hash before it, so the SIEM can check the chain as well.
+func (s *server) exportSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			s.writeError(w, r, errs.New(errs.Invalid, "after must be an event ID"))
+			return
+		}
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case "cef":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		s.writeError(w, r, errs.New(errs.Invalid, "format must be json or cef"))
+		return
+	}
+
+	// Load the first batch before writing anything, so a failure can still be reported properly
+	events, err := s.unscoped(r).ListSecurityEvents(after, securityEventBatch)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	flusher := http.NewResponseController(w)
+	for len(events) > 0 {
+		for _, e := range events {
+			if format == "cef" {
+				fmt.Fprintln(w, cefLine(e))
+				continue
+			}
+			encoder.Encode(securityEventResponse{
+				ID:       e.ID,
+				Time:     e.Time,
+				Kind:     e.Kind,
+				Severity: severityOf(e.Kind),
+				UserID:   e.UserID,
+				IP:       e.IP,
+				Detail:   e.Detail,
+				PrevHash: hex.EncodeToString(e.PrevHash),
+				Hash:     hex.EncodeToString(e.Hash),
+			})
+		}
+		flusher.Flush()
+		if len(events) < securityEventBatch {
+			return
+		}
+		if events, err = s.unscoped(r).ListSecurityEvents(events[len(events)-1].ID, securityEventBatch); err != nil {
+			// We've already started the response, all we can do is stop part way, the client can carry on with ?after=
+			s.logger.Printf("ERROR: Unable to export security events: %v", err)
+			return
+		}
+	}
+}
+
+// CEF escapes its header fields (separated by |) and extension values (key=value pairs separated by spaces) differently
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefLine formats a security event in ArcSight's Common Event Format, which most SIEMs understand.
+func cefLine(e database.SecurityEvent) string {
+	ext := []string{
+		"externalId=" + strconv.FormatInt(e.ID, 10),
+		"rt=" + strconv.FormatInt(e.Time.UnixMilli(), 10),
+	}
+	if e.UserID != 0 {
+		ext = append(ext, "suid="+strconv.FormatInt(e.UserID, 10))
+	}
+	if e.IP != "" {
+		ext = append(ext, "src="+cefExtensionEscaper.Replace(e.IP))
+	}
+	if e.Detail != "" {
+		ext = append(ext, "msg="+cefExtensionEscaper.Replace(e.Detail))
+	}
+	ext = append(ext,
+		"cs1Label=prevHash", "cs1="+hex.EncodeToString(e.PrevHash),
+		"cs2Label=hash", "cs2="+hex.EncodeToString(e.Hash),
+	)
+	kind := cefHeaderEscaper.Replace(e.Kind)
+	return fmt.Sprintf("CEF:0|examples|api|1.0|%s|%s|%d|%s", kind, kind, severityOf(e.Kind), strings.Join(ext, " "))
+}
+
+// securityChainResponse reports whether our security event log's hash chain is intact.
+type securityChainResponse struct {
+	Intact   bool  `json:"intact"`
+	Events   int   `json:"events"`             // How many events were checked
+	BrokenAt int64 `json:"brokenAt,omitempty"` // ID of the first event that doesn't match, if the chain is broken
+}
+
+// verifySecurityEvents walks our whole security event log, checking every event's hash and that each follows on from
+// the one before. A broken chain means events have been changed, removed or added behind our back.
+func (s *server) verifySecurityEvents(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp = securityChainResponse{Intact: true}
+		last *database.SecurityEvent
+	)
+	for after := int64(0); ; {
+		events, err := s.unscoped(r).ListSecurityEvents(after, securityEventBatch)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if len(events) == 0 {
+			break
+		}
+		// Include the last event of the batch before, so the link between batches is checked too
+		check := events
+		if last != nil {
+			check = append([]database.SecurityEvent{*last}, events...)
+		} else if len(events[0].PrevHash) != 0 {
+			// The first event ever recorded has nothing before it
+			resp.Intact, resp.BrokenAt = false, events[0].ID
+		}
+		if id, ok := database.VerifyChain(check); !ok && resp.Intact {
+			resp.Intact, resp.BrokenAt = false, id
+		}
+		resp.Events += len(events)
+		if !resp.Intact {
+			break
+		}
+		last = &events[len(events)-1]
+		after = last.ID
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/config"
+	"examples/csrf"
+	"examples/database"
+	"examples/emailaddr"
+	"examples/encryption"
+	"examples/errorlog"
+	"examples/health"
+	"examples/jobs"
+	"examples/loadshed"
+	"examples/logging"
+	"examples/loginstats"
+	"examples/mailer"
+	"examples/metrics"
+	"examples/mirror"
+	"examples/oauth"
+	"examples/ratelimit"
+	"examples/secrets"
+	"examples/signedurl"
+	"examples/tasks"
+	"examples/tenants"
+	"examples/token"
+	"examples/tracing"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Logger is the small slice of logging behaviour our server actually needs. Depending on an interface rather than
+// a concrete *log.Logger means tests (or a different logging library later on) can supply their own implementation.
+type Logger interface {
+	Println(v ...any)
+	Printf(format string, v ...any)
+}
+
+// Deps lists every external dependency the server needs. main() is responsible for building these (reading
+// environment variables, opening connections, etc), NewServer is only responsible for putting them together.
+//
+// Tools such as google/wire can generate this kind of composition code for you, but for a service this size writing
+// it out by hand keeps everything visible in one place.
+type Deps struct {
+	// TestDependency is an example of a plain configuration value being handed to the server
+	TestDependency string
+	// Logger is where the server writes any log output
+	Logger Logger
+	// DB is any implementation of our Storer interface (SQL, NoSQL, in-memory, etc)
+	DB database.Storer
+	// Secrets fetches secrets that may be rotated while we're running, leave nil if we don't have a secrets provider
+	Secrets secrets.Provider
+	// DBCredentials switches our database connections over to rotated credentials, required along with Secrets
+	DBCredentials credentialRotator
+	// WarmUp is what we warm up before reporting ready, leave its Timeout zero to skip warming up (see warm)
+	WarmUp WarmUp
+	// DBCredentialsInterval is how often we check Secrets for rotated database credentials
+	DBCredentialsInterval time.Duration
+	// DatabaseURL is the URL DB was opened with, so we can tell when Secrets has a new one
+	DatabaseURL string
+	// Encrypter encrypts the credentials stored with each session, with the newest of its keys
+	Encrypter *encryption.Keyring
+	// RekeyInterval is how often sessions encrypted with an older key are re-encrypted with the newest, by rekeySessions
+	RekeyInterval time.Duration
+	// SessionTransport is how session tokens are handed to clients, either config.TransportHeader or config.TransportCookie
+	SessionTransport string
+	// Cookies describes our session cookies when SessionTransport is config.TransportCookie
+	Cookies config.CookieSettings
+	// CORSOrigins are the origins browsers may call us from, leave empty (or include "*") to allow any (see cors)
+	CORSOrigins []string
+	// SessionMode is how sessions are kept track of, either config.SessionModeDatabase or config.SessionModeJWT
+	SessionMode string
+	// Tokens issues and verifies our signed session tokens, only required in config.SessionModeJWT
+	Tokens *token.Issuer
+	// SessionRenewAfter is the percentage of a session's idle timeout that must pass before it is renewed on use
+	SessionRenewAfter int
+	// SessionRefreshHint hints that refreshing may help in the 401 response for an expired session
+	SessionRefreshHint bool
+	// Sessions is how long database backed sessions last, for Users who asked to be remembered and for everyone else
+	Sessions config.SessionLifespans
+	// TenantCacheTTL is how long tenant settings, which can override Sessions for a tenant's members, are kept in memory
+	TenantCacheTTL time.Duration
+	// LockoutThreshold is how many failed logins in a row lock an account, leave 0 to never lock accounts
+	LockoutThreshold int
+	// FrontendURL is where our frontend is hosted, used to build links in emails
+	FrontendURL string
+	// BasePath is the path our public API is mounted under (see basepath.go), leave empty to mount it at the root
+	BasePath string
+	// Emails canonicalizes and validates the email addresses Users sign up and change to, leave nil to only check syntax
+	Emails *emailaddr.Validator
+	// OAuth holds the OAuth providers Users may log in with, keyed by name, leave empty to disable OAuth logins
+	OAuth map[string]*oauth.Provider
+	// Blobs is our blob store, holding the files we serve for download (avatars, exports, etc), leave nil to disable downloads
+	Blobs fs.FS
+	// URLSigner signs and checks our download links
+	URLSigner *signedurl.Signer
+	// CSRF issues and checks the tokens protecting cookie authenticated requests from cross site request forgery
+	CSRF *csrf.Tokens
+	// InstallLinks maps each platform to the link for installing our app on it
+	InstallLinks map[string]string
+	// RecipientLimiter limits how many emails we'll send to any one address, leave nil to disable this limit
+	RecipientLimiter ratelimit.Limiter
+	// AvailabilityLimiter limits how many availability checks each client may make, leave nil to disable this limit
+	AvailabilityLimiter ratelimit.Limiter
+	// LoginThrottle slows down repeated failed logins for the same email, and LoginThrottleIP from the same IP address,
+	// leave either nil to disable it
+	LoginThrottle   ratelimit.Throttle
+	LoginThrottleIP ratelimit.Throttle
+	// Mailer sends any emails our API needs to send
+	Mailer mailer.Mailer
+	// JobStore keeps our queued jobs, such as our database or a jobs.RedisStore
+	JobStore jobs.Store
+	// HTTPClient is used for calling any external APIs, leave nil to use a default client
+	HTTPClient *http.Client
+	// RateLimiter limits how often each client may call the public API, leave nil to disable rate limiting
+	RateLimiter ratelimit.Limiter
+	// Shedder caps how many requests the public API works on at once, leave nil for no cap
+	Shedder *loadshed.Shedder
+	// Mirror copies a share of requests to a shadow deployment, leave nil to mirror nothing
+	Mirror *mirror.Mirror
+	// Sampler decides which requests are traced, leave nil when tracing is disabled
+	Sampler *tracing.Sampler
+	// TrustedProxies are the proxies allowed to tell us the real client IP through forwarding headers, leave empty if
+	// clients connect to us directly
+	TrustedProxies []netip.Prefix
+	// LogRing holds our recent log entries, along with a record of each request, leave nil to disable live log tailing
+	LogRing *logging.Ring
+	// ErrorLog keeps our most recent server side errors for triage, leave nil to disable
+	ErrorLog *errorlog.Ring
+	// AdminToken protects the endpoints under /admin on our admin listener, leave empty to disable them
+	AdminToken string
+	// Retention is how long we keep old records, enforced by enforceRetention
+	Retention config.Retention
+	// RecordDir records every request to this directory, dev builds only, leave empty to disable
+	RecordDir string
+	// Config is our current configuration, which may be reloaded while we're running. Settings read from it on each
+	// request pick up a reload straight away, their docs in the config package say they can be changed by reloading.
+	// Anything read once as we start (such as MetricsRoutes, when our routes are built) keeps its value until a restart
+	Config *config.Snapshot
+}
+
+type server struct {
+	// Specify dependencies here
+	// loggers, external API clients, etc
+	testDependency string
+	// We'll want an implementation of a logger, anything satisfying our Logger interface will do
+	logger Logger
+	// We'll also have a database dependency
+	db database.Storer
+	// Encrypts session credentials
+	encrypter *encryption.Keyring
+	// How session tokens are handed to clients
+	sessionTransport string
+	// Our session cookie settings
+	cookies config.CookieSettings
+	// Origins browsers may call us from
+	corsOrigins []string
+	// How sessions are kept track of
+	sessionMode string
+	// Issues and verifies signed session tokens, nil unless we're in JWT mode
+	tokens *token.Issuer
+	// Percentage of a session's idle timeout that must pass before it is renewed on use
+	sessionRenewAfter int
+	// Whether to hint at refreshing in the 401 response for an expired session
+	sessionRefreshHint bool
+	// How long sessions last
+	sessions config.SessionLifespans
+	// The settings tenants have overridden for their members, see sessionLifespans
+	tenants *tenants.Cache
+	// Failed logins in a row that lock an account, 0 if accounts are never locked
+	lockoutThreshold int
+	// Where our frontend is hosted
+	frontendURL string
+	// The path our public API is mounted under, empty for the root
+	basePath string
+	// Canonicalizes and validates email addresses
+	emails *emailaddr.Validator
+	// OAuth providers Users may log in with, by name
+	oauth map[string]*oauth.Provider
+	// Files we serve for download, may be nil
+	blobs fs.FS
+	// Signs and checks our download links
+	urlSigner *signedurl.Signer
+	// Issues and checks CSRF tokens
+	csrf *csrf.Tokens
+	// Links for installing our app, by platform
+	installLinks map[string]string
+	// Limits how many emails we'll send to any one address, may be nil
+	recipientLimiter ratelimit.Limiter
+	// Limits how many availability checks each client may make, may be nil
+	availabilityLimiter ratelimit.Limiter
+	// Slow down repeated failed logins by email and by IP address, may be nil
+	loginThrottle   ratelimit.Throttle
+	loginThrottleIP ratelimit.Throttle
+	// Sends emails
+	mailer mailer.Mailer
+	// Calls external APIs
+	client *http.Client
+	// Limits how often each client may call us, may be nil
+	limiter ratelimit.Limiter
+	// Caps how many requests we work on at once, may be nil
+	shedder *loadshed.Shedder
+	// Where requests are mirrored to, nil if they aren't
+	mirror *mirror.Mirror
+	// Decides which requests are traced, nil if tracing is disabled
+	sampler *tracing.Sampler
+	// Proxies allowed to tell us the real client IP
+	trustedProxies []netip.Prefix
+	// Recent log entries and requests, may be nil
+	logRing *logging.Ring
+	// Recent server side errors, may be nil
+	errorLog *errorlog.Ring
+	// Login attempts over the last day, for security dashboards
+	logins *loginstats.Counter
+	// Bearer token for our admin endpoints, empty if they're disabled
+	adminToken string
+	// How long we keep old records
+	retention config.Retention
+	// How often sessions are re-encrypted with our newest key
+	rekeyInterval time.Duration
+	// Where our database credentials come from, and how to switch over to new ones. secrets is nil if we don't have one
+	secrets               secrets.Provider
+	dbCredentials         credentialRotator
+	dbCredentialsInterval time.Duration
+	dbURL                 string // The database URL we're connected with, only used by rotateDBCredentials
+	// Records requests for replaying later, nil unless recording is enabled
+	record func(http.Handler) http.Handler
+	// Our current configuration, load it as settings are used so reloads are picked up
+	config *config.Snapshot
+	// Checks our dependencies in the background, for our readiness endpoint
+	health *health.Checker
+	// What we warm up before our first health checks, and whether we're still doing so (see warm)
+	warmUp  WarmUp
+	warming atomic.Bool
+	// Runs our background tasks
+	tasks *tasks.Runner
+	// Queues work to be done outside of a request, such as sending emails
+	jobs *jobs.Queue
+	// Copies of recent reads, served in degraded mode while our database is unavailable (see degraded.go)
+	stale *staleCache
+	// Our routes, for replaying requests queued in degraded mode. Built the first time one is replayed.
+	replayOnce sync.Once
+	replayTo   http.Handler
+}
+
+// NewServer validates the supplied dependencies and combines them into a server ready to have its routes served.
+func NewServer(deps Deps) (*server, error) {
+	// Validate our dependencies up front, it's much easier to debug a clear error at startup than a nil pointer
+	// panic on the first request
+	if deps.TestDependency == "" {
+		return nil, errors.New("test dependency is required")
+	}
+	if deps.Logger == nil {
+		return nil, errors.New("logger is required")
+	}
+	if deps.DB == nil {
+		return nil, errors.New("database is required")
+	}
+	if deps.Encrypter == nil {
+		return nil, errors.New("encrypter is required")
+	}
+	if deps.Secrets != nil && deps.DBCredentials == nil {
+		return nil, errors.New("database credential rotator is required with a secrets provider")
+	}
+	if deps.JobStore == nil {
+		return nil, errors.New("job store is required")
+	}
+	if deps.SessionTransport != config.TransportHeader && deps.SessionTransport != config.TransportCookie {
+		return nil, errors.New("session transport must be header or cookie")
+	}
+	// Database backed sessions are the default, so an empty mode means those
+	if deps.SessionMode == "" {
+		deps.SessionMode = config.SessionModeDatabase
+	}
+	if deps.SessionMode != config.SessionModeDatabase && deps.SessionMode != config.SessionModeJWT {
+		return nil, errors.New("session mode must be database or jwt")
+	}
+	if deps.SessionMode == config.SessionModeJWT && deps.Tokens == nil {
+		return nil, errors.New("token issuer is required for jwt sessions")
+	}
+	if deps.Sessions.IdleTimeout <= 0 || deps.Sessions.MaxLifetime <= 0 ||
+		deps.Sessions.RememberIdleTimeout <= 0 || deps.Sessions.RememberLifetime <= 0 {
+		return nil, errors.New("session lifespans must be positive")
+	}
+	if deps.URLSigner == nil {
+		return nil, errors.New("url signer is required")
+	}
+	if deps.CSRF == nil {
+		return nil, errors.New("csrf token issuer is required")
+	}
+	if deps.Mailer == nil {
+		return nil, errors.New("mailer is required")
+	}
+	if deps.Config == nil {
+		return nil, errors.New("config is required")
+	}
+	if deps.Emails == nil {
+		deps.Emails = emailaddr.New(emailaddr.Options{})
+	}
+	// Never use a client without a timeout for external calls, a hung dependency would hang our handlers with it
+	if deps.HTTPClient == nil {
+		deps.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	// Combine all our connections and settings into a single struct that we can use to make handler methods on
+	s := &server{
+		testDependency:        deps.TestDependency,
+		logger:                deps.Logger,
+		db:                    deps.DB,
+		encrypter:             deps.Encrypter,
+		sessionTransport:      deps.SessionTransport,
+		cookies:               deps.Cookies,
+		corsOrigins:           deps.CORSOrigins,
+		sessionMode:           deps.SessionMode,
+		tokens:                deps.Tokens,
+		sessionRenewAfter:     deps.SessionRenewAfter,
+		sessionRefreshHint:    deps.SessionRefreshHint,
+		sessions:              deps.Sessions,
+		tenants:               tenants.New(deps.DB, deps.Sessions, deps.TenantCacheTTL),
+		lockoutThreshold:      deps.LockoutThreshold,
+		frontendURL:           deps.FrontendURL,
+		basePath:              deps.BasePath,
+		emails:                deps.Emails,
+		oauth:                 deps.OAuth,
+		blobs:                 deps.Blobs,
+		urlSigner:             deps.URLSigner,
+		csrf:                  deps.CSRF,
+		installLinks:          deps.InstallLinks,
+		recipientLimiter:      deps.RecipientLimiter,
+		availabilityLimiter:   deps.AvailabilityLimiter,
+		loginThrottle:         deps.LoginThrottle,
+		loginThrottleIP:       deps.LoginThrottleIP,
+		mailer:                deps.Mailer,
+		client:                deps.HTTPClient,
+		limiter:               deps.RateLimiter,
+		shedder:               deps.Shedder,
+		mirror:                deps.Mirror,
+		sampler:               deps.Sampler,
+		trustedProxies:        deps.TrustedProxies,
+		logRing:               deps.LogRing,
+		errorLog:              deps.ErrorLog,
+		logins:                loginstats.New(loginStatsWidth, loginStatsWindow),
+		adminToken:            deps.AdminToken,
+		retention:             deps.Retention,
+		rekeyInterval:         deps.RekeyInterval,
+		secrets:               deps.Secrets,
+		dbCredentials:         deps.DBCredentials,
+		dbCredentialsInterval: deps.DBCredentialsInterval,
+		dbURL:                 deps.DatabaseURL,
+		config:                deps.Config,
+		health:                health.NewChecker(10 * time.Second),
+		warmUp:                deps.WarmUp,
+		tasks:                 tasks.New(),
+		jobs:                  jobs.New(deps.JobStore, deps.Logger),
+		stale:                 newStaleCache(maxStaleBytes),
+	}
+
+	if deps.RecordDir != "" {
+		record, err := recordRequests(deps.RecordDir)
+		if err != nil {
+			return nil, err
+		}
+		s.record = record
+	}
+
+	s.warming.Store(deps.WarmUp.Timeout > 0)
+
+	// Register a readiness check for each dependency we can't serve traffic without
+	s.health.Add("database", func(ctx context.Context) error {
+		return s.db.Ping()
+	})
+	s.registerTasks()
+	s.registerJobs()
+	return s, nil
+}
+
+// registerJobs hooks up the handler for each kind of job we queue. Call s.jobs.Run in its own goroutine to start working
+// through them.
+func (s *server) registerJobs() {
+	// Emails that don't need to be sent before we respond
+	s.jobs.Handle(emailJob, s.sendEmailJob)
+	// Writes queued in degraded mode while our database was unavailable (see degraded.go)
+	s.jobs.Handle(deferredJob, s.replayDeferredJob)
+}
+
+// registerTasks lists every background task we run, and how often. Call s.tasks.Run in its own goroutine to start them.
+// Their progress can be checked on (and they can be run on demand) through our admin endpoints.
+func (s *server) registerTasks() {
+	s.tasks.Add("clear_expired_sessions", 10*time.Minute, s.clearExpiredSessions)
+	// Clean up after deleted Users
+	s.tasks.Add("user_deletions", time.Minute, s.cascadeDeletions)
+	// Purge old records according to our retention policies
+	s.tasks.Add("retention", s.retention.Interval, s.enforceRetention)
+	// Move sessions off old encryption keys, so they can be retired
+	s.tasks.Add("rekey_sessions", s.rekeyInterval, s.rekeySessions)
+	// Pick up rotated database credentials, if they come from a secrets provider
+	if s.secrets != nil {
+		s.tasks.Add("rotate_db_credentials", s.dbCredentialsInterval, s.rotateDBCredentials)
+	}
+}
+
+// clearExpiredSessions is a background task that keeps our database clean of expired login sessions (see
+// registerTasks).
+func (s *server) clearExpiredSessions(ctx context.Context) error {
+	count, err := s.db.ClearExpiredSessions()
+	if err != nil {
+		s.logger.Printf("ERROR: Unable to clear expired login sessions: %v", err)
+		return err
+	}
+	// If we didn't encounter an error, operation was successful, let's still log it:
+	s.logger.Printf("INFO: Cleared %d expired login sessions", count)
+	return nil
+}
+
+// routes builds our router, applies middleware and hooks up every endpoint to its handler.
+func (s *server) routes() http.Handler {
+	// Set up a Router, I'll use Gorilla Mux, although you can use standard library Mux, or other routers such as Chi
+	// In this case since we're doing a RESTful API, GorillaMux allows us to easily use parameters included in the path
+	// (such as "/users/{username}", we'll be able to easily retrieve the username)
+	router := mux.NewRouter()
+	// GorillaMux also gives us a handy Use method, which is perfect for Middleware! Any request that is handled by this
+	// router, will execute any middleware before the actual endpoint.
+	// Apply any Middleware you need to your Router with the Use method (In this case we'll give each request an ID, record
+	// metrics, record it for our live log tail, count its database calls, use our CORS middleware, turn requests away
+	// during maintenance or when we're too busy, and apply rate limiting). Metrics are labelled by route, but only for the
+	// routes on our allowlist (see metrics.Routes), which is filled in once every route has been hooked up below. Writes
+	// replayed after degraded mode queued them were counted and limited when they first arrived, so skip that here.
+	metricRoutes := metrics.Routes{}
+	recordMetrics := metricRoutes.Middleware(routeTemplate)
+	router.Use(requestID, s.traceRequests, unlessReplayed(recordMetrics), s.accessLog, s.countQueries(metricRoutes), s.cors,
+		s.maintenance, unlessReplayed(s.shedLoad), unlessReplayed(s.rateLimit))
+	// Middleware only runs for requests matching a route, so requests that don't (such as someone scanning for paths)
+	// need their metrics recording separately
+	router.NotFoundHandler = recordMetrics(http.NotFoundHandler())
+	router.MethodNotAllowedHandler = recordMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	// In dev builds, we can also record every request for replaying later. This comes before any of our handlers, so the
+	// recording has the request exactly as it arrived.
+	if s.record != nil {
+		router.Use(s.record)
+	}
+	// Copy a share of requests to our shadow deployment, if we have one. Requests turned away above (such as by our rate
+	// limit) aren't worth mirroring, the shadow would only be told about them by us.
+	router.Use(s.mirrorTraffic)
+	// Check request bodies match their schemas before they reach a handler (see schemacheck.go), and that the API version
+	// the client asked for responses to be shaped for is one we have (see versions.go)
+	router.Use(s.validateSchemas, s.negotiateVersion)
+
+	// Standard Health Check endpoint that just returns a 200 status and empty response body, useful for simply checking if your API is running
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	// Set up a Login endpoint to authenticate with your service
+	router.HandleFunc("/login/", s.login).Methods(http.MethodPost)
+	// Users with two-factor authentication finish logging in here, with the challenge the login endpoint gave them
+	router.HandleFunc("/login/2fa", s.twoFactorLogin).Methods(http.MethodPost)
+	// Logging in without a password, the first emails a one-time link, and the second logs in with the link's token
+	router.HandleFunc("/login/magic", s.requestMagicLink).Methods(http.MethodPost)
+	router.HandleFunc("/login/magic/{token}", s.magicLogin).Methods(http.MethodPost)
+	// We'll need a logout endpoint. This sits outside our auth middleware, as logging out of a session that has
+	// already expired should still succeed
+	router.HandleFunc("/logout/", s.logout).Methods(http.MethodPost)
+	// Refreshing is done with a refresh token rather than a session, as the session has usually expired by then
+	router.HandleFunc(refreshPath, s.refreshToken).Methods(http.MethodPost)
+	// Logging in with an OAuth provider, the browser is sent to the first, and the provider sends it back to the second
+	router.HandleFunc(oauthPath+"{provider}", s.oauthLogin).Methods(http.MethodGet)
+	router.HandleFunc(oauthPath+"{provider}/callback", s.oauthCallback).Methods(http.MethodGet)
+
+	// JSON Schemas for our request and response types, so frontends can share our definitions (see schemas.go)
+	router.HandleFunc("/schemas/", s.schemaIndex).Methods(http.MethodGet)
+	router.HandleFunc("/schemas/{type}.json", s.schema).Methods(http.MethodGet)
+	// What's changed in our API between releases (see changelog.go)
+	router.HandleFunc("/changelog/", s.changelogHandler).Methods(http.MethodGet)
+
+	// Confirming an email change doesn't require being logged in, the token from the email proves who they are
+	router.HandleFunc("/email/confirm/{token}", s.confirmEmail).Methods(http.MethodPost)
+	// Likewise choosing a new password with the token from a password reset email (see passwordreset.go)
+	router.HandleFunc("/password/reset/{token}", s.confirmPasswordReset).Methods(http.MethodPost)
+	// And verifying a new User's email with the link we sent them (see verify.go)
+	router.HandleFunc("/verify/{token}", s.verifyEmail).Methods(http.MethodGet)
+	// And creating an account with the link from an invite (see invites.go)
+	router.HandleFunc("/register/{token}", s.register).Methods(http.MethodPost)
+	// Signup forms check whether a username is free as it's typed (see availability.go)
+	router.HandleFunc("/availability", s.availability).Methods(http.MethodGet)
+
+	// Downloads are protected by a signed link rather than a session (see downloads.go), so sit outside our auth middleware
+	downloads := router.PathPrefix(downloadsPrefix).Subrouter()
+	downloads.Use(s.signedURL)
+	downloads.PathPrefix("/").HandlerFunc(s.download).Methods(http.MethodGet, http.MethodHead)
+
+	// We'll make a Subrouter to secure our endpoints
+	loggedin := router.PathPrefix("").Subrouter()
+	// Apply our Middleware that checks authentication for every endpoint, and then checks the user is allowed to use it.
+	// Which auth middleware depends on our session mode, both leave the user in the request context in the same way, so
+	// nothing after them needs to care which is in use.
+	auth := s.auth
+	if s.sessionMode == config.SessionModeJWT {
+		auth = s.authJWT
+	}
+	// Scripts and CI can use an API token instead of either (see apitokens.go). While our database is unavailable, we
+	// can fall back on our degraded mode, which comes first as authenticating needs our database too (see degraded.go).
+	loggedin.Use(s.degraded, s.apiTokens(auth), s.authorize, s.requireVerifiedEmail, s.checkCSRF)
+
+	// Hook up our endpoints
+	// Here's an example of a typical REST style API
+	// Users API
+	loggedin.HandleFunc("/users/", s.userInfoSelf).Methods(http.MethodGet)
+	// Finding other Users by name or email ("search" can never be a username)
+	loggedin.HandleFunc("/users/search/{name}", s.userSearch).Methods(http.MethodGet)
+	// Users change their own password here, given their current one ("password" can never be a username). Routes are
+	// matched in the order they're added, so this must come before /users/{username}
+	loggedin.HandleFunc("/users/password", s.resetPasswordSelf).Methods(http.MethodPut)
+	loggedin.HandleFunc("/users/{username}", s.userUpdate).Methods(http.MethodPut)
+	loggedin.HandleFunc("/users/{username}/email", s.userEmail).Methods(http.MethodPut)
+	loggedin.HandleFunc("/users/{username}/email", s.sendInstallLinks).Methods(http.MethodPost)
+	loggedin.HandleFunc("/users/{username}/avatar", s.userAvatar).Methods(http.MethodGet)
+	loggedin.HandleFunc("/users/{username}/username", s.userUsername).Methods(http.MethodPut)
+	loggedin.HandleFunc("/users/{username}/username", s.userUsernameHistory).Methods(http.MethodGet)
+	loggedin.HandleFunc("/users/{username}/2fa", s.twoFactorEnroll).Methods(http.MethodPost)
+	loggedin.HandleFunc("/users/{username}/2fa", s.twoFactorConfirm).Methods(http.MethodPut)
+	loggedin.HandleFunc("/users/{username}/2fa", s.twoFactorDisable).Methods(http.MethodDelete)
+	// Frontends using cookie sessions fetch the CSRF token for their session here (see csrf.go)
+	loggedin.HandleFunc("/csrf/", s.csrfToken).Methods(http.MethodGet)
+	// Sessions API, Users can see where they're logged in and log out of sessions they don't recognise
+	loggedin.HandleFunc("/sessions/", s.listSessions).Methods(http.MethodGet)
+	loggedin.HandleFunc("/sessions/{id}", s.deleteSession).Methods(http.MethodDelete)
+	// Users who haven't verified their email yet can ask for another link
+	loggedin.HandleFunc("/verify/", s.resendEmailVerification).Methods(http.MethodPost)
+	// Users create API tokens for their scripts and CI here ("self" can never be a username)
+	loggedin.HandleFunc("/users/self/tokens", s.createAPIToken).Methods(http.MethodPost)
+	loggedin.HandleFunc("/users/self/tokens", s.listAPITokens).Methods(http.MethodGet)
+	loggedin.HandleFunc("/users/self/tokens/{id}", s.deleteAPIToken).Methods(http.MethodDelete)
+
+	// Admin only endpoints, only admins can even reach these (see requireRole), on top of our policy table
+	admins := loggedin.NewRoute().Subrouter()
+	admins.Use(s.requireRole(roleAdmin))
+	// Admin UIs browse everyone here, a page at a time ("all" can never be a username)
+	admins.HandleFunc("/users/all", s.listUsers).Methods(http.MethodGet)
+	admins.HandleFunc("/users/{username}/admin", s.userPromote).Methods(http.MethodPut)
+	admins.HandleFunc("/users/{username}/admin", s.userDemote).Methods(http.MethodDelete)
+	admins.HandleFunc("/users/{username}/enabled", s.userEnable).Methods(http.MethodPut)
+	admins.HandleFunc("/users/{username}/enabled", s.userDisable).Methods(http.MethodDelete)
+	// Admins can't set a User's password, only email them a link to choose a new one
+	admins.HandleFunc("/users/{username}/password", s.resetPasswordOther).Methods(http.MethodPut)
+	// Support staff can see what a User sees, through a read only session of theirs
+	admins.HandleFunc("/users/{username}/impersonate", s.impersonate).Methods(http.MethodPost)
+	// Inviting people to create their own account
+	admins.HandleFunc("/invites/", s.createInvite).Methods(http.MethodPost)
+	admins.HandleFunc("/invites/", s.listInvites).Methods(http.MethodGet)
+	admins.HandleFunc("/invites/{id}", s.deleteInvite).Methods(http.MethodDelete)
+
+	// Every endpoint behind our auth middleware needs an entry in our authorization policy table (see authz.go). A
+	// missing entry is a programming mistake, so we'll refuse to start rather than discover it later.
+	if err := checkPolicies(loggedin); err != nil {
+		panic(err)
+	}
+	// Likewise for a route naming a schema we don't have
+	if err := checkRouteSchemas(); err != nil {
+		panic(err)
+	}
+	// And for a route missing from our changelog, so clients always hear about new routes
+	if err := checkChangelog(router); err != nil {
+		panic(err)
+	}
+	s.allowMetricRoutes(router, metricRoutes)
+
+	return s.stripBasePath(router)
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/config"
+	"examples/database"
+	"examples/errs"
+	"examples/loginstats"
+	"examples/mailer"
+	"examples/password"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionCookie is the name of the cookie holding the session token, when sessions are delivered by cookie
+const sessionCookie = "session"
+
+// sessionCreds are the credentials we encrypt and store alongside each session.
+type sessionCreds struct {
+	UserID      int64  `json:"userId"`
+	Email       string `json:"email"`
+	Fingerprint string `json:"fingerprint,omitempty"` // Client that logged in, see fingerprint.go
+}
+
+// loginRequest is the body expected by the login endpoint.
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Remember bool   `json:"remember,omitempty"` // "Remember me", keeps the User logged in for much longer
+}
+
+// loginResponse is returned after successfully logging in, or refreshing a session.
+type loginResponse struct {
+	Token          string    `json:"token,omitempty"`        // Only included when sessions are delivered by header
+	RefreshToken   string    `json:"refreshToken,omitempty"` // Only included when sessions are delivered by header
+	Expires        time.Time `json:"expires"`
+	EndOfLife      time.Time `json:"endOfLife"`
+	RefreshExpires time.Time `json:"refreshExpires"` // The refresh token can be used until this time
+	Remember       bool      `json:"remember"`       // Whether the User asked to be remembered when logging in
+}
+
+// login verifies the supplied credentials, and starts a new session for the user.
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	// Decode the credentials from the request body
+	var req loginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if req.Email == "" || req.Password == "" {
+		s.writeError(w, r, errs.New(errs.Invalid, "email and password are required"))
+		return
+	}
+	// Anyone who has been getting the password wrong has to wait a while before trying again (see loginthrottle.go)
+	if !s.checkLoginThrottle(w, r, req.Email) {
+		return
+	}
+
+	// Look up the user, and verify their password. Whether the email or the password was wrong, we give the same
+	// response, so we don't reveal which emails have accounts.
+	invalid := errs.New(errs.Unauthorized, "invalid email or password")
+	user, err := s.userByEmail(r, req.Email)
+	if errors.Is(err, errs.NotFound) {
+		// Checking against a User without a password still takes as long as a real check (see the password package)
+		password.CheckPassword(database.User{}, req.Password)
+		s.throttleFailedLogin(r, req.Email)
+		s.securityEvent(r, eventLoginFailure, 0, "unknown account")
+		s.countLogin(loginstats.Failure)
+		s.writeError(w, r, invalid)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// A locked account can't be logged in to, even with the right password, until an admin unlocks it. We still check
+	// the password first, so a locked account takes just as long to respond as any other.
+	locked := errs.New(errs.Locked, "account locked after too many failed logins, please contact support")
+	err = password.CheckPassword(user, req.Password)
+	if errors.Is(err, password.ErrMismatch) {
+		s.throttleFailedLogin(r, req.Email)
+	} else if err == nil {
+		s.resetLoginThrottle(req.Email)
+	}
+	if user.Locked {
+		s.countLogin(loginstats.Failure)
+		s.writeError(w, r, locked)
+		return
+	}
+	if errors.Is(err, password.ErrMismatch) {
+		s.failedLogin(w, r, user, invalid, locked)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "login"), user.ID))
+		return
+	}
+	// Now we know the password, we can upgrade a hash made with an older algorithm (or weaker parameters). This is the
+	// only chance we get, so failing to isn't worth failing the login over.
+	if password.NeedsRehash(user.PasswordHash) {
+		if err := password.SetPassword(&user, req.Password); err == nil {
+			err = s.unscoped(r).SetPasswordHash(user.ID, user.PasswordHash)
+		}
+		if err != nil {
+			s.logger.Printf("WARNING: Unable to rehash password for user %d: %v", user.ID, err)
+		}
+	}
+	// Only tell the caller their account is disabled once they've proven it's theirs
+	if !user.Enabled {
+		s.writeError(w, r, errs.New(errs.Forbidden, "account disabled"))
+		return
+	}
+
+	// Users with two-factor authentication still have another step to go
+	s.continueLogin(w, r, user, req.Remember)
+}
+
+// finishLogin logs in a User who has passed every step of logging in.
+func (s *server) finishLogin(w http.ResponseWriter, r *http.Request, user database.User, remember bool) {
+	// The count of failed logins is for failures in a row, so a successful login starts it again. This waits until
+	// the very end of logging in, otherwise getting the password right would reset the count for guessing 2FA codes.
+	if user.FailedLogins > 0 {
+		if err := s.unscoped(r).UnlockUser(user.ID); err != nil {
+			s.writeError(w, r, errs.WithUser(err, user.ID))
+			return
+		}
+	}
+	s.securityEvent(r, eventLoginSuccess, user.ID, "")
+	s.countLogin(loginstats.Success)
+	s.startSession(w, r, user, remember)
+}
+
+// failedLogin counts a wrong password against a User, responding with invalid, or with locked if that was one failure
+// too many and the User is now locked.
+func (s *server) failedLogin(w http.ResponseWriter, r *http.Request, user database.User, invalid, locked error) {
+	s.securityEvent(r, eventLoginFailure, user.ID, fmt.Sprintf("%d failed in a row", user.FailedLogins+1))
+	s.countLogin(loginstats.Failure)
+	nowLocked, err := s.unscoped(r).RecordFailedLogin(user.ID, s.lockoutThreshold)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if nowLocked {
+		s.audit(r, "user.lock", user.ID, fmt.Sprintf("locked after %d failed logins", user.FailedLogins+1))
+		s.securityEvent(r, eventAccountLocked, user.ID, fmt.Sprintf("after %d failed logins", user.FailedLogins+1))
+		s.countLogin(loginstats.Lockout)
+		s.writeError(w, r, locked)
+		return
+	}
+	s.writeError(w, r, invalid)
+}
+
+// startSession logs in a User who has proven who they are, issuing them an access token and refresh token. Users who
+// asked to be remembered get our longer session lifespans.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, user database.User, remember bool) {
+	// Every login starts a new family of refresh tokens, which every token refreshed from this login belongs to
+	family, _, err := newToken()
+	if err != nil {
+		s.writeError(w, r, errs.Wrap(err, "startSession"))
+		return
+	}
+	refresh, first, err := s.createRefreshToken(r, user.ID, family, remember)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.issueTokens(w, r, user, refresh, first)
+}
+
+// sessionLifespans returns how long a User's session lasts without being used, and the absolute limit on it, depending
+// on whether they asked to be remembered. Their tenants may have overridden our lifespans, see the tenants package.
+func (s *server) sessionLifespans(userID int64, remember bool) (idle, max time.Duration, err error) {
+	lifespans, err := s.tenants.SessionLifespans(userID)
+	if err != nil {
+		return 0, 0, errs.Wrap(err, "sessionLifespans")
+	}
+	if remember {
+		return lifespans.RememberIdleTimeout, lifespans.RememberLifetime, nil
+	}
+	return lifespans.IdleTimeout, lifespans.MaxLifetime, nil
+}
+
+// createSession starts a new database backed session for a User, from the given refresh token's family. Returns the
+// session along with its token, for the client to present on each request.
+func (s *server) createSession(r *http.Request, user database.User, family database.RefreshToken) (database.Session, string, error) {
+	session, token, err := s.newSession(r, user, family)
+	if err != nil {
+		return database.Session{}, "", err
+	}
+	if err := s.unscoped(r).SaveSession(&session); err != nil {
+		return database.Session{}, "", errs.WithUser(err, user.ID)
+	}
+	return session, token, nil
+}
+
+// newSession prepares a new database backed session for a User, from the given refresh token's family, ready to be
+// saved. Returns the session's token along with it, only its hash is kept with the session.
+func (s *server) newSession(r *http.Request, user database.User, family database.RefreshToken) (database.Session, string, error) {
+	// Our session IDs are handed out in order, so rather than the ID, clients are given a random token that can't be
+	// guessed from their own
+	token, hash, err := newToken()
+	if err != nil {
+		return database.Session{}, "", errs.Wrap(err, "newSession")
+	}
+	// Encrypt the credentials we keep with the session
+	creds, err := json.Marshal(sessionCreds{UserID: user.ID, Email: user.Email, Fingerprint: s.fingerprint(r)})
+	if err != nil {
+		return database.Session{}, "", errs.Wrap(err, "newSession")
+	}
+	encrypted, err := s.encrypter.Seal(creds)
+	if err != nil {
+		return database.Session{}, "", errs.Wrap(err, "newSession")
+	}
+
+	// Create the session, with its lifetime set by our session policy
+	now := clock.Now()
+	idle, max, err := s.sessionLifespans(user.ID, family.Remember)
+	if err != nil {
+		return database.Session{}, "", err
+	}
+	session := database.Session{
+		TokenHash:      hash,
+		UserID:         user.ID,
+		EncryptedCreds: encrypted,
+		Created:        now,
+		Expires:        now.Add(idle),
+		EndOfLife:      now.Add(max),
+		IP:             s.clientIP(r),
+		RefreshFamily:  family.FamilyID,
+		Remember:       family.Remember,
+		UserAgent:      userAgentOf(r),
+	}
+	return session, token, nil
+}
+
+// deliverTokens hands an access token and refresh token to the client, either as cookies or in the response body.
+func (s *server) deliverTokens(w http.ResponseWriter, r *http.Request, access, refresh string, resp loginResponse) {
+	if s.sessionTransport == config.TransportCookie {
+		// Unless the User asked to be remembered, our cookies only last until they close their browser
+		var expires, refreshExpires time.Time
+		if resp.Remember {
+			expires, refreshExpires = resp.EndOfLife, resp.RefreshExpires
+		}
+		session := s.sessionCookie(sessionCookie, access, "/", http.SameSiteLaxMode)
+		session.Expires = expires
+		http.SetCookie(w, session)
+		// The refresh token is only ever needed by our refresh endpoint, so the browser only sends it there
+		refreshToken := s.sessionCookie(refreshCookie, refresh, refreshPath, http.SameSiteStrictMode)
+		refreshToken.Expires = refreshExpires
+		http.SetCookie(w, refreshToken)
+	} else {
+		resp.Token = access
+		resp.RefreshToken = refresh
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// rawSessionToken reads the session token from the request, either from the Authorization header
+// ("Authorization: Bearer <token>") or from our session cookie. Returns an empty string if there isn't one.
+func rawSessionToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, _ := strings.CutPrefix(header, "Bearer ")
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// sessionToken reads the token of a database backed session from the request, returning its hash to look the session
+// up by. Returns false if there is no token. A replayed request only has the hash (see deferWrite).
+func sessionToken(r *http.Request) ([]byte, bool) {
+	if replay, ok := requestctx.ReplayOf(r.Context()); ok && len(replay.TokenHash) > 0 && !replay.APIToken {
+		return replay.TokenHash, true
+	}
+	token := rawSessionToken(r)
+	if token == "" {
+		return nil, false
+	}
+	return hashToken(token), true
+}
+
+// clearSessionCookie tells the browser to delete our session and refresh token cookies.
+func (s *server) clearSessionCookie(w http.ResponseWriter) {
+	// Cookies are only deleted by setting them again with the same name, domain and path
+	session := s.sessionCookie(sessionCookie, "", "/", http.SameSiteLaxMode)
+	session.MaxAge = -1 // A negative MaxAge deletes the cookie immediately
+	http.SetCookie(w, session)
+	refreshToken := s.sessionCookie(refreshCookie, "", refreshPath, http.SameSiteStrictMode)
+	refreshToken.MaxAge = -1
+	http.SetCookie(w, refreshToken)
+}
+
+// logout ends the current session. Logging out is idempotent, if the session has already gone (it expired, or this
+// is a retried request) we still respond with success, as the end result the client wanted is the same.
+//
+// Logging out also revokes the session's refresh tokens, so the session can't simply be refreshed back to life.
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	// Copies of what the session read, kept for degraded mode, shouldn't outlive it (see degraded.go)
+	s.stale.forget(rawSessionToken(r))
+	// A JWT itself can't be revoked, it's valid until it expires, but we can revoke its refresh tokens. An invalid or
+	// expired token has nothing left to revoke.
+	if s.sessionMode == config.SessionModeJWT {
+		if claims, err := s.tokens.Verify(rawSessionToken(r)); err == nil && claims.Family != "" {
+			if err := s.revokeRefreshFamily(r, claims.Family); err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+		}
+		if s.sessionTransport == config.TransportCookie {
+			s.clearSessionCookie(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	tokenHash, ok := sessionToken(r)
+	if !ok {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "not logged in"))
+		return
+	}
+
+	// Revoke the session's refresh tokens, along with any other sessions refreshed from the same login. A session that
+	// no longer exists has nothing left to revoke or delete.
+	session, err := s.unscoped(r).LoadSessionByToken(tokenHash)
+	if err != nil && !errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, err)
+		return
+	}
+	if err == nil {
+		if session.RefreshFamily != "" {
+			if err := s.revokeRefreshFamily(r, session.RefreshFamily); err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+		}
+		// Deleting a session that has gone since we loaded it isn't an error either
+		if err := s.unscoped(r).LogoutSession(session.ID); err != nil && !errors.Is(err, errs.NotFound) {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	// If the session was delivered by cookie, make sure the browser forgets it too
+	if s.sessionTransport == config.TransportCookie {
+		s.clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionResponse describes one of a User's sessions, so they can spot any they don't recognise. The credentials stored
+// with a session are never included.
+type sessionResponse struct {
+	ID           int64     `json:"id"`
+	Created      time.Time `json:"created"`      // When the User logged in
+	Expires      time.Time `json:"expires"`      // When the session ends if it isn't used again
+	EndOfLife    time.Time `json:"endOfLife"`    // When the session ends regardless
+	IP           string    `json:"ip,omitempty"` // Where the User logged in from
+	Remember     bool      `json:"remember"`
+	Current      bool      `json:"current"`                              // Whether this is the session making the request
+	UserAgent    string    `json:"userAgent,omitempty" since:"1.4.0"`    // The client that last used the session, such as a browser
+	LastSeen     time.Time `json:"lastSeen" since:"1.4.0"`               // When the session was last used, to within a few minutes
+	LastIP       string    `json:"lastIp,omitempty" since:"1.4.0"`       // Where the session was last used from
+	Impersonated bool      `json:"impersonated,omitempty" since:"1.5.0"` // Whether support staff are using this session (see impersonate.go)
+}
+
+// listSessions lists the logged in User's active sessions, newest first. Only database backed sessions can be listed,
+// so in JWT mode this is always empty.
+func (s *server) listSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	current, _ := requestctx.Session(r.Context())
+	sessions, err := s.dbFor(r).ListSessionsByUser(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, sessionResponse{
+			ID:           session.ID,
+			Created:      session.Created,
+			Expires:      session.Expires,
+			EndOfLife:    session.EndOfLife,
+			IP:           session.IP,
+			Remember:     session.Remember,
+			Current:      session.ID == current.ID,
+			UserAgent:    session.UserAgent,
+			LastSeen:     session.LastSeen,
+			LastIP:       session.LastIP,
+			Impersonated: session.ImpersonatorID != 0,
+		})
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// deleteSession revokes one of the logged in User's sessions, along with its refresh tokens so it can't be refreshed
+// back to life, such as one left logged in on a shared computer. Users may only revoke their own sessions, anyone
+// else's are reported as not found, so session IDs can't be probed.
+func (s *server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		s.writeError(w, r, errs.New(errs.Invalid, "session ID must be a positive number"))
+		return
+	}
+	session, err := s.unscoped(r).LoadSession(id)
+	if err == nil && session.UserID != user.ID {
+		err = errs.New(errs.NotFound, "session not found")
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+
+	if session.RefreshFamily != "" {
+		if err := s.revokeRefreshFamily(r, session.RefreshFamily); err != nil {
+			s.writeError(w, r, errs.WithUser(err, user.ID))
+			return
+		}
+	}
+	if err := s.unscoped(r).LogoutSession(session.ID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "session.revoke", user.ID, strconv.FormatInt(session.ID, 10))
+
+	// Revoking the session making the request is logging out, so make sure the browser forgets it too
+	if current, _ := requestctx.Session(r.Context()); current.ID == session.ID && s.sessionTransport == config.TransportCookie {
+		s.clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionRevokeBatchSize is how many sessions revokeSessions deletes at a time
+const sessionRevokeBatchSize = 500
+
+// sessionRevokeRequest is the body expected when revoking sessions in bulk. At least one criterion must be given, and
+// sessions must match every criterion given to be revoked.
+type sessionRevokeRequest struct {
+	Users         []string   `json:"users,omitempty"`         // Revoke sessions belonging to these Users, by username (or email)
+	CreatedBefore *time.Time `json:"createdBefore,omitempty"` // Revoke sessions created before this time
+	IPRange       string     `json:"ipRange,omitempty"`       // Revoke sessions created from this CIDR range (e.g. 203.0.113.0/24) or IP
+}
+
+// sessionRevokeResponse reports how many sessions were revoked.
+type sessionRevokeResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// revokeSessions revokes every session matching the given criteria, along with the refresh tokens they were created
+// from, for responding to incidents such as leaked credentials or a compromised network. Sessions are deleted in
+// batches, so revoking a large number doesn't lock up the sessions table. Only database backed sessions can be revoked,
+// signed tokens can't be (see the token package), so in JWT mode this revokes nothing.
+func (s *server) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	var req sessionRevokeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	var filter database.SessionFilter
+	for _, name := range req.Users {
+		user, err := userByName(s.unscoped(r), name)
+		if errors.Is(err, errs.NotFound) {
+			s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("unknown user %q", name)))
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		filter.UserIDs = append(filter.UserIDs, user.ID)
+	}
+	if req.CreatedBefore != nil {
+		filter.CreatedBefore = *req.CreatedBefore
+	}
+	if req.IPRange != "" {
+		prefix, err := parseIPRange(req.IPRange)
+		if err != nil {
+			s.writeError(w, r, errs.New(errs.Invalid, "ipRange must be an IP address or CIDR range"))
+			return
+		}
+		filter.IPRange = prefix
+	}
+	// Revoking every session is possible, but shouldn't be done by forgetting to fill in the criteria
+	if filter.Empty() {
+		s.writeError(w, r, errs.New(errs.Invalid, "at least one of users, createdBefore or ipRange is required"))
+		return
+	}
+
+	revoked := 0
+	for {
+		ids, err := s.unscoped(r).RevokeSessions(filter, sessionRevokeBatchSize)
+		revoked += len(ids)
+		if err != nil {
+			// Batches already revoked stay revoked, so say how far we got before failing
+			s.logger.Printf("ERROR: Bulk session revocation failed after revoking %d sessions: %v", revoked, err)
+			s.writeError(w, r, err)
+			return
+		}
+		if len(ids) < sessionRevokeBatchSize {
+			break
+		}
+	}
+	s.audit(r, "session.bulk_revoke", 0, fmt.Sprintf("revoked %d sessions matching users=%v createdBefore=%s ipRange=%s",
+		revoked, req.Users, filter.CreatedBefore.Format(time.RFC3339), req.IPRange))
+	s.writeJSON(w, r, http.StatusOK, sessionRevokeResponse{Revoked: revoked})
+}
+
+// expireSession ends the session in the {id} path parameter straight away, along with its refresh tokens so it can't
+// be refreshed back to life, for support to kill a session they've found to be compromised. The session's User is
+// emailed that our support team ended it, and when and where it was logged in, so they can tell us if they didn't ask
+// for it. Like revokeSessions, signed tokens can't be expired (see the token package), only database backed sessions.
+func (s *server) expireSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		s.writeError(w, r, errs.New(errs.Invalid, "session ID must be a positive number"))
+		return
+	}
+	session, err := s.unscoped(r).LoadSession(id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if session.RefreshFamily != "" {
+		if err := s.revokeRefreshFamily(r, session.RefreshFamily); err != nil {
+			s.writeError(w, r, errs.WithUser(err, session.UserID))
+			return
+		}
+	}
+	if err := s.unscoped(r).LogoutSession(session.ID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, session.UserID))
+		return
+	}
+	s.audit(r, "session.expire", session.UserID, fmt.Sprintf("session %d, created %s from %s",
+		session.ID, session.Created.Format(time.RFC3339), session.IP))
+
+	// The session has gone, so failing to let the User know shouldn't fail the request, but it is worth logging. A User
+	// deleted since has nobody left to tell.
+	where := "on " + session.Created.Format("2 January 2006")
+	if session.IP != "" {
+		where += " from " + session.IP
+	}
+	user, err := s.unscoped(r).GetUserByID(session.UserID)
+	if err == nil {
+		err = s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+			To:      user.Email,
+			Subject: "You've been logged out",
+			Body: fmt.Sprintf("Our support team has ended a session on your account, which was logged in %s. "+
+				"You'll need to log in again on that device.\n\n"+
+				"If you didn't ask for this, please contact support.", where),
+		})
+	}
+	if err != nil && !errors.Is(err, errs.NotFound) {
+		s.logger.Printf("ERROR: Unable to notify user %d of their session being expired: %v", session.UserID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseIPRange parses a CIDR range, or a single IP address as a range containing just that address.
+func parseIPRange(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
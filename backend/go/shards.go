@@ -0,0 +1,34 @@
+package main
+
+import (
+	"examples/database"
+	"examples/database/sharded"
+	"examples/database/sql"
+	"fmt"
+)
+
+// openShards connects to each of our further shards (see config.ShardURLs), checking every shard, including our home
+// shard, has been prepared with cmd/shards, and returns a Storer spreading our Users across them. Without further
+// shards it returns the home shard as it is. Each shard's pool of connections is limited by pool, and shards that can't
+// be reached yet are tried again as retry allows.
+func openShards(home *sql.DB, urls []string, pool sql.Pool, retry sql.Retry) (database.Storer, error) {
+	if len(urls) == 0 {
+		return home, nil
+	}
+	count := len(urls) + 1
+	if err := home.CheckShard(0, count); err != nil {
+		return nil, fmt.Errorf("shard 0: %w", err)
+	}
+	shards := []database.Storer{home}
+	for i, url := range urls {
+		shard, err := sql.NewSQLDB(url, pool, retry)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		if err := shard.CheckShard(i+1, count); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		shards = append(shards, shard)
+	}
+	return sharded.New(shards), nil
+}
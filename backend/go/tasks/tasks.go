@@ -0,0 +1,171 @@
+// tasks runs our background tasks (clearing expired sessions, enforcing retention, etc) each on its own schedule,
+// keeping track of when each last ran, how it went, and when it will next run. Having every task in one place lets
+// operators see at a glance whether a task is quietly failing, and run one straight away rather than waiting for its
+// next turn (say, after fixing whatever made it fail).
+package tasks
+
+import (
+	"context"
+	"errors"
+	"examples/clock"
+	"examples/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknown is returned when triggering a task that isn't registered
+var ErrUnknown = errors.New("no task with that name")
+
+// Func runs a task once, returning an error if it failed.
+type Func func(ctx context.Context) error
+
+// Status describes a task, and how its most recent run went.
+type Status struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"intervalNs"`
+	Running      bool          `json:"running"`
+	LastRun      time.Time     `json:"lastRun"` // Zero until the task has run once
+	LastDuration time.Duration `json:"lastDurationNs"`
+	LastError    string        `json:"lastError,omitempty"` // Empty if the last run succeeded
+	NextRun      time.Time     `json:"nextRun"`             // Zero if the task only runs when triggered
+}
+
+// task is a single registered task, along with its status.
+type task struct {
+	run     Func
+	trigger chan struct{} // Signalled to run the task now, holds at most one pending run
+	status  Status
+}
+
+// Runner runs a set of named tasks, each at its own interval.
+type Runner struct {
+	mu    sync.RWMutex
+	tasks map[string]*task
+}
+
+// New creates a Runner. Add tasks with Add, then call Run in its own goroutine.
+func New() *Runner {
+	return &Runner{tasks: make(map[string]*task)}
+}
+
+// Add registers a task with the given name, to be run every interval. A task with an interval of 0 (or less) only runs
+// when triggered. Tasks should all be added before calling Run.
+func (r *Runner) Add(name string, interval time.Duration, run Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tasks[name] = &task{
+		run:     run,
+		trigger: make(chan struct{}, 1),
+		status:  Status{Name: name, Interval: interval},
+	}
+}
+
+// Run runs every task on its own schedule until ctx is cancelled, each task first running one interval from now. A
+// task never runs more than once at a time.
+func (r *Runner) Run(ctx context.Context) {
+	r.mu.RLock()
+	var wg sync.WaitGroup
+	for name, t := range r.tasks {
+		wg.Add(1)
+		go func(name string, t *task) {
+			defer wg.Done()
+			r.loop(ctx, name, t)
+		}(name, t)
+	}
+	r.mu.RUnlock()
+	wg.Wait()
+}
+
+// loop runs a single task every interval, or sooner when triggered, until ctx is cancelled.
+func (r *Runner) loop(ctx context.Context, name string, t *task) {
+	interval := t.status.Interval
+	if interval <= 0 {
+		// Never scheduled, so only ever run when triggered
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.trigger:
+				r.runOnce(ctx, name, t)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	t.status.NextRun = clock.Now().Add(interval)
+	r.mu.Unlock()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-t.trigger:
+			// Running early restarts the schedule, so the task doesn't run again moments later
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		r.runOnce(ctx, name, t)
+		timer.Reset(interval)
+	}
+}
+
+// runOnce runs a task a single time, recording how it went.
+func (r *Runner) runOnce(ctx context.Context, name string, t *task) {
+	r.mu.Lock()
+	t.status.Running = true
+	r.mu.Unlock()
+
+	start := time.Now()
+	err := t.run(ctx)
+	took := time.Since(start)
+	metrics.ObserveJob(name, took, err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.status.Running = false
+	t.status.LastRun = clock.UTC(start)
+	t.status.LastDuration = took
+	t.status.LastError = ""
+	if err != nil {
+		t.status.LastError = err.Error()
+	}
+	if t.status.Interval > 0 {
+		t.status.NextRun = clock.Now().Add(t.status.Interval)
+	}
+}
+
+// Trigger runs a task as soon as possible, rather than waiting for its next turn. If the task is already running, it
+// runs again once it finishes, and triggering it any more times before then has no further effect.
+func (r *Runner) Trigger(name string) error {
+	r.mu.RLock()
+	t, ok := r.tasks[name]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrUnknown
+	}
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+		// A run is already pending
+	}
+	return nil
+}
+
+// Statuses describes every task, sorted by name.
+func (r *Runner) Statuses() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make([]Status, 0, len(r.tasks))
+	for _, t := range r.tasks {
+		statuses = append(statuses, t.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
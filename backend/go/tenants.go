@@ -0,0 +1,210 @@
+package main
+
+import (
+	"examples/database"
+	"examples/errs"
+	"examples/password"
+	"examples/tenants"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPasswordMinLength is the longest minimum password length a tenant may ask for, anything longer is more likely a
+// typo than a policy anyone could meet
+const maxPasswordMinLength = 128
+
+// tenantSettingsRequest is the body expected when saving a tenant's settings. Anything left empty (or 0) isn't
+// overridden, so our own setting applies to the tenant's members. Durations are written like "30m" or "720h".
+type tenantSettingsRequest struct {
+	IdleTimeout         string   `json:"idleTimeout,omitempty"`
+	MaxLifetime         string   `json:"maxLifetime,omitempty"`
+	RememberIdleTimeout string   `json:"rememberIdleTimeout,omitempty"`
+	RememberLifetime    string   `json:"rememberLifetime,omitempty"`
+	PasswordMinLength   int      `json:"passwordMinLength,omitempty"`
+	AllowedOrigins      []string `json:"allowedOrigins,omitempty"` // Such as https://portal.example.com
+}
+
+// tenantSettingsResponse describes the settings a tenant has overridden, durations written like "30m0s".
+type tenantSettingsResponse struct {
+	TenantID            int64     `json:"tenantId"`
+	IdleTimeout         string    `json:"idleTimeout,omitempty"`
+	MaxLifetime         string    `json:"maxLifetime,omitempty"`
+	RememberIdleTimeout string    `json:"rememberIdleTimeout,omitempty"`
+	RememberLifetime    string    `json:"rememberLifetime,omitempty"`
+	PasswordMinLength   int       `json:"passwordMinLength,omitempty"`
+	AllowedOrigins      []string  `json:"allowedOrigins,omitempty"`
+	Updated             time.Time `json:"updated"`
+}
+
+// formatOverride writes a duration a tenant has overridden for clients, or nothing if they haven't.
+func formatOverride(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// newTenantSettingsResponse describes TenantSettings for clients.
+func newTenantSettingsResponse(settings database.TenantSettings) tenantSettingsResponse {
+	return tenantSettingsResponse{
+		TenantID:            settings.TenantID,
+		IdleTimeout:         formatOverride(settings.IdleTimeout),
+		MaxLifetime:         formatOverride(settings.MaxLifetime),
+		RememberIdleTimeout: formatOverride(settings.RememberIdleTimeout),
+		RememberLifetime:    formatOverride(settings.RememberLifetime),
+		PasswordMinLength:   settings.PasswordMinLength,
+		AllowedOrigins:      settings.AllowedOrigins,
+		Updated:             settings.Updated,
+	}
+}
+
+// tenantID reads the tenant (dealership) ID from the {id} path parameter.
+func tenantID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errs.New(errs.Invalid, "tenant ID must be a positive number")
+	}
+	return id, nil
+}
+
+// listTenantSettings lists the settings of every tenant that has overridden any.
+func (s *server) listTenantSettings(w http.ResponseWriter, r *http.Request) {
+	list, err := s.unscoped(r).ListTenantSettings()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]tenantSettingsResponse, 0, len(list))
+	for _, settings := range list {
+		resp = append(resp, newTenantSettingsResponse(settings))
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getTenantSettings shows the settings the tenant in the {id} path parameter has overridden.
+func (s *server) getTenantSettings(w http.ResponseWriter, r *http.Request) {
+	id, err := tenantID(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	settings, err := s.unscoped(r).GetTenantSettings(id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, newTenantSettingsResponse(settings))
+}
+
+// saveTenantSettings replaces the settings the tenant in the {id} path parameter has overridden. Every instance of our
+// API picks the change up within our tenant cache's TTL, this one straight away.
+func (s *server) saveTenantSettings(w http.ResponseWriter, r *http.Request) {
+	id, err := tenantID(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var req tenantSettingsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	settings, err := s.parseTenantSettings(req)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	settings.TenantID = id
+	if err := s.unscoped(r).SaveTenantSettings(&settings); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.tenants.Forget()
+	s.audit(r, "tenant.settings_update", 0, fmt.Sprintf("tenant %d", id))
+	s.writeJSON(w, r, http.StatusOK, newTenantSettingsResponse(settings))
+}
+
+// deleteTenantSettings removes the settings the tenant in the {id} path parameter has overridden, so our own apply to
+// its members again.
+func (s *server) deleteTenantSettings(w http.ResponseWriter, r *http.Request) {
+	id, err := tenantID(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.unscoped(r).DeleteTenantSettings(id); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.tenants.Forget()
+	s.audit(r, "tenant.settings_delete", 0, fmt.Sprintf("tenant %d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTenantSettings checks a tenant's settings make sense, returning an Invalid error describing the first problem
+// if not. Tenants may make passwords stricter but not weaker, and their session lifespans must fit together in the
+// same way ours must, counting any they haven't overridden as ours.
+func (s *server) parseTenantSettings(req tenantSettingsRequest) (database.TenantSettings, error) {
+	var settings database.TenantSettings
+	durations := []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{"idleTimeout", req.IdleTimeout, &settings.IdleTimeout},
+		{"maxLifetime", req.MaxLifetime, &settings.MaxLifetime},
+		{"rememberIdleTimeout", req.RememberIdleTimeout, &settings.RememberIdleTimeout},
+		{"rememberLifetime", req.RememberLifetime, &settings.RememberLifetime},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		// Lifespans are stored in whole seconds
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed < time.Second || parsed%time.Second != 0 {
+			return database.TenantSettings{}, errs.New(errs.Invalid, d.name+" must be a whole number of seconds, such as 30m or 720h")
+		}
+		*d.into = parsed
+	}
+	lifespans := tenants.Lifespans(settings, s.sessions)
+	if lifespans.IdleTimeout > lifespans.MaxLifetime {
+		return database.TenantSettings{}, errs.New(errs.Invalid, fmt.Sprintf("idleTimeout (%s) must not be longer than maxLifetime (%s)",
+			lifespans.IdleTimeout, lifespans.MaxLifetime))
+	}
+	if lifespans.RememberIdleTimeout > lifespans.RememberLifetime {
+		return database.TenantSettings{}, errs.New(errs.Invalid, fmt.Sprintf("rememberIdleTimeout (%s) must not be longer than rememberLifetime (%s)",
+			lifespans.RememberIdleTimeout, lifespans.RememberLifetime))
+	}
+
+	if req.PasswordMinLength != 0 && (req.PasswordMinLength < password.MinLength || req.PasswordMinLength > maxPasswordMinLength) {
+		return database.TenantSettings{}, errs.New(errs.Invalid, fmt.Sprintf("passwordMinLength must be between %d and %d", password.MinLength, maxPasswordMinLength))
+	}
+	settings.PasswordMinLength = req.PasswordMinLength
+
+	for _, origin := range req.AllowedOrigins {
+		normalized, ok := parseOrigin(origin)
+		if !ok {
+			return database.TenantSettings{}, errs.New(errs.Invalid, fmt.Sprintf("%q is not an origin, such as https://portal.example.com", origin))
+		}
+		settings.AllowedOrigins = append(settings.AllowedOrigins, normalized)
+	}
+	return settings, nil
+}
+
+// parseOrigin checks an origin is just a scheme and host (and perhaps a port), as browsers send in the Origin header,
+// returning it lowercased. Wildcards aren't origins, a tenant can't open our API to everyone.
+func parseOrigin(origin string) (string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Contains(u.Host, "*") ||
+		u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
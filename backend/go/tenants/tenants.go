@@ -0,0 +1,244 @@
+// tenants applies the settings each tenant (a dealership) has overridden for its members: how long their sessions
+// last, how long their passwords must be, and which extra origins browsers may call us from. The overrides are kept
+// in our database (see database.TenantSettings), but they're needed on every authenticated request, so we keep them in
+// memory, reloading them every TTL. Which tenants each User belongs to is kept the same way.
+//
+// A User can belong to several tenants, in which case they get the strictest of their tenants' settings: the shortest
+// sessions and the longest passwords. A tenant that hasn't overridden a setting counts as having chosen ours, so a User
+// in two tenants, only one of which allows longer sessions, keeps our session lifespans. Users who aren't in any
+// tenant always get ours.
+//
+// Changes made through our admin endpoints call Forget, so this instance sees them straight away. Other instances of
+// our API see them once their copy expires.
+package tenants
+
+import (
+	"examples/config"
+	"examples/database"
+	"examples/metrics"
+	"examples/password"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache looks up the settings that apply to each User, keeping what it loads for a TTL.
+type Cache struct {
+	db       database.Storer
+	defaults config.SessionLifespans // Our own session lifespans, for anything a tenant hasn't overridden
+	ttl      time.Duration
+
+	group singleflight.Group // Collapses concurrent loads of the same thing
+
+	mu         sync.Mutex
+	settings   map[int64]database.TenantSettings // Every tenant's settings, by tenant ID
+	origins    []string                          // Every tenant's allowed origins, lowercased
+	loaded     time.Time                         // When settings was loaded, the zero time if it needs loading
+	members    map[int64]memberships             // Which tenants each User belongs to, by User ID
+	generation uint64                            // Bumped whenever we forget something, so a load that raced the change isn't kept
+	swept      time.Time                         // When expired memberships were last cleared out
+}
+
+// memberships is the tenants a User belongs to, along with when we stop trusting our copy.
+type memberships struct {
+	tenants []int64
+	expires time.Time
+}
+
+// New creates a Cache that loads tenant settings from db, keeping them for ttl. Settings a tenant hasn't overridden are
+// taken from defaults and our default password policy.
+func New(db database.Storer, defaults config.SessionLifespans, ttl time.Duration) *Cache {
+	return &Cache{db: db, defaults: defaults, ttl: ttl, members: make(map[int64]memberships)}
+}
+
+// SessionLifespans returns how long a User's sessions last, the shortest of each lifespan among their tenants.
+func (c *Cache) SessionLifespans(userID int64) (config.SessionLifespans, error) {
+	tenants, err := c.tenantsOf(userID)
+	if err != nil || len(tenants) == 0 {
+		return c.defaults, err
+	}
+	lifespans := config.SessionLifespans{}
+	for i, settings := range tenants {
+		// Each tenant's lifespans are checked to fit together when saved, so the shortest of each still fit together
+		tenant := Lifespans(settings, c.defaults)
+		if i == 0 {
+			lifespans = tenant
+			continue
+		}
+		lifespans.IdleTimeout = min(lifespans.IdleTimeout, tenant.IdleTimeout)
+		lifespans.MaxLifetime = min(lifespans.MaxLifetime, tenant.MaxLifetime)
+		lifespans.RememberIdleTimeout = min(lifespans.RememberIdleTimeout, tenant.RememberIdleTimeout)
+		lifespans.RememberLifetime = min(lifespans.RememberLifetime, tenant.RememberLifetime)
+	}
+	return lifespans, nil
+}
+
+// PasswordPolicy returns the policy a User's new passwords must meet, the longest minimum length among their tenants.
+func (c *Cache) PasswordPolicy(userID int64) (password.Policy, error) {
+	policy := password.DefaultPolicy
+	tenants, err := c.tenantsOf(userID)
+	if err != nil {
+		return policy, err
+	}
+	for _, settings := range tenants {
+		policy.MinLength = max(policy.MinLength, settings.PasswordMinLength)
+	}
+	return policy, nil
+}
+
+// OriginAllowed reports whether any tenant allows browsers to call us from origin. We don't know who's calling when
+// checking CORS (a preflight request carries no credentials), so an origin any tenant allows is allowed for everyone.
+func (c *Cache) OriginAllowed(origin string) (bool, error) {
+	if err := c.load(); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.origins, strings.ToLower(origin)), nil
+}
+
+// Forget drops every tenant's settings, so they're loaded again the next time they're needed. Call it after changing
+// any tenant's settings.
+func (c *Cache) Forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = time.Time{}
+	c.generation++
+}
+
+// ForgetUser drops which tenants a User belongs to, so it's loaded again the next time it's needed. Call it after
+// adding or removing a User's dealership memberships.
+func (c *Cache) ForgetUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members, userID)
+	c.generation++
+}
+
+// Lifespans returns the session lifespans a tenant's settings give its members, taking any the tenant hasn't overridden
+// from ours.
+func Lifespans(settings database.TenantSettings, ours config.SessionLifespans) config.SessionLifespans {
+	return config.SessionLifespans{
+		IdleTimeout:         override(settings.IdleTimeout, ours.IdleTimeout),
+		MaxLifetime:         override(settings.MaxLifetime, ours.MaxLifetime),
+		RememberIdleTimeout: override(settings.RememberIdleTimeout, ours.RememberIdleTimeout),
+		RememberLifetime:    override(settings.RememberLifetime, ours.RememberLifetime),
+	}
+}
+
+// override returns a tenant's setting, or ours if the tenant hasn't overridden it.
+func override(tenant, ours time.Duration) time.Duration {
+	if tenant > 0 {
+		return tenant
+	}
+	return ours
+}
+
+// tenantsOf returns the settings of each tenant a User belongs to that has overridden any.
+func (c *Cache) tenantsOf(userID int64) ([]database.TenantSettings, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	ids, err := c.membershipsOf(userID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tenants []database.TenantSettings
+	for _, id := range ids {
+		if settings, ok := c.settings[id]; ok {
+			tenants = append(tenants, settings)
+		}
+	}
+	return tenants, nil
+}
+
+// load makes sure we have every tenant's settings, loading them (once, however many requests are asking at the same
+// time) if ours have expired.
+func (c *Cache) load() error {
+	c.mu.Lock()
+	fresh := !c.loaded.IsZero() && time.Since(c.loaded) < c.ttl
+	c.mu.Unlock()
+	if fresh {
+		metrics.ObserveCache("tenants", "hit")
+		return nil
+	}
+	metrics.ObserveCache("tenants", "miss")
+
+	_, err, _ := c.group.Do("settings", func() (any, error) {
+		c.mu.Lock()
+		generation := c.generation
+		c.mu.Unlock()
+		list, err := c.db.ListTenantSettings()
+		if err != nil {
+			return nil, err
+		}
+		settings := make(map[int64]database.TenantSettings, len(list))
+		var origins []string
+		for _, tenant := range list {
+			settings[tenant.TenantID] = tenant
+			for _, origin := range tenant.AllowedOrigins {
+				origins = append(origins, strings.ToLower(origin))
+			}
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.settings = settings
+		c.origins = origins
+		// What we loaded is still used by whoever's waiting on it, but if the settings changed since we started
+		// loading it may already be out of date, so isn't kept for anyone else
+		if c.generation == generation {
+			c.loaded = time.Now()
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// membershipsOf returns the IDs of the tenants a User belongs to, loading them if ours have expired.
+func (c *Cache) membershipsOf(userID int64) ([]int64, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.members[userID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.tenants, nil
+	}
+
+	loaded, err, _ := c.group.Do("members:"+strconv.FormatInt(userID, 10), func() (any, error) {
+		c.mu.Lock()
+		generation := c.generation
+		c.mu.Unlock()
+		ids, err := c.db.ListUserDealerships(userID)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.generation == generation {
+			c.members[userID] = memberships{tenants: ids, expires: now.Add(c.ttl)}
+		}
+		// Users we haven't seen for a while would otherwise stay in memory forever
+		if now.Sub(c.swept) > c.ttl {
+			for id, entry := range c.members {
+				if now.After(entry.expires) {
+					delete(c.members, id)
+				}
+			}
+			c.swept = now
+		}
+		return ids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loaded.([]int64), nil
+}
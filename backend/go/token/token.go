@@ -0,0 +1,104 @@
+// token issues and verifies signed JSON Web Tokens (JWTs), for our stateless session mode. Unlike our database backed
+// sessions, a JWT carries everything needed to check it (who it's for, and when it expires) along with a signature
+// proving we issued it, so verifying one never touches the database.
+//
+// The tradeoff is that a JWT can't be revoked: it's valid until it expires, even after logging out. So keep their
+// lifetimes short, and prefer database backed sessions when being able to end a session immediately matters.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// issuer is who our tokens say issued them, and audience who they're intended for. Checking both means a token issued
+// for some other purpose (even one signed with the same key) is never accepted here.
+const (
+	issuer   = "examples"
+	audience = "examples-api"
+)
+
+// Errors returned by Verify
+var (
+	ErrInvalid = errors.New("token is invalid")  // Returned for any token that isn't valid, other than by expiring
+	ErrExpired = errors.New("token has expired") // Returned for a token that was valid, but has since expired
+)
+
+// Claims are what our tokens say about their holder.
+type Claims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+	// Family is the refresh token family the token was issued from, so logging out can revoke it
+	Family string `json:"fam,omitempty"`
+}
+
+// UserID returns the ID of the User the token was issued to.
+func (c Claims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// Issuer issues and verifies tokens with a single key.
+type Issuer struct {
+	key      []byte
+	lifetime time.Duration
+}
+
+// NewIssuer returns an Issuer whose tokens last for lifetime, with a key derived from secret (which should be at least
+// 32 random bytes). Deriving our own key means an existing secret (such as our session key) can be reused, without a
+// token ever being valid anywhere else that secret is used.
+func NewIssuer(secret []byte, lifetime time.Duration) *Issuer {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("token"))
+	return &Issuer{key: m.Sum(nil), lifetime: lifetime}
+}
+
+// Issue creates a token for a User from the given refresh token family, returning it along with when it expires.
+func (i *Issuer) Issue(userID int64, email, family string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(i.lifetime)
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			Subject:   strconv.FormatInt(userID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		Email:  email,
+		Family: family,
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(i.key)
+	return signed, expires, err
+}
+
+// Verify checks a token's signature, expiry, issuer and audience, returning its claims if it's valid.
+func (i *Issuer) Verify(signed string) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(signed, &claims, func(*jwt.Token) (any, error) {
+		return i.key, nil
+	},
+		// Only accept the algorithm we sign with, never let the token choose (the classic "alg: none" attack)
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	// The signature is checked before expiry, so a token reported as expired is one we really did issue
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return Claims{}, ErrExpired
+	}
+	if err != nil {
+		return Claims{}, ErrInvalid
+	}
+	if _, err := claims.UserID(); err != nil {
+		return Claims{}, ErrInvalid
+	}
+	return claims, nil
+}
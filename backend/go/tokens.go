@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// newToken generates a random, unguessable token for links we email out (such as confirming an email change). Only
+// the hash of the token should ever be stored, so someone able to read our database still can't use the tokens in it.
+func newToken() (token string, hash []byte, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a token for storage or lookup. Tokens are long and random, so a fast hash like SHA-256 is all that's
+// needed (unlike passwords, which need a deliberately slow hash).
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,86 @@
+// totp generates and checks time-based one-time passwords (TOTP, RFC 6238), the 6 digit codes shown by authenticator
+// apps such as Google Authenticator or 1Password. The app and our server share a secret, and each derives the current
+// code from that secret and the time, so a code proves the User has the device holding the secret.
+//
+// We use the same settings as nearly every authenticator app expects by default: HMAC-SHA1, 6 digits, and a new code
+// every 30 seconds. Changing any of these means some apps will quietly generate the wrong codes.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Our TOTP settings
+const (
+	period     = 30 // Seconds each code is valid for
+	digits     = 6
+	secretSize = 20 // Bytes, the size of an SHA-1 output as RFC 4226 recommends
+	// skew is how many periods either side of the current one we also accept, allowing for a clock that's a little off
+	// on the User's device, and for the time it takes to type a code in
+	skew = 1
+)
+
+// encoding is how secrets are written out, base32 without padding is what authenticator apps expect
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret generates a new random secret, base32 encoded.
+func NewSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI returns the otpauth:// provisioning URI for a secret, which authenticator apps can import. Shown as a QR code,
+// Users can enroll by scanning it rather than typing the secret in. issuer names our service in the app, and account
+// names the User (such as their email).
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(period))
+	// The label is "issuer:account", with the issuer repeated as a parameter for apps that predate it
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Check reports whether code is valid for the secret at time t. When it is, it also returns the time step the code
+// was for: a code stays valid for a little while (see skew), so the caller should only accept a step later than the
+// last one it accepted, otherwise someone who watched a code being typed could use it again.
+func Check(secret, code string, t time.Time) (step int64, ok bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != digits {
+		return 0, false
+	}
+	now := t.Unix() / period
+	for s := now - skew; s <= now+skew; s++ {
+		// Compare in constant time, so how long a wrong guess takes doesn't reveal how close it was
+		if subtle.ConstantTimeCompare([]byte(generate(key, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// generate returns the code for a key at the given time step (RFC 4226 section 5.3).
+func generate(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	// Dynamic truncation, take 4 bytes from an offset given by the last nibble of the HMAC
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
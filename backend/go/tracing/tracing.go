@@ -0,0 +1,204 @@
+// tracing exports traces of the requests we serve to an OpenTelemetry collector, sampling each group of routes at its
+// own rate (see Sampler). Tracing every request is rarely worth what it costs to send and keep, but the requests we
+// care most about (such as logins) should always be traced, while health checks polled every few seconds hardly ever
+// need to be.
+//
+// Requests that fail with a server error are always exported, whatever their route's rate. Whether a request fails
+// isn't known until it's finished, so spans the sampler doesn't pick are still recorded (in memory, a span per
+// request), and only thrown away when they end without an error.
+package tracing
+
+import (
+	"context"
+	"examples/clock"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GroupKey is the span attribute naming the group of routes a request belongs to, which our Sampler picks a rate by.
+// It must be given when the span is started, as that's when sampling is decided.
+const GroupKey = attribute.Key("route.group")
+
+// DefaultGroup names the rate used for groups without one of their own, when overriding it.
+const DefaultGroup = "default"
+
+// Start exports traces to an OpenTelemetry collector, sampled by sampler, and makes this the global tracer provider
+// (see otel.Tracer). Incoming requests may carry a W3C traceparent header, continuing a trace started by whoever called
+// us.
+//
+// Where to send traces is configured with the standard OpenTelemetry environment variables, such as
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS. The returned function flushes any remaining spans and
+// stops exporting, it should be called on shutdown.
+func Start(ctx context.Context, sampler *Sampler) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithSpanProcessor(keepErrors{sdktrace.NewBatchSpanProcessor(exporter)}),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Override is a sampling rate set while we're running, replacing the configured rate for a group.
+type Override struct {
+	Rate    float64
+	Expires time.Time // When the configured rate applies again, zero if only once the override is removed
+}
+
+// Rates describes every sampling rate a Sampler has.
+type Rates struct {
+	Default   float64             // For groups without a rate of their own
+	Groups    map[string]float64  // Configured rates, by group
+	Overrides map[string]Override // Unexpired overrides, by group (DefaultGroup for Default)
+}
+
+// Sampler decides which requests are traced, by the rate for their group of routes: a rate of 1 traces every request,
+// and 0 none of them (other than those that fail). Rates can be overridden while we're running, such as to trace
+// everything in a group for a while when looking into a problem. It's safe for concurrent use.
+//
+// A request continuing a trace someone else sampled is always sampled too, so the trace isn't missing our part.
+type Sampler struct {
+	mu        sync.RWMutex
+	rate      float64
+	groups    map[string]float64
+	overrides map[string]Override
+}
+
+// NewSampler creates a Sampler using rate for any group of routes without its own rate in groups.
+func NewSampler(rate float64, groups map[string]float64) *Sampler {
+	return &Sampler{rate: rate, groups: groups, overrides: make(map[string]Override)}
+}
+
+// Rate returns the sampling rate currently used for a group of routes.
+func (s *Sampler) Rate(group string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := clock.Now()
+	if o, ok := s.overrides[group]; ok && o.live(now) {
+		return o.Rate
+	}
+	if rate, ok := s.groups[group]; ok {
+		return rate
+	}
+	if o, ok := s.overrides[DefaultGroup]; ok && o.live(now) {
+		return o.Rate
+	}
+	return s.rate
+}
+
+// Override replaces the rate for a group of routes (or with DefaultGroup, for every group without its own) until
+// expires, or until it's removed if expires is zero.
+func (s *Sampler) Override(group string, rate float64, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[group] = Override{Rate: rate, Expires: expires}
+}
+
+// RemoveOverride goes back to the configured rate for a group of routes, reporting whether it was overridden.
+func (s *Sampler) RemoveOverride(group string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.overrides[group]
+	delete(s.overrides, group)
+	return ok && o.live(clock.Now())
+}
+
+// Rates returns a copy of every rate we have, leaving out expired overrides.
+func (s *Sampler) Rates() Rates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rates := Rates{Default: s.rate, Groups: make(map[string]float64, len(s.groups)), Overrides: make(map[string]Override)}
+	for group, rate := range s.groups {
+		rates.Groups[group] = rate
+	}
+	now := clock.Now()
+	for group, o := range s.overrides {
+		if o.live(now) {
+			rates.Overrides[group] = o
+		}
+	}
+	return rates
+}
+
+// live reports whether an override still applies.
+func (o Override) live(now time.Time) bool {
+	return o.Expires.IsZero() || now.Before(o.Expires)
+}
+
+// ShouldSample implements sdktrace.Sampler. Spans that aren't sampled are still recorded, so keepErrors can export
+// them if they fail.
+func (s *Sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	result := sdktrace.SamplingResult{Decision: sdktrace.RecordOnly, Tracestate: parent.TraceState()}
+	if parent.IsSampled() {
+		result.Decision = sdktrace.RecordAndSample
+		return result
+	}
+	var group string
+	for _, attr := range p.Attributes {
+		if attr.Key == GroupKey {
+			group = attr.Value.AsString()
+		}
+	}
+	// The trace ID is already random, so deciding by it (as TraceIDRatioBased does) saves generating another number,
+	// and every service sampling at the same rate agrees on the same traces
+	if traceIDRatio(p.TraceID) < s.Rate(group) {
+		result.Decision = sdktrace.RecordAndSample
+	}
+	return result
+}
+
+// Description implements sdktrace.Sampler.
+func (s *Sampler) Description() string {
+	return fmt.Sprintf("RouteGroupSampler{default=%g}", s.Rate(DefaultGroup))
+}
+
+// traceIDRatio maps a trace ID to a number in [0, 1), from its last 63 bits (the same ones TraceIDRatioBased uses).
+func traceIDRatio(id trace.TraceID) float64 {
+	var x uint64
+	for _, b := range id[8:] {
+		x = x<<8 | uint64(b)
+	}
+	return float64(x>>1) / (1 << 63)
+}
+
+// keepErrors passes sampled spans on to the next processor (our batch exporter), along with any that weren't sampled
+// but ended in an error. Others were only recorded in case they failed, and are dropped.
+type keepErrors struct {
+	sdktrace.SpanProcessor
+}
+
+// OnEnd implements sdktrace.SpanProcessor.
+func (p keepErrors) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		p.SpanProcessor.OnEnd(s)
+		return
+	}
+	if s.Status().Code == codes.Error {
+		p.SpanProcessor.OnEnd(sampledSpan{s})
+	}
+}
+
+// sampledSpan marks a span as sampled, as our batch exporter drops any that aren't.
+type sampledSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+// SpanContext implements sdktrace.ReadOnlySpan.
+func (s sampledSpan) SpanContext() trace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/requestctx"
+	"examples/totp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication (2FA) means logging in takes a code from the User's authenticator app as well as their
+// password. Enrolling takes two requests: the first generates a secret for the User to add to their app, the second
+// takes a code from the app, proving it's set up correctly, and only then is 2FA enabled. Until then, a User who gives
+// up part way through can still log in with just their password.
+//
+// Once enabled, logging in also takes two requests. A correct password (or OAuth login) gets a challenge rather than a
+// session, which is then swapped for a session at /login/2fa along with a code.
+const (
+	// twoFactorIssuer names our service in the User's authenticator app
+	twoFactorIssuer = "Examples"
+	// twoFactorChallengeLifetime is how long a User has to enter their code after entering their password
+	twoFactorChallengeLifetime = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes a User is given when enabling 2FA, each can be used once to log in
+	// without their authenticator app, in case they lose it
+	recoveryCodeCount = 10
+)
+
+// recoveryCodeEncoding writes out recovery codes, base32 avoids characters that are easily confused when written down
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactorEnrollResponse is returned when starting to enroll in 2FA.
+type twoFactorEnrollResponse struct {
+	Secret string `json:"secret"` // For typing in to an authenticator app by hand
+	URI    string `json:"uri"`    // otpauth:// provisioning URI, show this as a QR code for the User to scan
+}
+
+// twoFactorCodeRequest is the body expected when confirming or disabling 2FA.
+type twoFactorCodeRequest struct {
+	Code string `json:"code"` // A code from the User's authenticator app, or (when disabling) a recovery code
+}
+
+// twoFactorEnabledResponse is returned once 2FA is enabled.
+type twoFactorEnabledResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"` // Only ever shown this once, the User should keep them somewhere safe
+}
+
+// twoFactorChallengeResponse is returned instead of a session when a User with 2FA enabled logs in.
+type twoFactorChallengeResponse struct {
+	TwoFactorRequired bool      `json:"twoFactorRequired"` // Always true, so clients can tell this apart from a session
+	Challenge         string    `json:"challenge"`         // Send this back to /login/2fa along with a code
+	Expires           time.Time `json:"expires"`
+}
+
+// twoFactorLoginRequest is the body expected by the second step of logging in.
+type twoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // A code from the User's authenticator app, or a recovery code
+}
+
+// twoFactorChallenge is what a challenge holds. It's encrypted with our session key, so clients can't read or forge
+// one, and we don't need to store anything between the two steps.
+type twoFactorChallenge struct {
+	UserID   int64     `json:"userId"`
+	Expires  time.Time `json:"expires"`
+	Remember bool      `json:"remember"` // Whether the User asked to be remembered in the first step
+}
+
+// selfTwoFactor loads the User named in the request for changing their 2FA, which Users may only do for themselves.
+func (s *server) selfTwoFactor(r *http.Request) (database.User, error) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		return database.User{}, err
+	}
+	if self, _ := requestctx.User(r.Context()); self.ID != user.ID {
+		return database.User{}, errs.New(errs.Forbidden, "you may only change your own two-factor authentication")
+	}
+	return user, nil
+}
+
+// twoFactorEnroll starts enrolling a User in 2FA, generating a new secret for their authenticator app. 2FA isn't
+// enabled until they confirm a code from the app (see twoFactorConfirm).
+func (s *server) twoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	user, err := s.selfTwoFactor(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "twoFactorEnroll"), user.ID))
+		return
+	}
+	// The secret is all anyone needs to generate codes, so it's encrypted just like session credentials
+	encrypted, err := s.encrypter.Seal([]byte(secret))
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "twoFactorEnroll"), user.ID))
+		return
+	}
+	if err := s.dbFor(r).SaveTwoFactor(&database.TwoFactor{UserID: user.ID, EncryptedSecret: encrypted}); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, twoFactorEnrollResponse{
+		Secret: secret,
+		URI:    totp.URI(twoFactorIssuer, user.Email, secret),
+	})
+}
+
+// twoFactorConfirm finishes enrolling a User in 2FA, once they've proven their authenticator app is set up by sending
+// us a code from it. Responds with their recovery codes.
+func (s *server) twoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	user, err := s.selfTwoFactor(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var req twoFactorCodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	tf, err := s.dbFor(r).GetTwoFactor(user.ID)
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.Invalid, "start enrolling in two-factor authentication first"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if tf.Enabled {
+		s.writeError(w, r, database.ErrTwoFactorEnabled)
+		return
+	}
+	// Only codes from the authenticator app will do here, the User doesn't have any recovery codes yet
+	ok, err := s.checkTOTP(r, tf, req.Code)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if !ok {
+		s.writeError(w, r, errs.New(errs.Invalid, "invalid code, check your authenticator app's clock is correct"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "twoFactorConfirm"), user.ID))
+		return
+	}
+	if err := s.dbFor(r).EnableTwoFactor(user.ID, hashes); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.2fa_enable", user.ID, "")
+	s.securityEvent(r, eventTwoFactorEnabled, user.ID, "")
+	s.writeJSON(w, r, http.StatusOK, twoFactorEnabledResponse{RecoveryCodes: codes})
+}
+
+// twoFactorDisable turns off a User's 2FA. Being logged in isn't enough, they must also send a current code (or a
+// recovery code), so someone who gets hold of a session can't simply turn it off.
+func (s *server) twoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user, err := s.selfTwoFactor(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var req twoFactorCodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	tf, err := s.dbFor(r).GetTwoFactor(user.ID)
+	if errors.Is(err, errs.NotFound) {
+		// Nothing to disable, which is what the User wanted anyway
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	// A pending enrollment can be thrown away without a code, it was never protecting anything
+	if tf.Enabled {
+		ok, err := s.checkSecondFactor(r, tf, req.Code)
+		if err != nil {
+			s.writeError(w, r, errs.WithUser(err, user.ID))
+			return
+		}
+		if !ok {
+			s.writeError(w, r, errs.New(errs.Invalid, "invalid code"))
+			return
+		}
+	}
+	if err := s.dbFor(r).DeleteTwoFactor(user.ID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if tf.Enabled {
+		s.audit(r, "user.2fa_disable", user.ID, "")
+		s.securityEvent(r, eventTwoFactorDisabled, user.ID, "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// continueLogin is called once a User has proven who they are with a password or an OAuth provider. Users with 2FA
+// enabled are sent a challenge to complete with a code (see twoFactorLogin), anyone else is logged in straight away.
+func (s *server) continueLogin(w http.ResponseWriter, r *http.Request, user database.User, remember bool) {
+	tf, err := s.unscoped(r).GetTwoFactor(user.ID)
+	if err != nil && !errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if !tf.Enabled {
+		s.finishLogin(w, r, user, remember)
+		return
+	}
+
+	challenge := twoFactorChallenge{UserID: user.ID, Expires: clock.Now().Add(twoFactorChallengeLifetime), Remember: remember}
+	plain, err := json.Marshal(challenge)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "continueLogin"), user.ID))
+		return
+	}
+	sealed, err := s.encrypter.Seal(plain)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(errs.Wrap(err, "continueLogin"), user.ID))
+		return
+	}
+	// 202 Accepted, as the User isn't logged in until they complete the challenge
+	s.writeJSON(w, r, http.StatusAccepted, twoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		Challenge:         base64.RawURLEncoding.EncodeToString(sealed),
+		Expires:           challenge.Expires,
+	})
+}
+
+// twoFactorLogin is the second step of logging in for Users with 2FA enabled, swapping the challenge they were given
+// after the first step (along with a code) for a session.
+func (s *server) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorLoginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	invalid := errs.New(errs.Unauthorized, "invalid or expired login, please log in again")
+	sealed, err := base64.RawURLEncoding.DecodeString(req.Challenge)
+	if err != nil {
+		s.writeError(w, r, invalid)
+		return
+	}
+	plain, err := s.encrypter.Open(sealed)
+	if err != nil {
+		s.writeError(w, r, invalid)
+		return
+	}
+	var challenge twoFactorChallenge
+	if err := json.Unmarshal(plain, &challenge); err != nil || time.Now().After(challenge.Expires) {
+		s.writeError(w, r, invalid)
+		return
+	}
+
+	// Reload the User, they may have been disabled or locked since the first step
+	user, err := s.activeUser(r, challenge.UserID)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	locked := errs.New(errs.Locked, "account locked after too many failed logins, please contact support")
+	if user.Locked {
+		s.writeError(w, r, locked)
+		return
+	}
+	tf, err := s.unscoped(r).GetTwoFactor(user.ID)
+	if errors.Is(err, errs.NotFound) || (err == nil && !tf.Enabled) {
+		// They've turned 2FA off since the first step, so the challenge is stale
+		s.writeError(w, r, invalid)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	ok, err := s.checkSecondFactor(r, tf, req.Code)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	if !ok {
+		// Wrong codes count towards locking the account just like wrong passwords, otherwise someone who knows the
+		// password could keep guessing codes
+		s.failedLogin(w, r, user, errs.New(errs.Unauthorized, "invalid code"), locked)
+		return
+	}
+	s.finishLogin(w, r, user, challenge.Remember)
+}
+
+// checkSecondFactor reports whether code is a valid code from the User's authenticator app, or one of their recovery
+// codes. Either way, a code is only accepted once.
+func (s *server) checkSecondFactor(r *http.Request, tf database.TwoFactor, code string) (bool, error) {
+	if ok, err := s.checkTOTP(r, tf, code); ok || err != nil {
+		return ok, err
+	}
+	used, err := s.unscoped(r).UseRecoveryCode(tf.UserID, hashToken(normalizeRecoveryCode(code)))
+	if used {
+		s.audit(r, "user.2fa_recovery_code", tf.UserID, "")
+		s.securityEvent(r, eventRecoveryCodeUsed, tf.UserID, "")
+	}
+	return used, err
+}
+
+// checkTOTP reports whether code is a valid code from the User's authenticator app, that hasn't been used before.
+func (s *server) checkTOTP(r *http.Request, tf database.TwoFactor, code string) (bool, error) {
+	secret, err := s.encrypter.Open(tf.EncryptedSecret)
+	if err != nil {
+		return false, errs.Wrap(err, "checkTOTP")
+	}
+	step, ok := totp.Check(string(secret), strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	return s.unscoped(r).UseTwoFactorStep(tf.UserID, step)
+}
+
+// newRecoveryCodes generates a new set of recovery codes, returning them along with their hashes for storage. Like
+// our other tokens, only the hashes are stored.
+func newRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		// 80 random bits make a 16 character code, split in two to make it easier to copy out
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes = append(codes, code[:8]+"-"+code[8:])
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode strips the formatting from a recovery code, so it's accepted however the User types it.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,72 @@
+// username checks the usernames Users choose. A username is how a User is addressed in our routes (such as
+// /users/{username}/email) and shown to other Users, so unlike an email it's public, and it needs to be safe to put in a
+// URL and hard to use for impersonation.
+//
+// Usernames are case insensitive, they're stored lowercased so Jane and jane can't belong to two different Users.
+package username
+
+import (
+	"examples/errs"
+	"fmt"
+	"strings"
+)
+
+// Limits on a username's length
+const (
+	MinLength = 3
+	MaxLength = 30
+)
+
+// reserved lists usernames nobody may take. Some would clash with our own routes (e.g. /users/search), others could be
+// used to pass yourself off as staff.
+var reserved = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"all":           true,
+	"api":           true,
+	"help":          true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"moderator":     true,
+	"null":          true,
+	"password":      true,
+	"root":          true,
+	"search":        true,
+	"security":      true,
+	"self":          true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// Normalize returns the form a username is stored and looked up in.
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Validate checks a normalized username meets our rules, returning an Invalid error describing the problem if not.
+// Usernames are made of lowercase letters, digits, and the separators '.', '_' and '-', and must start and end with a
+// letter or digit. Notably they can never contain an '@', so a username can't be mistaken for an email.
+func Validate(name string) error {
+	if len(name) < MinLength || len(name) > MaxLength {
+		return errs.New(errs.Invalid, fmt.Sprintf("username must be between %d and %d characters", MinLength, MaxLength))
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '.' || c == '_' || c == '-') && i > 0 && i < len(name)-1:
+		default:
+			return errs.New(errs.Invalid, "username may only contain letters, digits, and '.', '_' or '-' between them")
+		}
+	}
+	// All digits would look like a User ID
+	if strings.Trim(name, "0123456789") == "" {
+		return errs.New(errs.Invalid, "username must contain a letter")
+	}
+	if reserved[name] {
+		return errs.New(errs.Invalid, "that username is reserved")
+	}
+	return nil
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"examples/password"
+	"examples/requestctx"
+	"examples/username"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Handlers for our Users API live here. Each is a method on server so it has access to all our dependencies.
+
+// userResponse is how we describe a User to clients. It's kept separate from database.User so fields like the password
+// hash can never be sent back by accident.
+type userResponse struct {
+	ID            int64  `json:"id"`
+	Username      string `json:"username,omitempty"` // Omitted until the User chooses one
+	First         string `json:"first"`
+	Last          string `json:"last"`
+	Email         string `json:"email"`
+	Role          string `json:"role"` // "user" or "admin"
+	EmailVerified bool   `json:"emailVerified" since:"1.6.0"`
+}
+
+// newUserResponse describes a User for clients.
+func newUserResponse(user database.User) userResponse {
+	return userResponse{
+		ID:            user.ID,
+		Username:      user.Username,
+		First:         user.First,
+		Last:          user.Last,
+		Email:         user.Email,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+// userInfoSelf returns the User record of whoever is currently logged in. Our auth middleware has already loaded them,
+// so there's no need to go back to the database.
+func (s *server) userInfoSelf(w http.ResponseWriter, r *http.Request) {
+	user, ok := requestctx.User(r.Context())
+	if !ok {
+		s.writeError(w, r, errs.New(errs.Unauthorized, "not logged in"))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, newUserResponse(user))
+}
+
+// userAddRequest is the body expected when creating a User.
+type userAddRequest struct {
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"` // Optional, Users can choose one later
+	Password string `json:"password"`
+}
+
+// userAdd creates a new User who logs in with a password.
+func (s *server) userAdd(w http.ResponseWriter, r *http.Request) {
+	var req userAddRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	email, err := s.emails.Validate(r.Context(), req.Email)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	req.Email = email
+	req.Username = username.Normalize(req.Username)
+	if req.Username != "" {
+		if err := username.Validate(req.Username); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	if err := password.Validate(req.Password); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.emailAvailable(r, req.Email); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	user := database.User{First: req.First, Last: req.Last, Email: req.Email, Username: req.Username}
+	if err := password.SetPassword(&user, req.Password); err != nil {
+		s.writeError(w, r, errs.Wrap(err, "userAdd"))
+		return
+	}
+	// emailAvailable catches most duplicates, but another request can take the email between it and here, in which case
+	// our database refuses it with the same ErrEmailTaken (and so the same 409)
+	if err := s.unscoped(r).CreateUser(&user); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "user.create", user.ID, "")
+	s.publish(r, eventUserCreated, user.ID, newUserResponse(user))
+	// The User can ask for another link if this one doesn't arrive, so it's not worth failing the request over
+	if err := s.sendEmailVerification(r, user); err != nil {
+		s.logger.Printf("ERROR: Unable to send email verification for user %d: %v", user.ID, err)
+	}
+	s.writeJSON(w, r, http.StatusCreated, newUserResponse(user))
+}
+
+// Limits on how many Users are listed at once
+const (
+	defaultUserPage = 50
+	maxUserPage     = 500
+
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+	maxSearchLength      = 100 // Characters, longer than any name or email worth searching for
+)
+
+// usersPageResponse is a page of Users, see listUsers.
+type usersPageResponse struct {
+	Users []userResponse `json:"users"`
+	Total int            `json:"total"`          // How many Users there are in all, not just on this page
+	Next  int64          `json:"next,omitempty"` // Pass as ?after= for the next page, omitted on the last page
+}
+
+// listUsers lists a page of Users in ID order, for admin UIs to browse everyone. Pass ?after= with the next value from
+// the page before to carry on from there, and ?limit= for how many to list at once (up to 500). Paging by ID rather
+// than by offset means Users created or deleted while paging don't shift the pages, so nobody is skipped or listed
+// twice, and the total is only a guide to how far through we are.
+func (s *server) listUsers(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			s.writeError(w, r, errs.New(errs.Invalid, "after must be a user ID"))
+			return
+		}
+	}
+	limit := defaultUserPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxUserPage {
+			s.writeError(w, r, errs.New(errs.Invalid, "limit must be between 1 and 500"))
+			return
+		}
+	}
+
+	// Ask for one more than we'll list, so we know whether there's another page
+	users, err := s.dbFor(r).ListUsers(after, limit+1)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	total, err := s.dbFor(r).CountUsers()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := usersPageResponse{Users: make([]userResponse, 0, min(len(users), limit)), Total: total}
+	if len(users) > limit {
+		users = users[:limit]
+		resp.Next = users[limit-1].ID
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, newUserResponse(user))
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// userSearch lists the Users whose first name, last name or email contains the {name} path parameter, ignoring case,
+// such as for a picker suggesting Users as a name is typed. Users with one starting with it come first, the closest
+// matches for what's been typed so far. Pass ?limit= for how many to list (up to 100). Only Users the caller is
+// allowed to see are listed (see dbFor).
+func (s *server) userSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(mux.Vars(r)["name"])
+	if query == "" || utf8.RuneCountInString(query) > maxSearchLength {
+		s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("search must be between 1 and %d characters", maxSearchLength)))
+		return
+	}
+	limit := defaultSearchResults
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxSearchResults {
+			s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("limit must be between 1 and %d", maxSearchResults)))
+			return
+		}
+	}
+
+	// Our scoped Storer narrows this down to the Users the caller may see, see dbFor
+	users, err := s.dbFor(r).SearchUsers(query, database.UserScope{}, limit)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]userResponse, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, newUserResponse(user))
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// userByUsername loads the User named by the {username} path parameter from the given store. Handlers on our public API
+// should pass s.dbFor(r), so users outside the caller's dealerships aren't found.
+func userByUsername(db database.Storer, r *http.Request) (database.User, error) {
+	return userByName(db, mux.Vars(r)["username"])
+}
+
+// userByName loads a User by their username. Before Users had usernames they were identified by their email in our
+// routes, and Users who haven't chosen a username yet still are, so anything with an '@' (which usernames can't
+// contain) is looked up as an email.
+func userByName(db database.Storer, name string) (database.User, error) {
+	if strings.Contains(name, "@") {
+		return db.GetUserByEmail(name)
+	}
+	return db.GetUserByUsername(username.Normalize(name))
+}
+
+// usernameChangeRequest is the body expected when changing a User's username.
+type usernameChangeRequest struct {
+	Username string `json:"username"`
+}
+
+// usernameChangeResponse describes one change a User made to their username.
+type usernameChangeResponse struct {
+	Old     string    `json:"old,omitempty"` // Omitted for the User's first username
+	New     string    `json:"new"`
+	Changed time.Time `json:"changed"`
+}
+
+// userUsername changes a User's username, which Users may only do for themselves. Their old username stays reserved for
+// them, so nobody else can pick it up and pretend to be them.
+func (s *server) userUsername(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if self, _ := requestctx.User(r.Context()); self.ID != user.ID {
+		s.writeError(w, r, errs.New(errs.Forbidden, "you may only change your own username"))
+		return
+	}
+
+	var req usernameChangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	name := username.Normalize(req.Username)
+	if err := username.Validate(name); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.dbFor(r).ChangeUsername(user.ID, name); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.username", user.ID, fmt.Sprintf("%q to %q", user.Username, name))
+	s.publishUser(r, eventUserUsernameChanged, user.ID)
+	user.Username = name
+	s.writeJSON(w, r, http.StatusOK, newUserResponse(user))
+}
+
+// userUsernameHistory lists the changes a User has made to their username, for anyone who can see the User. As old
+// usernames are reserved, this helps anyone who's followed an old link work out who it was for.
+func (s *server) userUsernameHistory(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	changes, err := s.dbFor(r).UsernameHistory(user.ID)
+	if err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	resp := make([]usernameChangeResponse, 0, len(changes))
+	for _, change := range changes {
+		resp = append(resp, usernameChangeResponse{Old: change.Old, New: change.New, Changed: change.Changed})
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// userUpdateRequest is the body expected when updating a User. As with any PUT, every field is replaced, so send the
+// User's current email to leave it as it is.
+type userUpdateRequest struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Email string `json:"email"`
+}
+
+// userUpdate changes a User's name and email. Users may change their own name, and anyone allowed to change other Users
+// (admins) may change anyone's name and email. Users change their own email with userEmail instead, which proves they
+// own the new address first, so here they must leave it as it is. Admins are trusted to have checked a new address
+// themselves, so their changes apply straight away, and the old address is told about it just as when a User confirms
+// a change of their own.
+func (s *server) userUpdate(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.dbFor(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	manager, err := s.hasPermission(r, permUsersWrite)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if self, _ := requestctx.User(r.Context()); self.ID != user.ID && !manager {
+		s.writeError(w, r, errs.New(errs.Forbidden, "you may only update your own details"))
+		return
+	}
+
+	var req userUpdateRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	updated := user
+	updated.First, updated.Last = strings.TrimSpace(req.First), strings.TrimSpace(req.Last)
+	if updated.First == "" || updated.Last == "" {
+		s.writeError(w, r, errs.New(errs.Invalid, "first and last name are required"))
+		return
+	}
+	email, err := s.emails.Validate(r.Context(), req.Email)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	updated.Email = email
+	emailChanged := updated.Email != user.Email
+	if emailChanged {
+		if !manager {
+			s.writeError(w, r, errs.New(errs.Forbidden, "change your own email with PUT /users/{username}/email, which confirms the new address"))
+			return
+		}
+		if err := s.emailAvailable(r, updated.Email); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	nameChanged := updated.First != user.First || updated.Last != user.Last
+	if !nameChanged && !emailChanged {
+		s.writeJSON(w, r, http.StatusOK, newUserResponse(user))
+		return
+	}
+
+	if err := s.dbFor(r).UpdateUser(&updated); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	var changes []string
+	if nameChanged {
+		changes = append(changes, fmt.Sprintf("name %q to %q", user.First+" "+user.Last, updated.First+" "+updated.Last))
+		s.publishUser(r, eventUserNameChanged, user.ID)
+	}
+	if emailChanged {
+		changes = append(changes, fmt.Sprintf("email %q to %q", user.Email, updated.Email))
+		s.publishUser(r, eventUserEmailChanged, user.ID)
+		if err := s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+			To:      user.Email,
+			Subject: "Your email has been changed",
+			Body: fmt.Sprintf("The email on your account has been changed to %s by an administrator.\n\n"+
+				"If you weren't expecting this, please contact support immediately.", updated.Email),
+		}); err != nil {
+			s.logger.Printf("ERROR: Unable to notify old address of email change for user %d: %v", user.ID, err)
+		}
+	}
+	s.audit(r, "user.update", user.ID, strings.Join(changes, ", "))
+	s.writeJSON(w, r, http.StatusOK, newUserResponse(updated))
+}
+
+// userEnable enables a User, allowing them to log in again.
+func (s *server) userEnable(w http.ResponseWriter, r *http.Request) {
+	s.setUserEnabled(w, r, true)
+}
+
+// userDisable disables a User. They won't be able to log in, and any sessions they already have stop working
+// immediately, as our auth middleware checks this on every request.
+func (s *server) userDisable(w http.ResponseWriter, r *http.Request) {
+	s.setUserEnabled(w, r, false)
+}
+
+// setUserEnabled is shared by userEnable and userDisable, as the only difference between them is the value being set.
+func (s *server) setUserEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	user, err := userByUsername(s.unscoped(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.unscoped(r).SetUserEnabled(user.ID, enabled); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if enabled {
+		s.publishUser(r, eventUserEnabled, user.ID)
+	} else {
+		s.publishUser(r, eventUserDisabled, user.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userPromote makes a User an admin.
+func (s *server) userPromote(w http.ResponseWriter, r *http.Request) {
+	s.setUserRole(w, r, database.RoleAdmin)
+}
+
+// userDemote makes an admin a regular User again. Admins can't demote themselves, so there's always someone left who
+// can manage admins (ask another admin, or use our admin listener).
+func (s *server) userDemote(w http.ResponseWriter, r *http.Request) {
+	s.setUserRole(w, r, database.RoleUser)
+}
+
+// setUserRole is shared by userPromote and userDemote, as the only difference between them is the role being set. It's
+// served both on our public API to admins, and on our admin listener, which is how the first admin gets promoted.
+func (s *server) setUserRole(w http.ResponseWriter, r *http.Request, role string) {
+	user, err := userByUsername(s.unscoped(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if self, ok := requestctx.User(r.Context()); ok && self.ID == user.ID && role != database.RoleAdmin {
+		s.writeError(w, r, errs.New(errs.Forbidden, "you can't remove your own admin role, ask another admin"))
+		return
+	}
+	if err := s.unscoped(r).SetUserRole(user.ID, role); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.role", user.ID, fmt.Sprintf("%q to %q", user.Role, role))
+	s.securityEvent(r, eventRoleChanged, user.ID, fmt.Sprintf("%q to %q", user.Role, role))
+	s.publishUser(r, eventUserRoleChanged, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userUnlock unlocks a User who was locked out after too many failed logins, letting them log in again.
+func (s *server) userUnlock(w http.ResponseWriter, r *http.Request) {
+	user, err := userByUsername(s.unscoped(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := s.unscoped(r).UnlockUser(user.ID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	s.audit(r, "user.unlock", user.ID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userAddToDealership makes a User a member of the dealership in the {cid} path parameter.
+func (s *server) userAddToDealership(w http.ResponseWriter, r *http.Request) {
+	s.setDealershipMember(w, r, s.unscoped(r).AddUserToDealership, eventDealershipJoined)
+}
+
+// userRemoveFromDealership removes a User from the dealership in the {cid} path parameter. They'll no longer be able to
+// see the other members of that dealership, or be seen by them.
+func (s *server) userRemoveFromDealership(w http.ResponseWriter, r *http.Request) {
+	s.setDealershipMember(w, r, s.unscoped(r).RemoveUserFromDealership, eventDealershipLeft)
+}
+
+// setDealershipMember is shared by userAddToDealership and userRemoveFromDealership, which only differ in which change
+// they make to the User's memberships, and the domain event recording it.
+func (s *server) setDealershipMember(w http.ResponseWriter, r *http.Request, change func(userID, dealershipID int64) error, kind string) {
+	dealershipID, err := strconv.ParseInt(mux.Vars(r)["cid"], 10, 64)
+	if err != nil || dealershipID <= 0 {
+		s.writeError(w, r, errs.New(errs.Invalid, "dealership ID must be a positive number"))
+		return
+	}
+	user, err := userByUsername(s.unscoped(r), r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if err := change(user.ID, dealershipID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	// Which tenants' settings apply to the User has changed
+	s.tenants.ForgetUser(user.ID)
+	s.publish(r, kind, user.ID, dealershipMemberEvent{UserID: user.ID, DealershipID: dealershipID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userMerge merges the User named by the {b} path parameter into the User named by {a}, deleting {b}. See MergeUsers
+// for how conflicts between the two are resolved.
+func (s *server) userMerge(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	keep, err := userByName(s.unscoped(r), vars["a"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	merge, err := userByName(s.unscoped(r), vars["b"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if keep.ID == merge.ID {
+		s.writeError(w, r, errs.New(errs.Invalid, "can't merge a user into themselves"))
+		return
+	}
+	if err := s.unscoped(r).MergeUsers(keep.ID, merge.ID); err != nil {
+		s.writeError(w, r, errs.WithUser(err, keep.ID))
+		return
+	}
+	// The kept User now has the merged User's dealership memberships too
+	s.tenants.ForgetUser(keep.ID)
+	// The merged User no longer exists, so record who they were
+	s.audit(r, "user.merge", keep.ID, fmt.Sprintf("merged user %d (%s)", merge.ID, merge.Email))
+	s.publish(r, eventUserMerged, merge.ID, userMergedEvent{ID: merge.ID, Into: keep.ID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"examples/errs"
+	"net/http"
+	"testing"
+)
+
+// TestUserAddEmailTaken checks adding a User with an email that only differs in case from an existing User's is
+// refused with a 409 and our structured conflict error, rather than a 500 from the database.
+func TestUserAddEmailTaken(t *testing.T) {
+	handler := newTestServer(t).adminRoutes()
+
+	w := serve(handler, testAdminToken, http.MethodPost, "/admin/users/",
+		`{"first": "Dup", "last": "One", "email": "Dup@Example.com", "password": "correct horse battery"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("adding first user: got %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+
+	w = serve(handler, testAdminToken, http.MethodPost, "/admin/users/",
+		`{"first": "Dup", "last": "Two", "email": "dup@example.com", "password": "correct horse battery"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("adding second user: got %d %s, want %d", w.Code, w.Body, http.StatusConflict)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding error response %s: %v", w.Body, err)
+	}
+	if resp.Error.Code != errs.Conflict {
+		t.Errorf("got error code %q, want %q", resp.Error.Code, errs.Conflict)
+	}
+}
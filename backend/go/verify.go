@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"examples/clock"
+	"examples/database"
+	"examples/errs"
+	"examples/mailer"
+	"examples/requestctx"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// emailVerificationLifetime is how long a new User has to follow the link verifying their email. They can ask for
+// another once it's expired.
+const emailVerificationLifetime = 24 * time.Hour
+
+// sendEmailVerification emails a User a link to verify their email, replacing any link sent before.
+func (s *server) sendEmailVerification(r *http.Request, user database.User) error {
+	token, hash, err := newToken()
+	if err != nil {
+		return errs.Wrap(err, "sendEmailVerification")
+	}
+	verification := database.EmailVerification{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Expires:   clock.Now().Add(emailVerificationLifetime),
+	}
+	if err := s.unscoped(r).CreateEmailVerification(&verification); err != nil {
+		return errs.WithUser(err, user.ID)
+	}
+	return s.jobs.Enqueue(r.Context(), emailJob, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Welcome! To finish setting up your account, please verify your email.\n\n"+
+			"Visit %s/verify/%s within the next 24 hours.\n\n"+
+			"If you didn't expect this, you can safely ignore this email.", s.frontendURL, token),
+	})
+}
+
+// resendEmailVerification sends the logged in User another link to verify their email, such as when the first has
+// expired or gone missing.
+func (s *server) resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestctx.User(r.Context())
+	if user.EmailVerified {
+		s.writeError(w, r, errs.New(errs.Conflict, "your email is already verified"))
+		return
+	}
+	if err := s.sendEmailVerification(r, user); err != nil {
+		s.writeError(w, r, errs.WithUser(err, user.ID))
+		return
+	}
+	// 202 Accepted, as nothing changes until the User follows the link
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyEmail marks a User's email as verified, using the token from the link we emailed them. Following the link is
+// all it takes, so it doesn't need a session, and works from whichever device they read their email on.
+func (s *server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	verification, err := s.unscoped(r).VerifyEmail(hashToken(mux.Vars(r)["token"]))
+	if errors.Is(err, errs.NotFound) {
+		s.writeError(w, r, errs.New(errs.NotFound, "this link is invalid or has expired"))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.audit(r, "user.email_verified", verification.UserID, "")
+	s.publishUser(r, eventUserEmailVerified, verification.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireVerifiedEmail only lets Users who have verified their email use our routes, apart from the few marked in our
+// policy table as open to unverified Users (such as seeing their own account, and asking for another verification
+// link). It runs after authorize, which has already checked the route has a policy.
+func (s *server) requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := requestctx.User(r.Context())
+		if user.EmailVerified {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := mux.CurrentRoute(r).GetPathTemplate()
+		if err != nil {
+			s.writeError(w, r, errs.Wrap(err, "requireVerifiedEmail"))
+			return
+		}
+		if !policies[routeKey{r.Method, path}].unverified {
+			s.writeError(w, r, errs.New(errs.Forbidden, "please verify your email first, we've sent you a link"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
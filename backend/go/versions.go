@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"examples/errs"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// apiVersionHeader lets a client pin the shape of our responses to a release of our API (see changelog.go), such as
+// the release it was last tested against. We echo back the version we responded as. Without it, clients get the latest.
+const apiVersionHeader = "API-Version"
+
+// latestVersion is our newest release, the newest version in our changelog.
+var latestVersion = func() string {
+	latest := "1.0.0"
+	for _, entry := range changelog {
+		if compareVersions(entry.Version, latest) > 0 {
+			latest = entry.Version
+		}
+	}
+	return latest
+}()
+
+// negotiateVersion checks the version a client asked for (if any) is one we've released, so writeJSON can shape its
+// response to match. Older clients keep working as fields are added to our responses, because fields are only ever
+// added with a `since` tag naming the release that added them (see forVersion).
+func (s *server) negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get(apiVersionHeader)
+		if version != "" && (!validVersion(version) || compareVersions(version, latestVersion) > 0) {
+			s.writeError(w, r, errs.New(errs.Invalid, fmt.Sprintf("%s must be one of our releases, up to %s", apiVersionHeader, latestVersion)))
+			return
+		}
+		w.Header().Set(apiVersionHeader, requestedVersion(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestedVersion returns the API version a client asked for, already checked by negotiateVersion, or our latest.
+func requestedVersion(r *http.Request) string {
+	if version := r.Header.Get(apiVersionHeader); version != "" && validVersion(version) {
+		return version
+	}
+	return latestVersion
+}
+
+// forVersion returns v as a client pinned to an earlier release expects it, leaving out any field tagged as added
+// since then, such as:
+//
+//	EmailVerified bool `json:"emailVerified" since:"1.6.0"`
+//
+// Structs are rebuilt as maps following their json tags, looking into pointers, slices, maps and nested structs, while
+// anything that encodes itself (such as time.Time) is kept as it is. Responses for our latest release are returned
+// untouched.
+func forVersion(v any, version string) any {
+	if compareVersions(version, latestVersion) >= 0 {
+		return v
+	}
+	return shapeValue(reflect.ValueOf(v), version)
+}
+
+// marshalerType is used to spot values that encode themselves, so forVersion leaves them be.
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// shapeValue does the work of forVersion.
+func shapeValue(v reflect.Value, version string) any {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(marshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return shapeValue(v.Elem(), version)
+	case reflect.Slice:
+		// Byte slices are encoded as base64 strings, so aren't looked into
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = shapeValue(v.Index(i), version)
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		items := make(map[string]any, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			items[iter.Key().String()] = shapeValue(iter.Value(), version)
+		}
+		return items
+	case reflect.Struct:
+		fields := make(map[string]any, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if since := field.Tag.Get("since"); since != "" && compareVersions(since, version) > 0 {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if strings.Contains(opts, "omitempty") && isEmpty(v.Field(i)) {
+				continue
+			}
+			fields[name] = shapeValue(v.Field(i), version)
+		}
+		return fields
+	}
+	return v.Interface()
+}
+
+// isEmpty reports whether encoding/json counts a value as empty, for omitempty. Unlike reflect's IsZero, structs are
+// never empty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"examples/errs"
+	"time"
+)
+
+// poolWarmer opens database connections ahead of time, such as *sql.DB.
+type poolWarmer interface {
+	Warm(ctx context.Context, n int) error
+}
+
+// WarmUp describes what we warm up when we start, see warm.
+type WarmUp struct {
+	Timeout     time.Duration // Longest we spend warming up before reporting ready anyway, zero to not warm up at all
+	Pool        poolWarmer    // Our pool of database connections, nil to leave connections to be opened as needed
+	Connections int           // How many database connections to open, no more than our pool keeps idle is useful
+	Users       int           // Most Users with live sessions to load, along with their tenants' settings
+}
+
+// warmUpPageSize is how many sessions we read at a time, looking for Users to load
+const warmUpPageSize = 500
+
+// warm gets us ready for traffic straight after starting, so the first requests after a deploy aren't slower than
+// the rest: database connections are opened, the Users most likely to make those requests (those with live sessions)
+// are loaded along with their tenants' settings, and our schemas are generated. Our readiness checks only start once
+// it's done, so we aren't sent traffic until then. Warming up is only an optimisation, so anything failing along the
+// way is logged and skipped, and we give up on the rest once WarmUp.Timeout has passed.
+func (s *server) warm(ctx context.Context) {
+	if !s.warming.Load() {
+		return
+	}
+	defer s.warming.Store(false)
+	ctx, cancel := context.WithTimeout(ctx, s.warmUp.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	steps := []struct {
+		name string
+		fn   func(ctx context.Context) error
+	}{
+		{"schemas", s.warmSchemas},
+		{"database connections", s.warmConnections},
+		{"users", s.warmUsers},
+	}
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			s.logger.Printf("WARNING: Warming up took longer than %s, skipping %s", s.warmUp.Timeout, step.name)
+			continue
+		}
+		stepStart := time.Now()
+		if err := step.fn(ctx); err != nil {
+			s.logger.Printf("WARNING: Unable to warm up %s: %v", step.name, err)
+			continue
+		}
+		s.logger.Printf("INFO: Warmed up %s in %s", step.name, time.Since(stepStart).Round(time.Millisecond))
+	}
+	s.logger.Printf("INFO: Finished warming up in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// warmSchemas generates each of our schemas, which requests are validated against.
+func (s *server) warmSchemas(ctx context.Context) error {
+	for name := range schemaTypes {
+		schemaFor(name)
+	}
+	return nil
+}
+
+// warmConnections opens our database connections.
+func (s *server) warmConnections(ctx context.Context) error {
+	if s.warmUp.Pool == nil || s.warmUp.Connections <= 0 {
+		return nil
+	}
+	return s.warmUp.Pool.Warm(ctx, s.warmUp.Connections)
+}
+
+// warmUsers loads the Users with live sessions, up to WarmUp.Users of them, along with the settings of their tenants.
+// Loading them fills our caches (see usercache and tenants), and our database's.
+func (s *server) warmUsers(ctx context.Context) error {
+	seen := make(map[int64]bool)
+	var after int64
+	for len(seen) < s.warmUp.Users {
+		sessions, err := s.db.ListSessionsAfter(after, warmUpPageSize)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if seen[session.UserID] || len(seen) >= s.warmUp.Users {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			seen[session.UserID] = true
+			// A User may have been deleted since, which is no reason to stop
+			if _, err := s.db.GetUserByID(session.UserID); err != nil && !errors.Is(err, errs.NotFound) {
+				return err
+			}
+			if _, err := s.tenants.SessionLifespans(session.UserID); err != nil {
+				return err
+			}
+		}
+		if len(sessions) < warmUpPageSize {
+			break
+		}
+		after = sessions[len(sessions)-1].ID
+	}
+	return nil
+}